@@ -4,21 +4,26 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/utils"
 )
 
 const accessLogFilePerm = 0600
 
+// the suffix appended to the rotated access logs
+const accessLogRotatedSuffix = "2006-01-02T15-04-05.000"
+
 // open an access log with the appropriate permissions on the file
 // if it isn't open yet. Return the already open otherwise
-func (a accessLogs) openAccessLog(file string) (io.Writer, error) {
+func (a accessLogs) openAccessLog(files *accessLogFiles, file string) (io.Writer, error) {
 	if accessLog, ok := a[file]; ok {
 		return accessLog, nil
 	}
-	accessLog, err := os.OpenFile(
-		file,
-		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
-		accessLogFilePerm,
-	)
+	accessLog, err := files.open(file)
 	if err != nil {
 		return nil, fmt.Errorf("error opening access log `%s`- %s",
 			file, err)
@@ -29,3 +34,158 @@ func (a accessLogs) openAccessLog(file string) (io.Writer, error) {
 
 // helper type to facilitate not opening the same access_log twice
 type accessLogs map[string]io.Writer
+
+// accessLogFiles keeps the access logs open between reloads, so that the
+// requests which are still served with the old config do not write to closed
+// files and the rotation continues where it was.
+type accessLogFiles struct {
+	sync.Mutex
+	files map[string]*rotatingLog
+}
+
+func newAccessLogFiles() *accessLogFiles {
+	return &accessLogFiles{files: make(map[string]*rotatingLog)}
+}
+
+func (f *accessLogFiles) open(file string) (*rotatingLog, error) {
+	f.Lock()
+	defer f.Unlock()
+	if log, ok := f.files[file]; ok {
+		return log, nil
+	}
+	log, err := newRotatingLog(file)
+	if err != nil {
+		return nil, err
+	}
+	f.files[file] = log
+	return log, nil
+}
+
+// update applies the rotation settings to the access logs which are used and
+// closes the ones which are not used anymore.
+func (f *accessLogFiles) update(used accessLogs, rotation config.AccessLogRotation) error {
+	f.Lock()
+	defer f.Unlock()
+	var errs []error
+	for file, log := range f.files {
+		if _, ok := used[file]; ok {
+			log.setRotation(rotation)
+			continue
+		}
+		if err := log.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(f.files, file)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error closing unused access logs: %v", errs)
+	}
+	return nil
+}
+
+// rotatingLog is an access log file which is renamed with the time of its
+// rotation as a suffix and reopened when it grows larger than its maximum
+// size or its rotation interval elapses. It is safe for concurrent use.
+type rotatingLog struct {
+	sync.Mutex
+	path     string
+	file     *os.File
+	size     uint64
+	opened   time.Time
+	maxSize  uint64
+	interval time.Duration
+	now      func() time.Time
+}
+
+func newRotatingLog(path string) (*rotatingLog, error) {
+	var log = &rotatingLog{path: path, now: time.Now}
+	if err := log.open(); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+func (l *rotatingLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, accessLogFilePerm)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.size, l.opened = file, uint64(st.Size()), l.now()
+	return nil
+}
+
+func (l *rotatingLog) setRotation(rotation config.AccessLogRotation) {
+	l.Lock()
+	defer l.Unlock()
+	l.maxSize = rotation.MaxSize.Bytes()
+	l.interval = time.Duration(rotation.Interval) * time.Second
+}
+
+// Write writes to the current file, rotating it first if it is due. The
+// entry is written even if the rotation fails.
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	var rotateErr error
+	if l.shouldRotate(uint64(len(p))) {
+		rotateErr = l.rotate()
+	}
+	n, err := l.file.Write(p)
+	l.size += uint64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (l *rotatingLog) shouldRotate(toWrite uint64) bool {
+	if l.size == 0 {
+		return false // nothing to rotate
+	}
+	if l.maxSize > 0 && l.size+toWrite > l.maxSize {
+		return true
+	}
+	return l.interval > 0 && l.now().Sub(l.opened) >= l.interval
+}
+
+// rotate renames the current file and opens a new one in its place. The
+// current file is closed only after the new one is opened, so if either of
+// them fails the logging continues in it.
+func (l *rotatingLog) rotate() error {
+	var rotated = l.rotatedPath()
+	if err := os.Rename(l.path, rotated); err != nil {
+		l.opened = l.now() // the rotation is not attempted on every write
+		return err
+	}
+	var old = l.file
+	if err := l.open(); err != nil {
+		l.opened = l.now()
+		return utils.NewCompositeError(err, os.Rename(rotated, l.path))
+	}
+	return old.Close()
+}
+
+// rotatedPath returns a path for the rotated log which is not used by the
+// previous rotations, even if they were at the same time.
+func (l *rotatingLog) rotatedPath() string {
+	var path = l.path + "." + l.now().Format(accessLogRotatedSuffix)
+	var candidate = path
+	for i := 1; ; i++ {
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = path + "." + strconv.Itoa(i)
+	}
+}
+
+// Close closes the current file.
+func (l *rotatingLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
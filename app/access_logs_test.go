@@ -0,0 +1,153 @@
+package app
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+// readLogs returns the contents of the current and the rotated logs, in the
+// order of their rotation.
+func readLogs(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "access.log*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the current log sorts before the rotated ones
+	files = append(files[1:], files[0])
+	var contents = make([]string, 0, len(files))
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(b))
+	}
+	return contents
+}
+
+func TestAccessLogRotationBySize(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var now = time.Unix(1500000000, 0)
+
+	files := newAccessLogFiles()
+	log, err := files.open(filepath.Join(dir, "access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.now = func() time.Time { now = now.Add(time.Second); return now }
+	if err := files.update(accessLogs{log.path: log}, config.AccessLogRotation{MaxSize: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"1234\n", "5678\n", "abcd\n", "efgh\n", "ijklmnopqrst\n", "u\n"} {
+		if _, err := log.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var expected = []string{"1234\n5678\n", "abcd\nefgh\n", "ijklmnopqrst\n", "u\n"}
+	if logs := readLogs(t, dir); strings.Join(logs, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected logs %q but got %q", expected, logs)
+	}
+}
+
+func TestAccessLogRotationByTime(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var now = time.Unix(1500000000, 0)
+
+	files := newAccessLogFiles()
+	log, err := files.open(filepath.Join(dir, "access.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.now = func() time.Time { return now }
+	log.opened = now
+	if err := files.update(accessLogs{log.path: log}, config.AccessLogRotation{Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range []time.Duration{0, 30, 29, 1, 61, 0} {
+		now = now.Add(step * time.Second)
+		if _, err := log.Write([]byte(now.Format("15:04:05\n"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var expected = []string{"02:40:00\n02:40:30\n02:40:59\n", "02:41:00\n", "02:42:01\n02:42:01\n"}
+	if logs := readLogs(t, dir); strings.Join(logs, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected logs %q but got %q", expected, logs)
+	}
+}
+
+func TestAccessLogsSurviveReload(t *testing.T) {
+	t.Parallel()
+	dir, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var file1, file2 = filepath.Join(dir, "access.log"), filepath.Join(dir, "other.log")
+
+	files := newAccessLogFiles()
+	var logs = accessLogs{"": nil}
+	log1, err := logs.openAccessLog(files, file1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logs.openAccessLog(files, file2); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.update(logs, config.AccessLogRotation{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the reloaded config uses only the first log
+	var reloaded = accessLogs{"": nil}
+	log1Reloaded, err := reloaded.openAccessLog(files, file1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log1Reloaded != log1 {
+		t.Error("Expected the same access log to be used after the reload")
+	}
+	if err := files.update(reloaded, config.AccessLogRotation{MaxSize: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files.files[file2]; ok {
+		t.Error("Expected the unused access log to be closed")
+	}
+	if log1.(*rotatingLog).maxSize != 100 {
+		t.Error("Expected the new rotation settings to be applied")
+	}
+
+	// concurrent writes from the requests are rotated safely
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := log1.Write([]byte("0123456789\n")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	var total int
+	for _, contents := range readLogs(t, dir) {
+		if len(contents) > 100 {
+			t.Errorf("A log with size %d is larger than the maximum", len(contents))
+		}
+		total += strings.Count(contents, "0123456789\n")
+	}
+	if total != 500 {
+		t.Errorf("Expected 500 entries in the logs but there are %d", total)
+	}
+}
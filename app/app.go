@@ -6,6 +6,7 @@ package app
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
@@ -19,6 +20,8 @@ import (
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/contexts"
 	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/upstream"
+	"github.com/ironsmile/nedomi/utils/memutils"
 	"github.com/ironsmile/nedomi/utils/netutils"
 )
 
@@ -69,6 +72,14 @@ type Application struct {
 	version types.AppVersion
 
 	conns *connections
+
+	// Watches the memory usage and tells whether the app should degrade
+	memory *memutils.Monitor
+
+	// The access log files which are kept open between reloads and the
+	// ones used by the current config
+	accessLogFiles *accessLogFiles
+	accessLogs     accessLogs
 }
 
 func (a *Application) copy() (app *Application) {
@@ -87,6 +98,9 @@ func (a *Application) copy() (app *Application) {
 		started:              a.started,
 		version:              a.version,
 		conns:                a.conns,
+		memory:               a.memory,
+		accessLogFiles:       a.accessLogFiles,
+		accessLogs:           a.accessLogs,
 	}
 	app.SetLogger(a.GetLogger())
 	return
@@ -97,6 +111,65 @@ func (a *Application) Stats() types.AppStats {
 	return (types.AppStats)(*a.stats)
 }
 
+// MemoryStats returns the memory usage of the application and whether it is
+// degraded because of memory pressure
+func (a *Application) MemoryStats() types.MemoryStats {
+	var used, limit, degraded = a.memory.Stats()
+	return types.MemoryStats{
+		Used:     used,
+		Limit:    limit,
+		Degraded: degraded,
+	}
+}
+
+// UpstreamsHealth returns the health of the addresses of all upstreams with
+// active health checks by their IDs
+func (a *Application) UpstreamsHealth() map[string][]types.UpstreamAddressHealth {
+	a.RLock()
+	defer a.RUnlock()
+	var result = make(map[string][]types.UpstreamAddressHealth)
+	for id, up := range a.upstreams {
+		if up, ok := up.(*upstream.Upstream); ok && up != nil {
+			if health := up.Health(); health != nil {
+				result[id] = health
+			}
+		}
+	}
+	return result
+}
+
+// UpstreamsConnections returns the numbers of requests in flight and waiting
+// for the addresses of all upstreams with a connection limit by their IDs
+func (a *Application) UpstreamsConnections() map[string][]types.UpstreamAddressConnections {
+	a.RLock()
+	defer a.RUnlock()
+	var result = make(map[string][]types.UpstreamAddressConnections)
+	for id, up := range a.upstreams {
+		if up, ok := up.(*upstream.Upstream); ok && up != nil {
+			if connections := up.Connections(); connections != nil {
+				result[id] = connections
+			}
+		}
+	}
+	return result
+}
+
+// UpstreamsLatency returns the distribution of the response times of all
+// upstreams which have responded by their IDs
+func (a *Application) UpstreamsLatency() map[string]types.UpstreamLatency {
+	a.RLock()
+	defer a.RUnlock()
+	var result = make(map[string]types.UpstreamLatency)
+	for id, up := range a.upstreams {
+		if up, ok := up.(*upstream.Upstream); ok && up != nil {
+			if latency := up.Latency(); latency.Requests > 0 {
+				result[id] = latency
+			}
+		}
+	}
+	return result
+}
+
 // Run fires up the application. And Blocks until it ends
 func (a *Application) Run() error {
 	if err := SetupEnv(a.cfg); err != nil {
@@ -111,6 +184,7 @@ func (a *Application) Run() error {
 		return err
 	}
 
+	go a.memory.Run(a.ctx)
 	go a.doServing()
 
 	a.GetLogger().Logf("Application %d started", os.Getpid())
@@ -143,6 +217,7 @@ func (a *Application) doServing() {
 			}
 		},
 	}
+	a.httpSrv.SetKeepAlivesEnabled(!a.cfg.HTTP.DisableKeepAlives)
 
 	err := a.listenAndServe()
 
@@ -171,17 +246,29 @@ func (a *Application) Stop() error {
 	}
 	err = process.Signal(syscall.SIGTERM)
 	<-a.finished
+	a.finishFills()
+	a.closeCacheZones()
 	a.ctxCancel()
 	return err
 }
 
 // Reload takse a new configuration and replaces the old one with it. After successful
-// reload the things that are written in the new config will be in use.
+// reload the things that are written in the new config will be in use. The new
+// config is validated before anything is replaced, so the old one stays in use
+// if it can't be loaded. The requests which are being served are not affected.
 func (a *Application) Reload(cfg *config.Config) error {
 	if err := a.checkConfigCouldBeReloaded(cfg); err != nil {
 		return err
 	}
-	return a.reinitFromConfig(cfg, false)
+	if err := a.reinitFromConfig(cfg, true); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
+	var old = a.cfg
+	if err := a.reinitFromConfig(cfg, false); err != nil {
+		return err
+	}
+	a.GetLogger().Logf("Config reloaded: %s", describeConfigChanges(old, cfg))
+	return nil
 }
 
 // Wait subscribes iteself to few signals and waits for any of them to be received.
@@ -199,7 +286,7 @@ func (a *Application) Wait() error {
 			}
 			err = a.Reload(newConfig)
 			if err != nil {
-				a.GetLogger().Errorf("Reloading failed: %s", err)
+				a.GetLogger().Errorf("Reloading failed, keeping the old config: %s", err)
 			}
 		} else {
 			a.GetLogger().Logf("Stopping %d: %s", os.Getpid(), sig)
@@ -221,13 +308,15 @@ func New(version types.AppVersion, configGetter config.Getter) (*Application, er
 		return nil, err
 	}
 	var a = &Application{
-		version:      version,
-		cfg:          cfg,
-		finished:     make(chan struct{}),
-		stats:        new(applicationStats),
-		configGetter: configGetter,
-		conns:        newConnections(),
-		cacheZones:   make(map[string]*types.CacheZone),
+		version:        version,
+		cfg:            cfg,
+		finished:       make(chan struct{}),
+		stats:          new(applicationStats),
+		configGetter:   configGetter,
+		conns:          newConnections(),
+		cacheZones:     make(map[string]*types.CacheZone),
+		memory:         memutils.NewMonitor(memutils.RuntimeUsage, 0, 0, 0),
+		accessLogFiles: newAccessLogFiles(),
 	}
 	a.ctx, a.ctxCancel = context.WithCancel(context.Background())
 	a.ctx = contexts.NewAppContext(a.ctx, a)
@@ -15,7 +15,6 @@ import (
 	"github.com/ironsmile/nedomi/storage"
 	"github.com/ironsmile/nedomi/types"
 	"github.com/ironsmile/nedomi/upstream"
-	"github.com/ironsmile/nedomi/utils"
 )
 
 func (a *Application) reinitFromConfigInplace(cfg *config.Config, testOnly bool) (toBeResized []string, err error) {
@@ -24,7 +23,7 @@ func (a *Application) reinitFromConfigInplace(cfg *config.Config, testOnly bool)
 	a.virtualHosts = make(map[string]*VirtualHost)
 	a.upstreams = make(map[string]types.Upstream)
 	a.cacheZones = make(map[string]*types.CacheZone)
-	logs := accessLogs{"": nil}
+	a.accessLogs = accessLogs{"": nil}
 	// Initialize the global logger
 	var l types.Logger
 	if l, err = logger.New(&a.cfg.Logger); err != nil {
@@ -46,20 +45,23 @@ func (a *Application) reinitFromConfigInplace(cfg *config.Config, testOnly bool)
 
 	// Initialize all advanced upstreams
 	for _, cfgUp := range a.cfg.HTTP.Upstreams {
-		if a.upstreams[cfgUp.ID], err = upstream.New(cfgUp, l); err != nil {
+		if a.upstreams[cfgUp.ID], err = upstream.New(a.ctx, cfgUp, l); err != nil {
 			return nil, err
 		}
 	}
 
 	a.notConfiguredHandler = newNotConfiguredHandler()
 	var accessLog io.Writer
-	if accessLog, err = logs.openAccessLog(a.cfg.HTTP.AccessLog); err != nil {
+	if accessLog, err = a.accessLogs.openAccessLog(a.accessLogFiles, a.cfg.HTTP.AccessLog); err != nil {
+		return nil, err
+	}
+	if a.notConfiguredHandler, err = loggingHandler(a.notConfiguredHandler, accessLog,
+		a.cfg.HTTP.AccessLogFormat, false, false); err != nil {
 		return nil, err
 	}
-	a.notConfiguredHandler, _ = loggingHandler(a.notConfiguredHandler, accessLog, false)
 	// Initialize all vhosts
 	for _, cfgVhost := range a.cfg.HTTP.Servers {
-		if err = a.initVirtualHost(cfgVhost, logs); err != nil {
+		if err = a.initVirtualHost(cfgVhost); err != nil {
 			return nil, err
 		}
 	}
@@ -70,20 +72,31 @@ func (a *Application) reinitFromConfigInplace(cfg *config.Config, testOnly bool)
 func (a *Application) reinitFromConfig(cfg *config.Config, testOnly bool) (err error) {
 	app := a.copy()
 	toBeResized, err := app.reinitFromConfigInplace(cfg, testOnly)
-	if err != nil {
+	if err != nil || testOnly {
+		stopUpstreams(app.upstreams)
+		for id, zone := range app.cacheZones { // the new zones are not used
+			if _, ok := a.cacheZones[id]; !ok {
+				zone.Close()
+			}
+		}
 		return err
 	}
-	if testOnly {
-		return nil
-	}
 	a.Lock()
 	defer a.Unlock()
 	a.cfg = app.cfg
 	a.SetLogger(app.GetLogger())
 	a.virtualHosts = app.virtualHosts
+	stopUpstreams(a.upstreams)
 	a.upstreams = app.upstreams
 	a.notConfiguredHandler = app.notConfiguredHandler
-	for id := range a.cacheZones { // clean the cacheZones
+	a.accessLogs = app.accessLogs
+	if err := a.accessLogFiles.update(a.accessLogs, a.cfg.HTTP.AccessLogRotation); err != nil {
+		a.GetLogger().Errorf("%s", err)
+	}
+	for id, zone := range a.cacheZones { // clean the cacheZones
+		if _, ok := app.cacheZones[id]; !ok {
+			a.drainCacheZone(zone)
+		}
 		delete(a.cacheZones, id)
 	}
 	for _, id := range toBeResized { // resize the to be resized
@@ -92,20 +105,46 @@ func (a *Application) reinitFromConfig(cfg *config.Config, testOnly bool) (err e
 		zone.Storage.SetLogger(app.GetLogger())
 		zone.Scheduler.SetLogger(app.GetLogger())
 		zone.Algorithm.SetLogger(app.GetLogger())
-		zone.Algorithm.ChangeConfig(cfgCz.BulkRemoveTimeout, cfgCz.BulkRemoveCount, cfgCz.StorageObjects)
+		zone.Algorithm.ChangeConfig(cfgCz.BulkRemoveTimeout, cfgCz.BulkRemoveCount,
+			cfgCz.StorageObjects, cfgCz.MaxSize)
 	}
 	for id, zone := range app.cacheZones { // copy everything
 		a.cacheZones[id] = zone
 	}
+	var mp = a.cfg.System.MemoryPressure
+	a.memory.ChangeConfig(mp.Limit.Bytes(), mp.Threshold, mp.RecoverThreshold,
+		time.Duration(mp.CheckInterval)*time.Millisecond)
+	if a.httpSrv != nil {
+		a.httpSrv.SetKeepAlivesEnabled(!a.cfg.HTTP.DisableKeepAlives)
+	}
 
 	return nil
 }
 
+// drainCacheZone closes the cache zone which was removed from the config in
+// the background, after the requests which still use it are finished.
+func (a *Application) drainCacheZone(cz *types.CacheZone) {
+	var logger = a.GetLogger()
+	cz.Remove()
+	logger.Logf("Cache zone `%s` was removed, waiting for its %d requests to finish",
+		cz.ID, cz.InFlight())
+	go func() {
+		<-cz.Drained()
+		cz.Close()
+		logger.Logf("Cache zone `%s` was drained and closed", cz.ID)
+	}()
+}
+
 func (a *Application) initCacheZone(cfgCz *config.CacheZone, testOnly bool) (err error) {
 	cz := &types.CacheZone{
 		ID:        cfgCz.ID,
 		PartSize:  cfgCz.PartSize,
 		Scheduler: storage.NewScheduler(a.GetLogger()),
+		Groups:    types.NewObjectGroups(),
+
+		SurrogateKeys: types.NewSurrogateKeys(),
+
+		ObjectIDHash: cfgCz.ObjectIDHash,
 	}
 	// Initialize the storage
 	if cz.Storage, err = storage.New(cfgCz, a.GetLogger()); err != nil {
@@ -114,13 +153,23 @@ func (a *Application) initCacheZone(cfgCz *config.CacheZone, testOnly bool) (err
 	}
 
 	// Initialize the cache algorithm
-	if cz.Algorithm, err = cache.New(cfgCz, cz.Storage.DiscardPart, a.GetLogger()); err != nil {
+	var removeFunc = cz.Storage.DiscardPart
+	if pe, ok := cz.Storage.(types.PartEvictor); ok {
+		removeFunc = pe.EvictPart
+	}
+	if cz.Algorithm, err = cache.New(cfgCz, removeFunc, a.GetLogger()); err != nil {
 		return fmt.Errorf("Could not initialize algorithm '%s' for cache zone '%s': %s",
 			cfgCz.Algorithm, cfgCz.ID, err)
 	}
 
+	if qe, ok := cz.Storage.(types.QuotaEnforcer); ok {
+		if sr, ok := cz.Algorithm.(types.SpaceReclaimer); ok {
+			qe.OnQuotaExceeded(sr.ReclaimSpace)
+		}
+	}
+
 	if !testOnly {
-		a.reloadCache(cz)
+		a.reloadCache(cz, newReloadErrorsLimit(cfgCz))
 	}
 
 	a.cacheZones[cfgCz.ID] = cz
@@ -128,6 +177,16 @@ func (a *Application) initCacheZone(cfgCz *config.CacheZone, testOnly bool) (err
 	return nil
 }
 
+// stopUpstreams stops the background work of upstreams which are no longer
+// going to be used for new requests.
+func stopUpstreams(upstreams map[string]types.Upstream) {
+	for _, up := range upstreams {
+		if up, ok := up.(*upstream.Upstream); ok && up != nil {
+			up.Stop()
+		}
+	}
+}
+
 func (a *Application) getUpstream(upID string) (types.Upstream, error) {
 	if upID == "" {
 		return nil, nil
@@ -149,10 +208,10 @@ func (a *Application) getUpstream(upID string) (types.Upstream, error) {
 	return nil, fmt.Errorf("Invalid upstream %s", upID)
 }
 
-func (a *Application) initVirtualHost(cfgVhost *config.VirtualHost, logs accessLogs) (err error) {
+func (a *Application) initVirtualHost(cfgVhost *config.VirtualHost) (err error) {
 	var accessLog io.Writer
 	if cfgVhost.AccessLog != "" {
-		if accessLog, err = logs.openAccessLog(cfgVhost.AccessLog); err != nil {
+		if accessLog, err = a.accessLogs.openAccessLog(a.accessLogFiles, cfgVhost.AccessLog); err != nil {
 			return fmt.Errorf("error opening access log for virtual host %s - %s",
 				cfgVhost.Name, err)
 		}
@@ -160,27 +219,30 @@ func (a *Application) initVirtualHost(cfgVhost *config.VirtualHost, logs accessL
 
 	vhost := VirtualHost{
 		Location: types.Location{
-			Name:                  cfgVhost.Name,
-			CacheKey:              cfgVhost.CacheKey,
-			CacheKeyIncludesQuery: cfgVhost.CacheKeyIncludesQuery,
-			CacheDefaultDuration:  cfgVhost.CacheDefaultDuration,
+			Name:                   cfgVhost.Name,
+			CacheKey:               cfgVhost.CacheKey,
+			CacheKeyIncludesQuery:  cfgVhost.CacheKeyIncludesQuery,
+			CacheKeyIncludesScheme: cfgVhost.CacheKeyIncludesScheme,
+			CacheKeyTemplate:       cfgVhost.CacheKeyTemplate,
+			TrustedProxies:         cfgVhost.TrustedProxies,
+			CacheDefaultDuration:   cfgVhost.CacheDefaultDuration,
 		},
 	}
 	if vhost.Upstream, err = a.getUpstream(cfgVhost.Upstream); err != nil {
 		return err
 	}
 
-	if _, ok := a.virtualHosts[cfgVhost.Name]; ok {
+	if _, ok := a.virtualHosts[vhostName(cfgVhost.Name)]; ok {
 		return fmt.Errorf("Virtual host or alias %s already exists", cfgVhost.Name)
 	}
-	a.virtualHosts[cfgVhost.Name] = &vhost
+	a.virtualHosts[vhostName(cfgVhost.Name)] = &vhost
 
 	for _, alias := range cfgVhost.Aliases {
-		if _, ok := a.virtualHosts[alias]; ok {
+		if _, ok := a.virtualHosts[vhostName(alias)]; ok {
 			return fmt.Errorf("Virtual host or alias %s already exists, duplicated by alias for %s",
 				alias, cfgVhost.Name)
 		}
-		a.virtualHosts[alias] = &vhost
+		a.virtualHosts[vhostName(alias)] = &vhost
 	}
 
 	if vhost.Logger, err = logger.New(&cfgVhost.Logger); err != nil {
@@ -195,7 +257,8 @@ func (a *Application) initVirtualHost(cfgVhost *config.VirtualHost, logs accessL
 		vhost.Cache = cz
 	}
 
-	if vhost.Handler, err = chainHandlers(&vhost.Location, &cfgVhost.Location, accessLog); err != nil {
+	if vhost.Handler, err = chainHandlers(&vhost.Location, &cfgVhost.Location, accessLog,
+		a.cfg.HTTP.AccessLogFormat, a.cfg.HTTP.AccessLogCacheStatus); err != nil {
 		return err
 	}
 	var locations []*types.Location
@@ -215,10 +278,13 @@ func (a *Application) initFromConfigLocationsForVHost(cfgLocations []*config.Loc
 	var locations = make([]*types.Location, len(cfgLocations))
 	for index, locCfg := range cfgLocations {
 		locations[index] = &types.Location{
-			Name:                  locCfg.Name,
-			CacheKey:              locCfg.CacheKey,
-			CacheKeyIncludesQuery: locCfg.CacheKeyIncludesQuery,
-			CacheDefaultDuration:  locCfg.CacheDefaultDuration,
+			Name:                   locCfg.Name,
+			CacheKey:               locCfg.CacheKey,
+			CacheKeyIncludesQuery:  locCfg.CacheKeyIncludesQuery,
+			CacheKeyIncludesScheme: locCfg.CacheKeyIncludesScheme,
+			CacheKeyTemplate:       locCfg.CacheKeyTemplate,
+			TrustedProxies:         locCfg.TrustedProxies,
+			CacheDefaultDuration:   locCfg.CacheDefaultDuration,
 		}
 		if locations[index].Upstream, err = a.getUpstream(locCfg.Upstream); err != nil {
 			return nil, err
@@ -236,7 +302,8 @@ func (a *Application) initFromConfigLocationsForVHost(cfgLocations []*config.Loc
 			locations[index].Cache = cz
 		}
 
-		if locations[index].Handler, err = chainHandlers(locations[index], locCfg, accessLog); err != nil {
+		if locations[index].Handler, err = chainHandlers(locations[index], locCfg, accessLog,
+			a.cfg.HTTP.AccessLogFormat, a.cfg.HTTP.AccessLogCacheStatus); err != nil {
 			return nil, err
 		}
 
@@ -245,10 +312,24 @@ func (a *Application) initFromConfigLocationsForVHost(cfgLocations []*config.Loc
 	return locations, nil
 }
 
-func (a *Application) reloadCache(cz *types.CacheZone) {
+func (a *Application) reloadCache(cz *types.CacheZone, limit reloadErrorsLimit) {
 	counter := 0
+	var errorsCount uint64
+	var limitErr error
+	onError := func(err error) bool {
+		errorsCount++
+		a.GetLogger().Errorf("Error for cache zone `%s` in reloadCache: %s", cz.ID, err)
+		limitErr = limit.exceeded(errorsCount, uint64(counter), false)
+		return limitErr == nil
+	}
 	callback := func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
 		counter++
+		select {
+		case <-cz.Removed():
+			return false
+		default:
+		}
+		cz.AddReloaded()
 		//!TODO: remove hardcoded periods and timeout, get them from config
 		if counter%100 == 0 {
 			select {
@@ -258,9 +339,14 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 			}
 		}
 
-		if !utils.IsMetadataFresh(obj) {
+		// objects with stale-while-revalidate are kept while they can be
+		// served stale
+		var expiresAt = time.Unix(obj.ExpiresAt+obj.StaleWhileRevalidate, 0)
+		if !expiresAt.After(time.Now()) {
 			if err := cz.Storage.Discard(obj.ID); err != nil {
 				a.GetLogger().Errorf("Error for cache zone `%s` on discarding objID `%s` in reloadCache: %s", cz.ID, obj.ID, err)
+			} else {
+				cz.AddReloadDiscarded()
 			}
 		} else {
 			cz.Scheduler.AddEvent(
@@ -268,8 +354,15 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 				storage.GetExpirationHandler(cz, obj.ID),
 				//!TODO: Maybe do not use time.Now but cached time. See the todo comment
 				// in utils.IsMetadataFresh.
-				time.Unix(obj.ExpiresAt, 0).Sub(time.Now()),
+				expiresAt.Sub(time.Now()),
 			)
+			if obj.Group != "" {
+				cz.Groups.Add(obj.Group, obj.GroupGeneration, obj.ID)
+			}
+			cz.SurrogateKeys.Add(obj.ID, obj.SurrogateKeys)
+			if st, ok := cz.Algorithm.(types.ObjectSizeTracker); ok {
+				st.SetObjectSize(obj.ID, obj.Size)
+			}
 
 			for _, idx := range parts {
 				if err := cz.Algorithm.AddObject(idx); err != nil && err != types.ErrAlreadyInCache {
@@ -281,7 +374,12 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 		return true
 	}
 
+	// the zone is not closed while its contents are being loaded
+	cz.Acquire()
+	cz.SetReloading(true)
 	go func() {
+		defer cz.Release()
+		defer cz.SetReloading(false)
 		var ch = make(chan struct{})
 		defer close(ch)
 		go func() {
@@ -301,7 +399,19 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 			}
 		}()
 		a.GetLogger().Logf("Start storage reload for cache zone `%s`", cz.ID)
-		if err := cz.Storage.Iterate(callback); err != nil {
+		var err error
+		if r, ok := cz.Storage.(types.IterationErrorsReporter); ok {
+			err = r.IterateWithErrors(callback, onError)
+		} else {
+			err = cz.Storage.Iterate(callback)
+		}
+		if err == nil && limitErr == nil {
+			limitErr = limit.exceeded(errorsCount, uint64(counter), true)
+		}
+		if limitErr != nil {
+			cz.SetReloadError(limitErr)
+			a.GetLogger().Errorf("Aborted the storage reload for cache zone `%s` after loading %d objects: %s", cz.ID, counter, limitErr)
+		} else if err != nil {
 			a.GetLogger().Errorf("For cache zone `%s` received iterator error '%s' after loading %d objects", cz.ID, err, counter)
 		} else {
 			a.GetLogger().Logf("Loading contents from disk for cache zone `%s` finished: %d objects loaded!", cz.ID, counter)
@@ -309,7 +419,8 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 	}()
 }
 
-func chainHandlers(location *types.Location, locCfg *config.Location, accessLog io.Writer) (http.Handler, error) {
+func chainHandlers(location *types.Location, locCfg *config.Location, accessLog io.Writer,
+	logFormat string, cacheStatus bool) (http.Handler, error) {
 	var res http.Handler
 	var err error
 	var handlers = locCfg.Handlers
@@ -322,12 +433,15 @@ func chainHandlers(location *types.Location, locCfg *config.Location, accessLog
 	if err != nil {
 		return nil, err
 	}
-	return loggingHandler(res, accessLog, true)
+	return loggingHandler(res, accessLog, logFormat, true, cacheStatus)
 }
 
 // loggingHandler will write to accessLog each and every request to it while proxing
-// it to next
-func loggingHandler(next http.Handler, accessLog io.Writer, knownVhost bool) (
+// it to next, in the format of http.access_log_format. With cacheStatus the cache
+// status and the upstream recorded through the request context are written too.
+// A format with variables is compiled as a template, which may use them anyway.
+func loggingHandler(next http.Handler, accessLog io.Writer, format string,
+	knownVhost, cacheStatus bool) (
 	http.Handler,
 	error,
 ) {
@@ -340,12 +454,28 @@ func loggingHandler(next http.Handler, accessLog io.Writer, knownVhost bool) (
 		return next, nil
 	}
 
+	var tmpl *logTemplate
+	if isLogTemplate(format) {
+		var err error
+		if tmpl, err = compileLogTemplate(format); err != nil {
+			return nil, err
+		}
+		cacheStatus = true
+	}
+
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			t := time.Now()
 			l := &responseLogger{ResponseWriter: w}
 			url := *r.URL
 			reqID, _ := contexts.GetRequestID(r.Context())
+			var fields *cacheLogFields
+			if cacheStatus {
+				fields = &cacheLogFields{}
+				var ctx = contexts.NewUpstreamRecorderContext(r.Context(), fields.setUpstream)
+				ctx = contexts.NewUpstreamTimeRecorderContext(ctx, fields.setUpstreamTime)
+				r = r.WithContext(contexts.NewCacheStatusRecorderContext(ctx, fields.setCacheStatus))
+			}
 
 			vhostID := r.Host
 
@@ -353,11 +483,12 @@ func loggingHandler(next http.Handler, accessLog io.Writer, knownVhost bool) (
 				vhostID += unknownVhostLogSuffix
 			}
 
-			defer func(vhostID string) {
-				go func() {
-					writeLog(accessLog, r, vhostID, reqID, url, t, l.Status(), l.Size())
-				}()
-			}(vhostID)
+			defer func() {
+				// the connection may serve its next request while the entry
+				// is written, so the response state is taken before that
+				var status, size = l.Status(), l.Size()
+				go writeLog(accessLog, format, tmpl, r, vhostID, reqID, url, t, status, size, fields)
+			}()
 			next.ServeHTTP(l, r)
 		}), nil
 }
@@ -77,4 +77,9 @@ func TestDiskReload(t *testing.T) {
 	if cacheObjects != expectedObjects {
 		t.Errorf("Expected object count in cache to be %d but it was %d", expectedObjects, cacheObjects)
 	}
+	reloading, loaded, discarded := app.cacheZones["default"].ReloadProgress()
+	if reloading || loaded != 2 || discarded != 1 {
+		t.Errorf("Expected a finished reload of 2 objects with 1 discarded but got %t, %d, %d",
+			reloading, loaded, discarded)
+	}
 }
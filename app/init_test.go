@@ -3,6 +3,7 @@ package app
 import (
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
@@ -105,6 +106,49 @@ func TestReinit(t *testing.T) {
 	}
 }
 
+func TestRemovedZoneIsDrained(t *testing.T) {
+	t.Parallel()
+
+	app, cleanup := appFromExampleConfig(t)
+	defer cleanup()
+	var zone2 = app.cacheZones["zone2"]
+	zone2.Acquire() // a request which is still in flight
+
+	cfg := *app.cfg
+	path3, cleanup3 := testutils.GetTestFolder(t)
+	defer cleanup3()
+	var zone3 = *cfg.CacheZones["zone2"]
+	zone3.ID, zone3.Path = "zone3", path3
+	replaceZone(&cfg, "zone2", &zone3)
+	cfg.CacheZones["zone3"] = &zone3
+	if err := app.reinitFromConfig(&cfg, false); err != nil {
+		t.Fatalf("Error upon reiniting app: %s", err)
+	}
+
+	select {
+	case <-zone2.Removed():
+	default:
+		t.Error("Expected zone2 to be marked as removed")
+	}
+	var drained = zone2.Drained()
+	select {
+	case <-drained:
+		t.Error("Expected zone2 not to be drained while a request uses it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	zone2.Release()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Errorf("Expected zone2 to be drained but %d requests are in flight",
+			zone2.InFlight())
+	}
+	if inFlight := app.cacheZones["default"].InFlight(); inFlight > 1 {
+		t.Errorf("Expected at most the reload of the kept zone in flight but got %d", inFlight)
+	}
+}
+
 func replaceZone(cfg *config.Config, id string, newZone *config.CacheZone) {
 	delete(cfg.CacheZones, id)
 	for _, server := range cfg.HTTP.Servers {
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// logEntry is everything which can be written in an access log entry.
+type logEntry struct {
+	req                    *http.Request
+	locationIdentification string
+	reqID                  types.RequestID
+	url                    url.URL
+	ts                     time.Time
+	duration               time.Duration
+	status                 int
+	size                   uint64
+	cache                  cacheLogValues
+}
+
+// logVariable appends the value of a template variable for an entry to buf.
+type logVariable func(buf []byte, e *logEntry) []byte
+
+// logVariables are the variables which can be used in an access log template
+// by their names. The headers of the request are available as $http_<name>.
+var logVariables = map[string]logVariable{
+	"remote_addr": func(buf []byte, e *logEntry) []byte {
+		host, _, err := net.SplitHostPort(e.req.RemoteAddr)
+		if err != nil {
+			host = e.req.RemoteAddr
+		}
+		return append(buf, host...)
+	},
+	"remote_user": func(buf []byte, e *logEntry) []byte {
+		if e.url.User != nil && e.url.User.Username() != "" {
+			return appendQuoted(buf, e.url.User.Username())
+		}
+		return append(buf, '-')
+	},
+	"host": func(buf []byte, e *logEntry) []byte {
+		return appendQuoted(buf, e.req.Host)
+	},
+	"vhost": func(buf []byte, e *logEntry) []byte {
+		return appendQuoted(buf, e.locationIdentification)
+	},
+	"request_id": func(buf []byte, e *logEntry) []byte {
+		return append(buf, e.reqID...)
+	},
+	"time_local": func(buf []byte, e *logEntry) []byte {
+		return append(buf, e.ts.Format("02/Jan/2006:15:04:05 -0700")...)
+	},
+	"time_iso8601": func(buf []byte, e *logEntry) []byte {
+		return append(buf, e.ts.Format(time.RFC3339)...)
+	},
+	"request": func(buf []byte, e *logEntry) []byte {
+		buf = append(buf, e.req.Method...)
+		buf = append(buf, ' ')
+		buf = appendQuoted(buf, e.url.RequestURI())
+		buf = append(buf, ' ')
+		return append(buf, e.req.Proto...)
+	},
+	"request_method": func(buf []byte, e *logEntry) []byte {
+		return append(buf, e.req.Method...)
+	},
+	"request_uri": func(buf []byte, e *logEntry) []byte {
+		return appendQuoted(buf, e.url.RequestURI())
+	},
+	"server_protocol": func(buf []byte, e *logEntry) []byte {
+		return append(buf, e.req.Proto...)
+	},
+	"status": func(buf []byte, e *logEntry) []byte {
+		return strconv.AppendInt(buf, int64(e.status), 10)
+	},
+	"body_bytes_sent": func(buf []byte, e *logEntry) []byte {
+		return strconv.AppendUint(buf, e.size, 10)
+	},
+	"request_time": func(buf []byte, e *logEntry) []byte {
+		return appendSeconds(buf, e.duration)
+	},
+	"upstream_cache_status": func(buf []byte, e *logEntry) []byte {
+		if e.cache.status == nil {
+			return append(buf, '-')
+		}
+		return append(buf, e.cache.status.Status...)
+	},
+	"cache_zone": func(buf []byte, e *logEntry) []byte {
+		if e.cache.status == nil || e.cache.status.Zone == "" {
+			return append(buf, '-')
+		}
+		return appendQuoted(buf, e.cache.status.Zone)
+	},
+	"cache_age": func(buf []byte, e *logEntry) []byte {
+		if e.cache.status == nil || e.cache.status.Age < 0 {
+			return append(buf, '-')
+		}
+		return strconv.AppendInt(buf, e.cache.status.Age, 10)
+	},
+	"upstream_addr": func(buf []byte, e *logEntry) []byte {
+		if e.cache.upstream == "" {
+			return append(buf, '-')
+		}
+		return appendQuoted(buf, e.cache.upstream)
+	},
+	"upstream_response_time": func(buf []byte, e *logEntry) []byte {
+		if !e.cache.upstreamTimed {
+			return append(buf, '-')
+		}
+		return appendSeconds(buf, e.cache.upstreamTime)
+	},
+}
+
+// appendSeconds appends d in seconds with a millisecond resolution.
+func appendSeconds(buf []byte, d time.Duration) []byte {
+	return strconv.AppendFloat(buf, d.Seconds(), 'f', 3, 64)
+}
+
+func headerVariable(name string) logVariable {
+	var header = http.CanonicalHeaderKey(strings.Replace(name, "_", "-", -1))
+	return func(buf []byte, e *logEntry) []byte {
+		if value := e.req.Header.Get(header); value != "" {
+			return appendQuoted(buf, value)
+		}
+		return append(buf, '-')
+	}
+}
+
+// logTemplate is an access log format with nginx style variables, for example
+// `$remote_addr "$request" $status $upstream_cache_status`. It is compiled
+// once and then only rendered for every entry.
+type logTemplate struct {
+	literals  []string
+	variables []logVariable
+}
+
+// isLogTemplate returns whether the http.access_log_format is a template
+// instead of the name of one of the predefined formats.
+func isLogTemplate(format string) bool {
+	return strings.Contains(format, "$")
+}
+
+// compileLogTemplate parses the template format. The name of a variable may
+// be enclosed in braces to separate it from the text after it, as in
+// `${status}ms`.
+func compileLogTemplate(format string) (*logTemplate, error) {
+	var t = new(logTemplate)
+	var literal []byte
+	for i := 0; i < len(format); i++ {
+		if format[i] != '$' {
+			literal = append(literal, format[i])
+			continue
+		}
+		var name string
+		if i+1 < len(format) && format[i+1] == '{' {
+			var end = strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed variable name at %d in the access log format %q",
+					i, format)
+			}
+			name = format[i+2 : i+end]
+			i += end
+		} else {
+			var end = i + 1
+			for end < len(format) && isVariableNameByte(format[end]) {
+				end++
+			}
+			name = format[i+1 : end]
+			i = end - 1
+		}
+
+		var variable, ok = logVariables[name]
+		if !ok && strings.HasPrefix(name, "http_") && len(name) > len("http_") {
+			variable, ok = headerVariable(name[len("http_"):]), true
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown variable `$%s` in the access log format %q", name, format)
+		}
+		t.literals = append(t.literals, string(literal))
+		t.variables = append(t.variables, variable)
+		literal = literal[:0]
+	}
+	t.literals = append(t.literals, string(literal))
+	return t, nil
+}
+
+func isVariableNameByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// render appends the entry in the format of the template to buf.
+func (t *logTemplate) render(buf []byte, e *logEntry) []byte {
+	for i, variable := range t.variables {
+		buf = append(buf, t.literals[i]...)
+		buf = variable(buf, e)
+	}
+	return append(buf, t.literals[len(t.literals)-1]...)
+}
@@ -0,0 +1,23 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// rejectedForMemoryPressure responds with 503 and returns true if the app is
+// degraded and configured to reject new requests when under memory pressure.
+func (a *Application) rejectedForMemoryPressure(writer http.ResponseWriter) bool {
+	if !a.memory.Degraded() {
+		return false
+	}
+	a.RLock()
+	var reject = a.cfg.System.MemoryPressure.RejectRequests
+	a.RUnlock()
+	if !reject {
+		return false
+	}
+	httputils.Error(writer, http.StatusServiceUnavailable)
+	return true
+}
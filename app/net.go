@@ -3,7 +3,6 @@ package app
 import (
 	"encoding/hex"
 	"net/http"
-	"strings"
 
 	"github.com/ironsmile/nedomi/contexts"
 	"github.com/ironsmile/nedomi/types"
@@ -13,9 +12,13 @@ import (
 // GetLocationFor returns the Location that mathes the provided host and path
 func (app *Application) GetLocationFor(host, path string) *types.Location {
 	app.RLock()
-	split := strings.Split(host, ":")
-	vh, ok := app.virtualHosts[split[0]]
-	app.RUnlock()
+	defer app.RUnlock()
+	return app.getLocationFor(host, path)
+}
+
+// getLocationFor is GetLocationFor for callers which hold the lock.
+func (app *Application) getLocationFor(host, path string) *types.Location {
+	vh, ok := app.virtualHosts[vhostName(host)]
 	if !ok {
 		return nil
 	}
@@ -29,10 +32,19 @@ func (app *Application) GetLocationFor(host, path string) *types.Location {
 
 func (app *Application) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
 	var (
-		reqID    = app.newRequestIDFor(app.stats.requested())
-		ctx      = contexts.NewIDContext(app.ctx, reqID)
-		location = app.GetLocationFor(req.Host, req.URL.Path)
+		reqID = app.requestIDFor(req, app.stats.requested())
+		ctx   = contexts.NewIDContext(app.ctx, reqID)
+		valid bool
 	)
+	if req, valid = app.normalizeRequestTarget(req); !valid {
+		defer app.stats.notConfigured()
+		httputils.Error(writer, http.StatusBadRequest)
+		return
+	}
+	var location = app.acquireLocationFor(req.Host, req.URL.Path)
+	if location != nil && location.Cache != nil {
+		defer location.Cache.Release()
+	}
 
 	if location == nil || location.Handler == nil {
 		req = req.WithContext(ctx)
@@ -43,6 +55,10 @@ func (app *Application) ServeHTTP(writer http.ResponseWriter, req *http.Request)
 
 	defer app.stats.responded()
 
+	if app.rejectedForMemoryPressure(writer) {
+		return
+	}
+
 	var conn, ok = app.conns.find(req.RemoteAddr)
 	if !ok { // highly unlikely
 		app.GetLogger().Errorf("couldn't find connection for req with addr %s!%s!%s\n",
@@ -56,10 +72,63 @@ func (app *Application) ServeHTTP(writer http.ResponseWriter, req *http.Request)
 	location.Handler.ServeHTTP(writer, req)
 }
 
+// acquireLocationFor returns the Location like GetLocationFor and acquires its
+// cache zone, if it has one. The zone is acquired under the lock, so a zone
+// which is removed on reload is not used by requests started after that.
+func (app *Application) acquireLocationFor(host, path string) *types.Location {
+	app.RLock()
+	defer app.RUnlock()
+	var location = app.getLocationFor(host, path)
+	if location != nil && location.Cache != nil {
+		location.Cache.Acquire()
+	}
+	return location
+}
+
 func newNotConfiguredHandler() http.Handler {
 	return http.HandlerFunc(http.NotFound)
 }
 
+// maxClientRequestIDLength limits the request ids of the clients which are
+// reused, as they are written in every log line of the request
+const maxClientRequestIDLength = 128
+
+// requestIDFor returns the id of the request with the count. If the request
+// id header is configured, the id which the client sent in it is reused, if
+// it is valid, and the header is set to the id so that the upstream requests
+// have it as well.
+func (app *Application) requestIDFor(req *http.Request, c uint64) types.RequestID {
+	app.RLock()
+	var header string
+	if app.cfg.HTTP != nil {
+		header = app.cfg.HTTP.RequestIDHeader
+	}
+	app.RUnlock()
+	if header == "" {
+		return app.newRequestIDFor(c)
+	}
+	var reqID = types.RequestID(req.Header.Get(header))
+	if !validClientRequestID(reqID) {
+		reqID = app.newRequestIDFor(c)
+	}
+	req.Header.Set(header, string(reqID))
+	return reqID
+}
+
+// validClientRequestID returns whether the id sent by a client may be used
+// in the logs: it is not too long and has only visible ASCII characters.
+func validClientRequestID(reqID types.RequestID) bool {
+	if len(reqID) == 0 || len(reqID) > maxClientRequestIDLength {
+		return false
+	}
+	for _, c := range reqID {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func (app *Application) newRequestIDFor(c uint64) types.RequestID {
 	app.RLock()
 	var appIdlen = len(app.cfg.ApplicationID)
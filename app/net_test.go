@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -8,6 +9,7 @@ import (
 
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/memutils"
 )
 
 func newLocationWithHandler(name string) *types.Location {
@@ -73,8 +75,9 @@ func TestLocationMatching(t *testing.T) {
 				Muxer: muxer,
 			},
 		},
-		stats: new(applicationStats),
-		conns: newConnections(),
+		stats:  new(applicationStats),
+		conns:  newConnections(),
+		memory: memutils.NewMonitor(nil, 0, 0, 0),
 	}
 
 	var mat = map[string]string{
@@ -143,3 +146,62 @@ type mockConnection struct {
 func (m *mockConnection) ID() string {
 	return m.id
 }
+
+func TestMemoryPressureRejectsRequests(t *testing.T) {
+	t.Parallel()
+	var used uint64
+	var vhost = newVHost("localhost")
+	vhost.Handler = newLocationWithHandler("localhost").Handler
+	var cfg = new(config.Config)
+	cfg.System.MemoryPressure = config.MemoryPressure{
+		Threshold:      0.8,
+		RejectRequests: true,
+	}
+	app := &Application{
+		cfg:                  cfg,
+		ctx:                  context.Background(),
+		notConfiguredHandler: newNotConfiguredHandler(),
+		virtualHosts: map[string]*VirtualHost{
+			"localhost": vhost,
+		},
+		stats: new(applicationStats),
+		conns: newConnections(),
+		memory: memutils.NewMonitor(func() (uint64, uint64) {
+			return used, 100
+		}, 0, 0.8, 0),
+	}
+	app.conns.add(&mockConnection{id: "fromTheTest:1337"})
+
+	var request = func(expectedCode int) {
+		var recorder = httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://localhost/path", nil)
+		if err != nil {
+			t.Fatalf("Error while creating request - %s", err)
+		}
+		req.RemoteAddr = "fromTheTest:1337"
+		app.ServeHTTP(recorder, req)
+		if recorder.Code != expectedCode {
+			t.Errorf("Expected code %d with memory usage %d but got %d",
+				expectedCode, used, recorder.Code)
+		}
+	}
+
+	used = 50
+	app.memory.Check()
+	request(http.StatusOK)
+
+	used = 90
+	app.memory.Check()
+	if !app.MemoryStats().Degraded {
+		t.Error("Expected the app to be degraded")
+	}
+	request(http.StatusServiceUnavailable)
+
+	app.cfg.System.MemoryPressure.RejectRequests = false
+	request(http.StatusOK)
+	app.cfg.System.MemoryPressure.RejectRequests = true
+
+	used = 10
+	app.memory.Check()
+	request(http.StatusOK)
+}
@@ -3,6 +3,8 @@ package app
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/ironsmile/nedomi/config"
 )
@@ -18,10 +20,12 @@ var (
 	errCfgWriteTimeoutIsDifferent    = errors.New("can't change write_timeout by reload")
 	errCfgMaxHeadersSizeIsDifferent  = errors.New("can't change max_headers_size by reload")
 
-	errTmplDifferentType      = "different types for same id '%s' between configs"
-	errTmplDifferentPath      = "different paths for same id '%s' between configs"
-	errTmplDifferentAlgorithm = "different algorithms for same id '%s' between configs"
-	errTmplDifferentPartSize  = "different part size for same id '%s' between configs"
+	errTmplDifferentType         = "different types for same id '%s' between configs"
+	errTmplDifferentPath         = "different paths for same id '%s' between configs"
+	errTmplDifferentAlgorithm    = "different algorithms for same id '%s' between configs"
+	errTmplDifferentPartSize     = "different part size for same id '%s' between configs"
+	errTmplDifferentObjectIDHash = "different object id hash for same id '%s' between configs"
+	errTmplDifferentBucket       = "different s3 buckets for same id '%s' between configs"
 )
 
 // checks if the provided config could be loaded in place of the current one.
@@ -72,14 +76,94 @@ func cacheZonesAreCompatible(zones1, zones2 map[string]*config.CacheZone) error
 			return fmt.Errorf(errTmplDifferentPath, key)
 		}
 
+		if zone2.S3.Endpoint != zone1.S3.Endpoint || zone2.S3.Bucket != zone1.S3.Bucket {
+			return fmt.Errorf(errTmplDifferentBucket, key)
+		}
+
 		if zone2.Algorithm != zone1.Algorithm {
 			return fmt.Errorf(errTmplDifferentAlgorithm, key)
 		}
 		if zone2.PartSize != zone1.PartSize {
 			return fmt.Errorf(errTmplDifferentPartSize, key)
 		}
+		if zone2.ObjectIDHash.String() != zone1.ObjectIDHash.String() {
+			return fmt.Errorf(errTmplDifferentObjectIDHash, key)
+		}
 	}
 	// !TODO check that a zone does not have the same path but with different ID
 
 	return nil
 }
+
+// describeConfigChanges returns a human readable summary of the virtual hosts
+// and cache zones which are added, removed or resized by replacing the config
+// old with cfg.
+func describeConfigChanges(old, cfg *config.Config) string {
+	var changes []string
+	var oldVhosts, newVhosts = vhostNames(old), vhostNames(cfg)
+	if added := missingFrom(newVhosts, oldVhosts); len(added) != 0 {
+		changes = append(changes, "added virtual hosts "+strings.Join(added, ", "))
+	}
+	if removed := missingFrom(oldVhosts, newVhosts); len(removed) != 0 {
+		changes = append(changes, "removed virtual hosts "+strings.Join(removed, ", "))
+	}
+
+	var oldZones, newZones = zoneIDs(old), zoneIDs(cfg)
+	if added := missingFrom(newZones, oldZones); len(added) != 0 {
+		changes = append(changes, "added cache zones "+strings.Join(added, ", "))
+	}
+	if removed := missingFrom(oldZones, newZones); len(removed) != 0 {
+		changes = append(changes, "removed cache zones "+strings.Join(removed, ", "))
+	}
+	var resized []string
+	for _, id := range newZones {
+		var zone1, zone2 = old.CacheZones[id], cfg.CacheZones[id]
+		if zone1 == nil {
+			continue
+		}
+		if zone1.StorageObjects != zone2.StorageObjects || zone1.MaxSize != zone2.MaxSize {
+			resized = append(resized, fmt.Sprintf("%s (%d objects, %d bytes -> %d objects, %d bytes)",
+				id, zone1.StorageObjects, zone1.MaxSize, zone2.StorageObjects, zone2.MaxSize))
+		}
+	}
+	if len(resized) != 0 {
+		changes = append(changes, "resized cache zones "+strings.Join(resized, ", "))
+	}
+
+	if len(changes) == 0 {
+		return "no virtual hosts or cache zones were changed"
+	}
+	return strings.Join(changes, "; ")
+}
+
+func vhostNames(cfg *config.Config) []string {
+	var names = make([]string, 0, len(cfg.HTTP.Servers))
+	for _, vh := range cfg.HTTP.Servers {
+		names = append(names, vh.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func zoneIDs(cfg *config.Config) []string {
+	var ids = make([]string, 0, len(cfg.CacheZones))
+	for id := range cfg.CacheZones {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// missingFrom returns the elements of the sorted slice a which are not in b.
+func missingFrom(a, b []string) (missing []string) {
+	var in = make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	for _, s := range a {
+		if !in[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,41 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/ironsmile/nedomi/config"
+)
+
+// reloadErrorRatioMinObjects is the number of objects after which the ratio
+// of the objects which could not be loaded is checked, so that the reload is
+// not aborted because of the first few errors.
+const reloadErrorRatioMinObjects = 100
+
+// reloadErrorsLimit decides when the loading of the stored objects of a zone
+// has failed too many times to continue.
+type reloadErrorsLimit struct {
+	maxErrors uint64
+	maxRatio  float64
+}
+
+func newReloadErrorsLimit(cfg *config.CacheZone) reloadErrorsLimit {
+	return reloadErrorsLimit{maxErrors: cfg.ReloadMaxErrors, maxRatio: cfg.ReloadMaxErrorRatio}
+}
+
+// exceeded returns an error if the number of errors is over the limits for
+// the number of loaded objects. The ratio is checked for any number of
+// objects when the reload is finished.
+func (l reloadErrorsLimit) exceeded(errors, loaded uint64, finished bool) error {
+	if l.maxErrors > 0 && errors > l.maxErrors {
+		return fmt.Errorf("%d objects could not be loaded, more than the maximum of %d",
+			errors, l.maxErrors)
+	}
+	var total = errors + loaded
+	if l.maxRatio > 0 && total > 0 && (finished || total >= reloadErrorRatioMinObjects) {
+		if ratio := float64(errors) / float64(total); ratio > l.maxRatio {
+			return fmt.Errorf("%d of %d objects could not be loaded, more than the maximum ratio of %g",
+				errors, total, l.maxRatio)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/storage/disk"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestReloadErrorsLimit(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		limit           reloadErrorsLimit
+		errors, loaded  uint64
+		finished, abort bool
+	}{
+		{limit: reloadErrorsLimit{}, errors: 1000, loaded: 0},
+		{limit: reloadErrorsLimit{maxErrors: 10}, errors: 10, loaded: 0},
+		{limit: reloadErrorsLimit{maxErrors: 10}, errors: 11, loaded: 1000, abort: true},
+		{limit: reloadErrorsLimit{maxRatio: 0.5}, errors: 60, loaded: 39, abort: false},
+		{limit: reloadErrorsLimit{maxRatio: 0.5}, errors: 60, loaded: 40, abort: true},
+		{limit: reloadErrorsLimit{maxRatio: 0.5}, errors: 50, loaded: 50, abort: false},
+		{limit: reloadErrorsLimit{maxRatio: 0.5}, errors: 3, loaded: 1, finished: true, abort: true},
+		{limit: reloadErrorsLimit{maxRatio: 0.5}, errors: 1, loaded: 3, finished: true, abort: false},
+	}
+	for num, test := range tests {
+		var err = test.limit.exceeded(test.errors, test.loaded, test.finished)
+		if (err != nil) != test.abort {
+			t.Errorf("Test %d: expected abort=%t but got error %v", num, test.abort, err)
+		}
+	}
+}
+
+func TestReloadAbortedForCorruptZone(t *testing.T) {
+	t.Parallel()
+	tempDir, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+
+	app, err := New(types.AppVersion{}, getConfigGetter(tempDir))
+	if err != nil {
+		t.Fatalf("Could not create an application: %s", err)
+	}
+	app.SetLogger(mock.NewLogger())
+	var cfg = app.cfg.CacheZones["default"]
+	cfg.ReloadMaxErrors = 50
+
+	stor, err := disk.New(cfg, app.GetLogger())
+	if err != nil {
+		t.Fatalf("Could not initialize a storage: %s", err)
+	}
+	var expiresAt = time.Now().Unix() + 600
+	for i := 0; i < 5; i++ {
+		id := types.NewObjectID("good", strconv.Itoa(i))
+		testutils.ShouldntFail(t, stor.SaveMetadata(&types.ObjectMetadata{ID: id, ExpiresAt: expiresAt}))
+	}
+	for i := 0; i < 300; i++ {
+		id := types.NewObjectID("corrupt", strconv.Itoa(i))
+		testutils.ShouldntFail(t, stor.SaveMetadata(&types.ObjectMetadata{ID: id, ExpiresAt: expiresAt}))
+	}
+	// the metadata of the objects with the corrupt key can not be read
+	err = filepath.Walk(filepath.Join(cfg.Path, "corrupt"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return ioutil.WriteFile(path, []byte("{garbage"), 0600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.reinitFromConfig(app.cfg, false); err != nil {
+		t.Fatalf("Could not init from config: %s", err)
+	}
+	defer app.ctxCancel()
+	var cz = app.cacheZones["default"]
+	select {
+	case <-cz.Drained():
+	case <-time.After(5 * time.Second):
+		t.Fatal("The reload did not finish in time")
+	}
+
+	reloadErr := cz.ReloadError()
+	if reloadErr == nil {
+		t.Fatal("Expected the reload of the corrupt zone to be aborted")
+	}
+	// the reload was stopped at the first error over the limit
+	if !strings.Contains(reloadErr.Error(), "51 objects could not be loaded") {
+		t.Errorf("Unexpected reload error: %s", reloadErr)
+	}
+	if zone2 := app.cacheZones["zone2"]; zone2 != nil && zone2.ReloadError() != nil {
+		t.Errorf("Unexpected reload error for the other zone: %s", zone2.ReloadError())
+	}
+}
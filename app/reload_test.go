@@ -4,6 +4,8 @@ import (
 	"testing"
 
 	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
 )
 
 func TestCacheZonesAreCompatible(t *testing.T) {
@@ -110,6 +112,49 @@ func TestCacheZonesAreCompatible(t *testing.T) {
 			},
 			err: "different part size for same id 'pesho' between configs",
 		},
+		{ // different object id hash
+			cfg1: map[string]*config.CacheZone{
+				"pesho": {
+					ID:        "pesho",
+					Type:      "type1",
+					Path:      "/path/to/somewhere",
+					Algorithm: "algorithm",
+					PartSize:  10,
+				},
+			},
+			cfg2: map[string]*config.CacheZone{
+				"pesho": {
+					ID:           "pesho",
+					Type:         "type1",
+					Path:         "/path/to/somewhere",
+					Algorithm:    "algorithm",
+					PartSize:     10,
+					ObjectIDHash: types.ObjectIDHashSHA256,
+				},
+			},
+			err: "different object id hash for same id 'pesho' between configs",
+		},
+		{ // the default object id hash is sha1
+			cfg1: map[string]*config.CacheZone{
+				"pesho": {
+					ID:        "pesho",
+					Type:      "type1",
+					Path:      "/path/to/somewhere",
+					Algorithm: "algorithm",
+					PartSize:  10,
+				},
+			},
+			cfg2: map[string]*config.CacheZone{
+				"pesho": {
+					ID:           "pesho",
+					Type:         "type1",
+					Path:         "/path/to/somewhere",
+					Algorithm:    "algorithm",
+					PartSize:     10,
+					ObjectIDHash: types.ObjectIDHashSHA1,
+				},
+			},
+		},
 		{ // object size going up is fine
 			cfg1: map[string]*config.CacheZone{
 				"pesho": {
@@ -525,3 +570,71 @@ func TestCheckConfigCouldBeReloaded(t *testing.T) {
 		}
 	}
 }
+
+func TestReloadKeepsTheOldConfigIfInvalid(t *testing.T) {
+	t.Parallel()
+
+	app, cleanup := appFromExampleConfig(t)
+	defer cleanup()
+	var oldCfg, oldZones = app.cfg, len(app.cacheZones)
+	cfg, err := app.configGetter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path3, cleanup3 := testutils.GetTestFolder(t)
+	defer cleanup3()
+	cfg.CacheZones["zone3"] = &config.CacheZone{
+		ID:             "zone3",
+		Type:           "disk",
+		Path:           path3,
+		StorageObjects: 300,
+		PartSize:       4096,
+		Algorithm:      "no-such-algorithm",
+	}
+
+	if err := app.Reload(cfg); err == nil {
+		t.Fatal("Expected an error for a zone with an unknown algorithm")
+	}
+	if app.cfg != oldCfg || len(app.cacheZones) != oldZones {
+		t.Error("Expected the old config to be kept after the failed reload")
+	}
+
+	cfg.CacheZones["zone3"].Algorithm = "lru"
+	if err := app.Reload(cfg); err != nil {
+		t.Fatalf("Unexpected error for the valid config: %s", err)
+	}
+	if app.cfg != cfg || app.cacheZones["zone3"] == nil {
+		t.Error("Expected the new config to be used after the reload")
+	}
+}
+
+func TestDescribeConfigChanges(t *testing.T) {
+	t.Parallel()
+	var newConfig = func(vhosts []string, zones map[string]uint64) *config.Config {
+		var cfg = &config.Config{
+			HTTP:       &config.HTTP{},
+			CacheZones: make(map[string]*config.CacheZone),
+		}
+		for _, name := range vhosts {
+			var vh = &config.VirtualHost{}
+			vh.Name = name
+			cfg.HTTP.Servers = append(cfg.HTTP.Servers, vh)
+		}
+		for id, objects := range zones {
+			cfg.CacheZones[id] = &config.CacheZone{ID: id, StorageObjects: objects}
+		}
+		return cfg
+	}
+
+	var old = newConfig([]string{"a.com", "b.com"}, map[string]uint64{"z1": 10, "z2": 20})
+	if got := describeConfigChanges(old, old); got != "no virtual hosts or cache zones were changed" {
+		t.Errorf("Unexpected changes for the same config: %s", got)
+	}
+	var cfg = newConfig([]string{"b.com", "c.com"}, map[string]uint64{"z1": 30, "z3": 20})
+	var expected = "added virtual hosts c.com; removed virtual hosts a.com; " +
+		"added cache zones z3; removed cache zones z2; " +
+		"resized cache zones z1 (10 objects, 0 bytes -> 30 objects, 0 bytes)"
+	if got := describeConfigChanges(old, cfg); got != expected {
+		t.Errorf("Expected the changes\n%s\nbut got\n%s", expected, got)
+	}
+}
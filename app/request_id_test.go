@@ -1,11 +1,17 @@
 package app
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/utils/memutils"
 )
 
 type newIDForTest struct {
@@ -48,6 +54,55 @@ func TestNewIDForWithoutApplicaitonID(t *testing.T) {
 	testNewIDFor(t, a, tests)
 }
 
+func TestRequestIDHeader(t *testing.T) {
+	t.Parallel()
+	var received *http.Request
+	var vhost = newVHost("example.com")
+	vhost.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	})
+	app := &Application{
+		cfg:                  &config.Config{HTTP: &config.HTTP{}},
+		ctx:                  context.Background(),
+		notConfiguredHandler: newNotConfiguredHandler(),
+		virtualHosts:         map[string]*VirtualHost{"example.com": vhost},
+		stats:                new(applicationStats),
+		conns:                newConnections(),
+		memory:               memutils.NewMonitor(nil, 0, 0, 0),
+	}
+	app.conns.add(&mockConnection{id: "fromTheTest:1337"})
+
+	// serve returns the request id with which the handler was called and the
+	// one in its header
+	var serve = func(clientID string) (string, string) {
+		var req = httptest.NewRequest("GET", "http://example.com/path", nil)
+		req.RemoteAddr = "fromTheTest:1337"
+		if clientID != "" {
+			req.Header.Set("X-Request-ID", clientID)
+		}
+		app.ServeHTTP(httptest.NewRecorder(), req)
+		reqID, _ := contexts.GetRequestID(received.Context())
+		return string(reqID), received.Header.Get("X-Request-ID")
+	}
+
+	if reqID, header := serve(""); reqID == "" || header != "" {
+		t.Errorf("Expected a new id which is not sent upstream but got %q and %q", reqID, header)
+	}
+	if reqID, header := serve("from-client"); reqID == "from-client" || header != "from-client" {
+		t.Errorf("Expected the id of the client to be ignored but got %q and %q", reqID, header)
+	}
+
+	app.cfg.HTTP.RequestIDHeader = "X-Request-ID"
+	if reqID, header := serve("from-client"); reqID != "from-client" || header != reqID {
+		t.Errorf("Expected the id of the client to be reused but got %q and %q", reqID, header)
+	}
+	for _, invalid := range []string{"", "with space", "new\nline", strings.Repeat("a", 129)} {
+		if reqID, header := serve(invalid); reqID == invalid || reqID == "" || header != reqID {
+			t.Errorf("Expected a new id instead of %q but got %q and %q", invalid, reqID, header)
+		}
+	}
+}
+
 func BenchmarkNewIDFor(b *testing.B) {
 	a := &Application{cfg: &config.Config{BaseConfig: config.BaseConfig{ApplicationID: "ThApp"}}, started: time.Unix(1073741824, 0)}
 	var count uint64
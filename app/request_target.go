@@ -0,0 +1,51 @@
+package app
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ironsmile/nedomi/config"
+)
+
+// normalizeRequestTarget makes requests in absolute-form (`GET
+// http://host/path HTTP/1.1`), as sent to forward proxies, equivalent to the
+// same requests in origin-form, so that they are routed, cached and proxied
+// the same way. As per RFC 7230 section 5.4 the host in the URI takes
+// precedence over the Host header. It returns false if such requests are
+// rejected by the configuration.
+func (app *Application) normalizeRequestTarget(req *http.Request) (*http.Request, bool) {
+	if !req.URL.IsAbs() && req.URL.Host == "" {
+		return req, true
+	}
+	app.RLock()
+	var reject = app.cfg.HTTP != nil && app.cfg.HTTP.AbsoluteFormRequests == config.AbsoluteFormReject
+	app.RUnlock()
+	if reject {
+		return req, false
+	}
+
+	var normalized = new(http.Request)
+	*normalized = *req
+	var u = *req.URL
+	// the credentials for the proxy are never sent further or logged
+	u.User = nil
+	if u.Path == "" && u.Opaque == "" {
+		u.Path = "/"
+	}
+	normalized.URL = &u
+	if u.Host != "" {
+		normalized.Host = u.Host
+	}
+	return normalized, true
+}
+
+// vhostName returns the name of the virtual host for the host of a request,
+// which is case insensitive and without the port, if any.
+func vhostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.ToLower(host)
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// abortedFillsTimeout is how long the shutdown waits for the aborted fills to
+// clean up after themselves.
+const abortedFillsTimeout = 5 * time.Second
+
+// finishFills lets the in-flight cache fills complete for the configured
+// grace period and aborts the remaining ones after it, so that they remove
+// their partially stored data instead of being cut off by the exit.
+func (a *Application) finishFills() {
+	a.RLock()
+	var grace = time.Duration(a.cfg.System.ShutdownFillGrace) * time.Second
+	var zones = make([]*types.CacheZone, 0, len(a.cacheZones))
+	for _, cz := range a.cacheZones {
+		zones = append(zones, cz)
+	}
+	a.RUnlock()
+
+	var logger = a.GetLogger()
+	var deadline = time.NewTimer(grace)
+	defer deadline.Stop()
+	var aborted bool
+	for _, cz := range zones {
+		if !aborted {
+			select {
+			case <-cz.Drained():
+				continue
+			case <-deadline.C:
+			}
+			aborted = true
+			for _, cz := range zones {
+				if inFlight := cz.InFlight(); inFlight > 0 {
+					logger.Logf("Aborting the %d in-flight operations of cache zone `%s`",
+						inFlight, cz.ID)
+				}
+				cz.AbortFills()
+			}
+			deadline.Reset(abortedFillsTimeout)
+		}
+
+		select {
+		case <-cz.Drained():
+		case <-deadline.C:
+			logger.Errorf("Cache zone `%s` still has %d in-flight operations after aborting them",
+				cz.ID, cz.InFlight())
+			return
+		}
+	}
+}
+
+// closeCacheZones stops the background work of the cache zones and flushes
+// what their storages have written to the disk. It is called on shutdown,
+// after the in-flight fills are finished or aborted.
+func (a *Application) closeCacheZones() {
+	a.RLock()
+	defer a.RUnlock()
+	for _, cz := range a.cacheZones {
+		cz.Close()
+	}
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func newShutdownTestApp(grace uint32, zones ...*types.CacheZone) *Application {
+	var a = &Application{
+		cfg:        &config.Config{},
+		cacheZones: make(map[string]*types.CacheZone),
+	}
+	a.cfg.System.ShutdownFillGrace = grace
+	a.SetLogger(mock.NewLogger())
+	for _, cz := range zones {
+		a.cacheZones[cz.ID] = cz
+	}
+	return a
+}
+
+// startFill acquires the zone like a fill which takes the duration to
+// complete or stops when the fills are aborted. The returned channel receives
+// whether it was aborted.
+func startFill(cz *types.CacheZone, duration time.Duration) <-chan bool {
+	var result = make(chan bool, 1)
+	cz.Acquire()
+	go func() {
+		defer cz.Release()
+		select {
+		case <-time.After(duration):
+			result <- false
+		case <-cz.FillsAborted():
+			result <- true
+		}
+	}()
+	return result
+}
+
+func TestShutdownFillsCompleteWithinGrace(t *testing.T) {
+	t.Parallel()
+	var zone1, zone2 = &types.CacheZone{ID: "1"}, &types.CacheZone{ID: "2"}
+	var fill1 = startFill(zone1, 50*time.Millisecond)
+	var fill2 = startFill(zone2, 100*time.Millisecond)
+
+	newShutdownTestApp(5, zone1, zone2).finishFills()
+	if <-fill1 || <-fill2 {
+		t.Error("Expected the fills to complete within the grace period")
+	}
+	if zone1.InFlight() != 0 || zone2.InFlight() != 0 {
+		t.Error("Expected the zones to be drained")
+	}
+}
+
+func TestShutdownFillsAbortedAfterGrace(t *testing.T) {
+	t.Parallel()
+	var zone1, zone2 = &types.CacheZone{ID: "1"}, &types.CacheZone{ID: "2"}
+	var fill1 = startFill(zone1, time.Hour)
+	var fill2 = startFill(zone2, time.Hour)
+
+	var start = time.Now()
+	newShutdownTestApp(0, zone1, zone2).finishFills()
+	if !<-fill1 || !<-fill2 {
+		t.Error("Expected the fills to be aborted")
+	}
+	if zone1.InFlight() != 0 || zone2.InFlight() != 0 {
+		t.Error("Expected the zones to be drained")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the fills to be aborted immediately but it took %s", elapsed)
+	}
+}
@@ -5,15 +5,18 @@
 package app
 
 import (
+	"encoding/json"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
+	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
 )
 
@@ -74,19 +77,104 @@ func buildCommonLogLine(
 	return buf
 }
 
-// writeLog writes a log entry for req to w in Apache Common Log Format.
+// jsonLogEntry is an access log entry in the JSON format. The duration is in
+// nanoseconds, as in the common format.
+type jsonLogEntry struct {
+	Host        string `json:"host"`
+	VHost       string `json:"vhost"`
+	RequestID   string `json:"request_id"`
+	User        string `json:"user,omitempty"`
+	Time        string `json:"time"`
+	Method      string `json:"method"`
+	URI         string `json:"uri"`
+	Proto       string `json:"proto"`
+	Status      int    `json:"status"`
+	Size        uint64 `json:"size"`
+	Duration    int64  `json:"duration"`
+	CacheStatus string `json:"cache_status,omitempty"`
+	CacheZone   string `json:"cache_zone,omitempty"`
+	CacheAge    *int64 `json:"cache_age,omitempty"`
+	Upstream    string `json:"upstream,omitempty"`
+}
+
+// buildJSONLogLine builds a log entry for req as a JSON object with the same
+// information as buildCommonLogLine. The cache fields, if not nil, are added
+// to it, leaving out the unknown ones.
+func buildJSONLogLine(
+	req *http.Request,
+	locationIdentification string,
+	reqID types.RequestID,
+	url url.URL,
+	ts time.Time,
+	status int, size uint64,
+	fields *cacheLogFields,
+) []byte {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	var entry = jsonLogEntry{
+		Host:      host,
+		VHost:     locationIdentification,
+		RequestID: string(reqID),
+		Time:      ts.Format(time.RFC3339),
+		Method:    req.Method,
+		URI:       url.RequestURI(),
+		Proto:     req.Proto,
+		Status:    status,
+		Size:      size,
+		Duration:  time.Since(ts).Nanoseconds(),
+	}
+	if url.User != nil {
+		entry.User = url.User.Username()
+	}
+	if fields != nil {
+		fields.fillJSON(&entry)
+	}
+	// the entry has only strings and numbers, so it is always encoded
+	buf, _ := json.Marshal(&entry)
+	return buf
+}
+
+// writeLog writes a log entry for req to w in the format, which is one of the
+// config.AccessLogFormat* values and the Apache Common Log Format by default.
+// The template, if not nil, is used instead of the format.
 // ts is the timestamp with which the entry should be logged.
 // status and size are used to provide the response HTTP status and size.
+// The cache fields, if not nil, are added to the entry.
 func writeLog(
 	w io.Writer,
+	format string,
+	tmpl *logTemplate,
 	req *http.Request,
 	locationIdentification string,
 	reqID types.RequestID,
 	url url.URL,
 	ts time.Time,
 	status int, size uint64,
+	fields *cacheLogFields,
 ) {
-	buf := buildCommonLogLine(req, locationIdentification, reqID, url, ts, status, size)
+	var buf []byte
+	if tmpl != nil {
+		buf = tmpl.render(buf, &logEntry{
+			req:                    req,
+			locationIdentification: locationIdentification,
+			reqID:                  reqID,
+			url:                    url,
+			ts:                     ts,
+			duration:               time.Since(ts),
+			status:                 status,
+			size:                   size,
+			cache:                  fields.values(),
+		})
+	} else if format == config.AccessLogFormatJSON {
+		buf = buildJSONLogLine(req, locationIdentification, reqID, url, ts, status, size, fields)
+	} else {
+		buf = buildCommonLogLine(req, locationIdentification, reqID, url, ts, status, size)
+		if fields != nil {
+			buf = fields.appendTo(buf)
+		}
+	}
 	buf = append(buf, '\n')
 	_, _ = w.Write(buf)
 }
@@ -183,7 +271,7 @@ func (l *responseLogger) Status() int {
 }
 
 func (l *responseLogger) Size() uint64 {
-	return l.size
+	return atomic.LoadUint64(&l.size)
 }
 
 func (l *responseLogger) ReadFrom(r io.Reader) (n int64, err error) {
@@ -191,3 +279,93 @@ func (l *responseLogger) ReadFrom(r io.Reader) (n int64, err error) {
 	atomic.AddUint64(&l.size, uint64(n))
 	return n, err
 }
+
+// cacheLogFields collects the cache status, the upstream and its response
+// time of a request, which the handlers record through its context.
+type cacheLogFields struct {
+	mu sync.Mutex
+	cacheLogValues
+}
+
+// cacheLogValues are the values recorded in cacheLogFields.
+type cacheLogValues struct {
+	status        *types.CacheStatus
+	upstream      string
+	upstreamTime  time.Duration
+	upstreamTimed bool
+}
+
+func (f *cacheLogFields) setCacheStatus(status *types.CacheStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *cacheLogFields) setUpstream(addr *types.UpstreamAddress) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// with retries the last upstream is the one which responded
+	f.upstream = addr.Host
+}
+
+func (f *cacheLogFields) setUpstreamTime(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upstreamTime, f.upstreamTimed = d, true
+}
+
+// values returns the recorded values, which are empty if f is nil.
+func (f *cacheLogFields) values() cacheLogValues {
+	if f == nil {
+		return cacheLogValues{}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cacheLogValues
+}
+
+// appendTo appends the cache status, the cache zone, the age of the cached
+// object and the upstream to a log entry, with "-" for the unknown ones.
+func (f *cacheLogFields) appendTo(buf []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var status, zone, age = "-", "-", "-"
+	if f.status != nil {
+		status = f.status.Status
+		if f.status.Zone != "" {
+			zone = f.status.Zone
+		}
+		if f.status.Age >= 0 {
+			age = strconv.FormatInt(f.status.Age, 10)
+		}
+	}
+	var upstream = f.upstream
+	if upstream == "" {
+		upstream = "-"
+	}
+	buf = append(buf, ' ')
+	buf = append(buf, status...)
+	buf = append(buf, ' ')
+	buf = appendQuoted(buf, zone)
+	buf = append(buf, ' ')
+	buf = append(buf, age...)
+	buf = append(buf, ' ')
+	buf = appendQuoted(buf, upstream)
+	return buf
+}
+
+// fillJSON sets the known cache status, cache zone, age of the cached object
+// and upstream in a JSON log entry.
+func (f *cacheLogFields) fillJSON(entry *jsonLogEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != nil {
+		entry.CacheStatus = f.status.Status
+		entry.CacheZone = f.status.Zone
+		if f.status.Age >= 0 {
+			var age = f.status.Age
+			entry.CacheAge = &age
+		}
+	}
+	entry.Upstream = f.upstream
+}
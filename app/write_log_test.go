@@ -0,0 +1,275 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// chanWriter sends every written log entry on a channel, as they are
+// written asynchronously.
+type chanWriter chan string
+
+func (c chanWriter) Write(b []byte) (int, error) {
+	c <- string(b)
+	return len(b), nil
+}
+
+func TestAccessLogCacheStatus(t *testing.T) {
+	t.Parallel()
+	var next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/miss" {
+			contexts.RecordCacheStatus(r.Context(), &types.CacheStatus{
+				Status: types.CacheStatusMiss, Zone: "zone1", Age: -1})
+			contexts.RecordUpstream(r.Context(), &types.UpstreamAddress{
+				URL: url.URL{Scheme: "http", Host: "upstream:8080"}})
+		} else if r.URL.Path == "/hit" {
+			contexts.RecordCacheStatus(r.Context(), &types.CacheStatus{
+				Status: types.CacheStatusHit, Zone: "zone1", Age: 42})
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var logs = make(chanWriter, 1)
+	var serve = func(handler http.Handler, path string) string {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		select {
+		case line := <-logs:
+			return line
+		case <-time.After(time.Second):
+			t.Fatalf("No access log entry for %s", path)
+		}
+		return ""
+	}
+
+	handler, err := loggingHandler(next, logs, config.AccessLogFormatCLF, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, suffix := range map[string]string{
+		"/miss":  " MISS zone1 - upstream:8080\n",
+		"/hit":   " HIT zone1 42 -\n",
+		"/other": " - - - -\n",
+	} {
+		if line := serve(handler, path); !strings.HasSuffix(line, suffix) {
+			t.Errorf("Expected the entry for %s to end with %q but it is %q", path, suffix, line)
+		}
+	}
+
+	if handler, err = loggingHandler(next, logs, config.AccessLogFormatCLF, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if line := serve(handler, "/hit"); strings.Contains(line, "HIT") {
+		t.Errorf("Expected no cache status without the setting but got %q", line)
+	}
+}
+
+func TestAccessLogOnKeepAliveConnection(t *testing.T) {
+	t.Parallel()
+	var next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status = r.URL.Query().Get("status")
+		if status != "" {
+			contexts.RecordCacheStatus(r.Context(), &types.CacheStatus{
+				Status: status, Zone: "zone1", Age: -1})
+		}
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte(r.URL.Path))
+	})
+	var logs = make(chanWriter, 10)
+	handler, err := loggingHandler(next, logs, config.AccessLogFormatCLF, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = httptest.NewServer(handler)
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	var reader = bufio.NewReader(conn)
+
+	// every entry has the status, size and cache status of its own request,
+	// although they are written after the next one is served
+	for i, step := range []struct {
+		path, suffix string
+		code         int
+	}{
+		{"/miss?status=MISS&code=200", " MISS zone1 - -\n", 200},
+		{"/hit-long-path?status=HIT&code=206", " HIT zone1 - -\n", 206},
+		{"/none?code=404", " - - - -\n", 404},
+		{"/bypass?status=BYPASS&code=200", " BYPASS zone1 - -\n", 200},
+		{"/none?code=500", " - - - -\n", 500},
+	} {
+		req, err := http.NewRequest("GET", server.URL+step.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("Could not read response %d from the reused connection: %s", i, err)
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+
+		var line string
+		select {
+		case line = <-logs:
+		case <-time.After(time.Second):
+			t.Fatalf("No access log entry for %s", step.path)
+		}
+		var expected = fmt.Sprintf(`"GET %s HTTP/1.1" %d %d `, step.path, step.code, len(req.URL.Path))
+		if !strings.Contains(line, expected) || !strings.HasSuffix(line, step.suffix) {
+			t.Errorf("Expected the entry for %s to contain %q and end with %q but it is %q",
+				step.path, expected, step.suffix, line)
+		}
+	}
+}
+
+func TestAccessLogJSONFormat(t *testing.T) {
+	t.Parallel()
+	var next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hit" {
+			contexts.RecordCacheStatus(r.Context(), &types.CacheStatus{
+				Status: types.CacheStatusHit, Zone: "zone1", Age: 42})
+			contexts.RecordUpstream(r.Context(), &types.UpstreamAddress{
+				URL: url.URL{Scheme: "http", Host: "upstream:8080"}})
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte("body"))
+	})
+
+	var logs = make(chanWriter, 1)
+	for _, cacheStatus := range []bool{true, false} {
+		handler, err := loggingHandler(next, logs, config.AccessLogFormatJSON, true, cacheStatus)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"/hit?q=\"quoted\"", "/other"} {
+			var req = httptest.NewRequest("HEAD", "http://example.com"+path, nil)
+			req = req.WithContext(contexts.NewIDContext(req.Context(), types.RequestID("req-1")))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			var line string
+			select {
+			case line = <-logs:
+			case <-time.After(time.Second):
+				t.Fatalf("No access log entry for %s", path)
+			}
+			if !strings.HasSuffix(line, "}\n") || strings.Count(line, "\n") != 1 {
+				t.Errorf("Expected a single JSON line for %s but got %q", path, line)
+			}
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Expected a JSON entry for %s but got %q: %s", path, line, err)
+			}
+			var expected = map[string]interface{}{
+				"host":       "192.0.2.1",
+				"vhost":      "example.com",
+				"request_id": "req-1",
+				"method":     "HEAD",
+				"uri":        path,
+				"proto":      "HTTP/1.1",
+				"status":     float64(http.StatusPartialContent),
+				"size":       float64(4),
+			}
+			if cacheStatus && path != "/other" {
+				expected["cache_status"] = types.CacheStatusHit
+				expected["cache_zone"] = "zone1"
+				expected["cache_age"] = float64(42)
+				expected["upstream"] = "upstream:8080"
+			}
+			for key, value := range expected {
+				if entry[key] != value {
+					t.Errorf("Expected %s to be %v in the entry for %s but it is %v",
+						key, value, path, entry[key])
+				}
+			}
+			if _, ok := entry["duration"].(float64); !ok {
+				t.Errorf("Expected a duration in the entry for %s but got %q", path, line)
+			}
+			if _, err := time.Parse(time.RFC3339, fmt.Sprint(entry["time"])); err != nil {
+				t.Errorf("Expected the time of the entry for %s but got %q: %s", path, line, err)
+			}
+			if len(entry) != len(expected)+2 {
+				t.Errorf("Expected no other fields in the entry for %s but got %q", path, line)
+			}
+		}
+	}
+}
+
+func TestAccessLogTemplate(t *testing.T) {
+	t.Parallel()
+	var next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/miss" {
+			contexts.RecordCacheStatus(r.Context(), &types.CacheStatus{
+				Status: types.CacheStatusMiss, Zone: "zone1", Age: -1})
+			contexts.RecordUpstream(r.Context(), &types.UpstreamAddress{
+				URL: url.URL{Scheme: "http", Host: "upstream:8080"}})
+			contexts.RecordUpstreamTime(r.Context(), 1500*time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("body"))
+	})
+
+	var logs = make(chanWriter, 1)
+	var format = `$remote_addr "$request" $status $body_bytes_sent ${upstream_cache_status}:$upstream_addr ` +
+		`$upstream_response_time "$http_user_agent" $request_id`
+	// the cache status is in the template even without the setting
+	handler, err := loggingHandler(next, logs, format, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"/miss":  `192.0.2.1 "GET /miss HTTP/1.1" 200 4 MISS:upstream:8080 1.500 "nedomi \"test\"" req-1` + "\n",
+		"/other": `192.0.2.1 "GET /other HTTP/1.1" 200 4 -:- - "nedomi \"test\"" req-1` + "\n",
+	} {
+		var req = httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Set("User-Agent", `nedomi "test"`)
+		req = req.WithContext(contexts.NewIDContext(req.Context(), types.RequestID("req-1")))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		select {
+		case line := <-logs:
+			if line != expected {
+				t.Errorf("Expected the entry for %s to be\n%q\nbut it is\n%q", path, expected, line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No access log entry for %s", path)
+		}
+	}
+}
+
+func TestCompileLogTemplateErrors(t *testing.T) {
+	t.Parallel()
+	for _, format := range []string{
+		"$status $unknown",
+		"$status ${status",
+		"100$ $status",
+		"$http_",
+	} {
+		if _, err := compileLogTemplate(format); err == nil {
+			t.Errorf("Expected an error for the access log format %q", format)
+		}
+	}
+	if _, err := loggingHandler(http.NotFoundHandler(), ioutil.Discard, "$nope", true, false); err == nil {
+		t.Error("Expected the logging handler to fail with an invalid template")
+	}
+}
@@ -0,0 +1,352 @@
+// Package lfu contains a LFU cache eviction implementation. The access counts
+// of the parts decay with time, so parts which were popular once but are not
+// requested anymore are eventually evicted.
+package lfu
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+)
+
+// defaultDecayInterval is used when the cache zone does not set one
+const defaultDecayInterval = 10 * time.Minute
+
+// entry is a single part in the cache.
+type entry struct {
+	oi types.ObjectIndex
+	// the decayed access count of the part
+	count uint64
+	// the value of the access clock on the last access of the part. Parts
+	// with equal counts are evicted in least recently used order.
+	lastAccess uint64
+	// the eviction weight of the part, by the size of its object
+	weight float64
+	// the index of the entry in the heap
+	index int
+}
+
+// score returns the access count of the entry divided by its eviction weight.
+// The entries with the lowest scores are evicted first.
+func (en *entry) score() float64 {
+	return float64(en.count) / en.weight
+}
+
+// entries is a min-heap of the cache entries by their access counts.
+type entries []*entry
+
+func (e entries) Len() int { return len(e) }
+
+func (e entries) Less(i, j int) bool {
+	if ci, cj := e[i].score(), e[j].score(); ci != cj {
+		return ci < cj
+	}
+	return e[i].lastAccess < e[j].lastAccess
+}
+
+func (e entries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].index = i
+	e[j].index = j
+}
+
+func (e *entries) Push(x interface{}) {
+	var en = x.(*entry)
+	en.index = len(*e)
+	*e = append(*e, en)
+}
+
+func (e *entries) Pop() interface{} {
+	var old = *e
+	var en = old[len(old)-1]
+	old[len(old)-1] = nil
+	*e = old[:len(old)-1]
+	return en
+}
+
+// LFUCache implements a least frequently used cache. The access counts of all
+// parts are halved every decay interval. The counts can be weighted by the
+// sizes of the objects of the parts, see cacheutils.ObjectSizes.
+type LFUCache struct {
+	types.SyncLogger
+
+	cfg *config.CacheZone
+
+	mutex  sync.Mutex
+	heap   entries
+	lookup map[types.ObjectIndexHash]*entry
+	sizes  *cacheutils.ObjectSizes
+
+	// the access clock, increased on every access
+	clock         uint64
+	decayInterval time.Duration
+	lastDecay     time.Time
+	now           func() time.Time
+
+	removeFunc func(*types.ObjectIndex) error
+
+	// Used to track cache hit/miss information
+	requests uint64
+	hits     uint64
+}
+
+// Lookup implements part of types.CacheAlgorithm interface
+func (c *LFUCache) Lookup(oi *types.ObjectIndex) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.requests++
+
+	_, ok := c.lookup[oi.Hash()]
+
+	if ok {
+		c.hits++
+	}
+
+	return ok
+}
+
+// ShouldKeep implements part of types.CacheAlgorithm interface
+func (c *LFUCache) ShouldKeep(oi *types.ObjectIndex) bool {
+	if err := c.AddObject(oi); err != nil && err != types.ErrAlreadyInCache {
+		c.GetLogger().Errorf("Error storing object: %s", err)
+	}
+	return true
+}
+
+// AddObject implements part of types.CacheAlgorithm interface
+func (c *LFUCache) AddObject(oi *types.ObjectIndex) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.lookup[oi.Hash()]; ok {
+		return types.ErrAlreadyInCache
+	}
+	c.decay()
+
+	var bytes = c.sizes.PartBytes(oi)
+	for (uint64(len(c.heap)) >= c.cfg.StorageObjects || c.overSize(bytes)) && len(c.heap) > 0 {
+		c.evict()
+	}
+
+	c.clock++
+	c.sizes.AddPart(oi)
+	var en = &entry{oi: *oi, count: 1, lastAccess: c.clock, weight: c.sizes.Weight(oi)}
+	heap.Push(&c.heap, en)
+
+	c.GetLogger().Debugf("Storing %s in lfu", oi)
+	c.lookup[oi.Hash()] = en
+
+	return nil
+}
+
+// evict removes the least frequently used part from the cache. It must be
+// called with the mutex held.
+func (c *LFUCache) evict() {
+	var en = heap.Pop(&c.heap).(*entry)
+	delete(c.lookup, en.oi.Hash())
+	c.sizes.RemovePart(&en.oi)
+	if err := c.removeFunc(&en.oi); err != nil {
+		c.GetLogger().Logf("error while removing %s from cache - %s", &en.oi, err)
+	}
+}
+
+// ReclaimSpace implements types.SpaceReclaimer. It evicts the least
+// frequently used parts.
+func (c *LFUCache) ReclaimSpace(bytes uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for freed := uint64(0); freed < bytes && len(c.heap) > 0; {
+		freed += c.sizes.PartBytes(&c.heap[0].oi)
+		c.evict()
+	}
+}
+
+// overSize returns whether the parts in the cache and the additional bytes
+// are over the maximum size of the cache zone. It must be called with the
+// mutex held.
+func (c *LFUCache) overSize(additional uint64) bool {
+	return c.cfg.MaxSize > 0 && c.sizes.Bytes()+additional > uint64(c.cfg.MaxSize)
+}
+
+// decay halves the access counts of all parts once for every decay interval
+// which has passed since the last decay. It must be called with the mutex
+// held.
+func (c *LFUCache) decay() {
+	var periods = c.now().Sub(c.lastDecay) / c.decayInterval
+	if periods <= 0 {
+		return
+	}
+	c.lastDecay = c.lastDecay.Add(periods * c.decayInterval)
+
+	var shift = uint(64)
+	if periods < 64 {
+		shift = uint(periods)
+	}
+	for _, en := range c.heap {
+		if shift >= 64 {
+			en.count = 0
+		} else {
+			en.count >>= shift
+		}
+	}
+	// the order of the parts whose counts became equal may have changed
+	heap.Init(&c.heap)
+}
+
+// Remove the objects given from the cache.
+func (c *LFUCache) Remove(ois ...*types.ObjectIndex) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, oi := range ois {
+		if en, ok := c.lookup[oi.Hash()]; ok {
+			delete(c.lookup, oi.Hash())
+			heap.Remove(&c.heap, en.index)
+			c.sizes.RemovePart(oi)
+		}
+	}
+}
+
+// PromoteObject implements part of types.CacheAlgorithm interface.
+// It increases the access count of the object index.
+func (c *LFUCache) PromoteObject(oi *types.ObjectIndex) {
+	c.mutex.Lock()
+	en, ok := c.lookup[oi.Hash()]
+	if !ok {
+		c.mutex.Unlock()
+
+		// This object is not in the cache yet. So we add it.
+		if err := c.AddObject(oi); err != nil {
+			c.GetLogger().Errorf("Adding object in cache failed. Object: %v\n%s", oi, err)
+		}
+		return
+	}
+	defer c.mutex.Unlock()
+
+	c.decay()
+	c.clock++
+	en.count++
+	en.lastAccess = c.clock
+	heap.Fix(&c.heap, en.index)
+}
+
+// SetObjectSize implements the types.ObjectSizeTracker interface. It changes
+// the eviction weights of the parts of the object which are already in the
+// cache.
+func (c *LFUCache) SetObjectSize(id *types.ObjectID, size uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.sizes.Set(id, size) {
+		return
+	}
+	for part, parts := uint64(0), c.sizes.Parts(id); part < parts; part++ {
+		var oi = &types.ObjectIndex{ObjID: id, Part: uint32(part)}
+		if en, ok := c.lookup[oi.Hash()]; ok {
+			en.weight = c.sizes.Weight(oi)
+			heap.Fix(&c.heap, en.index)
+		}
+	}
+}
+
+// ConsumedSize implements part of types.CacheAlgorithm interface
+func (c *LFUCache) ConsumedSize() types.BytesSize {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return types.BytesSize(c.sizes.Bytes())
+}
+
+// New returns LFUCache object ready for use.
+func New(cz *config.CacheZone, removeFunc func(*types.ObjectIndex) error,
+	logger types.Logger) *LFUCache {
+
+	var decayInterval = time.Duration(cz.DecayInterval) * time.Second
+	if decayInterval <= 0 {
+		decayInterval = defaultDecayInterval
+	}
+	lfu := &LFUCache{
+		cfg:           cz,
+		removeFunc:    removeFunc,
+		lookup:        make(map[types.ObjectIndexHash]*entry),
+		sizes:         cacheutils.NewObjectSizes(cz.PartSize, cz.EvictionSizeBias),
+		decayInterval: decayInterval,
+		lastDecay:     time.Now(),
+		now:           time.Now,
+	}
+	lfu.SetLogger(logger)
+	return lfu
+}
+
+// ChangeConfig changes the LFUCache config and start using it
+func (c *LFUCache) ChangeConfig(bulkRemoveTimout, bulkRemoveCount, newsize uint64,
+	maxSize types.BytesSize) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cfg.StorageObjects = newsize
+	c.cfg.MaxSize = maxSize
+	c.cfg.BulkRemoveCount = bulkRemoveCount
+	c.cfg.BulkRemoveTimeout = bulkRemoveTimout
+
+	var removed []types.ObjectIndex
+	for (uint64(len(c.heap)) > newsize || c.overSize(0)) && len(c.heap) > 0 {
+		var en = heap.Pop(&c.heap).(*entry)
+		delete(c.lookup, en.oi.Hash())
+		c.sizes.RemovePart(&en.oi)
+		removed = append(removed, en.oi)
+	}
+	if len(removed) > 0 {
+		go c.throttledRemove(removed)
+	}
+}
+
+// remove the elements with time in between removes,
+// but only if they are not in the cache at the time of removal
+func (c *LFUCache) throttledRemove(indexes []types.ObjectIndex) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			c.GetLogger().Errorf(
+				"Panic during throttled remove after resize down: %v\n%s",
+				msg, buf)
+		}
+	}()
+	var bulk = int(c.cfg.BulkRemoveCount)
+	if bulk <= 0 {
+		bulk = len(indexes)
+	}
+	var timer = time.NewTimer(0)
+	for i, n := 0, len(indexes); n > i; i += bulk {
+		c.removeIfMissing(indexes[i:min(i+bulk, n)]...)
+		timer.Reset(time.Duration(c.cfg.BulkRemoveTimeout) * time.Millisecond)
+		<-timer.C
+	}
+}
+
+func min(l, r int) int {
+	if l > r {
+		return r
+	}
+	return l
+}
+
+func (c *LFUCache) removeIfMissing(ois ...types.ObjectIndex) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range ois {
+		if _, ok := c.lookup[ois[i].Hash()]; !ok {
+			if err := c.removeFunc(&ois[i]); err != nil {
+				c.GetLogger().Logf("error while removing %s from cache - %s", &ois[i], err)
+			}
+		}
+	}
+}
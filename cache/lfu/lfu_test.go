@@ -0,0 +1,299 @@
+package lfu
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func getCacheZone(objects uint64) *config.CacheZone {
+	return &config.CacheZone{
+		ID:             "default",
+		Path:           "/some/path",
+		StorageObjects: objects,
+		PartSize:       2 * 1024 * 1024,
+		Algorithm:      "lfu",
+		DecayInterval:  60,
+	}
+}
+
+func getObjectIndex(part uint32) *types.ObjectIndex {
+	return &types.ObjectIndex{
+		Part:  part,
+		ObjID: types.NewObjectID("1.1", "/path"),
+	}
+}
+
+// removeRecorder records the parts removed by the cache algorithm
+type removeRecorder struct {
+	sync.Mutex
+	removed []uint32
+}
+
+func (r *removeRecorder) remove(oi *types.ObjectIndex) error {
+	r.Lock()
+	defer r.Unlock()
+	r.removed = append(r.removed, oi.Part)
+	return nil
+}
+
+func (r *removeRecorder) get() []uint32 {
+	r.Lock()
+	defer r.Unlock()
+	return append([]uint32(nil), r.removed...)
+}
+
+func expectRemoved(t *testing.T, r *removeRecorder, expected ...uint32) {
+	var removed = r.get()
+	if len(removed) != len(expected) {
+		t.Fatalf("Expected %v to be removed but got %v", expected, removed)
+	}
+	for i := range expected {
+		if removed[i] != expected[i] {
+			t.Fatalf("Expected %v to be removed but got %v", expected, removed)
+		}
+	}
+}
+
+func TestLookupAndRemove(t *testing.T) {
+	t.Parallel()
+	oi := getObjectIndex(3)
+	lfu := New(getCacheZone(30), nil, mock.NewLogger())
+
+	if lfu.Lookup(oi) {
+		t.Error("Empty LFU cache returned True for a object index lookup")
+	}
+	if err := lfu.AddObject(oi); err != nil {
+		t.Errorf("Error adding object into the cache. %s", err)
+	}
+	if err := lfu.AddObject(getObjectIndex(3)); err != types.ErrAlreadyInCache {
+		t.Errorf("Expected ErrAlreadyInCache when adding the object again but got %v", err)
+	}
+	if !lfu.Lookup(getObjectIndex(3)) {
+		t.Error("Lookup for object index which was just added returned false")
+	}
+
+	lfu.Remove(oi)
+
+	if lfu.Lookup(oi) {
+		t.Error("Lookup for object index which was just removed returned true")
+	}
+	if stats := lfu.Stats(); stats.Requests() != 3 || stats.Hits() != 1 || stats.Objects() != 0 {
+		t.Errorf("Unexpected stats: %d requests, %d hits, %d objects",
+			stats.Requests(), stats.Hits(), stats.Objects())
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	t.Parallel()
+	var r = new(removeRecorder)
+	cz := getCacheZone(4)
+	lfu := New(cz, r.remove, mock.NewLogger())
+
+	// part number n is accessed n+1 times, except for part 0 which is
+	// accessed the most but before all the others
+	for i := 0; i < 10; i++ {
+		lfu.PromoteObject(getObjectIndex(0))
+	}
+	for part := uint32(1); part < 4; part++ {
+		for i := uint32(0); i <= part; i++ {
+			lfu.PromoteObject(getObjectIndex(part))
+		}
+	}
+	expectRemoved(t, r)
+
+	// the least frequently used part makes space for the new one
+	lfu.PromoteObject(getObjectIndex(4))
+	expectRemoved(t, r, 1)
+
+	// the new part has the lowest count. Between equal counts the least
+	// recently used one is evicted.
+	lfu.PromoteObject(getObjectIndex(5))
+	expectRemoved(t, r, 1, 4)
+	lfu.PromoteObject(getObjectIndex(5))
+	lfu.PromoteObject(getObjectIndex(2))
+	lfu.PromoteObject(getObjectIndex(6))
+	expectRemoved(t, r, 1, 4, 5)
+
+	for _, part := range []uint32{0, 2, 3, 6} {
+		if !lfu.Lookup(getObjectIndex(part)) {
+			t.Errorf("Expected part %d to be in the cache", part)
+		}
+	}
+	if size, expected := lfu.ConsumedSize(), 4*cz.PartSize; size != expected {
+		t.Errorf("Expected total size to be %d but it was %d", expected, size)
+	}
+}
+
+func TestCountsDecay(t *testing.T) {
+	t.Parallel()
+	var r = new(removeRecorder)
+	lfu := New(getCacheZone(2), r.remove, mock.NewLogger())
+	var now = time.Now()
+	lfu.now = func() time.Time { return now }
+	lfu.lastDecay = now
+
+	// the old hot part
+	for i := 0; i < 64; i++ {
+		lfu.PromoteObject(getObjectIndex(0))
+	}
+	lfu.PromoteObject(getObjectIndex(1))
+
+	now = now.Add(3 * time.Minute) // 64 >> 3 == 8
+	for i := 0; i < 10; i++ {
+		lfu.PromoteObject(getObjectIndex(1))
+	}
+	if en := lfu.lookup[getObjectIndex(0).Hash()]; en.count != 8 {
+		t.Errorf("Expected the count of part 0 to decay to 8 but it is %d", en.count)
+	}
+
+	lfu.PromoteObject(getObjectIndex(2))
+	expectRemoved(t, r, 0)
+
+	// everything decays to zero after a long time
+	now = now.Add(24 * time.Hour)
+	lfu.PromoteObject(getObjectIndex(2))
+	lfu.PromoteObject(getObjectIndex(3))
+	expectRemoved(t, r, 0, 1)
+}
+
+func TestResizeDown(t *testing.T) {
+	t.Parallel()
+	var r = new(removeRecorder)
+	lfu := New(getCacheZone(10), r.remove, mock.NewLogger())
+	for part := uint32(0); part < 10; part++ {
+		for i := uint32(0); i <= part; i++ {
+			lfu.PromoteObject(getObjectIndex(part))
+		}
+	}
+
+	lfu.ChangeConfig(1, 2, 6, 0)
+	if objects := lfu.Stats().Objects(); objects != 6 {
+		t.Errorf("Expected 6 objects after the resize but there are %d", objects)
+	}
+	for i := 0; i < 100 && len(r.get()) < 4; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	expectRemoved(t, r, 0, 1, 2, 3)
+}
+
+func TestEvictionSizeBias(t *testing.T) {
+	t.Parallel()
+	var small = types.NewObjectID("1.1", "/small")
+	var big = types.NewObjectID("1.1", "/big")
+	var evict = func(bias float64) []*types.ObjectIndex {
+		var removed []*types.ObjectIndex
+		cz := getCacheZone(4)
+		cz.EvictionSizeBias = bias
+		lfu := New(cz, func(oi *types.ObjectIndex) error {
+			removed = append(removed, oi)
+			return nil
+		}, mock.NewLogger())
+
+		// the small object is accessed before the big one, which gets its
+		// size after its parts are added as when its length is not known
+		lfu.SetObjectSize(small, uint64(2*cz.PartSize))
+		for _, oi := range []*types.ObjectIndex{
+			{ObjID: small, Part: 0}, {ObjID: small, Part: 1},
+			{ObjID: big, Part: 0}, {ObjID: big, Part: 1},
+		} {
+			lfu.PromoteObject(oi)
+			lfu.PromoteObject(oi)
+		}
+		lfu.SetObjectSize(big, uint64(20*cz.PartSize))
+
+		lfu.PromoteObject(&types.ObjectIndex{ObjID: small, Part: 2})
+		lfu.PromoteObject(&types.ObjectIndex{ObjID: big, Part: 2})
+		return removed
+	}
+
+	for _, test := range []struct {
+		bias     float64
+		expected *types.ObjectID
+	}{
+		{bias: 0, expected: small},
+		{bias: 1, expected: big},
+		{bias: -1, expected: small},
+	} {
+		var removed = evict(test.bias)
+		if len(removed) != 2 {
+			t.Errorf("Expected 2 parts to be evicted with bias %g but got %v", test.bias, removed)
+			continue
+		}
+		for _, oi := range removed {
+			if oi.ObjID != test.expected {
+				t.Errorf("Expected only parts of %s to be evicted with bias %g but got %v",
+					test.expected, test.bias, removed)
+			}
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	t.Parallel()
+	var r = new(removeRecorder)
+	cz := getCacheZone(100)
+	cz.MaxSize = 3 * cz.PartSize
+	lfu := New(cz, r.remove, mock.NewLogger())
+
+	// every object is half a part, so the byte limit is hit long before the
+	// object count
+	var half = uint64(cz.PartSize / 2)
+	for i := uint32(0); i < 7; i++ {
+		var oi = &types.ObjectIndex{ObjID: types.NewObjectID("1.1", "/small/"+strconv.Itoa(int(i)))}
+		lfu.SetObjectSize(oi.ObjID, half)
+		lfu.PromoteObject(oi)
+		if i == 5 {
+			if size := lfu.Stats().Size(); size != cz.MaxSize {
+				t.Errorf("Expected the size of the cache to be %d but it is %d", cz.MaxSize, size)
+			}
+		}
+	}
+	if objects, size := lfu.Stats().Objects(), lfu.ConsumedSize(); objects != 6 || size != cz.MaxSize {
+		t.Errorf("Expected 6 objects in %d but got %d in %d", cz.MaxSize, objects, size)
+	}
+	if removed := r.get(); len(removed) != 1 {
+		t.Errorf("Expected a single part to be evicted but got %v", removed)
+	}
+
+	lfu.ChangeConfig(1, 2, 100, 2*cz.PartSize)
+	if objects, size := lfu.Stats().Objects(), lfu.Stats().Size(); objects != 4 || size != 2*cz.PartSize {
+		t.Errorf("Expected 4 objects in %d after the resize but got %d in %d",
+			2*cz.PartSize, objects, size)
+	}
+	for i := 0; i < 100 && len(r.get()) < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if removed := r.get(); len(removed) != 3 {
+		t.Errorf("Expected 3 evicted parts after the resize but got %v", removed)
+	}
+}
+
+func TestReclaimSpace(t *testing.T) {
+	t.Parallel()
+	var r = new(removeRecorder)
+	cz := getCacheZone(10)
+	lfu := New(cz, r.remove, mock.NewLogger())
+	for i := uint32(0); i < 4; i++ {
+		var oi = getObjectIndex(i)
+		// the later parts are used more often
+		for j := uint32(0); j <= i; j++ {
+			lfu.PromoteObject(oi)
+		}
+	}
+
+	lfu.ReclaimSpace(uint64(cz.PartSize) + 1)
+	expectRemoved(t, r, 0, 1)
+	if objects := lfu.Stats().Objects(); objects != 2 {
+		t.Errorf("Expected 2 parts to be left but there are %d", objects)
+	}
+	lfu.ReclaimSpace(100 * uint64(cz.PartSize))
+	if objects := lfu.Stats().Objects(); objects != 0 {
+		t.Errorf("Expected the cache to be emptied but there are %d parts", objects)
+	}
+}
@@ -0,0 +1,79 @@
+package lfu
+
+// This file contains the LFUCache's implementation of the CacheStats interface.
+
+import (
+	"fmt"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// CacheStats is used by the LFUCache to implement the CacheStats interface.
+type CacheStats struct {
+	id       string
+	hits     uint64
+	requests uint64
+	size     types.BytesSize
+	objects  uint64
+	capacity uint64
+	maxSize  types.BytesSize
+}
+
+// CacheHitPrc implements part of CacheStats interface
+func (cs *CacheStats) CacheHitPrc() string {
+	if cs.requests == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.f%%", (float32(cs.Hits())/float32(cs.Requests()))*100)
+}
+
+// ID implements part of CacheStats interface
+func (cs *CacheStats) ID() string {
+	return cs.id
+}
+
+// Hits implements part of CacheStats interface
+func (cs *CacheStats) Hits() uint64 {
+	return cs.hits
+}
+
+// Size implements part of CacheStats interface
+func (cs *CacheStats) Size() types.BytesSize {
+	return cs.size
+}
+
+// Objects implements part of CacheStats interface
+func (cs *CacheStats) Objects() uint64 {
+	return cs.objects
+}
+
+// Capacity implements part of CacheStats interface
+func (cs *CacheStats) Capacity() uint64 {
+	return cs.capacity
+}
+
+// MaxSize implements part of CacheStats interface
+func (cs *CacheStats) MaxSize() types.BytesSize {
+	return cs.maxSize
+}
+
+// Requests implements part of CacheStats interface
+func (cs *CacheStats) Requests() uint64 {
+	return cs.requests
+}
+
+// Stats implements part of types.CacheAlgorithm interface
+func (c *LFUCache) Stats() types.CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return &CacheStats{
+		id:       c.cfg.Path,
+		hits:     c.hits,
+		requests: c.requests,
+		size:     types.BytesSize(c.sizes.Bytes()),
+		objects:  uint64(len(c.heap)),
+		capacity: c.cfg.StorageObjects,
+		maxSize:  c.cfg.MaxSize,
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/cacheutils"
 )
 
 var debug bool
@@ -25,6 +26,10 @@ const (
 	// How many segments are there in the cache. 0 is the "best" segment in sense that
 	// it contains the most recent files.
 	cacheTiers = 4
+
+	// How many of the least recently used parts are considered for eviction
+	// when the eviction is weighted by the sizes of the objects.
+	evictionCandidates = 8
 )
 
 // Element is stored in the cache lookup hashmap
@@ -44,6 +49,7 @@ type TieredLRUCache struct {
 
 	tiers  [cacheTiers]*list.List
 	lookup map[types.ObjectIndexHash]*Element
+	sizes  *cacheutils.ObjectSizes
 	mutex  sync.Mutex
 
 	tierListSize int
@@ -88,6 +94,12 @@ func (tc *TieredLRUCache) AddObject(oi *types.ObjectIndex) error {
 		return types.ErrAlreadyInCache
 	}
 
+	for _, val := range tc.removeOverSize(tc.sizes.PartBytes(oi)) {
+		if err := tc.removeFunc(&val); err != nil {
+			tc.GetLogger().Logf("error while removing %s from cache - %s", &val, err)
+		}
+	}
+
 	lastList := tc.tiers[cacheTiers-1]
 
 	if lastList.Len() >= tc.tierListSize {
@@ -98,6 +110,7 @@ func (tc *TieredLRUCache) AddObject(oi *types.ObjectIndex) error {
 		ListTier: cacheTiers - 1,
 		ListElem: lastList.PushFront(*oi),
 	}
+	tc.sizes.AddPart(oi)
 
 	tc.GetLogger().Debugf("Storing %s in lru", oi)
 	tc.lookup[oi.Hash()] = le
@@ -147,14 +160,75 @@ func (tc *TieredLRUCache) freeSpaceInLastList() {
 	} else {
 		// There is no free slots anywhere in the upper tiers. So we will have to
 		// remove something from the cache in order to make space.
-		val := lastList.Remove(lastList.Back()).(types.ObjectIndex)
+		val := lastList.Remove(tc.evictionCandidate(lastList)).(types.ObjectIndex)
 		delete(tc.lookup, val.Hash())
+		tc.sizes.RemovePart(&val)
 		if err := tc.removeFunc(&val); err != nil {
 			tc.GetLogger().Logf("error while removing %s from cache - %s", &val, err)
 		}
 	}
 }
 
+// removeOverSize removes parts from the cache, starting with the least
+// recently used ones, until the parts in it and the additional bytes fit in
+// the maximum size of the cache zone. The removed parts are returned and it is
+// up to the caller to remove them from the storage.
+func (tc *TieredLRUCache) removeOverSize(additional uint64) []types.ObjectIndex {
+	var removed []types.ObjectIndex
+	var maxSize = uint64(tc.cfg.MaxSize)
+	for i := cacheTiers - 1; i >= 0 && maxSize > 0; i-- {
+		var l = tc.tiers[i]
+		for l.Len() > 0 && tc.sizes.Bytes()+additional > maxSize {
+			val := l.Remove(tc.evictionCandidate(l)).(types.ObjectIndex)
+			delete(tc.lookup, val.Hash())
+			tc.sizes.RemovePart(&val)
+			removed = append(removed, val)
+		}
+	}
+	return removed
+}
+
+// ReclaimSpace implements types.SpaceReclaimer. It evicts the least recently
+// used parts and removes them from the storage in bulks, like the ones
+// evicted on resize.
+func (tc *TieredLRUCache) ReclaimSpace(bytes uint64) {
+	tc.mutex.Lock()
+	var removed []types.ObjectIndex
+	var freed uint64
+	for i := cacheTiers - 1; i >= 0 && freed < bytes; i-- {
+		var l = tc.tiers[i]
+		for l.Len() > 0 && freed < bytes {
+			val := l.Remove(tc.evictionCandidate(l)).(types.ObjectIndex)
+			freed += tc.sizes.PartBytes(&val)
+			delete(tc.lookup, val.Hash())
+			tc.sizes.RemovePart(&val)
+			removed = append(removed, val)
+		}
+	}
+	tc.mutex.Unlock()
+	tc.throttledRemove(removed)
+}
+
+// evictionCandidate returns the element of the list which should be evicted.
+// It is the last one unless the eviction is weighted by the sizes of the
+// objects. Then it is the one with the largest eviction weight divided by its
+// position from the back among the last evictionCandidates elements.
+func (tc *TieredLRUCache) evictionCandidate(l *list.List) *list.Element {
+	var result = l.Back()
+	if !tc.sizes.Enabled() {
+		return result
+	}
+	var best float64
+	var e = result
+	for i := 0; i < evictionCandidates && e != nil; i, e = i+1, e.Prev() {
+		var oi = e.Value.(types.ObjectIndex)
+		if score := tc.sizes.Weight(&oi) / float64(i+1); score > best {
+			best, result = score, e
+		}
+	}
+	return result
+}
+
 // Remove the objects given from the cache.
 func (tc *TieredLRUCache) Remove(ois ...*types.ObjectIndex) {
 	tc.mutex.Lock()
@@ -164,6 +238,7 @@ func (tc *TieredLRUCache) Remove(ois ...*types.ObjectIndex) {
 		if el, ok := tc.lookup[oi.Hash()]; ok {
 			delete(tc.lookup, oi.Hash())
 			tc.tiers[el.ListTier].Remove(el.ListElem)
+			tc.sizes.RemovePart(oi)
 		}
 	}
 }
@@ -245,6 +320,14 @@ func (tc *TieredLRUCache) checkTiers() {
 	}
 }
 
+// SetObjectSize implements the types.ObjectSizeTracker interface.
+func (tc *TieredLRUCache) SetObjectSize(id *types.ObjectID, size uint64) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	tc.sizes.Set(id, size)
+}
+
 // ConsumedSize implements part of types.CacheAlgorithm interface
 func (tc *TieredLRUCache) ConsumedSize() types.BytesSize {
 	tc.mutex.Lock()
@@ -254,13 +337,7 @@ func (tc *TieredLRUCache) ConsumedSize() types.BytesSize {
 }
 
 func (tc *TieredLRUCache) consumedSize() types.BytesSize {
-	var sum types.BytesSize
-
-	for i := 0; i < cacheTiers; i++ {
-		sum += (tc.cfg.PartSize * types.BytesSize(tc.tiers[i].Len()))
-	}
-
-	return sum
+	return types.BytesSize(tc.sizes.Bytes())
 }
 
 func (tc *TieredLRUCache) init() {
@@ -268,6 +345,7 @@ func (tc *TieredLRUCache) init() {
 		tc.tiers[i] = list.New()
 	}
 	tc.lookup = make(map[types.ObjectIndexHash]*Element)
+	tc.sizes = cacheutils.NewObjectSizes(tc.cfg.PartSize, tc.cfg.EvictionSizeBias)
 	tc.tierListSize = int(tc.cfg.StorageObjects / uint64(cacheTiers))
 }
 
@@ -285,10 +363,12 @@ func New(cz *config.CacheZone, removeFunc func(*types.ObjectIndex) error,
 }
 
 // ChangeConfig changes the TieredLRUCache config and start using it
-func (tc *TieredLRUCache) ChangeConfig(bulkRemoveTimout, bulkRemoveCount, newsize uint64) {
+func (tc *TieredLRUCache) ChangeConfig(bulkRemoveTimout, bulkRemoveCount, newsize uint64,
+	maxSize types.BytesSize) {
 	tc.mutex.Lock()
 	defer tc.mutex.Unlock()
 	tc.cfg.StorageObjects = newsize
+	tc.cfg.MaxSize = maxSize
 	tc.cfg.BulkRemoveCount = bulkRemoveCount
 	tc.cfg.BulkRemoveTimeout = bulkRemoveTimout
 	tc.resize()
@@ -304,8 +384,9 @@ func (tc *TieredLRUCache) resize() {
 	if tc.tierListSize > newtierListSize {
 		var oids = tc.resizeDown(int(tc.stats().Objects() - tc.cfg.StorageObjects))
 
-		for _, oi := range oids {
-			delete(tc.lookup, oi.Hash())
+		for i := range oids {
+			delete(tc.lookup, oids[i].Hash())
+			tc.sizes.RemovePart(&oids[i])
 		}
 
 		// for each tier from the upper most without the last
@@ -334,13 +415,18 @@ func (tc *TieredLRUCache) resize() {
 			additionalOids = append(additionalOids, last.Remove(last.Back()).(types.ObjectIndex))
 		}
 
-		for _, oi := range additionalOids {
-			delete(tc.lookup, oi.Hash())
+		for i := range additionalOids {
+			delete(tc.lookup, additionalOids[i].Hash())
+			tc.sizes.RemovePart(&additionalOids[i])
 		}
 
 		go tc.throttledRemove(append(oids, additionalOids...))
 	}
 	tc.tierListSize = newtierListSize
+
+	if removed := tc.removeOverSize(0); len(removed) > 0 {
+		go tc.throttledRemove(removed)
+	}
 }
 
 // remove the elements with time in between removes,
@@ -359,9 +445,13 @@ func (tc *TieredLRUCache) throttledRemove(indexes []types.ObjectIndex) {
 			}
 		}
 	}()
+	var bulk = int(tc.cfg.BulkRemoveCount)
+	if bulk <= 0 {
+		bulk = len(indexes)
+	}
 	var timer = time.NewTimer(0)
-	for i, n := 0, len(indexes); n > i; i += int(tc.cfg.BulkRemoveCount) {
-		tc.removeIfMissing(indexes[i:min(i+int(tc.cfg.BulkRemoveCount), n)]...)
+	for i, n := 0, len(indexes); n > i; i += bulk {
+		tc.removeIfMissing(indexes[i:min(i+bulk, n)]...)
 		timer.Reset(time.Duration(tc.cfg.BulkRemoveTimeout) * time.Millisecond)
 		<-timer.C
 	}
@@ -1,6 +1,7 @@
 package lru
 
 import (
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -270,7 +271,7 @@ func TestResizeUp(t *testing.T) {
 		ObjID: types.NewObjectID("1.1", "/path/to/tested/object"),
 	}
 	oldSize := lru.Stats().Objects()
-	lru.ChangeConfig(10, 50, oldSize+20)
+	lru.ChangeConfig(10, 50, oldSize+20, 0)
 	lru.PromoteObject(testOi)
 	if lru.Stats().Objects() != oldSize+1 {
 		t.Errorf("It was expected that after resize more objects could be added but that wasn't true")
@@ -281,7 +282,7 @@ func TestResizeDown(t *testing.T) {
 	t.Parallel()
 	lru := getFullLruCache(t)
 	oldSize := lru.Stats().Objects()
-	lru.ChangeConfig(1, 1, oldSize/2)
+	lru.ChangeConfig(1, 1, oldSize/2, 0)
 	var ch = make(chan struct{})
 	var wg sync.WaitGroup
 	for i := 0; 30 > i; i++ {
@@ -328,7 +329,7 @@ func TestResizeDownRemoves(t *testing.T) {
 		return nil
 	}
 	oldSize := lru.Stats().Objects()
-	lru.ChangeConfig(2, 2, oldSize/2)
+	lru.ChangeConfig(2, 2, oldSize/2, 0)
 
 	time.Sleep(500 * time.Millisecond) // give time for the Resize down to remove objects
 
@@ -352,7 +353,7 @@ func TestPromoteObjectInEachPositionAfterResize(t *testing.T) {
 	lru := getFullLruCache(t)
 	defer printOnFailure(t, lru)
 
-	lru.ChangeConfig(1, 100, lru.cfg.StorageObjects/2)
+	lru.ChangeConfig(1, 100, lru.cfg.StorageObjects/2, 0)
 
 	promoteObjectInEachPosition(t, lru)
 }
@@ -381,3 +382,136 @@ func printOnFailure(t *testing.T, lru *TieredLRUCache) {
 		panic(errors.WithStack(str.(error)).Error())
 	}
 }
+
+func TestEvictionSizeBias(t *testing.T) {
+	t.Parallel()
+	var big = types.NewObjectID("1.1", "/big")
+	var evict = func(bias float64) []*types.ObjectIndex {
+		cz := getCacheZone()
+		cz.StorageObjects = 32
+		cz.EvictionSizeBias = bias
+		var removed []*types.ObjectIndex
+		lru := New(cz, func(oi *types.ObjectIndex) error {
+			removed = append(removed, oi)
+			return nil
+		}, mock.NewLogger())
+
+		// the small objects are accessed before the parts of the big one
+		lru.SetObjectSize(big, uint64(16*cz.PartSize))
+		for i := 0; i < 20; i++ {
+			var small = types.NewObjectID("1.1", "/small/"+strconv.Itoa(i))
+			lru.SetObjectSize(small, uint64(cz.PartSize))
+			lru.PromoteObject(&types.ObjectIndex{ObjID: small})
+			if i < 16 {
+				lru.PromoteObject(&types.ObjectIndex{ObjID: big, Part: uint32(i)})
+			}
+		}
+		return removed
+	}
+
+	var countBig = func(ois []*types.ObjectIndex) (result int) {
+		for _, oi := range ois {
+			if oi.ObjID.Path() == "/big" {
+				result++
+			}
+		}
+		return result
+	}
+
+	if removed := evict(0); len(removed) != 4 || countBig(removed) != 2 ||
+		removed[0].ObjID.Path() != "/small/0" {
+		t.Errorf("Expected the least recently used parts to be evicted without a bias "+
+			"but got %v", removed)
+	}
+	if removed := evict(1); len(removed) != 4 || countBig(removed) != 4 {
+		t.Errorf("Expected the parts of the big object to be evicted first but got %v", removed)
+	}
+	if removed := evict(-1); len(removed) != 4 || countBig(removed) != 0 {
+		t.Errorf("Expected the parts of the big object to be protected but got %v", removed)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	t.Parallel()
+	cz := getCacheZone()
+	cz.StorageObjects = 100
+	cz.MaxSize = 4 * cz.PartSize
+	var mu sync.Mutex
+	var removed []string
+	lru := New(cz, func(oi *types.ObjectIndex) error {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, oi.ObjID.Path())
+		return nil
+	}, mock.NewLogger())
+	var getRemoved = func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), removed...)
+	}
+
+	// every object is a quarter of a part, so the byte limit is hit long
+	// before the object count
+	var quarter = uint64(cz.PartSize / 4)
+	for i := 0; i < 20; i++ {
+		var oi = &types.ObjectIndex{ObjID: types.NewObjectID("1.1", "/small/"+strconv.Itoa(i))}
+		lru.SetObjectSize(oi.ObjID, quarter)
+		lru.PromoteObject(oi)
+	}
+	if objects, size := lru.Stats().Objects(), lru.Stats().Size(); objects != 16 || size != cz.MaxSize {
+		t.Errorf("Expected 16 objects in %d but got %d in %d", cz.MaxSize, objects, size)
+	}
+	if r := getRemoved(); len(r) != 4 || r[0] != "/small/0" || r[3] != "/small/3" {
+		t.Errorf("Expected the least recently used objects to be evicted but got %v", r)
+	}
+
+	// the parts of an object with an unknown size are counted as whole parts
+	lru.PromoteObject(&types.ObjectIndex{ObjID: types.NewObjectID("1.1", "/unknown")})
+	if objects, size := lru.Stats().Objects(), lru.ConsumedSize(); objects != 13 || size != cz.MaxSize {
+		t.Errorf("Expected 13 objects in %d but got %d in %d", cz.MaxSize, objects, size)
+	}
+
+	lru.ChangeConfig(1, 100, 100, cz.PartSize)
+	if objects, size := lru.Stats().Objects(), lru.Stats().Size(); objects != 1 || size != cz.PartSize {
+		t.Errorf("Expected a single object in %d after the resize but got %d in %d",
+			cz.PartSize, objects, size)
+	}
+	for i := 0; i < 100 && len(getRemoved()) < 20; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if r := getRemoved(); len(r) != 20 {
+		t.Errorf("Expected 20 evicted objects after the resize but got %v", r)
+	}
+}
+
+func TestReclaimSpace(t *testing.T) {
+	t.Parallel()
+	cz := getCacheZone()
+	var mu sync.Mutex
+	var removed []string
+	lru := New(cz, func(oi *types.ObjectIndex) error {
+		mu.Lock()
+		defer mu.Unlock()
+		removed = append(removed, oi.ObjID.Path())
+		return nil
+	}, mock.NewLogger())
+	for i := 0; i < 5; i++ {
+		lru.PromoteObject(&types.ObjectIndex{ObjID: types.NewObjectID("1.1", "/"+strconv.Itoa(i))})
+	}
+
+	// the least recently used parts are removed from the storage too
+	lru.ReclaimSpace(2*uint64(cz.PartSize) - 1)
+	if objects := lru.Stats().Objects(); objects != 3 {
+		t.Errorf("Expected 3 objects to be left but there are %d", objects)
+	}
+	mu.Lock()
+	if len(removed) != 2 || removed[0] != "/0" || removed[1] != "/1" {
+		t.Errorf("Expected the least recently used objects to be removed but got %v", removed)
+	}
+	mu.Unlock()
+
+	lru.ReclaimSpace(100 * uint64(cz.PartSize))
+	if objects := lru.Stats().Objects(); objects != 0 {
+		t.Errorf("Expected the cache to be emptied but there are %d objects", objects)
+	}
+}
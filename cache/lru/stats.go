@@ -17,6 +17,8 @@ type TieredCacheStats struct {
 	requests uint64
 	size     types.BytesSize
 	objects  uint64
+	capacity uint64
+	maxSize  types.BytesSize
 }
 
 // CacheHitPrc implements part of CacheStats interface
@@ -47,6 +49,16 @@ func (lcs *TieredCacheStats) Objects() uint64 {
 	return lcs.objects
 }
 
+// Capacity implements part of CacheStats interface
+func (lcs *TieredCacheStats) Capacity() uint64 {
+	return lcs.capacity
+}
+
+// MaxSize implements part of CacheStats interface
+func (lcs *TieredCacheStats) MaxSize() types.BytesSize {
+	return lcs.maxSize
+}
+
 // Requests implements part of CacheStats interface
 func (lcs *TieredCacheStats) Requests() uint64 {
 	return lcs.requests
@@ -60,20 +72,19 @@ func (tc *TieredLRUCache) Stats() types.CacheStats {
 }
 
 func (tc *TieredLRUCache) stats() types.CacheStats {
-	var sum types.BytesSize
 	var allObjects uint64
 
 	for i := 0; i < cacheTiers; i++ {
-		objects := types.BytesSize(tc.tiers[i].Len())
-		sum += (tc.cfg.PartSize * objects)
-		allObjects += uint64(objects)
+		allObjects += uint64(tc.tiers[i].Len())
 	}
 
 	return &TieredCacheStats{
 		id:       tc.cfg.Path,
 		hits:     tc.hits,
 		requests: tc.requests,
-		size:     sum,
+		size:     tc.consumedSize(),
 		objects:  allObjects,
+		capacity: tc.cfg.StorageObjects,
+		maxSize:  tc.cfg.MaxSize,
 	}
 }
@@ -8,6 +8,8 @@ import (
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
 
+	"github.com/ironsmile/nedomi/cache/lfu"
+
 	"github.com/ironsmile/nedomi/cache/lru"
 )
 
@@ -15,6 +17,11 @@ type newCacheFunc func(*config.CacheZone, func(*types.ObjectIndex) error, types.
 
 var cacheTypes = map[string]newCacheFunc{
 
+	"lfu": func(cz *config.CacheZone, remove func(*types.ObjectIndex) error,
+		logger types.Logger) types.CacheAlgorithm {
+		return lfu.New(cz, remove, logger)
+	},
+
 	"lru": func(cz *config.CacheZone, remove func(*types.ObjectIndex) error,
 		logger types.Logger) types.CacheAlgorithm {
 		return lru.New(cz, remove, logger)
@@ -118,6 +118,12 @@ func TestConfigVerification(t *testing.T) {
 		"No error with wrong cache default duration in vhost": func(cfg *Config) {
 			cfg.HTTP.Servers[0].CacheDefaultDuration = -1 * time.Hour
 		},
+		"No error with wrong absolute_form_requests": func(cfg *Config) {
+			cfg.HTTP.AbsoluteFormRequests = "forward"
+		},
+		"No error with wrong access_log_format": func(cfg *Config) {
+			cfg.HTTP.AccessLogFormat = "xml"
+		},
 	}
 
 	for errorStr, fnc := range tests {
@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/ironsmile/nedomi/types"
 )
@@ -17,6 +18,139 @@ type CacheZone struct {
 	BulkRemoveCount    uint64          `json:"bulk_remove_count"`
 	BulkRemoveTimeout  uint64          `json:"bulk_remove_timeout"`
 	SkipCacheKeyInPath bool            `json:"skip_cache_key_in_path"`
+	// CreatePathIfMissing makes the disk storage create its path if it does
+	// not exist instead of refusing to start.
+	CreatePathIfMissing bool `json:"create_path_if_missing"`
+	// SizeThreshold is used by the composite storage. Objects up to this size
+	// are kept in memory and larger ones are stored on the disk.
+	SizeThreshold types.BytesSize `json:"size_threshold"`
+	// VerifyChecksums makes the disk storage keep checksums of the saved
+	// parts and verify them when the parts are read.
+	VerifyChecksums bool `json:"verify_checksums"`
+	// Deduplicate makes the disk storage keep the parts with the same
+	// contents only once, no matter how many objects they belong to.
+	Deduplicate bool `json:"deduplicate"`
+	// BackgroundIO limits the storage operations which are not done for
+	// client requests.
+	BackgroundIO BackgroundIOLimits `json:"background_io"`
+	// ConcurrentIO limits how many parts the disk storage reads and writes
+	// at the same time for the requests.
+	ConcurrentIO ConcurrentIOLimits `json:"concurrent_io"`
+	// DecayInterval is used by the lfu cache algorithm. Every DecayInterval
+	// seconds the access counts of all parts are halved.
+	DecayInterval uint64 `json:"decay_interval"`
+	// EvictionSizeBias weights the eviction of the parts by the sizes of
+	// their objects. With positive values the parts of large objects are
+	// evicted earlier as they free the most space, with negative values
+	// they are protected as they are expensive to refetch. Zero disables it.
+	EvictionSizeBias float64 `json:"eviction_size_bias"`
+	// MaxSize limits the total size of the parts in the zone. The parts are
+	// evicted when either it or StorageObjects is reached, so the size of
+	// the zone can be bound even when its objects are smaller than
+	// PartSize. Zero disables it.
+	MaxSize types.BytesSize `json:"max_size"`
+	// ReloadMaxErrors and ReloadMaxErrorRatio abort the loading of the
+	// stored objects on start when more of them than the count or the
+	// fraction could not be loaded, which usually means that the contents
+	// of the zone are not compatible with its config. Zero disables them.
+	ReloadMaxErrors     uint64  `json:"reload_max_errors"`
+	ReloadMaxErrorRatio float64 `json:"reload_max_error_ratio"`
+	// GCInterval makes the disk storage look for orphaned files every
+	// GCInterval seconds: temporary files older than GCTempFileAge seconds
+	// which were left by interrupted writes and parts beyond the size of
+	// their objects. Zero disables it.
+	GCInterval    uint64 `json:"gc_interval"`
+	GCTempFileAge uint64 `json:"gc_temp_file_age"`
+	// MetadataCompactionInterval makes the disk storage compact the
+	// metadata of the objects in every top-level shard directory in a single
+	// index file every MetadataCompactionInterval seconds, so that they are
+	// reloaded faster. Zero disables it.
+	MetadataCompactionInterval uint64 `json:"metadata_compaction_interval"`
+	// MetadataCacheSize is the number of objects whose parsed metadata is
+	// kept in memory by the disk storage, so that it is not read from the
+	// disk for every request. Zero disables it.
+	MetadataCacheSize uint64 `json:"metadata_cache_size"`
+	// ObjectIDHash is the function with which the ids of the objects are
+	// hashed for their paths on the disk and their keys: sha1 (the
+	// default), sha256 or fnv. It cannot be changed for an existing zone.
+	ObjectIDHash types.ObjectIDHashFunc `json:"object_id_hash"`
+	// IncompleteObjects is what the disk storage does on start with the
+	// objects which have fewer stored parts than their size needs, such as
+	// the ones whose fill was interrupted by a restart. With "resume" (the
+	// default) they are loaded and their missing parts are filled when they
+	// are requested, with "discard" they are removed.
+	IncompleteObjects string `json:"incomplete_objects"`
+	// StrictReload makes the disk storage check more than the hash of the
+	// stored objects on start: that they are in the directory of their
+	// cache key and that their metadata was written by an app version with
+	// at least MinSchemaVersion of the metadata. The ones which fail the
+	// checks are not loaded.
+	StrictReload     bool   `json:"strict_reload"`
+	MinSchemaVersion uint32 `json:"min_schema_version"`
+	// InvalidObjects is what the disk storage does on start with the
+	// objects whose metadata could not be read or failed the checks of
+	// StrictReload. With "skip" (the default) they are left on the disk,
+	// with "delete" they are removed.
+	InvalidObjects string `json:"invalid_objects"`
+	// Fsync makes the disk storage sync every written file and its
+	// directory to the disk before the write is finished, so that the
+	// cached objects survive a power loss. It slows down the writes.
+	Fsync bool `json:"fsync"`
+	// MaxDiskSize limits the bytes of the parts stored by the disk storage.
+	// When they get close to it, the cache algorithm is asked to evict parts
+	// regardless of StorageObjects and MaxSize. Zero disables it.
+	MaxDiskSize types.BytesSize `json:"max_disk_size"`
+	// S3 is used by the s3 storage, which keeps the objects in a bucket of
+	// an S3-compatible object storage with Path as the prefix of their keys.
+	S3 S3Storage `json:"s3"`
+}
+
+// S3Storage contains the bucket of the s3 storage and the credentials for it.
+type S3Storage struct {
+	// Endpoint is the URL of the object storage, e.g.
+	// https://s3.eu-west-1.amazonaws.com
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// AccessKeyID and SecretAccessKey are used to sign the requests.
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	// VirtualHostedStyle puts the bucket in the host name of the requests
+	// instead of in their path.
+	VirtualHostedStyle bool `json:"virtual_hosted_style"`
+	// DialTimeout and ResponseTimeout limit, in milliseconds, how long the
+	// connecting to the object storage and the waiting for its responses
+	// take. The defaults of the storage are used when they are zero.
+	DialTimeout     uint32 `json:"dial_timeout"`
+	ResponseTimeout uint32 `json:"response_timeout"`
+}
+
+// The possible values of CacheZone.IncompleteObjects
+const (
+	IncompleteObjectsResume  = "resume"
+	IncompleteObjectsDiscard = "discard"
+)
+
+// The possible values of CacheZone.InvalidObjects
+const (
+	InvalidObjectsSkip   = "skip"
+	InvalidObjectsDelete = "delete"
+)
+
+// BackgroundIOLimits contains the rate limits for the background operations of
+// a storage, such as reloading its contents on start and removing evicted
+// parts. Serving client requests is never limited. Zero means no limit.
+type BackgroundIOLimits struct {
+	BytesPerSecond types.BytesSize `json:"bytes_per_second"`
+	OpsPerSecond   uint64          `json:"ops_per_second"`
+}
+
+// ConcurrentIOLimits contains the maximum numbers of concurrent reads and
+// writes of parts by a storage. The operations over the limits wait for their
+// turn. Zero means no limit.
+type ConcurrentIOLimits struct {
+	Reads  uint64 `json:"reads"`
+	Writes uint64 `json:"writes"`
 }
 
 // Validate checks a CacheZone config section for errors.
@@ -25,6 +159,32 @@ func (cz *CacheZone) Validate() error {
 	if cz.ID == "" || cz.Type == "" || cz.Path == "" || cz.Algorithm == "" || cz.PartSize == 0 {
 		return errors.New("missing or invalid information in the cache zone config section")
 	}
+	if cz.ReloadMaxErrorRatio < 0 || cz.ReloadMaxErrorRatio > 1 {
+		return fmt.Errorf("reload_max_error_ratio for cache zone %s should be between 0 and 1, not %g",
+			cz.ID, cz.ReloadMaxErrorRatio)
+	}
+	switch cz.IncompleteObjects {
+	case "", IncompleteObjectsResume, IncompleteObjectsDiscard:
+	default:
+		return fmt.Errorf("unknown incomplete_objects policy `%s` for cache zone %s",
+			cz.IncompleteObjects, cz.ID)
+	}
+	switch cz.InvalidObjects {
+	case "", InvalidObjectsSkip, InvalidObjectsDelete:
+	default:
+		return fmt.Errorf("unknown invalid_objects policy `%s` for cache zone %s",
+			cz.InvalidObjects, cz.ID)
+	}
+	if cz.MinSchemaVersion > types.ObjectMetadataSchemaVersion {
+		return fmt.Errorf("min_schema_version for cache zone %s should be at most %d, not %d",
+			cz.ID, types.ObjectMetadataSchemaVersion, cz.MinSchemaVersion)
+	}
+	if cz.Type == "s3" && (cz.S3.Endpoint == "" || cz.S3.Bucket == "") {
+		return fmt.Errorf("the s3 storage of cache zone %s needs an endpoint and a bucket", cz.ID)
+	}
+	if !cz.ObjectIDHash.Valid() {
+		return fmt.Errorf("unknown object_id_hash `%s` for cache zone %s", cz.ObjectIDHash, cz.ID)
+	}
 
 	return nil
 }
@@ -3,7 +3,9 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 
 	"github.com/ironsmile/nedomi/types"
 )
@@ -28,6 +30,55 @@ type BaseHTTP struct {
 	DefaultCacheZone string    `json:"default_cache_zone"`
 	AccessLog        string    `json:"access_log"`
 	Logger           Logger    `json:"logger"`
+
+	AccessLogRotation AccessLogRotation `json:"access_log_rotation"`
+
+	// AccessLogCacheStatus adds the cache status (HIT, MISS, STALE,
+	// REVALIDATED or BYPASS), the cache zone, the age of the cached object and the upstream
+	// to the end of the access log entries.
+	AccessLogCacheStatus bool `json:"access_log_cache_status"`
+
+	// AccessLogFormat is the format of the access log entries: "clf" (the
+	// default) for the Apache Common Log Format, "json" for a JSON object
+	// per line or a template with nginx style variables like $status.
+	AccessLogFormat string `json:"access_log_format"`
+
+	// AbsoluteFormRequests sets what happens with requests whose target is
+	// an absolute URI, like the ones which forward proxies send. With
+	// "accept" (the default) they are routed by the host in the URI, as if
+	// it was in the Host header. With "reject" they are answered with 400.
+	AbsoluteFormRequests string `json:"absolute_form_requests"`
+
+	// DisableKeepAlives closes every client connection after its first
+	// response instead of reusing it for the next requests.
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+
+	// RequestIDHeader is the header in which the ids of the requests are
+	// sent to the upstreams, so that their logs can be correlated. If a
+	// client sends an id in it, the id is used instead of a new one. Empty
+	// (the default) disables it.
+	RequestIDHeader string `json:"request_id_header"`
+}
+
+// The possible values of BaseHTTP.AbsoluteFormRequests
+const (
+	AbsoluteFormAccept = "accept"
+	AbsoluteFormReject = "reject"
+)
+
+// The possible values of BaseHTTP.AccessLogFormat
+const (
+	AccessLogFormatCLF  = "clf"
+	AccessLogFormatJSON = "json"
+)
+
+// AccessLogRotation contains the settings for the rotation of all access
+// logs. A log is rotated when it would grow larger than MaxSize or when
+// Interval seconds have passed since it was opened. Zero values disable the
+// respective rotation.
+type AccessLogRotation struct {
+	MaxSize  types.BytesSize `json:"max_size"`
+	Interval uint32          `json:"interval"`
 }
 
 // HTTP contains all configuration options for HTTP.
@@ -71,6 +122,12 @@ func (h *HTTP) UnmarshalJSON(buff []byte) error {
 	if h.MinIOTransferSize <= 0 { // set default
 		h.MinIOTransferSize = defaultMinIOTranferSize
 	}
+	if h.AbsoluteFormRequests == "" { // set default
+		h.AbsoluteFormRequests = AbsoluteFormAccept
+	}
+	if h.AccessLogFormat == "" { // set default
+		h.AccessLogFormat = AccessLogFormatCLF
+	}
 	return nil
 }
 
@@ -85,6 +142,22 @@ func (h *HTTP) Validate() error {
 		return errors.New("There has to be at least one virtual host")
 	}
 
+	switch h.AbsoluteFormRequests {
+	case "", AbsoluteFormAccept, AbsoluteFormReject:
+	default:
+		return fmt.Errorf("Invalid `http.absolute_form_requests` %q, it should be %q or %q",
+			h.AbsoluteFormRequests, AbsoluteFormAccept, AbsoluteFormReject)
+	}
+
+	switch h.AccessLogFormat {
+	case "", AccessLogFormatCLF, AccessLogFormatJSON:
+	default:
+		if !strings.Contains(h.AccessLogFormat, "$") {
+			return fmt.Errorf("Invalid `http.access_log_format` %q, it should be %q, %q or a template with variables",
+				h.AccessLogFormat, AccessLogFormatCLF, AccessLogFormatJSON)
+		}
+	}
+
 	//!TODO: make sure Listen is valid tcp address
 	if _, err := net.ResolveTCPAddr("tcp", h.Listen); err != nil {
 		return err
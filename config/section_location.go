@@ -4,19 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/netutils"
 )
 
 // baseLocation contains the basic configuration options for virtual host's. location.
 type baseLocation struct {
 	HeadersRewrite
-	Name                  string
-	Upstream              string    `json:"upstream"`
-	CacheZone             string    `json:"cache_zone"`
-	CacheKey              string    `json:"cache_key"`
-	CacheDefaultDuration  string    `json:"cache_default_duration"`
-	Handlers              []Handler `json:"handlers"`
-	Logger                Logger    `json:"logger"`
-	CacheKeyIncludesQuery bool      `json:"cache_key_includes_query"`
+	Name                   string
+	Upstream               string    `json:"upstream"`
+	CacheZone              string    `json:"cache_zone"`
+	CacheKey               string    `json:"cache_key"`
+	CacheDefaultDuration   string    `json:"cache_default_duration"`
+	Handlers               []Handler `json:"handlers"`
+	Logger                 Logger    `json:"logger"`
+	CacheKeyIncludesQuery  bool      `json:"cache_key_includes_query"`
+	CacheKeyIncludesScheme bool      `json:"cache_key_includes_scheme"`
+	CacheKeyTemplate       string    `json:"cache_key_template"`
+	TrustedProxies         []string  `json:"trusted_proxies"`
 }
 
 // Location contains all configuration options for virtual host's location.
@@ -24,7 +30,10 @@ type Location struct {
 	baseLocation
 	CacheZone            *CacheZone
 	CacheDefaultDuration time.Duration
-	parent               *VirtualHost
+	CacheKeyTemplate     *types.CacheKeyTemplate
+	// TrustedProxies are the networks whose X-Forwarded-Proto is honored
+	TrustedProxies netutils.IPNetworks
+	parent         *VirtualHost
 }
 
 // UnmarshalJSON is a custom JSON unmashalling that also implements inheritance
@@ -51,6 +60,28 @@ func (ls *Location) UnmarshalJSON(buff []byte) error {
 		ls.CacheDefaultDuration = dur
 	}
 
+	// The cache key template is inherited with the cache key
+	if ls.baseLocation.CacheKeyTemplate == "" {
+		if ls.parent != nil {
+			ls.CacheKeyTemplate = ls.parent.CacheKeyTemplate
+		}
+	} else if tmpl, err := types.ParseCacheKeyTemplate(ls.baseLocation.CacheKeyTemplate); err != nil {
+		return fmt.Errorf("Error parsing %s's cache_key_template: %s", ls, err)
+	} else {
+		ls.CacheKeyTemplate = tmpl
+	}
+
+	// The trusted proxies are inherited from the virtual host
+	if ls.baseLocation.TrustedProxies == nil {
+		if ls.parent != nil {
+			ls.TrustedProxies = ls.parent.TrustedProxies
+		}
+	} else if proxies, err := netutils.ParseIPNetworks(ls.baseLocation.TrustedProxies); err != nil {
+		return fmt.Errorf("Error parsing %s's trusted_proxies: %s", ls, err)
+	} else {
+		ls.TrustedProxies = proxies
+	}
+
 	// Inject the cache zone configuration from the root config
 	if cz, ok := ls.parent.parent.parent.CacheZones[ls.baseLocation.CacheZone]; ok {
 		ls.CacheZone = cz
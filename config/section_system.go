@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/user"
 	"path"
+
+	"github.com/ironsmile/nedomi/types"
 )
 
 // System contains system and environment configurations.
@@ -13,6 +15,44 @@ type System struct {
 	Pidfile string `json:"pidfile"`
 	Workdir string `json:"workdir"`
 	User    string `json:"user"`
+
+	MemoryPressure MemoryPressure `json:"memory_pressure"`
+
+	// ShutdownFillGrace is the time in seconds in which the in-flight cache
+	// fills are allowed to complete on shutdown. The remaining ones are
+	// aborted after it and clean up their partially stored data.
+	ShutdownFillGrace uint32 `json:"shutdown_fill_grace"`
+}
+
+// MemoryPressure contains the settings for the graceful degradation of the
+// server when the process approaches its memory limit.
+type MemoryPressure struct {
+	// Limit is the memory limit of the process. When it is not set the
+	// cgroup memory limit is used.
+	Limit types.BytesSize `json:"limit"`
+	// Threshold is the fraction of the limit at which the server starts to
+	// degrade. Zero disables the memory pressure monitoring.
+	Threshold float64 `json:"threshold"`
+	// RecoverThreshold is the fraction of the limit under which the usage
+	// has to drop for the server to recover. Defaults to Threshold.
+	RecoverThreshold float64 `json:"recover_threshold"`
+	// RejectRequests makes the server respond with 503 to new requests
+	// while it is degraded instead of only stopping new cache stores.
+	RejectRequests bool `json:"reject_requests"`
+	// CheckInterval is the time between memory checks in milliseconds.
+	CheckInterval uint32 `json:"check_interval"`
+}
+
+// Validate checks the memory pressure settings for errors.
+func (mp MemoryPressure) Validate() error {
+	if mp.Threshold < 0 || mp.Threshold > 1 {
+		return fmt.Errorf("memory_pressure.threshold should be between 0 and 1, not %g", mp.Threshold)
+	}
+	if mp.RecoverThreshold < 0 || mp.RecoverThreshold > mp.Threshold {
+		return fmt.Errorf("memory_pressure.recover_threshold should be between 0 and threshold(%g), not %g",
+			mp.Threshold, mp.RecoverThreshold)
+	}
+	return nil
 }
 
 // Validate checks a System config section config for errors.
@@ -52,7 +92,7 @@ func (s System) Validate() error {
 		}
 	}
 
-	return nil
+	return s.MemoryPressure.Validate()
 }
 
 // GetSubsections returns nil (System has no subsections).
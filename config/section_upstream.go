@@ -21,7 +21,125 @@ type UpstreamSettings struct {
 	UseIPv4                 bool   `json:"use_ipv4"`
 	UseIPv6                 bool   `json:"use_ipv6"`
 	ResolveAddresses        bool   `json:"resolve_addresses"`
-	//!TODO: add settings for timeouts, keep-alives, retries, etc.
+
+	// DNSRefreshInterval is the time in milliseconds after which the host
+	// names of the addresses are resolved again, so that the changes of
+	// their IP addresses are picked up. Zero resolves them only once.
+	DNSRefreshInterval uint32 `json:"dns_refresh_interval"`
+
+	// When MaxConnectionsPerServer requests to an address are in flight,
+	// up to MaxConnectionQueue more wait for one of them to finish for at
+	// most MaxConnectionWait milliseconds (until they are canceled if it is
+	// zero). The requests which do not fit in the queue or wait too long
+	// fail with types.ErrUpstreamBusy.
+	MaxConnectionQueue uint32 `json:"max_connection_queue"`
+	MaxConnectionWait  uint32 `json:"max_connection_wait"`
+
+	// The settings of the connections to the upstream addresses. The
+	// timeouts and the keep-alive period are in milliseconds.
+	MaxIdleConnsPerHost uint32 `json:"max_idle_conns_per_host"`
+	DisableKeepAlives   bool   `json:"disable_keep_alives"`
+	DisableCompression  bool   `json:"disable_compression"`
+	DialTimeout         uint32 `json:"dial_timeout"`
+	TLSHandshakeTimeout uint32 `json:"tls_handshake_timeout"`
+	KeepAlive           uint32 `json:"keep_alive"`
+
+	// Protocol is the HTTP version spoken with the upstream addresses, one
+	// of the UpstreamProtocol constants. With HTTP/2 all requests to an
+	// address are multiplexed over a single connection, so
+	// MaxConnectionsPerServer limits the concurrent requests (streams) and
+	// not the connections, and MaxIdleConnsPerHost does not matter.
+	Protocol string `json:"protocol"`
+
+	// MaxRetries is the number of times the idempotent requests without a
+	// body are retried after connection errors or when the upstream
+	// responds with one of RetryOnCodes. Zero disables the retries.
+	MaxRetries   uint32 `json:"max_retries"`
+	RetryOnCodes []int  `json:"retry_on_codes"`
+	// RetryBackoff is the time in milliseconds before the first retry. It
+	// is doubled for every following one, up to RetryMaxBackoff. Zero
+	// RetryMaxBackoff does not limit it.
+	RetryBackoff    uint32 `json:"retry_backoff"`
+	RetryMaxBackoff uint32 `json:"retry_max_backoff"`
+
+	HealthCheck HealthCheckSettings `json:"health_check"`
+
+	// HedgeDelay is the time in milliseconds after which the idempotent
+	// requests without response headers are also sent to another address.
+	// The first successful response is used and the other request is
+	// canceled. Zero disables the hedging. MaxHedges is the maximum number
+	// of such additional requests in flight.
+	HedgeDelay uint32 `json:"hedge_delay"`
+	MaxHedges  uint32 `json:"max_hedges"`
+
+	// StickyCookie is the name of the cookie whose value pins the clients
+	// to an address with the sticky balancing. The client IP address is
+	// used for the requests without it or when it is empty.
+	StickyCookie string `json:"sticky_cookie"`
+
+	// HostHeader is the Host header of the requests to the addresses, one
+	// of the UpstreamHostHeader constants. HostHeaderValue is the host sent
+	// with UpstreamHostHeaderExplicit. Empty leaves it to the proxy handler,
+	// which by default sends the host of the address.
+	HostHeader      string `json:"host_header"`
+	HostHeaderValue string `json:"host_header_value"`
+}
+
+// The possible values of UpstreamSettings.Protocol
+const (
+	// UpstreamProtocolHTTP1 uses HTTP/1.1 with all addresses.
+	UpstreamProtocolHTTP1 = "http1"
+	// UpstreamProtocolHTTP2 negotiates HTTP/2 with the https:// addresses
+	// which support it and uses HTTP/1.1 with the rest.
+	UpstreamProtocolHTTP2 = "http2"
+	// UpstreamProtocolH2C uses HTTP/2 with all addresses, without TLS
+	// (h2c with prior knowledge) for the http:// ones. They all have to
+	// support it.
+	UpstreamProtocolH2C = "h2c"
+)
+
+// The possible values of UpstreamSettings.HostHeader
+const (
+	// UpstreamHostHeaderOriginal sends the host requested by the client.
+	UpstreamHostHeaderOriginal = "original"
+	// UpstreamHostHeaderUpstream sends the host of the configured address,
+	// even when it is dialed by its resolved IP addresses.
+	UpstreamHostHeaderUpstream = "upstream"
+	// UpstreamHostHeaderExplicit sends UpstreamSettings.HostHeaderValue.
+	UpstreamHostHeaderExplicit = "explicit"
+)
+
+// HealthCheckSettings configures the active health checks of the upstream
+// addresses. They are disabled when the Path is empty.
+type HealthCheckSettings struct {
+	// Path is requested from every address in order to check it.
+	Path           string `json:"path"`
+	ExpectedStatus int    `json:"expected_status"`
+	// Interval and Timeout of the checks are in milliseconds.
+	Interval uint32 `json:"interval"`
+	Timeout  uint32 `json:"timeout"`
+	// An address is ejected from the balancing after FailThreshold
+	// consecutive failed checks and re-admitted after SuccessThreshold
+	// consecutive passed ones.
+	FailThreshold    uint32 `json:"fail_threshold"`
+	SuccessThreshold uint32 `json:"success_threshold"`
+}
+
+// Validate checks the health check settings for errors.
+func (hc HealthCheckSettings) Validate() error {
+	if hc.Path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(hc.Path, "/") {
+		return fmt.Errorf("the health check path '%s' should start with /", hc.Path)
+	}
+	if hc.Interval == 0 || hc.Timeout == 0 {
+		return fmt.Errorf("the health check interval and timeout should be positive")
+	}
+	if hc.FailThreshold == 0 || hc.SuccessThreshold == 0 {
+		return fmt.Errorf("the health check thresholds should be positive")
+	}
+	return nil
 }
 
 // UpstreamAddress contains a single upstream URL and it's weight.
@@ -39,6 +157,28 @@ func (cz *Upstream) Validate() error {
 	if len(cz.Addresses) < 1 {
 		return fmt.Errorf("upstream %s has no addresses", cz.ID)
 	}
+	if err := cz.Settings.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("upstream %s: %s", cz.ID, err)
+	}
+	switch cz.Settings.Protocol {
+	case "", UpstreamProtocolHTTP1, UpstreamProtocolHTTP2, UpstreamProtocolH2C:
+	default:
+		return fmt.Errorf("unknown protocol `%s` for upstream %s", cz.Settings.Protocol, cz.ID)
+	}
+	switch cz.Settings.HostHeader {
+	case "", UpstreamHostHeaderOriginal, UpstreamHostHeaderUpstream:
+		if cz.Settings.HostHeaderValue != "" {
+			return fmt.Errorf("host_header_value for upstream %s needs host_header `%s`",
+				cz.ID, UpstreamHostHeaderExplicit)
+		}
+	case UpstreamHostHeaderExplicit:
+		if cz.Settings.HostHeaderValue == "" {
+			return fmt.Errorf("upstream %s needs a host_header_value for host_header `%s`",
+				cz.ID, UpstreamHostHeaderExplicit)
+		}
+	default:
+		return fmt.Errorf("unknown host_header `%s` for upstream %s", cz.Settings.HostHeader, cz.ID)
+	}
 
 	return nil
 }
@@ -84,6 +224,28 @@ func GetDefaultUpstreamSettings() UpstreamSettings {
 		UseIPv4:                 true,
 		UseIPv6:                 false,
 		ResolveAddresses:        true,
-		//!TODO: add settings for timeouts, keep-alives, retries, etc.
+		DNSRefreshInterval:      0, // The addresses are resolved only once by default
+		MaxConnectionQueue:      100,
+		MaxConnectionWait:       5000,
+		MaxIdleConnsPerHost:     5,
+		DisableKeepAlives:       false,
+		DisableCompression:      true,
+		DialTimeout:             10000,
+		TLSHandshakeTimeout:     5000,
+		KeepAlive:               10000,
+		Protocol:                UpstreamProtocolHTTP1,
+		MaxRetries:              0, // Requests are not retried by default
+		RetryOnCodes:            []int{502, 503, 504},
+		RetryBackoff:            100,
+		RetryMaxBackoff:         2000,
+		HedgeDelay:              0, // Requests are not hedged by default
+		MaxHedges:               10,
+		HealthCheck: HealthCheckSettings{ // Disabled without a path
+			ExpectedStatus:   200,
+			Interval:         5000,
+			Timeout:          2000,
+			FailThreshold:    3,
+			SuccessThreshold: 2,
+		},
 	}
 }
@@ -16,6 +16,16 @@ type upstreamTestCase struct {
 
 var upstreams = []upstreamTestCase{
 	{json: `{"balancing":"test","addresses":[]}`, expValidateError: true},
+	{
+		json:             `{"balancing":"test","addresses":["http://upstream1.com"],"settings":{"protocol":"spdy"}}`,
+		expValidateError: true,
+	},
+	{
+		json: `{"balancing":"test","addresses":["http://upstream1.com"],"settings":{"protocol":"h2c"}}`,
+		expRes: Upstream{Balancing: "test", Addresses: []UpstreamAddress{
+			{URL: &url.URL{Scheme: "http", Host: "upstream1.com"}, Weight: DefaultUpstreamWeight},
+		}, Settings: UpstreamSettings{Protocol: UpstreamProtocolH2C}},
+	},
 	{
 		json: `{"balancing":"test","addresses":["http://upstream1.com|60","https://upstream2.com"]}`,
 		expRes: Upstream{Balancing: "test", Addresses: []UpstreamAddress{
@@ -99,3 +109,57 @@ func TestWrongUpstreamParsing(t *testing.T) {
 	}
 
 }
+
+func TestUpstreamHealthCheckValidation(t *testing.T) {
+	t.Parallel()
+
+	var valid = GetDefaultUpstreamSettings().HealthCheck
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Unexpected error for disabled health checks: %s", err)
+	}
+	valid.Path = "/health"
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Unexpected error for the default health checks: %s", err)
+	}
+
+	var wrong = []func(*HealthCheckSettings){
+		func(hc *HealthCheckSettings) { hc.Path = "health" },
+		func(hc *HealthCheckSettings) { hc.Interval = 0 },
+		func(hc *HealthCheckSettings) { hc.Timeout = 0 },
+		func(hc *HealthCheckSettings) { hc.FailThreshold = 0 },
+		func(hc *HealthCheckSettings) { hc.SuccessThreshold = 0 },
+	}
+	for num, change := range wrong {
+		var hc = valid
+		change(&hc)
+		if err := hc.Validate(); err == nil {
+			t.Errorf("Expected an error for wrong health check settings %d: %+v", num, hc)
+		}
+	}
+}
+
+func TestUpstreamHostHeaderValidation(t *testing.T) {
+	t.Parallel()
+
+	var tests = []struct {
+		hostHeader, value string
+		valid             bool
+	}{
+		{"", "", true},
+		{UpstreamHostHeaderOriginal, "", true},
+		{UpstreamHostHeaderUpstream, "", true},
+		{UpstreamHostHeaderExplicit, "backend.example.com", true},
+		{UpstreamHostHeaderExplicit, "", false},
+		{UpstreamHostHeaderOriginal, "backend.example.com", false},
+		{"client", "", false},
+	}
+	for _, test := range tests {
+		var up = &Upstream{ID: "test", Settings: GetDefaultUpstreamSettings()}
+		up.Addresses = []UpstreamAddress{{URL: &url.URL{Scheme: "http", Host: "example.com"}, Weight: 1}}
+		up.Settings.HostHeader, up.Settings.HostHeaderValue = test.hostHeader, test.value
+		if err := up.Validate(); (err == nil) != test.valid {
+			t.Errorf("Expected the host_header `%s` with the value `%s` to be valid: %t but got %v",
+				test.hostHeader, test.value, test.valid, err)
+		}
+	}
+}
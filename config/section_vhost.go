@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/netutils"
 )
 
 // DefaultCacheDuration is the duration which an object will be cached if it is cacheable
@@ -49,6 +52,22 @@ func (vh *VirtualHost) UnmarshalJSON(buff []byte) error {
 		vh.CacheDefaultDuration = dur
 	}
 
+	if vh.baseLocation.CacheKeyTemplate != "" {
+		tmpl, err := types.ParseCacheKeyTemplate(vh.baseLocation.CacheKeyTemplate)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s's cache_key_template: %s", vh, err)
+		}
+		vh.CacheKeyTemplate = tmpl
+	}
+
+	if vh.baseLocation.TrustedProxies != nil {
+		proxies, err := netutils.ParseIPNetworks(vh.baseLocation.TrustedProxies)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s's trusted_proxies: %s", vh, err)
+		}
+		vh.TrustedProxies = proxies
+	}
+
 	// Inject the cache zone configuration from the root config
 	vh.CacheZone = vh.parent.parent.CacheZones[vh.baseLocation.CacheZone]
 
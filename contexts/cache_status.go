@@ -0,0 +1,29 @@
+package contexts
+
+import (
+	"context"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// The key type is unexported to prevent collisions with context keys defined in
+// other packages.
+type cacheStatusContextKey int
+
+const cacheStatusKey cacheStatusContextKey = 0
+
+// NewCacheStatusRecorderContext returns a new Context carrying a function which
+// is called with the way the cache handled the request.
+func NewCacheStatusRecorderContext(ctx context.Context,
+	record func(*types.CacheStatus)) context.Context {
+
+	return context.WithValue(ctx, cacheStatusKey, record)
+}
+
+// RecordCacheStatus passes the cache status of the request to the function
+// carried by the context, if there is one.
+func RecordCacheStatus(ctx context.Context, status *types.CacheStatus) {
+	if record, ok := ctx.Value(cacheStatusKey).(func(*types.CacheStatus)); ok {
+		record(status)
+	}
+}
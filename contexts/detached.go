@@ -0,0 +1,23 @@
+package contexts
+
+import (
+	"context"
+	"time"
+)
+
+// detached carries the values of its parent but is never cancelled.
+type detached struct {
+	parent context.Context
+}
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// Detach returns a Context which carries the values of ctx, e.g. the App and
+// the request ID, but is not cancelled with it. It is used for work which may
+// outlive the request that started it.
+func Detach(ctx context.Context) context.Context {
+	return detached{parent: ctx}
+}
@@ -0,0 +1,26 @@
+package contexts
+
+import (
+	"context"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// The key type is unexported to prevent collisions with context keys defined in
+// other packages.
+type requestBudgetContextKey int
+
+const requestBudgetKey requestBudgetContextKey = 0
+
+// NewRequestBudgetContext returns a new Context carrying the latency budget of
+// the request.
+func NewRequestBudgetContext(ctx context.Context, budget *types.RequestBudget) context.Context {
+	return context.WithValue(ctx, requestBudgetKey, budget)
+}
+
+// GetRequestBudget returns the latency budget of the request carried by the
+// context or nil, which is unlimited, if there is none.
+func GetRequestBudget(ctx context.Context) *types.RequestBudget {
+	budget, _ := ctx.Value(requestBudgetKey).(*types.RequestBudget)
+	return budget
+}
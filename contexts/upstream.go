@@ -0,0 +1,65 @@
+package contexts
+
+import (
+	"context"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// The key type is unexported to prevent collisions with context keys defined in
+// other packages.
+type upstreamContextKey int
+
+const (
+	upstreamKey upstreamContextKey = iota
+	upstreamTimeKey
+)
+
+// NewUpstreamRecorderContext returns a new Context carrying a function which is
+// called with the upstream address chosen for the request. The functions
+// carried by ctx are still called after it.
+func NewUpstreamRecorderContext(ctx context.Context,
+	record func(*types.UpstreamAddress)) context.Context {
+
+	if parent, ok := ctx.Value(upstreamKey).(func(*types.UpstreamAddress)); ok {
+		var own = record
+		record = func(addr *types.UpstreamAddress) {
+			own(addr)
+			parent(addr)
+		}
+	}
+	return context.WithValue(ctx, upstreamKey, record)
+}
+
+// RecordUpstream passes the upstream address chosen for the request to the
+// function carried by the context, if there is one.
+func RecordUpstream(ctx context.Context, addr *types.UpstreamAddress) {
+	if record, ok := ctx.Value(upstreamKey).(func(*types.UpstreamAddress)); ok {
+		record(addr)
+	}
+}
+
+// NewUpstreamTimeRecorderContext returns a new Context carrying a function
+// which is called with the time it took the upstream to respond to the
+// request. The functions carried by ctx are still called after it.
+func NewUpstreamTimeRecorderContext(ctx context.Context,
+	record func(time.Duration)) context.Context {
+
+	if parent, ok := ctx.Value(upstreamTimeKey).(func(time.Duration)); ok {
+		var own = record
+		record = func(d time.Duration) {
+			own(d)
+			parent(d)
+		}
+	}
+	return context.WithValue(ctx, upstreamTimeKey, record)
+}
+
+// RecordUpstreamTime passes the time it took the upstream to respond to the
+// function carried by the context, if there is one.
+func RecordUpstreamTime(ctx context.Context, d time.Duration) {
+	if record, ok := ctx.Value(upstreamTimeKey).(func(time.Duration)); ok {
+		record(d)
+	}
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// alignRequestRange extends a single range of the Range header to the
+// boundaries of the parts which contain it, so that all of them are saved from
+// the response instead of only the whole parts in the range. The header is
+// returned unchanged for suffix ranges, which depend on the unknown size of
+// the object, and for multiple ranges.
+func alignRequestRange(header string, partSize uint64) string {
+	const b = "bytes="
+	if partSize == 0 || !strings.HasPrefix(header, b) || strings.Contains(header, ",") {
+		return header
+	}
+	var spec = strings.TrimSpace(header[len(b):])
+	var i = strings.Index(spec, "-")
+	if i <= 0 {
+		return header
+	}
+	start, err := strconv.ParseUint(strings.TrimSpace(spec[:i]), 10, 64)
+	if err != nil {
+		return header
+	}
+	var aligned = b + strconv.FormatUint(start-start%partSize, 10) + "-"
+	if end := strings.TrimSpace(spec[i+1:]); end != "" {
+		last, err := strconv.ParseUint(end, 10, 64)
+		if err != nil || last < start {
+			return header
+		}
+		aligned += strconv.FormatUint(last-last%partSize+partSize-1, 10)
+	}
+	return aligned
+}
+
+// narrowResponse makes the response to the client contain only the range it
+// requested if the partial response is for a wider range which contains it,
+// as it is when the requested range was aligned to the parts of the object.
+// It is called after the response headers are copied for the client.
+func (h *reqHandler) narrowResponse(rw *httputils.FlexibleResponseWriter) {
+	var header = h.req.Header.Get("Range")
+	if rw.Code != http.StatusPartialContent || header == "" {
+		return
+	}
+	respRng, err := httputils.GetResponseRange(rw.Code, rw.Headers)
+	if err != nil {
+		return
+	}
+	ranges, err := httputils.ParseRequestRange(header, respRng.ObjSize)
+	if err != nil || len(ranges) != 1 {
+		return
+	}
+	var rng = ranges[0]
+	if rng.Start < respRng.Start || rng.Start+rng.Length > respRng.Start+respRng.Length ||
+		rng.Start == respRng.Start && rng.Length == respRng.Length {
+		return
+	}
+	h.resp.Header().Set("Content-Range", rng.ContentRange(respRng.ObjSize))
+	h.resp.Header().Set("Content-Length", strconv.FormatUint(rng.Length, 10))
+	h.resp = &narrowingWriter{
+		ResponseWriter: h.resp,
+		skip:           rng.Start - respRng.Start,
+		remaining:      rng.Length,
+	}
+}
+
+// narrowingWriter writes to the client only the remaining bytes after the
+// skipped ones. The others are reported as written, so that the rest of the
+// response is still stored in the cache.
+type narrowingWriter struct {
+	http.ResponseWriter
+	skip, remaining uint64
+}
+
+func (w *narrowingWriter) Write(p []byte) (int, error) {
+	var n = len(p)
+	if w.skip >= uint64(len(p)) {
+		w.skip -= uint64(len(p))
+		return n, nil
+	}
+	p = p[w.skip:]
+	w.skip = 0
+	if uint64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+	}
+	w.remaining -= uint64(len(p))
+	if len(p) == 0 {
+		return n, nil
+	}
+	if _, err := w.ResponseWriter.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestAlignRequestRange(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		header, expected string
+	}{
+		{"bytes=7-12", "bytes=5-14"},
+		{"bytes=5-9", "bytes=5-9"},
+		{"bytes=0-0", "bytes=0-4"},
+		{"bytes=12-", "bytes=10-"},
+		{"bytes= 3 - 4", "bytes=0-4"},
+		{"bytes=-10", "bytes=-10"},
+		{"bytes=1-2,6-7", "bytes=1-2,6-7"},
+		{"bytes=9-3", "bytes=9-3"},
+		{"bytes=a-3", "bytes=a-3"},
+		{"items=1-2", "items=1-2"},
+	}
+	for _, test := range tests {
+		if got := alignRequestRange(test.header, 5); got != test.expected {
+			t.Errorf("Expected %q to be aligned to %q but got %q", test.header, test.expected, got)
+		}
+	}
+}
+
+func TestRangeMissesFillAlignedParts(t *testing.T) {
+	t.Parallel()
+	const file = "aligned"
+	app := newTestAppFromMap(t, map[string]string{
+		file: testutils.GenerateMeAString(7, 50),
+	})
+	defer app.cleanup()
+
+	var mu sync.Mutex
+	var requested []string
+	var up = app.cacheHandler.next
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Header.Get("Range"))
+		mu.Unlock()
+		up.ServeHTTP(w, r)
+	})
+	var rec = httptest.NewRecorder()
+	app.cacheHandler.ServeHTTP(rec, reqForRange(file, 7, 6))
+	if cr := rec.Header().Get("Content-Range"); cr != "bytes 7-12/50" {
+		t.Errorf("Expected the requested Content-Range but got %q", cr)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "6" {
+		t.Errorf("Expected Content-Length 6 but got %q", cl)
+	}
+	if body := rec.Body.String(); body != app.fsmap[file][7:13] {
+		t.Errorf("Expected the requested range but got %q", body)
+	}
+	parts, err := app.cacheHandler.Cache.Storage.GetAvailableParts(
+		app.cacheHandler.NewObjectIDForRequest(reqForRange(file, 0, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(types.ObjectIndexes(parts))
+	if len(parts) != 2 || parts[0].Part != 1 || parts[1].Part != 2 {
+		t.Errorf("Expected the parts 1 and 2 to be stored but got %v", parts)
+	}
+
+	// the next ranges request only the missing parts, the parts which are
+	// still being saved are waited for
+	app.testRange(file, 12, 10)
+	app.testRange(file, 5, 20)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := []string{"bytes=5-14", "bytes=15-24"}; !reflect.DeepEqual(requested, expected) {
+		t.Errorf("Expected the upstream requests for %v but got %v", expected, requested)
+	}
+}
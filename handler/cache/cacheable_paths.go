@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// validatePathPatterns returns an error for the first malformed pattern.
+func validatePathPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid path pattern `%s`: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchesPath returns whether one of the patterns matches the path or one of
+// its parent directories, so that "/static/*" matches "/static/css/main.css".
+func matchesPath(patterns []string, urlPath string) bool {
+	for _, pattern := range patterns {
+		for prefix := urlPath; prefix != ""; {
+			if matched, _ := path.Match(pattern, prefix); matched {
+				return true
+			}
+			var i = strings.LastIndexByte(prefix, '/')
+			if i < 0 {
+				break
+			}
+			prefix = prefix[:i]
+		}
+	}
+	return false
+}
+
+// isCacheablePath returns whether the requests for the path may use the cache
+// according to CacheablePaths and NonCacheablePaths.
+func (c *CachingProxy) isCacheablePath(urlPath string) bool {
+	if matchesPath(c.Settings.NonCacheablePaths, urlPath) {
+		return false
+	}
+	return len(c.Settings.CacheablePaths) == 0 || matchesPath(c.Settings.CacheablePaths, urlPath)
+}
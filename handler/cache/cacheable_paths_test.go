@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMatchesPath(t *testing.T) {
+	t.Parallel()
+	var patterns = []string{"/static/*", "/*.jpg", "/exact"}
+	for urlPath, expected := range map[string]bool{
+		"/static/main.css":     true,
+		"/static/css/main.css": true,
+		"/static":              false,
+		"/image.jpg":           true,
+		"/images/image.jpg":    false,
+		"/exact":               true,
+		"/exact/child":         true,
+		"/exactly":             false,
+		"/api/users":           false,
+		"/":                    false,
+	} {
+		if got := matchesPath(patterns, urlPath); got != expected {
+			t.Errorf("Expected matchesPath for %s to be %t", urlPath, expected)
+		}
+	}
+	if err := validatePathPatterns([]string{"/static/[a-"}); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestCacheablePaths(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.CacheablePaths = []string{"/static/*", "/api/public/*"}
+	app.cacheHandler.Settings.NonCacheablePaths = []string{"/static/private/*"}
+	var upstream = make(map[string]*int32)
+	for _, path := range []string{"/static/app.js", "/static/private/key", "/api/users", "/api/public/info"} {
+		var count = new(int32)
+		upstream[path] = count
+		app.up.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(count, 1)
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.Path)))
+			_, _ = w.Write([]byte(r.URL.Path))
+		})
+	}
+
+	for path, cached := range map[string]bool{
+		"/static/app.js":      true,
+		"/static/private/key": false,
+		"/api/users":          false,
+		"/api/public/info":    true,
+	} {
+		for i := 0; i < 3; i++ {
+			req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.testRequest(req.WithContext(app.ctx), path, http.StatusOK)
+		}
+		var expected int32 = 3
+		if cached {
+			expected = 1
+		}
+		if got := atomic.LoadInt32(upstream[path]); got != expected {
+			t.Errorf("Expected %d upstream requests for %s but got %d", expected, path, got)
+		}
+	}
+}
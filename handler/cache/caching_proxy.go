@@ -1,19 +1,201 @@
 package cache
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
 	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
 )
 
+// Settings contains the possible settings for the caching proxy
+type Settings struct {
+	// ForwardConditionals makes the conditional headers the client sent for
+	// objects which are not in the cache to be sent to the upstream, so that
+	// its 304 responses can be relayed. When false they are removed and the
+	// full object is always requested.
+	ForwardConditionals bool `json:"forward_conditionals"`
+
+	// GroupHeader is the upstream response header which contains the id of
+	// the group to which the object belongs. Groups of objects are purged
+	// together.
+	GroupHeader string `json:"group_header"`
+
+	// GroupByDirectory puts all objects from the same directory in one group
+	// when the upstream does not send the GroupHeader.
+	GroupByDirectory bool `json:"group_by_directory"`
+
+	// SurrogateKeyHeader is the upstream response header which contains the
+	// space separated surrogate keys (tags) of the object, e.g.
+	// Surrogate-Key. The objects can be purged by any of their keys.
+	SurrogateKeyHeader string `json:"surrogate_key_header"`
+
+	// CacheUnknownLength allows storing responses without Content-Length,
+	// e.g. chunked ones. Their metadata is saved only after the whole
+	// response was received successfully.
+	CacheUnknownLength bool `json:"cache_unknown_length"`
+
+	// ClientDisconnect sets what happens with the upstream request which
+	// fills the cache when the client disconnects. With "abort" it is
+	// aborted. With "complete-and-store" it is completed and the object is
+	// stored, as long as it finishes in DetachedFillTimeout seconds.
+	ClientDisconnect    string `json:"client_disconnect"`
+	DetachedFillTimeout uint32 `json:"detached_fill_timeout"`
+
+	// MaxRangeFillsPerObject bounds the concurrent upstream requests which
+	// fill missing parts of a single object. Zero means no limit.
+	MaxRangeFillsPerObject int `json:"max_range_fills_per_object"`
+
+	// FillLockTimeout is the time in milliseconds for which the requests
+	// for an object which is not cached wait for the request which fills
+	// its metadata. After it they are proxied to the upstream on their own,
+	// without storing the response. Zero means that they wait until the
+	// fill is done or their client goes away.
+	FillLockTimeout uint32 `json:"fill_lock_timeout"`
+
+	// ParallelFills is the number of concurrent range requests with which
+	// the objects larger than ParallelFillSize are loaded from the upstream
+	// when they are not cached, each for a chunk of ParallelFillSize bytes
+	// rounded up to whole parts. The first chunk is taken from the response
+	// which fills the metadata of the object. The client still gets the
+	// bytes in order and the chunks after the one which is being sent are
+	// buffered in memory. MaxRangeFillsPerObject bounds it too. Values below
+	// 2 disable it.
+	ParallelFills    int             `json:"parallel_fills"`
+	ParallelFillSize types.BytesSize `json:"parallel_fill_size"`
+
+	// MaxStale is the number of seconds after their expiry during which
+	// objects with stale-while-revalidate are still served when their
+	// revalidation fails with a server error. It extends the window set by
+	// the upstream, not the other way around.
+	MaxStale uint32 `json:"max_stale"`
+
+	// StaleIfError is the number of seconds after their expiry during which
+	// the objects which are revalidated before they are served are still
+	// served, with Warning: 112, when the upstream responds with a server
+	// error or can not be reached. They are never served after they were
+	// purged. Zero disables it.
+	StaleIfError uint32 `json:"stale_if_error"`
+
+	// PartialRevalidation is the number of seconds after their expiry
+	// during which objects with validators are kept, so that a range request
+	// for an expired object revalidates it with the upstream response for
+	// the range. If the object did not change, its freshness is extended and
+	// the parts which are already cached are kept. Zero disables it.
+	PartialRevalidation uint32 `json:"partial_revalidation"`
+
+	// ConditionalRevalidation is the number of seconds after their expiry
+	// during which objects with validators are kept, so that they can be
+	// revalidated with a conditional request instead of being downloaded
+	// again. Zero keeps them only while they can be served stale.
+	ConditionalRevalidation uint32 `json:"conditional_revalidation"`
+
+	// HonorImmutable makes the fresh objects with the immutable directive be
+	// served from the cache even when the client asks for a revalidation,
+	// e.g. with Cache-Control: no-cache when reloading a page.
+	HonorImmutable bool `json:"honor_immutable"`
+
+	// DebugBypass lets trusted clients skip the cache with a request header
+	// when diagnosing whether an issue is caused by the cache or the upstream.
+	DebugBypass DebugBypassSettings `json:"debug_bypass"`
+
+	// Vary limits the variants of the objects which the responses with a
+	// Vary header can create.
+	Vary VarySettings `json:"vary"`
+
+	// CacheablePaths and NonCacheablePaths decide which request paths use
+	// the cache. When CacheablePaths is not empty only the paths which match
+	// it are cached. The paths which match NonCacheablePaths are never
+	// cached. The rest are proxied to the upstream without the cache. The
+	// patterns are in the path.Match syntax and a pattern matches the paths
+	// in the directories it matches too, e.g. "/static/*" matches
+	// "/static/css/main.css".
+	CacheablePaths    []string `json:"cacheable_paths"`
+	NonCacheablePaths []string `json:"non_cacheable_paths"`
+
+	// CompressedRanges sets how the range requests for the objects cached
+	// with the gzip content encoding are served.
+	CompressedRanges CompressedRangeSettings `json:"compressed_ranges"`
+
+	// CacheStatusHeader is the response header which tells how the request
+	// was served: HIT, MISS, STALE or REVALIDATED. Empty disables it.
+	// CacheStatusZone adds the id of the cache zone to its value, e.g.
+	// "HIT from zone1".
+	CacheStatusHeader string `json:"cache_status_header"`
+	CacheStatusZone   bool   `json:"cache_status_zone"`
+
+	// RequestBudget is the time in milliseconds for which a client request
+	// waits for the upstream response headers, summed over all of its
+	// retries, hedges and revalidations. When it is spent an expired object
+	// which is being revalidated is served stale and otherwise the client
+	// gets 504 Gateway Timeout. Zero disables it.
+	RequestBudget uint32 `json:"request_budget"`
+
+	// NegativeCacheDuration is the number of seconds for which the upstream
+	// responses with one of NegativeCacheCodes (404 by default) are cached,
+	// so that the requests for a missing object do not all reach the
+	// upstream. A shorter expiry of the response is respected and nothing
+	// is cached if it forbids caching. Zero disables it.
+	NegativeCacheDuration uint32 `json:"negative_cache_duration"`
+	NegativeCacheCodes    []int  `json:"negative_cache_codes"`
+
+	// CacheAuthorized makes the responses to the requests with an
+	// Authorization header be cached like all others. By default they are
+	// cached only when they have the public, s-maxage or must-revalidate
+	// directives, as otherwise they may be meant only for the user who made
+	// the request. It should be set only when the upstream responds the same
+	// to all authorized users.
+	CacheAuthorized bool `json:"cache_authorized"`
+
+	// TTLRules set for how long the responses without an expiration of
+	// their own are cached, depending on their path or content type. The
+	// first rule which matches a response is used and the CacheDefaultDuration
+	// of the location when none does.
+	TTLRules []TTLRule `json:"ttl_rules"`
+
+	// ClientCacheControl overrides the Cache-Control header which the
+	// clients get, independently of for how long the responses are cached.
+	// The first rule which matches a response is used and the header is
+	// left as it is when none does.
+	ClientCacheControl []ClientCacheControlRule `json:"client_cache_control"`
+}
+
+// The possible values of Settings.ClientDisconnect
+const (
+	ClientDisconnectAbort            = "abort"
+	ClientDisconnectCompleteAndStore = "complete-and-store"
+)
+
+var defaultSettings = Settings{
+	ForwardConditionals:    true,
+	CacheUnknownLength:     true,
+	ClientDisconnect:       ClientDisconnectAbort,
+	DetachedFillTimeout:    60,
+	MaxRangeFillsPerObject: 4,
+	FillLockTimeout:        5000,
+	ParallelFillSize:       8 * 1024 * 1024,
+	HonorImmutable:         true,
+	CacheStatusHeader:      "X-Cache",
+	CompressedRanges:       CompressedRangeSettings{MaxSize: 1024 * 1024},
+	NegativeCacheCodes:     []int{http.StatusNotFound},
+}
+
 // CachingProxy is resposible for caching the metadata and parts the requested
 // objects to `loc.Storage`, according to the `loc.Algorithm`.
 type CachingProxy struct {
 	*types.Location
-	cfg  *config.Handler
-	next http.Handler
+	Settings Settings
+	cfg      *config.Handler
+	next     http.Handler
+	fills    *objectFills
+	revals   *revalidations
+
+	debugBypass *debugBypass
 }
 
 // New creates and returns a ready to used Handler.
@@ -26,13 +208,73 @@ func New(cfg *config.Handler, loc *types.Location, next http.Handler) (*CachingP
 		return nil, fmt.Errorf("caching proxy handler for %s needs a configured cache zone", loc.Name)
 	}
 
-	return &CachingProxy{loc, cfg, next}, nil
+	var s = defaultSettings
+	if cfg != nil && len(cfg.Settings) > 0 {
+		if err := json.Unmarshal(cfg.Settings, &s); err != nil {
+			return nil, fmt.Errorf("error while parsing settings for handler.cache - %s",
+				utils.ShowContextOfJSONError(err, cfg.Settings))
+		}
+	}
+
+	switch s.ClientDisconnect {
+	case ClientDisconnectAbort, ClientDisconnectCompleteAndStore:
+	default:
+		return nil, fmt.Errorf("handler.cache for %s has unknown client_disconnect policy `%s`",
+			loc.Name, s.ClientDisconnect)
+	}
+
+	s.CacheStatusHeader = http.CanonicalHeaderKey(strings.TrimSpace(s.CacheStatusHeader))
+
+	for _, patterns := range [][]string{s.CacheablePaths, s.NonCacheablePaths} {
+		if err := validatePathPatterns(patterns); err != nil {
+			return nil, fmt.Errorf("handler.cache for %s: %s", loc.Name, err)
+		}
+	}
+
+	if err := validateTTLRules(s.TTLRules); err != nil {
+		return nil, fmt.Errorf("handler.cache for %s: %s", loc.Name, err)
+	}
+
+	if err := validateClientCacheControlRules(s.ClientCacheControl); err != nil {
+		return nil, fmt.Errorf("handler.cache for %s: %s", loc.Name, err)
+	}
+
+	if err := validateVarySettings(&s.Vary); err != nil {
+		return nil, fmt.Errorf("handler.cache for %s: %s", loc.Name, err)
+	}
+
+	debugBypass, err := newDebugBypass(s.DebugBypass)
+	if err != nil {
+		return nil, fmt.Errorf("handler.cache for %s: %s", loc.Name, err)
+	}
+
+	return &CachingProxy{
+		Location: loc,
+		Settings: s,
+		cfg:      cfg,
+		next:     next,
+		fills:    newObjectFills(s.MaxRangeFillsPerObject),
+		revals:   newRevalidations(),
+
+		debugBypass: debugBypass,
+	}, nil
 }
 
 // ServeHTTP is the main serving function
 func (c *CachingProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" && req.Method != "HEAD" {
-		c.next.ServeHTTP(resp, req)
+	if c.debugBypass.requested(req) {
+		if c.debugBypass.isTrusted(req) {
+			c.recordCacheStatus(req, types.CacheStatusBypass, nil)
+			c.bypass(resp, req)
+			return
+		}
+		c.Logger.Debugf("Ignoring the request to bypass the cache from untrusted %s",
+			req.RemoteAddr)
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" || !c.isCacheablePath(req.URL.Path) {
+		c.recordCacheStatus(req, types.CacheStatusBypass, nil)
+		c.passThrough(resp, req)
 		return
 	}
 
@@ -41,5 +283,26 @@ func (c *CachingProxy) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		req:          req,
 		resp:         resp,
 	}
+	if c.Settings.RequestBudget > 0 {
+		rh.budget = types.NewRequestBudget(time.Duration(c.Settings.RequestBudget) * time.Millisecond)
+	}
 	rh.handle()
 }
+
+// recordCacheStatus passes how the request is handled by the cache to the
+// access log. obj is the cached object with which it is served, if any.
+func (c *CachingProxy) recordCacheStatus(req *http.Request, status string,
+	obj *types.ObjectMetadata) {
+
+	var age int64 = -1
+	if obj != nil {
+		if age = time.Now().Unix() - obj.ResponseTimestamp; age < 0 {
+			age = 0
+		}
+	}
+	contexts.RecordCacheStatus(req.Context(), &types.CacheStatus{
+		Status: status,
+		Zone:   c.Cache.ID,
+		Age:    age,
+	})
+}
@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+)
+
+// ClientCacheControlRule overrides the Cache-Control header which the clients
+// get for the matching responses, without changing for how long they are
+// cached. The pattern has the syntax of the TTLRule ones and an empty one
+// matches all responses. Value is the new Cache-Control header, e.g.
+// "public, max-age=60". With Remove the header is removed instead.
+type ClientCacheControlRule struct {
+	Pattern string `json:"pattern"`
+	Value   string `json:"value"`
+	Remove  bool   `json:"remove"`
+}
+
+// validateClientCacheControlRules returns an error if a rule has a malformed
+// pattern or does not say what to do with the header.
+func validateClientCacheControlRules(rules []ClientCacheControlRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid client cache control pattern `%s`: %s", rule.Pattern, err)
+		}
+		if (rule.Value == "") == !rule.Remove {
+			return fmt.Errorf("client cache control rule for `%s` needs either a value or remove",
+				rule.Pattern)
+		}
+	}
+	return nil
+}
+
+// setClientCacheControl applies the first of Settings.ClientCacheControl
+// which matches the response with the code and the upstream headers to the
+// headers sent to the client. The Expires and Pragma headers are removed
+// with the Cache-Control one, so that they do not contradict its new value.
+// The error responses and the ones which must not be stored in a shared
+// cache are left as they are.
+func (h *reqHandler) setClientCacheControl(code int, headers http.Header) {
+	if len(h.Settings.ClientCacheControl) == 0 || code >= http.StatusBadRequest ||
+		cacheutils.ResponseIsNoStore(headers) || cacheutils.ResponseIsPrivate(headers) {
+		return
+	}
+	if !h.Settings.CacheAuthorized && h.req.Header.Get("Authorization") != "" &&
+		!cacheutils.AuthorizedResponseIsShareable(headers) {
+		return
+	}
+	for _, rule := range h.Settings.ClientCacheControl {
+		if rule.Pattern != "" && !matchesResponse(rule.Pattern, h.req.URL.Path, headers) {
+			continue
+		}
+		var header = h.resp.Header()
+		header.Del("Expires")
+		header.Del("Pragma")
+		if rule.Remove {
+			header.Del("Cache-Control")
+		} else {
+			header.Set("Cache-Control", rule.Value)
+		}
+		return
+	}
+}
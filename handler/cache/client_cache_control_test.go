@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClientCacheControl(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.CacheDefaultDuration = time.Minute
+	app.cacheHandler.Settings.ClientCacheControl = []ClientCacheControlRule{
+		{Pattern: "/private/*", Remove: true},
+		{Pattern: "*.m3u8", Remove: true},
+		{Value: "public, max-age=60"},
+	}
+	var handler = func(cacheControl string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", cacheControl)
+			w.Header().Set("Expires", time.Now().Add(time.Hour).Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.Path)))
+			_, _ = w.Write([]byte(r.URL.Path))
+		}
+	}
+	app.up.Handle("/video.mp4", handler("max-age=3600"))
+	app.up.Handle("/live/stream.m3u8", handler("max-age=3600"))
+	app.up.Handle("/private/video.mp4", handler("private, max-age=3600"))
+
+	for _, test := range []struct {
+		path         string
+		cacheControl string
+		hasExpires   bool
+	}{
+		{"/video.mp4", "public, max-age=60", false},
+		{"/live/stream.m3u8", "", false},
+		// responses which are private are never changed
+		{"/private/video.mp4", "private, max-age=3600", true},
+	} {
+		// the first request is a miss and the second one is a hit
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://example.com"+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rec = httptest.NewRecorder()
+			app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+			if rec.Code != http.StatusOK || rec.Body.String() != test.path {
+				t.Errorf("Unexpected response %d %q for %s", rec.Code, rec.Body.String(), test.path)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != test.cacheControl {
+				t.Errorf("Expected Cache-Control %q for request %d of %s but got %q",
+					test.cacheControl, i, test.path, got)
+			}
+			if _, ok := rec.Header()["Expires"]; ok != test.hasExpires {
+				t.Errorf("Expected the Expires header for request %d of %s to be sent: %t",
+					i, test.path, test.hasExpires)
+			}
+		}
+	}
+
+	// the internal expiration does not change
+	req, err := http.NewRequest("GET", "http://example.com/video.mp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := app.cacheHandler.Cache.Storage.GetMetadata(app.cacheHandler.NewObjectIDForRequest(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresIn := time.Until(time.Unix(obj.ExpiresAt, 0)); expiresIn < time.Hour-2*time.Second {
+		t.Errorf("Expected the object to be cached for an hour but it expires in %s", expiresIn)
+	}
+}
+
+func TestValidateClientCacheControlRules(t *testing.T) {
+	t.Parallel()
+	for _, rules := range [][]ClientCacheControlRule{
+		{{Pattern: "/live/[a-", Value: "no-cache"}},
+		{{Pattern: "*.m3u8"}},
+		{{Value: "no-cache", Remove: true}},
+	} {
+		if err := validateClientCacheControlRules(rules); err == nil {
+			t.Errorf("Expected an error for the rules %v", rules)
+		}
+	}
+	var valid = []ClientCacheControlRule{{Value: "public, max-age=60"}, {Pattern: "image/*", Remove: true}}
+	if err := validateClientCacheControlRules(valid); err != nil {
+		t.Errorf("Unexpected error for valid rules: %s", err)
+	}
+}
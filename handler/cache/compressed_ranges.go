@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// CompressedRangeSettings configures the range requests for the objects which
+// are cached with the gzip content encoding, e.g. with vary.accept_encoding.
+type CompressedRangeSettings struct {
+	// Uncompressed makes the requested ranges refer to the uncompressed
+	// contents of such objects instead of the stored compressed bytes.
+	Uncompressed bool `json:"uncompressed"`
+
+	// MaxSize is the size of the largest compressed object which is
+	// decompressed to serve the range. The larger ones are served whole with
+	// 200, as decompressing them for every range is too expensive.
+	MaxSize types.BytesSize `json:"max_size"`
+}
+
+// maxDecompressionRatio bounds the uncompressed size of the objects which are
+// decompressed for range requests, so that a small object can not take an
+// unlimited amount of memory.
+const maxDecompressionRatio = 64
+
+// rangesUncompressed returns whether the range of the request refers to the
+// uncompressed contents of the cached object.
+func (h *reqHandler) rangesUncompressed() bool {
+	return h.Settings.CompressedRanges.Uncompressed &&
+		strings.EqualFold(h.obj.Headers.Get("Content-Encoding"), "gzip")
+}
+
+// knownCompressedRanged responds with the requested range of the uncompressed
+// contents of the cached gzip object. Objects larger than the limit, HEAD
+// requests and multiple ranges are responded to with the whole compressed
+// object.
+func (h *reqHandler) knownCompressedRanged() {
+	var rng = h.req.Header.Get("Range")
+	if h.req.Method == "HEAD" || h.obj.Size > h.Settings.CompressedRanges.MaxSize.Bytes() {
+		h.Logger.Debugf("[%s] Serving the whole compressed object of %d bytes instead of a range",
+			h.reqID, h.obj.Size)
+		h.knownFull()
+		return
+	}
+	// with a known uncompressed size the invalid ranges are not decompressed
+	if h.obj.UncompressedSize != 0 {
+		if _, err := httputils.ParseRequestRange(rng, h.obj.UncompressedSize); err != nil {
+			h.unsatisfiableRange(h.obj.UncompressedSize)
+			return
+		}
+	}
+
+	contents, err := h.decompressObject()
+	if err != nil {
+		h.Logger.Errorf("[%s] Could not decompress %s for a range, serving it whole: %s",
+			h.reqID, h.objID, err)
+		h.knownFull()
+		return
+	}
+	var size = uint64(len(contents))
+	h.saveUncompressedSize(size)
+
+	ranges, err := httputils.ParseRequestRange(rng, size)
+	if err != nil {
+		h.unsatisfiableRange(size)
+		return
+	}
+	if len(ranges) != 1 {
+		h.knownFull()
+		return
+	}
+
+	httputils.CopyHeaders(h.obj.Headers, h.resp.Header())
+	h.resp.Header().Del("Content-Encoding")
+	// the uncompressed representation is not the one the ETag is for
+	if etag := h.resp.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.resp.Header().Set("ETag", "W/"+etag)
+	}
+	h.resp.Header().Set("Content-Range", ranges[0].ContentRange(size))
+	h.resp.Header().Set("Content-Length", strconv.FormatUint(ranges[0].Length, 10))
+	h.rewriteTimeBasedHeaders()
+	h.setWarningHeaders()
+	h.setClientCacheControl(http.StatusPartialContent, h.obj.Headers)
+	h.setCacheStatusHeader()
+	h.resp.WriteHeader(http.StatusPartialContent)
+	if _, err := h.resp.Write(contents[ranges[0].Start : ranges[0].Start+ranges[0].Length]); err != nil {
+		h.Logger.Logf("[%s] Error while sending the uncompressed range: %s", h.reqID, err)
+	}
+}
+
+// decompressObject returns the uncompressed contents of the cached gzip object,
+// loading its missing parts from the upstream.
+func (h *reqHandler) decompressObject() ([]byte, error) {
+	var compressed bytes.Buffer
+	if h.obj.Size > 0 && !h.lazilyRespond(&compressed, 0, h.obj.Size-1) {
+		return nil, fmt.Errorf("could not read the compressed object")
+	}
+	r, err := gzip.NewReader(&compressed)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var limit = int64(maxDecompressionRatio * h.obj.Size)
+	contents, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(contents)) > limit {
+		return nil, fmt.Errorf("the object is more than %d times larger uncompressed",
+			maxDecompressionRatio)
+	}
+	return contents, nil
+}
+
+// saveUncompressedSize stores the uncompressed size of the object with its
+// metadata, if it was not known.
+func (h *reqHandler) saveUncompressedSize(size uint64) {
+	if h.obj.UncompressedSize == size {
+		return
+	}
+	var updated = *h.obj
+	updated.UncompressedSize = size
+	if err := h.Cache.Storage.UpdateMetadata(&updated); err != nil {
+		h.Logger.Debugf("[%s] Could not save the uncompressed size of %s: %s",
+			h.reqID, h.objID, err)
+		return
+	}
+	h.obj = &updated
+}
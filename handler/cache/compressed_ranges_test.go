@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressedRanges(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.Vary = VarySettings{AcceptEncoding: []string{"gzip"}}
+	if err := validateVarySettings(&app.cacheHandler.Settings.Vary); err != nil {
+		t.Fatal(err)
+	}
+	app.cacheHandler.Settings.CompressedRanges = CompressedRangeSettings{
+		Uncompressed: true,
+		MaxSize:      1024,
+	}
+
+	var contents = strings.Repeat("0123456789", 20)
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/small", "/large"} {
+		app.up.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("ETag", `"gz"`)
+			w.Header().Set("Vary", "Accept-Encoding")
+			w.Header().Set("Cache-Control", "max-age=3600")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(compressed.Bytes()))
+		})
+	}
+
+	var serve = func(path, rng string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+		return rec
+	}
+
+	// the small object is decompressed and sliced
+	if rec := serve("/small", ""); rec.Body.String() != compressed.String() {
+		t.Fatalf("Unexpected response while caching the object %d %q", rec.Code, rec.Body)
+	}
+	for _, test := range []struct{ rng, expected, contentRange string }{
+		{"bytes=5-14", contents[5:15], "bytes 5-14/200"},
+		{"bytes=-3", contents[197:], "bytes 197-199/200"},
+		{"bytes=190-", contents[190:], "bytes 190-199/200"},
+	} {
+		var rec = serve("/small", test.rng)
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != test.expected {
+			t.Errorf("Expected %q for %s but got %d %q", test.expected, test.rng, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Range"); got != test.contentRange {
+			t.Errorf("Expected Content-Range %q for %s but got %q", test.contentRange, test.rng, got)
+		}
+		if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("ETag") != `W/"gz"` {
+			t.Errorf("Expected an unencoded range with a weak ETag but got %v", rec.Header())
+		}
+		if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(test.expected)) {
+			t.Errorf("Expected Content-Length %d but got %s", len(test.expected), got)
+		}
+	}
+	var rec = serve("/small", "bytes=200-")
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */200" {
+		t.Errorf("Expected an unsatisfiable range but got %d %v", rec.Code, rec.Header())
+	}
+	req, err := http.NewRequest("GET", "http://example.com/small", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	var h = &reqHandler{CachingProxy: app.cacheHandler, req: req}
+	var id = h.variantID(app.cacheHandler.NewObjectIDForRequest(req))
+	if obj, err := app.cacheHandler.Cache.Storage.GetMetadata(id); err != nil || obj.UncompressedSize != 200 {
+		t.Errorf("Expected the uncompressed size to be stored but got %+v (%v)", obj, err)
+	}
+
+	// the large object is served whole
+	app.cacheHandler.Settings.CompressedRanges.MaxSize = 10
+	if rec = serve("/large", ""); rec.Body.String() != compressed.String() {
+		t.Fatalf("Unexpected response while caching the object %d %q", rec.Code, rec.Body)
+	}
+	rec = serve("/large", "bytes=5-14")
+	if rec.Code != http.StatusOK || rec.Body.String() != compressed.String() ||
+		rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected the whole cached compressed object but got %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// The headers of the stored response which are sent with a 304 response, as
+// per RFC 7232 section 4.1. Cache-Control and Expires are rewritten.
+var notModifiedHeaders = []string{"ETag", "Last-Modified", "Vary", "Content-Location"}
+
+// notModified evaluates the conditional headers of the request against the
+// cached object as per RFC 7232 section 6. If-None-Match uses the weak
+// comparison and if present If-Modified-Since is ignored.
+func (h *reqHandler) notModified() bool {
+	if h.req.Method != "GET" && h.req.Method != "HEAD" {
+		return false
+	}
+	if h.obj.Code < 200 || h.obj.Code > 299 {
+		return false // the conditions are evaluated only for successful responses
+	}
+	if inm := h.req.Header.Get("If-None-Match"); inm != "" {
+		return httputils.ETagMatches(inm, h.obj.Headers.Get("ETag"), true)
+	}
+
+	ims, err := http.ParseTime(h.req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.obj.Headers.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(ims)
+}
+
+// ifRangeMatches evaluates the If-Range header of the request against the
+// cached object as per RFC 7233 section 3.2. The requested range is served
+// only when it matches, otherwise the whole object is. An entity tag uses the
+// strong comparison and a date has to be the same as Last-Modified, so weak
+// validators never match. Requests without If-Range always match.
+func (h *reqHandler) ifRangeMatches() bool {
+	var ifRange = strings.TrimSpace(h.req.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return httputils.ETagMatches(ifRange, h.obj.Headers.Get("ETag"), false)
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.obj.Headers.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return lastModified.Equal(date)
+}
+
+// knownNotModified responds with 304 Not Modified and the validators of the
+// cached object. Any Range header is ignored, as per RFC 7233 section 3.1.
+func (h *reqHandler) knownNotModified() {
+	for _, name := range notModifiedHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := h.obj.Headers[name]; ok {
+			h.resp.Header()[name] = utils.CopyStringSlice(values)
+		}
+	}
+	h.rewriteTimeBasedHeaders()
+	h.setWarningHeaders()
+	h.setClientCacheControl(http.StatusNotModified, h.obj.Headers)
+	h.setCacheStatusHeader()
+	h.resp.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const contents = "conditionally requested contents"
+	var lastModified = time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	var requests int32
+	app.up.Handle("/cond", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", `"tag"`)
+		http.ServeContent(w, r, "", lastModified, strings.NewReader(contents))
+	}))
+
+	var newRequest = func(method string, headers map[string]string) *http.Request {
+		req, err := http.NewRequest(method, "http://example.com/cond", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req.WithContext(app.ctx)
+	}
+	app.testRequest(newRequest("GET", nil), contents, http.StatusOK)
+
+	var ims = func(t time.Time) string { return t.Format(http.TimeFormat) }
+	var tests = []struct {
+		name    string
+		method  string
+		headers map[string]string
+		code    int
+		body    string
+	}{
+		{"strong etag", "GET", map[string]string{"If-None-Match": `"tag"`}, 304, ""},
+		{"weak etag", "GET", map[string]string{"If-None-Match": `W/"tag"`}, 304, ""},
+		{"etag list", "GET", map[string]string{"If-None-Match": `"other", "tag"`}, 304, ""},
+		{"any etag", "GET", map[string]string{"If-None-Match": `*`}, 304, ""},
+		{"other etag", "GET", map[string]string{"If-None-Match": `"other"`}, 200, contents},
+		{"etag precedence", "GET", map[string]string{
+			"If-None-Match":     `"other"`,
+			"If-Modified-Since": ims(lastModified.Add(time.Minute)),
+		}, 200, contents},
+		{"not modified since", "GET", map[string]string{"If-Modified-Since": ims(lastModified)}, 304, ""},
+		{"modified since", "GET", map[string]string{"If-Modified-Since": ims(lastModified.Add(-time.Minute))}, 200, contents},
+		{"invalid date", "GET", map[string]string{"If-Modified-Since": "yesterday"}, 200, contents},
+		{"range ignored", "GET", map[string]string{"If-None-Match": `"tag"`, "Range": "bytes=0-4"}, 304, ""},
+		{"range", "GET", map[string]string{"If-None-Match": `"other"`, "Range": "bytes=0-4"}, 206, contents[:5]},
+		{"head", "HEAD", map[string]string{"If-None-Match": `"tag"`}, 304, ""},
+	}
+	for _, test := range tests {
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, newRequest(test.method, test.headers))
+		if rec.Code != test.code || rec.Body.String() != test.body {
+			t.Errorf("%s: expected %d %q but got %d %q",
+				test.name, test.code, test.body, rec.Code, rec.Body.String())
+		}
+		if rec.Code != http.StatusNotModified {
+			continue
+		}
+		if rec.Header().Get("ETag") != `"tag"` || rec.Header().Get("Last-Modified") != ims(lastModified) {
+			t.Errorf("%s: expected the validators in the 304 response but got %v", test.name, rec.Header())
+		}
+		if rec.Header().Get("Cache-Control") == "" || rec.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: unexpected headers of the 304 response %v", test.name, rec.Header())
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected only the first request to reach the upstream but there were %d", n)
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const contents = "partially requested contents"
+	var lastModified = time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	var requests int32
+	app.up.Handle("/ifrange", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", `"tag"`)
+		http.ServeContent(w, r, "", lastModified, strings.NewReader(contents))
+	}))
+
+	var newRequest = func(headers map[string]string) *http.Request {
+		req, err := http.NewRequest("GET", "http://example.com/ifrange", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req.WithContext(app.ctx)
+	}
+	app.testRequest(newRequest(nil), contents, http.StatusOK)
+
+	var date = func(t time.Time) string { return t.Format(http.TimeFormat) }
+	var tests = []struct {
+		name    string
+		ifRange string
+		code    int
+		body    string
+	}{
+		{"strong etag", `"tag"`, 206, contents[:7]},
+		{"other etag", `"other"`, 200, contents},
+		{"weak etag", `W/"tag"`, 200, contents},
+		{"same date", date(lastModified), 206, contents[:7]},
+		{"later date", date(lastModified.Add(time.Minute)), 200, contents},
+		{"earlier date", date(lastModified.Add(-time.Minute)), 200, contents},
+		{"invalid date", "yesterday", 200, contents},
+	}
+	for _, test := range tests {
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, newRequest(map[string]string{
+			"Range":    "bytes=0-6",
+			"If-Range": test.ifRange,
+		}))
+		if rec.Code != test.code || rec.Body.String() != test.body {
+			t.Errorf("%s: expected %d %q but got %d %q",
+				test.name, test.code, test.body, rec.Code, rec.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected only the first request to reach the upstream but there were %d", n)
+	}
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/netutils"
+)
+
+// The headers with which the responses to bypassing requests are diagnosed.
+const (
+	bypassUpstreamHeader = "X-Nedomi-Bypass-Upstream"
+	bypassTimeHeader     = "X-Nedomi-Bypass-Time"
+)
+
+// DebugBypassSettings configures the bypass of the cache for debugging. A
+// request with a true value (e.g. "1") of Header from one of TrustedNetworks
+// is proxied to the upstream without using or filling the cache. Requests from
+// other clients are served as if the header was not there.
+type DebugBypassSettings struct {
+	Header string `json:"header"`
+	// TrustedNetworks contains IP addresses and CIDR networks
+	TrustedNetworks []string `json:"trusted_networks"`
+}
+
+type debugBypass struct {
+	header  string
+	trusted netutils.IPNetworks
+}
+
+func newDebugBypass(s DebugBypassSettings) (*debugBypass, error) {
+	if s.Header == "" {
+		if len(s.TrustedNetworks) > 0 {
+			return nil, fmt.Errorf("debug_bypass has trusted_networks but no header")
+		}
+		return nil, nil
+	}
+	// without trusted networks anyone could bust the cache
+	if len(s.TrustedNetworks) == 0 {
+		return nil, fmt.Errorf("debug_bypass needs at least one trusted network")
+	}
+
+	trusted, err := netutils.ParseIPNetworks(s.TrustedNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("debug_bypass has an invalid trusted network: %s", err)
+	}
+	return &debugBypass{header: http.CanonicalHeaderKey(s.Header), trusted: trusted}, nil
+}
+
+// requested returns whether the request asks for the cache to be bypassed.
+func (d *debugBypass) requested(req *http.Request) bool {
+	if d == nil {
+		return false
+	}
+	bypass, err := strconv.ParseBool(req.Header.Get(d.header))
+	return err == nil && bypass
+}
+
+// isTrusted returns whether the client which sent the request may bypass the
+// cache. Only the address of the connection is checked as the headers with
+// forwarded addresses can be forged.
+func (d *debugBypass) isTrusted(req *http.Request) bool {
+	return d.trusted.ContainsRemoteAddr(req.RemoteAddr)
+}
+
+// bypass proxies the request straight to the upstream and adds the upstream
+// which was used and the time it took to respond to the response headers.
+func (c *CachingProxy) bypass(resp http.ResponseWriter, req *http.Request) {
+	var reqID, _ = contexts.GetRequestID(req.Context())
+	c.Logger.Logf("[%s] Bypassing the cache for %s %s from %s", reqID, req.Method,
+		req.RequestURI, req.RemoteAddr)
+
+	var w = &bypassWriter{ResponseWriter: resp, start: time.Now()}
+	var ctx = contexts.NewUpstreamRecorderContext(req.Context(), w.setUpstream)
+	var outreq = req.WithContext(ctx)
+	outreq.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		if name != c.debugBypass.header {
+			outreq.Header[name] = values
+		}
+	}
+	c.next.ServeHTTP(w, outreq)
+}
+
+// bypassWriter adds the diagnostic headers to the response of a request which
+// bypassed the cache.
+type bypassWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	mu          sync.Mutex
+	upstream    string
+	wroteHeader bool
+}
+
+func (w *bypassWriter) setUpstream(addr *types.UpstreamAddress) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// with retries the last upstream is the one which responded
+	w.upstream = addr.Host
+}
+
+func (w *bypassWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.mu.Lock()
+		if w.upstream != "" {
+			w.Header().Set(bypassUpstreamHeader, w.upstream)
+		}
+		w.mu.Unlock()
+		w.Header().Set(bypassTimeHeader, time.Since(w.start).String())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bypassWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush and CloseNotify are passed through, as the proxy handler relies on
+// them for streaming and aborting the upstream requests.
+
+func (w *bypassWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *bypassWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
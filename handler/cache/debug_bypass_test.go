@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestDebugBypass(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var err error
+	app.cacheHandler.debugBypass, err = newDebugBypass(DebugBypassSettings{
+		Header:          "X-Nedomi-Bypass",
+		TrustedNetworks: []string{"10.0.0.0/8", "::1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstreamRequests int32
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n = atomic.AddInt32(&upstreamRequests, 1)
+		if r.Header.Get("X-Nedomi-Bypass") != "" {
+			t.Error("The bypass header was sent to the upstream")
+		}
+		contexts.RecordUpstream(r.Context(), &types.UpstreamAddress{
+			URL: url.URL{Scheme: "http", Host: "origin:8080"},
+		})
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", "9")
+		fmt.Fprintf(w, "version %d", n)
+	})
+
+	var get = func(remoteAddr, bypass string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://example.com/bypass", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(app.ctx)
+		req.RemoteAddr = remoteAddr
+		if bypass != "" {
+			req.Header.Set("X-Nedomi-Bypass", bypass)
+		}
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var tests = []struct {
+		remoteAddr, bypass, body string
+		bypassed                 bool
+	}{
+		{"192.168.0.1:1234", "", "version 1", false},        // fills the cache
+		{"192.168.0.1:1234", "", "version 1", false},        // from the cache
+		{"192.168.0.1:1234", "1", "version 1", false},       // untrusted, ignored
+		{"10.1.2.3:1234", "1", "version 2", true},           // trusted
+		{"[::1]:1234", "true", "version 3", true},           // trusted single address
+		{"10.1.2.3:1234", "0", "version 1", false},          // not asked for
+		{"[::2]:1234", "1", "version 1", false},             // untrusted
+		{"11.1.2.3:1234", "1", "version 1", false},          // untrusted
+		{"192.168.0.1:1234", "", "version 1", false},        // the cache is unchanged
+		{"10.1.2.3:1234", "yes please", "version 1", false}, // not a boolean
+	}
+	for i, test := range tests {
+		var rec = get(test.remoteAddr, test.bypass)
+		if rec.Code != http.StatusOK || rec.Body.String() != test.body {
+			t.Errorf("Test %d: expected %q but got %d %q", i, test.body, rec.Code, rec.Body)
+		}
+		var upstream, elapsed = rec.Header().Get(bypassUpstreamHeader), rec.Header().Get(bypassTimeHeader)
+		if test.bypassed && (upstream != "origin:8080" || elapsed == "") {
+			t.Errorf("Test %d: expected diagnostic headers but got upstream %q and time %q",
+				i, upstream, elapsed)
+		} else if !test.bypassed && (upstream != "" || elapsed != "") {
+			t.Errorf("Test %d: expected no diagnostic headers but got upstream %q and time %q",
+				i, upstream, elapsed)
+		}
+	}
+	if upstreamRequests != 3 {
+		t.Errorf("Expected 3 upstream requests but there were %d", upstreamRequests)
+	}
+}
+
+func TestDebugBypassSettings(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		settings DebugBypassSettings
+		valid    bool
+	}{
+		{DebugBypassSettings{}, true},
+		{DebugBypassSettings{Header: "X-Bypass", TrustedNetworks: []string{"127.0.0.1"}}, true},
+		{DebugBypassSettings{Header: "X-Bypass", TrustedNetworks: []string{"fd00::/8"}}, true},
+		{DebugBypassSettings{Header: "X-Bypass"}, false},
+		{DebugBypassSettings{TrustedNetworks: []string{"127.0.0.1"}}, false},
+		{DebugBypassSettings{Header: "X-Bypass", TrustedNetworks: []string{"localhost"}}, false},
+		{DebugBypassSettings{Header: "X-Bypass", TrustedNetworks: []string{"10.0.0.0/33"}}, false},
+	}
+	for _, test := range tests {
+		if _, err := newDebugBypass(test.settings); (err == nil) != test.valid {
+			t.Errorf("Expected %+v to be valid=%t but got error %v", test.settings, test.valid, err)
+		}
+	}
+}
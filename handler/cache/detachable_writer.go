@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils"
+)
+
+var errDetachedFillTimeout = errors.New("the detached cache fill timed out")
+
+// detachableWriter writes to the client and to the cache. If writing to the
+// client fails, the client is detached and the writes continue only to the
+// cache so that the object is stored even though nobody is waiting for it.
+// A detached writer fails all writes after the timeout and calls the cancel
+// function so that the upstream request is aborted even if it is stalled.
+type detachableWriter struct {
+	sync.Mutex
+	client   io.WriteCloser
+	cache    io.WriteCloser
+	timeout  time.Duration
+	cancel   func()
+	onDetach func(error)
+
+	detached bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newDetachableWriter(client, cache io.WriteCloser, timeout time.Duration,
+	cancel func(), onDetach func(error)) *detachableWriter {
+	return &detachableWriter{
+		client:   client,
+		cache:    cache,
+		timeout:  timeout,
+		cancel:   cancel,
+		onDetach: onDetach,
+	}
+}
+
+func (d *detachableWriter) Write(p []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	if !d.detached {
+		n, err := d.client.Write(p)
+		if err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			d.detach(err)
+		}
+	} else if time.Now().After(d.deadline) {
+		return 0, errDetachedFillTimeout
+	}
+
+	return d.cache.Write(p)
+}
+
+// detach must be called with the lock held.
+func (d *detachableWriter) detach(err error) {
+	if d.onDetach != nil {
+		d.onDetach(err)
+	}
+	d.detached = true
+	d.deadline = time.Now().Add(d.timeout)
+	if d.cancel != nil {
+		d.timer = time.AfterFunc(d.timeout, d.cancel)
+	}
+}
+
+func (d *detachableWriter) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	return utils.NewCompositeError(d.client.Close(), d.cache.Close())
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+// disconnectingWriter is a response writer for a client which disconnects
+// after receiving a few bytes.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	remaining int
+}
+
+func (d *disconnectingWriter) Write(p []byte) (int, error) {
+	if d.remaining <= 0 {
+		return 0, errors.New("client disconnected")
+	}
+	if len(p) > d.remaining {
+		p = p[:d.remaining]
+	}
+	d.remaining -= len(p)
+	n, _ := d.ResponseRecorder.Write(p)
+	return n, nil
+}
+
+func testClientDisconnect(t *testing.T, policy string) (stored bool) {
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.ClientDisconnect = policy
+	var contents = testutils.GenerateMeAString(3, 100)
+	var upstreamRequests int32
+	app.up.HandleFunc("/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamRequests, 1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		// write in small chunks so the client is gone mid-fill
+		for i := 0; i < len(contents); i += 10 {
+			if _, err := w.Write([]byte(contents[i:min(i+10, len(contents))])); err != nil {
+				return
+			}
+		}
+	})
+
+	req, err := http.NewRequest("GET", "http://example.com/disconnect", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.cacheHandler.ServeHTTP(&disconnectingWriter{
+		ResponseRecorder: httptest.NewRecorder(),
+		remaining:        15,
+	}, req.WithContext(app.ctx))
+
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/disconnect"})
+	parts, err := app.cacheHandler.Cache.Storage.GetAvailableParts(objID)
+	if err != nil || len(parts) != 20 {
+		return false
+	}
+
+	app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+	if upstreamRequests != 1 {
+		t.Errorf("Expected the second request to be a hit but the upstream was hit %d times",
+			upstreamRequests)
+	}
+	return true
+}
+
+func TestClientDisconnectCompleteAndStore(t *testing.T) {
+	t.Parallel()
+	if !testClientDisconnect(t, ClientDisconnectCompleteAndStore) {
+		t.Error("Expected the object to be fully cached after the client disconnected")
+	}
+}
+
+func TestClientDisconnectAbort(t *testing.T) {
+	t.Parallel()
+	if testClientDisconnect(t, ClientDisconnectAbort) {
+		t.Error("Expected the cache fill to be aborted after the client disconnected")
+	}
+}
+
+func TestDetachedWriterTimeout(t *testing.T) {
+	t.Parallel()
+	var cancelled = make(chan struct{})
+	var cache = &disconnectingWriter{ResponseRecorder: httptest.NewRecorder(), remaining: 100}
+	var client = &disconnectingWriter{ResponseRecorder: httptest.NewRecorder()}
+	var dw = newDetachableWriter(utils.NopCloser(client), utils.NopCloser(cache), 0,
+		func() { close(cancelled) }, nil)
+
+	if _, err := dw.Write([]byte("data")); err != nil {
+		// the deadline is only checked for the writes after the detachment
+		t.Errorf("Unexpected error on the first write: %s", err)
+	}
+	<-cancelled
+	if _, err := dw.Write([]byte("data")); err != errDetachedFillTimeout {
+		t.Errorf("Expected a timeout error but got %v", err)
+	}
+	if err := dw.Close(); err != nil {
+		t.Errorf("Unexpected error on close: %s", err)
+	}
+}
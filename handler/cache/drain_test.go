@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ironsmile/nedomi/storage"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestDrainedZone(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const contents = "0123456789abcdefghijABCDEFGHIJ"
+	var cached, uncached = &versionedUpstream{}, &versionedUpstream{}
+	cached.set(1, contents)
+	uncached.set(1, contents)
+	app.up.Handle("/cached", cached)
+	app.up.Handle("/uncached", uncached)
+	var cz = app.cacheHandler.Cache
+
+	var get = func(path string) *http.Request {
+		req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.WithContext(app.ctx)
+	}
+	var isStored = func(path string) bool {
+		_, err := cz.Storage.GetMetadata(app.cacheHandler.NewObjectIDForRequest(get(path)))
+		return err == nil
+	}
+
+	app.testRequest(get("/cached"), contents, http.StatusOK)
+	cz.SetDrainMode(types.DrainReadOnly)
+
+	// the stored objects are still served
+	app.testRequest(get("/cached"), contents, http.StatusOK)
+	app.testRequest(reqForRange("cached", 10, 5).WithContext(app.ctx), contents[10:15], http.StatusPartialContent)
+	if r, _ := cached.counts(); r != 1 {
+		t.Errorf("Expected the drained zone to serve the hits but there were %d upstream requests", r)
+	}
+
+	// but nothing new is stored
+	app.testRequest(get("/uncached"), contents, http.StatusOK)
+	app.testRequest(get("/uncached"), contents, http.StatusOK)
+	if r, _ := uncached.counts(); r != 2 || isStored("/uncached") {
+		t.Errorf("Expected the drained zone to not store new objects but there were %d upstream requests", r)
+	}
+
+	// the expired objects are kept in frozen zones
+	var id = app.cacheHandler.NewObjectIDForRequest(get("/cached"))
+	cz.SetDrainMode(types.DrainFrozen)
+	storage.GetExpirationHandler(cz, id)(app.cacheHandler.Logger)
+	if !isStored("/cached") || !cz.Scheduler.Contains(id.Hash()) {
+		t.Error("Expected the expired object to be kept and its expiration postponed in the frozen zone")
+	}
+	cz.SetDrainMode(types.DrainReadOnly)
+	storage.GetExpirationHandler(cz, id)(app.cacheHandler.Logger)
+	if isStored("/cached") {
+		t.Error("Expected the expired object to be removed from the read-only zone")
+	}
+
+	// the zone stores objects again when the drain ends
+	cz.SetDrainMode(types.DrainOff)
+	app.testRequest(get("/uncached"), contents, http.StatusOK)
+	if !isStored("/uncached") {
+		t.Error("Expected the objects to be stored again after the drain ends")
+	}
+}
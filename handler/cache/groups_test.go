@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestGroupPurgeIsAtomic(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.GroupHeader = "X-Group"
+	var version int32 = 1
+	var contents = func(name string) string {
+		return name + "-version-" + strconv.Itoa(int(atomic.LoadInt32(&version)))
+	}
+	var handler = func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var body = contents(name)
+			w.Header().Set("X-Group", "stream")
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			_, _ = w.Write([]byte(body))
+		}
+	}
+	app.up.Handle("/stream/manifest", handler("manifest"))
+	app.up.Handle("/stream/segment", handler("segment"))
+
+	var fetchBoth = func(expected int) {
+		for _, name := range []string{"manifest", "segment"} {
+			req, err := http.NewRequest("GET", "http://example.com/stream/"+name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.testRequest(req.WithContext(app.ctx),
+				name+"-version-"+strconv.Itoa(expected), http.StatusOK)
+		}
+	}
+
+	fetchBoth(1) // fill the cache
+	atomic.StoreInt32(&version, 2)
+	fetchBoth(1) // served from the cache
+
+	var cz = app.cacheHandler.Cache
+	var ids = cz.Groups.Invalidate("stream")
+	if len(ids) != 2 {
+		t.Fatalf("Expected 2 objects in the group but got %d", len(ids))
+	}
+	var manifestID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/stream/manifest"})
+	// discard only the manifest - the segment is still in the storage but
+	// must not be served as the group was already purged
+	if err := cz.Storage.Discard(manifestID); err != nil {
+		t.Fatal(err)
+	}
+	fetchBoth(2)
+
+	for _, id := range ids {
+		_ = cz.Storage.Discard(id)
+	}
+	fetchBoth(2)
+}
+
+func TestSurrogateKeysAreIndexed(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.SurrogateKeyHeader = "Surrogate-Key"
+	var cz = app.cacheHandler.Cache
+	cz.SurrogateKeys = types.NewSurrogateKeys()
+	app.up.HandleFunc("/tagged", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Surrogate-Key", "product-1  products")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", "6")
+		_, _ = w.Write([]byte("tagged"))
+	})
+
+	req, err := http.NewRequest("GET", "http://example.com/tagged", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req.WithContext(app.ctx), "tagged", http.StatusOK)
+
+	var id = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/tagged"})
+	obj, err := cz.Storage.GetMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obj.SurrogateKeys) != 2 || obj.SurrogateKeys[0] != "product-1" || obj.SurrogateKeys[1] != "products" {
+		t.Errorf("Expected the surrogate keys to be stored but got %q", obj.SurrogateKeys)
+	}
+	if ids := cz.SurrogateKeys.Purge("products"); len(ids) != 1 || *ids[0] != *id {
+		t.Errorf("Expected %s to be indexed by its surrogate key but got %v", id, ids)
+	}
+}
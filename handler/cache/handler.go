@@ -1,12 +1,15 @@
 package cache
 
 import (
+	"context"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/storage"
 	"github.com/ironsmile/nedomi/types"
 	"github.com/ironsmile/nedomi/utils"
 	"github.com/ironsmile/nedomi/utils/cacheutils"
@@ -22,20 +25,64 @@ type reqHandler struct {
 	objID *types.ObjectID
 	obj   *types.ObjectMetadata
 	reqID types.RequestID
+	// cancels the upstream request made by carbonCopyProxy
+	cancelFill func()
+	// the context of the upstream request made by carbonCopyProxy, the
+	// parts from its response are saved with it
+	fillCtx context.Context
+	// called when the response hook for an object which was not cached has
+	// run, so that the requests waiting for its metadata can continue
+	metadataFilled func()
+	// releases the parts claimed by the response hook
+	releaseFilledParts func()
+	// the warn-code with which the cached object is served when it is not
+	// fresh, zero if it is
+	staleWarning int
+	// the stale object which is being revalidated by this request, if any
+	revalidating *types.ObjectMetadata
+	// whether the revalidation failed and the stale object was kept
+	revalidationFailed bool
+	// the expired object whose validators are sent with the upstream
+	// request, if any
+	conditional *types.ObjectMetadata
+	// whether the upstream responded that the conditional object is not
+	// modified
+	notModifiedUpstream bool
+	// how the request is served, for the cache status header
+	cacheStatus string
+	// the latency budget of the request, nil if it is unlimited
+	budget *types.RequestBudget
+	// stops the timer which cancels the upstream request when the budget is
+	// spent and returns false if it has already fired
+	stopBudgetTimer func() bool
+	// whether the revalidation of the expired object in h.obj failed, so
+	// that it is served stale
+	revalidatedStale bool
+	// whether the upstream requests for the missing parts are aborted when
+	// the request is done instead of being completed for the cache, as for
+	// the chunks which are loaded in parallel
+	abortFills bool
+	// the writer of the first chunk of the object which is not cached, when
+	// the rest of it is loaded in parallel
+	firstChunk *firstChunkWriter
+	// whether the request stopped waiting for the fill of the metadata of
+	// the object, so its response is passed through without being stored
+	lockTimedOut bool
 }
 
 // handle tries to respond to client request by loading metadata and file parts
 // from the cache. If there are missing parts, they are retrieved from the upstream.
 func (h *reqHandler) handle() {
-	h.objID = h.NewObjectIDForURL(h.req.URL)
+	h.objID = h.variantID(h.NewObjectIDForRequest(h.req))
 	h.reqID, _ = contexts.GetRequestID(h.req.Context())
 	h.Logger.Debugf("[%s] Caching proxy access: %s %s", h.reqID, h.req.Method, h.req.RequestURI)
+	// serving from the cache records a hit instead
+	h.setCacheStatus(types.CacheStatusMiss, nil)
 
-	rng := h.req.Header.Get("Range")
 	obj, err := h.Cache.Storage.GetMetadata(h.objID)
 	if os.IsNotExist(err) {
 		h.Logger.Debugf("[%s] No metadata on storage, proxying...", h.reqID)
-		h.carbonCopyProxy()
+		h.proxyMiss()
 	} else if err != nil {
 		h.Logger.Errorf("[%s] Storage error when reading metadata: %s", h.reqID, err)
 		if isTooManyFiles(err) {
@@ -50,43 +97,123 @@ func (h *reqHandler) handle() {
 				h.reqID, discardErr)
 		}
 		h.carbonCopyProxy()
-	} else if !utils.IsMetadataFresh(obj) {
-		h.Logger.Debugf("[%s] Metadata is stale, proxying...", h.reqID)
-		//!TODO: optimize, do only a head request when the metadata is stale?
-		if discardErr := h.Cache.Storage.Discard(h.objID); discardErr != nil {
+	} else if obj.Negative && !utils.IsMetadataFresh(obj) {
+		h.Logger.Debugf("[%s] The cached error response expired, proxying...", h.reqID)
+		storage.GetExpirationHandler(h.Cache, h.objID)(h.Logger)
+		h.carbonCopyProxy()
+	} else if !utils.IsMetadataFresh(obj) && h.serveStaleWarning(obj) == 0 {
+		h.revals.forget(h.objID)
+		if hasValidators(obj.Headers) || h.servesStaleIfError(obj) {
+			h.Logger.Debugf("[%s] Metadata is stale, revalidating it...", h.reqID)
+			h.revalidateConditionally(obj)
+		} else {
+			h.Logger.Debugf("[%s] Metadata is stale, proxying...", h.reqID)
+			storage.GetExpirationHandler(h.Cache, h.objID)(h.Logger)
+			h.carbonCopyProxy()
+		}
+	} else if obj.Group != "" && !h.Cache.Groups.IsCurrent(obj.Group, obj.GroupGeneration) {
+		h.Logger.Debugf("[%s] The group %s of the object was purged, proxying...",
+			h.reqID, obj.Group)
+		if discardErr := h.Cache.Storage.Discard(h.objID); discardErr != nil && !os.IsNotExist(discardErr) {
 			h.Logger.Errorf("[%s] Storage error when discarding of object's data: %s",
 				h.reqID, discardErr)
 		}
 		h.carbonCopyProxy()
-	} else if !cacheutils.CacheSatisfiesRequest(obj, h.req) {
+	} else if !cacheutils.CacheSatisfiesRequest(obj, h.req) && !h.freshImmutable(obj) {
 		h.Logger.Debugf("[%s] Client does not want cached response or the cache does not"+
 			"satisfy the request, proxying...", h.reqID)
 		h.carbonCopyProxy()
 	} else {
 		h.obj = obj
-		//!TODO: advertise that we support ranges - send "Accept-Ranges: bytes"?
-
-		//!TODO: evaluate conditional requests: https://tools.ietf.org/html/rfc7232
-		//!TODO: Also, handle this from RFC7233:
-		// "The Range header field is evaluated after evaluating the precondition
-		// header fields defined in [RFC7232], and only if the result in absence
-		// of the Range header field would be a 200 (OK) response.  In other
-		// words, Range is ignored when a conditional GET would result in a 304
-		// (Not Modified) response."
-
-		if rng != "" {
-			h.Logger.Debugf("[%s] Serving range '%s', preferably from cache...",
-				h.reqID, rng)
-			h.knownRanged()
-		} else {
-			h.Logger.Debugf("[%s] Serving full object, preferably from cache...",
-				h.reqID)
-			h.knownFull()
+		if !utils.IsMetadataFresh(obj) {
+			h.Logger.Debugf("[%s] Metadata is stale, serving it while revalidating...", h.reqID)
+			h.staleWarning = h.serveStaleWarning(obj)
+			h.revalidate(obj)
 		}
+		h.knownObject()
 	}
 }
 
+// knownObject responds with the object in h.obj, preferably from the cache.
+func (h *reqHandler) knownObject() {
+	//!TODO: advertise that we support ranges - send "Accept-Ranges: bytes"?
+	if h.notModifiedUpstream {
+		h.setCacheStatus(types.CacheStatusRevalidated, h.obj)
+	} else if utils.IsMetadataFresh(h.obj) {
+		h.setCacheStatus(types.CacheStatusHit, h.obj)
+	} else {
+		h.setCacheStatus(types.CacheStatusStale, h.obj)
+	}
+
+	var rng = h.req.Header.Get("Range")
+	if h.obj.Negative {
+		rng = "" // the error responses are always served whole
+	} else if rng != "" && !h.ifRangeMatches() {
+		h.Logger.Debugf("[%s] If-Range does not match the cached object, serving it whole...", h.reqID)
+		rng = ""
+	}
+	if h.notModified() {
+		h.Logger.Debugf("[%s] The client has the cached object, not modified...", h.reqID)
+		h.knownNotModified()
+	} else if rng != "" && h.rangesUncompressed() {
+		h.Logger.Debugf("[%s] Serving range '%s' of the uncompressed object...",
+			h.reqID, rng)
+		h.knownCompressedRanged()
+	} else if rng != "" {
+		h.Logger.Debugf("[%s] Serving range '%s', preferably from cache...",
+			h.reqID, rng)
+		h.knownRanged()
+	} else {
+		h.Logger.Debugf("[%s] Serving full object, preferably from cache...",
+			h.reqID)
+		h.knownFull()
+	}
+}
+
+// proxyMiss proxies the request for an object which is not in the cache. Only
+// one such request at a time fills the metadata of the object and the others
+// wait for it, so that a stampede of requests for an object which is not
+// cached reaches the upstream only once. They are then served from the cache,
+// waiting for every part which the first request is still filling until it is
+// saved. If the response was not stored, or they wait for longer than
+// FillLockTimeout, they are proxied on their own.
+func (h *reqHandler) proxyMiss() {
+	done, wait := h.fills.fillMetadata(h.objID)
+	if wait != nil {
+		h.Logger.Debugf("[%s] Waiting for another request to fill the metadata...", h.reqID)
+		var timeout <-chan time.Time
+		if h.Settings.FillLockTimeout > 0 {
+			var timer = time.NewTimer(time.Duration(h.Settings.FillLockTimeout) * time.Millisecond)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-wait:
+		case <-timeout:
+			h.Logger.Debugf("[%s] Timed out while waiting for the metadata fill, proxying...", h.reqID)
+			h.lockTimedOut = true
+			h.abortFills = true
+			h.carbonCopyProxy()
+			return
+		case <-h.req.Context().Done():
+			return
+		}
+		if _, err := h.Cache.Storage.GetMetadata(h.objID); err != nil {
+			h.Logger.Debugf("[%s] The other request did not store the object, proxying...", h.reqID)
+			h.carbonCopyProxy()
+			return
+		}
+		h.handle()
+		return
+	}
+	h.metadataFilled = done
+	defer done()
+	h.carbonCopyProxy()
+}
+
 func (h *reqHandler) carbonCopyProxy() {
+	// the rest of the object is loaded once its first chunk is saved
+	defer h.respondWithTheRest()
 	flexibleResp := httputils.NewFlexibleResponseWriter(h.getResponseHook())
 	defer func() {
 		if flexibleResp.BodyWriter != nil {
@@ -98,6 +225,9 @@ func (h *reqHandler) carbonCopyProxy() {
 				}
 			}
 		}
+		if h.releaseFilledParts != nil {
+			h.releaseFilledParts()
+		}
 		//!TODO: cache small upstream responses that we did not cache because
 		// there was no Content-Length header in the upstream response but it
 		// was otherwise cacheable? Examples are folder listings for apache and
@@ -106,21 +236,55 @@ func (h *reqHandler) carbonCopyProxy() {
 
 	}()
 
-	h.next.ServeHTTP(flexibleResp, h.getNormalizedRequest())
+	var ctx context.Context
+	// the fill may continue after the client disconnects, see ClientDisconnect
+	var cancel context.CancelFunc
+	var parent = contexts.Detach(h.req.Context())
+	if h.abortFills {
+		parent = h.req.Context()
+	}
+	ctx, cancel = context.WithCancel(parent)
+	h.cancelFill = cancel
+	defer cancel()
+	if h.budget != nil && h.revalidating == nil {
+		ctx = contexts.NewRequestBudgetContext(ctx, h.budget)
+		var timer = time.AfterFunc(h.budget.Deadline().Sub(time.Now()), cancel)
+		h.stopBudgetTimer = timer.Stop
+		defer timer.Stop()
+	}
+	h.fillCtx = ctx
+	go func() {
+		select {
+		case <-h.Cache.FillsAborted():
+			h.Logger.Logf("[%s] Aborting the fill of %s", h.reqID, h.objID)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	h.next.ServeHTTP(flexibleResp, h.getNormalizedRequest().WithContext(ctx))
+	// the response of a canceled fill is incomplete even if the next handler
+	// did not report it
+	if err := ctx.Err(); err != nil && flexibleResp.Aborted() == nil {
+		flexibleResp.Abort(err)
+	}
 }
 
 func (h *reqHandler) knownRanged() {
 	ranges, err := httputils.ParseRequestRange(h.req.Header.Get("Range"), h.obj.Size)
 	if err != nil {
-		err := http.StatusRequestedRangeNotSatisfiable
-		http.Error(h.resp, http.StatusText(err), err)
+		h.unsatisfiableRange(h.obj.Size)
 		return
 	}
 
 	if len(ranges) != 1 {
-		// We do not support multiple ranges but maybe the upstream does
-		//!TODO: implement support for multiple ranges
-		h.carbonCopyProxy()
+		// like net/http, ranges which are more than the whole object are
+		// not worth the trouble and are probably an attack
+		if sumRangesLength(ranges) > h.obj.Size {
+			h.knownFull()
+		} else {
+			h.knownMultiRanged(ranges)
+		}
 		return
 	}
 	reqRange := ranges[0]
@@ -129,18 +293,67 @@ func (h *reqHandler) knownRanged() {
 	h.resp.Header().Set("Content-Range", reqRange.ContentRange(h.obj.Size))
 	h.resp.Header().Set("Content-Length", strconv.FormatUint(reqRange.Length, 10))
 	h.rewriteTimeBasedHeaders()
+	h.setWarningHeaders()
+	h.setClientCacheControl(http.StatusPartialContent, h.obj.Headers)
+	h.setCacheStatusHeader()
 	h.resp.WriteHeader(http.StatusPartialContent)
 	if h.req.Method == "HEAD" {
 		return
 	}
 
-	h.lazilyRespond(ranges[0].Start, ranges[0].Start+ranges[0].Length-1)
+	h.lazilyRespond(h.resp, ranges[0].Start, ranges[0].Start+ranges[0].Length-1)
+}
+
+// unsatisfiableRange responds with 416 Range Not Satisfiable for an object
+// with the size.
+func (h *reqHandler) unsatisfiableRange(size uint64) {
+	h.resp.Header().Set("Content-Range", "bytes */"+strconv.FormatUint(size, 10))
+	err := http.StatusRequestedRangeNotSatisfiable
+	http.Error(h.resp, http.StatusText(err), err)
+}
+
+// knownMultiRanged responds with a multipart/byteranges body which contains
+// all of the requested ranges, in the order in which they were requested.
+func (h *reqHandler) knownMultiRanged(ranges []httputils.Range) {
+	var contentType = h.obj.Headers.Get("Content-Type")
+	var mw = multipart.NewWriter(h.resp)
+
+	httputils.CopyHeaders(h.obj.Headers, h.resp.Header())
+	h.resp.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	h.resp.Header().Set("Content-Length", strconv.FormatUint(
+		multipartLength(ranges, contentType, h.obj.Size), 10))
+	h.rewriteTimeBasedHeaders()
+	h.setWarningHeaders()
+	h.setClientCacheControl(http.StatusPartialContent, h.obj.Headers)
+	h.setCacheStatusHeader()
+	h.resp.WriteHeader(http.StatusPartialContent)
+	if h.req.Method == "HEAD" {
+		return
+	}
+
+	for _, rng := range ranges {
+		part, err := mw.CreatePart(rangeHeader(rng, contentType, h.obj.Size))
+		if err != nil {
+			h.Logger.Logf("[%s] Error while writing the header of range %s: %s",
+				h.reqID, rng.Range(), err)
+			return
+		}
+		if !h.lazilyRespond(part, rng.Start, rng.Start+rng.Length-1) {
+			return
+		}
+	}
+	if err := mw.Close(); err != nil {
+		h.Logger.Logf("[%s] Error while finishing the multipart response: %s", h.reqID, err)
+	}
 }
 
 func (h *reqHandler) knownFull() {
 	httputils.CopyHeaders(h.obj.Headers, h.resp.Header())
 	h.resp.Header().Set("Content-Length", strconv.FormatUint(h.obj.Size, 10))
 	h.rewriteTimeBasedHeaders()
+	h.setWarningHeaders()
+	h.setClientCacheControl(h.obj.Code, h.obj.Headers)
+	h.setCacheStatusHeader()
 	h.resp.WriteHeader(h.obj.Code)
 	if h.req.Method == "HEAD" {
 		return
@@ -150,14 +363,51 @@ func (h *reqHandler) knownFull() {
 	if responseSize != 0 {
 		responseSize--
 	}
-	h.lazilyRespond(0, responseSize)
+	h.lazilyRespond(h.resp, 0, responseSize)
 }
 
 func (h *reqHandler) rewriteTimeBasedHeaders() {
 	var nowUnix = time.Now().Unix()
+	var maxAge = h.obj.ExpiresAt - nowUnix
+	if maxAge < 0 { // served stale
+		maxAge = 0
+	}
+	var age = nowUnix - h.obj.ResponseTimestamp
+	if age < 0 { // the clock was moved back
+		age = 0
+	}
 	h.resp.Header().Set("Expires", time.Unix(h.obj.ExpiresAt, 0).Format(http.TimeFormat))
-	h.resp.Header().Set("Age", strconv.FormatInt(nowUnix-h.obj.ResponseTimestamp, 10))
-	h.resp.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(h.obj.ExpiresAt-nowUnix, 10))
+	h.resp.Header().Set("Age", strconv.FormatInt(age, 10))
+	h.resp.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(maxAge, 10))
+}
+
+// setWarningHeaders removes the warnings stored with the object which are no
+// longer true and adds the one for serving it stale, if that is the case.
+func (h *reqHandler) setWarningHeaders() {
+	cacheutils.RemoveOutdatedWarnings(h.resp.Header())
+	if h.staleWarning != 0 {
+		cacheutils.AddWarning(h.resp.Header(), h.staleWarning)
+	}
+}
+
+// setCacheStatus records how the request is served. obj is the cached object
+// with which it is served, if any.
+func (h *reqHandler) setCacheStatus(status string, obj *types.ObjectMetadata) {
+	h.cacheStatus = status
+	h.recordCacheStatus(h.req, status, obj)
+}
+
+// setCacheStatusHeader adds the cache status header to the response, unless
+// it is disabled.
+func (h *reqHandler) setCacheStatusHeader() {
+	if h.Settings.CacheStatusHeader == "" || h.cacheStatus == "" {
+		return
+	}
+	var value = h.cacheStatus
+	if h.Settings.CacheStatusZone {
+		value += " from " + h.Cache.ID
+	}
+	h.resp.Header().Set(h.Settings.CacheStatusHeader, value)
 }
 
 func isPartWriterShorWrite(err error) bool {
@@ -4,10 +4,15 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -25,8 +30,15 @@ var hopHeaders = httputils.GetHopByHopHeaders()
 var metadataHeadersToFilter = append(hopHeaders,
 	"Content-Length", "Content-Range", "Expires", "Age", "Cache-Control")
 
+// Conditional request headers. These are never sent with the requests made
+// for filling parts of the cache.
+var conditionalHeaders = []string{
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range",
+}
+
 // Returns a new HTTP 1.1 request that has no body. It also clears headers like
-// accept-encoding and rearranges the requested ranges so they match part
+// accept-encoding (unless it is normalized to an encoding variant) and
+// rearranges the requested ranges so they match part
 func (h *reqHandler) getNormalizedRequest() *http.Request {
 	url := *h.req.URL
 	result := &http.Request{
@@ -37,11 +49,36 @@ func (h *reqHandler) getNormalizedRequest() *http.Request {
 		ProtoMinor: 1,
 		Header:     make(http.Header),
 		Host:       h.req.Host,
+		// the next handlers may trust some of the headers only from
+		// certain clients
+		RemoteAddr: h.req.RemoteAddr,
 	}
 
-	httputils.CopyHeadersWithout(h.req.Header, result.Header, "Accept-Encoding")
+	// the trailers are not stored, so they are not asked for with TE
+	httputils.CopyHeadersWithout(h.req.Header, result.Header, "Accept-Encoding", "Te")
+	if len(h.Settings.Vary.AcceptEncoding) != 0 {
+		if encoding := h.encodingVariant(); encoding != identityEncoding {
+			result.Header.Set("Accept-Encoding", encoding)
+		}
+	}
+	if h.conditional != nil {
+		h.setConditionalHeaders(result.Header)
+	} else if !h.Settings.ForwardConditionals {
+		removeHeaders(result.Header, conditionalHeaders...)
+		// without a cached object only the upstream can evaluate If-Range,
+		// it responds with the whole object when it does not match
+		if ifRange := h.req.Header.Get("If-Range"); ifRange != "" && h.obj == nil &&
+			result.Header.Get("Range") != "" {
+			result.Header.Set("If-Range", ifRange)
+		}
+	}
+	if h.debugBypass != nil {
+		removeHeaders(result.Header, h.debugBypass.header)
+	}
 
-	//!TODO: fix requested range to be divisible by the storage partSize
+	if rng := result.Header.Get("Range"); rng != "" {
+		result.Header.Set("Range", alignRequestRange(rng, h.Cache.Storage.PartSize()))
+	}
 
 	return result
 }
@@ -49,27 +86,103 @@ func (h *reqHandler) getNormalizedRequest() *http.Request {
 func (h *reqHandler) getResponseHook() func(*httputils.FlexibleResponseWriter) {
 
 	return func(rw *httputils.FlexibleResponseWriter) {
+		if h.metadataFilled != nil {
+			// the requests waiting for the metadata can now use the cache
+			defer h.metadataFilled()
+		}
+		if h.stopBudgetTimer != nil && (!h.stopBudgetTimer() || h.budget.Spent()) {
+			h.budgetSpent(rw)
+			return
+		}
+		if h.conditional != nil {
+			if rw.Code == http.StatusNotModified {
+				h.refreshNotModified(rw)
+				rw.BodyWriter = utils.AddCloser(ioutil.Discard)
+				return
+			}
+			if rw.Code >= http.StatusInternalServerError && h.serveStaleOnError(rw) {
+				return
+			}
+			if h.revalidating == nil && !h.revalidatesPartially(h.conditional) {
+				// the expired object is replaced by the response
+				storage.GetExpirationHandler(h.Cache, h.objID)(h.Logger)
+			}
+		}
 		h.Logger.Debugf("[%s] Received headers for %s, sending them to client...",
 			h.reqID, h.req.URL)
 		httputils.CopyHeadersWithout(rw.Headers, h.resp.Header(), hopHeaders...)
+		h.narrowResponse(rw)
+		h.setClientCacheControl(rw.Code, rw.Headers)
+		h.setCacheStatusHeader()
 		h.resp.WriteHeader(rw.Code)
 
-		isCacheable := cacheutils.IsResponseCacheable(rw.Code, rw.Headers)
-		if !isCacheable {
+		if h.revalidating != nil && !h.keepRevalidated(rw) {
+			rw.BodyWriter = utils.AddCloser(h.resp)
+			return
+		}
+
+		// nothing is stored for no-store responses, not even transiently
+		if cacheutils.ResponseIsNoStore(rw.Headers) {
+			h.Logger.Debugf("[%s] Response has no-store, passing it through", h.reqID)
+			rw.BodyWriter = utils.AddCloser(h.resp)
+			return
+		}
+
+		if !h.Settings.CacheAuthorized && h.req.Header.Get("Authorization") != "" &&
+			!cacheutils.AuthorizedResponseIsShareable(rw.Headers) {
+			h.Logger.Debugf("[%s] Response to an authorized request is not public, passing it through",
+				h.reqID)
+			rw.BodyWriter = utils.AddCloser(h.resp)
+			return
+		}
+
+		isCacheable := cacheutils.IsResponseCacheable(rw.Code, rw.Headers, h.cacheableEncodings()...) &&
+			h.varyAllowsCaching(rw.Headers)
+		negative := !isCacheable && h.cachesNegatively(rw)
+		if !isCacheable && !negative {
 			h.Logger.Debugf("[%s] Response is non-cacheable", h.reqID)
 			rw.BodyWriter = utils.AddCloser(h.resp)
 			return
 		}
 
-		expiresIn := cacheutils.ResponseExpiresIn(rw.Headers, h.CacheDefaultDuration)
-		if expiresIn <= 0 {
+		if h.lockTimedOut {
+			h.Logger.Debugf("[%s] Another request fills the object, streaming the response without caching it",
+				h.reqID)
+			rw.BodyWriter = utils.AddCloser(h.resp)
+			return
+		}
+
+		if h.Cache.StoresPaused() {
+			h.Logger.Debugf("[%s] The cache zone is drained, streaming the response without caching it",
+				h.reqID)
+			rw.BodyWriter = utils.AddCloser(h.resp)
+			return
+		}
+
+		if h.underMemoryPressure() {
+			h.Logger.Debugf("[%s] Under memory pressure, streaming the response without caching it",
+				h.reqID)
+			rw.BodyWriter = utils.AddCloser(h.resp)
+			return
+		}
+
+		expiresIn := h.responseExpiresIn(rw.Headers)
+		if negative {
+			expiresIn = h.negativeExpiresIn(rw.Headers)
+		}
+		if expiresIn < 0 || expiresIn == 0 && (negative || !h.revalidatesConditionally(rw.Headers)) {
 			h.Logger.Debugf("[%s] Response expires in the past: %s", h.reqID, expiresIn)
 			rw.BodyWriter = utils.AddCloser(h.resp)
 			return
 		}
 
 		responseRange, err := httputils.GetResponseRange(rw.Code, rw.Headers)
-		if err != nil {
+		if negative {
+			// the error responses are stored whole
+			responseRange, err = httputils.GetResponseRange(http.StatusOK, rw.Headers)
+		}
+		var unknownLength = err != nil && h.canStoreWithUnknownLength(rw)
+		if err != nil && !unknownLength {
 			h.Logger.Debugf("[%s] Was not able to get response range (%s)",
 				h.reqID, err)
 			rw.BodyWriter = utils.AddCloser(h.resp)
@@ -89,18 +202,44 @@ func (h *reqHandler) getResponseHook() func(*httputils.FlexibleResponseWriter) {
 		now := time.Now()
 
 		obj := &types.ObjectMetadata{
-			ID:                h.objID,
-			ResponseTimestamp: now.Unix(),
-			Code:              code,
-			Size:              responseRange.ObjSize,
-			Headers:           make(http.Header),
-			ExpiresAt:         now.Add(expiresIn).Unix(),
+			ID:                   h.objID,
+			ResponseTimestamp:    now.Unix() - cacheutils.ResponseAge(rw.Headers),
+			Code:                 code,
+			Headers:              make(http.Header),
+			ExpiresAt:            now.Add(expiresIn).Unix(),
+			StaleWhileRevalidate: cacheutils.ResponseStaleWhileRevalidate(rw.Headers),
+			Immutable:            cacheutils.ResponseIsImmutable(rw.Headers),
+			SchemaVersion:        types.ObjectMetadataSchemaVersion,
+		}
+		if negative {
+			obj.Negative, obj.StaleWhileRevalidate, obj.Immutable = true, 0, false
+		}
+		if obj.Group = h.objectGroup(rw.Headers); obj.Group != "" {
+			obj.GroupGeneration = h.Cache.Groups.Generation(obj.Group)
 		}
+		obj.SurrogateKeys = h.surrogateKeys(rw.Headers)
 		httputils.CopyHeadersWithout(rw.Headers, obj.Headers, metadataHeadersToFilter...)
 		// maybe the server does not return date, we should set it then
 		if obj.Headers.Get("Date") == "" {
 			obj.Headers.Set("Date", now.Format(http.TimeFormat))
 		}
+		// the object is kept after it expires while it can be served stale
+		// or revalidated
+		if !negative {
+			expiresIn += h.retentionWindow(obj)
+		}
+
+		if unknownLength {
+			h.Logger.Debugf("[%s] Response has unknown length, the metadata will be saved after it is received",
+				h.reqID)
+			rw.BodyWriter = h.clientAndCacheWriter(newUnknownLengthWriter(h.fillCtx, h.Cache, obj, rw, func() {
+				h.objectSaved(obj)
+				h.scheduleExpiration(expiresIn)
+			}))
+			return
+		}
+		obj.Size = responseRange.ObjSize
+		h.discardIfChanged(obj)
 
 		//!TODO: consult the cache algorithm whether to save the metadata
 		//!TODO: optimize this, save the metadata only when it's newer
@@ -113,36 +252,164 @@ func (h *reqHandler) getResponseHook() func(*httputils.FlexibleResponseWriter) {
 			return
 		}
 
+		h.objectSaved(obj)
+
 		if h.req.Method == "HEAD" {
 			rw.BodyWriter = utils.AddCloser(h.resp)
 			return
 		}
 
-		rw.BodyWriter = utils.MultiWriteCloser(
-			utils.AddCloser(h.resp),
-			PartWriter(h.Cache, h.objID, *responseRange),
-		)
+		var fillRange = *responseRange
+		var parallel = h.fillsInParallel(rw.Code, obj.Size)
+		if parallel {
+			// only the first chunk is taken from this response
+			fillRange.Length = h.parallelChunkSize()
+			h.obj = obj
+		}
+		var saved func(part uint32)
+		h.releaseFilledParts, saved = h.claimFilledParts(&fillRange)
+		rw.BodyWriter = h.clientAndCacheWriter(newPartWriter(h.fillCtx, h.Cache, h.objID, fillRange, saved))
+		if parallel {
+			h.firstChunk = &firstChunkWriter{WriteCloser: rw.BodyWriter, remaining: fillRange.Length}
+			rw.BodyWriter = h.firstChunk
+		}
+		h.scheduleExpiration(expiresIn)
+	}
+}
+
+// claimFilledParts claims the parts which will be saved from the response, so
+// that other requests wait for them instead of requesting them again. See
+// objectFills.claimFilled for the returned functions, which are nil if no
+// parts are saved.
+func (h *reqHandler) claimFilledParts(rng *httputils.ContentRange) (func(), func(part uint32)) {
+	var partSize = h.Cache.Storage.PartSize()
+	var end = rng.Start + rng.Length
+	if rng.Length == 0 || end > rng.ObjSize {
+		return nil, nil
+	}
+	// only the whole parts in the range are saved, except for the last one
+	// of the object
+	var first = (rng.Start + partSize - 1) / partSize
+	var last = end / partSize
+	if end == rng.ObjSize {
+		last = (end + partSize - 1) / partSize
+	}
+	if last <= first {
+		return nil, nil
+	}
+	return h.fills.claimFilled(h.objID, uint32(first), uint32(last-1))
+}
+
+// canStoreWithUnknownLength returns whether a response without a known size
+// (e.g. a chunked one without Content-Length) can be stored.
+func (h *reqHandler) canStoreWithUnknownLength(rw *httputils.FlexibleResponseWriter) bool {
+	return h.Settings.CacheUnknownLength && h.req.Method == "GET" &&
+		rw.Code == http.StatusOK && rw.Headers.Get("Content-Length") == ""
+}
 
-		h.Logger.Debugf("[%s] Setting the cached data to expire in %s", h.reqID, expiresIn)
-		h.Cache.Scheduler.AddEvent(
-			h.objID.Hash(),
-			storage.GetExpirationHandler(h.Cache, h.objID),
-			expiresIn,
-		)
+// objectSaved is called after the metadata of the object was saved.
+func (h *reqHandler) objectSaved(obj *types.ObjectMetadata) {
+	if obj.Group != "" && !h.Cache.Groups.Add(obj.Group, obj.GroupGeneration, obj.ID) {
+		h.Logger.Debugf("[%s] The group %s was purged while saving %s",
+			h.reqID, obj.Group, obj.ID)
 	}
+	h.Cache.SurrogateKeys.Add(obj.ID, obj.SurrogateKeys)
+	if st, ok := h.Cache.Algorithm.(types.ObjectSizeTracker); ok {
+		st.SetObjectSize(obj.ID, obj.Size)
+	}
+}
+
+func (h *reqHandler) scheduleExpiration(expiresIn time.Duration) {
+	h.Logger.Debugf("[%s] Setting the cached data to expire in %s", h.reqID, expiresIn)
+	h.Cache.Scheduler.AddEvent(
+		h.objID.Hash(),
+		storage.GetExpirationHandler(h.Cache, h.objID),
+		expiresIn,
+	)
+}
+
+// objectGroup returns the id of the group to which the object with the
+// provided upstream response headers belongs or an empty string if it is not
+// part of a group.
+func (h *reqHandler) objectGroup(headers http.Header) string {
+	if h.Settings.GroupHeader != "" {
+		if group := headers.Get(h.Settings.GroupHeader); group != "" {
+			return group
+		}
+	}
+	if h.Settings.GroupByDirectory {
+		return path.Dir(h.objID.Path())
+	}
+	return ""
+}
+
+// surrogateKeys returns the surrogate keys of the object with the provided
+// upstream response headers.
+func (h *reqHandler) surrogateKeys(headers http.Header) []string {
+	if h.Settings.SurrogateKeyHeader == "" {
+		return nil
+	}
+	var keys []string
+	for _, value := range headers[http.CanonicalHeaderKey(h.Settings.SurrogateKeyHeader)] {
+		keys = append(keys, strings.Fields(value)...)
+	}
+	return keys
+}
+
+// clientAndCacheWriter returns a writer which writes both to the client and to
+// the supplied cache writer, handling client disconnects according to the
+// configured policy.
+func (h *reqHandler) clientAndCacheWriter(cache io.WriteCloser) io.WriteCloser {
+	if h.Settings.ClientDisconnect != ClientDisconnectCompleteAndStore {
+		return utils.MultiWriteCloser(utils.AddCloser(h.resp), cache)
+	}
+
+	return newDetachableWriter(
+		utils.AddCloser(h.resp),
+		cache,
+		time.Duration(h.Settings.DetachedFillTimeout)*time.Second,
+		h.cancelFill,
+		func(err error) {
+			h.Logger.Debugf("[%s] Client is gone (%s), continuing to fill the cache for %s",
+				h.reqID, err, h.objID)
+		},
+	)
+}
+
+// underMemoryPressure returns whether the app is degraded because it is close
+// to its memory limit, in which case no new objects should be stored.
+func (h *reqHandler) underMemoryPressure() bool {
+	app, ok := contexts.GetApp(h.req.Context())
+	return ok && app.MemoryStats().Degraded
 }
 
 func idSuffix(s, e uint64) []byte {
 	return strconv.AppendUint(append(strconv.AppendUint([]byte(`->b=`), s, 10), '-'), e, 10)
 }
 
-func (h *reqHandler) getUpstreamReader(start, end uint64) io.ReadCloser {
+// getUpstreamReader returns a reader for the bytes from start to end of the
+// object, requested from the upstream. The done function is called once the
+// request is finished and its parts are saved.
+func (h *reqHandler) getUpstreamReader(start, end uint64, done func()) io.ReadCloser {
 	subh := *h
+	subh.metadataFilled, subh.releaseFilledParts, subh.firstChunk = nil, nil, nil
+	// the parts are filled in the background, the client is already served
+	subh.budget, subh.stopBudgetTimer = nil, nil
+	// the parts are always requested unconditionally
+	subh.conditional, subh.notModifiedUpstream = nil, false
+	// The configured ClientDisconnect is kept, so with abort the requests
+	// waiting for the parts which were not saved request them again
+	if h.abortFills {
+		var proxy = *h.CachingProxy
+		proxy.Settings.ClientDisconnect = ClientDisconnectAbort
+		subh.CachingProxy = &proxy
+	}
 	// ->start-end
 	var newCtx context.Context
 	newCtx, subh.reqID = contexts.AppendToRequestID(subh.req.Context(), idSuffix(start, end))
 	subh.req = subh.getNormalizedRequest()
 	subh.req = subh.req.WithContext(newCtx)
+	removeHeaders(subh.req.Header, conditionalHeaders...)
 	subh.req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
 	h.Logger.Debugf("[%s] Making upstream request for %s, bytes [%d-%d]...",
@@ -159,6 +426,12 @@ func (h *reqHandler) getUpstreamReader(start, end uint64) io.ReadCloser {
 				"for the partial upstream request: %s",
 				subh.reqID, err)
 			_ = w.CloseWithError(err)
+		} else if h.obj != nil && objectChanged(h.obj, respRng.ObjSize, rw.Headers) {
+			// the response is still stored by subh as the new version
+			h.Logger.Logf("[%s] The object %s changed in the upstream while serving it",
+				subh.reqID, h.objID)
+			_ = w.CloseWithError(errObjectChanged)
+			return
 		}
 		h.Logger.Debugf("[%s] Received response with status %d and range %v",
 			subh.reqID, rw.Code, respRng)
@@ -173,8 +446,14 @@ func (h *reqHandler) getUpstreamReader(start, end uint64) io.ReadCloser {
 				fmt.Errorf("Upstream responded with status %d", rw.Code))
 		}
 	})
+	// the fill may outlive the request if the client disconnects
+	h.Cache.Acquire()
 	go utils.SafeExecute(
-		subh.carbonCopyProxy,
+		func() {
+			defer h.Cache.Release()
+			defer done()
+			subh.carbonCopyProxy()
+		},
 		func(err error) {
 			h.Logger.Errorf("[%s] Panic inside carbonCopyProxy %s", subh.reqID, err)
 			w.CloseWithError(err) // !TODO maybe some other error
@@ -183,15 +462,23 @@ func (h *reqHandler) getUpstreamReader(start, end uint64) io.ReadCloser {
 	return newWholeChunkReadCloser(r, h.Cache.PartSize.Bytes())
 }
 
-// if error is returned - it is 'too many open files'
+// if error is returned - it is 'too many open files' or the request was
+// canceled
 func (h *reqHandler) getPartFromStorage(idx *types.ObjectIndex) (io.ReadCloser, error) {
 	cached := h.Cache.Algorithm.Lookup(idx)
-	r, err := h.Cache.Storage.GetPart(idx)
+	r, err := storage.GetPartContext(h.req.Context(), h.Cache.Storage, idx)
 	if err == nil {
 		h.Cache.Algorithm.PromoteObject(idx)
 		return r, nil
 	}
-	if !os.IsNotExist(err) {
+	if ctxErr := h.req.Context().Err(); ctxErr != nil && err == ctxErr {
+		// the request was canceled while waiting for its turn to read
+		return nil, err
+	} else if err == types.ErrCorruptedPart {
+		// the storage has discarded it, so it will be downloaded again
+		h.Logger.Logf("[%s] Part %s was corrupted in the storage", h.reqID, idx)
+		h.Cache.Algorithm.Remove(idx)
+	} else if !os.IsNotExist(err) {
 		if isTooManyFiles(err) {
 			return nil, err
 		}
@@ -205,41 +492,90 @@ func (h *reqHandler) getPartFromStorage(idx *types.ObjectIndex) (io.ReadCloser,
 	return nil, nil
 }
 
+// getContents returns a reader for the part indexes[from] and possibly some of
+// the following ones, and the number of parts it reads. Missing parts are
+// requested from the upstream unless another request is already filling them,
+// in which case it waits for it and reads them from the cache. The same is
+// done for the parts which are being refetched after they were discarded, so
+// their stored contents are not read while they are replaced.
 func (h *reqHandler) getContents(indexes []*types.ObjectIndex, from int,
 ) (io.ReadCloser, int, error) {
-	r, err := h.getPartFromStorage(indexes[from])
-	if r != nil {
-		return r, 1, nil
-	} else if err != nil {
-		return nil, 0, err
-	}
-
-	partSize := h.Cache.Storage.PartSize()
-	fromByte := uint64(indexes[from].Part) * partSize
-	parts, err := h.Cache.Storage.GetAvailableParts(h.objID)
-	if err != nil {
-		return nil, 0, err
-	}
-	sort.Sort(objectIndexes(parts))
-	i := sort.Search(len(parts), func(i int) bool {
-		return (parts[i].Part > indexes[from].Part &&
-			parts[i].Part <= indexes[len(indexes)-1].Part)
-	})
-	if i < len(parts) { // there is a part
-		r, _ = h.getPartFromStorage(parts[i])
+	for {
+		if wait := h.fills.filling(h.objID, indexes[from].Part); wait != nil {
+			if err := h.waitForFill(wait, indexes[from]); err != nil {
+				return nil, 0, err
+			}
+		}
+		r, err := h.getPartFromStorage(indexes[from])
 		if r != nil {
-			toByte := umin(h.obj.Size, uint64(parts[i].Part)*partSize-1)
-			return utils.MultiReadCloser(
-					h.getUpstreamReader(fromByte, toByte), r),
-				int(parts[i].Part-indexes[from].Part) + 1, nil
+			return r, 1, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		slot, wait, err := h.fills.acquire(h.req.Context(), h.objID, indexes[from].Part)
+		if err != nil {
+			return nil, 0, err
+		}
+		if wait != nil {
+			if err := h.waitForFill(wait, indexes[from]); err != nil {
+				return nil, 0, err
+			}
+			continue
 		}
+
+		// the parts might have been filled while waiting for the slot
+		parts, err := h.Cache.Storage.GetAvailableParts(h.objID)
+		if err != nil {
+			slot.release()
+			return nil, 0, err
+		}
+		sort.Sort(types.ObjectIndexes(parts))
+		// the missing parts end before the next available one in the range
+		last := indexes[len(indexes)-1].Part
+		i := sort.Search(len(parts), func(i int) bool {
+			return parts[i].Part >= indexes[from].Part
+		})
+		if i < len(parts) && parts[i].Part == indexes[from].Part {
+			slot.release()
+			continue
+		}
+		if i < len(parts) && parts[i].Part <= last {
+			last = parts[i].Part - 1
+		}
+		if last, wait = slot.claim(indexes[from].Part, last); wait != nil {
+			if err := h.waitForFill(wait, indexes[from]); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		partSize := h.Cache.Storage.PartSize()
+		fromByte := uint64(indexes[from].Part) * partSize
+		toByte := umin(h.obj.Size, uint64(last+1)*partSize-1)
+		return h.getUpstreamReader(fromByte, toByte, slot.release),
+			int(last-indexes[from].Part) + 1, nil
 	}
+}
 
-	toByte := umin(h.obj.Size, uint64(indexes[len(indexes)-1].Part+1)*partSize-1)
-	return h.getUpstreamReader(fromByte, toByte), len(indexes) - from, nil
+// waitForFill waits for another request to fill the part.
+func (h *reqHandler) waitForFill(wait <-chan struct{}, idx *types.ObjectIndex) error {
+	h.Logger.Debugf("[%s] Waiting for another request to fill %s...", h.reqID, idx)
+	select {
+	case <-wait:
+		return nil
+	case <-h.req.Context().Done():
+		return h.req.Context().Err()
+	}
 }
 
-func (h *reqHandler) lazilyRespond(start, end uint64) {
+// lazilyRespond writes the bytes from start to end (inclusive) of the object
+// to w, loading the missing parts from the upstream. It returns whether all of
+// them were written.
+func (h *reqHandler) lazilyRespond(w io.Writer, start, end uint64) bool {
+	if h.respondsInParallel(start, end) {
+		return h.parallelRespond(w, start, end)
+	}
 	partSize := h.Cache.Storage.PartSize()
 	indexes := utils.BreakInIndexes(h.objID, start, end, partSize)
 	startOffset := start % partSize
@@ -251,7 +587,7 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 			h.Logger.Errorf(
 				"[%s] Unexpected error while trying to load %s from storage: %s",
 				h.reqID, indexes[i], err)
-			return
+			return false
 		}
 		if i == 0 && startOffset > 0 {
 			contents, err = utils.SkipReadCloser(contents, int64(startOffset))
@@ -259,7 +595,7 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 				h.Logger.Errorf(
 					"[%s] Unexpected error while trying to skip %d from %s: %s",
 					h.reqID, startOffset, indexes[i], err)
-				return
+				return false
 			}
 		}
 		if i+partsCount == len(indexes) {
@@ -271,7 +607,7 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 			contents = utils.LimitReadCloser(contents, int64(endLimit))
 		}
 
-		if copied, err := io.Copy(h.resp, contents); err != nil {
+		if copied, err := io.Copy(w, contents); err != nil {
 			h.Logger.Logf(
 				"[%s] Error sending contents after %dbytes of %s, parts[%d-%d]: %s",
 				h.reqID, copied, h.objID, indexes[i].Part,
@@ -288,28 +624,63 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 		}
 
 		if shouldReturn {
-			return
+			return false
 		}
 
 		i += partsCount
 	}
+	return true
 }
 
-func isTooManyFiles(err error) bool {
-	if pathError, ok := err.(*os.PathError); ok {
-		return pathError.Err == syscall.EMFILE
+func sumRangesLength(ranges []httputils.Range) uint64 {
+	var sum uint64
+	for _, rng := range ranges {
+		sum += rng.Length
 	}
-	return err == syscall.EMFILE
+	return sum
+}
+
+// rangeHeader returns the header of the part of a multipart/byteranges body
+// which contains rng.
+func rangeHeader(rng httputils.Range, contentType string, size uint64) textproto.MIMEHeader {
+	var header = textproto.MIMEHeader{"Content-Range": {rng.ContentRange(size)}}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return header
+}
+
+// multipartLength returns the length of the multipart/byteranges body with
+// the ranges. The boundaries are random but always with the same length.
+func multipartLength(ranges []httputils.Range, contentType string, size uint64) uint64 {
+	var counter countingWriter
+	var mw = multipart.NewWriter(&counter)
+	var length uint64
+	for _, rng := range ranges {
+		// writing to countingWriter never fails
+		mw.CreatePart(rangeHeader(rng, contentType, size))
+		length += rng.Length
+	}
+	mw.Close()
+	return length + uint64(counter)
 }
 
-type objectIndexes []*types.ObjectIndex
+type countingWriter uint64
 
-func (o objectIndexes) Len() int {
-	return len(o)
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
 }
-func (o objectIndexes) Less(i, j int) bool {
-	return o[i].Part < o[j].Part
+
+func removeHeaders(headers http.Header, names ...string) {
+	for _, name := range names {
+		headers.Del(name)
+	}
 }
-func (o objectIndexes) Swap(i, j int) {
-	o[i], o[j] = o[j], o[i]
+
+func isTooManyFiles(err error) bool {
+	if pathError, ok := err.(*os.PathError); ok {
+		return pathError.Err == syscall.EMFILE
+	}
+	return err == syscall.EMFILE
 }
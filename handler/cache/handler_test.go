@@ -1,12 +1,30 @@
 package cache
 
 import (
+	"bufio"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/cacheutils"
 	"github.com/ironsmile/nedomi/utils/httputils"
+	"github.com/ironsmile/nedomi/utils/netutils"
 )
 
 func TestTooManyFiles(t *testing.T) {
@@ -83,3 +101,773 @@ func TestTooManyFilesInTheMiddle(t *testing.T) {
 		t.Errorf("expected to read 1 not %d", n)
 	}
 }
+
+type memoryPressureApp struct {
+	types.App
+	degraded bool
+}
+
+func (m *memoryPressureApp) MemoryStats() types.MemoryStats {
+	return types.MemoryStats{Degraded: m.degraded}
+}
+
+func TestNoStoresUnderMemoryPressure(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var pressure = &memoryPressureApp{degraded: true}
+	app.ctx = contexts.NewAppContext(app.ctx, pressure)
+	var file = app.getFileName()
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/" + file})
+
+	app.testFullRequest(file)
+	if _, err := app.cacheHandler.Cache.Storage.GetMetadata(objID); !os.IsNotExist(err) {
+		t.Errorf("expected no metadata to be stored under memory pressure but got %v", err)
+	}
+
+	pressure.degraded = false
+	app.testFullRequest(file)
+	if _, err := app.cacheHandler.Cache.Storage.GetMetadata(objID); err != nil {
+		t.Errorf("expected metadata to be stored after the pressure eased but got %s", err)
+	}
+}
+
+func TestClientConditionalOnMissIsRelayed(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const etag, contents = `"the-etag"`, "conditional contents"
+	var upstreamConditionals int
+	app.up.HandleFunc("/conditional", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.Header.Get("If-None-Match") == etag {
+			upstreamConditionals++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	})
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/conditional"})
+
+	req, err := http.NewRequest("GET", "http://example.com/conditional", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	app.testRequest(req.WithContext(app.ctx), "", http.StatusNotModified)
+	if upstreamConditionals != 1 {
+		t.Errorf("Expected the conditional to reach the upstream once but it did %d times",
+			upstreamConditionals)
+	}
+	if _, err := app.cacheHandler.Cache.Storage.GetMetadata(objID); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be stored for a 304 but got %v", err)
+	}
+
+	req.Header.Set("If-None-Match", `"other-etag"`)
+	app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+	if _, err := app.cacheHandler.Cache.Storage.GetMetadata(objID); err != nil {
+		t.Errorf("Expected the 200 response to be stored but got %s", err)
+	}
+}
+
+func TestWarningHeaders(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const contents = "warned contents"
+	app.up.HandleFunc("/warned", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Add("Warning", `110 upstream "Response is Stale"`)
+		w.Header().Add("Warning", `214 upstream "Transformation Applied"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	})
+	req, err := http.NewRequest("GET", "http://example.com/warned", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(app.ctx)
+	app.testRequest(req, contents, http.StatusOK) // store it
+
+	var serve = func(staleWarning int) []string {
+		var rec = httptest.NewRecorder()
+		var h = &reqHandler{
+			CachingProxy: app.cacheHandler,
+			req:          req,
+			resp:         rec,
+			staleWarning: staleWarning,
+		}
+		h.handle()
+		if rec.Code != http.StatusOK || rec.Body.String() != contents {
+			t.Errorf("Unexpected cached response %d: %q", rec.Code, rec.Body.String())
+		}
+		return rec.HeaderMap["Warning"]
+	}
+
+	var freshExpected = []string{`214 upstream "Transformation Applied"`}
+	if got := serve(0); !reflect.DeepEqual(got, freshExpected) {
+		t.Errorf("Expected the fresh warnings to be %q but got %q", freshExpected, got)
+	}
+
+	for _, code := range []int{
+		cacheutils.WarningResponseIsStale,
+		cacheutils.WarningDisconnectedOperation,
+	} {
+		var got = serve(code)
+		if len(got) != 2 || got[0] != freshExpected[0] ||
+			!strings.HasPrefix(got[1], strconv.Itoa(code)+" ") {
+			t.Errorf("Expected a %d warning for a stale serve but got %q", code, got)
+		}
+	}
+}
+
+func TestSchemeInCacheKey(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.CacheKeyIncludesScheme = true
+	app.cacheHandler.TrustedProxies, _ = netutils.ParseIPNetworks([]string{"10.0.0.0/8"})
+	const contents = "scheme dependent"
+	var upstreamRequests int
+	app.up.HandleFunc("/scheme", func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	})
+
+	var request = func(scheme string) {
+		req, err := http.NewRequest("GET", "http://example.com/scheme", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-Proto", scheme)
+		app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+	}
+
+	request("http")
+	request("http")
+	if upstreamRequests != 1 {
+		t.Errorf("Expected one upstream request for http but got %d", upstreamRequests)
+	}
+	request("https")
+	request("https")
+	if upstreamRequests != 2 {
+		t.Errorf("Expected https to be cached separately but got %d upstream requests",
+			upstreamRequests)
+	}
+	// the header is ignored for the clients which are not trusted proxies
+	req, err := http.NewRequest("GET", "http://example.com/scheme", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.168.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if id := app.cacheHandler.NewObjectIDForRequest(req); id.Path() != "http:/scheme" {
+		t.Errorf("Expected the untrusted request to be http but got %s", id.Path())
+	}
+	for _, scheme := range []string{"http", "https"} {
+		var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Scheme: scheme, Path: "/scheme"})
+		if _, err := app.cacheHandler.Cache.Storage.GetMetadata(objID); err != nil {
+			t.Errorf("Expected the %s object to be stored but got %s", scheme, err)
+		}
+	}
+}
+
+func TestServingSparseObject(t *testing.T) {
+	t.Parallel()
+	const contents = "0123456789abcdefghijklmnopqrstuvwxyzABCD"
+	app := newTestAppFromMap(t, map[string]string{"sparse": contents})
+	defer app.cleanup()
+	var partSize = app.cacheHandler.Cache.Storage.PartSize()
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/sparse"})
+
+	var storage = app.cacheHandler.Cache.Storage
+	if err := storage.SaveMetadata(&types.ObjectMetadata{
+		ID:                objID,
+		ResponseTimestamp: time.Now().Unix(),
+		Code:              http.StatusOK,
+		Size:              uint64(len(contents)),
+		Headers:           http.Header{},
+		ExpiresAt:         time.Now().Add(time.Hour).Unix(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []uint32{0, 5, 3} {
+		var start = uint64(part) * partSize
+		var idx = &types.ObjectIndex{ObjID: objID, Part: part}
+		if err := storage.SavePart(idx, strings.NewReader(contents[start:start+partSize])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var upstreamRequests int
+	var up = app.cacheHandler.next
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		up.ServeHTTP(w, r)
+	})
+
+	app.testRange("sparse", 3*partSize+1, partSize-2)
+	if upstreamRequests != 0 {
+		t.Errorf("Expected a range in a present part to be served from the cache but "+
+			"there were %d upstream requests", upstreamRequests)
+	}
+
+	// the missing parts 2 and 4 are downloaded, 3 and 5 are from the cache
+	app.testRange("sparse", 2*partSize+2, 4*partSize-4)
+	if upstreamRequests != 2 {
+		t.Errorf("Expected the 2 gaps to be requested from the upstream but "+
+			"there were %d upstream requests", upstreamRequests)
+	}
+	app.testFullRequest("sparse")
+}
+
+func TestSetCookieOrderIsPreserved(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const contents = "cookie sensitive"
+	var cookies = []string{"session=abc; Path=/", "b=2", "a=1; HttpOnly", "session=; Max-Age=0"}
+	var upstreamRequests int
+	app.up.HandleFunc("/cookies", func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Cache-Control", "max-age=3600")
+		for _, cookie := range cookies {
+			w.Header().Add("Set-Cookie", cookie)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	})
+
+	var request = func(rng string) {
+		req, err := http.NewRequest("GET", "http://example.com/cookies", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var code = http.StatusOK
+		if rng != "" {
+			req.Header.Set("Range", rng)
+			code = http.StatusPartialContent
+		}
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+		if rec.Code != code {
+			t.Errorf("Expected code %d for range %q but got %d", code, rng, rec.Code)
+		}
+		if got := rec.HeaderMap["Set-Cookie"]; !reflect.DeepEqual(got, cookies) {
+			t.Errorf("Expected the cookies for range %q to be %q but got %q", rng, cookies, got)
+		}
+	}
+
+	request("")         // from the upstream
+	request("")         // from the cache
+	request("bytes=2-") // from the cache
+	if upstreamRequests != 1 {
+		t.Errorf("Expected a single upstream request but got %d", upstreamRequests)
+	}
+
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/cookies"})
+	obj, err := app.cacheHandler.Cache.Storage.GetMetadata(objID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := obj.Headers["Set-Cookie"]; !reflect.DeepEqual(got, cookies) {
+		t.Errorf("Expected the stored cookies to be %q but got %q", cookies, got)
+	}
+}
+
+func TestMultipleRanges(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var path = app.getFileName()
+	var expected = app.fsmap[path]
+	app.testFullRequest(path)
+
+	var get = func(method, rng string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://example.com/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", rng)
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+		return rec
+	}
+
+	// the parts are 5 bytes long, so the ranges span several of them
+	var rec = get("GET", "bytes=1-2,8-21,-3")
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("Expected a partial response but got %d", rec.Code)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Content-Length %s does not match the body length %d", cl, rec.Body.Len())
+	}
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Unexpected content type %q (%v)", rec.Header().Get("Content-Type"), err)
+	}
+	var size = len(expected)
+	var expectedParts = []struct{ contentRange, body string }{
+		{fmt.Sprintf("bytes 1-2/%d", size), expected[1:3]},
+		{fmt.Sprintf("bytes 8-21/%d", size), expected[8:22]},
+		{fmt.Sprintf("bytes %d-%d/%d", size-3, size-1, size), expected[size-3:]},
+	}
+	var mr = multipart.NewReader(rec.Body, params["boundary"])
+	for i, exp := range expectedParts {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Error while reading part %d: %s", i, err)
+		}
+		if cr := part.Header.Get("Content-Range"); cr != exp.contentRange {
+			t.Errorf("Expected part %d to have range %q but it had %q", i, exp.contentRange, cr)
+		}
+		if ct := part.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("Expected part %d to have the content type of the object but it had %q", i, ct)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != exp.body {
+			t.Errorf("Expected part %d to be %q but it was %q", i, exp.body, body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("Expected only %d parts but got %v", len(expectedParts), err)
+	}
+
+	rec = get("HEAD", "bytes=1-2,8-21,-3")
+	if rec.Code != http.StatusPartialContent || rec.Body.Len() != 0 ||
+		rec.Header().Get("Content-Length") == "" {
+		t.Errorf("Unexpected response to HEAD: %d %+v", rec.Code, rec.Header())
+	}
+
+	// ranges which add up to more than the object get all of it
+	rec = get("GET", "bytes=0-,0-")
+	if rec.Code != http.StatusOK || rec.Body.String() != expected {
+		t.Errorf("Expected the whole object but got %d %q", rec.Code, rec.Body)
+	}
+
+	// the unsatisfiable ranges are skipped when there are others
+	rec = get("GET", fmt.Sprintf("bytes=%d-,0-4", size))
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != expected[:5] {
+		t.Errorf("Expected the satisfiable range but got %d %q", rec.Code, rec.Body)
+	}
+
+	rec = get("GET", fmt.Sprintf("bytes=%d-,%d-", size, size+10))
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected %d but got %d", http.StatusRequestedRangeNotSatisfiable, rec.Code)
+	}
+	if cr := rec.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes */%d", size) {
+		t.Errorf("Unexpected Content-Range %q for unsatisfiable ranges", cr)
+	}
+}
+
+// stalledUpstream writes the first bytes of the response and blocks until the
+// request is canceled.
+type stalledUpstream struct {
+	size    string // the Content-Length, if any
+	started chan struct{}
+}
+
+func (u *stalledUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "max-age=3600")
+	if u.size != "" {
+		w.Header().Set("Content-Length", u.size)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("0123456"))
+	close(u.started)
+	<-r.Context().Done()
+}
+
+func TestAbortedFills(t *testing.T) {
+	t.Parallel()
+	for _, size := range []string{"", "20"} {
+		t.Run("size="+size, func(t *testing.T) {
+			app := newTestApp(t)
+			defer app.cleanup()
+			var up = &stalledUpstream{size: size, started: make(chan struct{})}
+			app.up.Handle("/stalled", up)
+			var cz = app.cacheHandler.Cache
+
+			req, err := http.NewRequest("GET", "http://example.com/stalled", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = req.WithContext(app.ctx)
+			var id = app.cacheHandler.NewObjectIDForRequest(req)
+
+			var done = make(chan struct{})
+			go func() {
+				defer close(done)
+				app.cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+			<-up.started
+			cz.AbortFills()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("The fill was not aborted")
+			}
+
+			parts, err := cz.Storage.GetAvailableParts(id)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if size == "" {
+				// without a size an incomplete object is useless
+				if len(parts) != 0 {
+					t.Errorf("Expected no stored parts but there are %v", parts)
+				}
+			} else if len(parts) != 1 || parts[0].Part != 0 {
+				// only the first part was received completely
+				t.Errorf("Expected only the first part to be stored but there are %v", parts)
+			}
+		})
+	}
+}
+
+func TestCacheStatusIsRecorded(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const contents = "cache status"
+	app.up.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		contexts.RecordUpstream(r.Context(), &types.UpstreamAddress{
+			URL: url.URL{Scheme: "http", Host: "upstream.example.com:8080"},
+		})
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	})
+
+	var request = func() (*types.CacheStatus, string) {
+		var status *types.CacheStatus
+		var upstream string
+		var ctx = contexts.NewCacheStatusRecorderContext(app.ctx,
+			func(s *types.CacheStatus) { status = s })
+		ctx = contexts.NewUpstreamRecorderContext(ctx,
+			func(addr *types.UpstreamAddress) { upstream = addr.Host })
+		req, err := http.NewRequest("GET", "http://example.com/status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.testRequest(req.WithContext(ctx), contents, http.StatusOK)
+		if status == nil {
+			t.Fatal("Expected the cache status to be recorded")
+		}
+		return status, upstream
+	}
+
+	status, upstream := request()
+	if status.Status != types.CacheStatusMiss || status.Zone != "1" || status.Age != -1 {
+		t.Errorf("Expected a miss in zone 1 without age but got %+v", status)
+	}
+	if upstream != "upstream.example.com:8080" {
+		t.Errorf("Expected the upstream of the miss to be recorded but got %q", upstream)
+	}
+	status, upstream = request()
+	if status.Status != types.CacheStatusHit || status.Zone != "1" || status.Age < 0 {
+		t.Errorf("Expected a hit in zone 1 with age but got %+v", status)
+	}
+	if upstream != "" {
+		t.Errorf("Expected no upstream for the hit but got %q", upstream)
+	}
+}
+
+// listCacheZone returns all files and directories in the cache zone.
+func listCacheZone(t *testing.T, app *testApp) map[string]bool {
+	var files = make(map[string]bool)
+	err := filepath.Walk(app.path, func(path string, _ os.FileInfo, err error) error {
+		files[path] = true
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestNoStoreLeavesNothingInStorage(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.CacheUnknownLength = true
+	const contents = "never stored contents"
+	app.up.HandleFunc("/no-store", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store, max-age=3600")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(contents))
+	})
+	app.up.HandleFunc("/no-store-chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store, max-age=3600")
+		_, _ = w.Write([]byte(contents))
+	})
+	var before = listCacheZone(t, app)
+
+	for _, path := range []string{"/no-store", "/no-store-chunked"} {
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+		}
+	}
+	var req = reqForRange("no-store", 2, 5)
+	app.testRequest(req.WithContext(app.ctx), contents[2:7], http.StatusPartialContent)
+
+	var after = listCacheZone(t, app)
+	for path := range after {
+		if !before[path] {
+			t.Errorf("Expected nothing to be stored for no-store responses but found %s", path)
+		}
+	}
+}
+
+func TestNotModifiedWithNoStoreIsNotRefreshed(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.ConditionalRevalidation = 60
+	const etag, contents = `"the-etag"`, "revalidated contents"
+	app.up.HandleFunc("/revalidated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.Header().Set("Cache-Control", "no-store, max-age=3600")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	})
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/revalidated"})
+
+	req, err := http.NewRequest("GET", "http://example.com/revalidated", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+	stored, err := app.cacheHandler.Cache.Storage.GetMetadata(objID)
+	if err != nil {
+		t.Fatalf("Expected the expired object to be stored for revalidation but got %s", err)
+	}
+
+	app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+	refreshed, err := app.cacheHandler.Cache.Storage.GetMetadata(objID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.ExpiresAt != stored.ExpiresAt {
+		t.Errorf("Expected the object not to be refreshed by a no-store 304 but it expires at %d instead of %d",
+			refreshed.ExpiresAt, stored.ExpiresAt)
+	}
+}
+
+func TestNoStateBleedOnKeepAliveConnections(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.ConditionalRevalidation = 60
+	var handle = func(path, cacheControl, etag string, extra http.Header) {
+		app.up.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range extra {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Cache-Control", cacheControl)
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+				if r.Header.Get("If-None-Match") == etag {
+					w.Header().Set("Cache-Control", "max-age=3600")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(path)))
+			_, _ = w.Write([]byte(path))
+		})
+	}
+	handle("/cached", "max-age=3600", "", nil)
+	handle("/no-store", "no-store", "", nil)
+	handle("/revalidated", "max-age=0", `"etag"`, nil)
+	handle("/upstream-status", "max-age=3600", "", http.Header{"X-Cache": {"HIT from upstream"}})
+
+	var server = httptest.NewServer(app.cacheHandler)
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	var reader = bufio.NewReader(conn)
+
+	// every request is sent on the same connection, so the status of a
+	// request must never show up in the response of the next one
+	for i, step := range []struct {
+		method, path, status string
+	}{
+		{"GET", "/cached", types.CacheStatusMiss},
+		{"GET", "/no-store", types.CacheStatusMiss},
+		{"GET", "/cached", types.CacheStatusHit},
+		{"POST", "/cached", ""},
+		{"GET", "/revalidated", types.CacheStatusMiss},
+		// the successful POST invalidated the object
+		{"GET", "/cached", types.CacheStatusMiss},
+		{"GET", "/revalidated", types.CacheStatusRevalidated},
+		{"GET", "/no-store", types.CacheStatusMiss},
+		{"GET", "/revalidated", types.CacheStatusHit},
+		{"HEAD", "/cached", types.CacheStatusHit},
+		{"GET", "/upstream-status", types.CacheStatusMiss},
+		{"GET", "/no-store", types.CacheStatusMiss},
+		{"GET", "/upstream-status", types.CacheStatusHit},
+	} {
+		req, err := http.NewRequest(step.method, "http://example.com"+step.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.Write(conn); err != nil {
+			t.Fatalf("Could not send request %d on the reused connection: %s", i, err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("Could not read response %d from the reused connection: %s", i, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected = step.path
+		if step.method == "HEAD" {
+			expected = ""
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != expected {
+			t.Errorf("Unexpected response %d to %s %s: %d %q", i, step.method, step.path,
+				resp.StatusCode, body)
+		}
+		var got = resp.Header["X-Cache"]
+		if step.status == "" && len(got) != 0 || step.status != "" && !reflect.DeepEqual(got, []string{step.status}) {
+			t.Errorf("Expected X-Cache %q in response %d to %s %s but got %q", step.status, i,
+				step.method, step.path, got)
+		}
+		if resp.Close {
+			t.Fatalf("Expected the connection to be kept alive after response %d", i)
+		}
+	}
+}
+
+func TestAgeHeader(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.ConditionalRevalidation = 60
+	const etag = `"aged"`
+	app.up.HandleFunc("/aged", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.Header().Set("Age", "5")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Age", "100")
+		w.Header().Set("Content-Length", "4")
+		_, _ = w.Write([]byte("aged"))
+	})
+
+	req, err := http.NewRequest("GET", "http://example.com/aged", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(app.ctx)
+	var id = app.cacheHandler.NewObjectIDForRequest(req)
+	var serve = func(status string, minAge, maxAge int64) {
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != status {
+			t.Errorf("Expected %s with 200 but got %q with %d", status, rec.Header().Get("X-Cache"), rec.Code)
+		}
+		age, err := strconv.ParseInt(rec.Header().Get("Age"), 10, 64)
+		if err != nil || age < minAge || age > maxAge {
+			t.Errorf("Expected the %s to have Age between %d and %d but got %q",
+				status, minAge, maxAge, rec.Header().Get("Age"))
+		}
+	}
+	var changeStored = func(change func(*types.ObjectMetadata)) {
+		obj, err := app.cacheHandler.Cache.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change(obj)
+		if err := app.cacheHandler.Cache.Storage.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serve(types.CacheStatusMiss, 100, 100)
+	// the age from the upstream is counted in the age of the cached object
+	serve(types.CacheStatusHit, 100, 102)
+	// and is subtracted from its freshness lifetime
+	obj, err := app.cacheHandler.Cache.Storage.GetMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresIn := time.Unix(obj.ExpiresAt, 0).Sub(time.Now()); expiresIn > 3500*time.Second {
+		t.Errorf("Expected the object to expire in 3500s but it expires in %s", expiresIn)
+	}
+
+	changeStored(func(obj *types.ObjectMetadata) {
+		obj.ResponseTimestamp = time.Now().Add(time.Hour).Unix()
+	})
+	serve(types.CacheStatusHit, 0, 0)
+
+	// the revalidated object is as old as the 304 response
+	changeStored(func(obj *types.ObjectMetadata) {
+		obj.ResponseTimestamp = time.Now().Add(-2 * time.Hour).Unix()
+		obj.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	})
+	serve(types.CacheStatusRevalidated, 5, 7)
+	serve(types.CacheStatusHit, 5, 7)
+}
+
+func TestAuthorizedResponses(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var servingUser = func(cacheControl string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", cacheControl)
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(r.Header.Get("Authorization")))
+		}
+	}
+	app.up.HandleFunc("/private", servingUser("max-age=3600"))
+	app.up.HandleFunc("/public", servingUser("public, max-age=3600"))
+	app.up.HandleFunc("/shared", servingUser("s-maxage=3600"))
+	app.up.HandleFunc("/trusted", servingUser("max-age=3600"))
+
+	var request = func(path, user, expected string) {
+		req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", user)
+		app.testRequest(req.WithContext(app.ctx), expected, http.StatusOK)
+	}
+	// the responses which do not allow it are not shared between the users
+	request("/private", "user1", "user1")
+	request("/private", "user2", "user2")
+	request("/public", "user1", "user1")
+	request("/public", "user2", "user1")
+	request("/shared", "user1", "user1")
+	request("/shared", "user2", "user1")
+
+	app.cacheHandler.Settings.CacheAuthorized = true
+	request("/trusted", "user1", "user1")
+	request("/trusted", "user2", "user1")
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeadRequests(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.NegativeCacheDuration = 60
+	const contents = "the contents which are not needed for HEAD"
+	var mu sync.Mutex
+	var methods []string
+	app.up.HandleFunc("/head", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=3600")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(contents))
+	})
+	app.up.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		var body = http.StatusText(http.StatusNotFound)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != "HEAD" {
+			_, _ = w.Write([]byte(body))
+		}
+	})
+
+	var request = func(method, path string, code int, contentLength int, body string, upstream ...string) {
+		mu.Lock()
+		methods = nil
+		mu.Unlock()
+		req, err := http.NewRequest(method, "http://example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+		if rec.Code != code || rec.Body.String() != body {
+			t.Errorf("Expected %d %q for %s %s but got %d %q",
+				code, body, method, path, rec.Code, rec.Body.String())
+		}
+		if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(contentLength) {
+			t.Errorf("Expected Content-Length %d for %s %s but got %q", contentLength, method, path, cl)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Join(methods, ",") != strings.Join(upstream, ",") {
+			t.Errorf("Expected the upstream requests %v for %s %s but got %v", upstream, method, path, methods)
+		}
+	}
+
+	request("HEAD", "/head", http.StatusOK, len(contents), "", "HEAD")
+	var oid = app.cacheHandler.NewObjectIDForRequest(reqForRange("head", 0, 1))
+	if obj, err := app.cacheHandler.Cache.Storage.GetMetadata(oid); err != nil || obj.Size != uint64(len(contents)) {
+		t.Errorf("Expected the metadata of the object to be stored but got %+v (%v)", obj, err)
+	}
+	if parts, _ := app.cacheHandler.Cache.Storage.GetAvailableParts(oid); len(parts) != 0 {
+		t.Errorf("Expected no parts to be stored for HEAD but got %v", parts)
+	}
+	request("HEAD", "/head", http.StatusOK, len(contents), "")
+	request("GET", "/head", http.StatusOK, len(contents), contents, "GET")
+	request("HEAD", "/head", http.StatusOK, len(contents), "")
+
+	// the error responses are stored only with their bodies
+	var notFound = http.StatusText(http.StatusNotFound)
+	request("HEAD", "/missing", http.StatusNotFound, len(notFound), "", "HEAD")
+	request("GET", "/missing", http.StatusNotFound, len(notFound), notFound, "GET")
+	request("HEAD", "/missing", http.StatusNotFound, len(notFound), "")
+	request("GET", "/missing", http.StatusNotFound, len(notFound), notFound)
+	if obj, err := app.cacheHandler.Cache.Storage.GetMetadata(
+		app.cacheHandler.NewObjectIDForRequest(reqForRange("missing", 0, 1))); err != nil || !obj.Negative {
+		t.Errorf("Expected the error response to be stored but got %+v (%v)", obj, err)
+	}
+}
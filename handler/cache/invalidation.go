@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// unsafeMethods are the methods whose successful responses invalidate the
+// cached object for the request URI, as described in RFC 7234 section 4.4.
+var unsafeMethods = map[string]bool{
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+// passThrough proxies a request which does not use the cache to the upstream.
+// Its body and the response are streamed as they are. If the method is unsafe
+// and the response is not an error, the cached objects for the request URI and
+// for the URIs in its Location and Content-Location headers on the same host
+// are discarded.
+func (c *CachingProxy) passThrough(resp http.ResponseWriter, req *http.Request) {
+	if !unsafeMethods[req.Method] {
+		c.next.ServeHTTP(resp, req)
+		return
+	}
+	var w = &statusWriter{ResponseWriter: resp}
+	c.next.ServeHTTP(w, req)
+	if w.code < 200 || w.code >= 400 {
+		return
+	}
+
+	var reqID, _ = contexts.GetRequestID(req.Context())
+	c.invalidate(reqID, req)
+	for _, name := range []string{"Location", "Content-Location"} {
+		if target := sameHostRequest(req, w.Header().Get(name)); target != nil {
+			c.invalidate(reqID, target)
+		}
+	}
+}
+
+// invalidate discards the cached object for the request, if there is one.
+func (c *CachingProxy) invalidate(reqID types.RequestID, req *http.Request) {
+	var id = c.NewObjectIDForRequest(req)
+	if _, err := c.Cache.Storage.GetMetadata(id); err != nil {
+		return
+	}
+	c.Logger.Debugf("[%s] Invalidating %s after %s %s", reqID, id, req.Method, req.URL)
+	parts, err := c.Cache.Storage.GetAvailableParts(id)
+	if err != nil && !os.IsNotExist(err) {
+		c.Logger.Errorf("[%s] Error while getting the parts of invalidated %s: %s", reqID, id, err)
+	}
+	if err := c.Cache.Storage.Discard(id); err != nil && !os.IsNotExist(err) {
+		c.Logger.Errorf("[%s] Error while discarding invalidated %s: %s", reqID, id, err)
+	}
+	c.Cache.Algorithm.Remove(parts...)
+	c.Cache.SurrogateKeys.Remove(id)
+	c.Cache.Groups.Remove(id)
+}
+
+// sameHostRequest returns a copy of the request for the URI reference, or nil
+// if it is empty, malformed or for another host.
+func sameHostRequest(req *http.Request, reference string) *http.Request {
+	if reference == "" {
+		return nil
+	}
+	ref, err := url.Parse(reference)
+	if err != nil {
+		return nil
+	}
+	var u = req.URL.ResolveReference(ref)
+	if u.Host != "" && u.Host != req.Host && u.Host != req.URL.Host {
+		return nil
+	}
+	var target = *req
+	target.URL = u
+	return &target
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush and CloseNotify are passed through, as the proxy handler relies on
+// them for streaming and aborting the upstream requests.
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
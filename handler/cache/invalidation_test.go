@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUnsafeMethodsInvalidate(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var gets int32
+	var handler = func(code int, location string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				atomic.AddInt32(&gets, 1)
+				w.Header().Set("Cache-Control", "max-age=3600")
+				w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.Path)))
+				_, _ = w.Write([]byte(r.URL.Path))
+				return
+			}
+			if location != "" {
+				w.Header().Set("Location", location)
+			}
+			w.WriteHeader(code)
+		}
+	}
+	app.up.Handle("/doc", handler(http.StatusNoContent, ""))
+	app.up.Handle("/failing", handler(http.StatusInternalServerError, ""))
+	app.up.Handle("/collection", handler(http.StatusCreated, "/created"))
+	app.up.Handle("/created", handler(http.StatusOK, ""))
+	app.up.Handle("/elsewhere", handler(http.StatusCreated, "http://other.example.com/doc"))
+
+	var request = func(method, path string, code int) {
+		req, err := http.NewRequest(method, "http://example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+		if rec.Code != code {
+			t.Errorf("Expected %d for %s %s but got %d", code, method, path, rec.Code)
+		}
+	}
+	var expectCached = func(path string, cached bool) {
+		req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+		_, err := app.cacheHandler.Cache.Storage.GetMetadata(app.cacheHandler.NewObjectIDForRequest(req))
+		if cached && err != nil {
+			t.Errorf("Expected %s to be cached but got %s", path, err)
+		} else if !cached && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be invalidated but got %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"/doc", "/failing", "/created"} {
+		request("GET", path, http.StatusOK)
+		expectCached(path, true)
+	}
+
+	// the safe methods and the error responses invalidate nothing
+	request("OPTIONS", "/doc", http.StatusNoContent)
+	expectCached("/doc", true)
+	request("POST", "/failing", http.StatusInternalServerError)
+	expectCached("/failing", true)
+
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		request(method, "/doc", http.StatusNoContent)
+		expectCached("/doc", false)
+		atomic.StoreInt32(&gets, 0)
+		request("GET", "/doc", http.StatusOK)
+		if got := atomic.LoadInt32(&gets); got != 1 {
+			t.Errorf("Expected the object to be fetched again after %s but there were %d requests",
+				method, got)
+		}
+	}
+
+	// the Location of the response is invalidated only on the same host
+	request("POST", "/elsewhere", http.StatusCreated)
+	expectCached("/doc", true)
+	request("POST", "/collection", http.StatusCreated)
+	expectCached("/created", false)
+}
+
+func TestPassThroughStreamsRequestBody(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var firstChunk = make(chan struct{})
+	app.up.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		var chunk = make([]byte, 5)
+		if _, err := io.ReadFull(r.Body, chunk); err != nil {
+			t.Errorf("Error while reading the first chunk: %s", err)
+		}
+		close(firstChunk)
+		rest, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Error while reading the rest of the body: %s", err)
+		}
+		_, _ = w.Write(append(chunk, rest...))
+	})
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write([]byte("first"))
+		select {
+		case <-firstChunk:
+			_, _ = pw.Write([]byte(" second"))
+			_ = pw.Close()
+		case <-time.After(5 * time.Second):
+			_ = pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}()
+	req, err := http.NewRequest("POST", "http://example.com/upload", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req.WithContext(app.ctx), "first second", http.StatusOK)
+}
@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// cachesNegatively returns whether the error response of the upstream is
+// stored, see Settings.NegativeCacheDuration. The error responses are stored
+// whole, so the ones to HEAD requests, which have no body, are not.
+func (h *reqHandler) cachesNegatively(rw *httputils.FlexibleResponseWriter) bool {
+	return h.Settings.NegativeCacheDuration > 0 && h.req.Method == "GET" &&
+		cacheutils.IsNegativeResponseCacheable(
+			rw.Code, h.Settings.NegativeCacheCodes, rw.Headers, h.cacheableEncodings()...) &&
+		h.varyAllowsCaching(rw.Headers)
+}
+
+// negativeExpiresIn returns in how long the stored error response expires. It
+// is never later than Settings.NegativeCacheDuration.
+func (h *reqHandler) negativeExpiresIn(headers http.Header) time.Duration {
+	var max = time.Duration(h.Settings.NegativeCacheDuration) * time.Second
+	if expiresIn := cacheutils.ResponseExpiresIn(headers, max); expiresIn < max {
+		return expiresIn
+	}
+	return max
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegativeCaching(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.NegativeCacheDuration = 60
+	var requests int32
+	var errorHandler = func(code int, cacheControl string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			var body = http.StatusText(code)
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(code)
+			_, _ = w.Write([]byte(body))
+		}
+	}
+	app.up.Handle("/missing", errorHandler(http.StatusNotFound, ""))
+	app.up.Handle("/missing-no-store", errorHandler(http.StatusNotFound, "no-store"))
+	app.up.Handle("/missing-short", errorHandler(http.StatusNotFound, "max-age=5"))
+	app.up.Handle("/gone", errorHandler(http.StatusGone, ""))
+
+	var serve = func(path, rng string, expectedRequests int32) {
+		atomic.StoreInt32(&requests, 0)
+		for i := 0; i < 3; i++ {
+			req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rng != "" {
+				req.Header.Set("Range", rng)
+			}
+			app.testRequest(req.WithContext(app.ctx), "Not Found", http.StatusNotFound)
+		}
+		if got := atomic.LoadInt32(&requests); got != expectedRequests {
+			t.Errorf("Expected %d upstream requests for %s but there were %d",
+				expectedRequests, path, got)
+		}
+	}
+
+	// the error is served from the cache with its status, even for ranges
+	serve("/missing", "", 1)
+	serve("/missing", "bytes=2-4", 0)
+	var req, _ = http.NewRequest("GET", "http://example.com/missing", nil)
+	var id = app.cacheHandler.NewObjectIDForRequest(req)
+	obj, err := app.cacheHandler.Cache.Storage.GetMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !obj.Negative || obj.Code != http.StatusNotFound {
+		t.Errorf("Expected a negative object with code 404 but got %t and %d", obj.Negative, obj.Code)
+	}
+	if expiresIn := time.Until(time.Unix(obj.ExpiresAt, 0)); expiresIn > time.Minute {
+		t.Errorf("Expected the negative object to expire in a minute but it expires in %s", expiresIn)
+	}
+
+	// and it is not served stale after it expires
+	obj.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	if err := app.cacheHandler.Cache.Storage.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	serve("/missing", "", 1)
+
+	// the upstream can forbid it or expire it earlier
+	serve("/missing-no-store", "", 3)
+	serve("/missing-short", "", 1)
+	req, _ = http.NewRequest("GET", "http://example.com/missing-short", nil)
+	obj, err = app.cacheHandler.Cache.Storage.GetMetadata(app.cacheHandler.NewObjectIDForRequest(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresIn := time.Until(time.Unix(obj.ExpiresAt, 0)); expiresIn > 5*time.Second {
+		t.Errorf("Expected the response to expire in 5s but it expires in %s", expiresIn)
+	}
+
+	// only the configured statuses are cached
+	atomic.StoreInt32(&requests, 0)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/gone", nil)
+		app.testRequest(req.WithContext(app.ctx), "Gone", http.StatusGone)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("Expected the 410 responses to not be cached but there were %d requests", got)
+	}
+}
@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// errFilledInParallel stops the upstream response for an object which is not
+// cached after its first chunk, as the rest of it is loaded in parallel.
+var errFilledInParallel = errors.New("the rest of the object is loaded in parallel")
+
+// parallelChunkSize returns the size of the chunks of the objects which are
+// loaded in parallel, which is Settings.ParallelFillSize rounded up to whole
+// parts.
+func (h *reqHandler) parallelChunkSize() uint64 {
+	var partSize = h.Cache.Storage.PartSize()
+	var parts = (h.Settings.ParallelFillSize.Bytes() + partSize - 1) / partSize
+	if parts == 0 {
+		parts = 1
+	}
+	return parts * partSize
+}
+
+// fillsInParallel returns whether the response with the code for an object
+// with the size which is not cached is loaded in parallel after its first
+// chunk.
+func (h *reqHandler) fillsInParallel(code int, size uint64) bool {
+	return h.Settings.ParallelFills > 1 && code == http.StatusOK && h.req.Method == "GET" &&
+		h.revalidating == nil && size > h.parallelChunkSize()
+}
+
+// respondsInParallel returns whether the bytes from start to end of the
+// object are loaded in parallel by lazilyRespond. They are when they span
+// more than one chunk and some of their parts are not cached, so that the
+// cached objects are not read into memory ahead of the client.
+func (h *reqHandler) respondsInParallel(start, end uint64) bool {
+	if h.Settings.ParallelFills < 2 || end-start < h.parallelChunkSize() {
+		return false
+	}
+	var partSize = h.Cache.Storage.PartSize()
+	for part := start / partSize; part <= end/partSize; part++ {
+		if !h.Cache.Algorithm.Lookup(&types.ObjectIndex{ObjID: h.objID, Part: uint32(part)}) {
+			return true
+		}
+	}
+	return false
+}
+
+// parallelRespond writes the bytes from start to end (inclusive) of the
+// object to w like lazilyRespond, but loads up to Settings.ParallelFills
+// chunks of them at the same time. The chunk which is being written streams
+// to the client and the ones after it are buffered in memory until it is
+// their turn. Loading all of them is canceled when writing to the client
+// fails or the request is done. It returns whether all bytes were written.
+func (h *reqHandler) parallelRespond(w io.Writer, start, end uint64) bool {
+	ctx, cancel := context.WithCancel(h.req.Context())
+	defer cancel()
+	var sub = *h
+	sub.req = h.req.WithContext(ctx)
+	sub.abortFills = true
+
+	var chunkSize = h.parallelChunkSize()
+	// the chunk which is being written is taken out of the channel, so that
+	// at most ParallelFills are loaded at the same time
+	var chunks = make(chan *chunkBuffer, h.Settings.ParallelFills-1)
+	go func() {
+		defer close(chunks)
+		for from := start; from <= end; {
+			var to = umin(end, (from/chunkSize+1)*chunkSize-1)
+			var chunk = newChunkBuffer(to - from + 1)
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+			go sub.loadChunk(ctx, chunk, from, to)
+			from = to + 1
+		}
+	}()
+
+	for chunk := range chunks {
+		if copied, err := io.Copy(w, chunk); err != nil {
+			h.Logger.Logf("[%s] Error loading or sending a chunk of %s after %dbytes: %s",
+				h.reqID, h.objID, copied, err)
+			return false
+		}
+	}
+	return true
+}
+
+// loadChunk loads the bytes from start to end of the object in the chunk.
+func (h *reqHandler) loadChunk(ctx context.Context, chunk *chunkBuffer, start, end uint64) {
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		// the client may be waiting for the chunk while its upstream is
+		// stalled
+		select {
+		case <-ctx.Done():
+			chunk.closeWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	if !h.lazilyRespond(chunk, start, end) {
+		chunk.closeWithError(fmt.Errorf("could not load bytes [%d-%d]", start, end))
+		return
+	}
+	chunk.closeWithError(nil)
+}
+
+// chunkBuffer is an in-memory pipe without a size limit for a chunk of an
+// object with a known length. Its writes never block, so the chunk is loaded
+// while the ones before it are written to the client.
+type chunkBuffer struct {
+	sync.Mutex
+	cond      *sync.Cond
+	data      []byte
+	remaining uint64
+	// err is returned by the reads after the data, it is io.EOF when the
+	// whole chunk was written
+	err error
+}
+
+func newChunkBuffer(length uint64) *chunkBuffer {
+	var c = &chunkBuffer{remaining: length}
+	c.cond = sync.NewCond(c)
+	return c
+}
+
+func (c *chunkBuffer) Write(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if uint64(len(p)) > c.remaining {
+		return 0, fmt.Errorf("chunk overflow, %d bytes remaining but %d were written",
+			c.remaining, len(p))
+	}
+	c.data = append(c.data, p...)
+	c.remaining -= uint64(len(p))
+	c.cond.Broadcast()
+	return len(p), nil
+}
+
+// closeWithError finishes the chunk with the error, which is nil when it was
+// written successfully. Only the first call has an effect.
+func (c *chunkBuffer) closeWithError(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return
+	}
+	if err == nil && c.remaining != 0 {
+		err = fmt.Errorf("chunk closed with %d bytes missing", c.remaining)
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	c.err = err
+	c.cond.Broadcast()
+}
+
+func (c *chunkBuffer) Read(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.data) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.data) == 0 {
+		return 0, c.err
+	}
+	var n = copy(p, c.data)
+	c.data = c.data[n:]
+	if len(c.data) == 0 {
+		c.data = nil // the memory of the read bytes is released
+	}
+	return n, nil
+}
+
+// firstChunkWriter writes the first chunk of an object which is not cached
+// and fails the writes after it, so that the upstream response for the whole
+// object is stopped once the rest is loaded in parallel.
+type firstChunkWriter struct {
+	io.WriteCloser
+	remaining uint64
+}
+
+func (f *firstChunkWriter) Write(p []byte) (int, error) {
+	if uint64(len(p)) <= f.remaining {
+		n, err := f.WriteCloser.Write(p)
+		f.remaining -= uint64(n)
+		return n, err
+	}
+	n, err := f.WriteCloser.Write(p[:f.remaining])
+	f.remaining -= uint64(n)
+	if err == nil {
+		err = errFilledInParallel
+	}
+	return n, err
+}
+
+// respondWithTheRest responds with the rest of the object after its first
+// chunk was proxied, if it is loaded in parallel.
+func (h *reqHandler) respondWithTheRest() {
+	if h.firstChunk == nil || h.firstChunk.remaining != 0 || h.req.Context().Err() != nil {
+		return
+	}
+	h.Logger.Debugf("[%s] Loading the rest of %s in parallel...", h.reqID, h.objID)
+	h.lazilyRespond(h.resp, h.parallelChunkSize(), h.obj.Size-1)
+}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestParallelFillOfMiss(t *testing.T) {
+	t.Parallel()
+	const file = "parallel"
+	app := newTestAppFromMap(t, map[string]string{
+		file: testutils.GenerateMeAString(7, 203),
+	})
+	defer app.cleanup()
+	app.cacheHandler.Settings.ParallelFills = 3
+	app.cacheHandler.Settings.ParallelFillSize = 20
+
+	var mu sync.Mutex
+	var running, maxRunning, requests int
+	var up = app.cacheHandler.next
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		up.ServeHTTP(w, r)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	app.testFullRequest(file)
+	mu.Lock()
+	// the first chunk and then one request for each of the other 10 chunks
+	if requests != 11 || maxRunning < 2 {
+		t.Errorf("Expected 11 concurrent upstream requests but got %d with up to %d at a time",
+			requests, maxRunning)
+	}
+	mu.Unlock()
+
+	var parts = (uint64(len(app.fsmap[file])) + 4) / 5
+	for part := uint64(0); part < parts; part++ {
+		if wait := app.cacheHandler.fills.filling(app.cacheHandler.NewObjectIDForRequest(
+			reqForRange(file, 0, 1)), uint32(part)); wait != nil {
+			<-wait
+		}
+	}
+	app.testFullRequest(file)
+	mu.Lock()
+	if requests != 11 {
+		t.Errorf("Expected the object to be served from the cache but got %d upstream requests",
+			requests-11)
+	}
+	mu.Unlock()
+}
+
+func TestParallelFillIsCanceledWithTheRequest(t *testing.T) {
+	t.Parallel()
+	const file = "canceled"
+	app := newTestAppFromMap(t, map[string]string{
+		file: testutils.GenerateMeAString(8, 200),
+	})
+	defer app.cleanup()
+	app.cacheHandler.Settings.ParallelFills = 4
+	app.cacheHandler.Settings.ParallelFillSize = 20
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var started, canceled int32
+	var up = app.cacheHandler.next
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			up.ServeHTTP(w, r)
+			return
+		}
+		// the client disconnects while the chunks are stalled
+		atomic.AddInt32(&started, 1)
+		cancel()
+		<-r.Context().Done()
+		atomic.AddInt32(&canceled, 1)
+		http.Error(w, "canceled", http.StatusBadGateway)
+	})
+
+	req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec = httptest.NewRecorder()
+	var served = make(chan struct{})
+	go func() {
+		defer close(served)
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(ctx))
+	}()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request did not finish after it was canceled")
+	}
+	if rec.Body.String() != app.fsmap[file][:20] {
+		t.Errorf("Expected only the first chunk to be sent but got %q", rec.Body.String())
+	}
+	var deadline = time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&canceled) != atomic.LoadInt32(&started) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c, s := atomic.LoadInt32(&canceled), atomic.LoadInt32(&started); s == 0 || c != s {
+		t.Errorf("Expected all %d chunk requests to be canceled but %d were", s, c)
+	}
+}
+
+func TestChunkBuffer(t *testing.T) {
+	t.Parallel()
+	var chunk = newChunkBuffer(6)
+	var read = make(chan string)
+	go func() {
+		b, err := ioutil.ReadAll(chunk)
+		if err != nil {
+			t.Errorf("Unexpected error while reading the chunk: %s", err)
+		}
+		read <- string(b)
+	}()
+	for _, s := range []string{"ab", "cde", "f"} {
+		if _, err := chunk.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := chunk.Write([]byte("g")); err == nil {
+		t.Error("Expected an error for writing after the end of the chunk")
+	}
+	chunk.closeWithError(nil)
+	if got := <-read; got != "abcdef" {
+		t.Errorf("Expected to read the whole chunk but got %q", got)
+	}
+
+	chunk = newChunkBuffer(6)
+	if _, err := chunk.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	chunk.closeWithError(nil)
+	if _, err := ioutil.ReadAll(chunk); err == nil || err == io.EOF {
+		t.Errorf("Expected an error for an incomplete chunk but got %v", err)
+	}
+
+	var failed = errors.New("failed")
+	chunk = newChunkBuffer(6)
+	chunk.closeWithError(failed)
+	if _, err := chunk.Write([]byte("abc")); err != failed {
+		t.Errorf("Expected the writes to fail after the chunk was closed but got %v", err)
+	}
+}
@@ -2,15 +2,18 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 
+	"github.com/ironsmile/nedomi/storage"
 	"github.com/ironsmile/nedomi/types"
 	"github.com/ironsmile/nedomi/utils/httputils"
 	"github.com/pkg/errors"
 )
 
 type partWriter struct {
+	ctx        context.Context
 	objID      *types.ObjectID
 	cz         *types.CacheZone
 	partSize   uint64
@@ -19,12 +22,28 @@ type partWriter struct {
 	length     uint64
 	objSize    uint64
 	buf        []byte
+	// saved, if not nil, is called when a part is done, whether or not it
+	// was kept by the cache algorithm
+	saved func(part uint32)
 }
 
 // PartWriter creates a io.WriteCloser that statefully writes sequential parts of
 // an object to the supplied storage.
 func PartWriter(cz *types.CacheZone, objID *types.ObjectID, ContentRange httputils.ContentRange) io.WriteCloser {
+	return newPartWriter(context.Background(), cz, objID, ContentRange, nil)
+}
+
+// newPartWriter creates a PartWriter which calls saved after every part it
+// writes. Waiting for the storage to save a part stops when ctx is done.
+func newPartWriter(
+	ctx context.Context,
+	cz *types.CacheZone,
+	objID *types.ObjectID,
+	ContentRange httputils.ContentRange,
+	saved func(part uint32),
+) io.WriteCloser {
 	return &partWriter{
+		ctx:        ctx,
 		objID:      objID,
 		cz:         cz,
 		partSize:   cz.Storage.PartSize(),
@@ -32,6 +51,7 @@ func PartWriter(cz *types.CacheZone, objID *types.ObjectID, ContentRange httputi
 		currentPos: ContentRange.Start,
 		length:     ContentRange.Length,
 		objSize:    ContentRange.ObjSize,
+		saved:      saved,
 	}
 }
 
@@ -91,18 +111,36 @@ func (pw *partWriter) flushBuffer() error {
 
 	if !pw.cz.Algorithm.ShouldKeep(idx) {
 		pw.buf = nil
+		pw.partDone(part)
 		return nil
-	} else if err := pw.cz.Storage.SavePart(idx, bytes.NewBuffer(pw.buf)); err != nil {
+	} else if err := storage.SavePartContext(pw.ctx, pw.cz.Storage, idx, bytes.NewBuffer(pw.buf)); err != nil {
 		return err
 	}
 	pw.buf = nil
 	if err := pw.cz.Algorithm.AddObject(idx); err != nil && err != types.ErrAlreadyInCache {
 		return err
 	}
+	pw.partDone(part)
 	return nil
 }
 
+func (pw *partWriter) partDone(part uint32) {
+	if pw.saved != nil {
+		pw.saved(part)
+	}
+}
+
+// Close saves the last part and lets the storage finish the fill, e.g. write
+// the checksums of the saved parts, even when not all parts were received.
 func (pw *partWriter) Close() error {
+	var err = pw.close()
+	if finishErr := storage.FinishFill(pw.cz.Storage, pw.objID); err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+func (pw *partWriter) close() error {
 	if pw.currentPos-pw.startPos != pw.length {
 		return errors.WithStack(&partWriterShortWrite{
 			expected: pw.length,
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// objectFills coordinates the upstream requests which fill the cache, so that
+// every part of an object is requested only once at a time and the number of
+// concurrent requests for the parts of an object is bounded. Requests which
+// need a part that is being filled wait for it and then read it from the
+// cache. The same is done for the metadata of objects which are not cached.
+type objectFills struct {
+	sync.Mutex
+	maxPerObject int
+	objects      map[types.ObjectIDHash]*objectFill
+}
+
+// objectFill is the state of the fills for a single object.
+type objectFill struct {
+	// users is the number of requests which hold or wait for a slot
+	users int
+	// slots bounds the concurrent part fills, it is nil when they are not
+	slots chan struct{}
+	// parts are the parts being filled, their channels are closed when done
+	parts map[uint32]chan struct{}
+	// metadata is closed when the metadata fill is done, nil if there is none
+	metadata chan struct{}
+}
+
+func newObjectFills(maxPerObject int) *objectFills {
+	return &objectFills{
+		maxPerObject: maxPerObject,
+		objects:      make(map[types.ObjectIDHash]*objectFill),
+	}
+}
+
+// get returns the fill state of the object, creating it if needed. It must be
+// called with the lock held.
+func (f *objectFills) get(id *types.ObjectID) *objectFill {
+	of, ok := f.objects[id.Hash()]
+	if !ok {
+		of = &objectFill{parts: make(map[uint32]chan struct{})}
+		if f.maxPerObject > 0 {
+			of.slots = make(chan struct{}, f.maxPerObject)
+		}
+		f.objects[id.Hash()] = of
+	}
+	return of
+}
+
+// forget removes the fill state of the object once nothing uses it. It must
+// be called with the lock held.
+func (f *objectFills) forget(id *types.ObjectID, of *objectFill) {
+	// a state which was already forgotten must not remove a newer one
+	if of.users == 0 && len(of.parts) == 0 && of.metadata == nil && f.objects[id.Hash()] == of {
+		delete(f.objects, id.Hash())
+	}
+}
+
+// filling returns a channel which is closed when the fill of the part is
+// done, or nil if the part is not being filled.
+func (f *objectFills) filling(id *types.ObjectID, part uint32) <-chan struct{} {
+	f.Lock()
+	defer f.Unlock()
+	if of, ok := f.objects[id.Hash()]; ok {
+		return of.parts[part]
+	}
+	return nil
+}
+
+// fillSlot is a slot for filling parts of an object, held by a request.
+type fillSlot struct {
+	fills   *objectFills
+	id      *types.ObjectID
+	of      *objectFill
+	claimed []uint32
+}
+
+// acquire waits for a free fill slot for the object. If the part is being
+// filled, no slot is acquired and the returned channel is closed when that
+// fill is done.
+func (f *objectFills) acquire(ctx context.Context, id *types.ObjectID, part uint32,
+) (*fillSlot, <-chan struct{}, error) {
+	f.Lock()
+	var of = f.get(id)
+	if wait, ok := of.parts[part]; ok {
+		f.Unlock()
+		return nil, wait, nil
+	}
+	of.users++
+	f.Unlock()
+
+	if of.slots != nil {
+		select {
+		case of.slots <- struct{}{}:
+		case <-ctx.Done():
+			f.Lock()
+			of.users--
+			f.forget(id, of)
+			f.Unlock()
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	var slot = &fillSlot{fills: f, id: id, of: of}
+	f.Lock()
+	defer f.Unlock()
+	if wait, ok := of.parts[part]; ok { // claimed while waiting for the slot
+		slot.releaseLocked()
+		return nil, wait, nil
+	}
+	return slot, nil, nil
+}
+
+// claim claims the parts from first to last, stopping before the first one
+// which is being filled, and returns the last claimed part. If the first part
+// is being filled already, the slot is released and the returned channel is
+// closed when that fill is done.
+func (s *fillSlot) claim(first, last uint32) (uint32, <-chan struct{}) {
+	s.fills.Lock()
+	defer s.fills.Unlock()
+	if wait, ok := s.of.parts[first]; ok {
+		s.releaseLocked()
+		return 0, wait
+	}
+	s.claimed = s.fills.claimParts(s.of, first, last, false)
+	return s.claimed[len(s.claimed)-1], nil
+}
+
+// release releases the slot and the claimed parts, notifying the requests
+// waiting for them.
+func (s *fillSlot) release() {
+	s.fills.Lock()
+	defer s.fills.Unlock()
+	s.releaseLocked()
+}
+
+func (s *fillSlot) releaseLocked() {
+	s.fills.releaseParts(s.of, s.claimed)
+	s.claimed = nil
+	if s.of.slots != nil {
+		<-s.of.slots
+	}
+	s.of.users--
+	s.fills.forget(s.id, s.of)
+}
+
+// claimFilled claims the parts from first to last which are not being filled
+// already, without waiting for a slot. It is used by the requests which fill
+// parts as a side effect of proxying the response to the client. The returned
+// saved function releases a single part as soon as it is saved, so that the
+// requests waiting for it do not wait for the whole response. The release
+// function must be called when the response is done.
+func (f *objectFills) claimFilled(id *types.ObjectID, first, last uint32,
+) (release func(), saved func(part uint32)) {
+	f.Lock()
+	defer f.Unlock()
+	var of = f.get(id)
+	var claimed = f.claimParts(of, first, last, true)
+	f.forget(id, of)
+	release = func() {
+		f.Lock()
+		defer f.Unlock()
+		f.releaseParts(of, claimed)
+		claimed = nil
+		f.forget(id, of)
+	}
+	saved = func(part uint32) {
+		f.Lock()
+		defer f.Unlock()
+		for i, claimedPart := range claimed {
+			if claimedPart != part {
+				continue
+			}
+			f.releaseParts(of, claimed[i:i+1])
+			if i == 0 { // the parts are usually saved in order
+				claimed = claimed[1:]
+			} else {
+				claimed = append(claimed[:i:i], claimed[i+1:]...)
+			}
+			f.forget(id, of)
+			return
+		}
+	}
+	return release, saved
+}
+
+// claimParts claims the parts from first to last. When skipFilling is false
+// it stops before the first part which is being filled, otherwise such parts
+// are skipped. It must be called with the lock held.
+func (f *objectFills) claimParts(of *objectFill, first, last uint32, skipFilling bool) []uint32 {
+	var claimed []uint32
+	for part := first; part <= last; part++ {
+		if _, ok := of.parts[part]; ok {
+			if skipFilling {
+				continue
+			}
+			break
+		}
+		of.parts[part] = make(chan struct{})
+		claimed = append(claimed, part)
+		if part == last { // do not overflow
+			break
+		}
+	}
+	return claimed
+}
+
+func (f *objectFills) releaseParts(of *objectFill, parts []uint32) {
+	for _, part := range parts {
+		close(of.parts[part])
+		delete(of.parts, part)
+	}
+}
+
+// fillMetadata registers that the metadata of the object is being requested
+// from the upstream. If it already is, it returns a channel which is closed
+// when the metadata is saved or the request fails. Otherwise it returns a
+// function which must be called once that happens. It is safe to call it
+// more than once.
+func (f *objectFills) fillMetadata(id *types.ObjectID) (func(), <-chan struct{}) {
+	f.Lock()
+	defer f.Unlock()
+	var of = f.get(id)
+	if of.metadata != nil {
+		return nil, of.metadata
+	}
+	var done = make(chan struct{})
+	of.metadata = done
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.Lock()
+			defer f.Unlock()
+			close(done)
+			of.metadata = nil
+			f.forget(id, of)
+		})
+	}, nil
+}
@@ -0,0 +1,464 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/httputils"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestConcurrentRangeFillsAreDeduplicated(t *testing.T) {
+	t.Parallel()
+	const file, requests = "ranges", 40
+	app := newTestAppFromMap(t, map[string]string{
+		file: testutils.GenerateMeAString(42, 200),
+	})
+	defer app.cleanup()
+	var partSize = app.cacheHandler.Cache.Storage.PartSize()
+	var objSize = uint64(len(app.fsmap[file]))
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	var filled = make(map[uint64]int)
+	var up = app.cacheHandler.next
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		ranges, err := httputils.ParseRequestRange(r.Header.Get("Range"), objSize)
+		if err != nil || len(ranges) != 1 {
+			t.Errorf("Unexpected upstream range %q", r.Header.Get("Range"))
+		} else {
+			// count the whole parts which are saved from the response
+			var start, end = ranges[0].Start, ranges[0].Start + ranges[0].Length
+			for part := (start + partSize - 1) / partSize; part*partSize < end; part++ {
+				if (part+1)*partSize <= end || end == objSize {
+					filled[part]++
+				}
+			}
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		up.ServeHTTP(w, r)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var start = uint64(i*17) % (objSize - 30)
+			app.testRange(file, start, uint64(10+i%20))
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	for part, count := range filled {
+		if count > 1 {
+			t.Errorf("Part %d was requested from the upstream %d times", part, count)
+		}
+	}
+	// the request which fills the metadata is not bound by the limit
+	if limit := app.cacheHandler.Settings.MaxRangeFillsPerObject + 1; maxRunning > limit {
+		t.Errorf("Expected at most %d concurrent upstream requests but there were %d",
+			limit, maxRunning)
+	}
+	mu.Unlock()
+
+	waitForFills(t, app)
+}
+
+// waitForFills waits for the fills to finish storing their parts, which they
+// may do after the clients are served.
+func waitForFills(t testing.TB, app *testApp) {
+	var left int
+	for i := 0; i < 100; i++ {
+		app.cacheHandler.fills.Lock()
+		left = len(app.cacheHandler.fills.objects)
+		app.cacheHandler.fills.Unlock()
+		if left == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if left != 0 {
+		t.Errorf("Expected no fills to be left but there are %d", left)
+	}
+}
+
+func TestDiscardedPartIsRefetchedOnce(t *testing.T) {
+	t.Parallel()
+	const file, readers = "refetched", 10
+	app := newTestAppFromMap(t, map[string]string{
+		file: testutils.GenerateMeAString(7, 50),
+	})
+	defer app.cleanup()
+	app.testFullRequest(file)
+	waitForFills(t, app)
+
+	var partSize = app.cacheHandler.Cache.Storage.PartSize()
+	var id = app.cacheHandler.NewObjectIDForURL(mustParseURL("/" + file))
+	var discarded = &types.ObjectIndex{ObjID: id, Part: 4}
+	if err := app.cacheHandler.Cache.Storage.DiscardPart(discarded); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests = make(chan string, readers)
+	var release = make(chan struct{})
+	var up = app.cacheHandler.next
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Header.Get("Range")
+		<-release
+		up.ServeHTTP(w, r)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			app.testRange(file, uint64(discarded.Part)*partSize+uint64(i%3), partSize-2)
+		}(i)
+	}
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the discarded part to be requested from the upstream")
+	}
+
+	// the other parts are served from the cache while the part is refetched
+	var served = make(chan struct{})
+	go func() {
+		defer close(served)
+		app.testRange(file, 0, 2*partSize)
+		app.testRange(file, 8*partSize, 2*partSize)
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Error("Expected the readers of the other parts not to wait for the refetch")
+	}
+
+	close(release)
+	wg.Wait()
+	<-served
+	waitForFills(t, app)
+	close(requests)
+	for rng := range requests {
+		t.Errorf("Expected a single upstream request for the discarded part but there was another for %s", rng)
+	}
+	if parts, err := app.cacheHandler.Cache.Storage.GetAvailableParts(id); err != nil || len(parts) != 10 {
+		t.Errorf("Expected all 10 parts to be stored after the refetch but got %d (%v)", len(parts), err)
+	}
+}
+
+func TestObjectFillsClaims(t *testing.T) {
+	t.Parallel()
+	var fills = newObjectFills(1)
+	var app = newTestApp(t)
+	defer app.cleanup()
+	var id = app.cacheHandler.NewObjectIDForURL(mustParseURL("/claims"))
+
+	slot, wait, err := fills.acquire(app.ctx, id, 2)
+	if err != nil || wait != nil {
+		t.Fatalf("Expected to acquire a slot but got %v, %v", wait, err)
+	}
+	if last, _ := slot.claim(2, 6); last != 6 {
+		t.Fatalf("Expected to claim parts 2-6 but got up to %d", last)
+	}
+	if _, wait, _ = fills.acquire(app.ctx, id, 4); wait == nil {
+		t.Fatal("Expected to wait for part 4")
+	}
+	// the parts which are being filled are skipped
+	var releaseFilled, _ = fills.claimFilled(id, 0, 10)
+	if len(fills.objects[id.Hash()].parts) != 11 {
+		t.Errorf("Expected all 11 parts to be claimed but got %d",
+			len(fills.objects[id.Hash()].parts))
+	}
+	if _, waitFilled, _ := fills.acquire(app.ctx, id, 8); waitFilled == nil {
+		t.Error("Expected to wait for part 8")
+	}
+	releaseFilled()
+
+	var claimed = make(chan uint32)
+	go func() {
+		other, _, err := fills.acquire(app.ctx, id, 1)
+		if err != nil || other == nil {
+			t.Errorf("Expected to acquire a slot but got %v", err)
+			close(claimed)
+			return
+		}
+		var last, _ = other.claim(1, 9)
+		other.release()
+		claimed <- last
+	}()
+	select {
+	case <-claimed:
+		t.Fatal("Expected to wait for a free slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	slot.release()
+	select {
+	case <-wait:
+	default:
+		t.Error("Expected the waiters for part 4 to be notified")
+	}
+	if last := <-claimed; last != 9 {
+		t.Errorf("Expected to claim up to part 9 but got %d", last)
+	}
+	if len(fills.objects) != 0 {
+		t.Errorf("Expected no fills to be left but there are %d", len(fills.objects))
+	}
+
+	// the part is claimed after the slot is acquired
+	slot, _, _ = fills.acquire(app.ctx, id, 3)
+	releaseFilled, _ = fills.claimFilled(id, 3, 3)
+	if _, wait = slot.claim(3, 5); wait == nil {
+		t.Error("Expected to wait for part 3")
+	}
+	releaseFilled()
+	if len(fills.objects) != 0 {
+		t.Errorf("Expected no fills to be left but there are %d", len(fills.objects))
+	}
+}
+
+func TestSavedFilledPartsAreReleased(t *testing.T) {
+	t.Parallel()
+	var fills = newObjectFills(0)
+	var app = newTestApp(t)
+	defer app.cleanup()
+	var id = app.cacheHandler.NewObjectIDForURL(mustParseURL("/saved"))
+
+	var release, saved = fills.claimFilled(id, 0, 3)
+	var wait1, wait2 = fills.filling(id, 1), fills.filling(id, 2)
+	saved(0)
+	saved(2)
+	saved(7) // not claimed
+	if fills.filling(id, 0) != nil || fills.filling(id, 2) != nil {
+		t.Error("Expected the saved parts not to be filled anymore")
+	}
+	select {
+	case <-wait2:
+	default:
+		t.Error("Expected the waiters for part 2 to be notified when it is saved")
+	}
+	select {
+	case <-wait1:
+		t.Error("Expected the waiters for part 1 to wait until it is saved")
+	default:
+	}
+
+	// a part which was released can be claimed by another fill, which is
+	// not released with this one
+	var releaseOther, _ = fills.claimFilled(id, 2, 2)
+	release()
+	<-wait1
+	if fills.filling(id, 2) == nil {
+		t.Error("Expected the part of the other fill to be still filled")
+	}
+	releaseOther()
+	if len(fills.objects) != 0 {
+		t.Errorf("Expected no fills to be left but there are %d", len(fills.objects))
+	}
+}
+
+func TestMissStampedeIsCoalesced(t *testing.T) {
+	t.Parallel()
+	const file, requests = "stampede", 30
+	var contents = testutils.GenerateMeAString(11, 200)
+	app := newTestAppFromMap(t, map[string]string{file: contents})
+	defer app.cleanup()
+
+	var upstreamRequests int32
+	var finish = make(chan struct{})
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamRequests, 1)
+		// the other requests arrive while the first one waits for headers
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(contents[:100]))
+		<-finish
+		_, _ = w.Write([]byte(contents[100:]))
+	})
+
+	var wg sync.WaitGroup
+	var started = make(chan struct{}, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// the parts which are already saved are served before the
+			// first request finishes
+			var rec = &progressRecorder{
+				ResponseRecorder: httptest.NewRecorder(),
+				after:            50,
+				reached:          started,
+			}
+			app.cacheHandler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Body.String() != contents {
+				t.Errorf("Expected the whole object but got %d %q", rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	var timeout = time.After(2 * time.Second)
+	for i := 0; i < requests; i++ {
+		select {
+		case <-started:
+		case <-timeout:
+			t.Error("Expected the requests to receive the saved parts before the fill is done")
+			i = requests
+		}
+	}
+	close(finish)
+	wg.Wait()
+	waitForFills(t, app)
+	if n := atomic.LoadInt32(&upstreamRequests); n != 1 {
+		t.Errorf("Expected a single upstream request but there were %d", n)
+	}
+}
+
+func TestMissWaitsForTheFillLock(t *testing.T) {
+	t.Parallel()
+	const file = "slow"
+	var contents = testutils.GenerateMeAString(12, 50)
+	app := newTestAppFromMap(t, map[string]string{file: contents})
+	defer app.cleanup()
+	app.cacheHandler.Settings.FillLockTimeout = 20
+
+	var upstreamRequests int32
+	var release = make(chan struct{})
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&upstreamRequests, 1) == 1 {
+			// the first request fills the metadata slowly
+			<-release
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(contents))
+	})
+
+	var get = func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req)
+		return rec
+	}
+	var filled = make(chan *httptest.ResponseRecorder)
+	go func() { filled <- get() }()
+	for atomic.LoadInt32(&upstreamRequests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var done = make(chan *httptest.ResponseRecorder)
+	go func() { done <- get() }()
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK || rec.Body.String() != contents {
+			t.Errorf("Expected the whole object but got %d %q", rec.Code, rec.Body.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the waiting request to be proxied on its own after the lock timeout")
+		close(release)
+		<-done
+	}
+	select {
+	case <-release:
+	default:
+		close(release)
+	}
+	if rec := <-filled; rec.Code != http.StatusOK || rec.Body.String() != contents {
+		t.Errorf("Expected the whole object but got %d %q", rec.Code, rec.Body.String())
+	}
+	waitForFills(t, app)
+	if n := atomic.LoadInt32(&upstreamRequests); n != 2 {
+		t.Errorf("Expected 2 upstream requests but there were %d", n)
+	}
+}
+
+// progressRecorder signals once the response body has at least after bytes.
+type progressRecorder struct {
+	*httptest.ResponseRecorder
+	after   int
+	reached chan<- struct{}
+}
+
+func (r *progressRecorder) Write(p []byte) (int, error) {
+	var before = r.Body.Len()
+	n, err := r.ResponseRecorder.Write(p)
+	if before < r.after && r.Body.Len() >= r.after {
+		r.reached <- struct{}{}
+	}
+	return n, err
+}
+
+func TestMissStampedeWithoutStoredResponse(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+
+	var upstreamRequests int32
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamRequests, 1)
+		time.Sleep(20 * time.Millisecond)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+
+	const requests = 10
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", "http://example.com/unavailable", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var rec = httptest.NewRecorder()
+			app.cacheHandler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("Expected the upstream error but got %d", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	waitForFills(t, app)
+	if n := atomic.LoadInt32(&upstreamRequests); n < 2 {
+		t.Errorf("Expected the waiting requests to be proxied on their own but there were %d upstream requests", n)
+	}
+}
+
+func mustParseURL(path string) *url.URL {
+	u, err := url.Parse(path)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
@@ -0,0 +1,422 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/storage"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// revalidations keeps track of the stale objects which are being revalidated
+// in the background, so that only one upstream request is made for each of
+// them, and of the ones whose last revalidation failed.
+type revalidations struct {
+	sync.Mutex
+	running map[types.ObjectIDHash]struct{}
+	failed  map[types.ObjectIDHash]struct{}
+}
+
+func newRevalidations() *revalidations {
+	return &revalidations{
+		running: make(map[types.ObjectIDHash]struct{}),
+		failed:  make(map[types.ObjectIDHash]struct{}),
+	}
+}
+
+// start returns whether a revalidation of the object should be started, which
+// is the case when there is none running already.
+func (r *revalidations) start(id *types.ObjectID) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.running[id.Hash()]; ok {
+		return false
+	}
+	r.running[id.Hash()] = struct{}{}
+	return true
+}
+
+// finish records the result of a revalidation started with start.
+func (r *revalidations) finish(id *types.ObjectID, failed bool) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.running, id.Hash())
+	if failed {
+		r.failed[id.Hash()] = struct{}{}
+	} else {
+		delete(r.failed, id.Hash())
+	}
+}
+
+// hasFailed returns whether the last revalidation of the object failed.
+func (r *revalidations) hasFailed(id *types.ObjectID) bool {
+	r.Lock()
+	defer r.Unlock()
+	_, ok := r.failed[id.Hash()]
+	return ok
+}
+
+// forget removes the record of a failed revalidation of the object.
+func (r *revalidations) forget(id *types.ObjectID) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.failed, id.Hash())
+}
+
+// staleWindow returns for how long after its expiry the object may be served
+// stale while it is revalidated. The window is longer if the last
+// revalidation failed and MaxStale allows it.
+func (h *reqHandler) staleWindow(obj *types.ObjectMetadata, failed bool) time.Duration {
+	if obj.StaleWhileRevalidate <= 0 {
+		return 0
+	}
+	var window = time.Duration(obj.StaleWhileRevalidate) * time.Second
+	if maxStale := time.Duration(h.Settings.MaxStale) * time.Second; failed && maxStale > window {
+		return maxStale
+	}
+	return window
+}
+
+// retentionWindow returns for how long after its expiry the object has to be
+// kept, so that it can be served stale if its revalidation fails or the
+// upstream errors, or it can be revalidated conditionally or partially.
+func (h *reqHandler) retentionWindow(obj *types.ObjectMetadata) time.Duration {
+	var window = h.staleWindow(obj, true)
+	if keep := time.Duration(h.Settings.StaleIfError) * time.Second; keep > window {
+		window = keep
+	}
+	if !hasValidators(obj.Headers) {
+		return window
+	}
+	for _, seconds := range []uint32{h.Settings.PartialRevalidation, h.Settings.ConditionalRevalidation} {
+		if keep := time.Duration(seconds) * time.Second; keep > window {
+			window = keep
+		}
+	}
+	return window
+}
+
+// hasValidators returns whether the headers identify the version of the object,
+// so that the parts of different versions are not mixed.
+func hasValidators(headers http.Header) bool {
+	for _, name := range validatorHeaders {
+		if headers.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// freshImmutable returns whether the object is fresh and will not change
+// until it expires, so it is not revalidated even if the client asks for it.
+func (h *reqHandler) freshImmutable(obj *types.ObjectMetadata) bool {
+	return h.Settings.HonorImmutable && obj.Immutable && utils.IsMetadataFresh(obj)
+}
+
+// revalidatesConditionally returns whether the expired object with these
+// headers is kept to be revalidated with a conditional request. The responses
+// which expire immediately, e.g. with no-cache, are cached only if they are.
+func (h *reqHandler) revalidatesConditionally(headers http.Header) bool {
+	return h.Settings.ConditionalRevalidation > 0 && hasValidators(headers)
+}
+
+// revalidatesPartially returns whether the expired object should be kept when
+// the upstream responds with the requested range instead of confirming that it
+// is not modified. The response for the range revalidates the whole object: if
+// it is for the same version its freshness is extended and the cached parts
+// are kept, otherwise they are discarded.
+func (h *reqHandler) revalidatesPartially(expired *types.ObjectMetadata) bool {
+	return h.Settings.PartialRevalidation > 0 &&
+		h.req.Header.Get("Range") != "" &&
+		hasValidators(expired.Headers)
+}
+
+// serveStaleWarning returns the warn-code with which the expired object can be
+// served while it is revalidated, or zero if it can not be served. After the
+// upstream failed to revalidate it, it is served as disconnected.
+func (h *reqHandler) serveStaleWarning(obj *types.ObjectMetadata) int {
+	var failed = h.revals.hasFailed(h.objID)
+	var staleUntil = time.Unix(obj.ExpiresAt, 0).Add(h.staleWindow(obj, failed))
+	if !staleUntil.After(time.Now()) {
+		return 0
+	}
+	if failed {
+		return cacheutils.WarningDisconnectedOperation
+	}
+	return cacheutils.WarningResponseIsStale
+}
+
+// revalidate requests the object from the upstream in the background and
+// replaces the stale one in the cache with the response. Only one
+// revalidation per object runs at a time.
+func (h *reqHandler) revalidate(stale *types.ObjectMetadata) {
+	if !h.revals.start(h.objID) {
+		h.Logger.Debugf("[%s] The object is already being revalidated", h.reqID)
+		return
+	}
+
+	var ctx, reqID = contexts.AppendToRequestID(h.req.Context(), []byte("->revalidate"))
+	var req = h.req.WithContext(ctx)
+	req.Method = "GET"
+	req.Header = make(http.Header)
+	httputils.CopyHeadersWithout(h.req.Header, req.Header,
+		append([]string{"Range", "Cache-Control", "Pragma"}, conditionalHeaders...)...)
+
+	var subh = &reqHandler{
+		CachingProxy: h.CachingProxy,
+		req:          req,
+		resp: httputils.NewFlexibleResponseWriter(func(rw *httputils.FlexibleResponseWriter) {
+			rw.BodyWriter = utils.AddCloser(ioutil.Discard)
+		}),
+		objID:        h.objID,
+		reqID:        reqID,
+		revalidating: stale,
+	}
+	if hasValidators(stale.Headers) {
+		subh.conditional = stale
+	}
+	h.Logger.Debugf("[%s] Revalidating the stale object in the background as %s", h.reqID, reqID)
+	h.Cache.Acquire()
+	go utils.SafeExecute(
+		func() {
+			defer h.Cache.Release()
+			subh.carbonCopyProxy()
+			subh.revals.finish(subh.objID, subh.revalidationFailed)
+			subh.discardIfPurged()
+		},
+		func(err error) {
+			subh.revals.finish(subh.objID, true)
+			h.Logger.Errorf("[%s] Panic inside carbonCopyProxy %s", reqID, err)
+		},
+	)
+}
+
+// servesStaleIfError returns whether the expired object is still served if
+// the upstream fails while it is revalidated, see Settings.StaleIfError.
+func (h *reqHandler) servesStaleIfError(obj *types.ObjectMetadata) bool {
+	var window = time.Duration(h.Settings.StaleIfError) * time.Second
+	return window > 0 && time.Now().Before(time.Unix(obj.ExpiresAt, 0).Add(window))
+}
+
+// revalidateConditionally requests the expired object from the upstream with
+// its validators, if it has any. If it is not modified, its freshness is
+// extended and it is served from the cache. If the upstream fails and it can
+// be served stale, it is. Otherwise the upstream response replaces it.
+func (h *reqHandler) revalidateConditionally(expired *types.ObjectMetadata) {
+	h.conditional = expired
+	h.carbonCopyProxy()
+	if h.revalidatedStale {
+		h.staleWarning = cacheutils.WarningDisconnectedOperation
+		h.knownObject()
+		return
+	}
+	if !h.notModifiedUpstream {
+		return
+	}
+	if h.obj == nil {
+		h.Logger.Debugf("[%s] The object %s was purged or replaced while revalidating it, proxying...",
+			h.reqID, h.objID)
+		h.conditional, h.notModifiedUpstream = nil, false
+		h.carbonCopyProxy()
+		return
+	}
+	h.knownObject()
+}
+
+// budgetSpent handles the upstream response which was received after the
+// budget of the request was spent, usually the error for the canceled
+// upstream request, by discarding it. The expired object which was being
+// revalidated is served stale if it is still stored, otherwise the client
+// gets 504 Gateway Timeout.
+func (h *reqHandler) budgetSpent(rw *httputils.FlexibleResponseWriter) {
+	rw.BodyWriter = utils.AddCloser(ioutil.Discard)
+	if h.conditional != nil && h.useStale() {
+		h.Logger.Logf("[%s] The budget of the request was spent while revalidating %s, serving it stale",
+			h.reqID, h.objID)
+		return
+	}
+	h.Logger.Logf("[%s] The budget of the request was spent waiting for the upstream", h.reqID)
+	h.setCacheStatusHeader()
+	httputils.Error(h.resp, http.StatusGatewayTimeout)
+}
+
+// serveStaleOnError handles the server error response of the upstream to the
+// revalidation of an expired object in the foreground. If the object can be
+// served stale, the response is discarded and it returns true.
+func (h *reqHandler) serveStaleOnError(rw *httputils.FlexibleResponseWriter) bool {
+	if h.revalidating != nil || !h.servesStaleIfError(h.conditional) || !h.useStale() {
+		return false
+	}
+	h.Logger.Logf("[%s] The upstream responded with %d while revalidating %s, serving it stale",
+		h.reqID, rw.Code, h.objID)
+	rw.BodyWriter = utils.AddCloser(ioutil.Discard)
+	return true
+}
+
+// useStale sets h.obj to the expired object which is being revalidated, so
+// that it is served stale, if it is still stored and was not purged or
+// replaced in the meantime. It returns whether it did.
+func (h *reqHandler) useStale() bool {
+	current, err := h.Cache.Storage.GetMetadata(h.objID)
+	if err != nil || current.ResponseTimestamp != h.conditional.ResponseTimestamp {
+		return false
+	}
+	if current.Group != "" && !h.Cache.Groups.IsCurrent(current.Group, current.GroupGeneration) {
+		return false
+	}
+	h.obj, h.revalidatedStale = current, true
+	return true
+}
+
+// setConditionalHeaders makes the upstream request conditional on the
+// validators of the expired object, so that it is not downloaded again if it
+// is not modified. The conditional headers of the client are not sent as the
+// response is for the cache.
+func (h *reqHandler) setConditionalHeaders(headers http.Header) {
+	removeHeaders(headers, conditionalHeaders...)
+	if etag := h.conditional.Headers.Get("ETag"); etag != "" {
+		headers.Set("If-None-Match", etag)
+	}
+	if lastModified := h.conditional.Headers.Get("Last-Modified"); lastModified != "" {
+		headers.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// refreshNotModified updates the expired object with the headers of the 304
+// response to its conditional revalidation and extends its freshness, keeping
+// all of its parts. The refreshed object is stored in h.obj, which is left nil
+// if the object was purged or replaced in the meantime.
+func (h *reqHandler) refreshNotModified(rw *httputils.FlexibleResponseWriter) {
+	h.notModifiedUpstream = true
+	current, err := h.Cache.Storage.GetMetadata(h.objID)
+	if err != nil || current.ResponseTimestamp != h.conditional.ResponseTimestamp {
+		return
+	}
+
+	if cacheutils.ResponseIsNoStore(rw.Headers) {
+		h.Logger.Debugf("[%s] The object %s is not modified, but the response has no-store",
+			h.reqID, h.objID)
+		h.obj = current
+		return
+	}
+	if h.Cache.StoresPaused() {
+		h.Logger.Debugf("[%s] The object %s is not modified, but the cache zone is drained",
+			h.reqID, h.objID)
+		h.obj = current
+		return
+	}
+	var expiresIn = h.responseExpiresIn(rw.Headers)
+	if expiresIn < 0 {
+		h.Logger.Debugf("[%s] The object %s is not modified but expires in the past: %s",
+			h.reqID, h.objID, expiresIn)
+		h.obj = current
+		return
+	}
+
+	var now = time.Now()
+	var obj = *current
+	obj.Headers = make(http.Header)
+	httputils.CopyHeaders(current.Headers, obj.Headers)
+	httputils.CopyHeadersWithout(rw.Headers, obj.Headers, metadataHeadersToFilter...)
+	if rw.Headers.Get("Date") == "" {
+		obj.Headers.Set("Date", now.Format(http.TimeFormat))
+	}
+	obj.ResponseTimestamp = now.Unix() - cacheutils.ResponseAge(rw.Headers)
+	obj.ExpiresAt = now.Add(expiresIn).Unix()
+	obj.StaleWhileRevalidate = cacheutils.ResponseStaleWhileRevalidate(rw.Headers)
+	obj.Immutable = cacheutils.ResponseIsImmutable(rw.Headers)
+	if err := h.Cache.Storage.UpdateMetadata(&obj); os.IsNotExist(err) {
+		h.Logger.Debugf("[%s] The object %s was purged while it was revalidated",
+			h.reqID, h.objID)
+		return
+	} else if err != nil {
+		h.Logger.Errorf("[%s] Could not save the revalidated metadata for %s: %s",
+			h.reqID, h.objID, err)
+		h.obj = current
+		return
+	}
+
+	h.Logger.Debugf("[%s] The object %s is not modified, keeping its parts", h.reqID, h.objID)
+	h.obj = &obj
+	h.scheduleExpiration(expiresIn + h.retentionWindow(&obj))
+}
+
+// keepRevalidated checks the response to the revalidation of a stale object
+// and returns whether it should replace the object in the cache. On success
+// the stale object is removed. On server errors or if the stale object was
+// purged or replaced in the meantime, nothing is changed.
+func (h *reqHandler) keepRevalidated(rw *httputils.FlexibleResponseWriter) bool {
+	if rw.Code >= http.StatusInternalServerError {
+		h.Logger.Errorf("[%s] Revalidation of %s failed with %d, keeping the stale object",
+			h.reqID, h.objID, rw.Code)
+		h.revalidationFailed = true
+		return false
+	}
+
+	current, err := h.Cache.Storage.GetMetadata(h.objID)
+	if err != nil || current.ResponseTimestamp != h.revalidating.ResponseTimestamp {
+		h.Logger.Debugf("[%s] The stale object %s was purged or replaced while revalidating it",
+			h.reqID, h.objID)
+		return false
+	}
+
+	h.Logger.Debugf("[%s] Replacing the stale object %s with the revalidated one",
+		h.reqID, h.objID)
+	storage.GetExpirationHandler(h.Cache, h.objID)(h.Logger)
+	return true
+}
+
+// discardIfPurged discards the parts saved by the revalidation if the object
+// was purged while they were being saved.
+func (h *reqHandler) discardIfPurged() {
+	if _, err := h.Cache.Storage.GetMetadata(h.objID); !os.IsNotExist(err) {
+		return
+	}
+	if err := h.Cache.Storage.Discard(h.objID); err != nil && !os.IsNotExist(err) {
+		h.Logger.Errorf("[%s] Storage error when discarding of object's data: %s",
+			h.reqID, err)
+	}
+}
+
+// errObjectChanged is returned when the parts of a stored object can not be
+// completed from the upstream as it has a different version of the object.
+var errObjectChanged = errors.New("the object changed in the upstream")
+
+// validatorHeaders identify the version of an object
+var validatorHeaders = []string{"ETag", "Last-Modified"}
+
+// objectChanged returns whether an upstream response with the size and headers
+// is for a different version of the stored object. The parts of different
+// versions must never be mixed.
+func objectChanged(stored *types.ObjectMetadata, size uint64, headers http.Header) bool {
+	if stored.Size != size {
+		return true
+	}
+	for _, name := range validatorHeaders {
+		var old, current = stored.Headers.Get(name), headers.Get(name)
+		if old != "" && current != "" && old != current {
+			return true
+		}
+	}
+	return false
+}
+
+// discardIfChanged discards the stored object with all of its parts if obj is
+// a different version of it, before obj is saved in its place.
+func (h *reqHandler) discardIfChanged(obj *types.ObjectMetadata) {
+	stored, err := h.Cache.Storage.GetMetadata(h.objID)
+	if err != nil || !objectChanged(stored, obj.Size, obj.Headers) {
+		return
+	}
+	h.Logger.Logf("[%s] The object %s changed in the upstream from %d to %d bytes, "+
+		"discarding the stored version", h.reqID, h.objID, stored.Size, obj.Size)
+	storage.GetExpirationHandler(h.Cache, h.objID)(h.Logger)
+}
@@ -0,0 +1,841 @@
+package cache
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/upstream"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// revalidationUpstream is an upstream for testing the revalidation of stale
+// objects. It serves the current version of the object and counts the
+// requests, which can be blocked until they are released.
+type revalidationUpstream struct {
+	sync.Mutex
+	version  string
+	code     int
+	requests int
+	block    chan struct{}
+}
+
+func (u *revalidationUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.Lock()
+	u.requests++
+	var contents, code, block = u.version, u.code, u.block
+	u.Unlock()
+	if block != nil {
+		<-block
+	}
+	if code >= http.StatusInternalServerError {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=3600, stale-while-revalidate=30")
+	w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+	_, _ = w.Write([]byte(contents))
+}
+
+func (u *revalidationUpstream) set(version string, code int, block chan struct{}) {
+	u.Lock()
+	defer u.Unlock()
+	u.version, u.code, u.block = version, code, block
+}
+
+func (u *revalidationUpstream) count() int {
+	u.Lock()
+	defer u.Unlock()
+	return u.requests
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.MaxStale = 120
+	var up = &revalidationUpstream{version: "version 1"}
+	app.up.Handle("/swr", up)
+
+	req, err := http.NewRequest("GET", "http://example.com/swr", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(app.ctx)
+	var id = app.cacheHandler.NewObjectIDForRequest(req)
+
+	// expire makes the cached object expired for the provided time
+	var expire = func(ago time.Duration) {
+		obj, err := app.cacheHandler.Cache.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.ExpiresAt = time.Now().Add(-ago).Unix()
+		if err := app.cacheHandler.Cache.Storage.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var serve = func(expected string, warning int) {
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("Expected %q but got %d: %q", expected, rec.Code, rec.Body.String())
+		}
+		var warnings = strings.Join(rec.HeaderMap["Warning"], ", ")
+		if warning == 0 && warnings != "" {
+			t.Errorf("Expected no warnings for %q but got %q", expected, warnings)
+		} else if warning != 0 && !strings.HasPrefix(warnings, strconv.Itoa(warning)+" ") {
+			t.Errorf("Expected a %d warning for %q but got %q", warning, expected, warnings)
+		}
+	}
+	var waitForRevalidations = func() {
+		for i := 0; i < 200; i++ {
+			app.cacheHandler.revals.Lock()
+			var running = len(app.cacheHandler.revals.running)
+			app.cacheHandler.revals.Unlock()
+			if running == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("The revalidations did not finish")
+	}
+
+	serve("version 1", 0)
+
+	// the stale object is served while a single revalidation is made
+	expire(time.Second)
+	up.set("version 2", 0, make(chan struct{}))
+	for i := 0; i < 5; i++ {
+		serve("version 1", cacheutils.WarningResponseIsStale)
+	}
+	close(up.block)
+	waitForRevalidations()
+	if up.count() != 2 {
+		t.Errorf("Expected one revalidation request but there were %d", up.count()-1)
+	}
+	serve("version 2", 0)
+
+	// server errors during the revalidation keep the stale object
+	expire(time.Second)
+	up.set("version 3", http.StatusBadGateway, nil)
+	serve("version 2", cacheutils.WarningResponseIsStale)
+	waitForRevalidations()
+	// after stale-while-revalidate ends it is still served up to MaxStale
+	expire(time.Minute)
+	serve("version 2", cacheutils.WarningDisconnectedOperation)
+	waitForRevalidations()
+	expire(3 * time.Minute)
+	up.set("version 3", 0, nil)
+	serve("version 3", 0)
+
+	// the object is not stored when it is purged while revalidating it
+	expire(time.Second)
+	up.set("version 4", 0, make(chan struct{}))
+	serve("version 3", cacheutils.WarningResponseIsStale)
+	if err := app.cacheHandler.Cache.Storage.Discard(id); err != nil {
+		t.Fatal(err)
+	}
+	close(up.block)
+	waitForRevalidations()
+	if _, err := app.cacheHandler.Cache.Storage.GetMetadata(id); err == nil {
+		t.Error("Expected the purged object to not be stored by its revalidation")
+	}
+}
+
+// versionedUpstream serves the current version of an object with support for
+// ranges and an ETag which changes with the version. It counts the requests
+// and the 304 responses to them.
+type versionedUpstream struct {
+	sync.Mutex
+	version  int
+	contents string
+	// makes it respond like upstreams which do not support conditional
+	// requests
+	ignoreConditionals bool
+	// overrides the default Cache-Control of the responses
+	cacheControl string
+	requests     int
+	notModified  int
+}
+
+func (u *versionedUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.Lock()
+	var version, contents = u.version, u.contents
+	u.requests++
+	if u.ignoreConditionals {
+		r.Header.Del("If-None-Match")
+		r.Header.Del("If-Modified-Since")
+	} else if r.Header.Get("If-None-Match") == `"v`+strconv.Itoa(version)+`"` {
+		u.notModified++
+	}
+	var cacheControl = u.cacheControl
+	u.Unlock()
+	if cacheControl == "" {
+		cacheControl = "max-age=3600, stale-while-revalidate=30"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", `"v`+strconv.Itoa(version)+`"`)
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(contents))
+}
+
+func (u *versionedUpstream) set(version int, contents string) {
+	u.Lock()
+	defer u.Unlock()
+	u.version, u.contents = version, contents
+}
+
+func (u *versionedUpstream) counts() (requests, notModified int) {
+	u.Lock()
+	defer u.Unlock()
+	return u.requests, u.notModified
+}
+
+func TestObjectSizeChange(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var up = &versionedUpstream{}
+	app.up.Handle("/changing", up)
+	var cz = app.cacheHandler.Cache
+	var partSize = cz.Storage.PartSize()
+
+	req, err := http.NewRequest("GET", "http://example.com/changing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(app.ctx)
+	var id = app.cacheHandler.NewObjectIDForRequest(req)
+
+	var waitForBackground = func() {
+		for i := 0; i < 200; i++ {
+			if cz.InFlight() == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("The background requests did not finish")
+	}
+	// checkStored checks that only the parts of contents are stored
+	var checkStored = func(contents string) {
+		obj, err := cz.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Size != uint64(len(contents)) {
+			t.Errorf("Expected the stored size to be %d but it is %d", len(contents), obj.Size)
+		}
+		parts, err := cz.Storage.GetAvailableParts(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range parts {
+			var start = uint64(idx.Part) * partSize
+			if start >= uint64(len(contents)) {
+				t.Errorf("Part %d of the old version was not discarded", idx.Part)
+				continue
+			}
+			r, err := cz.Storage.GetPart(idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			_ = r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(contents[start:], string(b)) {
+				t.Errorf("Part %d is %q which is not from the current version", idx.Part, b)
+			}
+		}
+	}
+	var expire = func() {
+		obj, err := cz.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.ExpiresAt = time.Now().Add(-time.Second).Unix()
+		if err := cz.Storage.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var serve = func(expected string) {
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("Expected %q but got %d: %q", expected, rec.Code, rec.Body.String())
+		}
+	}
+
+	var v1, v2, v3 = strings.Repeat("a", 22), strings.Repeat("b", 37), strings.Repeat("c", 12)
+	up.set(1, v1)
+	serve(v1)
+	checkStored(v1)
+
+	// the revalidation returns a larger and then a smaller object
+	for i, contents := range []string{v2, v3} {
+		var previous = []string{v1, v2}[i]
+		expire()
+		up.set(i+2, contents)
+		serve(previous)
+		waitForBackground()
+		serve(contents)
+		checkStored(contents)
+	}
+
+	// a missing part of the stored object is requested after it changed
+	if err := cz.Storage.DiscardPart(&types.ObjectIndex{ObjID: id, Part: 1}); err != nil {
+		t.Fatal(err)
+	}
+	up.set(4, v2)
+	var rec = httptest.NewRecorder()
+	app.cacheHandler.ServeHTTP(rec, reqForRange("changing", 0, uint64(len(v3))).WithContext(app.ctx))
+	if strings.Contains(rec.Body.String(), "b") {
+		t.Errorf("The parts of two versions were mixed in the response %q", rec.Body)
+	}
+	waitForBackground()
+	serve(v2)
+	checkStored(v2)
+}
+
+func TestPartialRevalidation(t *testing.T) {
+	t.Parallel()
+	const v1, v2 = "0123456789abcdefghijABCDEFGHIJ", "9876543210jihgfedcbaJIHGFEDCBA"
+	var tests = []struct {
+		name    string
+		window  uint32
+		version string
+		kept    bool
+	}{
+		{name: "disabled", window: 0, version: v1, kept: false},
+		{name: "unchanged", window: 60, version: v1, kept: true},
+		{name: "changed", window: 60, version: v2, kept: false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			app := newTestApp(t)
+			defer app.cleanup()
+			app.cacheHandler.Settings.PartialRevalidation = test.window
+			var up = &versionedUpstream{ignoreConditionals: true}
+			app.up.Handle("/media", up)
+			var cz = app.cacheHandler.Cache
+			up.set(1, v1)
+
+			var first = reqForRange("media", 0, 5)
+			var id = app.cacheHandler.NewObjectIDForRequest(first)
+			app.testRequest(first, v1[:5], http.StatusPartialContent)
+
+			// the object expires after the stale-while-revalidate window
+			obj, err := cz.Storage.GetMetadata(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+			if err := cz.Storage.SaveMetadata(obj); err != nil {
+				t.Fatal(err)
+			}
+			if test.version != v1 {
+				up.set(2, test.version)
+			}
+
+			app.testRequest(reqForRange("media", 10, 5), test.version[10:15], http.StatusPartialContent)
+
+			obj, err = cz.Storage.GetMetadata(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj.ExpiresAt <= time.Now().Unix() {
+				t.Error("Expected the freshness of the object to be extended")
+			}
+			parts, err := cz.Storage.GetAvailableParts(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stored = make(map[uint32]bool)
+			for _, idx := range parts {
+				stored[idx.Part] = true
+			}
+			if !stored[2] {
+				t.Errorf("Expected the requested part to be stored, the stored parts are %v", parts)
+			}
+			if stored[0] != test.kept {
+				t.Errorf("Expected the first part to be kept=%t, the stored parts are %v", test.kept, parts)
+			}
+			if stored[0] && !cz.Algorithm.Lookup(&types.ObjectIndex{ObjID: id, Part: 0}) {
+				t.Error("The kept part is not in the cache algorithm")
+			}
+			if !stored[0] && cz.Algorithm.Lookup(&types.ObjectIndex{ObjID: id, Part: 0}) {
+				t.Error("The discarded part is still in the cache algorithm")
+			}
+			if stored[0] {
+				app.testRequest(reqForRange("media", 0, 15), test.version[:15], http.StatusPartialContent)
+			}
+		})
+	}
+}
+
+func TestConditionalRevalidation(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.ConditionalRevalidation = 60
+	const v1, v2 = "0123456789abcdefghijABCDEFGHIJ", "9876543210jihgfedcbaJIHGFEDCBA"
+	var up = &versionedUpstream{}
+	app.up.Handle("/cond", up)
+	up.set(1, v1)
+	var cz = app.cacheHandler.Cache
+
+	req, err := http.NewRequest("GET", "http://example.com/cond", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(app.ctx)
+	var id = app.cacheHandler.NewObjectIDForRequest(req)
+
+	var expire = func(ago time.Duration) {
+		obj, err := cz.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.ExpiresAt = time.Now().Add(-ago).Unix()
+		if err := cz.Storage.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var check = func(etag string, requests, notModified, parts int) {
+		if r, nm := up.counts(); r != requests || nm != notModified {
+			t.Errorf("Expected %d upstream requests with %d not modified but got %d with %d",
+				requests, notModified, r, nm)
+		}
+		obj, err := cz.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !utils.IsMetadataFresh(obj) || obj.Headers.Get("ETag") != etag {
+			t.Errorf("Expected fresh metadata with ETag %s but got %+v", etag, obj)
+		}
+		stored, err := cz.Storage.GetAvailableParts(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != parts {
+			t.Errorf("Expected %d stored parts but got %v", parts, stored)
+		}
+		if !cz.Scheduler.Contains(id.Hash()) {
+			t.Error("Expected the expiration of the object to be scheduled")
+		}
+	}
+
+	app.testRequest(req, v1, http.StatusOK)
+	check(`"v1"`, 1, 0, 6)
+	var h = &reqHandler{CachingProxy: app.cacheHandler}
+	if obj, _ := cz.Storage.GetMetadata(id); h.retentionWindow(obj) != time.Minute {
+		t.Errorf("Expected the object to be kept for a minute after it expires but it is for %s",
+			h.retentionWindow(obj))
+	}
+
+	// the parts are kept when the expired object is not modified
+	expire(time.Hour)
+	app.testRequest(req, v1, http.StatusOK)
+	check(`"v1"`, 2, 1, 6)
+	expire(time.Hour)
+	app.testRequest(reqForRange("cond", 10, 5).WithContext(app.ctx), v1[10:15], http.StatusPartialContent)
+	check(`"v1"`, 3, 2, 6)
+
+	// the object is replaced when it is modified
+	expire(time.Hour)
+	up.set(2, v2)
+	app.testRequest(req, v2, http.StatusOK)
+	check(`"v2"`, 4, 2, 6)
+
+	// the revalidations while serving stale objects are conditional too
+	expire(time.Second)
+	app.testRequest(req, v2, http.StatusOK)
+	for i := 0; i < 200; i++ {
+		if _, nm := up.counts(); nm == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	check(`"v2"`, 5, 3, 6)
+}
+
+func TestResponseCacheControl(t *testing.T) {
+	t.Parallel()
+	const contents = "0123456789abcdefghijABCDEFGHIJ"
+	for _, test := range []struct {
+		cacheControl            string
+		conditionalRevalidation uint32
+		cached                  bool
+		requests, notModified   int
+	}{
+		{cacheControl: "no-store", conditionalRevalidation: 60, requests: 2},
+		{cacheControl: "private, max-age=3600", conditionalRevalidation: 60, requests: 2},
+		// the responses which must always be revalidated are useless
+		// without conditional revalidation
+		{cacheControl: "no-cache", requests: 2},
+		{cacheControl: "no-cache", conditionalRevalidation: 60, cached: true, requests: 2, notModified: 1},
+		{cacheControl: "s-maxage=0, max-age=3600", conditionalRevalidation: 60, cached: true, requests: 2, notModified: 1},
+		{cacheControl: "s-maxage=3600, max-age=0", cached: true, requests: 1},
+	} {
+		app := newTestApp(t)
+		app.cacheHandler.Settings.ConditionalRevalidation = test.conditionalRevalidation
+		var up = &versionedUpstream{cacheControl: test.cacheControl}
+		up.set(1, contents)
+		app.up.Handle("/cc", up)
+
+		req, err := http.NewRequest("GET", "http://example.com/cc", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(app.ctx)
+		app.testRequest(req, contents, http.StatusOK)
+		app.testRequest(req, contents, http.StatusOK)
+
+		var id = app.cacheHandler.NewObjectIDForRequest(req)
+		_, err = app.cacheHandler.Cache.Storage.GetMetadata(id)
+		if cached := err == nil; cached != test.cached {
+			t.Errorf("Expected cached to be %t for %q but it is %t (%v)",
+				test.cached, test.cacheControl, cached, err)
+		}
+		if r, nm := up.counts(); r != test.requests || nm != test.notModified {
+			t.Errorf("Expected %d upstream requests with %d not modified for %q but got %d with %d",
+				test.requests, test.notModified, test.cacheControl, r, nm)
+		}
+		app.cleanup()
+	}
+}
+
+func TestImmutableObjects(t *testing.T) {
+	t.Parallel()
+	const contents = "0123456789abcdefghijABCDEFGHIJ"
+	for _, test := range []struct {
+		cacheControl   string
+		honorImmutable bool
+		requests       int
+	}{
+		{cacheControl: "max-age=3600, immutable", honorImmutable: true, requests: 1},
+		{cacheControl: "max-age=3600, immutable", requests: 3},
+		{cacheControl: "max-age=3600", honorImmutable: true, requests: 3},
+	} {
+		app := newTestApp(t)
+		app.cacheHandler.Settings.HonorImmutable = test.honorImmutable
+		var up = &versionedUpstream{cacheControl: test.cacheControl}
+		up.set(1, contents)
+		app.up.Handle("/immutable", up)
+
+		req, err := http.NewRequest("GET", "http://example.com/immutable", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(app.ctx)
+		app.testRequest(req, contents, http.StatusOK)
+		obj, err := app.cacheHandler.Cache.Storage.GetMetadata(app.cacheHandler.NewObjectIDForRequest(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.Immutable != strings.Contains(test.cacheControl, "immutable") {
+			t.Errorf("Expected the immutable flag to be stored for %q but got %+v", test.cacheControl, obj)
+		}
+
+		// the client asks for revalidations, e.g. when reloading a page
+		for _, cacheControl := range []string{"no-cache", "no-cache, max-age=0"} {
+			reload, err := http.NewRequest("GET", "http://example.com/immutable", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reload.Header.Set("Cache-Control", cacheControl)
+			app.testRequest(reload.WithContext(app.ctx), contents, http.StatusOK)
+		}
+		if r, nm := up.counts(); r != test.requests || nm != 0 {
+			t.Errorf("Expected %d upstream requests without conditional ones for %q (honored %t) but got %d with %d",
+				test.requests, test.cacheControl, test.honorImmutable, r, nm)
+		}
+		app.cleanup()
+	}
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.ConditionalRevalidation = 60
+	const contents = "0123456789"
+	var up = &versionedUpstream{}
+	app.up.Handle("/status", up)
+	up.set(1, contents)
+
+	req, err := http.NewRequest("GET", "http://example.com/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(app.ctx)
+	var id = app.cacheHandler.NewObjectIDForRequest(req)
+	var serve = func(expected string) {
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != contents {
+			t.Errorf("Unexpected response %d: %q", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != expected {
+			t.Errorf("Expected X-Cache %q but got %q", expected, got)
+		}
+	}
+
+	serve(types.CacheStatusMiss)
+	serve(types.CacheStatusHit)
+
+	obj, err := app.cacheHandler.Cache.Storage.GetMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	if err := app.cacheHandler.Cache.Storage.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	serve(types.CacheStatusRevalidated)
+
+	app.cacheHandler.Settings.CacheStatusZone = true
+	serve(types.CacheStatusHit + " from " + app.cacheHandler.Cache.ID)
+	app.cacheHandler.Settings.CacheStatusHeader = ""
+	serve("")
+}
+
+// retryingUpstream proxies the requests to the origin through a retry
+// transport, like the upstreams with retries do.
+type retryingUpstream struct {
+	origin    string
+	transport http.RoundTripper
+}
+
+func (u *retryingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var out = r.WithContext(r.Context())
+	out.URL, out.RequestURI = &url.URL{}, ""
+	*out.URL = *r.URL
+	out.URL.Scheme, out.URL.Host = "http", u.origin
+	resp, err := u.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	httputils.CopyHeaders(resp.Header, w.Header())
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func TestRequestBudget(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	const budget = 300 * time.Millisecond
+	app.cacheHandler.Settings.ConditionalRevalidation = 60
+	app.cacheHandler.Settings.RequestBudget = uint32(budget / time.Millisecond)
+	const contents = "0123456789abcdefghij"
+
+	var mode, attempts int32
+	const (
+		healthy = iota
+		failing
+		slow
+	)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		switch atomic.LoadInt32(&mode) {
+		case failing:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		case slow:
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.up.Handle("/budget/", &retryingUpstream{
+		origin: originURL.Host,
+		transport: upstream.NewRetryTransport(http.DefaultTransport, config.UpstreamSettings{
+			MaxRetries:      100,
+			RetryOnCodes:    []int{http.StatusServiceUnavailable},
+			RetryBackoff:    20,
+			RetryMaxBackoff: 20,
+		}),
+	})
+
+	var serve = func(path string, code int, expected string, warning int) {
+		req, err := http.NewRequest("GET", "http://example.com/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec = httptest.NewRecorder()
+		var start = time.Now()
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+		if elapsed := time.Since(start); elapsed > budget+200*time.Millisecond {
+			t.Errorf("Expected %s to be served within the budget of %s but it took %s",
+				path, budget, elapsed)
+		}
+		if rec.Code != code || code == http.StatusOK && rec.Body.String() != expected {
+			t.Errorf("Expected %d %q for %s but got %d %q", code, expected, path,
+				rec.Code, rec.Body.String())
+		}
+		var warnings = strings.Join(rec.HeaderMap["Warning"], ", ")
+		if warning != 0 && !strings.HasPrefix(warnings, strconv.Itoa(warning)+" ") {
+			t.Errorf("Expected a %d warning for %s but got %q", warning, path, warnings)
+		}
+	}
+	var expire = func(path string) {
+		req, err := http.NewRequest("GET", "http://example.com/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var id = app.cacheHandler.NewObjectIDForRequest(req)
+		obj, err := app.cacheHandler.Cache.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+		if err := app.cacheHandler.Cache.Storage.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serve("budget/object", http.StatusOK, contents, 0)
+
+	// the retries stop before the budget is spent and the expired object is
+	// served stale instead of the error
+	expire("budget/object")
+	atomic.StoreInt32(&mode, failing)
+	atomic.StoreInt32(&attempts, 0)
+	serve("budget/object", http.StatusOK, contents, cacheutils.WarningDisconnectedOperation)
+	if n := atomic.LoadInt32(&attempts); n < 2 {
+		t.Errorf("Expected the failed upstream request to be retried but it was made %d times", n)
+	}
+
+	// the upstream request is canceled when the budget is spent
+	atomic.StoreInt32(&mode, slow)
+	serve("budget/object", http.StatusOK, contents, cacheutils.WarningDisconnectedOperation)
+
+	// without an object to serve stale the client gets an error in time
+	serve("budget/missing", http.StatusGatewayTimeout, "", 0)
+	atomic.StoreInt32(&mode, failing)
+	serve("budget/missing", http.StatusGatewayTimeout, "", 0)
+
+	// the object is still revalidated once the upstream recovers
+	atomic.StoreInt32(&mode, healthy)
+	serve("budget/object", http.StatusOK, contents, 0)
+}
+
+func TestStaleIfError(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.StaleIfError = 120
+	app.cacheHandler.Settings.GroupHeader = "X-Group"
+	// the responses have no validators and can not be served stale without
+	// stale-if-error
+	var version, code int32 = 1, http.StatusOK
+	app.up.HandleFunc("/sie/", func(w http.ResponseWriter, r *http.Request) {
+		if c := int(atomic.LoadInt32(&code)); c != http.StatusOK {
+			http.Error(w, http.StatusText(c), c)
+			return
+		}
+		var contents = "version " + strconv.Itoa(int(atomic.LoadInt32(&version)))
+		w.Header().Set("X-Group", "sie")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		_, _ = w.Write([]byte(contents))
+	})
+
+	req, err := http.NewRequest("GET", "http://example.com/sie/object", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(app.ctx)
+	var cz = app.cacheHandler.Cache
+	var id = app.cacheHandler.NewObjectIDForRequest(req)
+
+	var expire = func(ago time.Duration) {
+		obj, err := cz.Storage.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj.ExpiresAt = time.Now().Add(-ago).Unix()
+		if err := cz.Storage.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var serve = func(expectedCode int, expected string, warning int) {
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req)
+		if rec.Code != expectedCode {
+			t.Errorf("Expected code %d but got %d: %q", expectedCode, rec.Code, rec.Body.String())
+			return
+		}
+		if expected != "" && rec.Body.String() != expected {
+			t.Errorf("Expected %q but got %q", expected, rec.Body.String())
+		}
+		var warnings = strings.Join(rec.HeaderMap["Warning"], ", ")
+		if warning == 0 && warnings != "" {
+			t.Errorf("Expected no warnings for %q but got %q", expected, warnings)
+		} else if warning != 0 && !strings.HasPrefix(warnings, strconv.Itoa(warning)+" ") {
+			t.Errorf("Expected a %d warning for %q but got %q", warning, expected, warnings)
+		}
+	}
+
+	serve(http.StatusOK, "version 1", 0)
+
+	// server errors are replaced by the expired object within the window
+	expire(time.Minute)
+	atomic.StoreInt32(&code, http.StatusServiceUnavailable)
+	serve(http.StatusOK, "version 1", cacheutils.WarningDisconnectedOperation)
+	serve(http.StatusOK, "version 1", cacheutils.WarningDisconnectedOperation)
+	if _, err := cz.Storage.GetMetadata(id); err != nil {
+		t.Errorf("Expected the expired object to be kept but got %s", err)
+	}
+
+	// the client errors of the upstream are not
+	atomic.StoreInt32(&code, http.StatusNotFound)
+	serve(http.StatusNotFound, "", 0)
+
+	// successful revalidations replace it
+	atomic.StoreInt32(&code, http.StatusOK)
+	atomic.StoreInt32(&version, 2)
+	serve(http.StatusOK, "version 2", 0)
+
+	// and it is not served after the window
+	expire(3 * time.Minute)
+	atomic.StoreInt32(&code, http.StatusBadGateway)
+	serve(http.StatusBadGateway, "", 0)
+
+	// nor after its group was purged
+	atomic.StoreInt32(&code, http.StatusOK)
+	serve(http.StatusOK, "version 2", 0)
+	expire(time.Minute)
+	atomic.StoreInt32(&code, http.StatusBadGateway)
+	cz.Groups.Invalidate("sie")
+	serve(http.StatusBadGateway, "", 0)
+}
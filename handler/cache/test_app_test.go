@@ -29,6 +29,7 @@ type testApp struct {
 	cacheHandler *CachingProxy
 	ctx          context.Context
 	fsmap        map[string]string
+	path         string
 	cleanup      func()
 }
 
@@ -121,6 +122,7 @@ func newTestAppFromMap(t testing.TB, fsmap map[string]string) *testApp {
 		Algorithm: ca,
 		Scheduler: storage.NewScheduler(loc.Logger),
 		Storage:   st,
+		Groups:    types.NewObjectGroups(),
 	}
 
 	cacheHandler, err := New(nil, loc, up)
@@ -133,6 +135,7 @@ func newTestAppFromMap(t testing.TB, fsmap map[string]string) *testApp {
 		ctx:          context.Background(),
 		cacheHandler: cacheHandler,
 		fsmap:        fsmap,
+		path:         path,
 		cleanup:      cleanup,
 	}
 	return app
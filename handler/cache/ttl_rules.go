@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+)
+
+// TTLRule sets for how long the matching objects are cached when the
+// upstream does not say it. The patterns are in the path.Match syntax. The
+// ones starting with a slash match the path as in CacheablePaths, the other
+// ones with a slash match the media type of the response, e.g. "image/*",
+// and the rest match the last element of the path, e.g. "*.m3u8".
+type TTLRule struct {
+	Pattern string `json:"pattern"`
+	// Duration is in seconds
+	Duration uint32 `json:"duration"`
+}
+
+// validateTTLRules returns an error if a pattern of the rules is malformed.
+func validateTTLRules(rules []TTLRule) error {
+	for _, rule := range rules {
+		if rule.Pattern == "" {
+			return fmt.Errorf("ttl rule with an empty pattern")
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid ttl rule pattern `%s`: %s", rule.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches returns whether the rule is for the response for the path.
+func (rule TTLRule) matches(urlPath string, headers http.Header) bool {
+	return matchesResponse(rule.Pattern, urlPath, headers)
+}
+
+// matchesResponse returns whether the pattern of a rule matches the response
+// with the headers for the path, as described in TTLRule.
+func matchesResponse(pattern, urlPath string, headers http.Header) bool {
+	switch {
+	case strings.HasPrefix(pattern, "/"):
+		return matchesPath([]string{pattern}, urlPath)
+	case strings.Contains(pattern, "/"):
+		mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		matched, _ := path.Match(pattern, mediaType)
+		return matched
+	default:
+		matched, _ := path.Match(pattern, path.Base(urlPath))
+		return matched
+	}
+}
+
+// defaultExpiresIn returns for how long the response is cached if it has no
+// expiration of its own. It is the duration of the first of
+// Settings.TTLRules which matches it or the CacheDefaultDuration of the
+// location.
+func (h *reqHandler) defaultExpiresIn(headers http.Header) time.Duration {
+	for _, rule := range h.Settings.TTLRules {
+		if rule.matches(h.req.URL.Path, headers) {
+			return time.Duration(rule.Duration) * time.Second
+		}
+	}
+	return h.CacheDefaultDuration
+}
+
+// responseExpiresIn returns in how long the response of the upstream expires.
+func (h *reqHandler) responseExpiresIn(headers http.Header) time.Duration {
+	return cacheutils.ResponseExpiresIn(headers, h.defaultExpiresIn(headers))
+}
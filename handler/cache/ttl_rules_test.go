@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTTLRuleMatches(t *testing.T) {
+	t.Parallel()
+	var headers = http.Header{"Content-Type": {"image/png; charset=binary"}}
+	for _, test := range []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"*.m3u8", "/live/stream.m3u8", true},
+		{"*.m3u8", "/live/stream.ts", false},
+		{"/live/*", "/live/hd/stream.ts", true},
+		{"/live/*", "/vod/stream.ts", false},
+		{"image/*", "/logo", true},
+		{"video/*", "/logo", false},
+	} {
+		if got := (TTLRule{Pattern: test.pattern}).matches(test.path, headers); got != test.matches {
+			t.Errorf("Expected the match of %s for %s to be %t", test.pattern, test.path, test.matches)
+		}
+	}
+	if (TTLRule{Pattern: "image/*"}).matches("/logo", http.Header{}) {
+		t.Error("Expected a content type rule to not match a response without a content type")
+	}
+	for _, rules := range [][]TTLRule{{{Pattern: ""}}, {{Pattern: "/live/[a-"}}} {
+		if err := validateTTLRules(rules); err == nil {
+			t.Errorf("Expected an error for the rules %v", rules)
+		}
+	}
+}
+
+func TestTTLRules(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.CacheDefaultDuration = time.Minute
+	app.cacheHandler.Settings.TTLRules = []TTLRule{
+		{Pattern: "*.m3u8", Duration: 2},
+		{Pattern: "/live/*", Duration: 3600},
+		{Pattern: "image/*", Duration: 86400},
+	}
+	var handler = func(contentType, cacheControl string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.Path)))
+			_, _ = w.Write([]byte(r.URL.Path))
+		}
+	}
+	app.up.Handle("/live/stream.m3u8", handler("application/vnd.apple.mpegurl", ""))
+	app.up.Handle("/live/segment.ts", handler("video/mp2t", ""))
+	app.up.Handle("/live/explicit.ts", handler("video/mp2t", "max-age=10"))
+	app.up.Handle("/logo.png", handler("image/png", ""))
+	app.up.Handle("/other", handler("text/plain", ""))
+
+	for path, expected := range map[string]time.Duration{
+		"/live/stream.m3u8": 2 * time.Second,
+		"/live/segment.ts":  time.Hour,
+		"/live/explicit.ts": 10 * time.Second,
+		"/logo.png":         24 * time.Hour,
+		"/other":            time.Minute,
+	} {
+		req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.testRequest(req.WithContext(app.ctx), path, http.StatusOK)
+		obj, err := app.cacheHandler.Cache.Storage.GetMetadata(app.cacheHandler.NewObjectIDForRequest(req))
+		if err != nil {
+			t.Fatalf("Expected %s to be cached but got %s", path, err)
+		}
+		var expiresIn = time.Until(time.Unix(obj.ExpiresAt, 0))
+		if expiresIn > expected || expiresIn < expected-2*time.Second {
+			t.Errorf("Expected %s to expire in %s but it expires in %s", path, expected, expiresIn)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"os"
+
+	"github.com/ironsmile/nedomi/storage"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// unknownLengthWriter stores responses whose size is not known in advance,
+// such as chunked ones without Content-Length. The body is written to
+// sequential parts as it is received, but the metadata is saved only after the
+// whole body was read successfully, so an interrupted response never looks
+// like a complete object. If the response is aborted the saved parts are
+// discarded.
+type unknownLengthWriter struct {
+	// the parts are saved with the context of the upstream request
+	ctx        context.Context
+	obj        *types.ObjectMetadata
+	cz         *types.CacheZone
+	resp       *httputils.FlexibleResponseWriter
+	partSize   uint64
+	size       uint64
+	buf        []byte
+	saved      []*types.ObjectIndex
+	failed     bool
+	onComplete func()
+}
+
+func newUnknownLengthWriter(ctx context.Context, cz *types.CacheZone, obj *types.ObjectMetadata,
+	resp *httputils.FlexibleResponseWriter, onComplete func()) *unknownLengthWriter {
+	return &unknownLengthWriter{
+		ctx:        ctx,
+		obj:        obj,
+		cz:         cz,
+		resp:       resp,
+		partSize:   cz.Storage.PartSize(),
+		onComplete: onComplete,
+	}
+}
+
+func (uw *unknownLengthWriter) Write(data []byte) (int, error) {
+	var written = len(data)
+	if uw.failed {
+		return written, nil
+	}
+	for len(data) > 0 {
+		if uw.buf == nil {
+			uw.buf = make([]byte, 0, uw.partSize)
+		}
+		var toWrite = umin(uw.partSize-uint64(len(uw.buf)), uint64(len(data)))
+		uw.buf = append(uw.buf, data[:toWrite]...)
+		data = data[toWrite:]
+		uw.size += toWrite
+		if uint64(len(uw.buf)) == uw.partSize {
+			if err := uw.flushBuffer(); err != nil {
+				uw.failed = true
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (uw *unknownLengthWriter) flushBuffer() error {
+	part := uint32((uw.size - uint64(len(uw.buf))) / uw.partSize)
+	idx := &types.ObjectIndex{ObjID: uw.obj.ID, Part: part}
+	defer func() { uw.buf = nil }()
+
+	if !uw.cz.Algorithm.ShouldKeep(idx) {
+		// without all the parts the object can not be served as the
+		// upstream probably does not support ranges for it
+		uw.failed = true
+		return nil
+	}
+	if err := storage.SavePartContext(uw.ctx, uw.cz.Storage, idx, bytes.NewBuffer(uw.buf)); err != nil {
+		return err
+	}
+	uw.saved = append(uw.saved, idx)
+	return nil
+}
+
+// Close saves the metadata of the object with its final size if the whole
+// response was received or discards everything that was saved otherwise.
+func (uw *unknownLengthWriter) Close() error {
+	if uw.resp.Aborted() != nil || uw.failed {
+		return uw.discard()
+	}
+	if len(uw.buf) > 0 {
+		if err := uw.flushBuffer(); err != nil {
+			return utils.NewCompositeError(err, uw.discard())
+		}
+		if uw.failed {
+			return uw.discard()
+		}
+	}
+
+	uw.obj.Size = uw.size
+	if err := uw.cz.Storage.SaveMetadata(uw.obj); err != nil {
+		return utils.NewCompositeError(err, uw.discard())
+	}
+	for _, idx := range uw.saved {
+		if err := uw.cz.Algorithm.AddObject(idx); err != nil && err != types.ErrAlreadyInCache {
+			return err
+		}
+	}
+	uw.onComplete()
+	return nil
+}
+
+func (uw *unknownLengthWriter) discard() error {
+	if len(uw.saved) == 0 {
+		return nil
+	}
+	if err := uw.cz.Storage.Discard(uw.obj.ID); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/handler/proxy"
+	"github.com/ironsmile/nedomi/upstream"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+// newChunkedTestApp returns a test app whose cache handler proxies to a real
+// http server which responds with the supplied raw chunks. If truncate is true
+// the server closes the connection before the final chunk.
+func newChunkedTestApp(t *testing.T, chunks []string, truncate bool) (*testApp, func()) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		writeChunked(buf, chunks, truncate)
+	}))
+
+	app := newTestApp(t)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := *app.cacheHandler.Location
+	if loc.Upstream, err = upstream.NewSimple(u); err != nil {
+		t.Fatal(err)
+	}
+	next, err := proxy.New(config.NewHandler("proxy", nil), &loc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.cacheHandler.next = next
+	return app, func() {
+		server.Close()
+		app.cleanup()
+	}
+}
+
+func writeChunked(buf *bufio.ReadWriter, chunks []string, truncate bool) {
+	fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n"+
+		"Cache-Control: max-age=3600\r\nConnection: close\r\n\r\n")
+	for _, chunk := range chunks {
+		fmt.Fprintf(buf, "%x\r\n%s\r\n", len(chunk), chunk)
+	}
+	if !truncate {
+		fmt.Fprintf(buf, "0\r\n\r\n")
+	} else {
+		fmt.Fprintf(buf, "%x\r\n%s", 100, "not all of it")
+	}
+	_ = buf.Flush()
+}
+
+func TestChunkedResponseIsStored(t *testing.T) {
+	t.Parallel()
+	var chunks = []string{
+		testutils.GenerateMeAString(1, 7),
+		testutils.GenerateMeAString(2, 13),
+		testutils.GenerateMeAString(3, 4),
+	}
+	var contents = chunks[0] + chunks[1] + chunks[2]
+	app, cleanup := newChunkedTestApp(t, chunks, false)
+	defer cleanup()
+
+	req, err := http.NewRequest("GET", "http://example.com/chunked", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/chunked"})
+	obj, err := app.cacheHandler.Cache.Storage.GetMetadata(objID)
+	if err != nil {
+		t.Fatalf("Expected the chunked response to be stored but got %s", err)
+	}
+	if obj.Size != uint64(len(contents)) {
+		t.Errorf("Expected the stored size to be %d but it is %d", len(contents), obj.Size)
+	}
+	parts, err := app.cacheHandler.Cache.Storage.GetAvailableParts(objID)
+	if err != nil || len(parts) != 5 {
+		t.Errorf("Expected 5 stored parts but got %d (%v)", len(parts), err)
+	}
+
+	// the upstream is not needed anymore
+	app.cacheHandler.next = http.NotFoundHandler()
+	app.testRequest(req.WithContext(app.ctx), contents, http.StatusOK)
+	app.fsmap["chunked"] = contents
+	app.testRange("chunked", 3, 10)
+}
+
+func TestTruncatedChunkedResponseIsNotStored(t *testing.T) {
+	t.Parallel()
+	var chunks = []string{
+		testutils.GenerateMeAString(4, 12),
+		testutils.GenerateMeAString(5, 6),
+	}
+	app, cleanup := newChunkedTestApp(t, chunks, true)
+	defer cleanup()
+
+	req, err := http.NewRequest("GET", "http://example.com/truncated", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec = httptest.NewRecorder()
+	app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+
+	var objID = app.cacheHandler.NewObjectIDForURL(&url.URL{Path: "/truncated"})
+	if _, err := app.cacheHandler.Cache.Storage.GetMetadata(objID); !os.IsNotExist(err) {
+		t.Errorf("Expected the truncated response not to be stored but got %v", err)
+	}
+	if parts, _ := app.cacheHandler.Cache.Storage.GetAvailableParts(objID); len(parts) != 0 {
+		t.Errorf("Expected no parts of the truncated response but got %d", len(parts))
+	}
+}
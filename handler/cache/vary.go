@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// The possible values of VarySettings.Unlisted
+const (
+	VaryUnlistedIgnore      = "ignore"
+	VaryUnlistedUncacheable = "uncacheable"
+)
+
+// VarySettings configures the handling of the Vary header of the upstream
+// responses, so that broad ones do not make the cache useless.
+type VarySettings struct {
+	// Headers are the request headers on which the cached objects may vary.
+	// Their normalized values are part of the cache key of every object in
+	// the location, so purging by URL does not purge the variants.
+	Headers []string `json:"headers"`
+
+	// Unlisted sets what happens with the responses which vary on other
+	// headers. With "ignore" they are cached as if they do not vary on them.
+	// With "uncacheable" they are not cached.
+	Unlisted string `json:"unlisted"`
+
+	// MaxHeaders is the number of headers a response may vary on and still
+	// be cached. Zero means no limit.
+	MaxHeaders int `json:"max_headers"`
+
+	// AcceptEncoding are the content encodings in which the upstream may
+	// respond, in the order of preference. When set, the Accept-Encoding of
+	// the client is collapsed to the most preferred of them which it
+	// accepts, or to identity, and that is sent to the upstream and is a
+	// part of the cache key. When empty, Accept-Encoding is never sent and
+	// only the identity is cached.
+	AcceptEncoding []string `json:"accept_encoding"`
+}
+
+// identityEncoding is the variant of the clients which accept none of the
+// encodings in VarySettings.AcceptEncoding
+const identityEncoding = "identity"
+
+// varyAlwaysIgnored are the headers which are never sent to the upstream by
+// the cache, so the responses can not vary on them.
+var varyAlwaysIgnored = map[string]bool{
+	"Accept-Encoding": true,
+	"Te":              true,
+}
+
+// normalizeVaryHeaders returns the sorted canonical names of the headers with
+// the duplicates removed.
+func normalizeVaryHeaders(names []string) []string {
+	var seen = make(map[string]bool, len(names))
+	var result = make([]string, 0, len(names))
+	for _, name := range names {
+		if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// parseVary returns the normalized names of the headers in the Vary fields.
+func parseVary(headers http.Header) []string {
+	var names []string
+	for _, value := range headers["Vary"] {
+		names = append(names, strings.Split(value, ",")...)
+	}
+	return normalizeVaryHeaders(names)
+}
+
+func validateVarySettings(s *VarySettings) error {
+	switch s.Unlisted {
+	case "":
+		s.Unlisted = VaryUnlistedIgnore
+	case VaryUnlistedIgnore, VaryUnlistedUncacheable:
+	default:
+		return fmt.Errorf("unknown vary unlisted policy `%s`", s.Unlisted)
+	}
+	if s.MaxHeaders < 0 {
+		return fmt.Errorf("vary max_headers must not be negative")
+	}
+	s.Headers = normalizeVaryHeaders(s.Headers)
+
+	var encodings = make([]string, 0, len(s.AcceptEncoding))
+	for _, encoding := range s.AcceptEncoding {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if encoding == "" || encoding == "*" || encoding == identityEncoding {
+			return fmt.Errorf("invalid vary accept_encoding `%s`", encoding)
+		}
+		encodings = append(encodings, encoding)
+	}
+	s.AcceptEncoding = encodings
+	return nil
+}
+
+// varyAllowsCaching returns whether a response with the headers may be cached
+// according to its Vary header and the settings.
+func (h *reqHandler) varyAllowsCaching(headers http.Header) bool {
+	var s = h.Settings.Vary
+	var count int
+	for _, name := range parseVary(headers) {
+		if name == "*" {
+			return false
+		}
+		if varyAlwaysIgnored[name] {
+			continue
+		}
+		count++
+		if i := sort.SearchStrings(s.Headers, name); i < len(s.Headers) && s.Headers[i] == name {
+			continue
+		}
+		if s.Unlisted == VaryUnlistedUncacheable {
+			h.Logger.Debugf("[%s] Response varies on the unlisted %s", h.reqID, name)
+			return false
+		}
+	}
+	if s.MaxHeaders > 0 && count > s.MaxHeaders {
+		h.Logger.Debugf("[%s] Response varies on %d headers, more than %d",
+			h.reqID, count, s.MaxHeaders)
+		return false
+	}
+	return true
+}
+
+// variantID returns the id of the variant of the object with the values of
+// the request headers on which the objects may vary.
+func (h *reqHandler) variantID(id *types.ObjectID) *types.ObjectID {
+	var headers = h.Settings.Vary.Headers
+	if len(headers) == 0 && len(h.Settings.Vary.AcceptEncoding) == 0 {
+		return id
+	}
+	var values = make([]string, 0, len(headers)+1)
+	for _, name := range headers {
+		values = append(values, name+"="+normalizeVaryValue(name, h.req.Header[name]))
+	}
+	if len(h.Settings.Vary.AcceptEncoding) != 0 {
+		values = append(values, "Accept-Encoding="+h.encodingVariant())
+	}
+	// fragments are never sent in requests, so this does not match any path
+	return types.NewObjectIDWithHash(id.CacheKey(), id.Path()+"#vary:"+strings.Join(values, "&"), id.HashFunc())
+}
+
+// caseInsensitiveVaryHeaders are the request headers whose values do not
+// depend on their case.
+var caseInsensitiveVaryHeaders = map[string]bool{
+	"Accept-Charset":  true,
+	"Accept-Encoding": true,
+	"Accept-Language": true,
+}
+
+// normalizeVaryValue joins the values of a request header without the
+// whitespace around the elements of their lists, so that equivalent requests
+// share a variant. The values of the headers which are case-insensitive are
+// lowercased too.
+func normalizeVaryValue(name string, values []string) string {
+	var parts []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	var joined = strings.Join(parts, ",")
+	if caseInsensitiveVaryHeaders[name] {
+		return strings.ToLower(joined)
+	}
+	return joined
+}
+
+// encodingVariant returns the canonical encoding for the Accept-Encoding of
+// the request, which is one of VarySettings.AcceptEncoding or identity.
+func (h *reqHandler) encodingVariant() string {
+	var acceptEncoding = strings.Join(h.req.Header["Accept-Encoding"], ",")
+	if encoding := httputils.PreferredEncoding(acceptEncoding, h.Settings.Vary.AcceptEncoding...); encoding != "" {
+		return encoding
+	}
+	return identityEncoding
+}
+
+// cacheableEncodings returns the content encoding in which the upstream was
+// asked to respond, if any, as only the responses in it can be cached.
+func (h *reqHandler) cacheableEncodings() []string {
+	if len(h.Settings.Vary.AcceptEncoding) == 0 {
+		return nil
+	}
+	if encoding := h.encodingVariant(); encoding != identityEncoding {
+		return []string{encoding}
+	}
+	return nil
+}
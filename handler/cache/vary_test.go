@@ -0,0 +1,341 @@
+package cache
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/handler/compress"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestVaryPolicy(t *testing.T) {
+	t.Parallel()
+	type request struct {
+		header, value, expected string
+	}
+	var tests = []struct {
+		name     string
+		settings VarySettings
+		vary     string
+		requests []request
+		upstream int32
+	}{
+		{
+			name: "unlisted headers are ignored by default",
+			vary: "User-Agent",
+			requests: []request{
+				{"User-Agent", "a", "a"},
+				{"User-Agent", "b", "a"},
+			},
+			upstream: 1,
+		},
+		{
+			name:     "unlisted headers make the response uncacheable",
+			settings: VarySettings{Unlisted: VaryUnlistedUncacheable},
+			vary:     "User-Agent",
+			requests: []request{
+				{"User-Agent", "a", "a"},
+				{"User-Agent", "b", "b"},
+				{"User-Agent", "a", "a"},
+			},
+			upstream: 3,
+		},
+		{
+			name:     "listed headers create variants",
+			settings: VarySettings{Headers: []string{"user-agent"}, Unlisted: VaryUnlistedUncacheable},
+			vary:     "user-agent, User-Agent",
+			requests: []request{
+				{"User-Agent", "a", "a"},
+				{"User-Agent", "b", "b"},
+				{"User-Agent", "a", "a"},
+				{"User-Agent", "b", "b"},
+			},
+			upstream: 2,
+		},
+		{
+			name:     "the values of the listed headers are normalized",
+			settings: VarySettings{Headers: []string{"Accept-Language"}},
+			vary:     "Accept-Language",
+			requests: []request{
+				{"Accept-Language", "en-US, fr;q=0.5", "en-US, fr;q=0.5"},
+				{"Accept-Language", "en-us,FR;q=0.5 ", "en-US, fr;q=0.5"},
+				{"Accept-Language", "de", "de"},
+			},
+			upstream: 2,
+		},
+		{
+			name:     "only the case-insensitive headers are lowercased",
+			settings: VarySettings{Headers: []string{"X-Token"}},
+			vary:     "X-Token",
+			requests: []request{
+				{"X-Token", "a b, c", "a b, c"},
+				{"X-Token", " a b,c", "a b, c"},
+				{"X-Token", "A b, c", "A b, c"},
+				{"X-Token", "a  b, c", "a  b, c"},
+			},
+			upstream: 3,
+		},
+		{
+			name:     "responses varying on too many headers are uncacheable",
+			settings: VarySettings{Headers: []string{"User-Agent", "Accept-Language"}, MaxHeaders: 1},
+			vary:     "User-Agent, Accept-Language",
+			requests: []request{
+				{"User-Agent", "a", "a"},
+				{"User-Agent", "a", "a"},
+			},
+			upstream: 2,
+		},
+		{
+			name:     "the encodings are never varied on",
+			settings: VarySettings{Unlisted: VaryUnlistedUncacheable, MaxHeaders: 1},
+			vary:     "Accept-Encoding, accept-encoding",
+			requests: []request{
+				{"User-Agent", "a", "a"},
+				{"User-Agent", "b", "a"},
+			},
+			upstream: 1,
+		},
+		{
+			name: "responses varying on everything are uncacheable",
+			vary: "*",
+			requests: []request{
+				{"User-Agent", "a", "a"},
+				{"User-Agent", "a", "a"},
+			},
+			upstream: 2,
+		},
+	}
+
+	for _, test := range tests {
+		var test = test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			app := newTestApp(t)
+			defer app.cleanup()
+			app.cacheHandler.Settings.Vary = test.settings
+			if err := validateVarySettings(&app.cacheHandler.Settings.Vary); err != nil {
+				t.Fatal(err)
+			}
+			var upstream int32
+			app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&upstream, 1)
+				var body = r.Header.Get(test.requests[0].header)
+				w.Header().Set("Vary", test.vary)
+				w.Header().Set("Cache-Control", "max-age=3600")
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				_, _ = w.Write([]byte(body))
+			})
+
+			for i, r := range test.requests {
+				req, err := http.NewRequest("GET", "http://example.com/vary", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header.Set(r.header, r.value)
+				var rec = httptest.NewRecorder()
+				app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+				if rec.Code != http.StatusOK || rec.Body.String() != r.expected {
+					t.Errorf("Request %d: expected %q but got %d %q", i, r.expected, rec.Code, rec.Body)
+				}
+			}
+			if upstream != test.upstream {
+				t.Errorf("Expected %d upstream requests but there were %d", test.upstream, upstream)
+			}
+		})
+	}
+}
+
+func TestVarySettings(t *testing.T) {
+	t.Parallel()
+	var s = VarySettings{Headers: []string{" user-agent", "Accept-Language", "User-Agent"}}
+	if err := validateVarySettings(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Unlisted != VaryUnlistedIgnore {
+		t.Errorf("Expected the default unlisted policy to be %q but it is %q", VaryUnlistedIgnore, s.Unlisted)
+	}
+	if len(s.Headers) != 2 || s.Headers[0] != "Accept-Language" || s.Headers[1] != "User-Agent" {
+		t.Errorf("Unexpected normalized headers %v", s.Headers)
+	}
+	for _, invalid := range []VarySettings{
+		{Unlisted: "sometimes"},
+		{MaxHeaders: -1},
+		{AcceptEncoding: []string{"gzip", "identity"}},
+		{AcceptEncoding: []string{" "}},
+	} {
+		if err := validateVarySettings(&invalid); err == nil {
+			t.Errorf("Expected an error for %+v", invalid)
+		}
+	}
+}
+
+func TestEncodingVariantKeys(t *testing.T) {
+	t.Parallel()
+	var s = VarySettings{AcceptEncoding: []string{" BR", "gzip"}}
+	if err := validateVarySettings(&s); err != nil {
+		t.Fatal(err)
+	}
+	var proxy = &CachingProxy{Settings: Settings{Vary: s}}
+	var id = types.NewObjectID("test", "/encoded")
+	var variantFor = func(acceptEncoding ...string) (string, string) {
+		req, err := http.NewRequest("GET", "http://example.com/encoded", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range acceptEncoding {
+			req.Header.Add("Accept-Encoding", value)
+		}
+		var h = &reqHandler{CachingProxy: proxy, req: req}
+		return h.encodingVariant(), h.variantID(id).Path()
+	}
+
+	for expected, headers := range map[string][][]string{
+		"br": {
+			{"gzip, deflate, br"},
+			{"br;q=1.0, gzip;q=0.8"},
+			{"BR"},
+			{"gzip", "br"},
+			{"*"},
+		},
+		"gzip": {
+			{"gzip"},
+			{"gzip, deflate"},
+			{"x-gzip"},
+			{"br;q=0.5, gzip"},
+			{"br;q=0, *"},
+		},
+		identityEncoding: {
+			{},
+			{"deflate"},
+			{"identity"},
+			{"br;q=0, gzip;q=0"},
+			{"*;q=0"},
+		},
+	} {
+		var _, expectedPath = variantFor(headers[0]...)
+		for _, values := range headers {
+			variant, path := variantFor(values...)
+			if variant != expected || path != expectedPath {
+				t.Errorf("Expected the %s variant %s for %q but got %s %s",
+					expected, expectedPath, values, variant, path)
+			}
+		}
+	}
+}
+
+func TestNormalizedEncodingVariants(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	app.cacheHandler.Settings.Vary = VarySettings{AcceptEncoding: []string{"br", "gzip"}}
+	if err := validateVarySettings(&app.cacheHandler.Settings.Vary); err != nil {
+		t.Fatal(err)
+	}
+	var upstream int32
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		// the upstream gets only the canonical encodings
+		var body = r.Header.Get("Accept-Encoding")
+		if body != "" {
+			w.Header().Set("Content-Encoding", body)
+		} else {
+			body = identityEncoding
+		}
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, _ = w.Write([]byte(body))
+	})
+
+	for i, test := range []struct{ acceptEncoding, expected string }{
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate", "gzip"},
+		{"", identityEncoding},
+		{"br;q=1.0, gzip;q=0.8", "br"},
+		{"deflate, gzip", "gzip"},
+		{"deflate", identityEncoding},
+	} {
+		req, err := http.NewRequest("GET", "http://example.com/encoded", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		var rec = httptest.NewRecorder()
+		app.cacheHandler.ServeHTTP(rec, req.WithContext(app.ctx))
+		if rec.Code != http.StatusOK || rec.Body.String() != test.expected {
+			t.Errorf("Request %d: expected %q but got %d %q", i, test.expected, rec.Code, rec.Body)
+		}
+	}
+	if upstream != 3 {
+		t.Errorf("Expected 3 upstream requests but there were %d", upstream)
+	}
+}
+
+func TestCompressedVariants(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var body = strings.Repeat("compressible ", 4)
+	var upstream int32
+	app.cacheHandler.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		if r.Header.Get("Accept-Encoding") != "" {
+			t.Errorf("Expected no Accept-Encoding in the upstream request but got %q",
+				r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, _ = w.Write([]byte(body))
+	})
+	// the compress handler is in front of the cache, which stores only the
+	// identity variant
+	c, err := compress.New(config.NewHandler("compress", json.RawMessage(`{"min_size": "0"}`)), nil, app.cacheHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, acceptEncoding := range []string{"gzip", "", "deflate", "gzip"} {
+		req, err := http.NewRequest("GET", "http://example.com/compressed", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		var rec = httptest.NewRecorder()
+		c.ServeHTTP(rec, req.WithContext(app.ctx))
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != acceptEncoding {
+			t.Errorf("Request %d: expected %q encoding but got %q", i, acceptEncoding, encoding)
+		}
+		var r io.Reader = rec.Body
+		switch acceptEncoding {
+		case "gzip":
+			r, err = gzip.NewReader(rec.Body)
+		case "deflate":
+			r, err = zlib.NewReader(rec.Body)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || string(b) != body {
+			t.Errorf("Request %d: unexpected body %q (%v)", i, b, err)
+		}
+	}
+	if upstream != 1 {
+		t.Errorf("Expected 1 upstream request but there were %d", upstream)
+	}
+}
@@ -0,0 +1,193 @@
+// Package compress compresses the responses of the next handler for the
+// clients which accept gzip or deflate content encodings.
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// Configuration is the struct the handler settings will be unmarshalled in
+type Configuration struct {
+	// MinSize is the minimum Content-Length of the compressed responses.
+	// Responses without Content-Length are always compressed.
+	MinSize types.BytesSize `json:"min_size"`
+	// ContentTypes are the media types of the compressed responses. They
+	// may end with a wildcard subtype, e.g. "text/*".
+	ContentTypes []string `json:"content_types"`
+	// Level is the compression level, from 1 (fastest) to 9 (best).
+	Level int `json:"level"`
+}
+
+func defaultConfiguration() Configuration {
+	return Configuration{
+		MinSize: 1024,
+		ContentTypes: []string{
+			"text/html", "text/plain", "text/css", "text/xml", "text/javascript",
+			"application/javascript", "application/json", "application/xml",
+			"image/svg+xml",
+		},
+		Level: gzip.DefaultCompression,
+	}
+}
+
+// compressedTypes are the media types which are already compressed, so they
+// are never compressed again even if they match ContentTypes.
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/zstd":             true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// compressedTypePrefixes are the top-level media types whose subtypes are
+// compressed, besides the ones in uncompressedSubtypes.
+var compressedTypePrefixes = []string{"image/", "video/", "audio/"}
+
+var uncompressedSubtypes = map[string]bool{
+	"image/svg+xml": true,
+	"image/bmp":     true,
+}
+
+// encoder is the compressing writer for a content encoding.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Compress is the handler which compresses the responses of the next one.
+type Compress struct {
+	next         http.Handler
+	minSize      uint64
+	contentTypes []string
+	// the encoders are reused as every one of them allocates large buffers
+	pools map[string]*sync.Pool
+}
+
+// New creates and returns a ready to use compress handler.
+func New(cfg *config.Handler, l *types.Location, next http.Handler) (*Compress, error) {
+	if next == nil {
+		return nil, types.NilNextHandler("compress")
+	}
+
+	var c = defaultConfiguration()
+	if len(cfg.Settings) != 0 {
+		if err := json.Unmarshal(cfg.Settings, &c); err != nil {
+			return nil, utils.ShowContextOfJSONError(err, cfg.Settings)
+		}
+	}
+	if c.Level != gzip.DefaultCompression && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+		return nil, fmt.Errorf("handler.compress has invalid level %d", c.Level)
+	}
+
+	var contentTypes = make([]string, len(c.ContentTypes))
+	for i, contentType := range c.ContentTypes {
+		contentTypes[i] = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return &Compress{
+		next:         next,
+		minSize:      c.MinSize.Bytes(),
+		contentTypes: contentTypes,
+		pools: map[string]*sync.Pool{
+			"gzip": {New: func() interface{} {
+				w, _ := gzip.NewWriterLevel(nil, c.Level)
+				return w
+			}},
+			"deflate": {New: func() interface{} {
+				w, _ := zlib.NewWriterLevel(nil, c.Level)
+				return w
+			}},
+		},
+	}, nil
+}
+
+// ServeHTTP compresses the response of the next handler if the client
+// accepts it and the response is compressible.
+func (c *Compress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var cw = &compressWriter{
+		ResponseWriter: w,
+		compress:       c,
+		encoding:       httputils.PreferredEncoding(r.Header.Get("Accept-Encoding"), "gzip", "deflate"),
+		head:           r.Method == "HEAD",
+	}
+	defer func() {
+		_ = cw.close()
+	}()
+	c.next.ServeHTTP(cw, r)
+}
+
+func (c *Compress) getEncoder(encoding string, w io.Writer) encoder {
+	var enc = c.pools[encoding].Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+func (c *Compress) putEncoder(encoding string, enc encoder) {
+	c.pools[encoding].Put(enc)
+}
+
+// compressible returns whether the response with these code and headers may
+// be compressed, regardless of the encodings accepted by the client.
+func (c *Compress) compressible(code int, headers http.Header) bool {
+	if code < 200 || code > 299 || code == http.StatusNoContent || code == http.StatusPartialContent {
+		return false
+	}
+	if ce := headers.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	if headers.Get("Content-Range") != "" {
+		return false
+	}
+	// RFC 7234 section 5.2.2.4
+	if strings.Contains(strings.ToLower(headers.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if cl := headers.Get("Content-Length"); cl != "" {
+		if length, err := strconv.ParseUint(cl, 10, 64); err == nil && length < c.minSize {
+			return false
+		}
+	}
+	return c.allowedType(headers.Get("Content-Type"))
+}
+
+func (c *Compress) allowedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if compressedTypes[mediaType] {
+		return false
+	}
+	for _, prefix := range compressedTypePrefixes {
+		if strings.HasPrefix(mediaType, prefix) && !uncompressedSubtypes[mediaType] {
+			return false
+		}
+	}
+	for _, allowed := range c.contentTypes {
+		if allowed == mediaType || allowed == "*/*" ||
+			strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
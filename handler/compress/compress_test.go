@@ -0,0 +1,200 @@
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+)
+
+var testBody = strings.Repeat("nedomi compresses this body ", 100)
+
+func newTestCompress(t *testing.T, settings string, next http.HandlerFunc) *Compress {
+	c, err := New(config.NewHandler("compress", json.RawMessage(settings)), nil, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// serving returns a handler which responds with the body and headers.
+func serving(code int, body string, headers map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for key, value := range headers {
+			w.Header().Set(key, value)
+		}
+		w.WriteHeader(code)
+		_, _ = io.WriteString(w, body)
+	}
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	var r io.Reader = rec.Body
+	var err error
+	switch rec.Header().Get("Content-Encoding") {
+	case "gzip":
+		r, err = gzip.NewReader(rec.Body)
+	case "deflate":
+		r, err = zlib.NewReader(rec.Body)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+	var html = map[string]string{
+		"Content-Type":   "text/html; charset=utf-8",
+		"Content-Length": strconv.Itoa(len(testBody)),
+		"ETag":           `"v1"`,
+	}
+	for i, test := range []struct {
+		settings       string
+		method         string
+		acceptEncoding string
+		code           int
+		headers        map[string]string
+		encoding       string
+		vary           bool
+	}{
+		{acceptEncoding: "gzip, deflate", headers: html, encoding: "gzip", vary: true},
+		{acceptEncoding: "deflate", headers: html, encoding: "deflate", vary: true},
+		{acceptEncoding: "gzip;q=0, deflate;q=0.5", headers: html, encoding: "deflate", vary: true},
+		{acceptEncoding: "*", headers: html, encoding: "gzip", vary: true},
+		{acceptEncoding: "br", headers: html, vary: true},
+		{headers: html, vary: true},
+		{method: "HEAD", acceptEncoding: "gzip", headers: html, encoding: "gzip", vary: true},
+		// too small
+		{settings: `{"min_size": "1m"}`, acceptEncoding: "gzip", headers: html},
+		// unknown length
+		{settings: `{"min_size": "1m"}`, acceptEncoding: "gzip",
+			headers: map[string]string{"Content-Type": "text/plain"}, encoding: "gzip", vary: true},
+		// not in the allowlist
+		{acceptEncoding: "gzip", headers: map[string]string{"Content-Type": "application/octet-stream"}},
+		{settings: `{"content_types": ["text/*"]}`, acceptEncoding: "gzip",
+			headers: map[string]string{"Content-Type": "text/csv"}, encoding: "gzip", vary: true},
+		{settings: `{"content_types": ["text/*"]}`, acceptEncoding: "gzip", headers: map[string]string{"Content-Type": "application/json"}},
+		// already compressed
+		{settings: `{"content_types": ["*/*"]}`, acceptEncoding: "gzip", headers: map[string]string{"Content-Type": "image/png"}},
+		{settings: `{"content_types": ["*/*"]}`, acceptEncoding: "gzip", headers: map[string]string{"Content-Type": "application/zip"}},
+		{acceptEncoding: "gzip", headers: map[string]string{"Content-Type": "text/html", "Content-Encoding": "br"}},
+		// not to be transformed
+		{acceptEncoding: "gzip", headers: map[string]string{"Content-Type": "text/html", "Cache-Control": "no-transform"}},
+		{acceptEncoding: "gzip", code: http.StatusPartialContent,
+			headers: map[string]string{"Content-Type": "text/html", "Content-Range": "bytes 0-9/100"}},
+		{acceptEncoding: "gzip", code: http.StatusNotFound, headers: html},
+	} {
+		var code = test.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		var settings = test.settings
+		if settings == "" {
+			settings = "{}"
+		}
+		var c = newTestCompress(t, settings, serving(code, testBody, test.headers))
+		req, err := http.NewRequest(test.method, "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		var rec = httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+
+		if rec.Code != code {
+			t.Errorf("%d: Expected code %d but got %d", i, code, rec.Code)
+		}
+		if encoding := rec.Header().Get("Content-Encoding"); test.encoding != "" && encoding != test.encoding {
+			t.Errorf("%d: Expected %s encoding but got %q", i, test.encoding, encoding)
+		} else if test.encoding == "" && encoding != test.headers["Content-Encoding"] {
+			t.Errorf("%d: Expected the response not to be compressed but it is %q", i, encoding)
+		}
+		if vary := rec.Header().Get("Vary") == "Accept-Encoding"; vary != test.vary {
+			t.Errorf("%d: Expected Vary: Accept-Encoding to be %t but the Vary is %q",
+				i, test.vary, rec.Header().Get("Vary"))
+		}
+		if test.encoding == "" {
+			if rec.Body.String() != testBody {
+				t.Errorf("%d: Expected the body to not be changed", i)
+			}
+			continue
+		}
+		if rec.Header().Get("Content-Length") != "" || rec.Header().Get("ETag") == `"v1"` {
+			t.Errorf("%d: Expected no Content-Length and a weak ETag but got %v", i, rec.Header())
+		}
+		if test.method == "HEAD" {
+			if rec.Body.Len() != 0 {
+				t.Errorf("%d: Expected no body for HEAD but got %q", i, rec.Body.String())
+			}
+		} else if body := decode(t, rec); body != testBody {
+			t.Errorf("%d: Expected the decompressed body to be the same but got %q", i, body)
+		}
+	}
+}
+
+func TestCompressedResponseFlushing(t *testing.T) {
+	t.Parallel()
+	var rec = httptest.NewRecorder()
+	var c = newTestCompress(t, `{}`, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "first chunk")
+		w.(http.Flusher).Flush()
+		if !rec.Flushed || rec.Body.Len() == 0 {
+			t.Error("Expected the first chunk to be flushed")
+		}
+		_, _ = io.WriteString(w, " and the rest")
+	})
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	c.ServeHTTP(rec, req)
+	if body := decode(t, rec); body != "first chunk and the rest" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestContentTypeDetection(t *testing.T) {
+	t.Parallel()
+	var c = newTestCompress(t, `{}`, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<html><body>"+testBody+"</body></html>")
+	})
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	var rec = httptest.NewRecorder()
+	c.ServeHTTP(rec, req)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected the detected HTML to be compressed but got %v", rec.Header())
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	t.Parallel()
+	var next = serving(http.StatusOK, "", nil)
+	if _, err := New(config.NewHandler("compress", json.RawMessage(`{"level": 10}`)), nil, next); err == nil {
+		t.Error("Expected an error for an invalid level")
+	}
+	if _, err := New(config.NewHandler("compress", json.RawMessage(`{}`)), nil, nil); err == nil {
+		t.Error("Expected an error without a next handler")
+	}
+}
@@ -0,0 +1,117 @@
+package compress
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// compressWriter decides whether to compress the response when its headers
+// are written and then compresses the body written to it.
+type compressWriter struct {
+	http.ResponseWriter
+	compress *Compress
+	// the encoding accepted by the client, empty if none is
+	encoding    string
+	head        bool
+	enc         encoder
+	compressing bool
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	var headers = w.Header()
+	if w.compress.compressible(code, headers) {
+		addVary(headers, "Accept-Encoding")
+		if w.encoding != "" {
+			headers.Set("Content-Encoding", w.encoding)
+			headers.Del("Content-Length")
+			// the ranges of the compressed body are not the ranges of the
+			// resource and the identity and compressed bodies differ
+			headers.Del("Accept-Ranges")
+			if etag := headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				headers.Set("ETag", "W/"+etag)
+			}
+			w.compressing = true
+			if !w.head {
+				w.enc = w.compress.getEncoder(w.encoding, w.ResponseWriter)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		// like net/http, so that the content type can be checked
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	} else if w.compressing {
+		// the response to HEAD has only the headers of the compressed one
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush writes the data compressed so far to the client, so that streamed
+// responses are not delayed by the compression.
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		if err := w.enc.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify and Abort are passed through, as the proxy handler relies on
+// them for aborting the upstream requests.
+
+func (w *compressWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+func (w *compressWriter) Abort(err error) {
+	if aborter, ok := w.ResponseWriter.(httputils.Aborter); ok {
+		aborter.Abort(err)
+	}
+}
+
+// close writes the end of the compressed body, if any.
+func (w *compressWriter) close() error {
+	if w.enc == nil {
+		return nil
+	}
+	var err = w.enc.Close()
+	w.compress.putEncoder(w.encoding, w.enc)
+	w.enc = nil
+	return err
+}
+
+// addVary adds the header name to the Vary header unless it is already there.
+func addVary(headers http.Header, name string) {
+	for _, value := range headers["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	headers.Add("Vary", name)
+}
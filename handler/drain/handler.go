@@ -0,0 +1,96 @@
+// Package drain contains the handler which puts cache zones in and out of a
+// drain state, e.g. for a maintenance of their disks.
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// modeOff is how DrainOff is shown and can be requested.
+const modeOff = "off"
+
+// Handler shows and changes the drain modes of the cache zones.
+type Handler struct {
+	logger types.Logger
+}
+
+type drainRequest struct {
+	Zone string `json:"zone"`
+	Mode string `json:"mode"`
+}
+
+// drainModes are the drain modes by zone IDs
+type drainModes map[string]string
+
+// ServeHTTP responds with the drain modes of all zones. POST requests change
+// the mode of a zone before that.
+func (dh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqID, _ := contexts.GetRequestID(r.Context())
+	//!TODO authentication
+	if r.Method != "GET" && r.Method != "POST" {
+		httputils.Error(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	cacheZones, ok := contexts.GetCacheZones(r.Context())
+	if !ok {
+		httputils.Error(w, http.StatusInternalServerError)
+		dh.logger.Errorf("[%s] no cache zones in context", reqID)
+		return
+	}
+
+	if r.Method == "POST" {
+		var dr drainRequest
+		if err := json.NewDecoder(r.Body).Decode(&dr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			dh.logger.Errorf("[%s] error on parsing request %s", reqID, err)
+			return
+		}
+		if err := dh.setMode(cacheZones, dr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dh.logger.Logf("[%s] The drain mode of cache zone %s is now %s", reqID, dr.Zone, dr.Mode)
+	}
+
+	var modes = make(drainModes, len(cacheZones))
+	for id, cz := range cacheZones {
+		if modes[id] = string(cz.DrainMode()); modes[id] == "" {
+			modes[id] = modeOff
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(modes); err != nil {
+		dh.logger.Errorf("[%s] error while encoding response %s", reqID, err)
+	}
+}
+
+func (dh *Handler) setMode(cacheZones map[string]*types.CacheZone, dr drainRequest) error {
+	cz, ok := cacheZones[dr.Zone]
+	if !ok {
+		return fmt.Errorf("no such cache zone `%s`", dr.Zone)
+	}
+	var mode = types.DrainMode(dr.Mode)
+	if dr.Mode == modeOff {
+		mode = types.DrainOff
+	}
+	if !mode.Valid() {
+		return fmt.Errorf("unknown drain mode `%s`", dr.Mode)
+	}
+	cz.SetDrainMode(mode)
+	return nil
+}
+
+// New creates and returns a ready to use drain handler.
+func New(cfg *config.Handler, l *types.Location, next http.Handler) (*Handler, error) {
+	return &Handler{
+		logger: l.Logger,
+	}, nil
+}
@@ -0,0 +1,55 @@
+package drain
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestDrainModes(t *testing.T) {
+	t.Parallel()
+	var zones = map[string]*types.CacheZone{"1": {ID: "1"}, "2": {ID: "2"}}
+	var ctx = contexts.NewCacheZonesContext(context.Background(), zones)
+	dh, err := New(config.NewHandler("drain", nil), &types.Location{Logger: mock.NewLogger()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var request = func(method, body string, code int, expected string) {
+		req, err := http.NewRequest(method, "http://example.com/drain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec = httptest.NewRecorder()
+		dh.ServeHTTP(rec, req.WithContext(ctx))
+		if rec.Code != code {
+			t.Errorf("Expected %d for %s %s but got %d: %s", code, method, body, rec.Code, rec.Body)
+		} else if expected != "" && strings.TrimSpace(rec.Body.String()) != expected {
+			t.Errorf("Expected %s for %s %s but got %s", expected, method, body, rec.Body)
+		}
+	}
+
+	request("GET", "", http.StatusOK, `{"1":"off","2":"off"}`)
+	request("POST", `{"zone": "2", "mode": "read-only"}`, http.StatusOK, `{"1":"off","2":"read-only"}`)
+	request("POST", `{"zone": "1", "mode": "frozen"}`, http.StatusOK, `{"1":"frozen","2":"read-only"}`)
+	if !zones["1"].EvictionPaused() || !zones["2"].StoresPaused() || zones["2"].EvictionPaused() {
+		t.Errorf("Unexpected states of the zones: %s, %s", zones["1"].DrainMode(), zones["2"].DrainMode())
+	}
+	request("POST", `{"zone": "1", "mode": "off"}`, http.StatusOK, `{"1":"off","2":"read-only"}`)
+	request("POST", `{"zone": "2", "mode": ""}`, http.StatusOK, `{"1":"off","2":"off"}`)
+
+	request("POST", `{"zone": "3", "mode": "frozen"}`, http.StatusBadRequest, "")
+	request("POST", `{"zone": "1", "mode": "melted"}`, http.StatusBadRequest, "")
+	request("POST", `not json`, http.StatusBadRequest, "")
+	request("DELETE", "", http.StatusMethodNotAllowed, "")
+	if zones["1"].StoresPaused() || zones["2"].StoresPaused() {
+		t.Error("Expected the invalid requests to not change the drain modes")
+	}
+}
@@ -29,6 +29,12 @@ func (hr *headersRewrite) rewrite(headers http.Header) {
 	}
 }
 
+// Rewrite removes, adds and then sets the headers according to the rules, in
+// the same way as the handler does.
+func Rewrite(headers http.Header, rules config.HeadersRewrite) {
+	(*headersRewrite)(&rules).rewrite(headers)
+}
+
 func addValues(headers http.Header, key string, values []string) {
 	for _, value := range values {
 		headers.Add(key, value)
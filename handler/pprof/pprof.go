@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/pprof"
-	"path"
+	"strings"
 
 	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
 	"github.com/ironsmile/nedomi/types"
 	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+	"github.com/ironsmile/nedomi/utils/netutils"
 )
 
 var prefixToHandler = map[string]http.HandlerFunc{
@@ -18,7 +21,15 @@ var prefixToHandler = map[string]http.HandlerFunc{
 	"symbol":  pprof.Symbol,
 }
 
-// New creates and returns a ready to used ServerStatusHandler.
+// Handler serves the runtime profiling data of net/http/pprof to the trusted
+// clients.
+type Handler struct {
+	logger  types.Logger
+	path    string
+	trusted netutils.IPNetworks
+}
+
+// New creates and returns a ready to used Handler.
 func New(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
 	var s = defaultSettings
 	if len(cfg.Settings) > 0 {
@@ -27,18 +38,52 @@ func New(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handle
 				utils.ShowContextOfJSONError(err, cfg.Settings))
 		}
 	}
-	var mux = http.NewServeMux()
-	mux.HandleFunc(s.Path, pprof.Index)
-	for prefix, handler := range prefixToHandler {
-		mux.HandleFunc(path.Join(s.Path, prefix), handler)
+	// the profiles may reveal too much to be served to anyone
+	if len(s.TrustedNetworks) == 0 {
+		return nil, fmt.Errorf("handler.pprof for %s needs at least one trusted network", l.Name)
+	}
+	trusted, err := netutils.ParseIPNetworks(s.TrustedNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("handler.pprof for %s has an invalid trusted network: %s", l.Name, err)
 	}
-	return mux, nil
+	if !strings.HasSuffix(s.Path, "/") {
+		s.Path += "/"
+	}
+	return &Handler{logger: l.Logger, path: s.Path, trusted: trusted}, nil
 }
 
 var defaultSettings = settings{
-	Path: "/debug/pprof/",
+	Path:            "/debug/pprof/",
+	TrustedNetworks: []string{"127.0.0.1", "::1"},
 }
 
 type settings struct {
 	Path string `json:"path"`
+	// TrustedNetworks contains the IP addresses and CIDR networks of the
+	// clients which may get the profiles
+	TrustedNetworks []string `json:"trusted_networks"`
+}
+
+// ServeHTTP serves the index of the profiles at the path of the handler and
+// the profiles under it, e.g. heap and goroutine.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.trusted.ContainsRemoteAddr(r.RemoteAddr) {
+		reqID, _ := contexts.GetRequestID(r.Context())
+		h.logger.Logf("[%s] Refusing the profiling data to untrusted %s", reqID, r.RemoteAddr)
+		httputils.Error(w, http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, h.path) {
+		httputils.Error(w, http.StatusNotFound)
+		return
+	}
+	// pprof.Index finds the profiles only under /debug/pprof/
+	var name = strings.TrimPrefix(r.URL.Path, h.path)
+	if name == "" {
+		pprof.Index(w, r)
+	} else if handler, ok := prefixToHandler[name]; ok {
+		handler(w, r)
+	} else {
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
 }
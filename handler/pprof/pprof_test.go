@@ -0,0 +1,47 @@
+package pprof
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestTrustedNetworks(t *testing.T) {
+	t.Parallel()
+	var loc = &types.Location{Name: "profiling", Logger: mock.NewLogger()}
+	var settings = `{"path": "/profiling", "trusted_networks": ["10.0.0.0/8", "::1"]}`
+	h, err := New(config.NewHandler("pprof", []byte(settings)), loc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var get = func(remoteAddr, path string, code int, expected string) {
+		var req = httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.RemoteAddr = remoteAddr
+		var rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("Expected %d for %s from %s but got %d", code, path, remoteAddr, rec.Code)
+		} else if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("Expected %q in the response for %s but got %q", expected, path, rec.Body)
+		}
+	}
+
+	get("10.1.2.3:1234", "/profiling/", http.StatusOK, "goroutine")
+	get("[::1]:1234", "/profiling/goroutine?debug=1", http.StatusOK, "goroutine profile")
+	get("10.1.2.3:1234", "/profiling/cmdline", http.StatusOK, "")
+	get("10.1.2.3:1234", "/profiling/nonexistent", http.StatusNotFound, "Unknown profile")
+	get("10.1.2.3:1234", "/other/", http.StatusNotFound, "")
+	get("192.168.1.1:1234", "/profiling/", http.StatusForbidden, "")
+
+	for _, settings := range []string{`{"trusted_networks": []}`, `{"trusted_networks": ["10.0.0.0/33"]}`} {
+		if _, err := New(config.NewHandler("pprof", []byte(settings)), loc, nil); err == nil {
+			t.Errorf("Expected an error for the settings %s", settings)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package preload contains the handler which warms up the cache zones by
+// fetching objects through the handlers of their locations, e.g. after a cold
+// restart.
+package preload
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// Handler fetches the requested URLs through the handlers of their locations,
+// so that they are stored in the cache zones of the locations.
+type Handler struct {
+	logger      types.Logger
+	concurrency int
+}
+
+// preloadResult has for every URL whether its object is in the cache after
+// the preload.
+type preloadResult map[string]bool
+
+// New creates and returns a ready to use Handler.
+func New(cfg *config.Handler, l *types.Location, next http.Handler) (*Handler, error) {
+	var s = defaultSettings
+	if len(cfg.Settings) > 0 {
+		if err := json.Unmarshal(cfg.Settings, &s); err != nil {
+			return nil, fmt.Errorf("error while parsing settings for handler.preload - %s",
+				utils.ShowContextOfJSONError(err, cfg.Settings))
+		}
+	}
+	if s.Concurrency < 1 {
+		return nil, fmt.Errorf("handler.preload for %s needs a positive concurrency, not %d",
+			l.Name, s.Concurrency)
+	}
+	return &Handler{logger: l.Logger, concurrency: s.Concurrency}, nil
+}
+
+var defaultSettings = settings{
+	Concurrency: 4,
+}
+
+type settings struct {
+	// Concurrency is the maximum number of URLs which are fetched at the
+	// same time.
+	Concurrency int `json:"concurrency"`
+}
+
+// ServeHTTP fetches the URLs in the body of a POST request and responds with
+// whether each of them was cached.
+func (ph *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqID, _ := contexts.GetRequestID(r.Context())
+	//!TODO authentication
+	if r.Method != "POST" {
+		httputils.Error(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	var urls config.StringSlice
+	if err := json.NewDecoder(r.Body).Decode(&urls); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		ph.logger.Errorf("[%s] error on parsing request %s", reqID, err)
+		return
+	}
+
+	var app, ok = contexts.GetApp(r.Context())
+	if !ok {
+		httputils.Error(w, http.StatusInternalServerError)
+		ph.logger.Errorf("[%s] no app in context", reqID)
+		return
+	}
+
+	var res = ph.preloadAll(r, app, urls)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		ph.logger.Errorf("[%s] error while encoding response %s", reqID, err)
+	}
+}
+
+// preloadAll preloads the URLs with up to ph.concurrency of them at the same
+// time.
+func (ph *Handler) preloadAll(r *http.Request, app types.App, urls []string) preloadResult {
+	var (
+		res     = make(preloadResult, len(urls))
+		seen    = make(map[string]bool, len(urls))
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		tickets = make(chan struct{}, ph.concurrency)
+	)
+	for i, uString := range urls {
+		if seen[uString] {
+			continue // the duplicates are preloaded once
+		}
+		seen[uString] = true
+		wg.Add(1)
+		tickets <- struct{}{}
+		go func(i int, uString string) {
+			defer wg.Done()
+			var cached = ph.preload(r, app, i, uString)
+			<-tickets
+			mu.Lock()
+			res[uString] = cached
+			mu.Unlock()
+		}(i, uString)
+	}
+	wg.Wait()
+	return res
+}
+
+// preload fetches the URL through the handler of its location, unless its
+// object is already cached and fresh, and returns whether it is cached.
+func (ph *Handler) preload(r *http.Request, app types.App, i int, uString string) bool {
+	var ctx, reqID = contexts.AppendToRequestID(r.Context(), []byte(fmt.Sprintf("->preload%d", i)))
+	var u, err = url.Parse(uString)
+	if err != nil || u.Host == "" {
+		ph.logger.Logf("[%s] got request to preload an invalid URL (%s)", reqID, uString)
+		return false
+	}
+	var location = app.GetLocationFor(u.Host, u.Path)
+	if location == nil || location.Cache == nil || location.Handler == nil {
+		ph.logger.Logf("[%s] got request to preload an object (%s) that is for a location without a cache zone",
+			reqID, uString)
+		return false
+	}
+	location.Cache.Acquire()
+	defer location.Cache.Release()
+
+	var oid = location.NewObjectIDForURL(u)
+	if isCachedAndFresh(location.Cache, oid) {
+		ph.logger.Debugf("[%s] %s is already cached", reqID, oid)
+		return true
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		ph.logger.Logf("[%s] could not create a request for %s - %s", reqID, uString, err)
+		return false
+	}
+	req = req.WithContext(ctx)
+	req.RemoteAddr = r.RemoteAddr
+	var rw = &discardingWriter{header: make(http.Header)}
+	location.Handler.ServeHTTP(rw, req)
+	if rw.code != http.StatusOK {
+		ph.logger.Logf("[%s] could not preload %s, the response was %d", reqID, uString, rw.code)
+		return false
+	}
+	if _, err := location.Cache.Storage.GetMetadata(oid); err != nil {
+		ph.logger.Logf("[%s] %s was not stored, it may not be cacheable - %s", reqID, uString, err)
+		return false
+	}
+	return true
+}
+
+// isCachedAndFresh returns whether the object is stored whole in the cache
+// zone and has not expired yet. The cached error responses are not counted.
+func isCachedAndFresh(cz *types.CacheZone, oid *types.ObjectID) bool {
+	obj, err := cz.Storage.GetMetadata(oid)
+	if err != nil || obj.Negative || !utils.IsMetadataFresh(obj) {
+		return false
+	}
+	var partSize = cz.Storage.PartSize()
+	for part := uint64(0); part*partSize < obj.Size; part++ {
+		if !cz.Algorithm.Lookup(&types.ObjectIndex{ObjID: oid, Part: uint32(part)}) {
+			return false
+		}
+	}
+	return true
+}
+
+// discardingWriter is the http.ResponseWriter for the preloading requests,
+// which keeps only the status of the response.
+type discardingWriter struct {
+	header http.Header
+	code   int
+}
+
+func (d *discardingWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardingWriter) WriteHeader(code int) {
+	if d.code == 0 {
+		d.code = code
+	}
+}
+
+func (d *discardingWriter) Write(p []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
@@ -0,0 +1,166 @@
+package preload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/storage/memory"
+	"github.com/ironsmile/nedomi/types"
+)
+
+type mockApp struct {
+	types.App
+	getLocationFor func(string, string) *types.Location
+}
+
+func (m *mockApp) GetLocationFor(host, path string) *types.Location {
+	return m.getLocationFor(host, path)
+}
+
+func TestPreload(t *testing.T) {
+	t.Parallel()
+	st, err := memory.New(&config.CacheZone{PartSize: 10}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cz = &types.CacheZone{
+		ID: "testZone",
+		Algorithm: mock.NewCacheAlgorithm(&mock.CacheAlgorithmRepliers{
+			Lookup: func(idx *types.ObjectIndex) bool {
+				_, err := st.GetPart(idx)
+				return err == nil
+			},
+		}),
+		Storage: st,
+	}
+	var loc = &types.Location{Name: "cached", Logger: mock.NewLogger(), CacheKey: "test", Cache: cz}
+
+	// the handler of the location caches everything but /uncacheable
+	var mu sync.Mutex
+	var fetched []string
+	var running, maxRunning int
+	loc.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		if running++; running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		case "/uncacheable":
+		default:
+			var id = loc.NewObjectIDForURL(r.URL)
+			if err := st.SaveMetadata(&types.ObjectMetadata{
+				ID: id, Code: http.StatusOK, Size: 10, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			}); err != nil {
+				t.Error(err)
+			}
+			if err := st.SavePart(&types.ObjectIndex{ObjID: id}, strings.NewReader("0123456789")); err != nil {
+				t.Error(err)
+			}
+		}
+		w.Write([]byte("0123456789"))
+	})
+	var app = &mockApp{getLocationFor: func(host, path string) *types.Location {
+		if host == "example.com" {
+			return loc
+		}
+		return nil
+	}}
+
+	// the first object is already cached and fresh
+	var cached = loc.NewObjectIDForURL(mustParseURL(t, "http://example.com/cached"))
+	if err := st.SaveMetadata(&types.ObjectMetadata{
+		ID: cached, Code: http.StatusOK, Size: 10, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SavePart(&types.ObjectIndex{ObjID: cached}, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := New(config.NewHandler("preload", []byte(`{"concurrency": 2}`)), &types.Location{Logger: mock.NewLogger()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body = `["http://example.com/cached", "http://example.com/1", "http://example.com/2",
+		"http://example.com/3", "http://example.com/3", "http://example.com/missing",
+		"http://example.com/uncacheable", "http://other.com/1", "/relative"]`
+	req := httptest.NewRequest("POST", "http://admin.example.com/preload", bytes.NewReader([]byte(body)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req.WithContext(contexts.NewAppContext(context.Background(), app)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 but got %d: %s", rec.Code, rec.Body)
+	}
+
+	var res preloadResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	var expected = preloadResult{
+		"http://example.com/cached": true, "http://example.com/1": true,
+		"http://example.com/2": true, "http://example.com/3": true,
+		"http://example.com/missing": false, "http://example.com/uncacheable": false,
+		"http://other.com/1": false, "/relative": false,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expected the result %v but got %v", expected, res)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetched) != 5 {
+		t.Errorf("Expected the cached and the duplicated URLs to be fetched once but got %v", fetched)
+	}
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 fetches at the same time but there were %d", maxRunning)
+	}
+}
+
+func TestPreloadSettings(t *testing.T) {
+	t.Parallel()
+	var loc = &types.Location{Name: "preload", Logger: mock.NewLogger()}
+	for _, settings := range []string{`{"concurrency": 0}`, `{"concurrency": "2"}`} {
+		if _, err := New(config.NewHandler("preload", []byte(settings)), loc, nil); err == nil {
+			t.Errorf("Expected an error for the settings %s", settings)
+		}
+	}
+
+	h, err := New(config.NewHandler("preload", nil), loc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/preload", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET requests but got %d", rec.Code)
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
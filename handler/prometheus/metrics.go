@@ -0,0 +1,127 @@
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ironsmile/nedomi/handler/status"
+)
+
+// The types of the metrics
+const (
+	counter = "counter"
+	gauge   = "gauge"
+)
+
+// metricsWriter writes metrics in the text format. After the first error
+// nothing more is written and the error is kept.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// metric writes the help and type of a metric which must be followed by its
+// samples.
+func (mw *metricsWriter) metric(name, metricType, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (mw *metricsWriter) sample(name string, value uint64) {
+	mw.printf("%s %d\n", name, value)
+}
+
+func (mw *metricsWriter) sampleWithLabels(name string, labels string, value uint64) {
+	mw.printf("%s{%s} %d\n", name, labels, value)
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label returns the label pair with the value escaped.
+func label(name, value string) string {
+	return name + `="` + labelValueEscaper.Replace(value) + `"`
+}
+
+func boolToUint(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// zoneMetrics are the metrics of a single cache zone, labeled with its id.
+var zoneMetrics = []struct {
+	name, metricType, help string
+	value                  func(zone status.ZoneStatistics) uint64
+}{
+	{"nedomi_cache_zone_requests_total", counter, "Requests for objects in the cache zone.",
+		func(z status.ZoneStatistics) uint64 { return z.Requests }},
+	{"nedomi_cache_zone_hits_total", counter, "Requests for objects found in the cache zone.",
+		func(z status.ZoneStatistics) uint64 { return z.Hits }},
+	{"nedomi_cache_zone_objects", gauge, "Parts of objects stored in the cache zone.",
+		func(z status.ZoneStatistics) uint64 { return z.Objects }},
+	{"nedomi_cache_zone_size_bytes", gauge, "Size of the objects stored in the cache zone.",
+		func(z status.ZoneStatistics) uint64 { return z.Size }},
+	{"nedomi_cache_zone_disk_usage_bytes", gauge, "Disk usage of the cache zone directory.",
+		func(z status.ZoneStatistics) uint64 { return z.DiskUsage }},
+	{"nedomi_cache_zone_in_flight", gauge, "Requests and background operations using the cache zone.",
+		func(z status.ZoneStatistics) uint64 { return z.InFlight }},
+	{"nedomi_cache_zone_reloading", gauge, "Whether the stored objects of the cache zone are still being loaded.",
+		func(z status.ZoneStatistics) uint64 { return boolToUint(z.Reloading) }},
+	{"nedomi_cache_zone_reloaded_objects_total", counter, "Stored objects loaded on start in the cache zone.",
+		func(z status.ZoneStatistics) uint64 { return z.ReloadedObjects }},
+	{"nedomi_cache_zone_reload_discarded_total", counter, "Stored objects discarded on start as expired in the cache zone.",
+		func(z status.ZoneStatistics) uint64 { return z.ReloadDiscarded }},
+}
+
+func writeMetrics(w io.Writer, stats status.Statistics) error {
+	var mw = &metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.metric("nedomi_requests_total", counter, "Requests received by the server.")
+	mw.sample("nedomi_requests_total", stats.Requests)
+	mw.metric("nedomi_responded_total", counter, "Requests to which the server responded.")
+	mw.sample("nedomi_responded_total", stats.Responded)
+	mw.metric("nedomi_not_configured_total", counter, "Requests for hosts or locations which are not configured.")
+	mw.sample("nedomi_not_configured_total", stats.NotConfigured)
+	mw.metric("nedomi_in_flight_requests", gauge, "Requests which are currently served.")
+	mw.sample("nedomi_in_flight_requests", stats.InFlight)
+	mw.metric("nedomi_goroutines", gauge, "Goroutines that currently exist.")
+	mw.sample("nedomi_goroutines", stats.Goroutines)
+	mw.metric("nedomi_cgo_calls_total", counter, "Calls to C made by the process.")
+	mw.sample("nedomi_cgo_calls_total", stats.CGOCalls)
+	mw.metric("nedomi_memory_used_bytes", gauge, "Memory used by the process.")
+	mw.sample("nedomi_memory_used_bytes", stats.Memory.Used)
+	mw.metric("nedomi_memory_limit_bytes", gauge, "Memory limit of the process.")
+	mw.sample("nedomi_memory_limit_bytes", stats.Memory.Limit)
+	mw.metric("nedomi_memory_degraded", gauge, "Whether the server is degraded because of memory pressure.")
+	mw.sample("nedomi_memory_degraded", boolToUint(stats.Memory.Degraded))
+	if !stats.Started.IsZero() {
+		mw.metric("nedomi_start_time_seconds", gauge, "Start time of the server since the unix epoch.")
+		mw.sample("nedomi_start_time_seconds", uint64(stats.Started.Unix()))
+	}
+	mw.metric("nedomi_build_info", gauge, "The version of the server.")
+	mw.sampleWithLabels("nedomi_build_info", strings.Join([]string{
+		label("version", stats.Version.Version),
+		label("git_hash", stats.Version.GitHash),
+		label("git_tag", stats.Version.GitTag),
+	}, ","), 1)
+
+	for _, m := range zoneMetrics {
+		mw.metric(m.name, m.metricType, m.help)
+		for _, zone := range stats.CacheZones {
+			mw.sampleWithLabels(m.name, label("zone", zone.ID), m.value(zone))
+		}
+	}
+
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
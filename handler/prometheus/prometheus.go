@@ -0,0 +1,77 @@
+// Package prometheus exposes the statistics of the status page in the
+// Prometheus text exposition format.
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/handler/status"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// contentType is the content type of the version 0.0.4 of the text format
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves the metrics.
+type Handler struct {
+	loc  *types.Location
+	path string
+}
+
+// New creates and returns a ready to use Handler.
+func New(cfg *config.Handler, l *types.Location, next http.Handler) (*Handler, error) {
+	var s = defaultSettings
+	if len(cfg.Settings) > 0 {
+		if err := json.Unmarshal(cfg.Settings, &s); err != nil {
+			return nil, fmt.Errorf("error while parsing settings for handler.prometheus - %s",
+				utils.ShowContextOfJSONError(err, cfg.Settings))
+		}
+	}
+	if s.Path == "" {
+		return nil, fmt.Errorf("handler.prometheus for %s needs a path", l.Name)
+	}
+
+	return &Handler{loc: l, path: s.Path}, nil
+}
+
+var defaultSettings = settings{
+	Path: "/metrics",
+}
+
+type settings struct {
+	Path string `json:"path"`
+}
+
+// ServeHTTP writes the metrics for requests to the configured path.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	reqID, _ := contexts.GetRequestID(r.Context())
+	app, ok := contexts.GetApp(r.Context())
+	if !ok {
+		h.loc.Logger.Errorf("[%s] could not get the App from the context", reqID)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+	cacheZones, ok := contexts.GetCacheZones(r.Context())
+	if !ok {
+		h.loc.Logger.Errorf("[%s] could not get the cache zones from the context", reqID)
+		http.Error(w, http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if err := writeMetrics(w, status.NewStatistics(app, cacheZones)); err != nil {
+		h.loc.Logger.Errorf("[%s] error while writing the metrics: %s", reqID, err)
+	}
+}
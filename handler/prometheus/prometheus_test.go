@@ -0,0 +1,123 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/cache/lru"
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+type fakeApp struct {
+	types.App
+}
+
+func (a *fakeApp) Stats() types.AppStats {
+	return types.AppStats{Requests: 10, Responded: 7, NotConfigured: 1}
+}
+
+func (a *fakeApp) MemoryStats() types.MemoryStats {
+	return types.MemoryStats{Used: 100, Limit: 1000}
+}
+
+func (a *fakeApp) UpstreamsHealth() map[string][]types.UpstreamAddressHealth {
+	return nil
+}
+func (a *fakeApp) UpstreamsConnections() map[string][]types.UpstreamAddressConnections {
+	return nil
+}
+func (a *fakeApp) UpstreamsLatency() map[string]types.UpstreamLatency {
+	return nil
+}
+
+func (a *fakeApp) Started() time.Time { return time.Unix(1500000000, 0) }
+
+func (a *fakeApp) Version() types.AppVersion {
+	return types.AppVersion{Version: `v1 "quoted"`, GitHash: "abc"}
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	var cz = &config.CacheZone{ID: "zone", Path: "zone\\1", StorageObjects: 10, PartSize: 10}
+	var zone = &types.CacheZone{ID: cz.ID, Algorithm: lru.New(cz, nil, mock.NewLogger())}
+	var idx = &types.ObjectIndex{ObjID: types.NewObjectID("k", "/p")}
+	zone.Algorithm.Lookup(idx)
+	if err := zone.Algorithm.AddObject(idx); err != nil {
+		t.Fatal(err)
+	}
+	zone.Algorithm.Lookup(idx)
+	zone.Acquire()
+	defer zone.Release()
+	zone.SetReloading(true)
+	zone.AddReloaded()
+	zone.AddReloaded()
+	zone.AddReloadDiscarded()
+
+	handler, err := New(config.NewHandler("prometheus", json.RawMessage(`{"path": "/stats"}`)),
+		&types.Location{Name: "test", Logger: mock.NewLogger()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx = contexts.NewAppContext(context.Background(), &fakeApp{})
+	ctx = contexts.NewCacheZonesContext(ctx, map[string]*types.CacheZone{zone.ID: zone})
+	req, err := http.NewRequest("GET", "http://example.com/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != contentType {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+
+	var body = rec.Body.String()
+	for _, expected := range []string{
+		"# TYPE nedomi_requests_total counter\nnedomi_requests_total 10\n",
+		"# TYPE nedomi_responded_total counter\nnedomi_responded_total 7\n",
+		"nedomi_not_configured_total 1\n",
+		"# TYPE nedomi_in_flight_requests gauge\nnedomi_in_flight_requests 2\n",
+		"# TYPE nedomi_goroutines gauge\n",
+		"# TYPE nedomi_cgo_calls_total counter\n",
+		"nedomi_memory_used_bytes 100\n",
+		"nedomi_memory_limit_bytes 1000\n",
+		"nedomi_memory_degraded 0\n",
+		"nedomi_start_time_seconds 1500000000\n",
+		`nedomi_build_info{version="v1 \"quoted\"",git_hash="abc",git_tag=""} 1` + "\n",
+		"# TYPE nedomi_cache_zone_requests_total counter\n" +
+			`nedomi_cache_zone_requests_total{zone="zone\\1"} 2` + "\n",
+		`nedomi_cache_zone_hits_total{zone="zone\\1"} 1` + "\n",
+		"# TYPE nedomi_cache_zone_objects gauge\n" +
+			`nedomi_cache_zone_objects{zone="zone\\1"} 1` + "\n",
+		`nedomi_cache_zone_size_bytes{zone="zone\\1"} 10` + "\n",
+		`nedomi_cache_zone_in_flight{zone="zone\\1"} 1` + "\n",
+		`nedomi_cache_zone_reloading{zone="zone\\1"} 1` + "\n",
+		`nedomi_cache_zone_reloaded_objects_total{zone="zone\\1"} 2` + "\n",
+		`nedomi_cache_zone_reload_discarded_total{zone="zone\\1"} 1` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected the metrics to contain %q but they were:\n%s", expected, body)
+		}
+	}
+
+	req, err = http.NewRequest("GET", "http://example.com/other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for other paths but got %d", rec.Code)
+	}
+}
@@ -207,7 +207,7 @@ func TestBasichAuthenticateParsedFromConfig(t *testing.T) {
 
 	json.Unmarshal([]byte(upstreamConfigString), &cfgUp)
 
-	up, err := upstream.New(&cfgUp, mock.NewLogger())
+	up, err := upstream.New(context.Background(), &cfgUp, mock.NewLogger())
 
 	if err != nil {
 		t.Fatalf("Failed to create upstream: %s", err)
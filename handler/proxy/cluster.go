@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/netutils"
+)
+
+// The values of ClusterSettings.Scope
+const (
+	// CoalescingNode makes every node fetch its misses from the upstream
+	CoalescingNode = "node"
+	// CoalescingCluster makes every node fetch its misses from the node which
+	// owns the object, so that only it contacts the upstream
+	CoalescingCluster = "cluster"
+)
+
+// clusterHopHeader marks the requests which were forwarded by another node of
+// the cluster. They are always sent to the upstream, so that nodes which do
+// not agree on the owner of an object do not forward requests in a loop. It
+// is removed from the requests which do not come from the trusted peers.
+const clusterHopHeader = "X-Nedomi-Cluster-Hop"
+
+// ClusterSettings configures the coalescing of the upstream requests for the
+// same object between the nodes of a cluster.
+type ClusterSettings struct {
+	// Scope is "node" (the default) or "cluster".
+	Scope string `json:"scope"`
+	// Peers is the id of the upstream which contains all nodes of the
+	// cluster, including this one. It should use a consistent hashing
+	// balancing so that all nodes choose the same owner for an object.
+	Peers string `json:"peers"`
+	// Self is the address of this node as it is in Peers.
+	Self string `json:"self"`
+	// TrustedPeers are the IP addresses and CIDR networks of the nodes of
+	// the cluster. Only the requests from them are recognized as forwarded
+	// by another node, as anyone could send the header.
+	TrustedPeers []string `json:"trusted_peers"`
+}
+
+// parseClusterSettings validates the settings and returns the host of this
+// node, which is empty when the scope is not the cluster, and the networks of
+// the trusted peers.
+func parseClusterSettings(s ClusterSettings) (string, netutils.IPNetworks, error) {
+	switch s.Scope {
+	case "", CoalescingNode:
+		return "", nil, nil
+	case CoalescingCluster:
+	default:
+		return "", nil, fmt.Errorf("unknown cluster scope `%s`", s.Scope)
+	}
+	if s.Peers == "" || s.Self == "" || len(s.TrustedPeers) == 0 {
+		return "", nil, fmt.Errorf("cluster scope needs the peers upstream, the self address and the trusted peers")
+	}
+	self, err := url.Parse(s.Self)
+	if err != nil || self.Host == "" {
+		return "", nil, fmt.Errorf("invalid cluster self address `%s`", s.Self)
+	}
+	trusted, err := netutils.ParseIPNetworks(s.TrustedPeers)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid cluster trusted peers: %s", err)
+	}
+	return self.Host, trusted, nil
+}
+
+// ownerPeer returns the upstream for the node which owns the requested object
+// if it is not this one and the request should be forwarded to it.
+func (p *ReverseProxy) ownerPeer(reqID types.RequestID, req *http.Request) types.Upstream {
+	if p.clusterSelf == "" || (req.Method != "GET" && req.Method != "HEAD") {
+		return nil
+	}
+	if req.Header.Get(clusterHopHeader) != "" {
+		if p.clusterPeers.ContainsRemoteAddr(req.RemoteAddr) {
+			return nil
+		}
+		p.Logger.Debugf("[%s] Ignoring the cluster hop header from %s which is not a trusted peer",
+			reqID, req.RemoteAddr)
+		req.Header.Del(clusterHopHeader)
+	}
+
+	peers := getUpstreamFromContext(req.Context(), p.Settings.Cluster.Peers)
+	if peers == nil {
+		p.Logger.Errorf("[%s] Proxy was configured with cluster peers %s but no such upstream exist",
+			reqID, p.Settings.Cluster.Peers)
+		return nil
+	}
+	owner, err := peers.GetAddress(p.Settings.UpstreamHashPrefix + req.URL.Path)
+	if err != nil {
+		p.Logger.Errorf("[%s] Proxy could not get the owner of %s from the cluster: %v",
+			reqID, req.URL.Path, err)
+		return nil
+	}
+	if owner.OriginalURL.Host == p.clusterSelf {
+		return nil
+	}
+	// the address is pinned, in case the balancing is not deterministic
+	return pinnedUpstream{Upstream: peers, address: owner}
+}
+
+// doPeerRequest forwards the request to the peer which owns the object. The
+// original host is kept, so that the peer serves it from the same location.
+func (p *ReverseProxy) doPeerRequest(reqID types.RequestID, rw http.ResponseWriter,
+	req *http.Request, peer types.Upstream) (*http.Response, error) {
+	outreq, err := p.getOutRequest(reqID, rw, req, peer)
+	if err != nil {
+		return nil, err
+	}
+	if outreq.Host = req.Host; outreq.Host == "" {
+		outreq.Host = req.URL.Host
+	}
+	outreq.Header.Set(clusterHopHeader, "1")
+
+	return peer.Do(outreq)
+}
+
+type pinnedUpstream struct {
+	types.Upstream
+	address *types.UpstreamAddress
+}
+
+func (u pinnedUpstream) GetAddress(string) (*types.UpstreamAddress, error) {
+	return u.address, nil
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/cache"
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	cachehandler "github.com/ironsmile/nedomi/handler/cache"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/storage"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/upstream"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+type clusterApp struct {
+	mockApp
+}
+
+func (a *clusterApp) MemoryStats() types.MemoryStats { return types.MemoryStats{} }
+
+// newClusterNode returns the handler of a caching node which coalesces its
+// upstream requests with the peers.
+func newClusterNode(t *testing.T, self string, origin, peers types.Upstream) (http.Handler, func()) {
+	path, cleanup := testutils.GetTestFolder(t)
+	var logger = mock.NewLogger()
+	var cz = &config.CacheZone{
+		ID:             "zone",
+		Type:           "disk",
+		Path:           path,
+		StorageObjects: 100,
+		Algorithm:      "lru",
+		PartSize:       10,
+	}
+	st, err := storage.New(cz, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := cache.New(cz, st.DiscardPart, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loc = &types.Location{
+		Name:                 "cluster",
+		Logger:               logger,
+		Upstream:             origin,
+		CacheKey:             "cluster",
+		CacheDefaultDuration: time.Hour,
+		Cache: &types.CacheZone{
+			ID:        cz.ID,
+			PartSize:  cz.PartSize,
+			Algorithm: ca,
+			Scheduler: storage.NewScheduler(logger),
+			Storage:   st,
+			Groups:    types.NewObjectGroups(),
+		},
+	}
+
+	proxy, err := New(config.NewHandler("proxy", json.RawMessage(fmt.Sprintf(
+		`{"cluster": {"scope": "cluster", "peers": "peers", "self": %q, "trusted_peers": ["127.0.0.1"]}}`, self))), loc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheHandler, err := cachehandler.New(nil, loc, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var app = &clusterApp{mockApp{upstreams: map[string]types.Upstream{"peers": peers}}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheHandler.ServeHTTP(w, r.WithContext(contexts.NewAppContext(r.Context(), app)))
+	}), cleanup
+}
+
+func TestClusterCoalescing(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var originRequests = make(map[string]int)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(clusterHopHeader) != "" {
+			t.Errorf("The cluster hop header was sent to the origin for %s", r.URL.Path)
+		}
+		mu.Lock()
+		originRequests[r.URL.Path]++
+		mu.Unlock()
+		var body = "contents of " + r.URL.Path
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		fmt.Fprint(w, body)
+	}))
+	defer origin.Close()
+	originURL, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originUp, err := upstream.NewSimple(originURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the servers are started before the nodes, which need their addresses
+	var nodes [2]http.Handler
+	var servers [2]*httptest.Server
+	var peersConfig = &config.Upstream{ID: "peers", Balancing: "ketama"}
+	for i := range servers {
+		var i = i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nodes[i].ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+		serverURL, err := url.Parse(servers[i].URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peersConfig.Addresses = append(peersConfig.Addresses,
+			config.UpstreamAddress{URL: serverURL, Weight: 1})
+	}
+	peers, err := upstream.New(context.Background(), peersConfig, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range nodes {
+		var cleanup func()
+		nodes[i], cleanup = newClusterNode(t, servers[i].URL, originUp, peers)
+		defer cleanup()
+	}
+
+	// every node gets every hot object, but the origin is contacted once
+	var owners = make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		var path = "/hot/" + strconv.Itoa(i)
+		owner, err := peers.GetAddress(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owners[owner.OriginalURL.Host] = true
+		for _, server := range append(servers[:], servers[:]...) {
+			resp, err := http.Get(server.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "contents of "+path {
+				t.Errorf("Unexpected response for %s from %s: %q", path, server.URL, body)
+			}
+		}
+		mu.Lock()
+		if originRequests[path] != 1 {
+			t.Errorf("Expected one origin request for %s but there were %d",
+				path, originRequests[path])
+		}
+		mu.Unlock()
+	}
+	if len(owners) != 2 {
+		t.Errorf("Expected the objects to be owned by both nodes but they were owned by %v", owners)
+	}
+}
+
+func TestClusterSettings(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		settings ClusterSettings
+		self     string
+		valid    bool
+	}{
+		{ClusterSettings{}, "", true},
+		{ClusterSettings{Scope: CoalescingNode}, "", true},
+		{ClusterSettings{Scope: CoalescingCluster, Peers: "p", Self: "http://10.0.0.1:8080",
+			TrustedPeers: []string{"10.0.0.0/24"}}, "10.0.0.1:8080", true},
+		{ClusterSettings{Scope: CoalescingCluster, Peers: "p", TrustedPeers: []string{"10.0.0.1"}}, "", false},
+		{ClusterSettings{Scope: CoalescingCluster, Self: "http://10.0.0.1", TrustedPeers: []string{"10.0.0.1"}}, "", false},
+		{ClusterSettings{Scope: CoalescingCluster, Peers: "p", Self: "10.0.0.1", TrustedPeers: []string{"10.0.0.1"}}, "", false},
+		{ClusterSettings{Scope: CoalescingCluster, Peers: "p", Self: "http://10.0.0.1"}, "", false},
+		{ClusterSettings{Scope: CoalescingCluster, Peers: "p", Self: "http://10.0.0.1",
+			TrustedPeers: []string{"10.0.0"}}, "", false},
+		{ClusterSettings{Scope: "world"}, "", false},
+	}
+	for _, test := range tests {
+		self, _, err := parseClusterSettings(test.settings)
+		if (err == nil) != test.valid || self != test.self {
+			t.Errorf("Expected %+v to be valid=%t with self %q but got %q, %v",
+				test.settings, test.valid, test.self, self, err)
+		}
+	}
+}
+
+// ownerUpstream always chooses the same address as the owner.
+type ownerUpstream struct {
+	types.Upstream
+	owner *types.UpstreamAddress
+}
+
+func (u ownerUpstream) GetAddress(string) (*types.UpstreamAddress, error) {
+	return u.owner, nil
+}
+
+func TestClusterHopFromUntrustedClients(t *testing.T) {
+	t.Parallel()
+	owner, _ := url.Parse("http://10.0.0.2:8080")
+	var peers = ownerUpstream{owner: &types.UpstreamAddress{URL: *owner, OriginalURL: owner}}
+	proxy, err := New(config.NewHandler("proxy", json.RawMessage(
+		`{"cluster": {"scope": "cluster", "peers": "peers", "self": "http://10.0.0.1:8080", "trusted_peers": ["10.0.0.0/24"]}}`)),
+		&types.Location{Name: "cluster", Logger: mock.NewLogger(), Upstream: peers}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var app = &mockApp{upstreams: map[string]types.Upstream{"peers": peers}}
+
+	for remoteAddr, forwarded := range map[string]bool{
+		"10.0.0.2:1234":    false, // forwarded by the peer
+		"192.168.0.1:1234": true,  // a client which wants to skip the owner
+	} {
+		req, err := http.NewRequest("GET", "http://example.com/object", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(contexts.NewAppContext(req.Context(), app))
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(clusterHopHeader, "1")
+		if peer := proxy.ownerPeer(types.RequestID("id"), req); (peer != nil) != forwarded {
+			t.Errorf("Expected the request from %s to be forwarded=%t but got %v", remoteAddr, forwarded, peer)
+		}
+		if hop := req.Header.Get(clusterHopHeader) != ""; hop == forwarded {
+			t.Errorf("Expected the hop header from %s to be kept=%t", remoteAddr, !forwarded)
+		}
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/ironsmile/nedomi/contexts"
 	"github.com/ironsmile/nedomi/types"
 	"github.com/ironsmile/nedomi/utils/httputils"
+	"github.com/ironsmile/nedomi/utils/netutils"
 )
 
 // This code is based on the source of ReverseProxy from Go's standard library:
@@ -31,6 +34,16 @@ type ReverseProxy struct {
 	Settings Settings
 
 	CodesToRetry map[int]string
+
+	// creates the temporary files for spooling request bodies
+	tempFiles func() (*os.File, error)
+
+	// the host of this node in the cluster peers, empty unless the requests
+	// are coalesced by the cluster
+	clusterSelf string
+	// the networks of the nodes whose requests are recognized as forwarded
+	// by another node of the cluster
+	clusterPeers netutils.IPNetworks
 }
 
 // Hop-by-hop headers. These are removed when sent to the backend.
@@ -53,6 +66,15 @@ func (c *runOnFirstRead) Read(bs []byte) (int, error) {
 	return c.Reader.Read(bs)
 }
 
+// upstreamHostHeader returns the Host header which the upstream chooses for
+// the request to the address, if any.
+func upstreamHostHeader(upstream types.Upstream, req *http.Request, addr *types.UpstreamAddress) string {
+	if hu, ok := upstream.(types.HostHeaderUpstream); ok {
+		return hu.HostHeader(req, addr)
+	}
+	return ""
+}
+
 func (p *ReverseProxy) getOutRequest(reqID types.RequestID, rw http.ResponseWriter, req *http.Request, upstream types.Upstream) (*http.Request, error) {
 	outreq := new(http.Request)
 	*outreq = *req
@@ -61,6 +83,10 @@ func (p *ReverseProxy) getOutRequest(reqID types.RequestID, rw http.ResponseWrit
 
 	outreq.Header = http.Header{}
 	httputils.CopyHeadersWithout(req.Header, outreq.Header, hopHeaders...)
+	outreq.Header.Del(clusterHopHeader)
+	if p.askForTrailers(req) {
+		outreq.Header.Set("Te", "trailers")
+	}
 	outreq.Header.Set("User-Agent", p.Settings.UserAgent) // If we don't set it, Go sets it for us to something stupid...
 
 	outreq.RequestURI = ""
@@ -69,11 +95,18 @@ func (p *ReverseProxy) getOutRequest(reqID types.RequestID, rw http.ResponseWrit
 	outreq.ProtoMinor = 1
 	outreq.Close = false
 
-	upAddr, err := upstream.GetAddress(p.Settings.UpstreamHashPrefix + req.URL.Path)
+	var key = p.Settings.UpstreamHashPrefix + req.URL.Path
+	if sticky, ok := upstream.(types.StickyUpstream); ok {
+		if affinity := sticky.AffinityKey(req); affinity != "" {
+			key = affinity
+		}
+	}
+	upAddr, err := upstream.GetAddress(key)
 	if err != nil {
 		return nil, fmt.Errorf("[%s] Proxy handler could not get an upstream address: %v", reqID, err)
 	}
 	p.Logger.Debugf("[%s] Using upstream %s (%s) to proxy request", reqID, upAddr, upAddr.OriginalURL)
+	contexts.RecordUpstream(req.Context(), upAddr)
 	outreq.URL.Scheme = upAddr.Scheme
 	outreq.URL.Host = upAddr.Host
 	outreq.URL.User = upAddr.User
@@ -87,6 +120,8 @@ func (p *ReverseProxy) getOutRequest(reqID types.RequestID, rw http.ResponseWrit
 		} else {
 			outreq.Host = req.URL.Host
 		}
+	} else if host := upstreamHostHeader(upstream, req, upAddr); host != "" {
+		outreq.Host = host
 	} else {
 		outreq.Host = upAddr.OriginalURL.Host
 	}
@@ -126,6 +161,7 @@ func (p *ReverseProxy) getOutRequest(reqID types.RequestID, rw http.ResponseWrit
 		}
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
+	p.rewriteRequestHeaders(outreq)
 
 	return outreq, nil
 }
@@ -147,24 +183,59 @@ func (p *ReverseProxy) doRequestFor(
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var upstream = p.defaultUpstream
 	reqID, _ := contexts.GetRequestID(req.Context())
-	res, err := p.doRequestFor(reqID, rw, req, upstream)
+	if p.Settings.RequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(),
+			time.Duration(p.Settings.RequestTimeout)*time.Millisecond)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	var doRequest = func(upstream types.Upstream) (*http.Response, error) {
+		return p.doRequestFor(reqID, rw, req, upstream)
+	}
+	if p.shouldSpool(req) {
+		body := p.spoolRequestBody(reqID, rw, req)
+		if body == nil {
+			return
+		}
+		defer func() {
+			if err := body.Close(); err != nil {
+				p.Logger.Errorf("[%s] Proxy error while removing the request body: %v", reqID, err)
+			}
+		}()
+		doRequest = func(upstream types.Upstream) (*http.Response, error) {
+			return p.doRequestFor(reqID, rw, body.request(req), upstream)
+		}
+	}
+	var res *http.Response
+	var err error
+	if peer := p.ownerPeer(reqID, req); peer != nil {
+		if res, err = p.doPeerRequest(reqID, rw, req, peer); err != nil {
+			p.Logger.Logf("[%s] Proxy error from the cluster peer, using the upstream: %v",
+				reqID, err)
+		}
+	}
+	if res == nil {
+		res, err = doRequest(upstream)
+	}
 	if err != nil {
-		p.Logger.Logf("[%s] Proxy error: %v", reqID, err)
-		httputils.Error(rw, http.StatusInternalServerError)
+		p.respondWithError(reqID, rw, req, err)
 		return
 	}
 	if newUpstream, ok := p.CodesToRetry[res.StatusCode]; ok {
 		upstream = getUpstreamFromContext(req.Context(), newUpstream)
-		if upstream != nil {
+		if budget := contexts.GetRequestBudget(req.Context()); upstream != nil && !budget.Allows(0) {
+			p.Logger.Logf("[%s] Not retrying with upstream %s as the budget of the request is spent",
+				reqID, newUpstream)
+			budget.Spend()
+		} else if upstream != nil {
 			if err = res.Body.Close(); err != nil {
 				p.Logger.Logf("[%s] Proxy error on closing response which will be retried: %v",
 					reqID, err)
 			}
 
-			res, err = p.doRequestFor(reqID, rw, req, upstream)
+			res, err = doRequest(upstream)
 			if err != nil {
-				p.Logger.Logf("[%s] Proxy error: %v", reqID, err)
-				httputils.Error(rw, http.StatusInternalServerError)
+				p.respondWithError(reqID, rw, req, err)
 				return
 			}
 		} else {
@@ -200,6 +271,9 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	if _, err := io.Copy(rw, res.Body); err != nil {
 		p.Logger.Logf("[%s] Proxy error during copying: %v", reqID, err)
+		if aborter, ok := rw.(httputils.Aborter); ok {
+			aborter.Abort(err)
+		}
 	}
 
 	// Close now, instead of defer, to populate res.Trailer
@@ -209,6 +283,24 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	httputils.CopyHeaders(res.Trailer, rw.Header())
 }
 
+// respondWithError responds to the client when the upstream request failed
+// before its response headers were received.
+func (p *ReverseProxy) respondWithError(reqID types.RequestID, rw http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() == context.DeadlineExceeded {
+		p.Logger.Logf("[%s] Proxy request timed out after %dms: %v",
+			reqID, p.Settings.RequestTimeout, err)
+		httputils.Error(rw, http.StatusGatewayTimeout)
+		return
+	}
+	if err == types.ErrUpstreamBusy {
+		p.Logger.Logf("[%s] Proxy error: %v", reqID, err)
+		httputils.Error(rw, http.StatusServiceUnavailable)
+		return
+	}
+	p.Logger.Logf("[%s] Proxy error: %v", reqID, err)
+	httputils.Error(rw, http.StatusInternalServerError)
+}
+
 func getUpstreamFromContext(ctx context.Context, upstream string) types.Upstream {
 	app, ok := contexts.GetApp(ctx)
 	if !ok {
@@ -300,3 +300,141 @@ func TestSimpleRetryWithNilUpstream(t *testing.T) {
 		t.Errorf("Unexpected response %#v", resp2)
 	}
 }
+
+type abortRecorder struct {
+	*httptest.ResponseRecorder
+	aborted error
+}
+
+func (ar *abortRecorder) Abort(err error) {
+	ar.aborted = err
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Parallel()
+	var release = make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-headers":
+			<-release
+		case "/slow-body":
+			w.Header().Set("Content-Length", "20")
+			fmt.Fprint(w, "first part")
+			w.(http.Flusher).Flush()
+			<-release
+		default:
+			fmt.Fprint(w, "hello world")
+		}
+	}))
+	defer func() {
+		close(release)
+		ts.Close()
+	}()
+
+	upstreamURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := upstream.NewSimple(upstreamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := New(config.NewHandler("proxy", json.RawMessage(`{"request_timeout": 50}`)),
+		&types.Location{
+			Name:     "test",
+			Logger:   mock.NewLogger(),
+			Upstream: up,
+		}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var serve = func(path string) *abortRecorder {
+		req, err := http.NewRequest("GET", "http://www.somewhere.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec = &abortRecorder{ResponseRecorder: httptest.NewRecorder()}
+		proxy.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("/fast"); rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := serve("/slow-headers"); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected a gateway timeout but got %d", rec.Code)
+	}
+	if rec := serve("/slow-body"); rec.Code != http.StatusOK || rec.aborted == nil {
+		t.Errorf("Expected the response to be aborted after its headers but got %d, %v",
+			rec.Code, rec.aborted)
+	}
+}
+
+func TestUpstreamHostHeader(t *testing.T) {
+	t.Parallel()
+	var received = make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Host
+	}))
+	defer ts.Close()
+	tsURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the host name is resolved and the requests are sent to its IP address
+	addrURL, err := url.Parse("http://localhost:" + tsURL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hostFor = func(hostHeader, value, proxySettings string) string {
+		var conf = &config.Upstream{
+			ID:        "test",
+			Balancing: "rendezvous",
+			Addresses: []config.UpstreamAddress{{URL: addrURL, Weight: 1}},
+			Settings:  config.GetDefaultUpstreamSettings(),
+		}
+		conf.Settings.HostHeader, conf.Settings.HostHeaderValue = hostHeader, value
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		up, err := upstream.New(ctx, conf, mock.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := New(config.NewHandler("proxy", []byte(proxySettings)), &types.Location{
+			Name:     "test",
+			Logger:   mock.NewLogger(),
+			Upstream: up,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("GET", "http://www.somewhere.com/path", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+		return <-received
+	}
+
+	var tests = []struct {
+		hostHeader, value, proxySettings, expected string
+	}{
+		{"", "", "{}", addrURL.Host},
+		{config.UpstreamHostHeaderOriginal, "", "{}", "www.somewhere.com"},
+		{config.UpstreamHostHeaderUpstream, "", "{}", addrURL.Host},
+		{config.UpstreamHostHeaderExplicit, "backend.example.com", "{}", "backend.example.com"},
+		// the settings of the proxy handler take precedence
+		{config.UpstreamHostHeaderExplicit, "backend.example.com",
+			`{"host_header": "other.example.com"}`, "other.example.com"},
+		{config.UpstreamHostHeaderUpstream, "",
+			`{"host_header_keep_original": true}`, "www.somewhere.com"},
+	}
+	for _, test := range tests {
+		if got := hostFor(test.hostHeader, test.value, test.proxySettings); got != test.expected {
+			t.Errorf("Expected the Host %s with host_header `%s` and the proxy settings %s but got %s",
+				test.expected, test.hostHeader, test.proxySettings, got)
+		}
+	}
+}
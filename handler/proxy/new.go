@@ -17,6 +17,30 @@ type Settings struct {
 	HostHeaderKeepOriginal bool              `json:"host_header_keep_original"`
 	UpstreamHashPrefix     string            `json:"upstream_hash_prefix"`
 	TryOtherUpstreamOnCode map[string]string `json:"try_other_upstream_on_code"`
+
+	// RequestBodies configures the buffering of the request bodies before
+	// they are sent to the upstream.
+	RequestBodies RequestBodySettings `json:"request_bodies"`
+
+	// Trailers controls when the upstream is asked for response trailers
+	// with `TE: trailers`. It is "client" (the default), "always" or "never".
+	Trailers string `json:"trailers"`
+
+	// Cluster configures whether the upstream requests for the same object
+	// are coalesced only by this node or by the whole cluster.
+	Cluster ClusterSettings `json:"cluster"`
+
+	// RequestTimeout is the time in milliseconds in which the whole upstream
+	// request, including the response body, has to finish. Responses which
+	// time out before their headers are received are replaced with 504
+	// Gateway Timeout. Zero means no limit.
+	RequestTimeout uint32 `json:"request_timeout"`
+
+	// RequestHeaders rewrites the headers of the upstream requests after the
+	// proxy has set its own ones, such as X-Forwarded-For, so that they can be
+	// changed too. Setting the Host header overrides the host of the requests
+	// even over HostHeader.
+	RequestHeaders config.HeadersRewrite `json:"request_headers"`
 }
 
 // New returns a configured and ready to use Upstream instance.
@@ -31,6 +55,9 @@ func New(cfg *config.Handler, l *types.Location, next http.Handler) (*ReversePro
 
 	s := Settings{
 		UserAgent: "nedomi",
+		RequestBodies: RequestBodySettings{
+			MemoryLimit: 64 * 1024,
+		},
 	}
 
 	if len(cfg.Settings) != 0 {
@@ -39,6 +66,15 @@ func New(cfg *config.Handler, l *types.Location, next http.Handler) (*ReversePro
 		}
 	}
 
+	if err := validateTrailers(s.Trailers); err != nil {
+		return nil, fmt.Errorf("handler.proxy[%s]: %s", l.Name, err)
+	}
+
+	clusterSelf, clusterPeers, err := parseClusterSettings(s.Cluster)
+	if err != nil {
+		return nil, fmt.Errorf("handler.proxy[%s]: %s", l.Name, err)
+	}
+
 	var codesToRetry = make(map[int]string, len(s.TryOtherUpstreamOnCode))
 	for code, upstream := range s.TryOtherUpstreamOnCode {
 		intCode, err := strconv.Atoi(code)
@@ -55,5 +91,8 @@ func New(cfg *config.Handler, l *types.Location, next http.Handler) (*ReversePro
 		Logger:          l.Logger,
 		Settings:        s,
 		CodesToRetry:    codesToRetry,
+		tempFiles:       tempFileCreator(l.Cache),
+		clusterSelf:     clusterSelf,
+		clusterPeers:    clusterPeers,
 	}, nil
 }
@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/ironsmile/nedomi/handler/headers"
+)
+
+// rewriteRequestHeaders applies Settings.RequestHeaders to the upstream
+// request. The Host header is not sent from the headers of a request, so it is
+// moved to its Host field.
+func (p *ReverseProxy) rewriteRequestHeaders(outreq *http.Request) {
+	headers.Rewrite(outreq.Header, p.Settings.RequestHeaders)
+	if host := outreq.Header.Get("Host"); host != "" {
+		outreq.Host = host
+	}
+	outreq.Header.Del("Host")
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/upstream"
+)
+
+func TestRequestHeadersRewrite(t *testing.T) {
+	t.Parallel()
+	var received = make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer ts.Close()
+
+	upstreamURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := upstream.NewSimple(upstreamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var settings = `{
+		"host_header": "ignored.example.com",
+		"request_headers": {
+			"remove_headers": ["cookie"],
+			"add_headers": {"Via": "1.1 nedomi"},
+			"set_headers": {"Host": "origin.example.com", "X-Real-IP": "hidden"}
+		}
+	}`
+	proxy, err := New(config.NewHandler("proxy", json.RawMessage(settings)), &types.Location{
+		Name:     "test",
+		Logger:   mock.NewLogger(),
+		Upstream: up,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "http://www.somewhere.com/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Via", "1.1 client-proxy")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	var r = <-received
+	if r.Host != "origin.example.com" {
+		t.Errorf("Expected the Host to be overridden but got %s", r.Host)
+	}
+	if cookie := r.Header.Get("Cookie"); cookie != "" {
+		t.Errorf("Expected the cookies to be stripped but got %s", cookie)
+	}
+	if via := r.Header["Via"]; len(via) != 2 || via[1] != "1.1 nedomi" {
+		t.Errorf("Expected Via to be added to but got %v", via)
+	}
+	if ip := r.Header.Get("X-Real-IP"); ip != "hidden" {
+		t.Errorf("Expected X-Real-IP to be set but got %s", ip)
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "10.0.0.1, 10.0.0.2" {
+		t.Errorf("Expected the client IP to be appended to X-Forwarded-For but got %s", xff)
+	}
+}
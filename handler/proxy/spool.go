@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// RequestBodySettings configures the buffering of request bodies. When Buffer
+// is true the whole body is read from the client before the request is sent
+// to the upstream, so that slow clients do not hold upstream connections and
+// the upstream receives the body at once. Bodies larger than MemoryLimit are
+// spooled to a temporary file in the storage of the cache zone or, if it is
+// not on the disk, in the temporary directory of the system. Bodies larger
+// than MaxSize are rejected. Zero MaxSize means no limit.
+type RequestBodySettings struct {
+	Buffer      bool            `json:"buffer"`
+	MemoryLimit types.BytesSize `json:"memory_limit"`
+	MaxSize     types.BytesSize `json:"max_size"`
+}
+
+var (
+	errBodyTooLarge = errors.New("the request body is too large")
+	errNoSpoolFile  = errors.New("could not create a file for the request body")
+)
+
+// spooledBody is a request body which was read whole before sending the
+// request. It is kept either in memory or in a temporary file.
+type spooledBody struct {
+	buf  []byte
+	file *os.File
+	size int64
+}
+
+// request returns a copy of the request which reads the spooled body from its
+// start. It can be called many times, e.g. for retrying the request.
+func (b *spooledBody) request(req *http.Request) *http.Request {
+	var r io.Reader = bytes.NewReader(b.buf)
+	if b.file != nil {
+		r = io.NewSectionReader(b.file, 0, b.size)
+	}
+	var result = new(http.Request)
+	*result = *req
+	result.Body = ioutil.NopCloser(r)
+	result.ContentLength = b.size
+	result.TransferEncoding = nil
+	return result
+}
+
+// Close removes the temporary file of the body, if there is one.
+func (b *spooledBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	return utils.NewCompositeError(b.file.Close(), os.Remove(b.file.Name()))
+}
+
+// shouldSpool returns whether the body of the request has to be read before
+// sending it to the upstream.
+func (p *ReverseProxy) shouldSpool(req *http.Request) bool {
+	return p.Settings.RequestBodies.Buffer && req.Body != nil && req.ContentLength != 0
+}
+
+// spoolRequestBody reads the whole body of the request. If this fails, the
+// error response is sent to the client and nil is returned.
+func (p *ReverseProxy) spoolRequestBody(reqID types.RequestID, rw http.ResponseWriter,
+	req *http.Request) *spooledBody {
+	var maxSize = int64(p.Settings.RequestBodies.MaxSize)
+	if maxSize > 0 && req.ContentLength > maxSize {
+		p.Logger.Debugf("[%s] The request body of %d bytes is too large", reqID, req.ContentLength)
+		httputils.Error(rw, http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	body, err := p.spoolBody(reqID, req.Body)
+	switch {
+	case err == errBodyTooLarge:
+		p.Logger.Debugf("[%s] The request body is too large", reqID)
+		httputils.Error(rw, http.StatusRequestEntityTooLarge)
+	case err == errNoSpoolFile:
+		httputils.Error(rw, http.StatusInternalServerError)
+	case err != nil:
+		p.Logger.Logf("[%s] Proxy error while reading the request body: %v", reqID, err)
+		httputils.Error(rw, http.StatusBadRequest)
+	default:
+		if body.file != nil {
+			p.Logger.Debugf("[%s] Spooled the request body of %d bytes to %s",
+				reqID, body.size, body.file.Name())
+		}
+		return body
+	}
+	return nil
+}
+
+// spoolBody reads the body into memory or into a temporary file if it is
+// larger than the memory limit.
+func (p *ReverseProxy) spoolBody(reqID types.RequestID, body io.Reader) (*spooledBody, error) {
+	var maxSize = int64(p.Settings.RequestBodies.MaxSize)
+	if maxSize > 0 {
+		body = io.LimitReader(body, maxSize+1)
+	}
+
+	var memoryLimit = int64(p.Settings.RequestBodies.MemoryLimit)
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(body, memoryLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	var result = &spooledBody{buf: buf.Bytes(), size: n}
+
+	if n > memoryLimit {
+		if result.file, err = p.tempFiles(); err != nil {
+			p.Logger.Errorf("[%s] Proxy error while creating a file for the request body: %v",
+				reqID, err)
+			return nil, errNoSpoolFile
+		}
+		result.buf = nil
+		if result.size, err = io.Copy(result.file, io.MultiReader(&buf, body)); err != nil {
+			return nil, utils.NewCompositeError(err, result.Close())
+		}
+	}
+
+	if maxSize > 0 && result.size > maxSize {
+		if err := result.Close(); err != nil {
+			p.Logger.Errorf("[%s] Proxy error while removing the request body: %v", reqID, err)
+		}
+		return nil, errBodyTooLarge
+	}
+	return result, nil
+}
+
+// tempFileCreator returns a function which creates the temporary files for
+// the request bodies in the storage of the cache zone if it can create them
+// or in the temporary directory of the system otherwise.
+func tempFileCreator(cz *types.CacheZone) func() (*os.File, error) {
+	if cz != nil {
+		if tc, ok := cz.Storage.(types.TempFileCreator); ok {
+			return tc.CreateTempFile
+		}
+	}
+	return func() (*os.File, error) {
+		return ioutil.TempFile("", "nedomi-body-")
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/storage/disk"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/upstream"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestRequestBodySpooling(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	storage, err := disk.New(&config.CacheZone{Path: diskPath, PartSize: 1024}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spoolFiles = func() int {
+		files, _ := ioutil.ReadDir(filepath.Join(diskPath, ".nedomi-tmp"))
+		return len(files)
+	}
+
+	var received struct {
+		body          []byte
+		contentLength int64
+		spooled       int
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.body, _ = ioutil.ReadAll(r.Body)
+		received.contentLength = r.ContentLength
+		received.spooled = spoolFiles()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	upstreamURL, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := upstream.NewSimple(upstreamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, _ := json.Marshal(map[string]interface{}{
+		"request_bodies": map[string]interface{}{
+			"buffer":       true,
+			"memory_limit": "1k",
+			"max_size":     "1m",
+		},
+	})
+	proxy, err := New(config.NewHandler("proxy", settings), &types.Location{
+		Name:     "test",
+		Logger:   mock.NewLogger(),
+		Upstream: up,
+		Cache:    &types.CacheZone{ID: "test", Storage: storage},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		size    int
+		chunked bool
+		code    int
+		spooled int
+	}{
+		{name: "small", size: 1000, code: http.StatusCreated},
+		{name: "large", size: 500 * 1024, code: http.StatusCreated, spooled: 1},
+		{name: "large chunked", size: 500 * 1024, chunked: true, code: http.StatusCreated, spooled: 1},
+		{name: "too large", size: 2 * 1024 * 1024, code: http.StatusRequestEntityTooLarge},
+		{name: "too large chunked", size: 2 * 1024 * 1024, chunked: true,
+			code: http.StatusRequestEntityTooLarge},
+	} {
+		received.body, received.contentLength, received.spooled = nil, 0, 0
+		var body = []byte(testutils.GenerateMeAString(int64(test.size), int64(test.size)))
+		req, err := http.NewRequest("POST", "http://www.somewhere.com/upload", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.chunked {
+			// this is how the server sees the requests without Content-Length
+			req.Body = ioutil.NopCloser(io.MultiReader(req.Body))
+			req.ContentLength = -1
+		}
+		var resp = httptest.NewRecorder()
+		proxy.ServeHTTP(resp, req)
+
+		if resp.Code != test.code {
+			t.Errorf("%s: expected code %d but got %d", test.name, test.code, resp.Code)
+		}
+		if test.code == http.StatusCreated {
+			if !bytes.Equal(received.body, body) {
+				t.Errorf("%s: the upstream received a different body of %d bytes",
+					test.name, len(received.body))
+			}
+			if received.contentLength != int64(test.size) {
+				t.Errorf("%s: expected the upstream to receive Content-Length %d but got %d",
+					test.name, test.size, received.contentLength)
+			}
+		} else if received.body != nil {
+			t.Errorf("%s: expected the request to not be sent to the upstream", test.name)
+		}
+		if received.spooled != test.spooled {
+			t.Errorf("%s: expected %d spooled files but there were %d",
+				test.name, test.spooled, received.spooled)
+		}
+		if spoolFiles() != 0 {
+			t.Errorf("%s: expected the spooled body to be removed", test.name)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(diskPath, ".nedomi-tmp")); err != nil {
+		t.Errorf("Expected the bodies to be spooled in the storage: %s", err)
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The values of the trailers setting. They control when the upstream is told
+// with `TE: trailers` that the response may have trailers, which some origins
+// send only then.
+const (
+	// trailersFromClient asks for trailers only when the client has asked
+	// for them, as the proxy passes them to the client. This is the default.
+	trailersFromClient = "client"
+	// trailersAlways always asks for trailers.
+	trailersAlways = "always"
+	// trailersNever never asks for trailers.
+	trailersNever = "never"
+)
+
+func validateTrailers(value string) error {
+	switch value {
+	case "", trailersFromClient, trailersAlways, trailersNever:
+		return nil
+	}
+	return fmt.Errorf("unknown trailers setting %q, expected %q, %q or %q",
+		value, trailersFromClient, trailersAlways, trailersNever)
+}
+
+// askForTrailers returns whether the upstream request for req should have the
+// `TE: trailers` header. TE is a hop-by-hop header and the transfer codings in
+// it are never forwarded, as the only value allowed in HTTP/2 is "trailers".
+func (p *ReverseProxy) askForTrailers(req *http.Request) bool {
+	switch p.Settings.Trailers {
+	case trailersAlways:
+		return true
+	case trailersNever:
+		return false
+	}
+	return acceptsTrailers(req.Header)
+}
+
+// acceptsTrailers returns whether the TE header lists the trailers.
+func acceptsTrailers(h http.Header) bool {
+	for _, value := range h["Te"] {
+		for _, token := range strings.Split(value, ",") {
+			if i := strings.IndexByte(token, ';'); i >= 0 {
+				token = token[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/upstream"
+)
+
+func newTrailersProxy(t *testing.T, setting string, upstreamURL string) *ReverseProxy {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := upstream.NewSimple(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := New(config.NewHandler("proxy", json.RawMessage(
+		fmt.Sprintf(`{"trailers": %q}`, setting))), &types.Location{
+		Name:     "test",
+		Logger:   mock.NewLogger(),
+		Upstream: up,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func TestTrailersNegotiation(t *testing.T) {
+	t.Parallel()
+	var receivedTE = make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedTE <- r.Header.Get("Te")
+		// like some origins, send the trailer only when it is asked for
+		if acceptsTrailers(r.Header) {
+			w.Header().Set("Trailer", "X-Checksum")
+		}
+		fmt.Fprint(w, "body")
+		if acceptsTrailers(r.Header) {
+			w.Header().Set("X-Checksum", "sum")
+		}
+	}))
+	defer ts.Close()
+
+	var tests = []struct {
+		setting, clientTE, upstreamTE string
+	}{
+		{"", "", ""},
+		{"", "trailers", "trailers"},
+		{"client", "gzip, Trailers;q=1", "trailers"},
+		{"client", "gzip", ""},
+		{"always", "", "trailers"},
+		{"always", "gzip", "trailers"},
+		{"never", "trailers", ""},
+	}
+	for _, test := range tests {
+		var proxy = newTrailersProxy(t, test.setting, ts.URL)
+		req, err := http.NewRequest("GET", "http://www.somewhere.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.clientTE != "" {
+			req.Header.Set("Te", test.clientTE)
+		}
+		var resp = httptest.NewRecorder()
+		proxy.ServeHTTP(resp, req)
+
+		if te := <-receivedTE; te != test.upstreamTE {
+			t.Errorf("With setting %q and client TE %q expected upstream TE %q but got %q",
+				test.setting, test.clientTE, test.upstreamTE, te)
+		}
+		if resp.Body.String() != "body" {
+			t.Errorf("Unexpected response body %q", resp.Body)
+		}
+		var expected string
+		if test.upstreamTE != "" {
+			expected = "sum"
+		}
+		if got := resp.Header().Get("X-Checksum"); got != expected {
+			t.Errorf("With setting %q and client TE %q expected trailer %q but got %q",
+				test.setting, test.clientTE, expected, got)
+		}
+	}
+}
+
+func TestUnknownTrailersSetting(t *testing.T) {
+	t.Parallel()
+	up, err := upstream.NewSimple(&url.URL{Scheme: "http", Host: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(config.NewHandler("proxy", json.RawMessage(`{"trailers": "sometimes"}`)),
+		&types.Location{Name: "test", Logger: mock.NewLogger(), Upstream: up}, nil)
+	if err == nil {
+		t.Error("Expected an error for an unknown trailers setting")
+	}
+}
@@ -1,7 +1,9 @@
 package purge
 
 import (
+	"bytes"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -20,6 +22,51 @@ type Handler struct {
 type purgeRequest config.StringSlice
 type purgeResult map[string]bool
 
+// groupPurge is a request for purging all objects in a group. The location is
+// an URL which is used to find the cache zone of the group.
+type groupPurge struct {
+	Location string `json:"location"`
+	Group    string `json:"group"`
+}
+
+// keyPurge is a request for purging all objects with a surrogate key. The
+// location is an URL which is used to find the cache zone of the objects.
+type keyPurge struct {
+	Location string `json:"location"`
+	Key      string `json:"key"`
+}
+
+// keyPurgeResult is the number of purged objects by surrogate key.
+type keyPurgeResult map[string]int
+
+// partsPurge is a request for purging only some parts of an object, e.g. a
+// corrected segment of a large one. The parts are given by their numbers or
+// by a byte range in the form of the Range header, or both.
+type partsPurge struct {
+	URL   string   `json:"url"`
+	Range string   `json:"range"`
+	Parts []uint32 `json:"parts"`
+}
+
+// partsPurgeResult is the number of purged parts by URL.
+type partsPurgeResult map[string]int
+
+// extendedPurgeRequest is the object form of the purge request which can also
+// contain groups, surrogate keys and parts of objects to be purged.
+type extendedPurgeRequest struct {
+	URLs   purgeRequest `json:"urls"`
+	Groups []groupPurge `json:"groups"`
+	Keys   []keyPurge   `json:"keys"`
+	Parts  []partsPurge `json:"parts"`
+}
+
+type extendedPurgeResult struct {
+	URLs   purgeResult      `json:"urls"`
+	Groups purgeResult      `json:"groups,omitempty"`
+	Keys   keyPurgeResult   `json:"keys,omitempty"`
+	Parts  partsPurgeResult `json:"parts,omitempty"`
+}
+
 // ServeHTTP servers the purge page.
 func (ph *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	reqID, _ := contexts.GetRequestID(r.Context())
@@ -29,8 +76,16 @@ func (ph *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var pr = new(purgeRequest)
-	if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
+	var epr = new(extendedPurgeRequest)
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+			err = json.Unmarshal(body, epr)
+		} else {
+			err = json.Unmarshal(body, &epr.URLs)
+		}
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		ph.logger.Errorf("[%s] error on parsing request %s",
 			reqID, err)
@@ -43,7 +98,20 @@ func (ph *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ph.logger.Errorf("[%s] no app in context", reqID)
 		return
 	}
-	var res, err = ph.purgeAll(reqID, app, *pr)
+	var res interface{}
+	urlsRes, err := ph.purgeAll(reqID, app, epr.URLs)
+	if err == nil {
+		res = urlsRes
+		if epr.Groups != nil || epr.Keys != nil || epr.Parts != nil {
+			var eres = extendedPurgeResult{URLs: urlsRes}
+			if eres.Groups, err = ph.purgeGroups(reqID, app, epr.Groups); err == nil {
+				if eres.Keys, err = ph.purgeKeys(reqID, app, epr.Keys); err == nil {
+					eres.Parts, err = ph.purgeParts(reqID, app, epr.Parts)
+				}
+			}
+			res = eres
+		}
+	}
 	if err != nil {
 		httputils.Error(w, http.StatusInternalServerError)
 		// previosly logged
@@ -73,37 +141,217 @@ func (ph *Handler) purgeAll(reqID types.RequestID, app types.App, pr purgeReques
 		}
 
 		var oid = location.NewObjectIDForURL(u)
+		if pres[uString], err = ph.purgeObject(reqID, location.Cache, oid); err != nil {
+			return nil, err
+		}
+	}
+	return pres, nil
+}
 
-		parts, err := location.Cache.Storage.GetAvailableParts(oid)
+// purgeGroups purges all objects in the requested groups. The generation of
+// every group is increased before its objects are removed, so from that
+// moment on none of them is served from the cache even if it has not been
+// removed yet.
+func (ph *Handler) purgeGroups(reqID types.RequestID, app types.App, groups []groupPurge) (purgeResult, error) {
+	var pres = purgeResult(make(map[string]bool))
 
+	for _, gp := range groups {
+		pres[gp.Group] = false
+		var u, err = url.Parse(gp.Location)
 		if err != nil {
-			if !os.IsNotExist(err) {
-				ph.logger.Errorf(
-					"[%s] got error while gettings parts of object '%s' - %s",
-					reqID, oid, err)
+			continue
+		}
+		var location = app.GetLocationFor(u.Host, u.Path)
+		if location == nil || location.Cache == nil {
+			ph.logger.Logf(
+				"[%s] got request to purge a group (%s) that is for a not configured location",
+				reqID, gp.Group)
+			continue
+		}
+
+		for _, oid := range location.Cache.Groups.Invalidate(gp.Group) {
+			if _, err = ph.purgeObject(reqID, location.Cache, oid); err != nil {
 				return nil, err
 			}
 		}
+		pres[gp.Group] = true
+	}
+	return pres, nil
+}
 
-		if len(parts) == 0 {
+// purgeKeys purges all objects with the requested surrogate keys and returns
+// how many of them were purged by key. The objects are found in the index of
+// the cache zone, so the storage is not iterated.
+func (ph *Handler) purgeKeys(reqID types.RequestID, app types.App, keys []keyPurge) (keyPurgeResult, error) {
+	var kres = keyPurgeResult(make(map[string]int))
+
+	for _, kp := range keys {
+		if _, ok := kres[kp.Key]; !ok {
+			kres[kp.Key] = 0
+		}
+		var u, err = url.Parse(kp.Location)
+		if err != nil {
+			continue
+		}
+		var location = app.GetLocationFor(u.Host, u.Path)
+		if location == nil || location.Cache == nil {
+			ph.logger.Logf(
+				"[%s] got request to purge a surrogate key (%s) that is for a not configured location",
+				reqID, kp.Key)
 			continue
 		}
 
-		if err = location.Cache.Storage.Discard(oid); err != nil {
-			if !os.IsNotExist(err) {
-				ph.logger.Errorf(
-					"[%s] got error while purging object '%s' - %s",
-					reqID, oid, err)
+		for _, oid := range location.Cache.SurrogateKeys.Purge(kp.Key) {
+			purged, err := ph.purgeObject(reqID, location.Cache, oid)
+			if err != nil {
 				return nil, err
+			} else if purged {
+				kres[kp.Key]++
 			}
 		}
+	}
+	return kres, nil
+}
+
+// purgeParts purges the requested parts of objects and returns how many of
+// them were purged by URL. The rest of the parts and the metadata of the
+// objects are kept, so the next requests for them fetch only the purged
+// parts from the upstream.
+func (ph *Handler) purgeParts(reqID types.RequestID, app types.App, purges []partsPurge) (partsPurgeResult, error) {
+	var pres = partsPurgeResult(make(map[string]int))
 
-		location.Cache.Algorithm.Remove(parts...)
-		pres[uString] = err == nil // err is os.ErrNotExist
+	for _, pp := range purges {
+		if _, ok := pres[pp.URL]; !ok {
+			pres[pp.URL] = 0
+		}
+		var u, err = url.Parse(pp.URL)
+		if err != nil {
+			continue
+		}
+		var location = app.GetLocationFor(u.Host, u.Path)
+		if location == nil || location.Cache == nil {
+			ph.logger.Logf(
+				"[%s] got request to purge parts of an object (%s) that is for a not configured location",
+				reqID, pp.URL)
+			continue
+		}
+
+		var oid = location.NewObjectIDForURL(u)
+		requested, err := requestedParts(location.Cache.Storage, oid, pp)
+		if err != nil {
+			ph.logger.Logf("[%s] could not purge parts of object '%s' - %s", reqID, oid, err)
+			continue
+		}
+		purged, err := ph.purgeObjectParts(reqID, location.Cache, oid, requested)
+		if err != nil {
+			return nil, err
+		}
+		pres[pp.URL] += purged
 	}
 	return pres, nil
 }
 
+// requestedParts returns the numbers of the parts of the object which are
+// requested to be purged. The parts which are only partially in the byte
+// range are purged too.
+func requestedParts(st types.Storage, oid *types.ObjectID, pp partsPurge) (map[uint32]bool, error) {
+	var requested = make(map[uint32]bool, len(pp.Parts))
+	for _, part := range pp.Parts {
+		requested[part] = true
+	}
+	if pp.Range == "" {
+		return requested, nil
+	}
+
+	// the size of the object is needed for the ranges relative to its end
+	obj, err := st.GetMetadata(oid)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := httputils.ParseRequestRange(pp.Range, obj.Size)
+	if err != nil {
+		return nil, err
+	}
+	var partSize = st.PartSize()
+	for _, r := range ranges {
+		for part := r.Start / partSize; part <= (r.Start+r.Length-1)/partSize; part++ {
+			requested[uint32(part)] = true
+		}
+	}
+	return requested, nil
+}
+
+// purgeObjectParts removes the requested parts of the object from the cache
+// zone and returns how many of them were there.
+func (ph *Handler) purgeObjectParts(reqID types.RequestID, cz *types.CacheZone,
+	oid *types.ObjectID, requested map[uint32]bool) (int, error) {
+	parts, err := cz.Storage.GetAvailableParts(oid)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ph.logger.Errorf(
+				"[%s] got error while gettings parts of object '%s' - %s",
+				reqID, oid, err)
+			return 0, err
+		}
+	}
+
+	var purged int
+	for _, idx := range parts {
+		if !requested[idx.Part] {
+			continue
+		}
+		if err := cz.Storage.DiscardPart(idx); err != nil {
+			if !os.IsNotExist(err) {
+				ph.logger.Errorf(
+					"[%s] got error while purging part '%s' - %s",
+					reqID, idx, err)
+				return purged, err
+			}
+		} else {
+			purged++
+		}
+		cz.Algorithm.Remove(idx)
+	}
+	return purged, nil
+}
+
+// purgeObject removes the object from the cache zone and returns whether it
+// was there.
+func (ph *Handler) purgeObject(reqID types.RequestID, cz *types.CacheZone, oid *types.ObjectID) (bool, error) {
+	parts, err := cz.Storage.GetAvailableParts(oid)
+
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ph.logger.Errorf(
+				"[%s] got error while gettings parts of object '%s' - %s",
+				reqID, oid, err)
+			return false, err
+		}
+	}
+
+	if len(parts) == 0 {
+		// objects without a body, such as cached empty error responses,
+		// have only metadata
+		if _, err := cz.Storage.GetMetadata(oid); err != nil {
+			return false, nil
+		}
+	}
+
+	if err = cz.Storage.Discard(oid); err != nil {
+		if !os.IsNotExist(err) {
+			ph.logger.Errorf(
+				"[%s] got error while purging object '%s' - %s",
+				reqID, oid, err)
+			return false, err
+		}
+	}
+
+	cz.Algorithm.Remove(parts...)
+	cz.SurrogateKeys.Remove(oid)
+	cz.Groups.Remove(oid)
+	return err == nil, nil // err is os.ErrNotExist
+}
+
 // New creates and returns a ready to used ServerPurgeHandler.
 func New(cfg *config.Handler, l *types.Location, next http.Handler) (*Handler, error) {
 	return &Handler{
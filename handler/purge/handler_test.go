@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/ironsmile/nedomi/config"
@@ -277,3 +280,212 @@ func TestPurgeBadGetParts(t *testing.T) {
 	purger.ServeHTTP(rec, req)
 	testCode(t, rec.Code, http.StatusInternalServerError)
 }
+
+func TestPurgeGroups(t *testing.T) {
+	ctx, purger, _ := testSetup(t)
+	app, _ := contexts.GetApp(ctx)
+	var cz = app.GetLocationFor(host1, path1).Cache
+	cz.Groups = types.NewObjectGroups()
+	cz.Groups.Add("group", 0, obj1)
+	cz.Groups.Add("group", 0, obj2)
+
+	var body = `{"groups": [
+		{"location": "` + url1 + `", "group": "group"},
+		{"location": "` + url3 + `", "group": "other"}
+	]}`
+	req, err := http.NewRequest("POST", testURL, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	rec := httptest.NewRecorder()
+	purger.ServeHTTP(rec, req)
+	testCode(t, rec.Code, http.StatusOK)
+
+	var epr extendedPurgeResult
+	if err = json.Unmarshal(rec.Body.Bytes(), &epr); err != nil {
+		t.Error(rec.Body.String())
+		t.Fatal(err)
+	}
+	checkPr(t, epr.Groups, []string{"group"}, true)
+	checkPr(t, epr.Groups, []string{"other"}, false)
+
+	if cz.Groups.IsCurrent("group", 0) {
+		t.Error("the group should have been invalidated")
+	}
+	for _, obj := range []*types.ObjectID{obj1, obj2} {
+		if _, err := cz.Storage.GetMetadata(obj); err == nil {
+			t.Errorf("expected %s to be purged", obj)
+		}
+	}
+}
+
+func TestPurgeObjectWithoutParts(t *testing.T) {
+	var st = mock.NewStorage(10)
+	testutils.ShouldntFail(t, st.SaveMetadata(&types.ObjectMetadata{ID: obj1, Code: http.StatusNotFound}))
+	ctx, purger, _ := testSetupWithStorage(t, st)
+
+	req, err := http.NewRequest("POST", testURL, bytes.NewReader([]byte(`["`+url1+`"]`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	purger.ServeHTTP(rec, req.WithContext(ctx))
+	testCode(t, rec.Code, http.StatusOK)
+
+	var pr purgeResult
+	if err = json.Unmarshal(rec.Body.Bytes(), &pr); err != nil {
+		t.Fatal(err)
+	}
+	checkPr(t, pr, []string{url1}, true)
+	if _, err := st.GetMetadata(obj1); err == nil {
+		t.Errorf("expected %s to be purged", obj1)
+	}
+}
+
+func TestPurgeSurrogateKeys(t *testing.T) {
+	ctx, purger, _ := testSetup(t)
+	app, _ := contexts.GetApp(ctx)
+	var cz = app.GetLocationFor(host1, path1).Cache
+	cz.SurrogateKeys = types.NewSurrogateKeys()
+	cz.SurrogateKeys.Add(obj1, []string{"product-1", "products"})
+	cz.SurrogateKeys.Add(obj2, []string{"product-2", "products"})
+
+	var body = `{"keys": [
+		{"location": "` + url1 + `", "key": "products"},
+		{"location": "` + url1 + `", "key": "product-1"},
+		{"location": "` + url3 + `", "key": "other"}
+	]}`
+	req, err := http.NewRequest("POST", testURL, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	rec := httptest.NewRecorder()
+	purger.ServeHTTP(rec, req)
+	testCode(t, rec.Code, http.StatusOK)
+
+	var epr extendedPurgeResult
+	if err = json.Unmarshal(rec.Body.Bytes(), &epr); err != nil {
+		t.Error(rec.Body.String())
+		t.Fatal(err)
+	}
+	// the objects purged with the first key are not counted again
+	var expected = keyPurgeResult{"products": 2, "product-1": 0, "other": 0}
+	if !reflect.DeepEqual(epr.Keys, expected) {
+		t.Errorf("expected the purged counts %v but got %v", expected, epr.Keys)
+	}
+	if epr.Groups != nil {
+		t.Errorf("expected no groups in the result but got %v", epr.Groups)
+	}
+	for _, obj := range []*types.ObjectID{obj1, obj2} {
+		if _, err := cz.Storage.GetMetadata(obj); err == nil {
+			t.Errorf("expected %s to be purged", obj)
+		}
+	}
+}
+
+func TestPurgeWithSchemeInCacheKey(t *testing.T) {
+	t.Parallel()
+	var loc = &types.Location{
+		Logger:                 mock.NewLogger(),
+		CacheKey:               cacheKey1,
+		CacheKeyIncludesScheme: true,
+		Name:                   "location1",
+	}
+	var httpsObj = loc.NewObjectIDForURL(&url.URL{Scheme: "https", Path: path1})
+	loc.Cache = &types.CacheZone{
+		ID:        "testZone",
+		Algorithm: mock.NewCacheAlgorithm(nil),
+		Storage:   storageWithObjects(t, httpsObj),
+	}
+	var app = &mockApp{
+		getLocationFor: func(host, path string) *types.Location { return loc },
+	}
+	purger, err := New(&config.Handler{}, &types.Location{Logger: mock.NewLogger()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var httpURL, httpsURL = "http://" + host1 + path1, "https://" + host1 + path1
+	req, err := http.NewRequest("POST", testURL,
+		bytes.NewReader([]byte(`["`+httpURL+`", "`+httpsURL+`"]`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	purger.ServeHTTP(rec, req.WithContext(contexts.NewAppContext(context.Background(), app)))
+	testCode(t, rec.Code, http.StatusOK)
+	var pr purgeResult
+	if err = json.Unmarshal(rec.Body.Bytes(), &pr); err != nil {
+		t.Fatal(err)
+	}
+	checkPr(t, pr, []string{httpsURL}, true)
+	checkPr(t, pr, []string{httpURL}, false)
+}
+
+func TestPurgeParts(t *testing.T) {
+	t.Parallel()
+	var st = mock.NewStorage(10)
+	for _, obj := range []*types.ObjectID{obj1, obj2} {
+		testutils.ShouldntFail(t, st.SaveMetadata(&types.ObjectMetadata{ID: obj, Size: 50}))
+		for part := uint32(0); part < 5; part++ {
+			testutils.ShouldntFail(t, st.SavePart(&types.ObjectIndex{ObjID: obj, Part: part},
+				bytes.NewReader([]byte("0123456789"))))
+		}
+	}
+	ctx, purger, _ := testSetupWithStorage(t, st)
+	app, _ := contexts.GetApp(ctx)
+	var removed []string
+	app.GetLocationFor(host1, path1).Cache.Algorithm = mock.NewCacheAlgorithm(&mock.CacheAlgorithmRepliers{
+		Remove: func(parts ...*types.ObjectIndex) {
+			for _, part := range parts {
+				removed = append(removed, part.String())
+			}
+		},
+	})
+
+	var body = `{"parts": [
+		{"url": "` + url1 + `", "range": "bytes=15-25"},
+		{"url": "` + url2 + `", "parts": [4, 7], "range": "bytes=-1"},
+		{"url": "` + url3 + `", "parts": [0]}
+	]}`
+	req, err := http.NewRequest("POST", testURL, bytes.NewReader([]byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	purger.ServeHTTP(rec, req.WithContext(ctx))
+	testCode(t, rec.Code, http.StatusOK)
+
+	var epr extendedPurgeResult
+	if err = json.Unmarshal(rec.Body.Bytes(), &epr); err != nil {
+		t.Error(rec.Body.String())
+		t.Fatal(err)
+	}
+	// the last part of the second object is requested twice but purged once
+	var expected = partsPurgeResult{url1: 2, url2: 1, url3: 0}
+	if !reflect.DeepEqual(epr.Parts, expected) {
+		t.Errorf("expected the purged counts %v but got %v", expected, epr.Parts)
+	}
+
+	var expectedRemaining = map[*types.ObjectID][]uint32{obj1: {0, 3, 4}, obj2: {0, 1, 2, 3}}
+	for obj, expectedParts := range expectedRemaining {
+		if _, err := st.GetMetadata(obj); err != nil {
+			t.Errorf("expected the metadata of %s to be kept but got %s", obj, err)
+		}
+		// the mock storage returns os.ErrNotExist with the parts
+		parts, _ := st.GetAvailableParts(obj)
+		var got []uint32
+		for _, part := range parts {
+			got = append(got, part.Part)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !reflect.DeepEqual(got, expectedParts) {
+			t.Errorf("expected the parts %v of %s to remain but got %v", expectedParts, obj, got)
+		}
+	}
+	if len(removed) != 3 {
+		t.Errorf("expected the 3 purged parts to be removed from the algorithm but got %v", removed)
+	}
+}
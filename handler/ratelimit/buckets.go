@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is the token bucket of a single client or object.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// buckets keeps the token buckets of the most recently seen keys. The buckets
+// which were idle long enough to be refilled are the same as the missing ones,
+// so they are removed. When there are too many buckets the least recently
+// used ones are removed even if they are not full.
+type buckets struct {
+	sync.Mutex
+	rate, burst float64
+	max         int
+	lru         *list.List
+	byKey       map[string]*list.Element
+}
+
+func newBuckets(rate, burst float64, max int) *buckets {
+	return &buckets{
+		rate:  rate,
+		burst: burst,
+		max:   max,
+		lru:   list.New(),
+		byKey: make(map[string]*list.Element),
+	}
+}
+
+// take takes a token from the bucket of the key at the time now. It returns
+// whether there was one, how many whole tokens are left and how long it takes
+// until the next token is available.
+func (bs *buckets) take(key string, now time.Time) (allowed bool, remaining int, wait time.Duration) {
+	bs.Lock()
+	defer bs.Unlock()
+	var b *bucket
+	if e, ok := bs.byKey[key]; ok {
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(bs.burst, b.tokens+now.Sub(b.last).Seconds()*bs.rate)
+		b.last = now
+		bs.lru.MoveToFront(e)
+	} else {
+		b = &bucket{key: key, tokens: bs.burst, last: now}
+		bs.byKey[key] = bs.lru.PushFront(b)
+	}
+	bs.removeIdle(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		allowed = true
+	}
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / bs.rate * float64(time.Second))
+	}
+	return allowed, int(b.tokens), wait
+}
+
+// removeIdle removes the least recently used buckets while they are too many
+// or are refilled by now. It should be called with the lock held.
+func (bs *buckets) removeIdle(now time.Time) {
+	for e := bs.lru.Back(); e != nil && e != bs.lru.Front(); e = bs.lru.Back() {
+		var b = e.Value.(*bucket)
+		if bs.lru.Len() <= bs.max && b.tokens+now.Sub(b.last).Seconds()*bs.rate < bs.burst {
+			return
+		}
+		bs.lru.Remove(e)
+		delete(bs.byKey, b.key)
+	}
+}
+
+// len returns the number of kept buckets.
+func (bs *buckets) len() int {
+	bs.Lock()
+	defer bs.Unlock()
+	return bs.lru.Len()
+}
@@ -0,0 +1,145 @@
+// Package ratelimit limits the rate of the requests of every client or for
+// every object which are passed to the next handler.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// The possible values of Configuration.Key
+const (
+	// KeyIP limits the requests of every client IP address.
+	KeyIP = "ip"
+	// KeyCacheKey limits the requests for every object, i.e. for every
+	// cache key of the location.
+	KeyCacheKey = "cache_key"
+)
+
+// Configuration is the struct the handler settings will be unmarshalled in
+type Configuration struct {
+	// Rate is the number of requests per second which are allowed for a
+	// key and Burst is how many of them may be made at once. The default
+	// burst is the rate, rounded up.
+	Rate  float64 `json:"rate"`
+	Burst uint32  `json:"burst"`
+	// Key is by what the requests are limited, one of the Key constants.
+	Key string `json:"key"`
+	// MaxKeys is the number of keys whose limits are kept in memory. The
+	// least recently seen ones are forgotten when there are more.
+	MaxKeys uint32 `json:"max_keys"`
+	// Headers makes the handler add the X-RateLimit-Limit and
+	// X-RateLimit-Remaining headers to all responses.
+	Headers bool `json:"headers"`
+}
+
+func defaultConfiguration() Configuration {
+	return Configuration{
+		Key:     KeyIP,
+		MaxKeys: 100000,
+	}
+}
+
+// RateLimit is the handler which responds with 429 Too Many Requests to the
+// requests over the limit instead of passing them to the next handler.
+type RateLimit struct {
+	next     http.Handler
+	location *types.Location
+	key      string
+	burst    uint32
+	headers  bool
+	buckets  *buckets
+	now      func() time.Time
+}
+
+// New creates and returns a ready to use rate limiting handler.
+func New(cfg *config.Handler, l *types.Location, next http.Handler) (*RateLimit, error) {
+	if next == nil {
+		return nil, types.NilNextHandler("ratelimit")
+	}
+
+	var c = defaultConfiguration()
+	if len(cfg.Settings) != 0 {
+		if err := json.Unmarshal(cfg.Settings, &c); err != nil {
+			return nil, utils.ShowContextOfJSONError(err, cfg.Settings)
+		}
+	}
+	if c.Rate <= 0 {
+		return nil, fmt.Errorf("handler.ratelimit needs to have rate settings > 0")
+	}
+	if c.Burst == 0 {
+		c.Burst = uint32(math.Ceil(c.Rate))
+	}
+	if c.MaxKeys == 0 {
+		return nil, fmt.Errorf("handler.ratelimit needs to have max_keys settings > 0")
+	}
+	switch c.Key {
+	case KeyIP:
+	case KeyCacheKey:
+		if l == nil {
+			return nil, fmt.Errorf("handler.ratelimit needs a location to limit by cache key")
+		}
+	default:
+		return nil, fmt.Errorf("handler.ratelimit has unknown key `%s`", c.Key)
+	}
+
+	return &RateLimit{
+		next:     next,
+		location: l,
+		key:      c.Key,
+		burst:    c.Burst,
+		headers:  c.Headers,
+		buckets:  newBuckets(c.Rate, float64(c.Burst), int(c.MaxKeys)),
+		now:      time.Now,
+	}, nil
+}
+
+// ServeHTTP passes the request to the next handler if its key has not
+// exceeded the limit.
+func (rl *RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var key = rl.requestKey(r)
+	allowed, remaining, wait := rl.buckets.take(key, rl.now())
+	if rl.headers {
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatUint(uint64(rl.burst), 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	}
+	if !allowed {
+		if rl.location != nil && rl.location.Logger != nil {
+			var reqID, _ = contexts.GetRequestID(r.Context())
+			rl.location.Logger.Debugf("[%s] Rate limit exceeded for %s", reqID, key)
+		}
+		var seconds = int64(math.Ceil(wait.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		httputils.Error(w, http.StatusTooManyRequests)
+		return
+	}
+	rl.next.ServeHTTP(w, r)
+}
+
+// requestKey returns the key by which the request is limited.
+func (rl *RateLimit) requestKey(r *http.Request) string {
+	if rl.key == KeyCacheKey {
+		return rl.location.NewObjectIDForRequest(r).StrHash()
+	}
+	// only the address of the connection is used as the headers with
+	// forwarded addresses can be forged
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
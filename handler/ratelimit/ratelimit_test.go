@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+// newTestRateLimit returns a rate limiting handler whose clock is moved only
+// by the returned function.
+func newTestRateLimit(t *testing.T, settings string, l *types.Location) (*RateLimit, func(time.Duration)) {
+	rl, err := New(config.NewHandler("ratelimit", json.RawMessage(settings)), l, okHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now = time.Unix(1000, 0)
+	rl.now = func() time.Time { return now }
+	return rl, func(d time.Duration) { now = now.Add(d) }
+}
+
+func limitedRequest(rl *RateLimit, remoteAddr, path string) *httptest.ResponseRecorder {
+	var req = httptest.NewRequest("GET", "http://example.com"+path, nil)
+	req.RemoteAddr = remoteAddr
+	var rec = httptest.NewRecorder()
+	rl.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	t.Parallel()
+	rl, advance := newTestRateLimit(t, `{"rate": 2, "burst": 3, "headers": true}`, nil)
+
+	for i := 0; i < 3; i++ {
+		var rec = limitedRequest(rl, "10.0.0.1:1234", "/")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d within the burst to be allowed but got %d", i, rec.Code)
+		}
+		if remaining := rec.Header().Get("X-RateLimit-Remaining"); remaining != strconv.Itoa(2-i) {
+			t.Errorf("Expected %d remaining requests but got %s", 2-i, remaining)
+		}
+	}
+	var rec = limitedRequest(rl, "10.0.0.1:5678", "/")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the request over the burst to be limited but got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("X-RateLimit-Limit") != "3" {
+		t.Errorf("Unexpected headers of the limited response %v", rec.Header())
+	}
+	if rec := limitedRequest(rl, "10.0.0.2:1234", "/"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the other client not to be limited but got %d", rec.Code)
+	}
+
+	// the tokens are refilled with the rate
+	advance(500 * time.Millisecond)
+	if rec := limitedRequest(rl, "10.0.0.1:1234", "/"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the request after the refill to be allowed but got %d", rec.Code)
+	}
+	if rec := limitedRequest(rl, "10.0.0.1:1234", "/"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second request after the refill to be limited but got %d", rec.Code)
+	}
+}
+
+func TestRateLimitByCacheKey(t *testing.T) {
+	t.Parallel()
+	var l = &types.Location{Name: "test", CacheKey: "key"}
+	rl, _ := newTestRateLimit(t, `{"rate": 1, "key": "cache_key"}`, l)
+	var rec = limitedRequest(rl, "10.0.0.1:1234", "/a")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the first request to be allowed but got %d", rec.Code)
+	}
+	if rec := limitedRequest(rl, "10.0.0.2:1234", "/a"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the request for the same object to be limited but got %d", rec.Code)
+	}
+	if rec := limitedRequest(rl, "10.0.0.1:1234", "/b"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the request for another object to be allowed but got %d", rec.Code)
+	}
+	if rec.Header().Get("X-RateLimit-Limit") != "" {
+		t.Error("Expected no rate limit headers by default")
+	}
+}
+
+func TestRateLimitIsBounded(t *testing.T) {
+	t.Parallel()
+	rl, advance := newTestRateLimit(t, `{"rate": 1, "burst": 2, "max_keys": 2}`, nil)
+	for _, addr := range []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"} {
+		limitedRequest(rl, addr, "/")
+	}
+	if n := rl.buckets.len(); n != 2 {
+		t.Errorf("Expected only the 2 most recent keys to be kept but there are %d", n)
+	}
+
+	// the refilled buckets are removed as they are not needed
+	advance(2 * time.Second)
+	limitedRequest(rl, "10.0.0.4:1", "/")
+	if n := rl.buckets.len(); n != 1 {
+		t.Errorf("Expected the idle keys to be removed but there are %d", n)
+	}
+}
+
+func TestRateLimitSettings(t *testing.T) {
+	t.Parallel()
+	for _, settings := range []string{
+		`{}`,
+		`{"rate": 0}`,
+		`{"rate": 1, "key": "cookie"}`,
+		`{"rate": 1, "max_keys": 0}`,
+		`{"rate": 1, "key": "cache_key"}`, // without a location
+	} {
+		if _, err := New(config.NewHandler("ratelimit", json.RawMessage(settings)), nil, okHandler); err == nil {
+			t.Errorf("Expected an error for the settings %s", settings)
+		}
+	}
+	if _, err := New(config.NewHandler("ratelimit", json.RawMessage(`{"rate": 1}`)), nil, nil); err == nil {
+		t.Error("Expected an error without a next handler")
+	}
+}
@@ -20,8 +20,9 @@ import (
 
 // ServerStatusHandler is a simple handler that handles the server status page.
 type ServerStatusHandler struct {
-	tmpl *template.Template
-	loc  *types.Location
+	tmpl   *template.Template
+	loc    *types.Location
+	stream *statsStream
 }
 
 // ServeHTTP servers the status page.
@@ -49,8 +50,14 @@ func (ssh *ServerStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	var stats = newStatistics(app, cacheZones)
-	sort.Sort(stats.CacheZones)
+	if ssh.stream != nil && strings.HasSuffix(r.URL.Path, streamSuffix) {
+		if err := ssh.stream.serve(w, r); err != nil {
+			ssh.loc.Logger.Errorf("[%s] error while streaming the statistics: %s", reqID, err)
+		}
+		return
+	}
+
+	var stats = NewStatistics(app, cacheZones)
 	var err error
 	if strings.HasSuffix(r.URL.Path, jsonSuffix) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -69,44 +76,112 @@ func (ssh *ServerStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	return
 }
 
-func newStatistics(app types.App, cacheZones map[string]*types.CacheZone) statisticsRoot {
-	var zones = make([]zoneStat, 0, len(cacheZones))
+// NewStatistics gathers the current statistics of the app and its cache
+// zones. The zones are sorted by their IDs.
+func NewStatistics(app types.App, cacheZones map[string]*types.CacheZone) Statistics {
+	var zones = make(zoneStats, 0, len(cacheZones))
 	for _, cacheZone := range cacheZones {
 		var stats = cacheZone.Algorithm.Stats()
-		zones = append(zones, zoneStat{
+		var zone = ZoneStatistics{
 			ID:          stats.ID(),
 			Hits:        stats.Hits(),
 			Requests:    stats.Requests(),
 			Objects:     stats.Objects(),
 			CacheHitPrc: stats.CacheHitPrc(),
 			Size:        stats.Size().Bytes(),
-		})
+			InFlight:    cacheZone.InFlight(),
+			Capacity:    stats.Capacity(),
+			MaxSize:     stats.MaxSize().Bytes(),
+			Drain:       string(cacheZone.DrainMode()),
+		}
+		zone.FillRatio = fillRatio(zone.Objects, zone.Capacity)
+		if r := fillRatio(zone.Size, zone.MaxSize); r > zone.FillRatio {
+			zone.FillRatio = r
+		}
+		zone.Reloading, zone.ReloadedObjects, zone.ReloadDiscarded = cacheZone.ReloadProgress()
+		if err := cacheZone.ReloadError(); err != nil {
+			zone.ReloadError = err.Error()
+		}
+		if r, ok := cacheZone.Storage.(types.DiskUsageReporter); ok {
+			// on error the last known usage is still reported
+			zone.DiskUsage, _ = r.DiskUsage()
+		}
+		if r, ok := cacheZone.Storage.(types.IOConcurrencyReporter); ok {
+			var io = r.IOConcurrency()
+			zone.IO = &io
+		}
+		zones = append(zones, zone)
 	}
+	sort.Sort(zones)
+
+	var upstreamsHealth = app.UpstreamsHealth()
+	var upstreamsConnections = app.UpstreamsConnections()
+	var upstreamsLatency = app.UpstreamsLatency()
+	var upstreamIDs = make(map[string]bool)
+	for id := range upstreamsHealth {
+		upstreamIDs[id] = true
+	}
+	for id := range upstreamsConnections {
+		upstreamIDs[id] = true
+	}
+	for id := range upstreamsLatency {
+		upstreamIDs[id] = true
+	}
+	var upstreams = make(upstreamStats, 0, len(upstreamIDs))
+	for id := range upstreamIDs {
+		var stats = UpstreamStatistics{
+			ID:          id,
+			Addresses:   upstreamsHealth[id],
+			Connections: upstreamsConnections[id],
+		}
+		if latency, ok := upstreamsLatency[id]; ok {
+			stats.Latency = &latency
+		}
+		upstreams = append(upstreams, stats)
+	}
+	sort.Sort(upstreams)
 
 	var appStats = app.Stats()
-	return statisticsRoot{
+	var memStats = app.MemoryStats()
+	return Statistics{
 		Requests:      appStats.Requests,
 		Responded:     appStats.Responded,
 		NotConfigured: appStats.NotConfigured,
 		InFlight:      appStats.Requests - appStats.Responded - appStats.NotConfigured,
 		CacheZones:    zones,
+		Upstreams:     upstreams,
 		Started:       app.Started(),
 		Version:       versionFromAppVersion(app.Version()),
 		CGOCalls:      uint64(runtime.NumCgoCall()),
 		Goroutines:    uint64(runtime.NumGoroutine()),
+		Memory: memoryStat{
+			Used:     memStats.Used,
+			Limit:    memStats.Limit,
+			Degraded: memStats.Degraded,
+		},
 	}
 }
 
-type statisticsRoot struct {
-	Requests      uint64    `json:"requests"`
-	Responded     uint64    `json:"responded"`
-	NotConfigured uint64    `json:"not_configured"`
-	InFlight      uint64    `json:"in_flight"`
-	Version       version   `json:"version"`
-	Started       time.Time `json:"started"`
-	CacheZones    zoneStats `json:"zones"`
-	CGOCalls      uint64    `json:"cgo_calls"`
-	Goroutines    uint64    `json:"goroutines"`
+// Statistics contains everything which is shown on the status page. It is
+// shared by all handlers which expose the statistics so that they match.
+type Statistics struct {
+	Requests      uint64        `json:"requests"`
+	Responded     uint64        `json:"responded"`
+	NotConfigured uint64        `json:"not_configured"`
+	InFlight      uint64        `json:"in_flight"`
+	Version       version       `json:"version"`
+	Started       time.Time     `json:"started"`
+	CacheZones    zoneStats     `json:"zones"`
+	Upstreams     upstreamStats `json:"upstreams"`
+	CGOCalls      uint64        `json:"cgo_calls"`
+	Goroutines    uint64        `json:"goroutines"`
+	Memory        memoryStat    `json:"memory"`
+}
+
+type memoryStat struct {
+	Used     uint64 `json:"used"`
+	Limit    uint64 `json:"limit"`
+	Degraded bool   `json:"degraded"`
 }
 
 type version struct {
@@ -127,13 +202,65 @@ func versionFromAppVersion(appVersion types.AppVersion) version {
 	}
 }
 
-type zoneStat struct {
+// ZoneStatistics contains the statistics of a single cache zone.
+type ZoneStatistics struct {
 	ID          string `json:"id"`
 	Hits        uint64 `json:"hits"`
 	Requests    uint64 `json:"requests"`
 	Objects     uint64 `json:"objects"`
 	CacheHitPrc string `json:"hit_percentage"`
 	Size        uint64 `json:"size"`
+	DiskUsage   uint64 `json:"disk_usage"`
+	InFlight    uint64 `json:"in_flight"`
+	// IO are the reads and writes of the parts of the zone which are running
+	// and waiting for their turn, if the storage counts them.
+	IO *types.IOConcurrency `json:"io,omitempty"`
+	// Capacity is the maximum number of objects in the zone and MaxSize the
+	// maximum size of its objects, if it is limited. FillRatio is how close
+	// the zone is to either of them, the objects are evicted when it is 1.
+	Capacity  uint64  `json:"capacity"`
+	MaxSize   uint64  `json:"max_size"`
+	FillRatio float64 `json:"fill_ratio"`
+	// Drain is the drain mode of the zone, if it is being drained.
+	Drain string `json:"drain,omitempty"`
+	// ReloadError is the reason for aborting the loading of the stored
+	// objects on start, if it was aborted.
+	ReloadError string `json:"reload_error,omitempty"`
+	// Reloading is whether the stored objects are still being loaded, i.e.
+	// the zone is warming up after a start. ReloadedObjects are the objects
+	// loaded so far and ReloadDiscarded are the ones of them which were
+	// discarded because they had expired.
+	Reloading       bool   `json:"reloading"`
+	ReloadedObjects uint64 `json:"reloaded_objects"`
+	ReloadDiscarded uint64 `json:"reload_discarded"`
+}
+
+// FillPercentage returns the fill ratio of the zone as a percentage such
+// as '53%'.
+func (zs ZoneStatistics) FillPercentage() string {
+	return fmt.Sprintf("%.f%%", zs.FillRatio*100)
+}
+
+// fillRatio returns the ratio of the used to the limit, if there is one.
+func fillRatio(used, limit uint64) float64 {
+	if limit == 0 {
+		return 0
+	}
+	return float64(used) / float64(limit)
+}
+
+// UpstreamStatistics contains the health of the addresses of an upstream
+// with active health checks, the requests to the addresses of an upstream
+// with a connection limit and the response times of the upstream.
+type UpstreamStatistics struct {
+	ID        string                        `json:"id"`
+	Addresses []types.UpstreamAddressHealth `json:"addresses"`
+	// Connections are the requests in flight and waiting for the addresses
+	// which have any.
+	Connections []types.UpstreamAddressConnections `json:"connections,omitempty"`
+	// Latency is the distribution of the response times, if the upstream
+	// has responded.
+	Latency *types.UpstreamLatency `json:"latency,omitempty"`
 }
 
 // New creates and returns a ready to used ServerStatusHandler.
@@ -170,13 +297,22 @@ func New(cfg *config.Handler, l *types.Location, next http.Handler) (*ServerStat
 		return nil, fmt.Errorf("error on opening %s - %s", statusFilePath, err)
 	}
 
+	var stream *statsStream
+	if s.StreamInterval > 0 {
+		stream = newStatsStream(time.Duration(s.StreamInterval)*time.Millisecond, l.Logger)
+	}
+
 	return &ServerStatusHandler{
-		tmpl: tmpl,
-		loc:  l,
+		tmpl:   tmpl,
+		loc:    l,
+		stream: stream,
 	}, nil
 }
 
-const jsonSuffix = ".json"
+const (
+	jsonSuffix   = ".json"
+	streamSuffix = ".stream"
+)
 
 var defaultSettings = serverStatusHandlerSettings{
 	Path: "handler/status/templates",
@@ -184,9 +320,13 @@ var defaultSettings = serverStatusHandlerSettings{
 
 type serverStatusHandlerSettings struct {
 	Path string `json:"path"`
+	// StreamInterval is the interval in milliseconds at which the changes
+	// of the statistics are sent to the clients of the stream. Zero
+	// disables the stream.
+	StreamInterval uint32 `json:"stream_interval"`
 }
 
-type zoneStats []zoneStat
+type zoneStats []ZoneStatistics
 
 func (c zoneStats) Len() int {
 	return len(c)
@@ -199,3 +339,17 @@ func (c zoneStats) Less(i, j int) bool {
 func (c zoneStats) Swap(i, j int) {
 	c[j], (c)[i] = c[i], c[j]
 }
+
+type upstreamStats []UpstreamStatistics
+
+func (u upstreamStats) Len() int {
+	return len(u)
+}
+
+func (u upstreamStats) Less(i, j int) bool {
+	return u[i].ID < u[j].ID
+}
+
+func (u upstreamStats) Swap(i, j int) {
+	u[i], u[j] = u[j], u[i]
+}
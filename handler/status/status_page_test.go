@@ -0,0 +1,100 @@
+package status
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/cache/lru"
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestZoneCapacityAndFillRatio(t *testing.T) {
+	t.Parallel()
+	var cz = &config.CacheZone{ID: "zone", Path: "/zone", StorageObjects: 10, MaxSize: 40, PartSize: 10}
+	var zone = &types.CacheZone{ID: cz.ID, Algorithm: lru.New(cz, nil, mock.NewLogger())}
+	var app = &fakeApp{zone: zone}
+	var zones = map[string]*types.CacheZone{zone.ID: zone}
+
+	for i := uint32(0); i < 3; i++ {
+		var oi = &types.ObjectIndex{ObjID: types.NewObjectID("k", "/filled"), Part: i}
+		if err := zone.Algorithm.AddObject(oi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats = NewStatistics(app, zones).CacheZones[0]
+	if stats.Capacity != 10 || stats.MaxSize != 40 {
+		t.Errorf("Expected the limits of the zone config but got %d objects and %d bytes",
+			stats.Capacity, stats.MaxSize)
+	}
+	// the size is closer to its limit than the number of objects
+	if math.Abs(stats.FillRatio-0.75) > 1e-9 {
+		t.Errorf("Expected fill ratio 0.75 but got %f", stats.FillRatio)
+	}
+
+	zone.Algorithm.ChangeConfig(cz.BulkRemoveTimeout, cz.BulkRemoveCount, 30, 0)
+	stats = NewStatistics(app, zones).CacheZones[0]
+	if stats.Capacity != 30 || stats.MaxSize != 0 || math.Abs(stats.FillRatio-0.1) > 1e-9 {
+		t.Errorf("Expected the reloaded limits to be used but got %+v", stats)
+	}
+
+	var ssh = &ServerStatusHandler{
+		tmpl: template.Must(template.ParseFiles("templates/status_page.html")),
+		loc:  &types.Location{Logger: mock.NewLogger()},
+	}
+	var serve = func(path string) string {
+		var req = httptest.NewRequest("GET", "http://example.com"+path, nil)
+		var ctx = contexts.NewAppContext(req.Context(), app)
+		ctx = contexts.NewCacheZonesContext(ctx, zones)
+		var rec = httptest.NewRecorder()
+		ssh.ServeHTTP(rec, req.WithContext(ctx))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s but got %d", path, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	var decoded Statistics
+	if err := json.Unmarshal([]byte(serve("/status.json")), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.CacheZones) != 1 || decoded.CacheZones[0].Capacity != 30 {
+		t.Errorf("Expected the capacity in the JSON statistics but got %+v", decoded.CacheZones)
+	}
+	if page := serve("/status"); !strings.Contains(page, `style="width: 10%"`) {
+		t.Errorf("Expected a fill bar of 10%% on the status page")
+	}
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	t.Parallel()
+	var cz = &config.CacheZone{ID: "zone", Path: "/zone", StorageObjects: 10, PartSize: 10}
+	var zone = &types.CacheZone{ID: cz.ID, Algorithm: lru.New(cz, nil, mock.NewLogger())}
+	var latency = types.UpstreamLatency{Requests: 3, P50: 12 * time.Millisecond, P95: time.Second}
+	var app = &fakeApp{zone: zone, latency: map[string]types.UpstreamLatency{"origin": latency}}
+
+	var stats = NewStatistics(app, map[string]*types.CacheZone{zone.ID: zone})
+	if len(stats.Upstreams) != 1 || stats.Upstreams[0].ID != "origin" ||
+		stats.Upstreams[0].Latency == nil || *stats.Upstreams[0].Latency != latency {
+		t.Errorf("Expected the latency of the upstream in the statistics but got %+v", stats.Upstreams)
+	}
+
+	var page bytes.Buffer
+	var tmpl = template.Must(template.ParseFiles("templates/status_page.html"))
+	if err := tmpl.Execute(&page, stats); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), "<td>12ms</td>") {
+		t.Errorf("Expected the median latency on the status page")
+	}
+}
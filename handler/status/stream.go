@@ -0,0 +1,201 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// statsStream periodically computes the changes of the statistics and sends
+// them to all of its subscribers as rates per second. The statistics are
+// gathered once for all subscribers and only while there are any.
+type statsStream struct {
+	interval time.Duration
+	logger   types.Logger
+
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+	stop        chan struct{}
+	// the context of the last subscriber, from which the app and its cache
+	// zones are taken, so that the changes of the configuration are seen
+	ctx context.Context
+}
+
+func newStatsStream(interval time.Duration, logger types.Logger) *statsStream {
+	return &statsStream{
+		interval:    interval,
+		logger:      logger,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+}
+
+// subscribe returns a channel on which the encoded deltas are received. The
+// stream is started with the first subscriber.
+func (s *statsStream) subscribe(ctx context.Context) chan []byte {
+	// a subscriber which is too slow misses the events which do not fit
+	var ch = make(chan []byte, 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers[ch] = struct{}{}
+	// only the values of the context are used after the request is done
+	s.ctx = contexts.Detach(ctx)
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+		go s.run(s.stop)
+	}
+	return ch
+}
+
+// unsubscribe removes the subscriber. The stream is stopped with the last one.
+func (s *statsStream) unsubscribe(ch chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, ch)
+	if len(s.subscribers) == 0 && s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *statsStream) run(stop chan struct{}) {
+	var ticker = time.NewTicker(s.interval)
+	defer ticker.Stop()
+	var prev, prevTime = s.statistics(), time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			var cur = s.statistics()
+			data, err := json.Marshal(newStatsDelta(prev, cur, now.Sub(prevTime)))
+			if err != nil {
+				s.logger.Errorf("Error while encoding the statistics deltas: %s", err)
+				continue
+			}
+			prev, prevTime = cur, now
+			s.broadcast(data)
+		}
+	}
+}
+
+// statistics gathers the statistics of the app and the cache zones which are
+// in the context of the last subscriber at the moment.
+func (s *statsStream) statistics() Statistics {
+	s.mu.Lock()
+	var ctx = s.ctx
+	s.mu.Unlock()
+	app, _ := contexts.GetApp(ctx)
+	cacheZones, _ := contexts.GetCacheZones(ctx)
+	return NewStatistics(app, cacheZones)
+}
+
+func (s *statsStream) broadcast(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+// serve sends the deltas to the client as server-sent events until it
+// disconnects.
+func (s *statsStream) serve(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return fmt.Errorf("the response writer does not support streaming")
+	}
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var ch = s.subscribe(r.Context())
+	defer s.unsubscribe(ch)
+	for {
+		select {
+		case data := <-ch:
+			if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", data); err != nil {
+				return nil // the client is gone
+			}
+			flusher.Flush()
+		case <-closed:
+			return nil
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+// statsDelta contains the rates per second at which the statistics changed
+// during the last interval. The gauges are sent with their current values.
+type statsDelta struct {
+	Interval      float64     `json:"interval"`
+	Requests      float64     `json:"requests"`
+	Responded     float64     `json:"responded"`
+	NotConfigured float64     `json:"not_configured"`
+	InFlight      uint64      `json:"in_flight"`
+	CacheZones    []zoneDelta `json:"zones"`
+}
+
+type zoneDelta struct {
+	ID       string  `json:"id"`
+	Requests float64 `json:"requests"`
+	Hits     float64 `json:"hits"`
+	Size     float64 `json:"size"`
+	Objects  uint64  `json:"objects"`
+	// IO is the gauge of the running and waiting operations of the storage
+	IO *types.IOConcurrency `json:"io,omitempty"`
+}
+
+func newStatsDelta(prev, cur Statistics, elapsed time.Duration) statsDelta {
+	var seconds = elapsed.Seconds()
+	var result = statsDelta{
+		Interval:      seconds,
+		Requests:      counterRate(prev.Requests, cur.Requests, seconds),
+		Responded:     counterRate(prev.Responded, cur.Responded, seconds),
+		NotConfigured: counterRate(prev.NotConfigured, cur.NotConfigured, seconds),
+		InFlight:      cur.InFlight,
+		CacheZones:    make([]zoneDelta, 0, len(cur.CacheZones)),
+	}
+
+	var prevZones = make(map[string]ZoneStatistics, len(prev.CacheZones))
+	for _, zone := range prev.CacheZones {
+		prevZones[zone.ID] = zone
+	}
+	for _, zone := range cur.CacheZones {
+		var p = prevZones[zone.ID]
+		result.CacheZones = append(result.CacheZones, zoneDelta{
+			ID:       zone.ID,
+			Requests: counterRate(p.Requests, zone.Requests, seconds),
+			Hits:     counterRate(p.Hits, zone.Hits, seconds),
+			Size:     (float64(zone.Size) - float64(p.Size)) / seconds,
+			Objects:  zone.Objects,
+			IO:       zone.IO,
+		})
+	}
+	return result
+}
+
+// counterRate returns the rate at which the counter increased. A counter which
+// decreased was reset, so all of its current value is new.
+func counterRate(prev, cur uint64, seconds float64) float64 {
+	if cur < prev {
+		prev = 0
+	}
+	return float64(cur-prev) / seconds
+}
@@ -0,0 +1,206 @@
+package status
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/cache/lru"
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// fakeApp receives 5 requests, 2 of which for the cache zone, every time its
+// statistics are gathered.
+type fakeApp struct {
+	types.App
+	sync.Mutex
+	requests uint64
+	zone     *types.CacheZone
+	latency  map[string]types.UpstreamLatency
+}
+
+func (a *fakeApp) Stats() types.AppStats {
+	a.Lock()
+	defer a.Unlock()
+	a.requests += 5
+	for i := 0; i < 2; i++ {
+		a.zone.Algorithm.Lookup(&types.ObjectIndex{ObjID: types.NewObjectID("k", "/p")})
+	}
+	return types.AppStats{Requests: a.requests, Responded: a.requests}
+}
+
+func (a *fakeApp) MemoryStats() types.MemoryStats { return types.MemoryStats{} }
+func (a *fakeApp) Started() time.Time             { return time.Time{} }
+func (a *fakeApp) Version() types.AppVersion      { return types.AppVersion{} }
+func (a *fakeApp) UpstreamsHealth() map[string][]types.UpstreamAddressHealth {
+	return nil
+}
+func (a *fakeApp) UpstreamsConnections() map[string][]types.UpstreamAddressConnections {
+	return nil
+}
+func (a *fakeApp) UpstreamsLatency() map[string]types.UpstreamLatency {
+	return a.latency
+}
+
+func newTestStream(t *testing.T, interval time.Duration) (*ServerStatusHandler, *httptest.Server) {
+	var cz = &config.CacheZone{ID: "zone", Path: "/zone", StorageObjects: 10, PartSize: 10}
+	var zone = &types.CacheZone{ID: cz.ID, Algorithm: lru.New(cz, nil, mock.NewLogger())}
+	var app = &fakeApp{zone: zone}
+	var ssh = &ServerStatusHandler{
+		loc:    &types.Location{Logger: mock.NewLogger()},
+		stream: newStatsStream(interval, mock.NewLogger()),
+	}
+	var ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ctx = contexts.NewAppContext(r.Context(), app)
+		ctx = contexts.NewCacheZonesContext(ctx, map[string]*types.CacheZone{zone.ID: zone})
+		ssh.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	return ssh, ts
+}
+
+// subscribe returns a channel on which the received deltas are sent.
+func subscribe(ctx context.Context, t *testing.T, url string) <-chan statsDelta {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream but got content type %q", ct)
+	}
+	var result = make(chan statsDelta, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(result)
+		var scanner = bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var line = scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var delta statsDelta
+			if err := json.Unmarshal([]byte(line[len("data: "):]), &delta); err != nil {
+				t.Errorf("Could not decode event %q: %s", line, err)
+				return
+			}
+			result <- delta
+		}
+	}()
+	return result
+}
+
+func TestStatsStream(t *testing.T) {
+	t.Parallel()
+	const interval = 50 * time.Millisecond
+	ssh, ts := newTestStream(t, interval)
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var first, second = subscribe(ctx, t, ts.URL+"/status.stream"),
+		subscribe(ctx, t, ts.URL+"/status.stream")
+	var start = time.Now()
+	for i := 0; i < 3; i++ {
+		for _, events := range []<-chan statsDelta{first, second} {
+			var delta, ok = <-events
+			if !ok {
+				t.Fatal("The stream ended unexpectedly")
+			}
+			if math.Abs(delta.Interval-interval.Seconds()) > interval.Seconds()/2 {
+				t.Errorf("Expected an interval of %s but got %gs", interval, delta.Interval)
+			}
+			// the statistics are gathered once for both subscribers
+			if requests := delta.Requests * delta.Interval; math.Abs(requests-5) > 0.01 {
+				t.Errorf("Expected 5 requests in the interval but got %g", requests)
+			}
+			if len(delta.CacheZones) != 1 {
+				t.Fatalf("Expected the deltas for one zone but got %+v", delta.CacheZones)
+			}
+			if requests := delta.CacheZones[0].Requests * delta.Interval; math.Abs(requests-2) > 0.01 {
+				t.Errorf("Expected 2 zone requests in the interval but got %g", requests)
+			}
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("Expected the 3 events to take at least %s but they took %s", 2*interval, elapsed)
+	}
+
+	cancel()
+	for i := 0; i < 100; i++ {
+		ssh.stream.mu.Lock()
+		var subscribers, running = len(ssh.stream.subscribers), ssh.stream.stop != nil
+		ssh.stream.mu.Unlock()
+		if subscribers == 0 && !running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the subscribers to be removed and the stream stopped after they disconnected")
+}
+
+func TestStatsStreamFollowsTheCacheZones(t *testing.T) {
+	t.Parallel()
+	var newZone = func(id string) *types.CacheZone {
+		var cz = &config.CacheZone{ID: id, Path: "/" + id, StorageObjects: 10, PartSize: 10}
+		return &types.CacheZone{ID: cz.ID, Algorithm: lru.New(cz, nil, mock.NewLogger())}
+	}
+	var old, added = newZone("old"), newZone("added")
+	var app = &fakeApp{zone: old}
+	var ssh = &ServerStatusHandler{
+		loc:    &types.Location{Logger: mock.NewLogger()},
+		stream: newStatsStream(20*time.Millisecond, mock.NewLogger()),
+	}
+	var mu sync.Mutex
+	var current = old
+	var ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		var zones = map[string]*types.CacheZone{current.ID: current}
+		mu.Unlock()
+		var ctx = contexts.NewAppContext(r.Context(), app)
+		ctx = contexts.NewCacheZonesContext(ctx, zones)
+		ssh.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the statistics of the zones are identified by their paths
+	var expectZone = func(events <-chan statsDelta, id string) {
+		var deadline = time.After(2 * time.Second)
+		for {
+			select {
+			case delta, ok := <-events:
+				if !ok {
+					t.Fatal("The stream ended unexpectedly")
+				}
+				if len(delta.CacheZones) == 1 && delta.CacheZones[0].ID == id {
+					return
+				}
+			case <-deadline:
+				t.Fatalf("Expected the deltas for the zone %s only", id)
+			}
+		}
+	}
+	var first = subscribe(ctx, t, ts.URL+"/status.stream")
+	expectZone(first, "/old")
+
+	// the configuration is reloaded
+	mu.Lock()
+	current = added
+	mu.Unlock()
+	subscribe(ctx, t, ts.URL+"/status.stream")
+	expectZone(first, "/added")
+}
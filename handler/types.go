@@ -10,13 +10,18 @@ import (
 	"github.com/ironsmile/nedomi/config"
 
 	"github.com/ironsmile/nedomi/handler/cache"
+	"github.com/ironsmile/nedomi/handler/compress"
 	"github.com/ironsmile/nedomi/handler/dir"
+	"github.com/ironsmile/nedomi/handler/drain"
 	"github.com/ironsmile/nedomi/handler/flv"
 	"github.com/ironsmile/nedomi/handler/headers"
 	"github.com/ironsmile/nedomi/handler/mp4"
 	"github.com/ironsmile/nedomi/handler/pprof"
+	"github.com/ironsmile/nedomi/handler/preload"
+	"github.com/ironsmile/nedomi/handler/prometheus"
 	"github.com/ironsmile/nedomi/handler/proxy"
 	"github.com/ironsmile/nedomi/handler/purge"
+	"github.com/ironsmile/nedomi/handler/ratelimit"
 	"github.com/ironsmile/nedomi/handler/status"
 	"github.com/ironsmile/nedomi/handler/throttle"
 	"github.com/ironsmile/nedomi/types"
@@ -28,10 +33,18 @@ var handlerTypes = map[string]newHandlerFunc{
 		return cache.New(cfg, l, next)
 	},
 
+	"compress": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
+		return compress.New(cfg, l, next)
+	},
+
 	"dir": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
 		return dir.New(cfg, l, next)
 	},
 
+	"drain": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
+		return drain.New(cfg, l, next)
+	},
+
 	"flv": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
 		return flv.New(cfg, l, next)
 	},
@@ -48,6 +61,14 @@ var handlerTypes = map[string]newHandlerFunc{
 		return pprof.New(cfg, l, next)
 	},
 
+	"preload": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
+		return preload.New(cfg, l, next)
+	},
+
+	"prometheus": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
+		return prometheus.New(cfg, l, next)
+	},
+
 	"proxy": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
 		return proxy.New(cfg, l, next)
 	},
@@ -56,6 +77,10 @@ var handlerTypes = map[string]newHandlerFunc{
 		return purge.New(cfg, l, next)
 	},
 
+	"ratelimit": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
+		return ratelimit.New(cfg, l, next)
+	},
+
 	"status": func(cfg *config.Handler, l *types.Location, next http.Handler) (http.Handler, error) {
 		return status.New(cfg, l, next)
 	},
@@ -16,6 +16,8 @@ import (
 
 	"github.com/ironsmile/nedomi/app"
 	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/logger"
+	"github.com/ironsmile/nedomi/storage/disk"
 	"github.com/ironsmile/nedomi/types"
 )
 
@@ -36,15 +38,18 @@ var (
 
 // The following will be populated from the command line with via `flag`
 var (
-	testConfig  bool
-	showVersion bool
-	cpuprofile  string
+	testConfig      bool
+	showVersion     bool
+	cpuprofile      string
+	migratePartSize bool
 )
 
 func init() {
 	flag.BoolVar(&testConfig, "t", false, "Test configuration file and exit")
 	flag.BoolVar(&showVersion, "v", false, "Print version information")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "Write cpu profile to this file")
+	flag.BoolVar(&migratePartSize, "migrate-partsize", false,
+		"Convert the disk cache zones whose part size was changed and exit")
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
@@ -78,6 +83,10 @@ func run() int {
 		return 0
 	}
 
+	if migratePartSize {
+		return migratePartSizes()
+	}
+
 	appInstance, err := app.New(appVersion, config.Get)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't initialize nedomi: %s\n", err)
@@ -101,6 +110,31 @@ func run() int {
 	return 0
 }
 
+// migratePartSizes converts the disk storages of all cache zones from the part
+// size with which they were last used to the configured one.
+func migratePartSizes() int {
+	cfg, err := config.Get()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read the config: %s\n", err)
+		return 4
+	}
+	log, err := logger.New(&cfg.Logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't initialize the logger: %s\n", err)
+		return 4
+	}
+	for _, cz := range cfg.CacheZones {
+		if cz.Type != "disk" && cz.Type != "composite" {
+			continue
+		}
+		if err := disk.MigratePartSize(cz, log); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't migrate the cache zone %s: %s\n", cz.ID, err)
+			return 7
+		}
+	}
+	return 0
+}
+
 func absolutizeArgv0() error {
 	if filepath.IsAbs(os.Args[0]) {
 		return nil
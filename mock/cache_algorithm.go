@@ -77,7 +77,7 @@ func (c *CacheAlgorithm) Stats() types.CacheStats {
 }
 
 // ChangeConfig does nothing
-func (c *CacheAlgorithm) ChangeConfig(_, _, _ uint64) {
+func (c *CacheAlgorithm) ChangeConfig(_, _, _ uint64, _ types.BytesSize) {
 }
 
 // SetFakeReplies is used to customize the replies for certain indexes
@@ -108,6 +108,9 @@ func NewCacheAlgorithm(defaults *CacheAlgorithmRepliers) *CacheAlgorithm {
 	if defaults.PromoteObject != nil {
 		res.Defaults.PromoteObject = defaults.PromoteObject
 	}
+	if defaults.Remove != nil {
+		res.Defaults.Remove = defaults.Remove
+	}
 
 	return res
 }
@@ -77,6 +77,17 @@ func (s *Storage) SaveMetadata(m *types.ObjectMetadata) error {
 	return nil
 }
 
+// UpdateMetadata replaces the metadata of an already saved object.
+func (s *Storage) UpdateMetadata(m *types.ObjectMetadata) error {
+	if _, ok := s.Objects[m.ID.Hash()]; !ok {
+		return os.ErrNotExist
+	}
+
+	s.Objects[m.ID.Hash()] = m
+
+	return nil
+}
+
 // SavePart saves the contents of the supplied object part.
 func (s *Storage) SavePart(idx *types.ObjectIndex, data io.Reader) error {
 	objHash := idx.ObjID.Hash()
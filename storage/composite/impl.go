@@ -0,0 +1,284 @@
+// Package composite implements a storage which wraps two other storages and
+// places every object in one of them depending on its size. Small objects go
+// to the first one and large objects to the second one. The placement is
+// decided once, when the metadata of the object is saved, and the object is
+// never moved between them afterwards.
+package composite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/storage/disk"
+	"github.com/ironsmile/nedomi/storage/memory"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// Composite implements the Storage interface by routing every object to one of
+// two storages according to the size recorded in its metadata.
+type Composite struct {
+	small, large  types.Storage
+	sizeThreshold uint64
+}
+
+// PartSize the maximum part size for the composite storage.
+func (c *Composite) PartSize() uint64 {
+	return c.large.PartSize()
+}
+
+// storageFor returns the storage which holds the object with the provided id.
+// The small storage is consulted first as it is expected to be the faster one.
+// Objects which are in neither of the storages belong to the large one.
+func (c *Composite) storageFor(id *types.ObjectID) types.Storage {
+	if _, err := c.small.GetMetadata(id); err == nil {
+		return c.small
+	}
+	return c.large
+}
+
+// GetMetadata returns the metadata for this object, if present.
+func (c *Composite) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
+	if obj, err := c.small.GetMetadata(id); err == nil {
+		return obj, nil
+	}
+	return c.large.GetMetadata(id)
+}
+
+// GetPart returns an io.ReadCloser that will read the specified part of the
+// object from the storage it was placed in.
+func (c *Composite) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
+	return c.storageFor(idx.ObjID).GetPart(idx)
+}
+
+// GetAvailableParts returns types.ObjectIndexMap including all the available
+// parts of for the object specified by the provided objectMetadata
+func (c *Composite) GetAvailableParts(oid *types.ObjectID) ([]*types.ObjectIndex, error) {
+	return c.storageFor(oid).GetAvailableParts(oid)
+}
+
+// SaveMetadata saves the supplied metadata in the small storage if the size of
+// the object is not over the threshold or in the large one otherwise.
+func (c *Composite) SaveMetadata(m *types.ObjectMetadata) error {
+	var target, other = c.large, c.small
+	// Parts saved before the metadata (when the size was not known in
+	// advance) are in the large storage and the object stays there
+	if parts, _ := c.large.GetAvailableParts(m.ID); m.Size <= c.sizeThreshold && len(parts) == 0 {
+		target, other = c.small, c.large
+	}
+	// The size of the object might have changed since it was last saved
+	if _, err := other.GetMetadata(m.ID); err == nil {
+		if err := other.Discard(m.ID); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return target.SaveMetadata(m)
+}
+
+// GetPartContext works like GetPart, but the waiting of the storage the object
+// was placed in stops when the context is done, if it supports that.
+func (c *Composite) GetPartContext(ctx context.Context, idx *types.ObjectIndex) (io.ReadCloser, error) {
+	var st = c.storageFor(idx.ObjID)
+	if cs, ok := st.(types.ContextPartStorage); ok {
+		return cs.GetPartContext(ctx, idx)
+	}
+	return st.GetPart(idx)
+}
+
+// UpdateMetadata replaces the metadata of an object in the storage it was
+// placed in. The object is not moved even if its size crossed the threshold.
+func (c *Composite) UpdateMetadata(m *types.ObjectMetadata) error {
+	return c.storageFor(m.ID).UpdateMetadata(m)
+}
+
+// SavePart saves the contents of the supplied object part to the storage in
+// which the metadata of the object was placed. Parts of objects without saved
+// metadata go to the large storage.
+func (c *Composite) SavePart(idx *types.ObjectIndex, data io.Reader) error {
+	return c.storageFor(idx.ObjID).SavePart(idx, data)
+}
+
+// SavePartContext works like SavePart, but the waiting of the storage the
+// object was placed in stops when the context is done, if it supports that.
+func (c *Composite) SavePartContext(ctx context.Context, idx *types.ObjectIndex, data io.Reader) error {
+	var st = c.storageFor(idx.ObjID)
+	if cs, ok := st.(types.ContextPartStorage); ok {
+		return cs.SavePartContext(ctx, idx, data)
+	}
+	return st.SavePart(idx, data)
+}
+
+// Discard removes the object and its metadata from both storages.
+func (c *Composite) Discard(id *types.ObjectID) error {
+	var smallErr, largeErr = c.small.Discard(id), c.large.Discard(id)
+	if os.IsNotExist(smallErr) {
+		return largeErr
+	}
+	if os.IsNotExist(largeErr) {
+		return smallErr
+	}
+	if smallErr != nil || largeErr != nil {
+		return utils.NewCompositeError(smallErr, largeErr)
+	}
+	return nil
+}
+
+// DiscardPart removes the specified part of an Object from the storage it was
+// placed in.
+func (c *Composite) DiscardPart(idx *types.ObjectIndex) error {
+	return c.storageFor(idx.ObjID).DiscardPart(idx)
+}
+
+// EvictPart implements types.PartEvictor by evicting the part from the
+// storage it was placed in.
+func (c *Composite) EvictPart(idx *types.ObjectIndex) error {
+	var st = c.storageFor(idx.ObjID)
+	if pe, ok := st.(types.PartEvictor); ok {
+		return pe.EvictPart(idx)
+	}
+	return st.DiscardPart(idx)
+}
+
+// FinishFill implements types.FillFinisher by finishing the fill in the
+// storage the object was placed in.
+func (c *Composite) FinishFill(id *types.ObjectID) error {
+	if ff, ok := c.storageFor(id).(types.FillFinisher); ok {
+		return ff.FinishFill(id)
+	}
+	return nil
+}
+
+// Iterate iterates over the objects in both storages and passes them to the
+// supplied callback function. If the callback function returns false, the
+// iteration stops.
+func (c *Composite) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool) error {
+	var stopped bool
+	var wrapped = func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+		stopped = !callback(obj, parts...)
+		return !stopped
+	}
+	if err := c.small.Iterate(wrapped); err != nil || stopped {
+		return err
+	}
+	return c.large.Iterate(wrapped)
+}
+
+// IterateWithErrors works like Iterate and reports the objects which could
+// not be loaded by the underlying storages which support it.
+func (c *Composite) IterateWithErrors(
+	callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool,
+	onError func(error) bool,
+) error {
+	var stopped bool
+	var wrapped = func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+		stopped = !callback(obj, parts...)
+		return !stopped
+	}
+	var wrappedOnError = func(err error) bool {
+		stopped = !onError(err)
+		return !stopped
+	}
+	var iterate = func(s types.Storage) error {
+		if r, ok := s.(types.IterationErrorsReporter); ok {
+			return r.IterateWithErrors(wrapped, wrappedOnError)
+		}
+		return s.Iterate(wrapped)
+	}
+	if err := iterate(c.small); err != nil || stopped {
+		return err
+	}
+	return iterate(c.large)
+}
+
+// DiskUsage returns the disk usage of the large storage, if it is on the disk.
+func (c *Composite) DiskUsage() (uint64, error) {
+	if r, ok := c.large.(types.DiskUsageReporter); ok {
+		return r.DiskUsage()
+	}
+	return 0, nil
+}
+
+// IOConcurrency returns the concurrent operations of the large storage, if it
+// is on the disk.
+func (c *Composite) IOConcurrency() types.IOConcurrency {
+	if r, ok := c.large.(types.IOConcurrencyReporter); ok {
+		return r.IOConcurrency()
+	}
+	return types.IOConcurrency{}
+}
+
+// OnQuotaExceeded sets the reclaim function of the large storage, if it
+// limits the bytes it stores.
+func (c *Composite) OnQuotaExceeded(reclaim func(bytes uint64)) {
+	if qe, ok := c.large.(types.QuotaEnforcer); ok {
+		qe.OnQuotaExceeded(reclaim)
+	}
+}
+
+// CreateTempFile creates a temporary file with the large storage, if it is on
+// the disk.
+func (c *Composite) CreateTempFile() (*os.File, error) {
+	if tc, ok := c.large.(types.TempFileCreator); ok {
+		return tc.CreateTempFile()
+	}
+	return nil, fmt.Errorf("the large storage can not create temporary files")
+}
+
+// Stop stops the background work of both storages.
+func (c *Composite) Stop() {
+	for _, st := range []types.Storage{c.small, c.large} {
+		if stopper, ok := st.(types.Stopper); ok {
+			stopper.Stop()
+		}
+	}
+}
+
+// SetLogger changes the logger of both storages.
+func (c *Composite) SetLogger(l types.Logger) {
+	c.small.SetLogger(l)
+	c.large.SetLogger(l)
+}
+
+// NewWithStorages returns a composite storage which places objects with size up
+// to sizeThreshold in small and all other objects in large.
+func NewWithStorages(small, large types.Storage, sizeThreshold uint64) (*Composite, error) {
+	if small == nil || large == nil {
+		return nil, fmt.Errorf("nil storages supplied")
+	}
+	if small.PartSize() != large.PartSize() {
+		return nil, fmt.Errorf("the storages have different part sizes: %d and %d",
+			small.PartSize(), large.PartSize())
+	}
+	return &Composite{
+		small:         small,
+		large:         large,
+		sizeThreshold: sizeThreshold,
+	}, nil
+}
+
+// New returns a new composite storage that keeps the objects up to the
+// configured size threshold in memory and all other objects on the disk.
+func New(cfg *config.CacheZone, log types.Logger) (*Composite, error) {
+	if cfg == nil || log == nil {
+		return nil, fmt.Errorf("nil constructor parameters")
+	}
+
+	if cfg.SizeThreshold == 0 {
+		return nil, fmt.Errorf("composite storage needs size_threshold")
+	}
+
+	small, err := memory.New(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	large, err := disk.New(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithStorages(small, large, cfg.SizeThreshold.Bytes())
+}
@@ -0,0 +1,160 @@
+package composite
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func getTestCompositeStorage(t *testing.T) (*Composite, func()) {
+	path, cleanup := testutils.GetTestFolder(t)
+	c, err := New(&config.CacheZone{
+		Path:          path,
+		PartSize:      5,
+		SizeThreshold: 10,
+	}, mock.NewLogger())
+	if err != nil {
+		cleanup()
+		t.Fatalf("Could not create storage: %s", err)
+	}
+	return c, cleanup
+}
+
+func saveObject(t *testing.T, c *Composite, path, contents string) *types.ObjectID {
+	var id = types.NewObjectID("test", path)
+	if err := c.SaveMetadata(&types.ObjectMetadata{
+		ID:   id,
+		Size: uint64(len(contents)),
+	}); err != nil {
+		t.Fatalf("Could not save metadata for %s: %s", id, err)
+	}
+	for i := 0; i*5 < len(contents); i++ {
+		var part = contents[i*5:]
+		if len(part) > 5 {
+			part = part[:5]
+		}
+		idx := &types.ObjectIndex{ObjID: id, Part: uint32(i)}
+		if err := c.SavePart(idx, strings.NewReader(part)); err != nil {
+			t.Fatalf("Could not save part %s: %s", idx, err)
+		}
+	}
+	return id
+}
+
+func checkObject(t *testing.T, s types.Storage, id *types.ObjectID, contents string) {
+	var read string
+	for i := 0; i*5 < len(contents); i++ {
+		r, err := s.GetPart(&types.ObjectIndex{ObjID: id, Part: uint32(i)})
+		if err != nil {
+			t.Fatalf("Could not get part %d of %s: %s", i, id, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Could not read part %d of %s: %s", i, id, err)
+		}
+		read += string(b)
+	}
+	if read != contents {
+		t.Errorf("Expected to read '%s' but got '%s'", contents, read)
+	}
+}
+
+func TestPlacementBySize(t *testing.T) {
+	t.Parallel()
+	c, cleanup := getTestCompositeStorage(t)
+	defer cleanup()
+
+	var smallContents, largeContents = "small", "this one is large"
+	var small = saveObject(t, c, "/small", smallContents)
+	var large = saveObject(t, c, "/large", largeContents)
+
+	if _, err := c.small.GetMetadata(small); err != nil {
+		t.Errorf("The small object is not in the memory storage: %s", err)
+	}
+	if _, err := c.large.GetMetadata(small); !os.IsNotExist(err) {
+		t.Errorf("The small object should not be on the disk: %v", err)
+	}
+	if _, err := c.large.GetMetadata(large); err != nil {
+		t.Errorf("The large object is not on the disk: %s", err)
+	}
+	if _, err := c.small.GetMetadata(large); !os.IsNotExist(err) {
+		t.Errorf("The large object should not be in the memory: %v", err)
+	}
+
+	checkObject(t, c, small, smallContents)
+	checkObject(t, c, large, largeContents)
+	checkObject(t, c.small, small, smallContents)
+	checkObject(t, c.large, large, largeContents)
+
+	if parts, err := c.GetAvailableParts(large); err != nil || len(parts) != 4 {
+		t.Errorf("Expected 4 parts for the large object but got %d (%v)", len(parts), err)
+	}
+
+	var found int
+	if err := c.Iterate(func(*types.ObjectMetadata, ...*types.ObjectIndex) bool {
+		found++
+		return true
+	}); err != nil {
+		t.Errorf("Unexpected iteration error: %s", err)
+	}
+	if found != 2 {
+		t.Errorf("Expected to iterate over 2 objects but got %d", found)
+	}
+
+	for _, id := range []*types.ObjectID{small, large} {
+		if err := c.Discard(id); err != nil {
+			t.Errorf("Could not discard %s: %s", id, err)
+		}
+		if _, err := c.GetMetadata(id); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be discarded but got %v", id, err)
+		}
+	}
+}
+
+func TestSizeChangeMovesObject(t *testing.T) {
+	t.Parallel()
+	c, cleanup := getTestCompositeStorage(t)
+	defer cleanup()
+
+	var id = saveObject(t, c, "/growing", "small")
+	saveObject(t, c, "/growing", "it is not small anymore")
+	if _, err := c.small.GetMetadata(id); !os.IsNotExist(err) {
+		t.Errorf("The old small object should have been removed from memory: %v", err)
+	}
+	checkObject(t, c, id, "it is not small anymore")
+}
+
+func TestUpdateKeepsPlacement(t *testing.T) {
+	t.Parallel()
+	c, cleanup := getTestCompositeStorage(t)
+	defer cleanup()
+
+	var small = saveObject(t, c, "/small", "small")
+	var large = saveObject(t, c, "/large", "this one is large")
+	for _, id := range []*types.ObjectID{small, large} {
+		var obj, err = c.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var updated = *obj
+		updated.ExpiresAt = 42
+		if err := c.UpdateMetadata(&updated); err != nil {
+			t.Errorf("Could not update %s: %s", id, err)
+		}
+	}
+	if obj, err := c.small.GetMetadata(small); err != nil || obj.ExpiresAt != 42 {
+		t.Errorf("Expected the small object to be updated in memory but got %v (%v)", obj, err)
+	}
+	if obj, err := c.large.GetMetadata(large); err != nil || obj.ExpiresAt != 42 {
+		t.Errorf("Expected the large object to be updated on the disk but got %v (%v)", obj, err)
+	}
+	if err := c.UpdateMetadata(&types.ObjectMetadata{ID: types.NewObjectID("test", "/missing")}); !os.IsNotExist(err) {
+		t.Errorf("Expected the update of a missing object to fail but got %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package disk
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// checksums keeps the checksums of the saved parts until they are written to
+// the metadata of their objects. Writing the metadata for every part would
+// rewrite it hundreds of times during the fill of a big object, so they are
+// written once the fill is done or when the metadata is saved.
+type checksums struct {
+	mu      sync.Mutex
+	pending map[types.ObjectIDHash]map[uint32]uint32
+	objects map[types.ObjectIDHash]*types.ObjectID
+}
+
+func newChecksums() *checksums {
+	return &checksums{
+		pending: make(map[types.ObjectIDHash]map[uint32]uint32),
+		objects: make(map[types.ObjectIDHash]*types.ObjectID),
+	}
+}
+
+func (c *checksums) addPending(idx *types.ObjectIndex, sum uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hash = idx.ObjID.Hash()
+	if _, ok := c.pending[hash]; !ok {
+		c.pending[hash] = make(map[uint32]uint32)
+		c.objects[hash] = idx.ObjID
+	}
+	c.pending[hash][idx.Part] = sum
+}
+
+func (c *checksums) getPending(idx *types.ObjectIndex) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sum, ok := c.pending[idx.ObjID.Hash()][idx.Part]
+	return sum, ok
+}
+
+func (c *checksums) removePending(idx *types.ObjectIndex) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hash = idx.ObjID.Hash()
+	delete(c.pending[hash], idx.Part)
+	if len(c.pending[hash]) == 0 {
+		delete(c.pending, hash)
+		delete(c.objects, hash)
+	}
+}
+
+func (c *checksums) takePending(id *types.ObjectID) map[uint32]uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sums = c.pending[id.Hash()]
+	delete(c.pending, id.Hash())
+	delete(c.objects, id.Hash())
+	return sums
+}
+
+// pendingObjects returns the objects which have pending checksums.
+func (c *checksums) pendingObjects() []*types.ObjectID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result = make([]*types.ObjectID, 0, len(c.objects))
+	for _, id := range c.objects {
+		result = append(result, id)
+	}
+	return result
+}
+
+// saveMetadataWithPartRecords saves the metadata keeping the checksums and the
+// content hashes of the parts which are already saved, as the callers are not
+// aware of them. If existing is true, the metadata is saved only if the old
+// one is readable. The caller has to hold the lock for the object.
+func (s *Disk) saveMetadataWithPartRecords(m *types.ObjectMetadata, existing bool) error {
+	old, err := s.getObjectMetadata(s.getObjectMetadataPath(m.ID))
+	if err != nil && existing {
+		return err
+	} else if err != nil {
+		old = nil
+	}
+	var withRecords = *m
+	if s.verifyChecksums {
+		withRecords.PartChecksums = s.mergedChecksums(old, m)
+	}
+	if s.deduplicate {
+		withRecords.PartHashes = s.mergedPartHashes(old, m)
+	}
+	return s.writeMetadata(&withRecords)
+}
+
+func (s *Disk) mergedChecksums(old, m *types.ObjectMetadata) map[uint32]uint32 {
+	var sums = make(map[uint32]uint32)
+	if old != nil {
+		for part, sum := range old.PartChecksums {
+			sums[part] = sum
+		}
+	}
+	for part, sum := range m.PartChecksums {
+		sums[part] = sum
+	}
+	// the pending checksums are of the parts saved after the others were read
+	for part, sum := range s.checksums.takePending(m.ID) {
+		sums[part] = sum
+	}
+	if len(sums) == 0 {
+		return nil
+	}
+	return sums
+}
+
+// FinishFill implements types.FillFinisher. It writes the checksums of the
+// parts of the object which were saved since its metadata was written. They
+// are kept until the metadata is saved if it is not on the disk yet.
+func (s *Disk) FinishFill(id *types.ObjectID) error {
+	if !s.verifyChecksums {
+		return nil
+	}
+	var lock = s.metadataLocks.lockFor(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var sums = s.checksums.takePending(id)
+	if len(sums) == 0 {
+		return nil
+	}
+	obj, err := s.getObjectMetadata(s.getObjectMetadataPath(id))
+	if err != nil {
+		for part, sum := range sums {
+			s.checksums.addPending(&types.ObjectIndex{ObjID: id, Part: part}, sum)
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if obj.PartChecksums == nil {
+		obj.PartChecksums = make(map[uint32]uint32)
+	}
+	for part, sum := range sums {
+		obj.PartChecksums[part] = sum
+	}
+	return s.writeMetadata(obj)
+}
+
+// finishPendingFills writes all checksums which are still pending, e.g. of
+// the fills which were not finished.
+func (s *Disk) finishPendingFills() {
+	for _, id := range s.checksums.pendingObjects() {
+		if err := s.FinishFill(id); err != nil {
+			s.GetLogger().Errorf("[DiskStorage] Could not write the checksums of %s: %s", id, err)
+		}
+	}
+}
+
+// partChecksum returns the checksum of the part which is pending or recorded
+// in the metadata of its object.
+func (s *Disk) partChecksum(idx *types.ObjectIndex) (uint32, bool) {
+	if sum, ok := s.checksums.getPending(idx); ok {
+		return sum, true
+	}
+	obj, err := s.getObjectMetadata(s.getObjectMetadataPath(idx.ObjID))
+	if err != nil {
+		// the metadata is checked by the callers, the part can not be verified
+		return 0, false
+	}
+	sum, ok := obj.PartChecksums[idx.Part]
+	return sum, ok
+}
+
+// verifiedPart reads the whole part from f and checks it against its pending
+// or recorded checksum. Corrupted parts are discarded.
+func (s *Disk) verifiedPart(idx *types.ObjectIndex, f *os.File) (io.ReadCloser, error) {
+	expected, ok := s.partChecksum(idx)
+	if !ok {
+		return f, nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, utils.NewCompositeError(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != expected {
+		s.discardCorruptedPart(idx)
+		return nil, types.ErrCorruptedPart
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// withoutCorruptedParts verifies the parts which have recorded checksums,
+// discards the corrupted ones and returns the rest. Reading the parts is
+// subject to the background IO limits.
+func (s *Disk) withoutCorruptedParts(obj *types.ObjectMetadata, parts []*types.ObjectIndex) []*types.ObjectIndex {
+	var result = parts[:0]
+	for _, idx := range parts {
+		if expected, ok := obj.PartChecksums[idx.Part]; ok {
+			data, err := ioutil.ReadFile(s.getObjectIndexPath(idx))
+			s.background.Wait(1, int64(len(data)))
+			if err == nil && crc32.ChecksumIEEE(data) != expected {
+				s.discardCorruptedPart(idx)
+				continue
+			}
+		}
+		result = append(result, idx)
+	}
+	return result
+}
+
+func (s *Disk) discardCorruptedPart(idx *types.ObjectIndex) {
+	s.GetLogger().Errorf("[DiskStorage] Part %s is corrupted, discarding it...", idx)
+	if err := s.discardPart(idx); err != nil && !os.IsNotExist(err) {
+		s.GetLogger().Errorf("[DiskStorage] Error while discarding corrupted part %s: %s", idx, err)
+	}
+	if err := s.forgetChecksum(idx); err != nil && !os.IsNotExist(err) {
+		s.GetLogger().Errorf("[DiskStorage] Error while removing the checksum of %s: %s", idx, err)
+	}
+}
+
+// forgetChecksum removes the checksum of the discarded part from the metadata
+// of its object, so that the part which is fetched again is not verified
+// against it before its own checksum is recorded.
+func (s *Disk) forgetChecksum(idx *types.ObjectIndex) error {
+	var lock = s.metadataLocks.lockFor(idx.ObjID)
+	lock.Lock()
+	defer lock.Unlock()
+	s.checksums.removePending(idx)
+
+	obj, err := s.getObjectMetadata(s.getObjectMetadataPath(idx.ObjID))
+	if err != nil {
+		return err
+	}
+	if _, ok := obj.PartChecksums[idx.Part]; !ok {
+		return nil
+	}
+	delete(obj.PartChecksums, idx.Part)
+	return s.writeMetadata(obj)
+}
@@ -0,0 +1,222 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func getTestVerifyingDiskStorage(t *testing.T) (*Disk, func()) {
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	d, err := New(&config.CacheZone{
+		Path:            diskPath,
+		PartSize:        10,
+		VerifyChecksums: true,
+	}, mock.NewLogger())
+	if err != nil {
+		t.Fatalf("Could not create storage: %s", err)
+	}
+	return d, cleanup
+}
+
+func corruptPart(t *testing.T, d *Disk, idx *types.ObjectIndex) {
+	if err := ioutil.WriteFile(d.getObjectIndexPath(idx), []byte("corrupted!"), d.filePermissions); err != nil {
+		t.Fatalf("Could not corrupt %s: %s", idx, err)
+	}
+}
+
+func TestCorruptedPartIsDiscarded(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getTestVerifyingDiskStorage(t)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("checksums", "/corrupted"),
+		ResponseTimestamp: time.Now().Unix(),
+	}
+	var idx0, idx1 = &types.ObjectIndex{ObjID: obj.ID, Part: 0}, &types.ObjectIndex{ObjID: obj.ID, Part: 1}
+	saveMetadata(t, d, obj)
+	savePart(t, d, idx0, "0123456789")
+	savePart(t, d, idx1, "abcdefghij")
+	if err := d.FinishFill(obj.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := d.GetMetadata(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.PartChecksums) != 2 {
+		t.Errorf("Expected 2 part checksums in the metadata but got %v", stored.PartChecksums)
+	}
+
+	// saving the metadata again does not lose the checksums
+	saveMetadata(t, d, stored)
+	var resaved = *obj
+	resaved.ExpiresAt = 42
+	if err := d.SaveMetadata(&resaved); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = d.GetMetadata(obj.ID); err != nil || len(stored.PartChecksums) != 2 {
+		t.Errorf("Expected the checksums to survive saving the metadata but got %v (%v)",
+			stored.PartChecksums, err)
+	}
+
+	corruptPart(t, d, idx1)
+	if _, err := d.GetPart(idx1); err != types.ErrCorruptedPart {
+		t.Errorf("Expected ErrCorruptedPart but got %v", err)
+	}
+	if _, err := os.Stat(d.getObjectIndexPath(idx1)); !os.IsNotExist(err) {
+		t.Errorf("Expected the corrupted part to be discarded but got %v", err)
+	}
+	if r, err := d.GetPart(idx0); err != nil {
+		t.Errorf("Unexpected error for the intact part: %s", err)
+	} else {
+		r.Close()
+	}
+
+	// the part which is fetched again is not verified against the checksum
+	// of the corrupted one before its own is recorded
+	if stored, err = d.GetMetadata(obj.ID); err != nil || len(stored.PartChecksums) != 1 {
+		t.Errorf("Expected the checksum of the discarded part to be removed but got %v (%v)",
+			stored.PartChecksums, err)
+	}
+	if err := ioutil.WriteFile(d.getObjectIndexPath(idx1), []byte("klmnopqrst"), d.filePermissions); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := d.GetPart(idx1); err != nil {
+		t.Errorf("Expected the refetched part to be readable but got %s", err)
+	} else {
+		r.Close()
+	}
+	savePart(t, d, idx1, "klmnopqrst")
+	if err := d.FinishFill(obj.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = d.GetMetadata(obj.ID); err != nil || len(stored.PartChecksums) != 2 {
+		t.Errorf("Expected the checksum of the refetched part to be recorded but got %v (%v)",
+			stored.PartChecksums, err)
+	}
+}
+
+func TestChecksumsOfPartsSavedBeforeMetadata(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getTestVerifyingDiskStorage(t)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("checksums", "/unknown/size"),
+		ResponseTimestamp: time.Now().Unix(),
+	}
+	var idx0, idx1 = &types.ObjectIndex{ObjID: obj.ID, Part: 0}, &types.ObjectIndex{ObjID: obj.ID, Part: 1}
+	for _, idx := range []*types.ObjectIndex{idx0, idx1} {
+		if err := d.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := d.GetMetadata(obj.ID); err != nil || len(stored.PartChecksums) != 2 {
+		t.Errorf("Expected the pending checksums to be saved but got %v (%v)",
+			stored.PartChecksums, err)
+	}
+
+	corruptPart(t, d, idx0)
+	var iterated bool
+	err := d.Iterate(func(o *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+		iterated = true
+		if len(parts) != 1 || parts[0].Part != 1 {
+			t.Errorf("Expected only the intact part 1 but got %v", parts)
+		}
+		return true
+	})
+	if err != nil || !iterated {
+		t.Errorf("Unexpected iteration result %t, %v", iterated, err)
+	}
+	if _, err := os.Stat(d.getObjectIndexPath(idx0)); !os.IsNotExist(err) {
+		t.Errorf("Expected the corrupted part to be discarded on iteration but got %v", err)
+	}
+}
+
+func TestUpdateMetadataKeepsChecksums(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getTestVerifyingDiskStorage(t)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("checksums", "/updated"),
+		ResponseTimestamp: time.Now().Unix(),
+		Size:              20,
+	}
+	if err := d.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SavePart(&types.ObjectIndex{ObjID: obj.ID, Part: 0}, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	var updated = *obj
+	updated.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	if err := d.UpdateMetadata(&updated); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := d.GetMetadata(obj.ID); err != nil || len(stored.PartChecksums) != 1 ||
+		stored.ExpiresAt != updated.ExpiresAt {
+		t.Errorf("Expected the updated metadata with the part checksum but got %#v (%v)",
+			stored, err)
+	}
+}
+
+func TestChecksumsAreWrittenWhenTheFillIsDone(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getTestVerifyingDiskStorage(t)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("checksums", "/filling"),
+		ResponseTimestamp: time.Now().Unix(),
+		Size:              30,
+	}
+	var idx0, idx1 = &types.ObjectIndex{ObjID: obj.ID, Part: 0}, &types.ObjectIndex{ObjID: obj.ID, Part: 1}
+	saveMetadata(t, d, obj)
+	before, err := os.Stat(d.getObjectMetadataPath(obj.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	savePart(t, d, idx0, "0123456789")
+	savePart(t, d, idx1, "abcdefghij")
+
+	// the metadata is not rewritten for every part
+	if after, err := os.Stat(d.getObjectMetadataPath(obj.ID)); err != nil || !os.SameFile(before, after) {
+		t.Errorf("Expected the metadata not to be rewritten while the object is filled (%v)", err)
+	}
+	// but the parts which are being filled are still verified
+	corruptPart(t, d, idx1)
+	if _, err := d.GetPart(idx1); err != types.ErrCorruptedPart {
+		t.Errorf("Expected ErrCorruptedPart for a part of the filled object but got %v", err)
+	}
+
+	if err := d.FinishFill(obj.ID); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := d.GetMetadata(obj.ID); err != nil || len(stored.PartChecksums) != 1 {
+		t.Errorf("Expected the checksum of the intact part to be written but got %v (%v)",
+			stored.PartChecksums, err)
+	}
+
+	// the checksums of the fills which were not finished are written on stop
+	var idx2 = &types.ObjectIndex{ObjID: obj.ID, Part: 2}
+	savePart(t, d, idx2, "klmnopqrst")
+	d.Stop()
+	if stored, err := d.getObjectMetadata(d.getObjectMetadataPath(obj.ID)); err != nil || len(stored.PartChecksums) != 2 {
+		t.Errorf("Expected the pending checksum to be written on stop but got %v (%v)",
+			stored.PartChecksums, err)
+	}
+}
@@ -0,0 +1,111 @@
+package disk
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// ioSemaphore limits how many operations of one kind, e.g. reads of parts,
+// run at the same time and counts the running and the waiting ones. Without
+// a limit the operations are only counted.
+type ioSemaphore struct {
+	sync.Mutex
+	slots   chan struct{}
+	running uint64
+	waiting uint64
+}
+
+func newIOSemaphore(limit uint64) *ioSemaphore {
+	var sem = &ioSemaphore{}
+	if limit > 0 {
+		sem.slots = make(chan struct{}, limit)
+	}
+	return sem
+}
+
+// limited returns whether the operations are limited.
+func (sem *ioSemaphore) limited() bool {
+	return sem.slots != nil
+}
+
+// acquire waits for a free slot for an operation. It returns the error of
+// the context, without taking a slot, when the context is done first.
+func (sem *ioSemaphore) acquire(ctx context.Context) error {
+	if sem.limited() {
+		select {
+		case sem.slots <- struct{}{}:
+		default:
+			sem.count(&sem.waiting, 1)
+			select {
+			case sem.slots <- struct{}{}:
+				sem.count(&sem.waiting, -1)
+			case <-ctx.Done():
+				sem.count(&sem.waiting, -1)
+				return ctx.Err()
+			}
+		}
+	}
+	sem.count(&sem.running, 1)
+	return nil
+}
+
+// release frees the slot of a finished operation.
+func (sem *ioSemaphore) release() {
+	sem.count(&sem.running, -1)
+	if sem.limited() {
+		<-sem.slots
+	}
+}
+
+func (sem *ioSemaphore) count(counter *uint64, delta int) {
+	sem.Lock()
+	defer sem.Unlock()
+	if delta > 0 {
+		*counter++
+	} else {
+		*counter--
+	}
+}
+
+// stats returns the numbers of the running and the waiting operations.
+func (sem *ioSemaphore) stats() (running, waiting uint64) {
+	sem.Lock()
+	defer sem.Unlock()
+	return sem.running, sem.waiting
+}
+
+// IOConcurrency returns how many reads and writes of parts for requests are
+// running and waiting for their turn at the moment.
+func (s *Disk) IOConcurrency() types.IOConcurrency {
+	var result types.IOConcurrency
+	result.Reads, result.ReadsQueued = s.reads.stats()
+	result.Writes, result.WritesQueued = s.writes.stats()
+	return result
+}
+
+// limitedPart is a part file whose every read takes a slot of the read limit.
+// The slot is not held between the reads, so the slow clients do not keep
+// the others waiting.
+type limitedPart struct {
+	file  *os.File
+	ctx   context.Context
+	reads *ioSemaphore
+}
+
+func (p *limitedPart) Read(b []byte) (int, error) {
+	if err := p.reads.acquire(p.ctx); err != nil {
+		return 0, err
+	}
+	defer p.reads.release()
+	return p.file.Read(b)
+}
+
+func (p *limitedPart) Close() error {
+	return p.file.Close()
+}
+
+var _ io.ReadCloser = (*limitedPart)(nil)
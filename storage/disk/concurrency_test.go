@@ -0,0 +1,88 @@
+package disk
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestConcurrentIOLimits(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var cfg = &config.CacheZone{Path: diskPath, PartSize: 10,
+		ConcurrentIO: config.ConcurrentIOLimits{Reads: 1, Writes: 1}}
+	d, err := New(cfg, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obj = &types.ObjectMetadata{ID: types.NewObjectID("key", "/limited"), Size: 20}
+	var idx = &types.ObjectIndex{ObjID: obj.ID, Part: 0}
+	saveMetadata(t, d, obj)
+	savePart(t, d, idx, "0123456789")
+
+	var expectIO = func(expected types.IOConcurrency, after string) {
+		var deadline = time.Now().Add(5 * time.Second)
+		for d.IOConcurrency() != expected && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := d.IOConcurrency(); got != expected {
+			t.Errorf("Expected %+v operations %s but got %+v", expected, after, got)
+		}
+	}
+
+	// a running write keeps the next one waiting until it is done
+	if err := d.writes.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var saved = make(chan error)
+	go func() {
+		saved <- d.SavePart(&types.ObjectIndex{ObjID: obj.ID, Part: 1}, strings.NewReader("abcdefghij"))
+	}()
+	expectIO(types.IOConcurrency{Writes: 1, WritesQueued: 1}, "with a queued write")
+	ctx, cancel := context.WithCancel(context.Background())
+	var canceled = make(chan error)
+	go func() {
+		canceled <- d.SavePartContext(ctx, &types.ObjectIndex{ObjID: obj.ID, Part: 1}, strings.NewReader("x"))
+	}()
+	expectIO(types.IOConcurrency{Writes: 1, WritesQueued: 2}, "with two queued writes")
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("Expected the queued write to be canceled but got %v", err)
+	}
+	d.writes.release()
+	if err := <-saved; err != nil {
+		t.Errorf("Unexpected error for the queued write: %s", err)
+	}
+	expectIO(types.IOConcurrency{}, "after the writes")
+
+	// the reads of a part take a slot only while they run
+	r, err := d.GetPart(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIO(types.IOConcurrency{}, "between the reads")
+	if err := d.reads.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.GetPartContext(ctx, idx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the read to time out while waiting but got %v", err)
+	}
+	d.reads.release()
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "0123456789" {
+		t.Errorf("Expected to read the part but got %q (%v)", b, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+	expectIO(types.IOConcurrency{}, "after the reads")
+}
@@ -0,0 +1,273 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// blobsDirName is the directory in the storage path in which the contents of
+// the parts are stored by their hashes when the storage deduplicates them.
+// The part files of the objects are hard links to these blobs, so the number
+// of links of a blob is the number of parts which use it plus one.
+const blobsDirName = ".nedomi-blobs"
+
+// blobLocksCount is the number of locks which serialize the linking and the
+// removal of the blobs. Blobs are assigned to them by hash.
+const blobLocksCount = 64
+
+// dedup keeps the hashes of the parts saved before the metadata of their
+// objects and serializes the operations on the blobs.
+type dedup struct {
+	locks   [blobLocksCount]sync.Mutex
+	mu      sync.Mutex
+	pending map[types.ObjectIDHash]map[uint32]string
+}
+
+func newDedup() *dedup {
+	return &dedup{pending: make(map[types.ObjectIDHash]map[uint32]string)}
+}
+
+func (d *dedup) lockFor(hash string) *sync.Mutex {
+	var sum, _ = hex.DecodeString(hash[:2])
+	return &d.locks[sum[0]%blobLocksCount]
+}
+
+// addPending records the hash of a part and returns the hash of the part it
+// replaced, if any.
+func (d *dedup) addPending(idx *types.ObjectIndex, hash string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var id = idx.ObjID.Hash()
+	if _, ok := d.pending[id]; !ok {
+		d.pending[id] = make(map[uint32]string)
+	}
+	var old = d.pending[id][idx.Part]
+	d.pending[id][idx.Part] = hash
+	return old
+}
+
+func (d *dedup) getPending(idx *types.ObjectIndex) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending[idx.ObjID.Hash()][idx.Part]
+}
+
+func (d *dedup) takePending(id *types.ObjectID) map[uint32]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var hashes = d.pending[id.Hash()]
+	delete(d.pending, id.Hash())
+	return hashes
+}
+
+func newPartHash() hash.Hash {
+	return sha256.New()
+}
+
+func (s *Disk) blobsDir() string {
+	return filepath.Join(s.path, blobsDirName)
+}
+
+func (s *Disk) blobPath(hash string) string {
+	return filepath.Join(s.blobsDir(), hash[:2], hash)
+}
+
+// linkPart makes the saved part in tmpPath a link to the blob with its
+// contents, moving it there if there is no such blob yet. The part which it
+// replaces, if any, is released.
+func (s *Disk) linkPart(idx *types.ObjectIndex, tmpPath, hash string) error {
+	var lock = s.dedup.lockFor(hash)
+	lock.Lock()
+	var err = s.linkBlob(s.getObjectIndexPath(idx), tmpPath, hash)
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if old, err := s.recordPartHash(idx, hash); err != nil {
+		return err
+	} else if old != "" && old != hash {
+		s.releaseBlob(old)
+	}
+	return nil
+}
+
+// linkBlob should be called with the lock for the hash held.
+func (s *Disk) linkBlob(partPath, tmpPath, hash string) error {
+	var blob = s.blobPath(hash)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := s.mkdirAll(filepath.Dir(blob)); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, blob); err != nil {
+			return err
+		}
+		if err := s.syncDir(filepath.Dir(blob)); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if err := os.Remove(tmpPath); err != nil {
+		return err
+	}
+
+	// the link is renamed in place, so that a part which is replaced is
+	// never missing
+	var linkPath = appendRandomSuffix(partPath)
+	if err := os.Link(blob, linkPath); err != nil {
+		return err
+	}
+	if err := os.Rename(linkPath, partPath); err != nil {
+		return err
+	}
+	return s.syncDir(filepath.Dir(partPath))
+}
+
+// recordPartHash adds the hash of the saved part to the metadata of its object
+// and returns the hash of the part it replaced, if any. If the metadata is not
+// saved yet, the hash is added when it is.
+func (s *Disk) recordPartHash(idx *types.ObjectIndex, hash string) (string, error) {
+	var lock = s.metadataLocks.lockFor(idx.ObjID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	obj, err := s.getObjectMetadata(s.getObjectMetadataPath(idx.ObjID))
+	if os.IsNotExist(err) {
+		return s.dedup.addPending(idx, hash), nil
+	} else if err != nil {
+		return "", err
+	}
+	if obj.PartHashes == nil {
+		obj.PartHashes = make(map[uint32]string)
+	}
+	var old = obj.PartHashes[idx.Part]
+	obj.PartHashes[idx.Part] = hash
+	return old, s.writeMetadata(obj)
+}
+
+func (s *Disk) mergedPartHashes(old, m *types.ObjectMetadata) map[uint32]string {
+	var hashes = make(map[uint32]string)
+	if old != nil {
+		for part, hash := range old.PartHashes {
+			hashes[part] = hash
+		}
+	}
+	for part, hash := range s.dedup.takePending(m.ID) {
+		hashes[part] = hash
+	}
+	for part, hash := range m.PartHashes {
+		hashes[part] = hash
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	return hashes
+}
+
+// partHash returns the hash of the stored part or an empty string if it is
+// not known.
+func (s *Disk) partHash(idx *types.ObjectIndex) string {
+	if obj, err := s.getObjectMetadata(s.getObjectMetadataPath(idx.ObjID)); err == nil {
+		if hash, ok := obj.PartHashes[idx.Part]; ok {
+			return hash
+		}
+	}
+	return s.dedup.getPending(idx)
+}
+
+// objectHashes returns the hashes of all parts of the object.
+func (s *Disk) objectHashes(id *types.ObjectID) []string {
+	var hashes []string
+	if obj, err := s.getObjectMetadata(s.getObjectMetadataPath(id)); err == nil {
+		for _, hash := range obj.PartHashes {
+			hashes = append(hashes, hash)
+		}
+	}
+	for _, hash := range s.dedup.takePending(id) {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// releaseBlob removes the blob if no part uses it anymore. It is safe to call
+// it for blobs which are still used, so the hashes which are no longer
+// accurate do not cause any harm.
+func (s *Disk) releaseBlob(hash string) {
+	if len(hash) < 2 {
+		return
+	}
+	var lock = s.dedup.lockFor(hash)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := s.removeUnusedBlob(s.blobPath(hash)); err != nil && !os.IsNotExist(err) {
+		s.GetLogger().Errorf("[DiskStorage] Error while removing unused blob %s: %s", hash, err)
+	}
+}
+
+func (s *Disk) removeUnusedBlob(blob string) error {
+	stat, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	if links(stat) > 1 {
+		return nil
+	}
+	s.GetLogger().Debugf("[DiskStorage] Removing unused blob %s...", blob)
+	return os.Remove(blob)
+}
+
+// removeUnusedBlobs removes the blobs left unused by a crash, e.g. between
+// the removal of a part and the release of its blob.
+func (s *Disk) removeUnusedBlobs() error {
+	dirs, err := ioutil.ReadDir(s.blobsDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		var dirPath = filepath.Join(s.blobsDir(), dir.Name())
+		blobs, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if links(blob) > 1 {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dirPath, blob.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// links returns the number of hard links to the file.
+func links(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+// fileID identifies a file regardless of its links.
+type fileID struct {
+	dev, ino uint64
+}
+
+// linkedFileID returns the identity of the file if it has more than one link.
+func linkedFileID(info os.FileInfo) (fileID, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+		return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+	}
+	return fileID{}, false
+}
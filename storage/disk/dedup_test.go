@@ -0,0 +1,163 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func getTestDeduplicatingDiskStorage(t *testing.T, diskPath string) *Disk {
+	d, err := New(&config.CacheZone{
+		Path:        diskPath,
+		PartSize:    10,
+		Deduplicate: true,
+	}, mock.NewLogger())
+	if err != nil {
+		t.Fatalf("Could not create storage: %s", err)
+	}
+	return d
+}
+
+func countBlobs(t *testing.T, d *Disk) int {
+	blobs, err := filepath.Glob(filepath.Join(d.blobsDir(), "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(blobs)
+}
+
+func TestIdenticalPartsAreDeduplicated(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	d := getTestDeduplicatingDiskStorage(t, diskPath)
+
+	var obj1 = &types.ObjectMetadata{
+		ID:                types.NewObjectID("dedup", "/first"),
+		ResponseTimestamp: time.Now().Unix(),
+	}
+	var obj2 = &types.ObjectMetadata{
+		ID:                types.NewObjectID("dedup", "/second"),
+		ResponseTimestamp: time.Now().Unix(),
+	}
+	var idx1 = &types.ObjectIndex{ObjID: obj1.ID, Part: 0}
+	var idx2 = &types.ObjectIndex{ObjID: obj2.ID, Part: 3}
+	saveMetadata(t, d, obj1)
+	savePart(t, d, idx1, "0123456789")
+	// the part of the second object is saved before its metadata
+	savePart(t, d, idx2, "0123456789")
+	if err := d.SaveMetadata(obj2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []*types.ObjectID{obj1.ID, obj2.ID} {
+		stored, err := d.GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored.PartHashes) != 1 {
+			t.Errorf("Expected 1 part hash in the metadata of %s but got %v", id, stored.PartHashes)
+		}
+	}
+	if blobs := countBlobs(t, d); blobs != 1 {
+		t.Errorf("Expected the identical parts to share 1 blob but there are %d", blobs)
+	}
+	info1, err1 := os.Stat(d.getObjectIndexPath(idx1))
+	info2, err2 := os.Stat(d.getObjectIndexPath(idx2))
+	if err1 != nil || err2 != nil {
+		t.Fatalf("Could not stat the parts: %v, %v", err1, err2)
+	}
+	if !os.SameFile(info1, info2) {
+		t.Error("Expected the identical parts to be the same file")
+	}
+	if data, err := ioutil.ReadFile(d.getObjectIndexPath(idx2)); err != nil || string(data) != "0123456789" {
+		t.Errorf("Unexpected contents of the deduplicated part: %q (%v)", data, err)
+	}
+
+	// the calculation started with the storage is not left to overwrite it
+	_, _ = d.DiskUsage()
+	d.refreshDiskUsage()
+	if usage, err := d.DiskUsage(); err != nil {
+		t.Error(err)
+	} else if files := totalSizeWithoutParts(t, d); usage != files+10 {
+		t.Errorf("Expected the shared part to be counted once in %d bytes (%d without it)", usage, files)
+	}
+
+	// replacing a part releases only the blob which is no longer used
+	savePart(t, d, idx1, "abcdefghij")
+	if blobs := countBlobs(t, d); blobs != 2 {
+		t.Errorf("Expected 2 blobs after replacing a part but there are %d", blobs)
+	}
+
+	if err := d.DiscardPart(idx1); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, d); blobs != 1 {
+		t.Errorf("Expected the blob of the discarded part to be removed but there are %d", blobs)
+	}
+	if err := d.Discard(obj2.ID); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, d); blobs != 0 {
+		t.Errorf("Expected no blobs after discarding all parts but there are %d", blobs)
+	}
+}
+
+func TestSharedBlobOutlivesDiscardedObject(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	d := getTestDeduplicatingDiskStorage(t, diskPath)
+
+	var id1, id2 = types.NewObjectID("dedup", "/one"), types.NewObjectID("dedup", "/two")
+	var idx1, idx2 = &types.ObjectIndex{ObjID: id1, Part: 0}, &types.ObjectIndex{ObjID: id2, Part: 0}
+	saveMetadata(t, d, &types.ObjectMetadata{ID: id1, ResponseTimestamp: time.Now().Unix()})
+	saveMetadata(t, d, &types.ObjectMetadata{ID: id2, ResponseTimestamp: time.Now().Unix()})
+	savePart(t, d, idx1, "same part")
+	savePart(t, d, idx2, "same part")
+
+	if err := d.Discard(id1); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := countBlobs(t, d); blobs != 1 {
+		t.Errorf("Expected the shared blob to be kept but there are %d", blobs)
+	}
+	if data, err := ioutil.ReadFile(d.getObjectIndexPath(idx2)); err != nil || string(data) != "same part" {
+		t.Errorf("Unexpected contents of the remaining part: %q (%v)", data, err)
+	}
+
+	// a blob left unused by a crash is removed when the storage is created
+	if err := os.Remove(d.getObjectIndexPath(idx2)); err != nil {
+		t.Fatal(err)
+	}
+	d = getTestDeduplicatingDiskStorage(t, diskPath)
+	if blobs := countBlobs(t, d); blobs != 0 {
+		t.Errorf("Expected the unused blob to be removed but there are %d", blobs)
+	}
+}
+
+// totalSizeWithoutParts returns the size of all files in the storage besides
+// the blobs and the parts linked to them.
+func totalSizeWithoutParts(t *testing.T, d *Disk) uint64 {
+	var total uint64
+	err := filepath.Walk(d.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && links(info) == 1 {
+			total += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
@@ -0,0 +1,98 @@
+package disk
+
+import (
+	"os"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// evictionQueue keeps the parts evicted by the cache algorithm until they are
+// removed from the disk in the background, subject to the background IO
+// limits. The cache algorithms evict parts while holding their locks, so
+// they must not wait for the limits.
+type evictionQueue struct {
+	sync.Mutex
+	parts  []*types.ObjectIndex
+	queued chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// EvictPart implements types.PartEvictor. It queues the removal of the part
+// when the background IO of the storage is limited and removes it right
+// away otherwise.
+func (s *Disk) EvictPart(idx *types.ObjectIndex) error {
+	if s.evictions == nil {
+		return s.DiscardPart(idx)
+	}
+	s.GetLogger().Debugf("[DiskStorage] Queueing the eviction of %s...", idx)
+	s.evictions.push(idx)
+	return nil
+}
+
+// startEvictions removes the queued parts in the background until the
+// storage is stopped.
+func (s *Disk) startEvictions() {
+	var q = &evictionQueue{
+		queued: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.evictions = q
+	go func() {
+		defer close(q.done)
+		for {
+			select {
+			case <-q.queued:
+			case <-q.stop:
+				return
+			}
+			for idx := q.pop(); idx != nil; idx = q.pop() {
+				s.background.Wait(1, 0)
+				if err := s.discardPart(idx); err != nil && !os.IsNotExist(err) {
+					s.GetLogger().Errorf("[DiskStorage] Could not evict %s: %s", idx, err)
+				}
+				select {
+				case <-q.stop:
+					return
+				default:
+				}
+			}
+		}
+	}()
+}
+
+func (q *evictionQueue) push(idx *types.ObjectIndex) {
+	q.Lock()
+	q.parts = append(q.parts, idx)
+	q.Unlock()
+	select {
+	case q.queued <- struct{}{}:
+	default:
+	}
+}
+
+func (q *evictionQueue) pop() *types.ObjectIndex {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.parts) == 0 {
+		return nil
+	}
+	var idx = q.parts[0]
+	q.parts[0] = nil
+	q.parts = q.parts[1:]
+	return idx
+}
+
+// close stops removing the parts and waits for the removal which is running.
+// The parts which are still queued are left on the disk and are loaded again
+// with the other objects.
+func (q *evictionQueue) close() {
+	if q == nil {
+		return
+	}
+	q.once.Do(func() { close(q.stop) })
+	<-q.done
+}
@@ -0,0 +1,64 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// syncFile flushes the written contents of the file to the disk before it is
+// renamed in place, if the storage is durable.
+func (s *Disk) syncFile(f *os.File) error {
+	if !s.fsync {
+		return nil
+	}
+	return f.Sync()
+}
+
+// syncDir flushes the entries of the directory to the disk after a file was
+// renamed in it, if the storage is durable. Otherwise the renamed file may be
+// missing after a power loss even though its contents were flushed.
+func (s *Disk) syncDir(dir string) error {
+	if !s.fsync {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return utils.NewCompositeError(d.Sync(), d.Close())
+}
+
+// mkdirAll creates the directory with all of its missing parents. If the
+// storage is durable, the directories in which new ones were created are
+// synced as well.
+func (s *Disk) mkdirAll(dir string) error {
+	if !s.fsync {
+		return os.MkdirAll(dir, s.dirPermissions)
+	}
+	var missing []string
+	for current := dir; ; current = filepath.Dir(current) {
+		if _, err := os.Stat(current); !os.IsNotExist(err) || current == filepath.Dir(current) {
+			break
+		}
+		missing = append(missing, current)
+	}
+	if err := os.MkdirAll(dir, s.dirPermissions); err != nil {
+		return err
+	}
+	for _, created := range missing {
+		if err := s.syncDir(filepath.Dir(created)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes all buffered data of the file systems to the disks, so that
+// what the storage has written is not lost on a power loss after it is
+// stopped, even if it was not synced as it was written.
+func flush() {
+	syscall.Sync()
+}
@@ -0,0 +1,67 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestFsync(t *testing.T) {
+	t.Parallel()
+	for _, cfg := range []config.CacheZone{
+		{Fsync: true},
+		{Fsync: true, VerifyChecksums: true, Deduplicate: true},
+	} {
+		diskPath, cleanup := testutils.GetTestFolder(t)
+		defer cleanup()
+		cfg.Path, cfg.PartSize = diskPath, 10
+		d, err := New(&cfg, mock.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.fsync {
+			t.Errorf("Expected the storage with %#v to sync its writes", cfg)
+		}
+
+		var obj = &types.ObjectMetadata{ID: types.NewObjectID("key", "/synced"), Size: 15}
+		saveMetadata(t, d, obj)
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 0}, "0123456789")
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 1}, "abcde")
+		d.Stop()
+
+		reloaded, err := New(&cfg, mock.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reloaded.GetMetadata(obj.ID); err != nil {
+			t.Errorf("Expected the synced metadata to be kept but got %s", err)
+		}
+		if parts, err := reloaded.GetAvailableParts(obj.ID); err != nil || len(parts) != 2 {
+			t.Errorf("Expected the 2 synced parts to be kept but got %v, %v", parts, err)
+		}
+	}
+}
+
+func TestFsyncCreatesDirectories(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var d = newDisk(&config.CacheZone{Path: diskPath, PartSize: 10, Fsync: true},
+		mock.NewLogger(), 0700|os.ModeDir)
+
+	var dir = filepath.Join(diskPath, "a", "b", "c")
+	if err := d.mkdirAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		t.Errorf("Expected %s to be created but got %v", dir, err)
+	}
+	if err := d.mkdirAll(dir); err != nil {
+		t.Errorf("Expected no error for an existing directory but got %s", err)
+	}
+}
@@ -0,0 +1,179 @@
+package disk
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// defaultGCTempFileAge is used when the cache zone does not set how old the
+// temporary files have to be before they are removed. It is much longer than
+// any write should take, so the files which are still written are left alone.
+const defaultGCTempFileAge = time.Hour
+
+// diskGC runs a periodic background job of a storage, such as the garbage
+// collection, until it is stopped.
+type diskGC struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// start runs the job every interval in the background.
+func (g *diskGC) start(interval time.Duration, job func()) {
+	g.stop = make(chan struct{})
+	g.done = make(chan struct{})
+	go func() {
+		defer close(g.done)
+		var ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				job()
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+// startGC removes the orphaned files of the storage every interval until it
+// is stopped.
+func (s *Disk) startGC(interval, tempFileAge time.Duration) {
+	if tempFileAge <= 0 {
+		tempFileAge = defaultGCTempFileAge
+	}
+	s.gc.start(interval, func() {
+		s.collectGarbage(time.Now().Add(-tempFileAge))
+	})
+}
+
+// Stop stops the periodic garbage collection, the metadata compaction and the
+// removal of the evicted parts of the storage, if they were started, writes
+// the checksums of the unfinished fills and flushes what was written to the
+// disk.
+// The jobs which are running are finished first, so nothing is left working
+// in the background, e.g. after the storage of a config which was only
+// validated is stopped.
+func (s *Disk) Stop() {
+	s.gc.close()
+	s.compaction.close()
+	s.evictions.close()
+	s.finishPendingFills()
+	flush()
+}
+
+// close stops the job and waits for it to finish if it is running.
+func (g *diskGC) close() {
+	if g.stop != nil {
+		g.once.Do(func() { close(g.stop) })
+	}
+	if g.done != nil {
+		<-g.done
+	}
+}
+
+// collectGarbage removes the temporary files and directories modified before
+// tempBefore, which were left by interrupted writes and discards, and the
+// parts which are beyond the size of their objects. Reading every directory
+// is subject to the background IO limits.
+func (s *Disk) collectGarbage(tempBefore time.Time) {
+	var logger = s.GetLogger()
+	rootDirs, err := filepath.Glob(s.path + s.iterateGlob())
+	if err != nil {
+		logger.Errorf("[DiskStorage] GC error while listing %s: %s", s.path, err)
+		return
+	}
+
+	for _, rootDir := range rootDirs {
+		s.background.Wait(1, 0)
+		objectDirs, err := ioutil.ReadDir(rootDir)
+		if err != nil {
+			logger.Errorf("[DiskStorage] GC error while reading %s: %s", rootDir, err)
+			continue
+		}
+		for _, objectDir := range objectDirs {
+			var path = filepath.Join(rootDir, objectDir.Name())
+			if isTempName(objectDir.Name()) {
+				// discarded objects are renamed before they are removed
+				s.removeStaleTemp(path, objectDir, tempBefore)
+			} else if objectDir.IsDir() {
+				s.collectObjectGarbage(path, tempBefore)
+			}
+		}
+	}
+}
+
+// collectObjectGarbage removes the stale temporary files and the parts beyond
+// the size of the object in its directory.
+func (s *Disk) collectObjectGarbage(objectDir string, tempBefore time.Time) {
+	var logger = s.GetLogger()
+	s.background.Wait(1, 0)
+	files, err := ioutil.ReadDir(objectDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("[DiskStorage] GC error while reading %s: %s", objectDir, err)
+		}
+		return
+	}
+
+	var obj *types.ObjectMetadata
+	for _, file := range files {
+		var name = file.Name()
+		if isTempName(name) {
+			s.removeStaleTemp(filepath.Join(objectDir, name), file, tempBefore)
+			continue
+		}
+		partNum, err := s.getPartNumberFromFile(name)
+		if err != nil {
+			continue
+		}
+		if obj == nil {
+			// objects without metadata are handled when they are loaded
+			if obj, err = s.getObjectMetadata(filepath.Join(objectDir, objectMetadataFileName)); err != nil {
+				return
+			}
+		}
+		if s.getPartSize(partNum, obj.Size) != 0 {
+			continue
+		}
+		var idx = &types.ObjectIndex{ObjID: obj.ID, Part: partNum}
+		if err := s.discardPart(idx); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("[DiskStorage] GC error while removing %s: %s", idx, err)
+			continue
+		}
+		logger.Logf("[DiskStorage] GC removed the part %s beyond the object size %d",
+			idx, obj.Size)
+	}
+}
+
+// removeStaleTemp removes the temporary file or directory if it was last
+// modified before tempBefore.
+func (s *Disk) removeStaleTemp(path string, info os.FileInfo, tempBefore time.Time) {
+	if !info.ModTime().Before(tempBefore) {
+		return
+	}
+	if err := os.RemoveAll(path); err != nil {
+		s.GetLogger().Errorf("[DiskStorage] GC error while removing %s: %s", path, err)
+		return
+	}
+	s.GetLogger().Logf("[DiskStorage] GC removed the stale temporary %s", path)
+}
+
+// isTempName returns whether the file name has a suffix added by
+// appendRandomSuffix.
+func isTempName(name string) bool {
+	var i = strings.LastIndexByte(name, '_')
+	if i < 0 || len(name)-i-1 != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(name[i+1:])
+	return err == nil
+}
@@ -0,0 +1,122 @@
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestGarbageCollection(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("gc", "/orphaned/parts"),
+		ResponseTimestamp: time.Now().Unix(),
+		Size:              25,
+	}
+	saveMetadata(t, d, obj)
+	for _, part := range []uint32{0, 2, 3, 5} {
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: part}, fmt.Sprintf("part %d", part))
+	}
+
+	var old = time.Now().Add(-2 * time.Hour)
+	var createTemp = func(path string, dir bool) string {
+		path = appendRandomSuffix(path)
+		var err error
+		if dir {
+			err = os.MkdirAll(filepath.Join(path, "000000"), d.dirPermissions)
+		} else {
+			var f *os.File
+			if f, err = d.createFile(path); err == nil {
+				err = f.Close()
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	var staleMetadata = createTemp(d.getObjectMetadataPath(obj.ID), false)
+	var stalePart = createTemp(d.getObjectIndexPath(&types.ObjectIndex{ObjID: obj.ID, Part: 1}), false)
+	var staleDiscarded = createTemp(d.getObjectIDPath(types.NewObjectID("gc", "/discarded")), true)
+	var freshPart = createTemp(d.getObjectIndexPath(&types.ObjectIndex{ObjID: obj.ID, Part: 1}), false)
+	for _, path := range []string{staleMetadata, stalePart, staleDiscarded} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.collectGarbage(time.Now().Add(-time.Hour))
+
+	for _, path := range []string{staleMetadata, stalePart, staleDiscarded} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected the stale %s to be removed but got %v", path, err)
+		}
+	}
+	if _, err := os.Stat(freshPart); err != nil {
+		t.Errorf("Expected the fresh temporary file to be kept but got %s", err)
+	}
+	parts, err := d.GetAvailableParts(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for _, idx := range parts {
+		got = append(got, idx.Part)
+	}
+	if !reflect.DeepEqual(got, []uint32{0, 2}) {
+		t.Errorf("Expected only the parts [0 2] within the object size but got %v", got)
+	}
+	if _, err := d.GetMetadata(obj.ID); err != nil {
+		t.Errorf("Expected the metadata to be kept but got %s", err)
+	}
+}
+
+func TestIsTempName(t *testing.T) {
+	t.Parallel()
+	for name, expected := range map[string]bool{
+		filepath.Base(appendRandomSuffix("000001")): true,
+		filepath.Base(appendRandomSuffix("objID")):  true,
+		"000001":                             false,
+		"objID":                              false,
+		"000001_0123":                        false,
+		"000001_" + string(make([]byte, 32)): false,
+	} {
+		if got := isTempName(name); got != expected {
+			t.Errorf("Expected isTempName(%q) to be %t", name, expected)
+		}
+	}
+}
+
+func TestStoppingWaitsForTheRunningJob(t *testing.T) {
+	t.Parallel()
+	var (
+		gc       diskGC
+		started  = make(chan struct{})
+		finished = make(chan struct{})
+		once     sync.Once
+	)
+	gc.start(time.Millisecond, func() {
+		once.Do(func() {
+			close(started)
+			time.Sleep(50 * time.Millisecond)
+			close(finished)
+		})
+	})
+	<-started
+	gc.close()
+	select {
+	case <-finished:
+	default:
+		t.Error("Expected the running job to be finished when the gc is stopped")
+	}
+	gc.close()
+}
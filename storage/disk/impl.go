@@ -1,16 +1,22 @@
 package disk
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
 	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/throttle"
 )
 
 // Disk implements the Storage interface by writing data to a disk
@@ -21,6 +27,45 @@ type Disk struct {
 	dirPermissions     os.FileMode
 	filePermissions    os.FileMode
 	skipCacheKeyInPath bool
+	// background limits the IO of the operations which are not done for
+	// client requests - reloading the objects and removing evicted parts
+	background *throttle.Limiter
+	// evictions is used only when the background IO is limited
+	evictions *evictionQueue
+	// metadataLocks serialize the writes of the metadata of every object
+	metadataLocks metadataLocks
+	// checksums keeps the checksums of the parts which are not yet in the
+	// metadata and is used only when the parts are verified
+	verifyChecksums bool
+	checksums       *checksums
+	// dedup is used only when identical parts are stored once
+	deduplicate bool
+	dedup       *dedup
+	usage       diskUsage
+	gc          diskGC
+	// index is used for reloading the objects from the compacted metadata
+	index      *metadataIndex
+	compaction diskGC
+	// metadata caches the parsed metadata of the recently read objects
+	metadata *metadataCache
+	// discardIncomplete removes the objects with missing parts when they
+	// are iterated instead of loading them
+	discardIncomplete bool
+	// strictReload checks the directories and the schema versions of the
+	// iterated objects and deleteInvalid removes the ones which cannot be
+	// loaded instead of leaving them on the disk
+	strictReload     bool
+	minSchemaVersion uint32
+	deleteInvalid    bool
+	// fsync makes the written files and their directories be synced to the
+	// disk before the writes are finished
+	fsync bool
+	// quota counts the bytes of the stored parts, if they are limited
+	quota diskQuota
+	// reads and writes limit the concurrent operations with the parts
+	// which are done for requests
+	reads  *ioSemaphore
+	writes *ioSemaphore
 }
 
 // PartSize the maximum part size for the disk storage.
@@ -30,20 +75,51 @@ func (s *Disk) PartSize() uint64 {
 
 // GetMetadata returns the metadata on disk for this object, if present.
 func (s *Disk) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
-	//!TODO: optimize - reading and parsing the file from disk every time is very ineffictient
 	s.GetLogger().Debugf("[DiskStorage] Getting metadata for %s...", id)
-	return s.getObjectMetadata(s.getObjectMetadataPath(id))
+	if obj := s.indexedMetadata(id); obj != nil {
+		return obj, nil
+	}
+	var obj, generation = s.metadata.get(id)
+	if obj != nil {
+		return obj, nil
+	}
+	obj, err := s.getObjectMetadata(s.getObjectMetadataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	s.metadata.add(obj, generation)
+	return obj, nil
 }
 
 // GetPart returns an io.ReadCloser that will read the specified part of the
 // object from the disk.
 func (s *Disk) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
+	return s.GetPartContext(context.Background(), idx)
+}
+
+// GetPartContext works like GetPart, but waiting for a free slot of the
+// concurrent reads stops when the context is done. When the reads are
+// limited, every read of the returned part takes a slot.
+func (s *Disk) GetPartContext(ctx context.Context, idx *types.ObjectIndex) (io.ReadCloser, error) {
 	s.GetLogger().Debugf("[DiskStorage] Getting file data for %s...", idx)
+	if err := s.reads.acquire(ctx); err != nil {
+		return nil, err
+	}
 	f, err := os.Open(s.getObjectIndexPath(idx))
 	if err != nil {
+		s.reads.release()
 		return nil, err
 	}
 
+	if s.verifyChecksums {
+		// the whole part is read for the verification
+		defer s.reads.release()
+		return s.verifiedPart(idx, f)
+	}
+	s.reads.release()
+	if s.reads.limited() {
+		return &limitedPart{file: f, ctx: ctx, reads: s.reads}, nil
+	}
 	return f, nil
 }
 
@@ -77,13 +153,42 @@ func (s *Disk) GetAvailableParts(oid *types.ObjectID) ([]*types.ObjectIndex, err
 		}
 	}
 
+	sort.Sort(types.ObjectIndexes(parts))
 	return parts, nil
 }
 
 // SaveMetadata writes the supplied metadata to the disk.
 func (s *Disk) SaveMetadata(m *types.ObjectMetadata) error {
 	s.GetLogger().Debugf("[DiskStorage] Saving metadata for %s...", m.ID)
+	var lock = s.metadataLocks.lockFor(m.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.verifyChecksums || s.deduplicate {
+		return s.saveMetadataWithPartRecords(m, false)
+	}
+	return s.writeMetadata(m)
+}
+
+// UpdateMetadata atomically replaces the metadata file of an object which is
+// already on the disk. The updates of the same object are serialized with
+// each other and with saving and discarding it, so the object directory is
+// never recreated after it was discarded.
+func (s *Disk) UpdateMetadata(m *types.ObjectMetadata) error {
+	s.GetLogger().Debugf("[DiskStorage] Updating metadata for %s...", m.ID)
+	var lock = s.metadataLocks.lockFor(m.ID)
+	lock.Lock()
+	defer lock.Unlock()
+	if s.verifyChecksums || s.deduplicate {
+		return s.saveMetadataWithPartRecords(m, true)
+	}
+	if _, err := os.Stat(s.getObjectMetadataPath(m.ID)); err != nil {
+		return err
+	}
+	return s.writeMetadata(m)
+}
 
+func (s *Disk) writeMetadata(m *types.ObjectMetadata) error {
+	defer s.beginShardWrite(m.ID)()
 	tmpPath := appendRandomSuffix(s.getObjectMetadataPath(m.ID))
 	f, err := s.createFile(tmpPath)
 	if err != nil {
@@ -92,18 +197,33 @@ func (s *Disk) SaveMetadata(m *types.ObjectMetadata) error {
 
 	if err = json.NewEncoder(f).Encode(m); err != nil {
 		return utils.NewCompositeError(err, f.Close())
+	} else if err := s.syncFile(f); err != nil {
+		return utils.NewCompositeError(err, f.Close())
 	} else if err := f.Close(); err != nil {
 		return err
 	}
 
 	//!TODO: use a faster encoding than json (some binary marshaller? gob?)
 
-	return os.Rename(tmpPath, s.getObjectMetadataPath(m.ID))
+	if err := os.Rename(tmpPath, s.getObjectMetadataPath(m.ID)); err != nil {
+		return err
+	}
+	return s.syncDir(s.getObjectIDPath(m.ID))
 }
 
 // SavePart writes the contents of the supplied object part to the disk.
 func (s *Disk) SavePart(idx *types.ObjectIndex, data io.Reader) error {
+	return s.SavePartContext(context.Background(), idx, data)
+}
+
+// SavePartContext works like SavePart, but waiting for a free slot of the
+// concurrent writes stops when the context is done.
+func (s *Disk) SavePartContext(ctx context.Context, idx *types.ObjectIndex, data io.Reader) error {
 	s.GetLogger().Debugf("[DiskStorage] Saving file data for %s...", idx)
+	if err := s.writes.acquire(ctx); err != nil {
+		return err
+	}
+	defer s.writes.release()
 
 	tmpPath := appendRandomSuffix(s.getObjectIndexPath(idx))
 	f, err := s.createFile(tmpPath)
@@ -111,48 +231,143 @@ func (s *Disk) SavePart(idx *types.ObjectIndex, data io.Reader) error {
 		return err
 	}
 
-	if savedSize, err := io.Copy(f, data); err != nil {
+	var sum, hash = crc32.NewIEEE(), newPartHash()
+	var writers = []io.Writer{f}
+	if s.verifyChecksums {
+		writers = append(writers, sum)
+	}
+	if s.deduplicate {
+		writers = append(writers, hash)
+	}
+	var w = io.MultiWriter(writers...)
+	savedSize, err := io.Copy(w, data)
+	if err != nil {
 		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpPath))
 	} else if uint64(savedSize) > s.partSize {
 		err = fmt.Errorf("Object part has invalid size %d", savedSize)
 		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpPath))
+	} else if err := s.syncFile(f); err != nil {
+		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpPath))
 	} else if err := f.Close(); err != nil {
 		return err
 	}
 
-	return os.Rename(tmpPath, s.getObjectIndexPath(idx))
+	var replacedSize int64
+	if s.quota.enabled() {
+		replacedSize = fileSize(s.getObjectIndexPath(idx))
+	}
+	if s.deduplicate {
+		if err := s.linkPart(idx, tmpPath, hex.EncodeToString(hash.Sum(nil))); err != nil {
+			return err
+		}
+	} else if err := os.Rename(tmpPath, s.getObjectIndexPath(idx)); err != nil {
+		return err
+	} else if err := s.syncDir(s.getObjectIDPath(idx.ObjID)); err != nil {
+		return err
+	}
+	s.quota.add(savedSize - replacedSize)
+	if s.verifyChecksums {
+		// written to the metadata when the fill is done, see FinishFill
+		s.checksums.addPending(idx, sum.Sum32())
+	}
+	return nil
 }
 
 // Discard removes the object and its metadata from the disk.
 func (s *Disk) Discard(id *types.ObjectID) error {
 	s.GetLogger().Debugf("[DiskStorage] Discarding %s...", id)
+	if s.verifyChecksums {
+		s.checksums.takePending(id)
+	}
+	var hashes []string
+	if s.deduplicate {
+		hashes = s.objectHashes(id)
+	}
 	oldPath := s.getObjectIDPath(id)
 	tmpPath := appendRandomSuffix(oldPath)
-	if err := os.Rename(oldPath, tmpPath); err != nil {
+	var lock = s.metadataLocks.lockFor(id)
+	lock.Lock()
+	var shardWritten = s.beginShardWrite(id)
+	err := os.Rename(oldPath, tmpPath)
+	shardWritten()
+	lock.Unlock()
+	if err != nil {
 		return err
 	}
 
-	return os.RemoveAll(tmpPath)
+	var size int64
+	if s.quota.enabled() {
+		size = s.partsSize(tmpPath)
+	}
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+	s.quota.add(-size)
+	for _, hash := range hashes {
+		s.releaseBlob(hash)
+	}
+	return nil
 }
 
-// DiscardPart removes the specified part of an Object from the disk.
+// DiscardPart removes the specified part of an Object from the disk. The
+// parts evicted by the cache algorithms are removed with EvictPart instead,
+// which is subject to the background IO limits.
 func (s *Disk) DiscardPart(idx *types.ObjectIndex) error {
 	s.GetLogger().Debugf("[DiskStorage] Discarding %s...", idx)
-	return os.Remove(s.getObjectIndexPath(idx))
+	return s.discardPart(idx)
+}
+
+func (s *Disk) discardPart(idx *types.ObjectIndex) error {
+	var hash string
+	if s.deduplicate {
+		hash = s.partHash(idx)
+	}
+	var size int64
+	if s.quota.enabled() {
+		size = fileSize(s.getObjectIndexPath(idx))
+	}
+	if err := os.Remove(s.getObjectIndexPath(idx)); err != nil {
+		return err
+	}
+	s.quota.add(-size)
+	s.releaseBlob(hash)
+	return nil
 }
 
 // Iterate is a disk-specific function that iterates over all the objects on the
 // disk and passes them to the supplied callback function. If the callback
-// function returns false, the iteration stops.
+// function returns false, the iteration stops. The iteration is subject to the
+// background IO limits. The bytes of the stored parts are recounted while
+// iterating, as they may not have been counted correctly before a crash.
 func (s *Disk) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool) error {
+	return s.IterateWithErrors(callback, func(err error) bool {
+		s.GetLogger().Errorf("[DiskStorage] %s", err)
+		return true
+	})
+}
+
+// IterateWithErrors works like Iterate, but the objects which could not be
+// loaded are passed to onError instead of being logged.
+func (s *Disk) IterateWithErrors(
+	callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool,
+	onError func(error) bool,
+) error {
 	// At most count(cacheKeys)*256*256 directories
 	rootDirs, err := filepath.Glob(s.path + s.iterateGlob())
 	if err != nil {
 		return err
 	}
 
-	//!TODO: should we delete the offending folder if we detect an error? maybe just in some cases?
+	// the discarded parts are counted too, as their discarding is
+	// subtracted from the counter
+	var counted uint64
+	var completed bool
+	s.quota.startRecount()
+	defer func() { s.quota.finishRecount(counted, completed) }()
+
 	for _, rootDir := range rootDirs {
+		// the objects are loaded from the compacted metadata when possible
+		var indexed = s.loadShardIndex(filepath.Dir(rootDir))
 		//TODO: stat dirs little by little?
 		objectDirs, err := ioutil.ReadDir(rootDir)
 		if err != nil {
@@ -161,19 +376,47 @@ func (s *Disk) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectInde
 
 		for _, objectDir := range objectDirs {
 			objectDirPath := filepath.Join(rootDir, objectDir.Name(), objectMetadataFileName)
-			//!TODO: continue on os.ErrNotExist, delete on other errors?
-			obj, err := s.getObjectMetadata(objectDirPath)
+			var obj = indexed[objectDir.Name()]
+			var err error
+			if obj != nil {
+				s.background.Wait(1, 0)
+			} else {
+				s.waitForMetadataRead(objectDirPath)
+				obj, err = s.getObjectMetadata(objectDirPath)
+			}
+			if err == nil && s.strictReload {
+				err = s.validateObject(obj, filepath.Dir(objectDirPath))
+			}
 			if err != nil {
-				s.GetLogger().Errorf(
-					"[DiskStorage] error on getting metadata from %s - %s",
-					objectDirPath, err)
+				// the objects without metadata may still be being saved
+				if s.deleteInvalid && !os.IsNotExist(err) {
+					s.removeInvalidObject(filepath.Dir(objectDirPath))
+				}
+				if !onError(fmt.Errorf("error on getting metadata from %s - %s",
+					objectDirPath, err)) {
+					return nil
+				}
 				continue
 			}
 			parts, err := s.GetAvailableParts(obj.ID)
 			if err != nil {
-				s.GetLogger().Errorf(
-					"[DiskStorage] error on getting parts from %s - %s",
-					objectDirPath, err)
+				if !onError(fmt.Errorf("error on getting parts from %s - %s",
+					objectDirPath, err)) {
+					return nil
+				}
+				continue
+			}
+			counted += s.storedPartsSize(obj, parts)
+			if s.verifyChecksums {
+				parts = s.withoutCorruptedParts(obj, parts)
+			}
+			if s.discardIncomplete && s.isIncomplete(obj, parts) {
+				s.GetLogger().Logf("[DiskStorage] Discarding %s which has %d of its parts",
+					obj.ID, len(parts))
+				if err := s.Discard(obj.ID); err != nil && !os.IsNotExist(err) {
+					s.GetLogger().Errorf("[DiskStorage] Error while discarding incomplete %s: %s",
+						obj.ID, err)
+				}
 				continue
 			}
 			if !callback(obj, parts...) {
@@ -181,9 +424,33 @@ func (s *Disk) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectInde
 			}
 		}
 	}
+	completed = true
 	return nil
 }
 
+// removeInvalidObject removes the directory of an object whose metadata
+// could not be loaded. It is not discarded by its id as the id may not match
+// the directory.
+func (s *Disk) removeInvalidObject(objectDir string) {
+	s.GetLogger().Logf("[DiskStorage] Deleting the invalid object in %s", objectDir)
+	var tmpPath = appendRandomSuffix(objectDir)
+	if err := os.Rename(objectDir, tmpPath); err != nil {
+		s.GetLogger().Errorf("[DiskStorage] Error while deleting the invalid object in %s: %s",
+			objectDir, err)
+		return
+	}
+	if err := os.RemoveAll(tmpPath); err != nil {
+		s.GetLogger().Errorf("[DiskStorage] Error while deleting the invalid object in %s: %s",
+			objectDir, err)
+	}
+}
+
+// isIncomplete returns whether the object has fewer stored parts than its
+// size needs.
+func (s *Disk) isIncomplete(obj *types.ObjectMetadata, parts []*types.ObjectIndex) bool {
+	return uint64(len(parts)) < (obj.Size+s.partSize-1)/s.partSize
+}
+
 // New returns a new disk storage that ready for use.
 func New(cfg *config.CacheZone, log types.Logger) (*Disk, error) {
 	if cfg == nil || log == nil {
@@ -194,23 +461,81 @@ func New(cfg *config.CacheZone, log types.Logger) (*Disk, error) {
 		return nil, fmt.Errorf("invalid partSize value")
 	}
 
+	if isRootPath(cfg.Path) {
+		return nil, fmt.Errorf("disk storage path `%s` cannot be the root directory", cfg.Path)
+	}
+
+	var dirPermissions os.FileMode = 0700 | os.ModeDir //!TODO: get from the config
 	if _, err := os.Stat(cfg.Path); err != nil {
-		if os.IsNotExist(err) {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot stat the disk storage path %s: %s", cfg.Path, err)
+		}
+		if !cfg.CreatePathIfMissing {
 			return nil, fmt.Errorf("disk storage path `%s` should be created", cfg.Path)
 		}
-		return nil, fmt.Errorf("cannot stat the disk storage path %s: %s", cfg.Path, err)
+		if err := os.MkdirAll(cfg.Path, dirPermissions); err != nil {
+			return nil, fmt.Errorf("cannot create the disk storage path %s: %s", cfg.Path, err)
+		}
+		log.Logf("Created the missing disk storage path %s", cfg.Path)
+	}
+
+	s := newDisk(cfg, log, dirPermissions)
+
+	if err := os.RemoveAll(s.tempDir()); err != nil {
+		return nil, fmt.Errorf("cannot remove the temporary files in %s: %s", s.tempDir(), err)
+	}
+	if s.deduplicate {
+		if err := s.removeUnusedBlobs(); err != nil {
+			return nil, fmt.Errorf("cannot remove the unused blobs in %s: %s", s.blobsDir(), err)
+		}
+	}
+
+	if err := s.saveSettingsOnDisk(cfg); err != nil {
+		return s, err
 	}
+	if cfg.GCInterval > 0 {
+		s.startGC(time.Duration(cfg.GCInterval)*time.Second,
+			time.Duration(cfg.GCTempFileAge)*time.Second)
+	}
+	if cfg.MetadataCompactionInterval > 0 {
+		s.startCompaction(time.Duration(cfg.MetadataCompactionInterval) * time.Second)
+	}
+	if s.background != nil {
+		s.startEvictions()
+	}
+	// the status page shows the disk usage from the start
+	s.startDiskUsage()
+	return s, nil
+}
 
+// newDisk returns a disk storage for the cache zone without touching the disk.
+func newDisk(cfg *config.CacheZone, log types.Logger, dirPermissions os.FileMode) *Disk {
 	s := &Disk{
 		partSize:           cfg.PartSize.Bytes(),
 		path:               cfg.Path,
-		dirPermissions:     0700 | os.ModeDir, //!TODO: get from the config
-		filePermissions:    0600,              //!TODO: get from the config
+		dirPermissions:     dirPermissions,
+		filePermissions:    0600, //!TODO: get from the config
 		skipCacheKeyInPath: cfg.SkipCacheKeyInPath,
+		verifyChecksums:    cfg.VerifyChecksums,
+		checksums:          newChecksums(),
+		deduplicate:        cfg.Deduplicate,
+		dedup:              newDedup(),
+		index:              newMetadataIndex(),
+		metadata:           newMetadataCache(cfg.MetadataCacheSize),
+		discardIncomplete:  cfg.IncompleteObjects == config.IncompleteObjectsDiscard,
+		strictReload:       cfg.StrictReload,
+		minSchemaVersion:   cfg.MinSchemaVersion,
+		deleteInvalid:      cfg.InvalidObjects == config.InvalidObjectsDelete,
+		fsync:              cfg.Fsync,
+		quota:              diskQuota{max: cfg.MaxDiskSize.Bytes()},
+		usage:              diskUsage{calculated: make(chan struct{})},
+		background: throttle.NewLimiter(
+			cfg.BackgroundIO.BytesPerSecond.Bytes(), cfg.BackgroundIO.OpsPerSecond),
+		reads:  newIOSemaphore(cfg.ConcurrentIO.Reads),
+		writes: newIOSemaphore(cfg.ConcurrentIO.Writes),
 	}
 	s.SetLogger(log)
-
-	return s, s.saveSettingsOnDisk(cfg)
+	return s
 }
 
 const (
@@ -2,11 +2,13 @@ package disk
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
@@ -247,6 +249,120 @@ func TestIteration(t *testing.T) {
 	}
 }
 
+func TestIncompleteObjectsOnReload(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []string{"", config.IncompleteObjectsResume, config.IncompleteObjectsDiscard} {
+		diskPath, cleanup := testutils.GetTestFolder(t)
+		defer cleanup()
+		var cfg = &config.CacheZone{Path: diskPath, PartSize: 10, IncompleteObjects: policy}
+		d, err := New(cfg, mock.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the fill of the large object was interrupted while its third part
+		// was written, the small one is complete
+		var large = &types.ObjectMetadata{ID: types.NewObjectID("incomplete", "/large"), Size: 45}
+		var small = &types.ObjectMetadata{ID: types.NewObjectID("incomplete", "/small"), Size: 15}
+		saveMetadata(t, d, large)
+		saveMetadata(t, d, small)
+		for part, contents := range []string{"0123456789", "abcdefghij"} {
+			savePart(t, d, &types.ObjectIndex{ObjID: large.ID, Part: uint32(part)}, contents)
+			savePart(t, d, &types.ObjectIndex{ObjID: small.ID, Part: uint32(part)}, contents)
+		}
+		var partial = appendRandomSuffix(d.getObjectIndexPath(&types.ObjectIndex{ObjID: large.ID, Part: 2}))
+		if err := ioutil.WriteFile(partial, []byte("klm"), d.filePermissions); err != nil {
+			t.Fatal(err)
+		}
+
+		if d, err = New(cfg, mock.NewLogger()); err != nil {
+			t.Fatal(err)
+		}
+		var loaded = make(map[string]int)
+		if err := d.Iterate(func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+			loaded[obj.ID.Path()] = len(parts)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var expected = map[string]int{"/large": 2, "/small": 2}
+		if policy == config.IncompleteObjectsDiscard {
+			expected = map[string]int{"/small": 2}
+			if _, err := d.GetMetadata(large.ID); !os.IsNotExist(err) {
+				t.Errorf("Expected the incomplete object to be discarded but got %v", err)
+			}
+		}
+		if !reflect.DeepEqual(loaded, expected) {
+			t.Errorf("Expected %v to be loaded with the %q policy but got %v", expected, policy, loaded)
+		}
+	}
+}
+
+func TestStrictReload(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []string{config.InvalidObjectsSkip, config.InvalidObjectsDelete} {
+		diskPath, cleanup := testutils.GetTestFolder(t)
+		defer cleanup()
+		var cfg = &config.CacheZone{Path: diskPath, PartSize: 10, StrictReload: true,
+			MinSchemaVersion: types.ObjectMetadataSchemaVersion, InvalidObjects: policy}
+		d, err := New(cfg, mock.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var current = &types.ObjectMetadata{ID: types.NewObjectID("strict", "/current"),
+			Size: 5, SchemaVersion: types.ObjectMetadataSchemaVersion}
+		var old = &types.ObjectMetadata{ID: types.NewObjectID("strict", "/old"), Size: 5}
+		var moved = &types.ObjectMetadata{ID: types.NewObjectID("strict", "/moved"),
+			Size: 5, SchemaVersion: types.ObjectMetadataSchemaVersion}
+		for _, obj := range []*types.ObjectMetadata{current, old, moved} {
+			saveMetadata(t, d, obj)
+			savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 0}, "01234")
+		}
+		// the object is in the directory of another cache key
+		var movedDir = d.getObjectIDPath(types.NewObjectID("other", "/moved"))
+		if err := os.MkdirAll(filepath.Dir(movedDir), d.dirPermissions); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(d.getObjectIDPath(moved.ID), movedDir); err != nil {
+			t.Fatal(err)
+		}
+		var corrupted = d.getObjectIDPath(types.NewObjectID("strict", "/corrupted"))
+		if err := os.MkdirAll(corrupted, d.dirPermissions); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(corrupted, objectMetadataFileName),
+			[]byte("{corrupted"), d.filePermissions); err != nil {
+			t.Fatal(err)
+		}
+
+		var loaded []string
+		var errors int
+		if err := d.IterateWithErrors(func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+			loaded = append(loaded, obj.ID.Path())
+			return true
+		}, func(error) bool {
+			errors++
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, []string{"/current"}) || errors != 3 {
+			t.Errorf("Expected only /current to be loaded and 3 errors with the %q policy but got %v and %d",
+				policy, loaded, errors)
+		}
+
+		for _, dir := range []string{d.getObjectIDPath(old.ID), movedDir, corrupted} {
+			if _, err := os.Stat(dir); policy == config.InvalidObjectsDelete && !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be deleted but got %v", dir, err)
+			} else if policy == config.InvalidObjectsSkip && err != nil {
+				t.Errorf("Expected %s to be kept but got %s", dir, err)
+			}
+		}
+	}
+}
+
 func TestIterationSkipKeyInPath(t *testing.T) {
 	t.Parallel()
 	d, _, cleanup := getTestDiskStorage(t, 10)
@@ -385,3 +501,231 @@ func TestConstructor(t *testing.T) {
 		t.Errorf("Received unexpected error while creating a normal disk storage: %s", err)
 	}
 }
+
+func TestCreatePathIfMissing(t *testing.T) {
+	t.Parallel()
+	workingDiskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var missing = filepath.Join(workingDiskPath, "missing", "zone")
+	l := mock.NewLogger()
+
+	if _, err := New(&config.CacheZone{Path: missing, PartSize: 10}, l); err == nil {
+		t.Error("Expected to receive error with a missing path")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("Expected the path not to be created without the option but got %v", err)
+	}
+
+	cfg := &config.CacheZone{Path: missing, PartSize: 10, CreatePathIfMissing: true}
+	if _, err := New(cfg, l); err != nil {
+		t.Fatalf("Received unexpected error while creating a missing path: %s", err)
+	}
+	if stat, err := os.Stat(missing); err != nil || !stat.IsDir() {
+		t.Errorf("Expected the path to be created as a directory but got %v", err)
+	} else if perm := stat.Mode().Perm(); perm != 0700 {
+		t.Errorf("Expected the path to be created with permissions 0700 but got %o", perm)
+	}
+	if _, err := New(cfg, l); err != nil {
+		t.Errorf("Received unexpected error with an already created path: %s", err)
+	}
+
+	if _, err := New(&config.CacheZone{Path: "/", PartSize: 10, CreatePathIfMissing: true}, l); err == nil {
+		t.Error("Expected to receive error with root path")
+	}
+}
+
+func TestBackgroundIOLimits(t *testing.T) {
+	t.Parallel()
+	const objects, opsPerSecond = 6, 20
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+
+	d, err := New(&config.CacheZone{
+		Path:         diskPath,
+		PartSize:     10,
+		BackgroundIO: config.BackgroundIOLimits{OpsPerSecond: opsPerSecond},
+	}, mock.NewLogger())
+	if err != nil {
+		t.Fatalf("Could not create storage: %s", err)
+	}
+
+	var indexes = make([]*types.ObjectIndex, 0, objects)
+	for i := 0; i < objects; i++ {
+		obj := &types.ObjectMetadata{
+			ID:                types.NewObjectID("throttled", fmt.Sprintf("/object/%d", i)),
+			ResponseTimestamp: time.Now().Unix(),
+		}
+		idx := &types.ObjectIndex{ObjID: obj.ID, Part: 0}
+		saveMetadata(t, d, obj)
+		savePart(t, d, idx, "0123456789")
+		indexes = append(indexes, idx)
+	}
+
+	// foreground operations are not limited
+	var start = time.Now()
+	for i := 0; i < 10; i++ {
+		for _, idx := range indexes {
+			if _, err := d.GetMetadata(idx.ObjID); err != nil {
+				t.Fatalf("Unexpected error while getting metadata: %s", err)
+			}
+			part, err := d.GetPart(idx)
+			if err != nil {
+				t.Fatalf("Unexpected error while getting part: %s", err)
+			}
+			part.Close()
+		}
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("Foreground reads took %s which is too slow", took)
+	}
+
+	var minDuration = time.Duration(objects-1) * time.Second / opsPerSecond
+	start = time.Now()
+	var iterated int
+	if err := d.Iterate(func(*types.ObjectMetadata, ...*types.ObjectIndex) bool {
+		iterated++
+		return true
+	}); err != nil {
+		t.Fatalf("Unexpected error while iterating: %s", err)
+	}
+	if iterated != objects {
+		t.Errorf("Expected to iterate over %d objects but got %d", objects, iterated)
+	}
+	if took := time.Since(start); took < minDuration {
+		t.Errorf("Iterating over %d objects took %s but should take at least %s",
+			objects, took, minDuration)
+	}
+
+	// the evicted parts are removed in the background without blocking
+	start = time.Now()
+	for _, idx := range indexes {
+		if err := d.EvictPart(idx); err != nil {
+			t.Errorf("Unexpected error while evicting part: %s", err)
+		}
+	}
+	if took := time.Since(start); took > minDuration/2 {
+		t.Errorf("Queueing the eviction of %d parts took %s", objects, took)
+	}
+	var last = d.getObjectIndexPath(indexes[objects-1])
+	for deadline := start.Add(5 * time.Second); time.Now().Before(deadline); {
+		if _, err := os.Stat(last); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if took := time.Since(start); took < minDuration {
+		t.Errorf("Evicting %d parts took %s but should take at least %s",
+			objects, took, minDuration)
+	}
+	for _, idx := range indexes {
+		if _, err := os.Stat(d.getObjectIndexPath(idx)); !os.IsNotExist(err) {
+			t.Errorf("Expected the evicted part %s to be removed but got %v", idx, err)
+		}
+	}
+	d.Stop()
+}
+
+func TestOutOfOrderParts(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("sparse", "/out/of/order"),
+		ResponseTimestamp: time.Now().Unix(),
+	}
+	saveMetadata(t, d, obj)
+	for _, part := range []uint32{0, 5, 3} {
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: part}, fmt.Sprintf("part %05d", part))
+	}
+
+	parts, err := d.GetAvailableParts(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for _, idx := range parts {
+		got = append(got, idx.Part)
+	}
+	if !reflect.DeepEqual(got, []uint32{0, 3, 5}) {
+		t.Errorf("Expected exactly the parts [0 3 5] in order but got %v", got)
+	}
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("update", "/metadata"),
+		ResponseTimestamp: time.Now().Unix(),
+		Headers:           http.Header{"version": []string{"1"}},
+	}
+	if err := d.UpdateMetadata(obj); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error for a missing object but got %v", err)
+	}
+	if _, err := os.Stat(d.getObjectIDPath(obj.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the object directory not to be created but got %v", err)
+	}
+
+	saveMetadata(t, d, obj)
+	var updated = *obj
+	updated.Headers = http.Header{"version": []string{"2"}}
+	if err := d.UpdateMetadata(&updated); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := d.GetMetadata(obj.ID); err != nil || !reflect.DeepEqual(*read, updated) {
+		t.Errorf("Expected the updated metadata but got %#v (%v)", read, err)
+	}
+
+	if err := d.Discard(obj.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateMetadata(&updated); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error for a discarded object but got %v", err)
+	}
+	if _, err := os.Stat(d.getObjectIDPath(obj.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded object not to be recreated but got %v", err)
+	}
+}
+
+func TestConcurrentMetadataUpdates(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{
+		ID:                types.NewObjectID("update", "/concurrently"),
+		ResponseTimestamp: time.Now().Unix(),
+	}
+	saveMetadata(t, d, obj)
+
+	var wg sync.WaitGroup
+	var discarded = make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			randSleep(0, 20)
+			var updated = *obj
+			updated.Headers = http.Header{"version": []string{fmt.Sprint(i)}}
+			if err := d.UpdateMetadata(&updated); err != nil && !os.IsNotExist(err) {
+				t.Errorf("Unexpected error while updating: %s", err)
+			}
+		}(i)
+	}
+	go func() {
+		randSleep(0, 20)
+		if err := d.Discard(obj.ID); err != nil {
+			t.Errorf("Unexpected error while discarding: %s", err)
+		}
+		close(discarded)
+	}()
+	wg.Wait()
+	<-discarded
+
+	if _, err := os.Stat(d.getObjectIDPath(obj.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded object to stay discarded but got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package disk
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// metadataCache keeps the parsed metadata of the most recently read objects in
+// memory, so that it is not read from the disk for every request. An entry is
+// removed both before and after its object is written or discarded and the
+// metadata read from the disk is not cached if any object was written
+// meanwhile, so the cache never returns metadata which is older than the file
+// on the disk. A nil *metadataCache is valid and caches nothing.
+type metadataCache struct {
+	sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[types.ObjectIDHash]*list.Element
+	// generation is changed with every write, so that the reads which
+	// overlap with writes are not cached
+	generation uint64
+}
+
+func newMetadataCache(size uint64) *metadataCache {
+	if size == 0 {
+		return nil
+	}
+	return &metadataCache{
+		size:    int(size),
+		lru:     list.New(),
+		entries: make(map[types.ObjectIDHash]*list.Element),
+	}
+}
+
+// get returns a copy of the cached metadata of the object or nil if it is not
+// cached. The returned generation has to be passed to add when the metadata is
+// read from the disk instead.
+func (mc *metadataCache) get(id *types.ObjectID) (obj *types.ObjectMetadata, generation uint64) {
+	if mc == nil {
+		return nil, 0
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	if e, ok := mc.entries[id.Hash()]; ok {
+		mc.lru.MoveToFront(e)
+		return copyMetadata(e.Value.(*types.ObjectMetadata)), mc.generation
+	}
+	return nil, mc.generation
+}
+
+// add caches a copy of the metadata which was read from the disk, unless an
+// object was written after the generation was returned by get.
+func (mc *metadataCache) add(obj *types.ObjectMetadata, generation uint64) {
+	if mc == nil {
+		return
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	if generation != mc.generation {
+		return
+	}
+	if e, ok := mc.entries[obj.ID.Hash()]; ok {
+		e.Value = copyMetadata(obj)
+		mc.lru.MoveToFront(e)
+		return
+	}
+	mc.entries[obj.ID.Hash()] = mc.lru.PushFront(copyMetadata(obj))
+	if mc.lru.Len() > mc.size {
+		var oldest = mc.lru.Remove(mc.lru.Back()).(*types.ObjectMetadata)
+		delete(mc.entries, oldest.ID.Hash())
+	}
+}
+
+// remove removes the metadata of the object when it is written or discarded.
+func (mc *metadataCache) remove(id *types.ObjectID) {
+	if mc == nil {
+		return
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	mc.generation++
+	if e, ok := mc.entries[id.Hash()]; ok {
+		mc.lru.Remove(e)
+		delete(mc.entries, id.Hash())
+	}
+}
@@ -0,0 +1,146 @@
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func getCachingDiskStorage(t testing.TB, cacheSize uint64) (*Disk, func()) {
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	d, err := New(&config.CacheZone{
+		Path:              diskPath,
+		PartSize:          10,
+		MetadataCacheSize: cacheSize,
+	}, mock.NewLogger())
+	if err != nil {
+		cleanup()
+		t.Fatalf("Could not create storage: %s", err)
+	}
+	return d, cleanup
+}
+
+// corruptMetadata replaces the metadata file of the object, so that it can be
+// told whether it is read from the disk.
+func corruptMetadata(t *testing.T, d *Disk, id *types.ObjectID) {
+	if err := ioutil.WriteFile(d.getObjectMetadataPath(id), []byte("corrupted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getCachingDiskStorage(t, 2)
+	defer cleanup()
+
+	var objects = make([]*types.ObjectMetadata, 3)
+	for i := range objects {
+		objects[i] = newIndexedObject(i)
+		saveMetadata(t, d, objects[i])
+	}
+
+	// the cached metadata is not read from the disk and can not be changed
+	// by its users
+	corruptMetadata(t, d, objects[2].ID)
+	obj, err := d.GetMetadata(objects[2].ID)
+	if err != nil {
+		t.Fatalf("Expected the metadata from the cache but got %s", err)
+	}
+	obj.Headers.Set("Content-Type", "changed")
+	if obj, _ = d.GetMetadata(objects[2].ID); obj.Headers.Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the cached metadata not to be changed but got %v", obj.Headers)
+	}
+
+	// only the most recently used objects are kept
+	corruptMetadata(t, d, objects[0].ID)
+	if _, err := d.GetMetadata(objects[0].ID); err == nil {
+		t.Error("Expected the evicted metadata to be read from the disk")
+	}
+
+	// writes and discards remove the cached metadata
+	objects[1].Size = 100
+	if err := d.UpdateMetadata(objects[1]); err != nil {
+		t.Fatal(err)
+	}
+	if obj, err := d.GetMetadata(objects[1].ID); err != nil || obj.Size != 100 {
+		t.Errorf("Expected the updated metadata but got %v, %v", obj, err)
+	}
+	if err := d.Discard(objects[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetMetadata(objects[1].ID); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded metadata not to be found but got %v", err)
+	}
+
+	// a failed write does not leave the old metadata in the cache
+	if _, err := d.GetMetadata(objects[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	var path = d.getObjectMetadataPath(objects[2].ID)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveMetadata(objects[2]); err == nil {
+		t.Fatal("Expected the metadata not to be saved over a directory")
+	}
+	if _, err := d.GetMetadata(objects[2].ID); err == nil {
+		t.Error("Expected the metadata which failed to be saved not to be cached")
+	}
+}
+
+func TestMetadataCacheOverlappingWrites(t *testing.T) {
+	t.Parallel()
+	var mc = newMetadataCache(10)
+	var obj = newIndexedObject(1)
+	var _, generation = mc.get(obj.ID)
+	// the object is written while its old metadata is read from the disk
+	mc.remove(obj.ID)
+	mc.add(obj, generation)
+	if cached, _ := mc.get(obj.ID); cached != nil {
+		t.Error("Expected the metadata read during a write not to be cached")
+	}
+
+	_, generation = mc.get(obj.ID)
+	mc.add(obj, generation)
+	if cached, _ := mc.get(obj.ID); cached == nil {
+		t.Error("Expected the metadata to be cached")
+	}
+
+	var disabled = newMetadataCache(0)
+	disabled.add(obj, 0)
+	if cached, _ := disabled.get(obj.ID); cached != nil {
+		t.Error("Expected nothing to be cached by the disabled cache")
+	}
+}
+
+func BenchmarkGetMetadata(b *testing.B) {
+	for _, cacheSize := range []uint64{0, 1000} {
+		b.Run(fmt.Sprintf("cache-%d", cacheSize), func(b *testing.B) {
+			d, cleanup := getCachingDiskStorage(b, cacheSize)
+			defer cleanup()
+			var objects = make([]*types.ObjectMetadata, 100)
+			for i := range objects {
+				objects[i] = newIndexedObject(i)
+				if err := d.SaveMetadata(objects[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := d.GetMetadata(objects[i%len(objects)].ID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package disk
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// metadataIndexFileName is the file in every top-level shard directory (the
+// first level of hash directories) in which the metadata of all of its
+// objects is compacted. The objects are reloaded from it instead of from
+// their own metadata files.
+const metadataIndexFileName = ".metadata-index"
+
+// metadataIndex keeps the state of the compacted metadata index files. An
+// index file is valid only while none of the objects in its shard is written
+// or discarded, so it is removed before the first such change after it was
+// compacted and the per-object files are used until the next compaction.
+type metadataIndex struct {
+	sync.Mutex
+	shards map[string]*indexShard
+}
+
+// indexShard is the state of the index of a single shard directory.
+type indexShard struct {
+	// generation is changed with every write to the shard, so that the
+	// compactions which overlap with writes are discarded
+	generation uint64
+	// writing is the number of writes to the shard in progress
+	writing int
+	// invalidated is whether the index file was removed after the shard
+	// was written and is not compacted again yet
+	invalidated bool
+	// entries are the loaded metadata by object hash or nil if the index
+	// was not loaded
+	entries map[string]*types.ObjectMetadata
+}
+
+func newMetadataIndex() *metadataIndex {
+	return &metadataIndex{shards: make(map[string]*indexShard)}
+}
+
+// shard returns the state of the shard. It should be called with the lock
+// held.
+func (mi *metadataIndex) shard(dir string) *indexShard {
+	var sh, ok = mi.shards[dir]
+	if !ok {
+		sh = &indexShard{}
+		mi.shards[dir] = sh
+	}
+	return sh
+}
+
+// shardDir returns the shard directory in which the object is stored.
+func (s *Disk) shardDir(id *types.ObjectID) string {
+	return filepath.Dir(filepath.Dir(s.getObjectIDPath(id)))
+}
+
+// beginShardWrite invalidates the index of the shard before the metadata of
+// one of its objects is written or the object is discarded. The returned
+// function has to be called after that is done.
+func (s *Disk) beginShardWrite(id *types.ObjectID) func() {
+	var dir = s.shardDir(id)
+	s.metadata.remove(id)
+	s.index.Lock()
+	defer s.index.Unlock()
+	var sh = s.index.shard(dir)
+	sh.generation++
+	sh.writing++
+	sh.entries = nil
+	if !sh.invalidated {
+		var path = filepath.Join(dir, metadataIndexFileName)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			s.GetLogger().Errorf("[DiskStorage] Could not remove the metadata index %s: %s", path, err)
+		}
+		sh.invalidated = true
+	}
+	return func() {
+		// the metadata may have been read and cached while it was written
+		s.metadata.remove(id)
+		s.index.Lock()
+		defer s.index.Unlock()
+		sh.generation++
+		sh.writing--
+	}
+}
+
+// indexedMetadata returns a copy of the metadata of the object from the
+// loaded index of its shard or nil if it is not there.
+func (s *Disk) indexedMetadata(id *types.ObjectID) *types.ObjectMetadata {
+	s.index.Lock()
+	defer s.index.Unlock()
+	var sh, ok = s.index.shards[s.shardDir(id)]
+	if !ok || sh.entries == nil {
+		return nil
+	}
+	var obj, found = sh.entries[id.StrHash()]
+	if !found {
+		return nil
+	}
+	return copyMetadata(obj)
+}
+
+// copyMetadata returns a copy of the metadata with its own headers, so that
+// the shared in-memory metadata is not changed by its users.
+func copyMetadata(obj *types.ObjectMetadata) *types.ObjectMetadata {
+	var result = *obj
+	result.Headers = make(http.Header, len(obj.Headers))
+	for name, values := range obj.Headers {
+		result.Headers[name] = append([]string(nil), values...)
+	}
+	return &result
+}
+
+// loadShardIndex returns the metadata in the index of the shard by object
+// hash or nil if it does not have a valid index. The loaded index is kept in
+// memory until the shard is written.
+func (s *Disk) loadShardIndex(dir string) map[string]*types.ObjectMetadata {
+	s.index.Lock()
+	var sh = s.index.shard(dir)
+	var generation, entries = sh.generation, sh.entries
+	var invalidated = sh.invalidated || sh.writing > 0
+	s.index.Unlock()
+	if entries != nil || invalidated {
+		return entries
+	}
+
+	var path = filepath.Join(dir, metadataIndexFileName)
+	s.waitForMetadataRead(path)
+	objects, err := readMetadataIndex(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.GetLogger().Errorf("[DiskStorage] Could not read the metadata index %s: %s", path, err)
+		}
+		// the per-object files are used until the shard is compacted
+		s.index.Lock()
+		if sh.generation == generation {
+			sh.invalidated = true
+		}
+		s.index.Unlock()
+		return nil
+	}
+	entries = make(map[string]*types.ObjectMetadata, len(objects))
+	for _, obj := range objects {
+		entries[obj.ID.StrHash()] = obj
+	}
+
+	s.index.Lock()
+	defer s.index.Unlock()
+	if sh.generation != generation || sh.writing > 0 || sh.invalidated {
+		return nil
+	}
+	sh.entries = entries
+	return entries
+}
+
+func readMetadataIndex(path string) ([]*types.ObjectMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var objects []*types.ObjectMetadata
+	if err := gob.NewDecoder(f).Decode(&objects); err != nil {
+		return nil, utils.NewCompositeError(err, f.Close())
+	}
+	return objects, f.Close()
+}
+
+// startCompaction compacts the metadata of the shards which were written
+// every interval until the storage is stopped.
+func (s *Disk) startCompaction(interval time.Duration) {
+	s.compaction.start(interval, s.compactMetadata)
+}
+
+// compactMetadata writes the index files of the shards which do not have a
+// valid one. Reading the metadata is subject to the background IO limits.
+func (s *Disk) compactMetadata() {
+	rootDirs, err := filepath.Glob(s.path + s.iterateGlob())
+	if err != nil {
+		s.GetLogger().Errorf("[DiskStorage] Compaction error while listing %s: %s", s.path, err)
+		return
+	}
+	var compacted = make(map[string]bool)
+	for _, rootDir := range rootDirs {
+		var dir = filepath.Dir(rootDir)
+		if compacted[dir] {
+			continue
+		}
+		compacted[dir] = true
+		if err := s.compactShard(dir); err != nil {
+			s.GetLogger().Errorf("[DiskStorage] Could not compact the metadata in %s: %s", dir, err)
+		}
+	}
+}
+
+// compactShard writes the metadata of all objects in the shard directory in
+// its index file, unless it already has a valid one. The index is not used if
+// any of the objects is written or discarded in the meantime.
+func (s *Disk) compactShard(dir string) error {
+	var path = filepath.Join(dir, metadataIndexFileName)
+	s.index.Lock()
+	var sh = s.index.shard(dir)
+	var generation, skip = sh.generation, sh.writing > 0
+	if !sh.invalidated && !skip {
+		_, err := os.Stat(path)
+		skip = err == nil
+	}
+	s.index.Unlock()
+	if skip {
+		return nil
+	}
+
+	objects, err := s.readShardMetadata(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.tempDir(), s.dirPermissions); err != nil {
+		return err
+	}
+	var tmpPath = appendRandomSuffix(filepath.Join(s.tempDir(), metadataIndexFileName))
+	f, err := s.createFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(objects); err != nil {
+		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpPath))
+	} else if err := f.Close(); err != nil {
+		return utils.NewCompositeError(err, os.Remove(tmpPath))
+	}
+
+	s.index.Lock()
+	defer s.index.Unlock()
+	if sh.generation != generation || sh.writing > 0 {
+		s.GetLogger().Debugf("[DiskStorage] The shard %s was written while compacting it", dir)
+		return os.Remove(tmpPath)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return utils.NewCompositeError(err, os.Remove(tmpPath))
+	}
+	sh.invalidated = false
+	s.GetLogger().Debugf("[DiskStorage] Compacted the metadata of %d objects in %s", len(objects), dir)
+	return nil
+}
+
+// readShardMetadata reads the metadata files of all objects in the shard
+// directory. The objects with missing or invalid metadata are skipped, they
+// are handled when they are reloaded.
+func (s *Disk) readShardMetadata(dir string) ([]*types.ObjectMetadata, error) {
+	var objects []*types.ObjectMetadata
+	subDirs, err := filepath.Glob(filepath.Join(dir, "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return nil, err
+	}
+	for _, subDir := range subDirs {
+		s.background.Wait(1, 0)
+		objectDirs, err := ioutil.ReadDir(subDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, objectDir := range objectDirs {
+			if !objectDir.IsDir() || isTempName(objectDir.Name()) {
+				continue
+			}
+			var objPath = filepath.Join(subDir, objectDir.Name(), objectMetadataFileName)
+			s.waitForMetadataRead(objPath)
+			if obj, err := s.getObjectMetadata(objPath); err == nil {
+				objects = append(objects, obj)
+			}
+		}
+	}
+	return objects, nil
+}
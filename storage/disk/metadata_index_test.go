@@ -0,0 +1,153 @@
+package disk
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func newIndexedObject(i int) *types.ObjectMetadata {
+	return &types.ObjectMetadata{
+		ID:                types.NewObjectID("index", fmt.Sprintf("/object/%d", i)),
+		ResponseTimestamp: time.Now().Unix(),
+		Code:              200,
+		Size:              uint64(i),
+		Headers:           http.Header{"Content-Type": {"text/plain"}},
+		ExpiresAt:         time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func reloadAll(t testing.TB, d *Disk) map[string]*types.ObjectMetadata {
+	var objects = make(map[string]*types.ObjectMetadata)
+	err := d.Iterate(func(obj *types.ObjectMetadata, _ ...*types.ObjectIndex) bool {
+		objects[obj.ID.StrHash()] = obj
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func TestMetadataCompaction(t *testing.T) {
+	t.Parallel()
+	d, diskPath, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+
+	var objects = make([]*types.ObjectMetadata, 20)
+	for i := range objects {
+		objects[i] = newIndexedObject(i)
+		saveMetadata(t, d, objects[i])
+	}
+	d.compactMetadata()
+	var shard = d.shardDir(objects[0].ID)
+	var indexPath = filepath.Join(shard, metadataIndexFileName)
+	if _, err := os.Stat(indexPath); err != nil {
+		t.Fatalf("Expected the metadata index to be written but got %s", err)
+	}
+
+	// the reloaded objects come from the index, so the removed file does
+	// not matter
+	if err := os.Remove(d.getObjectMetadataPath(objects[0].ID)); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := New(&config.CacheZone{Path: diskPath, PartSize: 10}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all = reloadAll(t, reloaded)
+	if len(all) != len(objects) {
+		t.Errorf("Expected %d reloaded objects but got %d", len(objects), len(all))
+	}
+	for _, obj := range objects {
+		if got := all[obj.ID.StrHash()]; got == nil || !reflect.DeepEqual(*got, *obj) {
+			t.Errorf("Expected %#v to be reloaded but got %#v", obj, got)
+		}
+	}
+	if got, err := reloaded.GetMetadata(objects[0].ID); err != nil || got.Size != objects[0].Size {
+		t.Errorf("Expected the metadata from the loaded index but got %v, %v", got, err)
+	}
+
+	// writing to the shard invalidates its index
+	saveMetadata(t, reloaded, objects[0])
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the index to be removed after a write but got %v", err)
+	}
+	if err := reloaded.Discard(objects[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloaded.GetMetadata(objects[0].ID); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded object to be missing but got %v", err)
+	}
+}
+
+func TestCompactionSkipsShardsBeingWritten(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+	var obj = newIndexedObject(1)
+	saveMetadata(t, d, obj)
+	var shard = d.shardDir(obj.ID)
+
+	var done = d.beginShardWrite(obj.ID)
+	if err := d.compactShard(shard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(shard, metadataIndexFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected no index while the shard is written but got %v", err)
+	}
+	done()
+	if err := d.compactShard(shard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(shard, metadataIndexFileName)); err != nil {
+		t.Errorf("Expected the index after the write but got %s", err)
+	}
+}
+
+func BenchmarkReload(b *testing.B) {
+	for _, compacted := range []bool{false, true} {
+		var name = "files"
+		if compacted {
+			name = "index"
+		}
+		b.Run(name, func(b *testing.B) {
+			diskPath, cleanup := testutils.GetTestFolder(b)
+			defer cleanup()
+			var cfg = &config.CacheZone{Path: diskPath, PartSize: 10}
+			d, err := New(cfg, mock.NewLogger())
+			if err != nil {
+				b.Fatal(err)
+			}
+			const objects = 5000
+			for i := 0; i < objects; i++ {
+				if err := d.SaveMetadata(newIndexedObject(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if compacted {
+				d.compactMetadata()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reloaded, err := New(cfg, mock.NewLogger())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n := len(reloadAll(b, reloaded)); n != objects {
+					b.Fatalf("Expected %d reloaded objects but got %d", objects, n)
+				}
+			}
+		})
+	}
+}
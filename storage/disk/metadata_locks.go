@@ -0,0 +1,21 @@
+package disk
+
+import (
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// metadataLocksCount is the number of locks which serialize the writes of the
+// metadata files. Objects are assigned to them by hash.
+const metadataLocksCount = 64
+
+// metadataLocks serialize the writes of the metadata of every object with
+// each other and with discarding it, so that the updates which read the old
+// metadata do not lose each other's changes.
+type metadataLocks [metadataLocksCount]sync.Mutex
+
+func (l *metadataLocks) lockFor(id *types.ObjectID) *sync.Mutex {
+	var hash = id.Hash()
+	return &l[hash[0]%metadataLocksCount]
+}
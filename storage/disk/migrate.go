@@ -0,0 +1,226 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// partSizeMigration converts the objects of a storage from the part size with
+// which they were saved to a new one. Both storages use the same path.
+type partSizeMigration struct {
+	from, to *Disk
+	// the numbers of converted objects, of objects which were already
+	// converted and of dropped objects and parts
+	converted, skipped, droppedObjects, droppedParts uint64
+}
+
+// MigratePartSize converts the objects in the disk storage of the cache zone
+// from the part size with which the storage was last used to cfg.PartSize and
+// then replaces its settings file with one for the new part size. Nothing is
+// done if the part size has not changed. The storage must not be used while it
+// runs.
+//
+// The objects are converted one by one: the directory of the object is moved
+// aside, its parts are split again from the moved files and the moved files
+// are removed. The new parts for which some of the old parts were missing are
+// dropped, as they are filled again when they are requested. As the settings
+// file is replaced only after all objects are converted, an interrupted
+// migration can be run again - the objects which were already converted are
+// recognized by the sizes of their parts.
+func MigratePartSize(cfg *config.CacheZone, log types.Logger) error {
+	if cfg == nil || log == nil {
+		return fmt.Errorf("nil parameters")
+	}
+	if cfg.PartSize == 0 {
+		return fmt.Errorf("invalid partSize value")
+	}
+	if isRootPath(cfg.Path) {
+		return fmt.Errorf("disk storage path `%s` cannot be the root directory", cfg.Path)
+	}
+
+	var dirPermissions os.FileMode = 0700 | os.ModeDir //!TODO: get from the config
+	var to = newDisk(cfg, log, dirPermissions)
+	oldSettings, err := to.readPreviousDiskSettings()
+	if err != nil {
+		return err
+	}
+	if oldSettings == nil || oldSettings.PartSize == cfg.PartSize {
+		log.Logf("[DiskStorage] The part size of %s has not changed, nothing to migrate", cfg.Path)
+		return nil
+	}
+	if oldSettings.PartSize == 0 {
+		return fmt.Errorf("invalid old partSize value in %s", cfg.Path)
+	}
+	if oldSettings.ObjectIDHash.String() != cfg.ObjectIDHash.String() {
+		return fmt.Errorf("Old object id hash is %s and new object id hash is %s",
+			oldSettings.ObjectIDHash, cfg.ObjectIDHash)
+	}
+
+	var oldCfg = *cfg
+	oldCfg.PartSize = oldSettings.PartSize
+	var m = &partSizeMigration{from: newDisk(&oldCfg, log, dirPermissions), to: to}
+	// the migration runs before the storage is used, so it is not limited and
+	// the incomplete and the invalid objects are kept as they are, whatever
+	// the config says
+	m.from.background, m.to.background = nil, nil
+	m.from.discardIncomplete, m.to.discardIncomplete = false, false
+	m.from.deleteInvalid, m.to.deleteInvalid = false, false
+
+	log.Logf("[DiskStorage] Migrating %s from part size %d to %d...",
+		cfg.Path, oldSettings.PartSize.Bytes(), cfg.PartSize.Bytes())
+	if err := os.RemoveAll(to.tempDir()); err != nil {
+		return fmt.Errorf("cannot remove the temporary files in %s: %s", to.tempDir(), err)
+	}
+	if err := m.from.Iterate(m.migrateObject); err != nil {
+		return err
+	}
+	log.Logf("[DiskStorage] Migrated %s: %d objects converted, %d already converted, %d objects and %d parts dropped",
+		cfg.Path, m.converted, m.skipped, m.droppedObjects, m.droppedParts)
+	return to.writeSettingsOnDisk(cfg)
+}
+
+// migrateObject converts a single object. It always returns true, as the
+// failure to convert an object only drops it.
+func (m *partSizeMigration) migrateObject(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+	var logger = m.to.GetLogger()
+	converted, known := m.isConverted(obj, parts)
+	if converted {
+		m.skipped++
+		return true
+	} else if !known {
+		logger.Logf("[DiskStorage] Dropping %s as the part size of its parts is not known", obj.ID)
+		m.dropObject(obj.ID)
+		return true
+	}
+
+	if err := m.convertObject(obj, parts); err != nil {
+		logger.Errorf("[DiskStorage] Dropping %s which could not be converted: %s", obj.ID, err)
+		m.dropObject(obj.ID)
+		return true
+	}
+	m.converted++
+	return true
+}
+
+// isConverted returns whether the stored parts of the object are already split
+// with the new part size. It returns known as false if that can not be told
+// from the sizes of the parts.
+func (m *partSizeMigration) isConverted(obj *types.ObjectMetadata, parts []*types.ObjectIndex) (converted, known bool) {
+	var identical = true
+	for _, idx := range parts {
+		var oldSize = m.from.getPartSize(idx.Part, obj.Size)
+		var newSize = m.to.getPartSize(idx.Part, obj.Size)
+		if oldSize == newSize {
+			// only the first part of an object which fits in both part
+			// sizes is the same in both and the rest can not be told apart
+			identical = identical && idx.Part == 0
+			continue
+		}
+		info, err := os.Stat(m.from.getObjectIndexPath(idx))
+		if err != nil {
+			return false, false
+		}
+		var size = uint64(info.Size())
+		return size == newSize, size == newSize || size == oldSize
+	}
+	return identical, identical
+}
+
+// convertObject moves the directory of the object aside and saves it again
+// with its parts split with the new part size.
+func (m *partSizeMigration) convertObject(obj *types.ObjectMetadata, parts []*types.ObjectIndex) error {
+	var oldDir = m.from.getObjectIDPath(obj.ID)
+	var movedDir = appendRandomSuffix(oldDir)
+	if err := os.Rename(oldDir, movedDir); err != nil {
+		return err
+	}
+	defer m.removeMoved(obj, movedDir)
+
+	var stored = make(map[uint32]bool, len(parts))
+	for _, idx := range parts {
+		stored[idx.Part] = true
+	}
+	var converted = *obj
+	// the records of the old parts are replaced by the new ones as the parts
+	// are saved
+	converted.PartChecksums, converted.PartHashes = nil, nil
+	if err := m.to.SaveMetadata(&converted); err != nil {
+		return err
+	}
+	for part := uint32(0); m.to.getPartSize(part, obj.Size) > 0; part++ {
+		if err := m.convertPart(obj, part, movedDir, stored); err != nil {
+			return utils.NewCompositeError(err, m.to.FinishFill(obj.ID))
+		}
+	}
+	return m.to.FinishFill(obj.ID)
+}
+
+// convertPart saves the new part from the old parts in movedDir which contain
+// it. The part is dropped if any of them is not stored.
+func (m *partSizeMigration) convertPart(obj *types.ObjectMetadata, part uint32, movedDir string, stored map[uint32]bool) error {
+	var start = uint64(part) * m.to.partSize
+	var end = start + m.to.getPartSize(part, obj.Size)
+	var buf = bytes.NewBuffer(make([]byte, 0, end-start))
+	for oldPart := uint32(start / m.from.partSize); uint64(oldPart)*m.from.partSize < end; oldPart++ {
+		if !stored[oldPart] {
+			m.droppedParts++
+			return nil
+		}
+		var oldStart = uint64(oldPart) * m.from.partSize
+		var from = umax(start, oldStart) - oldStart
+		var to = umin(end, oldStart+m.from.partSize) - oldStart
+		f, err := os.Open(filepath.Join(movedDir, getPartFilename(oldPart)))
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(buf, io.NewSectionReader(f, int64(from), int64(to-from)))
+		if err != nil {
+			return utils.NewCompositeError(err, f.Close())
+		} else if err := f.Close(); err != nil {
+			return err
+		} else if uint64(n) != to-from {
+			return fmt.Errorf("the old part %d is shorter than expected", oldPart)
+		}
+	}
+	return m.to.SavePart(&types.ObjectIndex{ObjID: obj.ID, Part: part}, buf)
+}
+
+// removeMoved removes the moved directory of a converted or dropped object and
+// the blobs which were used only by its old parts.
+func (m *partSizeMigration) removeMoved(obj *types.ObjectMetadata, movedDir string) {
+	if err := os.RemoveAll(movedDir); err != nil {
+		m.to.GetLogger().Errorf("[DiskStorage] Could not remove %s: %s", movedDir, err)
+		return
+	}
+	for _, hash := range obj.PartHashes {
+		m.to.releaseBlob(hash)
+	}
+}
+
+func (m *partSizeMigration) dropObject(id *types.ObjectID) {
+	m.droppedObjects++
+	if err := m.to.Discard(id); err != nil && !os.IsNotExist(err) {
+		m.to.GetLogger().Errorf("[DiskStorage] Could not discard %s: %s", id, err)
+	}
+}
+
+func umax(l, r uint64) uint64 {
+	if l < r {
+		return r
+	}
+	return l
+}
+
+func umin(l, r uint64) uint64 {
+	if l > r {
+		return r
+	}
+	return l
+}
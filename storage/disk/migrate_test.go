@@ -0,0 +1,112 @@
+package disk
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestMigratePartSize(t *testing.T) {
+	t.Parallel()
+	for _, cfg := range []config.CacheZone{
+		{},
+		{VerifyChecksums: true},
+		{Deduplicate: true},
+	} {
+		testMigratePartSize(t, cfg)
+	}
+}
+
+func testMigratePartSize(t *testing.T, cfg config.CacheZone) {
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	cfg.Path = diskPath
+	var withPartSize = func(partSize types.BytesSize) *config.CacheZone {
+		var result = cfg
+		result.PartSize = partSize
+		return &result
+	}
+
+	d, err := New(withPartSize(4), mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var whole = &types.ObjectMetadata{ID: types.NewObjectID("key", "/whole"), Size: 10}
+	var partial = &types.ObjectMetadata{ID: types.NewObjectID("key", "/partial"), Size: 10}
+	var small = &types.ObjectMetadata{ID: types.NewObjectID("key", "/small"), Size: 3}
+	for _, obj := range []*types.ObjectMetadata{whole, partial, small} {
+		if err := d.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	savePart(t, d, &types.ObjectIndex{ObjID: whole.ID, Part: 0}, "0123")
+	savePart(t, d, &types.ObjectIndex{ObjID: whole.ID, Part: 1}, "4567")
+	savePart(t, d, &types.ObjectIndex{ObjID: whole.ID, Part: 2}, "89")
+	savePart(t, d, &types.ObjectIndex{ObjID: partial.ID, Part: 0}, "0123")
+	savePart(t, d, &types.ObjectIndex{ObjID: partial.ID, Part: 2}, "89")
+	savePart(t, d, &types.ObjectIndex{ObjID: small.ID, Part: 0}, "abc")
+
+	if _, err := New(withPartSize(6), mock.NewLogger()); err == nil {
+		t.Fatal("Expected an error for the changed part size without a migration")
+	}
+
+	var expected = map[*types.ObjectMetadata][]string{
+		whole:   {"012345", "6789"},
+		partial: nil, // both new parts need the missing old part
+		small:   {"abc"},
+	}
+	var check = func() {
+		d, err := New(withPartSize(6), mock.NewLogger())
+		if err != nil {
+			t.Fatalf("Could not use the migrated storage with %#v: %s", cfg, err)
+		}
+		for obj, contents := range expected {
+			if _, err := d.GetMetadata(obj.ID); err != nil {
+				t.Errorf("Expected the metadata of %s to be kept but got %s", obj.ID, err)
+			}
+			parts, err := d.GetAvailableParts(obj.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != len(contents) {
+				t.Errorf("Expected %d parts of %s but there are %d", len(contents), obj.ID, len(parts))
+				continue
+			}
+			for i, idx := range parts {
+				r, err := d.GetPart(idx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				read, err := ioutil.ReadAll(r)
+				_ = r.Close()
+				if err != nil || string(read) != contents[i] {
+					t.Errorf("Expected %s to be %q but got %q (%v)", idx, contents[i], read, err)
+				}
+			}
+		}
+		if cfg.Deduplicate {
+			if blobs := countBlobs(t, d); blobs != 3 {
+				t.Errorf("Expected only the blobs of the new parts to be kept but there are %d", blobs)
+			}
+		}
+	}
+
+	if err := MigratePartSize(withPartSize(6), mock.NewLogger()); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// an interrupted migration is run again without converting the objects
+	// which are already converted
+	if err := d.writeSettingsOnDisk(withPartSize(4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigratePartSize(withPartSize(6), mock.NewLogger()); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
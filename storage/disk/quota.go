@@ -0,0 +1,152 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// When the stored parts take more than quotaHighWatermark of the quota of the
+// storage, it asks for as many bytes to be reclaimed as are needed for them to
+// take quotaLowWatermark of it. The gap keeps every write near the limit from
+// triggering a new eviction.
+const (
+	quotaHighWatermark = 0.95
+	quotaLowWatermark  = 0.9
+)
+
+// diskQuota counts the bytes of the parts in the storage as they are saved
+// and discarded. The counter is not persisted, so it is recounted from the
+// stored objects when they are iterated on start.
+type diskQuota struct {
+	sync.Mutex
+	max  uint64
+	used uint64
+	// the changes of used since the recount started, while it is running
+	recounting bool
+	changed    int64
+	reclaiming bool
+	reclaim    func(uint64)
+}
+
+// enabled returns whether the storage has a quota. The bytes are counted
+// only then, as it costs a stat for every change.
+func (q *diskQuota) enabled() bool {
+	return q.max > 0
+}
+
+// add changes the used bytes by delta.
+func (q *diskQuota) add(delta int64) {
+	if !q.enabled() || delta == 0 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.used = addClamped(q.used, delta)
+	if q.recounting {
+		q.changed += delta
+	}
+	q.checkLimit()
+}
+
+// startRecount starts counting the bytes of the stored parts from scratch.
+func (q *diskQuota) startRecount() {
+	q.Lock()
+	defer q.Unlock()
+	q.recounting, q.changed = true, 0
+}
+
+// finishRecount replaces the used bytes with the counted ones, if all of the
+// stored parts were counted. The changes made by the writes while counting
+// are kept.
+func (q *diskQuota) finishRecount(counted uint64, completed bool) {
+	q.Lock()
+	defer q.Unlock()
+	if completed {
+		q.used = addClamped(counted, q.changed)
+		q.checkLimit()
+	}
+	q.recounting, q.changed = false, 0
+}
+
+// checkLimit asks for bytes to be reclaimed if the used ones are over the
+// high watermark and no reclaim is running. It must be called with the lock
+// held.
+func (q *diskQuota) checkLimit() {
+	var high, low = uint64(float64(q.max) * quotaHighWatermark), uint64(float64(q.max) * quotaLowWatermark)
+	if q.reclaiming || q.reclaim == nil || q.used <= high {
+		return
+	}
+	q.reclaiming = true
+	var reclaim, bytes = q.reclaim, q.used - low
+	// the parts are discarded through the storage, which changes the
+	// counter, so it is done without the lock
+	go func() {
+		reclaim(bytes)
+		q.Lock()
+		defer q.Unlock()
+		q.reclaiming = false
+	}()
+}
+
+// usedBytes returns the bytes of the stored parts.
+func (q *diskQuota) usedBytes() uint64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.used
+}
+
+func addClamped(value uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > value {
+		return 0
+	}
+	return uint64(int64(value) + delta)
+}
+
+// OnQuotaExceeded implements types.QuotaEnforcer. The reclaim function is
+// called in the background with how many bytes should be freed when the
+// stored parts take almost all of the max_disk_size of the zone.
+func (s *Disk) OnQuotaExceeded(reclaim func(bytes uint64)) {
+	s.quota.Lock()
+	defer s.quota.Unlock()
+	s.quota.reclaim = reclaim
+	s.quota.checkLimit()
+}
+
+// fileSize returns the size of the file or 0 if it can not be stat-ed, e.g.
+// because it does not exist.
+func fileSize(path string) int64 {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return st.Size()
+}
+
+// partsSize returns the total size of the part files in the object
+// directory.
+func (s *Disk) partsSize(dir string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, file := range files {
+		if _, err := s.getPartNumberFromFile(file.Name()); err == nil {
+			size += file.Size()
+		}
+	}
+	return size
+}
+
+// storedPartsSize returns how many bytes the parts of the object take
+// according to its size.
+func (s *Disk) storedPartsSize(obj *types.ObjectMetadata, parts []*types.ObjectIndex) uint64 {
+	var size uint64
+	for _, idx := range parts {
+		size += s.getPartSize(idx.Part, obj.Size)
+	}
+	return size
+}
@@ -0,0 +1,105 @@
+package disk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestQuotaCountsParts(t *testing.T) {
+	t.Parallel()
+	for _, deduplicate := range []bool{false, true} {
+		diskPath, cleanup := testutils.GetTestFolder(t)
+		defer cleanup()
+		var cfg = &config.CacheZone{Path: diskPath, PartSize: 10, MaxDiskSize: 1000, Deduplicate: deduplicate}
+		d, err := New(cfg, mock.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expectUsed = func(expected uint64, after string) {
+			if used := d.quota.usedBytes(); used != expected {
+				t.Errorf("Expected %d used bytes after %s but got %d (deduplicate %t)",
+					expected, after, used, deduplicate)
+			}
+		}
+
+		var obj = &types.ObjectMetadata{ID: types.NewObjectID("key", "/counted"), Size: 25}
+		saveMetadata(t, d, obj)
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 0}, "0123456789")
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 1}, "0123456789")
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 2}, "abcde")
+		expectUsed(25, "saving")
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 2}, "abcde")
+		expectUsed(25, "saving a part again")
+		if err := d.DiscardPart(&types.ObjectIndex{ObjID: obj.ID, Part: 1}); err != nil {
+			t.Fatal(err)
+		}
+		expectUsed(15, "discarding a part")
+
+		// the counter is recounted when the objects are iterated
+		d.quota.add(1000)
+		if err := d.Iterate(func(*types.ObjectMetadata, ...*types.ObjectIndex) bool { return true }); err != nil {
+			t.Fatal(err)
+		}
+		expectUsed(15, "iterating")
+
+		if err := d.Discard(obj.ID); err != nil {
+			t.Fatal(err)
+		}
+		expectUsed(0, "discarding the object")
+	}
+}
+
+func TestQuotaReclaim(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	d, err := New(&config.CacheZone{Path: diskPath, PartSize: 10, MaxDiskSize: 100}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reclaimed = make(chan uint64, 10)
+	d.OnQuotaExceeded(func(bytes uint64) { reclaimed <- bytes })
+
+	var obj = &types.ObjectMetadata{ID: types.NewObjectID("key", "/large"), Size: 100}
+	saveMetadata(t, d, obj)
+	for i := uint32(0); i < 9; i++ {
+		savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: i}, "0123456789")
+	}
+	select {
+	case bytes := <-reclaimed:
+		t.Fatalf("Expected no reclaim under the high watermark but %d bytes were asked for", bytes)
+	default:
+	}
+
+	savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 9}, "0123456789")
+	select {
+	case bytes := <-reclaimed:
+		if bytes != 10 {
+			t.Errorf("Expected 10 bytes to be reclaimed to get to the low watermark but got %d", bytes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the space to be reclaimed over the high watermark")
+	}
+}
+
+func TestQuotaDisabled(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	d, err := New(&config.CacheZone{Path: diskPath, PartSize: 10}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.OnQuotaExceeded(func(bytes uint64) { t.Errorf("Unexpected reclaim of %d bytes", bytes) })
+	var obj = &types.ObjectMetadata{ID: types.NewObjectID("key", "/unlimited"), Size: 10}
+	saveMetadata(t, d, obj)
+	savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 0}, "0123456789")
+	if used := d.quota.usedBytes(); used != 0 {
+		t.Errorf("Expected nothing to be counted without a quota but got %d", used)
+	}
+}
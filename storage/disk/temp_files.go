@@ -0,0 +1,25 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// tempDirName is the directory in the storage path in which the temporary
+// files are created. It is emptied when the storage is created, so that the
+// files left after a crash do not take space forever.
+const tempDirName = ".nedomi-tmp"
+
+// CreateTempFile creates a new temporary file in the storage directory. The
+// caller has to close and remove it.
+func (s *Disk) CreateTempFile() (*os.File, error) {
+	if err := os.MkdirAll(s.tempDir(), s.dirPermissions); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(appendRandomSuffix(filepath.Join(s.tempDir(), "file")),
+		os.O_CREATE|os.O_EXCL|os.O_RDWR, s.filePermissions)
+}
+
+func (s *Disk) tempDir() string {
+	return filepath.Join(s.path, tempDirName)
+}
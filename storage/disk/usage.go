@@ -0,0 +1,88 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// diskUsageRefreshInterval is the minimum time between two calculations of
+// the disk usage of a storage.
+const diskUsageRefreshInterval = time.Minute
+
+// diskUsage caches the result of the last disk usage calculation.
+type diskUsage struct {
+	sync.Mutex
+	bytes      uint64
+	err        error
+	updated    time.Time
+	refreshing bool
+	// closed when the first calculation finishes
+	calculated chan struct{}
+}
+
+// DiskUsage returns the number of bytes occupied by the files of the storage.
+// Walking all the files is expensive, so the value is calculated in the
+// background at most once every diskUsageRefreshInterval and the last known
+// one is returned. The first calculation is started when the storage is
+// created and DiskUsage waits for it to finish.
+func (s *Disk) DiskUsage() (uint64, error) {
+	s.startDiskUsage()
+	<-s.usage.calculated
+	s.usage.Lock()
+	defer s.usage.Unlock()
+	return s.usage.bytes, s.usage.err
+}
+
+// startDiskUsage starts calculating the disk usage in the background, unless
+// it is already being calculated or the last value is recent enough.
+func (s *Disk) startDiskUsage() {
+	s.usage.Lock()
+	defer s.usage.Unlock()
+	if !s.usage.refreshing && time.Since(s.usage.updated) >= diskUsageRefreshInterval {
+		s.usage.refreshing = true
+		go s.refreshDiskUsage()
+	}
+}
+
+func (s *Disk) refreshDiskUsage() {
+	var total uint64
+	// the deduplicated parts are hard links to the same files
+	var seen = make(map[fileID]struct{})
+	err := filepath.Walk(s.path, func(path string, info os.FileInfo, err error) error {
+		s.background.Wait(1, 0)
+		if err != nil {
+			if os.IsNotExist(err) { // removed in the meantime
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if id, ok := linkedFileID(info); ok {
+			if _, counted := seen[id]; counted {
+				return nil
+			}
+			seen[id] = struct{}{}
+		}
+		total += uint64(info.Size())
+		return nil
+	})
+
+	s.usage.Lock()
+	defer s.usage.Unlock()
+	if s.usage.updated.IsZero() {
+		close(s.usage.calculated)
+	}
+	if err != nil {
+		s.GetLogger().Errorf("[DiskStorage] Error while calculating the disk usage of %s: %s",
+			s.path, err)
+	} else {
+		s.usage.bytes = total
+	}
+	s.usage.err = err
+	s.usage.updated = time.Now()
+	s.usage.refreshing = false
+}
@@ -33,6 +33,13 @@ func appendRandomSuffix(path string) string {
 	return path + "_" + hex.EncodeToString(randBytes)
 }
 
+// isRootPath returns whether the path is the root directory. The storage
+// removes files in its path, so it must never use the whole file system.
+func isRootPath(path string) bool {
+	abs, err := filepath.Abs(path)
+	return err == nil && filepath.Dir(abs) == abs
+}
+
 func (s *Disk) getObjectIDPath(id *types.ObjectID) string {
 	// !TODO redo this with more []byte appending(we know how big it will be)
 	// less string contamination
@@ -54,7 +61,7 @@ func (s *Disk) getObjectMetadataPath(id *types.ObjectID) string {
 }
 
 func (s *Disk) createFile(filePath string) (*os.File, error) {
-	if err := os.MkdirAll(filepath.Dir(filePath), s.dirPermissions); err != nil {
+	if err := s.mkdirAll(filepath.Dir(filePath)); err != nil {
 		return nil, err
 	}
 
@@ -97,37 +104,78 @@ func (s *Disk) getObjectMetadata(objPath string) (*types.ObjectMetadata, error)
 		return nil, utils.NewCompositeError(err, f.Close())
 	}
 
+	if obj.ID == nil {
+		err := fmt.Errorf("The metadata in %s has no object id", objPath)
+		return nil, utils.NewCompositeError(err, f.Close())
+	}
 	if filepath.Base(filepath.Dir(objPath)) != obj.ID.StrHash() {
 		err := fmt.Errorf("The object %s was in the wrong directory: %s", obj.ID, objPath)
 		return nil, utils.NewCompositeError(err, f.Close())
 	}
-	//!TODO: add more validation? ex. compare the cache key as well? also the
-	// data itself may be corrupted or from an old app version
 
 	return obj, f.Close()
 }
 
-func (s *Disk) checkPreviousDiskSettings(newSettings *config.CacheZone) error {
+// validateObject checks the object stored in objectDir more strictly than
+// getObjectMetadata when the objects are reloaded: its whole path, including
+// the directory of its cache key, has to match its id and its metadata has to
+// be stored by an app version which is not too old.
+func (s *Disk) validateObject(obj *types.ObjectMetadata, objectDir string) error {
+	if expected := s.getObjectIDPath(obj.ID); filepath.Clean(objectDir) != expected {
+		return fmt.Errorf("The object %s was in %s instead of %s", obj.ID, objectDir, expected)
+	}
+	if obj.SchemaVersion < s.minSchemaVersion {
+		return fmt.Errorf("The object %s has metadata schema version %d, older than %d",
+			obj.ID, obj.SchemaVersion, s.minSchemaVersion)
+	}
+	return nil
+}
+
+// waitForMetadataRead blocks until the metadata file may be read without
+// exceeding the background IO limits.
+func (s *Disk) waitForMetadataRead(objPath string) {
+	if s.background == nil {
+		return
+	}
+	var size int64
+	if stat, err := os.Stat(objPath); err == nil {
+		size = stat.Size()
+	}
+	s.background.Wait(1, size)
+}
+
+// readPreviousDiskSettings returns the settings with which the storage was
+// last used or nil if it was not used before.
+func (s *Disk) readPreviousDiskSettings() (*config.CacheZone, error) {
 	f, err := os.Open(filepath.Join(s.path, diskSettingsFileName))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return nil, nil
 		}
-		return err
+		return nil, err
 	}
 
 	oldSettings := &config.CacheZone{}
 	if err := json.NewDecoder(f).Decode(&oldSettings); err != nil {
-		return utils.NewCompositeError(err, f.Close())
+		return nil, utils.NewCompositeError(err, f.Close())
 	}
-	if err := f.Close(); err != nil {
+	return oldSettings, f.Close()
+}
+
+func (s *Disk) checkPreviousDiskSettings(newSettings *config.CacheZone) error {
+	oldSettings, err := s.readPreviousDiskSettings()
+	if err != nil || oldSettings == nil {
 		return err
 	}
 
 	if oldSettings.PartSize != newSettings.PartSize {
-		return fmt.Errorf("Old partsize is %d and new partsize is %d",
+		return fmt.Errorf("Old partsize is %d and new partsize is %d, the zone can be converted with -migrate-partsize",
 			oldSettings.PartSize, newSettings.PartSize)
 	}
+	if oldSettings.ObjectIDHash.String() != newSettings.ObjectIDHash.String() {
+		return fmt.Errorf("Old object id hash is %s and new object id hash is %s",
+			oldSettings.ObjectIDHash, newSettings.ObjectIDHash)
+	}
 	//!TODO: more validation?
 	return nil
 }
@@ -136,16 +184,28 @@ func (s *Disk) saveSettingsOnDisk(cz *config.CacheZone) error {
 	if err := s.checkPreviousDiskSettings(cz); err != nil {
 		return err
 	}
+	return s.writeSettingsOnDisk(cz)
+}
 
+// writeSettingsOnDisk atomically replaces the settings file of the storage.
+func (s *Disk) writeSettingsOnDisk(cz *config.CacheZone) error {
 	filePath := filepath.Join(s.path, diskSettingsFileName)
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, s.filePermissions)
+	tmpPath := appendRandomSuffix(filePath)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, s.filePermissions)
 	if err != nil {
 		return err
 	}
 
 	if err = json.NewEncoder(f).Encode(cz); err != nil {
-		return utils.NewCompositeError(err, f.Close())
+		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpPath))
+	} else if err := s.syncFile(f); err != nil {
+		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpPath))
+	} else if err := f.Close(); err != nil {
+		return utils.NewCompositeError(err, os.Remove(tmpPath))
 	}
 
-	return f.Close()
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	return s.syncDir(s.path)
 }
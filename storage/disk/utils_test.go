@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/mock"
@@ -202,5 +203,102 @@ func TestObjectMetadataLoading(t *testing.T) {
 
 func TestDiskSettingsLoadAndSave(t *testing.T) {
 	t.Parallel()
-	t.Skip("TODO: write tests for checkPreviousDiskSettings() and saveSettingsOnDisk()")
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var newDisk = func(partSize types.BytesSize, hash types.ObjectIDHashFunc) error {
+		_, err := New(&config.CacheZone{Path: diskPath, PartSize: partSize, ObjectIDHash: hash},
+			mock.NewLogger())
+		return err
+	}
+
+	if err := newDisk(10, ""); err != nil {
+		t.Fatal(err)
+	}
+	// sha1 is the default
+	if err := newDisk(10, types.ObjectIDHashSHA1); err != nil {
+		t.Errorf("Expected the same zone with explicit sha1 to be accepted but got %s", err)
+	}
+	if err := newDisk(20, ""); err == nil {
+		t.Error("Expected a different part size to be rejected")
+	}
+	if err := newDisk(10, types.ObjectIDHashFNV); err == nil {
+		t.Error("Expected a different object id hash to be rejected")
+	}
+}
+
+func TestObjectIDHashFuncs(t *testing.T) {
+	t.Parallel()
+	var paths = make(map[string]bool)
+	for _, hash := range []types.ObjectIDHashFunc{"", types.ObjectIDHashSHA256, types.ObjectIDHashFNV} {
+		d, _, cleanup := getTestDiskStorage(t, 10)
+		defer cleanup()
+		var obj = &types.ObjectMetadata{
+			ID:        types.NewObjectIDWithHash("key", "/path", hash),
+			Code:      200,
+			Headers:   make(map[string][]string),
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}
+		saveMetadata(t, d, obj)
+		var path, err = filepath.Rel(d.path, d.getObjectIDPath(obj.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if paths[path] {
+			t.Errorf("Expected a different path with %s but got %s", hash, path)
+		}
+		paths[path] = true
+
+		var found bool
+		if err := d.Iterate(func(loaded *types.ObjectMetadata, _ ...*types.ObjectIndex) bool {
+			found = loaded.ID.Hash() == obj.ID.Hash() && loaded.ID.HashFunc() == obj.ID.HashFunc()
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Errorf("Expected the object hashed with %s to be reloaded with the same hash", hash)
+		}
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	t.Parallel()
+	d, diskPath, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+	// the usage calculated when the storage was created
+	if usage, err := d.DiskUsage(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	} else if usage == 0 {
+		t.Error("Expected the settings of the storage to be counted")
+	}
+
+	var obj = &types.ObjectMetadata{ID: types.NewObjectID("usage", "/path")}
+	saveMetadata(t, d, obj)
+	savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 0}, "0123456789")
+	savePart(t, d, &types.ObjectIndex{ObjID: obj.ID, Part: 1}, "01234")
+
+	var expected uint64
+	if err := filepath.Walk(diskPath, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			expected += uint64(info.Size())
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new storage for the same path has the usage right away
+	reopened, err := New(&config.CacheZone{Path: diskPath, PartSize: 10}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := reopened.DiskUsage(); err != nil || usage != expected {
+		t.Fatalf("Expected disk usage %d but got %d (%v)", expected, usage, err)
+	}
+
+	// the value is cached and not recalculated on every call
+	savePart(t, reopened, &types.ObjectIndex{ObjID: obj.ID, Part: 2}, "0123456789")
+	if usage, _ := reopened.DiskUsage(); usage != expected {
+		t.Errorf("Expected the cached disk usage %d but got %d", expected, usage)
+	}
 }
@@ -0,0 +1,182 @@
+// Package memory implements a storage which keeps all objects and their parts
+// in the memory of the process. Its contents do not survive restarts.
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// Memory implements the Storage interface by keeping everything in memory
+type Memory struct {
+	types.SyncLogger
+	sync.RWMutex
+	partSize uint64
+	objects  map[types.ObjectIDHash]*types.ObjectMetadata
+	parts    map[types.ObjectIDHash]map[uint32][]byte
+}
+
+// PartSize the maximum part size for the memory storage.
+func (s *Memory) PartSize() uint64 {
+	return s.partSize
+}
+
+// GetMetadata returns the metadata for this object, if present.
+func (s *Memory) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if obj, ok := s.objects[id.Hash()]; ok {
+		return obj, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// GetPart returns an io.ReadCloser that will read the specified part of the
+// object from memory.
+func (s *Memory) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if obj, ok := s.parts[idx.ObjID.Hash()]; ok {
+		if part, ok := obj[idx.Part]; ok {
+			return ioutil.NopCloser(bytes.NewReader(part)), nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// GetAvailableParts returns types.ObjectIndexMap including all the available
+// parts of for the object specified by the provided objectMetadata
+func (s *Memory) GetAvailableParts(oid *types.ObjectID) ([]*types.ObjectIndex, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if _, ok := s.objects[oid.Hash()]; !ok {
+		return nil, os.ErrNotExist
+	}
+	var obj = s.parts[oid.Hash()]
+	var result = make([]*types.ObjectIndex, 0, len(obj))
+	for partNum := range obj {
+		result = append(result, &types.ObjectIndex{
+			ObjID: oid,
+			Part:  partNum,
+		})
+	}
+	sort.Sort(types.ObjectIndexes(result))
+	return result, nil
+}
+
+// SaveMetadata saves the supplied metadata in memory.
+func (s *Memory) SaveMetadata(m *types.ObjectMetadata) error {
+	s.Lock()
+	defer s.Unlock()
+	s.objects[m.ID.Hash()] = m
+	return nil
+}
+
+// UpdateMetadata replaces the metadata of an object which is in memory.
+func (s *Memory) UpdateMetadata(m *types.ObjectMetadata) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.objects[m.ID.Hash()]; !ok {
+		return os.ErrNotExist
+	}
+	s.objects[m.ID.Hash()] = m
+	return nil
+}
+
+// SavePart saves the contents of the supplied object part in memory.
+func (s *Memory) SavePart(idx *types.ObjectIndex, data io.Reader) error {
+	contents, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if uint64(len(contents)) > s.partSize {
+		return fmt.Errorf("Object part has invalid size %d", len(contents))
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	objHash := idx.ObjID.Hash()
+	if _, ok := s.parts[objHash]; !ok {
+		s.parts[objHash] = make(map[uint32][]byte)
+	}
+	s.parts[objHash][idx.Part] = contents
+	return nil
+}
+
+// Discard removes the object and its metadata from memory.
+func (s *Memory) Discard(id *types.ObjectID) error {
+	s.Lock()
+	defer s.Unlock()
+	_, hasMetadata := s.objects[id.Hash()]
+	_, hasParts := s.parts[id.Hash()]
+	if !hasMetadata && !hasParts {
+		return os.ErrNotExist
+	}
+	delete(s.objects, id.Hash())
+	delete(s.parts, id.Hash())
+	return nil
+}
+
+// DiscardPart removes the specified part of an Object from memory.
+func (s *Memory) DiscardPart(idx *types.ObjectIndex) error {
+	s.Lock()
+	defer s.Unlock()
+	if obj, ok := s.parts[idx.ObjID.Hash()]; ok {
+		if _, ok := obj[idx.Part]; ok {
+			delete(obj, idx.Part)
+			return nil
+		}
+	}
+	return os.ErrNotExist
+}
+
+// Iterate iterates over all the objects in memory and passes them to the
+// supplied callback function. If the callback function returns false, the
+// iteration stops.
+func (s *Memory) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool) error {
+	s.RLock()
+	var objects = make([]*types.ObjectMetadata, 0, len(s.objects))
+	for _, obj := range s.objects {
+		objects = append(objects, obj)
+	}
+	s.RUnlock()
+
+	for _, obj := range objects {
+		parts, err := s.GetAvailableParts(obj.ID)
+		if err != nil { // discarded in the meantime
+			continue
+		}
+		if !callback(obj, parts...) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// New returns a new memory storage that ready for use.
+func New(cfg *config.CacheZone, log types.Logger) (*Memory, error) {
+	if cfg == nil || log == nil {
+		return nil, fmt.Errorf("nil constructor parameters")
+	}
+
+	if cfg.PartSize == 0 {
+		return nil, fmt.Errorf("invalid partSize value")
+	}
+
+	s := &Memory{
+		partSize: cfg.PartSize.Bytes(),
+		objects:  make(map[types.ObjectIDHash]*types.ObjectMetadata),
+		parts:    make(map[types.ObjectIDHash]map[uint32][]byte),
+	}
+	s.SetLogger(log)
+
+	return s, nil
+}
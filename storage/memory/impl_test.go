@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestBasicOperations(t *testing.T) {
+	t.Parallel()
+	s, err := New(&config.CacheZone{PartSize: 10}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var obj = &types.ObjectMetadata{ID: types.NewObjectID("test", "/path"), Size: 15}
+	var idx = &types.ObjectIndex{ObjID: obj.ID, Part: 1}
+
+	if err := s.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePart(idx, strings.NewReader("0123456789ab")); err == nil {
+		t.Error("Saving a part bigger than the part size should fail")
+	}
+	if err := s.SavePart(idx, strings.NewReader("01234")); err != nil {
+		t.Fatal(err)
+	}
+
+	if r, err := s.GetPart(idx); err != nil {
+		t.Errorf("Unexpected error while getting part: %s", err)
+	} else if b, _ := ioutil.ReadAll(r); string(b) != "01234" {
+		t.Errorf("Expected to read 01234 but got %s", b)
+	}
+	if parts, err := s.GetAvailableParts(obj.ID); err != nil || len(parts) != 1 {
+		t.Errorf("Expected one available part but got %v (%v)", parts, err)
+	}
+	var updated = &types.ObjectMetadata{ID: obj.ID, Size: 15, ExpiresAt: 42}
+	if err := s.UpdateMetadata(updated); err != nil {
+		t.Errorf("Unexpected error while updating metadata: %s", err)
+	} else if read, _ := s.GetMetadata(obj.ID); read != updated {
+		t.Errorf("Expected the metadata to be updated but got %v", read)
+	}
+
+	if err := s.DiscardPart(idx); err != nil {
+		t.Errorf("Unexpected error while discarding part: %s", err)
+	}
+	if _, err := s.GetPart(idx); !os.IsNotExist(err) {
+		t.Errorf("Expected the part to be discarded but got %v", err)
+	}
+	if err := s.Discard(obj.ID); err != nil {
+		t.Errorf("Unexpected error while discarding object: %s", err)
+	}
+	if _, err := s.GetMetadata(obj.ID); !os.IsNotExist(err) {
+		t.Errorf("Expected the metadata to be discarded but got %v", err)
+	}
+	if err := s.UpdateMetadata(updated); !os.IsNotExist(err) {
+		t.Errorf("Expected the update of a discarded object to fail but got %v", err)
+	}
+}
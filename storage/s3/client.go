@@ -0,0 +1,272 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	signService   = "s3"
+)
+
+// client is a minimal client for the S3 REST API. It supports only what the
+// storage needs: reading, writing, deleting and listing the objects of one
+// bucket. The requests are signed with AWS Signature Version 4.
+type client struct {
+	endpoint           *url.URL
+	region             string
+	bucket             string
+	accessKeyID        string
+	secretAccessKey    string
+	virtualHostedStyle bool
+	http               *http.Client
+	now                func() time.Time
+}
+
+// listResult is the part of the response of ListObjectsV2 used by the client.
+type listResult struct {
+	Keys []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// errorResult is the body of the error responses of S3.
+type errorResult struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// get returns the contents of the object with the provided key. The caller
+// has to close them.
+func (c *client) get(key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// head returns the entity tag of the object with the provided key.
+func (c *client) head(key string) (string, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// put stores the object with the provided key and contents.
+func (c *client) put(key string, header http.Header, body []byte) error {
+	resp, err := c.do("PUT", key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// delete removes the object with the provided key. It does not fail when
+// there is no such object.
+func (c *client) delete(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// list returns a page of the keys with the provided prefix, sorted, and the
+// token for the next page. The token is empty after the last page.
+func (c *client) list(prefix, token string) ([]string, string, error) {
+	var query = url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	resp, err := c.do("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var result listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", fmt.Errorf("error while parsing the list of %s: %s", prefix, err)
+	}
+	var keys = make([]string, 0, len(result.Keys))
+	for _, k := range result.Keys {
+		keys = append(keys, k.Key)
+	}
+	if !result.IsTruncated {
+		return keys, "", nil
+	}
+	return keys, result.NextContinuationToken, nil
+}
+
+// listAll returns all keys with the provided prefix, sorted.
+func (c *client) listAll(prefix string) ([]string, error) {
+	var result []string
+	var token string
+	for {
+		keys, next, err := c.list(prefix, token)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, keys...)
+		if next == "" {
+			return result, nil
+		}
+		token = next
+	}
+}
+
+// do sends a signed request for the object with the provided key, or for the
+// bucket when the key is empty. Responses with 404 Not Found are returned as
+// os.ErrNotExist and the other unsuccessful ones as errors.
+func (c *client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var u = c.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, body)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	var result errorResult
+	if b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096)); err == nil {
+		_ = xml.Unmarshal(b, &result)
+	}
+	return nil, fmt.Errorf("s3 %s of `%s` failed with %s: %s %s",
+		method, key, resp.Status, result.Code, result.Message)
+}
+
+// objectURL returns the URL of the object with the provided key in the
+// bucket, either with the bucket in the path or in the host name.
+func (c *client) objectURL(key string) *url.URL {
+	var u = *c.endpoint
+	var path = "/" + key
+	if c.virtualHostedStyle {
+		u.Host = c.bucket + "." + u.Host
+	} else {
+		path = "/" + c.bucket + path
+	}
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + path
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+// sign adds the headers with AWS Signature Version 4 to the request. The
+// host, the headers which are already set and the x-amz-* ones are signed.
+func (c *client) sign(req *http.Request, body []byte) {
+	var now = c.now().UTC()
+	var date = now.Format(amzDateFormat)
+	var payloadHash = sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	var headers = map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names = make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	var signedHeaders = strings.Join(names, ";")
+
+	var canonicalRequest = strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	var scope = strings.Join([]string{now.Format("20060102"), c.region, signService, "aws4_request"}, "/")
+	var requestHash = sha256.Sum256([]byte(canonicalRequest))
+	var stringToSign = strings.Join([]string{
+		signAlgorithm, date, scope, hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	var key = []byte("AWS4" + c.secretAccessKey)
+	for _, part := range []string{now.Format("20060102"), c.region, signService, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, c.accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	var h = hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by the names of the parameters, as
+// needed for the signature.
+func canonicalQuery(query url.Values) string {
+	var names = make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params = make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes everything except the unreserved characters, as
+// required by the signature. The slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var result bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '.', b == '_', b == '~':
+			result.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			result.WriteByte(b)
+		default:
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,318 @@
+// Package s3 implements a storage which keeps the objects in a bucket of an
+// S3-compatible object storage. Every part is a separate object in the
+// bucket and the metadata is a sidecar object next to the parts, all of them
+// under the key prefix of the object, which starts with the path of the zone.
+package s3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+const (
+	objectMetadataKeyName  = "objID"
+	defaultRegion          = "us-east-1"
+	defaultDialTimeout     = 10 * time.Second
+	defaultResponseTimeout = 30 * time.Second
+)
+
+// S3 implements the Storage interface by keeping the objects in a bucket.
+type S3 struct {
+	types.SyncLogger
+	partSize           uint64
+	prefix             string
+	skipCacheKeyInPath bool
+	client             *client
+}
+
+// PartSize the maximum part size for the s3 storage.
+func (s *S3) PartSize() uint64 {
+	return s.partSize
+}
+
+// GetMetadata returns the metadata for this object, if present.
+func (s *S3) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
+	return s.getObjectMetadata(s.getObjectMetadataKey(id))
+}
+
+// GetPart returns an io.ReadCloser that will read the specified part of the
+// object from the bucket.
+func (s *S3) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
+	return s.client.get(s.getObjectIndexKey(idx))
+}
+
+// GetAvailableParts returns types.ObjectIndexMap including all the available
+// parts of for the object specified by the provided objectMetadata
+func (s *S3) GetAvailableParts(oid *types.ObjectID) ([]*types.ObjectIndex, error) {
+	keys, err := s.client.listAll(s.getObjectIDKey(oid))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return partsFromKeys(oid, keys), nil
+}
+
+// SaveMetadata saves the supplied metadata in its sidecar object.
+func (s *S3) SaveMetadata(m *types.ObjectMetadata) error {
+	s.GetLogger().Debugf("[S3Storage] Saving metadata for %s...", m.ID)
+	return s.putMetadata(m, nil)
+}
+
+// UpdateMetadata replaces the metadata of an object which is in the bucket.
+// The metadata is replaced only if it was not changed since it was checked,
+// when the object storage supports conditional writes.
+func (s *S3) UpdateMetadata(m *types.ObjectMetadata) error {
+	s.GetLogger().Debugf("[S3Storage] Updating metadata for %s...", m.ID)
+	etag, err := s.client.head(s.getObjectMetadataKey(m.ID))
+	if err != nil {
+		return err
+	}
+	var header = make(http.Header)
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	return s.putMetadata(m, header)
+}
+
+func (s *S3) putMetadata(m *types.ObjectMetadata, header http.Header) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", "application/json")
+	return s.client.put(s.getObjectMetadataKey(m.ID), header, body)
+}
+
+// SavePart saves the contents of the supplied object part in the bucket.
+func (s *S3) SavePart(idx *types.ObjectIndex, data io.Reader) error {
+	s.GetLogger().Debugf("[S3Storage] Saving %s...", idx)
+	contents, err := ioutil.ReadAll(io.LimitReader(data, int64(s.partSize)+1))
+	if err != nil {
+		return err
+	}
+	if uint64(len(contents)) > s.partSize {
+		return fmt.Errorf("Object part has invalid size %d", len(contents))
+	}
+	return s.client.put(s.getObjectIndexKey(idx), nil, contents)
+}
+
+// Discard removes the object and its metadata from the bucket. The metadata
+// is removed first, so that the object is not found while its parts are
+// being removed.
+func (s *S3) Discard(id *types.ObjectID) error {
+	s.GetLogger().Debugf("[S3Storage] Discarding %s...", id)
+	keys, err := s.client.listAll(s.getObjectIDKey(id))
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return os.ErrNotExist
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return path.Base(keys[i]) == objectMetadataKeyName && path.Base(keys[j]) != objectMetadataKeyName
+	})
+	for _, key := range keys {
+		if err := s.client.delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiscardPart removes the specified part of an Object from the bucket. As
+// deleting a missing key is not an error for S3, neither is discarding a
+// missing part.
+func (s *S3) DiscardPart(idx *types.ObjectIndex) error {
+	s.GetLogger().Debugf("[S3Storage] Discarding %s...", idx)
+	return s.client.delete(s.getObjectIndexKey(idx))
+}
+
+// Iterate iterates over all the objects in the bucket and passes them to the
+// supplied callback function. The keys are listed page by page and as they
+// are sorted, all keys of an object are next to each other. If the callback
+// function returns false, the iteration stops.
+func (s *S3) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool) error {
+	var prefix = s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	var (
+		group    []string
+		token    string
+		stopped  bool
+		flushFor = func(keys []string) {
+			if stopped || len(keys) == 0 {
+				return
+			}
+			var metadataKey = path.Join(path.Dir(keys[0]), objectMetadataKeyName)
+			obj, err := s.getObjectMetadata(metadataKey)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					s.GetLogger().Errorf("[S3Storage] %s", err)
+				}
+				return
+			}
+			stopped = !callback(obj, partsFromKeys(obj.ID, keys)...)
+		}
+	)
+	for {
+		keys, next, err := s.client.list(prefix, token)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if len(group) > 0 && path.Dir(group[0]) != path.Dir(key) {
+				flushFor(group)
+				group = group[:0]
+			}
+			if stopped {
+				return nil
+			}
+			group = append(group, key)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	flushFor(group)
+	return nil
+}
+
+func (s *S3) getObjectIDKey(id *types.ObjectID) string {
+	var segments = []string{s.prefix, id.CacheKey(), id.StrHash()}
+	if s.skipCacheKeyInPath {
+		segments = []string{s.prefix, id.StrHash()}
+	}
+	return strings.TrimPrefix(path.Join(segments...), "/") + "/"
+}
+
+func (s *S3) getObjectIndexKey(idx *types.ObjectIndex) string {
+	return s.getObjectIDKey(idx.ObjID) + getPartKeyName(idx.Part)
+}
+
+func (s *S3) getObjectMetadataKey(id *types.ObjectID) string {
+	return s.getObjectIDKey(id) + objectMetadataKeyName
+}
+
+func (s *S3) getObjectMetadata(key string) (*types.ObjectMetadata, error) {
+	r, err := s.client.get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	obj := &types.ObjectMetadata{}
+	if err := json.NewDecoder(r).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("could not read the metadata in %s: %s", key, err)
+	}
+	if obj.ID == nil {
+		return nil, fmt.Errorf("The metadata in %s has no object id", key)
+	}
+	if path.Base(path.Dir(key)) != obj.ID.StrHash() {
+		return nil, fmt.Errorf("The object %s was under the wrong key: %s", obj.ID, key)
+	}
+	return obj, nil
+}
+
+func getPartKeyName(part uint32) string {
+	// The same names as the part files of the disk storage
+	return fmt.Sprintf("%06d", part)
+}
+
+// partsFromKeys returns the sorted parts of the object among the keys under
+// its prefix. The other keys are ignored.
+func partsFromKeys(oid *types.ObjectID, keys []string) []*types.ObjectIndex {
+	var parts = make([]*types.ObjectIndex, 0, len(keys))
+	for _, key := range keys {
+		var name = path.Base(key)
+		partNum, err := strconv.Atoi(name)
+		if err != nil || partNum < 0 || getPartKeyName(uint32(partNum)) != name {
+			continue
+		}
+		parts = append(parts, &types.ObjectIndex{ObjID: oid, Part: uint32(partNum)})
+	}
+	sort.Sort(types.ObjectIndexes(parts))
+	return parts
+}
+
+// newHTTPClient returns the client for the requests to the object storage
+// with the timeouts of the settings.
+func newHTTPClient(settings config.S3Storage) *http.Client {
+	var dialTimeout = time.Duration(settings.DialTimeout) * time.Millisecond
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	var responseTimeout = time.Duration(settings.ResponseTimeout) * time.Millisecond
+	if responseTimeout == 0 {
+		responseTimeout = defaultResponseTimeout
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			TLSHandshakeTimeout:   dialTimeout,
+			ResponseHeaderTimeout: responseTimeout,
+		},
+	}
+}
+
+// New returns a new s3 storage that ready for use. The path of the zone is
+// the prefix of the keys of its objects in the bucket.
+func New(cfg *config.CacheZone, log types.Logger) (*S3, error) {
+	if cfg == nil || log == nil {
+		return nil, fmt.Errorf("nil constructor parameters")
+	}
+	if cfg.PartSize == 0 {
+		return nil, fmt.Errorf("invalid partSize value")
+	}
+	if cfg.S3.Endpoint == "" || cfg.S3.Bucket == "" {
+		return nil, fmt.Errorf("the s3 storage needs an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(cfg.S3.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint `%s`", cfg.S3.Endpoint)
+	}
+	var region = cfg.S3.Region
+	if region == "" {
+		region = defaultRegion
+	}
+
+	s := &S3{
+		partSize:           cfg.PartSize.Bytes(),
+		prefix:             strings.Trim(cfg.Path, "/"),
+		skipCacheKeyInPath: cfg.SkipCacheKeyInPath,
+		client: &client{
+			endpoint:           endpoint,
+			region:             region,
+			bucket:             cfg.S3.Bucket,
+			accessKeyID:        cfg.S3.AccessKeyID,
+			secretAccessKey:    cfg.S3.SecretAccessKey,
+			virtualHostedStyle: cfg.S3.VirtualHostedStyle,
+			http:               newHTTPClient(cfg.S3),
+			now:                time.Now,
+		},
+	}
+	s.SetLogger(log)
+
+	return s, nil
+}
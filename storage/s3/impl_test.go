@@ -0,0 +1,258 @@
+package s3
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// fakeBucket is an in-memory object storage with a single bucket which lists
+// up to pageSize keys at a time.
+type fakeBucket struct {
+	sync.Mutex
+	objects  map[string][]byte
+	pageSize int
+}
+
+func (f *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	f.Lock()
+	defer f.Unlock()
+	var key = strings.TrimPrefix(r.URL.Path, "/bucket/")
+	if r.URL.Path == "/bucket/" && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token"))
+		return
+	}
+	var contents, ok = f.objects[key]
+	switch r.Method {
+	case "GET", "HEAD":
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Write(contents)
+	case "PUT":
+		if r.Header.Get("If-Match") != "" && !ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		f.objects[key], _ = ioutil.ReadAll(r.Body)
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeBucket) list(w http.ResponseWriter, prefix, token string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var result listResult
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Keys = append(result.Keys, struct {
+			Key string `xml:"Key"`
+		}{key})
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		listResult
+	}{listResult: result})
+}
+
+func newTestStorage(t *testing.T) (*S3, *fakeBucket, func()) {
+	var bucket = &fakeBucket{objects: make(map[string][]byte), pageSize: 2}
+	var server = httptest.NewServer(bucket)
+	s, err := New(&config.CacheZone{
+		Path:     "/zone/",
+		PartSize: 10,
+		S3: config.S3Storage{
+			Endpoint:        server.URL,
+			Bucket:          "bucket",
+			AccessKeyID:     "key",
+			SecretAccessKey: "secret",
+		},
+	}, mock.NewLogger())
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return s, bucket, server.Close
+}
+
+func TestBasicOperations(t *testing.T) {
+	t.Parallel()
+	s, bucket, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	var obj = &types.ObjectMetadata{ID: types.NewObjectID("test", "/path"), Size: 15}
+	var idx = &types.ObjectIndex{ObjID: obj.ID, Part: 1}
+
+	if _, err := s.GetMetadata(obj.ID); !os.IsNotExist(err) {
+		t.Errorf("Expected no metadata before it is saved but got %v", err)
+	}
+	if err := s.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePart(idx, strings.NewReader("0123456789ab")); err == nil {
+		t.Error("Saving a part bigger than the part size should fail")
+	}
+	if err := s.SavePart(idx, strings.NewReader("01234")); err != nil {
+		t.Fatal(err)
+	}
+	var partKey = "zone/test/" + obj.ID.StrHash() + "/000001"
+	if string(bucket.objects[partKey]) != "01234" {
+		t.Errorf("Expected the part to be stored as %s but got %v", partKey, bucket.objects)
+	}
+
+	if r, err := s.GetPart(idx); err != nil {
+		t.Errorf("Unexpected error while getting part: %s", err)
+	} else if b, _ := ioutil.ReadAll(r); string(b) != "01234" {
+		t.Errorf("Expected to read 01234 but got %s", b)
+	}
+	if parts, err := s.GetAvailableParts(obj.ID); err != nil || len(parts) != 1 || parts[0].Part != 1 {
+		t.Errorf("Expected one available part but got %v (%v)", parts, err)
+	}
+	var updated = &types.ObjectMetadata{ID: obj.ID, Size: 15, ExpiresAt: 42}
+	if err := s.UpdateMetadata(updated); err != nil {
+		t.Errorf("Unexpected error while updating metadata: %s", err)
+	} else if read, _ := s.GetMetadata(obj.ID); read == nil || read.ExpiresAt != 42 {
+		t.Errorf("Expected the metadata to be updated but got %v", read)
+	}
+
+	if err := s.DiscardPart(idx); err != nil {
+		t.Errorf("Unexpected error while discarding part: %s", err)
+	}
+	if _, err := s.GetPart(idx); !os.IsNotExist(err) {
+		t.Errorf("Expected the part to be discarded but got %v", err)
+	}
+	if err := s.DiscardPart(idx); err != nil {
+		t.Errorf("Unexpected error for discarding a missing part: %s", err)
+	}
+	if err := s.Discard(obj.ID); err != nil {
+		t.Errorf("Unexpected error while discarding object: %s", err)
+	}
+	if _, err := s.GetMetadata(obj.ID); !os.IsNotExist(err) {
+		t.Errorf("Expected the metadata to be discarded but got %v", err)
+	}
+	if err := s.UpdateMetadata(updated); !os.IsNotExist(err) {
+		t.Errorf("Expected the update of a discarded object to fail but got %v", err)
+	}
+	if err := s.Discard(obj.ID); !os.IsNotExist(err) {
+		t.Errorf("Expected an error for discarding a missing object but got %v", err)
+	}
+}
+
+func TestIterateOverPages(t *testing.T) {
+	t.Parallel()
+	s, bucket, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	var expected = map[string]int{}
+	for i, path := range []string{"/a", "/b", "/c", "/d"} {
+		var obj = &types.ObjectMetadata{ID: types.NewObjectID("test", path), Size: 30}
+		if err := s.SaveMetadata(obj); err != nil {
+			t.Fatal(err)
+		}
+		for part := 0; part < i; part++ {
+			var idx = &types.ObjectIndex{ObjID: obj.ID, Part: uint32(part)}
+			if err := s.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected[path] = i
+	}
+	// keys which are not of objects are skipped
+	bucket.objects["zone/unknown/000001"] = []byte("orphan")
+	bucket.objects["zone/test/broken/objID"] = []byte("{")
+
+	var found = map[string]int{}
+	if err := s.Iterate(func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+		found[obj.ID.Path()] = len(parts)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(expected) {
+		t.Errorf("Expected to iterate over %v but got %v", expected, found)
+	}
+	for path, parts := range expected {
+		if found[path] != parts {
+			t.Errorf("Expected %d parts of %s but got %d", parts, path, found[path])
+		}
+	}
+
+	var count int
+	if err := s.Iterate(func(*types.ObjectMetadata, ...*types.ObjectIndex) bool {
+		count++
+		return count < 2
+	}); err != nil || count != 2 {
+		t.Errorf("Expected the iteration to stop after 2 objects but got %d (%v)", count, err)
+	}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	t.Parallel()
+	var unblock = make(chan struct{})
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+	s, err := New(&config.CacheZone{
+		Path:     "zone",
+		PartSize: 10,
+		S3: config.S3Storage{
+			Endpoint:        server.URL,
+			Bucket:          "bucket",
+			ResponseTimeout: 50,
+		},
+	}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start = time.Now()
+	if _, err := s.GetMetadata(types.NewObjectID("test", "/slow")); err == nil {
+		t.Error("Expected an error when the object storage does not respond")
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Expected the request to time out but it took %s", took)
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	t.Parallel()
+	for _, settings := range []config.S3Storage{
+		{Bucket: "bucket"},
+		{Endpoint: "http://localhost"},
+		{Endpoint: "localhost:9000", Bucket: "bucket"},
+	} {
+		var cfg = &config.CacheZone{Path: "zone", PartSize: 10, S3: settings}
+		if _, err := New(cfg, mock.NewLogger()); err == nil {
+			t.Errorf("Expected an error for the settings %+v", settings)
+		}
+	}
+}
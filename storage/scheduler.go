@@ -153,13 +153,17 @@ func (em *Scheduler) expiresHandler() {
 			heap.Init(expires)
 
 		case <-timer.C:
-			if nextExpire == nil {
+			// the timer may have fired for an earlier reset
+			if nextExpire == nil || nextExpire.Expires.After(time.Now()) {
 				continue
 			}
-			em.deleteRequest <- nextExpire.Key
-			delete(expiresDict, nextExpire.Key)
-
-			heap.Remove(expires, 0)
+			var next = heap.Remove(expires, 0).(expireTime)
+			// the event may have been rescheduled since this entry was added
+			if at, ok := expiresDict[next.Key]; !ok || !at.Equal(next.Expires) {
+				continue
+			}
+			em.deleteRequest <- next.Key
+			delete(expiresDict, next.Key)
 		}
 	}
 }
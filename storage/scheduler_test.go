@@ -177,3 +177,22 @@ func TestChangeLogger(t *testing.T) {
 		t.Error("the log checking function has not expired")
 	}
 }
+
+func TestReschedulingForLater(t *testing.T) {
+	t.Parallel()
+	logger := mock.NewLogger()
+	mp := NewScheduler(logger)
+	defer mp.Destroy()
+	var early, late = "early", "late"
+
+	ch := make(chan string)
+	mp.AddEvent(fooKey, writeFunc(ch, early), 50*time.Millisecond)
+	mp.AddEvent(fooKey, writeFunc(ch, late), 200*time.Millisecond)
+
+	if got := waitAround(t, ch, 200*time.Millisecond); got != late {
+		t.Errorf("expected '%s' got '%s'", late, got)
+	}
+	if mp.Contains(fooKey) {
+		t.Error("expected the executed event to be removed")
+	}
+}
@@ -8,14 +8,32 @@ import (
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
 
+	"github.com/ironsmile/nedomi/storage/composite"
+
 	"github.com/ironsmile/nedomi/storage/disk"
+
+	"github.com/ironsmile/nedomi/storage/memory"
+
+	"github.com/ironsmile/nedomi/storage/s3"
 )
 
 type newStorageFunc func(cfg *config.CacheZone, log types.Logger) (types.Storage, error)
 
 var storageTypes = map[string]newStorageFunc{
 
+	"composite": func(cfg *config.CacheZone, log types.Logger) (types.Storage, error) {
+		return composite.New(cfg, log)
+	},
+
 	"disk": func(cfg *config.CacheZone, log types.Logger) (types.Storage, error) {
 		return disk.New(cfg, log)
 	},
+
+	"memory": func(cfg *config.CacheZone, log types.Logger) (types.Storage, error) {
+		return memory.New(cfg, log)
+	},
+
+	"s3": func(cfg *config.CacheZone, log types.Logger) (types.Storage, error) {
+		return s3.New(cfg, log)
+	},
 }
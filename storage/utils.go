@@ -1,11 +1,27 @@
 package storage
 
-import "github.com/ironsmile/nedomi/types"
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// frozenExpirationRetry is the interval after which the expiration of an
+// object is attempted again when its zone is frozen.
+const frozenExpirationRetry = time.Minute
 
 // GetExpirationHandler returns a potentially long-lived callback that removes
-// the specified object from the storage.
+// the specified object from the storage. While the zone is frozen the removal
+// is postponed.
 func GetExpirationHandler(cz *types.CacheZone, id *types.ObjectID) func(types.Logger) {
 	return func(logger types.Logger) {
+		if cz.EvictionPaused() {
+			logger.Debugf("Keeping expired object %s in frozen zone %s", id, cz.ID)
+			cz.Scheduler.AddEvent(id.Hash(), GetExpirationHandler(cz, id), frozenExpirationRetry)
+			return
+		}
 		//!TODO: simplify and ignore the cache algorithm when expiring objects.
 		// It is only supposed to take into account client interest in the
 		// object parts, not whether they are expired due to upstream timeouts
@@ -21,5 +37,34 @@ func GetExpirationHandler(cz *types.CacheZone, id *types.ObjectID) func(types.Lo
 		if err := cz.Storage.Discard(id); err != nil {
 			logger.Errorf("Error while discarding expired object %s from zone %s: %s", id, cz.ID, err)
 		}
+		cz.SurrogateKeys.Remove(id)
+		cz.Groups.Remove(id)
+	}
+}
+
+// GetPartContext reads the part from the storage. If the storage supports it,
+// waiting for its turn to read is abandoned when the context is done.
+func GetPartContext(ctx context.Context, s types.Storage, idx *types.ObjectIndex) (io.ReadCloser, error) {
+	if cs, ok := s.(types.ContextPartStorage); ok {
+		return cs.GetPartContext(ctx, idx)
+	}
+	return s.GetPart(idx)
+}
+
+// SavePartContext saves the part in the storage. If the storage supports it,
+// waiting for its turn to write is abandoned when the context is done.
+func SavePartContext(ctx context.Context, s types.Storage, idx *types.ObjectIndex, data io.Reader) error {
+	if cs, ok := s.(types.ContextPartStorage); ok {
+		return cs.SavePartContext(ctx, idx, data)
+	}
+	return s.SavePart(idx, data)
+}
+
+// FinishFill tells the storage that a fill of the object is done, if it needs
+// to know.
+func FinishFill(s types.Storage, id *types.ObjectID) error {
+	if ff, ok := s.(types.FillFinisher); ok {
+		return ff.FinishFill(id)
 	}
+	return nil
 }
@@ -21,6 +21,23 @@ type App interface {
 
 	// GetUpstream gets an upstream by it's id, nil is returned if no such is defined
 	GetUpstream(id string) Upstream
+
+	// MemoryStats returns the memory usage of the app and whether it is
+	// degraded because of memory pressure
+	MemoryStats() MemoryStats
+
+	// UpstreamsHealth returns the health of the addresses of all upstreams
+	// with active health checks by their IDs
+	UpstreamsHealth() map[string][]UpstreamAddressHealth
+
+	// UpstreamsConnections returns the numbers of requests in flight and
+	// waiting for the addresses of all upstreams with a connection limit by
+	// their IDs
+	UpstreamsConnections() map[string][]UpstreamAddressConnections
+
+	// UpstreamsLatency returns the distribution of the response times of
+	// all upstreams which have responded by their IDs
+	UpstreamsLatency() map[string]UpstreamLatency
 }
 
 // AppStats are stats for the whole application
@@ -28,6 +45,12 @@ type AppStats struct {
 	Requests, Responded, NotConfigured uint64
 }
 
+// MemoryStats represents the memory usage of the application
+type MemoryStats struct {
+	Used, Limit uint64
+	Degraded    bool
+}
+
 // AppVersion is struct representing an App version
 type AppVersion struct {
 	Dirty     bool
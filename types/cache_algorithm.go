@@ -19,7 +19,7 @@ type CacheAlgorithm interface {
 	// to satisfy a client request
 	PromoteObject(*ObjectIndex)
 
-	// ConsumedSize returns the full size of all files currently in the cache
+	// ConsumedSize returns the full size of all parts currently in the cache
 	ConsumedSize() BytesSize
 
 	// Stats returns statistics for this cache algorithm
@@ -29,15 +29,31 @@ type CacheAlgorithm interface {
 	Remove(...*ObjectIndex)
 
 	// ChangeConfig changes the changeable parts of the a CacheAlgorithm:
-	// the timeout and count for removing objects in bulk
-	// and the count of objects it contains. Automatically resizing the algorithm
-	// if it's required
-	ChangeConfig(bulkTimeout, bulkCount, objectCount uint64)
+	// the timeout and count for removing objects in bulk,
+	// the count of objects it contains and their maximum total size (zero for
+	// no limit). Automatically resizing the algorithm if it's required
+	ChangeConfig(bulkTimeout, bulkCount, objectCount uint64, maxSize BytesSize)
 
 	// SetLogger changes the Logger of the CacheAlgorithm
 	SetLogger(Logger)
 }
 
+// ObjectSizeTracker is implemented by the cache algorithms which weight the
+// eviction of the parts by the sizes of their objects.
+type ObjectSizeTracker interface {
+	// SetObjectSize records the size of the object with the given ID. It may
+	// be called before or after its parts are added to the cache.
+	SetObjectSize(id *ObjectID, size uint64)
+}
+
+// SpaceReclaimer is implemented by the cache algorithms which can evict parts
+// on demand, e.g. when their storage is running out of space.
+type SpaceReclaimer interface {
+	// ReclaimSpace evicts parts, the least valuable ones first, until at
+	// least the given number of bytes are freed or the cache is empty.
+	ReclaimSpace(bytes uint64)
+}
+
 // Exported errors
 var (
 	ErrAlreadyInCache = errors.New("Object already in cache")
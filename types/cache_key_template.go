@@ -0,0 +1,182 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CacheKeyTemplate builds the keys of the cached objects from the requested
+// URLs, so that the equivalent URLs are cached as a single object. It is
+// parsed from a template with literal text and placeholders such as
+// "{host}{path}?{query:sorted,drop=utm_*}". The supported placeholders are:
+//
+//	{scheme}       - the lowercased scheme, http if it is not known
+//	{host}         - the lowercased host
+//	{path}         - the path
+//	{query:opts}   - the query parameters, where opts are comma-separated:
+//	                 sorted, keep=pattern and drop=pattern. Only the
+//	                 parameters matching one of the keep patterns are used, if
+//	                 there are any, and the ones matching a drop pattern are not
+//	                 used. The patterns use the path.Match syntax.
+//	{header:Name}  - the value of the request header
+type CacheKeyTemplate struct {
+	template string
+	parts    []keyPart
+}
+
+// keyPart writes its part of the key for the URL and request headers.
+type keyPart func(b *bytes.Buffer, u *url.URL, headers http.Header)
+
+// ParseCacheKeyTemplate parses the cache key template, see CacheKeyTemplate.
+func ParseCacheKeyTemplate(template string) (*CacheKeyTemplate, error) {
+	var t = &CacheKeyTemplate{template: template}
+	var rest = template
+	for rest != "" {
+		var start = strings.IndexAny(rest, "{}")
+		if start < 0 {
+			t.parts = append(t.parts, literalPart(rest))
+			break
+		}
+		if rest[start] == '}' {
+			return nil, fmt.Errorf("unexpected } in the cache key template '%s'", template)
+		}
+		if start > 0 {
+			t.parts = append(t.parts, literalPart(rest[:start]))
+		}
+		var end = strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed { in the cache key template '%s'", template)
+		}
+		part, err := placeholderPart(rest[start+1 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("cache key template '%s': %s", template, err)
+		}
+		t.parts = append(t.parts, part)
+		rest = rest[start+end+1:]
+	}
+	return t, nil
+}
+
+// Key returns the key for the URL and request headers, which may be nil.
+func (t *CacheKeyTemplate) Key(u *url.URL, headers http.Header) string {
+	var b bytes.Buffer
+	for _, part := range t.parts {
+		part(&b, u, headers)
+	}
+	return b.String()
+}
+
+func (t *CacheKeyTemplate) String() string {
+	return t.template
+}
+
+func literalPart(text string) keyPart {
+	return func(b *bytes.Buffer, _ *url.URL, _ http.Header) {
+		b.WriteString(text)
+	}
+}
+
+func placeholderPart(placeholder string) (keyPart, error) {
+	var name, options = placeholder, ""
+	if i := strings.IndexByte(placeholder, ':'); i >= 0 {
+		name, options = placeholder[:i], placeholder[i+1:]
+	}
+	switch name {
+	case "scheme", "host", "path":
+		if options != "" {
+			return nil, fmt.Errorf("{%s} has no options", name)
+		}
+	}
+
+	switch name {
+	case "scheme":
+		return func(b *bytes.Buffer, u *url.URL, _ http.Header) {
+			if u.Scheme == "" {
+				b.WriteString("http")
+			} else {
+				b.WriteString(strings.ToLower(u.Scheme))
+			}
+		}, nil
+	case "host":
+		return func(b *bytes.Buffer, u *url.URL, _ http.Header) {
+			b.WriteString(strings.ToLower(u.Host))
+		}, nil
+	case "path":
+		return func(b *bytes.Buffer, u *url.URL, _ http.Header) {
+			b.WriteString(u.Path)
+		}, nil
+	case "query":
+		return queryPart(options)
+	case "header":
+		if options == "" {
+			return nil, fmt.Errorf("{header} needs a header name, e.g. {header:Accept-Language}")
+		}
+		var header = http.CanonicalHeaderKey(options)
+		return func(b *bytes.Buffer, _ *url.URL, headers http.Header) {
+			b.WriteString(headers.Get(header))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown placeholder {%s}", placeholder)
+}
+
+func queryPart(options string) (keyPart, error) {
+	var sorted bool
+	var keep, drop []string
+	for _, option := range strings.Split(options, ",") {
+		var name, pattern = option, ""
+		if i := strings.IndexByte(option, '='); i >= 0 {
+			name, pattern = option[:i], option[i+1:]
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid query parameter pattern '%s': %s", pattern, err)
+			}
+		}
+		switch {
+		case name == "" && pattern == "":
+		case name == "sorted" && pattern == "":
+			sorted = true
+		case name == "keep" && pattern != "":
+			keep = append(keep, pattern)
+		case name == "drop" && pattern != "":
+			drop = append(drop, pattern)
+		default:
+			return nil, fmt.Errorf("unknown query option '%s'", option)
+		}
+	}
+
+	return func(b *bytes.Buffer, u *url.URL, _ http.Header) {
+		var params []string
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			if param == "" {
+				continue
+			}
+			var name = param
+			if i := strings.IndexByte(param, '='); i >= 0 {
+				name = param[:i]
+			}
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if (len(keep) == 0 || matchesAny(keep, name)) && !matchesAny(drop, name) {
+				params = append(params, param)
+			}
+		}
+		if sorted {
+			sort.Strings(params)
+		}
+		b.WriteString(strings.Join(params, "&"))
+	}, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package types
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCacheKeyTemplate(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		template, url string
+		header        http.Header
+		expected      string
+	}{
+		{"{path}", "http://example.com/a?b=1", nil, "/a"},
+		{"{host}{path}?{query}", "http://Example.COM/a?b=1&c=2", nil, "example.com/a?b=1&c=2"},
+		{"{path}?{query:sorted}", "/a?c=2&b=1&a=3", nil, "/a?a=3&b=1&c=2"},
+		{"{path}?{query:sorted,drop=utm_*}", "/a?utm_source=x&id=5&utm_medium=y", nil, "/a?id=5"},
+		{"{path}?{query:keep=id,keep=v*}", "/a?x=1&id=5&version=2", nil, "/a?id=5&version=2"},
+		{"{path}?{query:drop=utm_*}", "/a?utm_source=x", nil, "/a?"},
+		{"{scheme}://{path}", "/a", nil, "http:///a"},
+		{"{path}|{header:accept-language}", "/a",
+			http.Header{"Accept-Language": {"bg"}}, "/a|bg"},
+	}
+	for _, test := range tests {
+		tmpl, err := ParseCacheKeyTemplate(test.template)
+		if err != nil {
+			t.Errorf("Unexpected error for template '%s': %s", test.template, err)
+			continue
+		}
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key := tmpl.Key(req.URL, test.header); key != test.expected {
+			t.Errorf("Expected '%s' for %s with '%s' but got '%s'",
+				test.expected, test.url, test.template, key)
+		}
+	}
+
+	for _, invalid := range []string{
+		"{path", "path}", "{unknown}", "{path:sorted}", "{header}",
+		"{query:reversed}", "{query:drop=[}",
+	} {
+		if _, err := ParseCacheKeyTemplate(invalid); err == nil {
+			t.Errorf("Expected an error for the template '%s'", invalid)
+		}
+	}
+}
+
+func TestNewObjectIDWithTemplate(t *testing.T) {
+	t.Parallel()
+	tmpl, err := ParseCacheKeyTemplate("{host}{path}?{query:sorted,drop=utm_*}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loc = &Location{CacheKey: "1", CacheKeyIncludesQuery: true, CacheKeyTemplate: tmpl}
+
+	req, err := http.NewRequest("GET", "/path?b=2&utm_source=x&a=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "Example.com"
+	var expected = "example.com/path?a=1&b=2"
+	if got := loc.NewObjectIDForRequest(req).Path(); got != expected {
+		t.Errorf("Expected '%s' for the request but got '%s'", expected, got)
+	}
+	req.URL.Host = "example.com"
+	if got := loc.NewObjectIDForURL(req.URL).Path(); got != expected {
+		t.Errorf("Expected '%s' for the URL but got '%s'", expected, got)
+	}
+}
@@ -25,4 +25,12 @@ type CacheStats interface {
 
 	// Size returns the consumed space in bytes for this cache
 	Size() BytesSize
+
+	// Capacity returns the maximum number of objects in the cache, i.e. its
+	// configured storage_objects
+	Capacity() uint64
+
+	// MaxSize returns the maximum consumed space in bytes for this cache or 0
+	// if it is limited only by Capacity
+	MaxSize() BytesSize
 }
@@ -0,0 +1,20 @@
+package types
+
+// The possible values of CacheStatus.Status
+const (
+	CacheStatusHit         = "HIT"
+	CacheStatusMiss        = "MISS"
+	CacheStatusStale       = "STALE"
+	CacheStatusRevalidated = "REVALIDATED"
+	CacheStatusBypass      = "BYPASS"
+)
+
+// CacheStatus describes how a request was handled by the cache.
+type CacheStatus struct {
+	Status string
+	// Zone is the id of the cache zone of the location
+	Zone string
+	// Age is the age in seconds of the cached object with which the request
+	// was served, or -1 if it was not served from the cache.
+	Age int64
+}
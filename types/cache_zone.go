@@ -1,11 +1,245 @@
 package types
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DrainMode is the state of a cache zone which is being drained, e.g. for a
+// maintenance of its disk.
+type DrainMode string
+
+// The possible drain modes of a cache zone
+const (
+	// DrainOff is the normal state of the zone
+	DrainOff DrainMode = ""
+	// DrainReadOnly serves the stored objects but stores nothing new, the
+	// responses for everything else go through uncached
+	DrainReadOnly DrainMode = "read-only"
+	// DrainFrozen is like DrainReadOnly, but the expired objects are not
+	// removed either
+	DrainFrozen DrainMode = "frozen"
+)
+
+// Valid returns whether the drain mode is one of the known ones.
+func (m DrainMode) Valid() bool {
+	return m == DrainOff || m == DrainReadOnly || m == DrainFrozen
+}
+
 // CacheZone is the combination of a Storage for storing object parts and an
 // `CacheAlgorithm` which determines what should be stored.
 type CacheZone struct {
+	// the progress of the loading of the stored objects on start. They are
+	// updated atomically and are kept first for their 64-bit alignment.
+	reloadedObjects uint64
+	reloadDiscarded uint64
+	reloading       uint32
+
 	ID        string
 	PartSize  BytesSize
 	Algorithm CacheAlgorithm
 	Scheduler Scheduler
 	Storage   Storage
+	Groups    *ObjectGroups
+	// SurrogateKeys indexes the objects in the zone by their surrogate keys
+	SurrogateKeys *SurrogateKeys
+	// ObjectIDHash is the function with which the ids of the objects in the
+	// zone are hashed
+	ObjectIDHash ObjectIDHashFunc
+
+	// tracks the requests which use the zone, so that a zone which is removed
+	// from the config on reload is closed only after they are finished
+	mu       sync.Mutex
+	inFlight uint64
+	drained  []chan struct{}
+	removed  chan struct{}
+	aborted  chan struct{}
+	// the reason for aborting the loading of the stored objects, if any
+	reloadErr error
+	drainMode DrainMode
+}
+
+// Acquire marks the start of a request or background operation which uses the
+// zone. Every call must be followed by a call to Release when it is finished.
+func (cz *CacheZone) Acquire() {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	cz.inFlight++
+}
+
+// Release marks the end of an operation started with Acquire.
+func (cz *CacheZone) Release() {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	if cz.inFlight == 0 {
+		panic("CacheZone.Release called without Acquire")
+	}
+	if cz.inFlight--; cz.inFlight == 0 {
+		for _, ch := range cz.drained {
+			close(ch)
+		}
+		cz.drained = nil
+	}
+}
+
+// InFlight returns the number of requests and background operations which
+// currently use the zone.
+func (cz *CacheZone) InFlight() uint64 {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	return cz.inFlight
+}
+
+// Drained returns a channel which is closed when the zone is not used by any
+// request or background operation. It is closed immediately if the zone is
+// not used at the moment.
+func (cz *CacheZone) Drained() <-chan struct{} {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	var ch = make(chan struct{})
+	if cz.inFlight == 0 {
+		close(ch)
+	} else {
+		cz.drained = append(cz.drained, ch)
+	}
+	return ch
+}
+
+// Remove marks the zone as removed from the config. Long running background
+// operations which use the zone should stop when it is removed.
+func (cz *CacheZone) Remove() {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	var removed = cz.removedLocked()
+	select {
+	case <-removed:
+	default:
+		close(removed)
+	}
+}
+
+// Removed returns a channel which is closed when the zone is removed.
+func (cz *CacheZone) Removed() <-chan struct{} {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	return cz.removedLocked()
+}
+
+func (cz *CacheZone) removedLocked() chan struct{} {
+	if cz.removed == nil {
+		cz.removed = make(chan struct{})
+	}
+	return cz.removed
+}
+
+// AbortFills makes the in-flight upstream fills which use the zone stop and
+// discard what they have not stored completely, e.g. when shutting down.
+func (cz *CacheZone) AbortFills() {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	var aborted = cz.abortedLocked()
+	select {
+	case <-aborted:
+	default:
+		close(aborted)
+	}
+}
+
+// FillsAborted returns a channel which is closed when the fills are aborted.
+func (cz *CacheZone) FillsAborted() <-chan struct{} {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	return cz.abortedLocked()
+}
+
+func (cz *CacheZone) abortedLocked() chan struct{} {
+	if cz.aborted == nil {
+		cz.aborted = make(chan struct{})
+	}
+	return cz.aborted
+}
+
+// Close stops the background work of the zone, such as its scheduled
+// expirations and the garbage collection of its storage. It must be called
+// only after the zone is removed and drained as the zone must not be used
+// after that.
+func (cz *CacheZone) Close() {
+	if d, ok := cz.Scheduler.(interface {
+		Destroy()
+	}); ok {
+		d.Destroy()
+	}
+	if s, ok := cz.Storage.(Stopper); ok {
+		s.Stop()
+	}
+}
+
+// SetReloadError marks that the loading of the stored objects of the zone
+// was aborted because of the error.
+func (cz *CacheZone) SetReloadError(err error) {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	cz.reloadErr = err
+}
+
+// ReloadError returns the reason for which the loading of the stored objects
+// was aborted or nil if it was not.
+func (cz *CacheZone) ReloadError() error {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	return cz.reloadErr
+}
+
+// SetReloading marks whether the stored objects of the zone are being loaded.
+func (cz *CacheZone) SetReloading(reloading bool) {
+	var value uint32
+	if reloading {
+		value = 1
+	}
+	atomic.StoreUint32(&cz.reloading, value)
+}
+
+// AddReloaded counts an object which was loaded from the storage of the zone.
+func (cz *CacheZone) AddReloaded() {
+	atomic.AddUint64(&cz.reloadedObjects, 1)
+}
+
+// AddReloadDiscarded counts a loaded object which was discarded because it
+// had expired.
+func (cz *CacheZone) AddReloadDiscarded() {
+	atomic.AddUint64(&cz.reloadDiscarded, 1)
+}
+
+// ReloadProgress returns whether the stored objects of the zone are still
+// being loaded, how many of them were loaded so far and how many of those
+// were discarded because they had expired.
+func (cz *CacheZone) ReloadProgress() (reloading bool, loaded, discarded uint64) {
+	return atomic.LoadUint32(&cz.reloading) != 0,
+		atomic.LoadUint64(&cz.reloadedObjects),
+		atomic.LoadUint64(&cz.reloadDiscarded)
+}
+
+// SetDrainMode sets the drain mode of the zone. DrainOff returns it to normal.
+func (cz *CacheZone) SetDrainMode(mode DrainMode) {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	cz.drainMode = mode
+}
+
+// DrainMode returns the current drain mode of the zone.
+func (cz *CacheZone) DrainMode() DrainMode {
+	cz.mu.Lock()
+	defer cz.mu.Unlock()
+	return cz.drainMode
+}
+
+// StoresPaused returns whether nothing new should be stored in the zone.
+func (cz *CacheZone) StoresPaused() bool {
+	return cz.DrainMode() != DrainOff
+}
+
+// EvictionPaused returns whether the expired objects should be kept in the
+// zone.
+func (cz *CacheZone) EvictionPaused() bool {
+	return cz.DrainMode() == DrainFrozen
 }
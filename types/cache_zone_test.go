@@ -0,0 +1,79 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(10 * time.Millisecond):
+		return false
+	}
+}
+
+func TestCacheZoneDraining(t *testing.T) {
+	t.Parallel()
+	var cz = new(CacheZone)
+	if !isClosed(cz.Drained()) {
+		t.Error("Expected an unused zone to be drained")
+	}
+
+	cz.Acquire()
+	cz.Acquire()
+	var drained = cz.Drained()
+	if inFlight := cz.InFlight(); inFlight != 2 {
+		t.Errorf("Expected 2 requests in flight but got %d", inFlight)
+	}
+	if isClosed(cz.Removed()) {
+		t.Error("Expected the zone not to be removed")
+	}
+	cz.Remove()
+	cz.Remove()
+	if !isClosed(cz.Removed()) {
+		t.Error("Expected the zone to be removed")
+	}
+
+	cz.Release()
+	if isClosed(drained) {
+		t.Error("Expected the zone not to be drained with a request in flight")
+	}
+	cz.Release()
+	if !isClosed(drained) {
+		t.Error("Expected the zone to be drained after the last request")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic on Release without Acquire")
+		}
+	}()
+	cz.Release()
+}
+
+func TestCacheZoneReloadProgress(t *testing.T) {
+	t.Parallel()
+	var cz = &CacheZone{ID: "zone"}
+	cz.SetReloading(true)
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			cz.AddReloaded()
+			if i%5 == 0 {
+				cz.AddReloadDiscarded()
+			}
+		}
+	}()
+	<-done
+	if reloading, loaded, discarded := cz.ReloadProgress(); !reloading || loaded != 10 || discarded != 2 {
+		t.Errorf("Expected a reload in progress with 10 loaded and 2 discarded objects "+
+			"but got %t, %d, %d", reloading, loaded, discarded)
+	}
+	cz.SetReloading(false)
+	if reloading, _, _ := cz.ReloadProgress(); reloading {
+		t.Error("Expected the reload to be finished")
+	}
+}
@@ -3,6 +3,7 @@ package types
 import (
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -13,19 +14,91 @@ type Location struct {
 	CacheKey              string
 	CacheDefaultDuration  time.Duration
 	CacheKeyIncludesQuery bool
-	Cache                 *CacheZone //!TODO: move to the cache handler settings (plus all Cache* settings)
-	Upstream              Upstream
-	Logger                Logger
+	// CacheKeyIncludesScheme separates the objects requested over HTTP and
+	// HTTPS in the cache
+	CacheKeyIncludesScheme bool
+	Cache                  *CacheZone //!TODO: move to the cache handler settings (plus all Cache* settings)
+	Upstream               Upstream
+	Logger                 Logger
+
+	// CacheKeyTemplate builds the keys of the cached objects instead of
+	// CacheKeyIncludesQuery and CacheKeyIncludesScheme, if it is set
+	CacheKeyTemplate *CacheKeyTemplate
+	// TrustedProxies are the clients whose X-Forwarded-Proto header is
+	// honored. It is ignored for all clients when it is nil.
+	TrustedProxies RemoteAddrMatcher
+}
+
+// RemoteAddrMatcher matches the remote addresses of requests, as in
+// http.Request.RemoteAddr, e.g. netutils.IPNetworks.
+type RemoteAddrMatcher interface {
+	ContainsRemoteAddr(remoteAddr string) bool
 }
 
 func (l *Location) String() string {
 	return l.Name
 }
 
-// NewObjectIDForURL returns new ObjectID from the provided URL
+// NewObjectIDForURL returns new ObjectID from the provided URL. Unless the
+// location has a CacheKeyTemplate, the host of the URL is never part of the
+// ObjectID. Its scheme is used only when the location includes it in the cache
+// key, URLs without one are considered to be http. The CacheKeyTemplate is
+// used without request headers.
 func (l *Location) NewObjectIDForURL(u *url.URL) *ObjectID {
+	if l.CacheKeyTemplate != nil {
+		return l.newObjectID(l.CacheKeyTemplate.Key(u, nil))
+	}
+	var path = u.Path
 	if l.CacheKeyIncludesQuery {
-		return NewObjectID(l.CacheKey, u.String())
+		var withoutHost = *u
+		withoutHost.Scheme, withoutHost.Opaque = "", ""
+		withoutHost.User, withoutHost.Host = nil, ""
+		path = withoutHost.String()
+	}
+	if l.CacheKeyIncludesScheme {
+		var scheme = strings.ToLower(u.Scheme)
+		if scheme == "" {
+			scheme = "http"
+		}
+		path = scheme + ":" + path
+	}
+	return l.newObjectID(path)
+}
+
+// NewObjectIDForRequest returns new ObjectID for the object requested by the
+// provided client request. The request is HTTPS if it was received over TLS
+// or through one of the TrustedProxies with the X-Forwarded-Proto: https
+// header.
+func (l *Location) NewObjectIDForRequest(r *http.Request) *ObjectID {
+	if !l.CacheKeyIncludesScheme && l.CacheKeyTemplate == nil {
+		return l.NewObjectIDForURL(r.URL)
+	}
+	var u = *r.URL
+	if r.TLS != nil || l.forwardedOverHTTPS(r) {
+		u.Scheme = "https"
+	}
+	if l.CacheKeyTemplate == nil {
+		return l.NewObjectIDForURL(&u)
+	}
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	return l.newObjectID(l.CacheKeyTemplate.Key(&u, r.Header))
+}
+
+// forwardedOverHTTPS returns whether the request was received over HTTPS by
+// a trusted proxy. The header is ignored for the other clients, as anyone
+// could send it.
+func (l *Location) forwardedOverHTTPS(r *http.Request) bool {
+	return l.TrustedProxies != nil && l.TrustedProxies.ContainsRemoteAddr(r.RemoteAddr) &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// newObjectID returns the ObjectID for the path, hashed with the hash function
+// of the cache zone of the location.
+func (l *Location) newObjectID(path string) *ObjectID {
+	if l.Cache == nil {
+		return NewObjectID(l.CacheKey, path)
 	}
-	return NewObjectID(l.CacheKey, u.Path)
+	return NewObjectIDWithHash(l.CacheKey, path, l.Cache.ObjectIDHash)
 }
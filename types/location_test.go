@@ -1,6 +1,8 @@
 package types
 
 import (
+	"crypto/tls"
+	"net/http"
 	"net/url"
 	"testing"
 )
@@ -42,3 +44,60 @@ func TestNewObjectIDForURL(t *testing.T) {
 	}
 
 }
+
+// trustedAddr trusts only the clients with the same remote address.
+type trustedAddr string
+
+func (a trustedAddr) ContainsRemoteAddr(remoteAddr string) bool {
+	return string(a) == remoteAddr
+}
+
+func TestNewObjectIDWithScheme(t *testing.T) {
+	const proxy = "10.0.0.1:1234"
+	var loc = &Location{CacheKey: "1", CacheKeyIncludesScheme: true, TrustedProxies: trustedAddr(proxy)}
+	var queryLoc = &Location{CacheKey: "2", CacheKeyIncludesScheme: true, CacheKeyIncludesQuery: true,
+		TrustedProxies: trustedAddr(proxy)}
+
+	var tests = []struct {
+		url, forwardedProto string
+		remoteAddr          string
+		tls                 bool
+		expected            string
+		expectedWithQuery   string
+	}{
+		{url: "/path?q=1", expected: "http:/path", expectedWithQuery: "http:/path?q=1"},
+		{url: "/path?q=1", tls: true, expected: "https:/path", expectedWithQuery: "https:/path?q=1"},
+		{url: "/path", forwardedProto: "HTTPS", remoteAddr: proxy, expected: "https:/path", expectedWithQuery: "https:/path"},
+		{url: "/path", forwardedProto: "https", remoteAddr: "10.0.0.2:1234", expected: "http:/path", expectedWithQuery: "http:/path"},
+		{url: "/path", forwardedProto: "gopher", remoteAddr: proxy, expected: "http:/path", expectedWithQuery: "http:/path"},
+		{url: "https://example.com/path?q", expected: "https:/path", expectedWithQuery: "https:/path?q"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		req.RemoteAddr = test.remoteAddr
+		if test.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+		}
+		if got := loc.NewObjectIDForRequest(req).Path(); got != test.expected {
+			t.Errorf("expected '%s' got '%s' for %+v", test.expected, got, test)
+		}
+		if got := queryLoc.NewObjectIDForRequest(req).Path(); got != test.expectedWithQuery {
+			t.Errorf("expected '%s' got '%s' for %+v with query", test.expectedWithQuery, got, test)
+		}
+	}
+
+	// the purge URLs contain a host, which is never part of the key
+	u, err := url.Parse("http://example.com/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := (&Location{CacheKeyIncludesQuery: true}).NewObjectIDForURL(u).Path(); got != "/path?q=1" {
+		t.Errorf("expected '/path?q=1' got '%s'", got)
+	}
+}
@@ -0,0 +1,126 @@
+package types
+
+import "sync"
+
+// ObjectGroups keeps track of the groups to which the objects in a cache zone
+// belong. Every group has a generation which is increased when the group is
+// purged. Objects which were saved with an older generation than the current
+// one are considered purged, which makes it possible to invalidate a whole
+// group at once. A nil *ObjectGroups is valid and has no groups.
+type ObjectGroups struct {
+	sync.Mutex
+	groups map[string]*objectGroup
+	// the group of every object in the groups
+	objects map[ObjectIDHash]string
+}
+
+type objectGroup struct {
+	generation uint64
+	objects    map[ObjectIDHash]*ObjectID
+}
+
+// NewObjectGroups returns a new ObjectGroups ready for use.
+func NewObjectGroups() *ObjectGroups {
+	return &ObjectGroups{
+		groups:  make(map[string]*objectGroup),
+		objects: make(map[ObjectIDHash]string),
+	}
+}
+
+// Generation returns the current generation of the group.
+func (g *ObjectGroups) Generation(group string) uint64 {
+	if g == nil {
+		return 0
+	}
+	g.Lock()
+	defer g.Unlock()
+	if og, ok := g.groups[group]; ok {
+		return og.generation
+	}
+	return 0
+}
+
+// IsCurrent returns whether an object saved with the provided generation of
+// the group has not been purged since.
+func (g *ObjectGroups) IsCurrent(group string, generation uint64) bool {
+	return g.Generation(group) <= generation
+}
+
+// Add records that the object with the provided id is part of the group and was
+// saved with the provided generation. If the group has been purged since that
+// generation, the object is not added and false is returned. Generations newer
+// than the current one (such as the ones restored from the storage after a
+// restart) become the current generation of the group.
+func (g *ObjectGroups) Add(group string, generation uint64, id *ObjectID) bool {
+	if g == nil {
+		return true
+	}
+	g.Lock()
+	defer g.Unlock()
+	og, ok := g.groups[group]
+	if !ok {
+		og = &objectGroup{objects: make(map[ObjectIDHash]*ObjectID)}
+		g.groups[group] = og
+	}
+	if generation < og.generation {
+		return false
+	}
+	og.generation = generation
+	if old, ok := g.objects[id.Hash()]; ok && old != group {
+		g.remove(id.Hash())
+	}
+	og.objects[id.Hash()] = id
+	g.objects[id.Hash()] = group
+	return true
+}
+
+// Remove forgets the object, e.g. after it expired or was removed.
+func (g *ObjectGroups) Remove(id *ObjectID) {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	g.remove(id.Hash())
+}
+
+// remove removes the object from its group. The groups without objects are
+// forgotten too, unless they were invalidated, as their generation is
+// needed for the objects which are still being saved. It should be called
+// with the lock held.
+func (g *ObjectGroups) remove(hash ObjectIDHash) {
+	group, ok := g.objects[hash]
+	if !ok {
+		return
+	}
+	delete(g.objects, hash)
+	var og = g.groups[group]
+	delete(og.objects, hash)
+	if len(og.objects) == 0 && og.generation == 0 {
+		delete(g.groups, group)
+	}
+}
+
+// Invalidate increases the generation of the group so that all of its objects
+// are considered purged from this moment on and returns them so they can be
+// removed. The groups without objects are not recorded, so that purging
+// unknown groups does not fill the memory.
+func (g *ObjectGroups) Invalidate(group string) []*ObjectID {
+	if g == nil {
+		return nil
+	}
+	g.Lock()
+	defer g.Unlock()
+	og, ok := g.groups[group]
+	if !ok {
+		return nil
+	}
+	og.generation++
+	var ids = make([]*ObjectID, 0, len(og.objects))
+	for hash, id := range og.objects {
+		ids = append(ids, id)
+		delete(g.objects, hash)
+	}
+	og.objects = make(map[ObjectIDHash]*ObjectID)
+	return ids
+}
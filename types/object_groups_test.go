@@ -0,0 +1,60 @@
+package types
+
+import "testing"
+
+func TestObjectGroups(t *testing.T) {
+	t.Parallel()
+	var g = NewObjectGroups()
+	var id1, id2 = NewObjectID("key", "/group/1"), NewObjectID("key", "/group/2")
+
+	if !g.Add("group", g.Generation("group"), id1) || !g.Add("group", 0, id2) {
+		t.Fatal("could not add objects to a new group")
+	}
+	if ids := g.Invalidate("group"); len(ids) != 2 {
+		t.Errorf("expected 2 objects in the invalidated group but got %d", len(ids))
+	}
+	if g.IsCurrent("group", 0) {
+		t.Error("objects from the old generation should not be current")
+	}
+	if g.Add("group", 0, id1) {
+		t.Error("adding an object with an old generation should fail")
+	}
+	if !g.Add("group", g.Generation("group"), id1) || !g.IsCurrent("group", 1) {
+		t.Error("adding an object with the current generation should succeed")
+	}
+
+	var nilGroups *ObjectGroups
+	if !nilGroups.IsCurrent("group", 0) || nilGroups.Invalidate("group") != nil {
+		t.Error("nil groups should have no groups")
+	}
+	nilGroups.Remove(id1)
+}
+
+func TestObjectGroupsForgetObjects(t *testing.T) {
+	t.Parallel()
+	var g = NewObjectGroups()
+	var id1, id2 = NewObjectID("key", "/group/1"), NewObjectID("key", "/group/2")
+
+	if g.Invalidate("unknown") != nil || len(g.groups) != 0 || g.Generation("unknown") != 0 {
+		t.Error("invalidating an unknown group should not record it")
+	}
+
+	g.Add("group", 0, id1)
+	g.Add("group", 0, id2)
+	g.Remove(id1)
+	if ids := g.Invalidate("group"); len(ids) != 1 || ids[0] != id2 {
+		t.Errorf("expected only the object which was not removed to be invalidated but got %v", ids)
+	}
+	g.Add("group", 1, id1)
+	g.Remove(id1)
+	if g.Generation("group") != 1 {
+		t.Error("the generation of an invalidated group should be kept without objects")
+	}
+
+	g.Add("other", 0, id2)
+	g.Add("moved", 0, id2)
+	g.Remove(id2)
+	if len(g.objects) != 0 || len(g.groups) != 1 {
+		t.Errorf("expected only the invalidated group to be kept but got %v", g.groups)
+	}
+}
@@ -3,9 +3,11 @@ package types
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 )
 
 // ObjectIDHashSize is the size of the byte array that contains the object hash.
@@ -14,11 +16,58 @@ const ObjectIDHashSize = sha1.Size
 // ObjectIDHash is the fixed-width byte array that represents an ObjectID hash.
 type ObjectIDHash [ObjectIDHashSize]byte
 
+// ObjectIDHashFunc is the name of the function with which the object ids of a
+// cache zone are hashed. The empty one is the default sha1.
+type ObjectIDHashFunc string
+
+// The possible values of ObjectIDHashFunc
+const (
+	ObjectIDHashSHA1 ObjectIDHashFunc = "sha1"
+	// ObjectIDHashSHA256 uses the first ObjectIDHashSize bytes of the sum
+	ObjectIDHashSHA256 ObjectIDHashFunc = "sha256"
+	// ObjectIDHashFNV uses the 128-bit FNV-1a, which is faster but is not
+	// cryptographic. The rest of the hash is zeros.
+	ObjectIDHashFNV ObjectIDHashFunc = "fnv"
+)
+
+// Valid returns whether the hash function is one of the known ones.
+func (f ObjectIDHashFunc) Valid() bool {
+	switch f {
+	case "", ObjectIDHashSHA1, ObjectIDHashSHA256, ObjectIDHashFNV:
+		return true
+	}
+	return false
+}
+
+func (f ObjectIDHashFunc) String() string {
+	if f == "" {
+		return string(ObjectIDHashSHA1)
+	}
+	return string(f)
+}
+
+func (f ObjectIDHashFunc) sum(data []byte) ObjectIDHash {
+	var result ObjectIDHash
+	switch f {
+	case ObjectIDHashSHA256:
+		var sum = sha256.Sum256(data)
+		copy(result[:], sum[:])
+	case ObjectIDHashFNV:
+		var h = fnv.New128a()
+		_, _ = h.Write(data)
+		copy(result[:], h.Sum(nil))
+	default:
+		result = sha1.Sum(data)
+	}
+	return result
+}
+
 // ObjectID represents a cached file.
 type ObjectID struct {
 	cacheKey string
 	path     string
 	hash     ObjectIDHash
+	hashFunc ObjectIDHashFunc
 	//!TODO: add vary headers information
 }
 
@@ -36,19 +85,28 @@ func (oid *ObjectID) Path() string {
 	return oid.path
 }
 
-// Hash returns the pre-calculated sha1 hash of the object id.
+// Hash returns the pre-calculated hash of the object id.
 func (oid *ObjectID) Hash() ObjectIDHash {
 	return oid.hash
 }
 
-// StrHash returns the sha1 hash of the object id in hex format.
+// HashFunc returns the function with which the object id is hashed.
+func (oid *ObjectID) HashFunc() ObjectIDHashFunc {
+	return oid.hashFunc
+}
+
+// StrHash returns the hash of the object id in hex format.
 func (oid *ObjectID) StrHash() string {
 	return hex.EncodeToString(oid.hash[:])
 }
 
 // MarshalJSON is used to help the JSON library marshal the unexported vars.
+// The hash function is included only if it is not the default one.
 func (oid *ObjectID) MarshalJSON() ([]byte, error) {
-	return json.Marshal([]string{oid.cacheKey, oid.path})
+	if oid.hashFunc == "" {
+		return json.Marshal([]string{oid.cacheKey, oid.path})
+	}
+	return json.Marshal([]string{oid.cacheKey, oid.path, string(oid.hashFunc)})
 }
 
 // UnmarshalJSON is used to help the JSON library unmarshal the unexported vars.
@@ -58,18 +116,45 @@ func (oid *ObjectID) UnmarshalJSON(buf []byte) error {
 		return err
 	}
 
-	if len(data) != 2 || data[0] == "" || data[1] == "" {
+	if len(data) < 2 || len(data) > 3 || data[0] == "" || data[1] == "" {
 		return fmt.Errorf("Invalid ObjectID %s", buf)
 	}
-	*oid = *NewObjectID(data[0], data[1])
+	var hashFunc ObjectIDHashFunc
+	if len(data) == 3 {
+		if hashFunc = ObjectIDHashFunc(data[2]); hashFunc == "" || !hashFunc.Valid() {
+			return fmt.Errorf("Invalid ObjectID hash function in %s", buf)
+		}
+	}
+	*oid = *NewObjectIDWithHash(data[0], data[1], hashFunc)
 	return nil
 }
 
-// NewObjectID creates and returns a new ObjectID.
+// GobEncode is used to help the gob package encode the unexported vars.
+func (oid *ObjectID) GobEncode() ([]byte, error) {
+	return oid.MarshalJSON()
+}
+
+// GobDecode is used to help the gob package decode the unexported vars.
+func (oid *ObjectID) GobDecode(buf []byte) error {
+	return oid.UnmarshalJSON(buf)
+}
+
+// NewObjectID creates and returns a new ObjectID hashed with the default
+// hash function.
 func NewObjectID(cacheKey, path string) *ObjectID {
+	return NewObjectIDWithHash(cacheKey, path, "")
+}
+
+// NewObjectIDWithHash creates and returns a new ObjectID hashed with the hash
+// function.
+func NewObjectIDWithHash(cacheKey, path string, hashFunc ObjectIDHashFunc) *ObjectID {
+	if hashFunc == ObjectIDHashSHA1 {
+		hashFunc = ""
+	}
 	return &ObjectID{
 		cacheKey: cacheKey,
 		path:     path,
-		hash:     sha1.Sum([]byte(cacheKey + "/" + path)),
+		hash:     hashFunc.sum([]byte(cacheKey + "/" + path)),
+		hashFunc: hashFunc,
 	}
 }
@@ -76,3 +76,39 @@ func TestObjectIDStringersWithSensibleData(t *testing.T) {
 	}
 
 }
+
+func TestObjectIDHashFuncs(t *testing.T) {
+	t.Parallel()
+	for hash, expected := range map[ObjectIDHashFunc]string{
+		"":                 "583fae38a17840864d328e08b0d21cec293f74b2",
+		ObjectIDHashSHA1:   "583fae38a17840864d328e08b0d21cec293f74b2",
+		ObjectIDHashSHA256: "f84f771e360414aae29c8df82e492cb1614e0b14",
+		ObjectIDHashFNV:    "09d9ca0af68b21b8c5963c3b0fe26b5900000000",
+	} {
+		var obj = NewObjectIDWithHash("1.2", "/somewhere", hash)
+		if obj.StrHash() != expected {
+			t.Errorf("Expected hash %s with %s but got %s", expected, hash, obj.StrHash())
+		}
+
+		buf, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var unmarshalled = &ObjectID{}
+		if err := json.Unmarshal(buf, unmarshalled); err != nil {
+			t.Fatalf("Could not unmarshal %s: %s", buf, err)
+		}
+		if !reflect.DeepEqual(obj, unmarshalled) {
+			t.Errorf("The original object %#v is different from the unmarshalled %#v", obj, unmarshalled)
+		}
+	}
+
+	for _, invalid := range []string{`["1.2","/somewhere",""]`, `["1.2","/somewhere","md5"]`} {
+		if err := json.Unmarshal([]byte(invalid), &ObjectID{}); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+	if ObjectIDHashFunc("md5").Valid() {
+		t.Error("Expected md5 not to be a valid object id hash")
+	}
+}
@@ -30,6 +30,22 @@ func (oi *ObjectIndex) Hash() ObjectIndexHash {
 	return hash
 }
 
+// ObjectIndexes implements sort.Interface for sorting the indexes of an
+// object by their part numbers.
+type ObjectIndexes []*ObjectIndex
+
+func (o ObjectIndexes) Len() int {
+	return len(o)
+}
+
+func (o ObjectIndexes) Less(i, j int) bool {
+	return o[i].Part < o[j].Part
+}
+
+func (o ObjectIndexes) Swap(i, j int) {
+	o[i], o[j] = o[j], o[i]
+}
+
 // HashStr returns a hash
 func (oi *ObjectIndex) HashStr() string {
 	return fmt.Sprintf("%s:%d", oi.ObjID.StrHash(), oi.Part)
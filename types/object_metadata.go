@@ -4,6 +4,12 @@ import (
 	"net/http"
 )
 
+// ObjectMetadataSchemaVersion is the version of ObjectMetadata which is
+// written by this version of the app. It is increased when the meaning of
+// the stored metadata changes, so that the objects stored by older versions
+// can be recognized.
+const ObjectMetadataSchemaVersion uint32 = 1
+
 // ObjectMetadata represents all the needed metadata of a cacheable object.
 type ObjectMetadata struct {
 
@@ -12,20 +18,69 @@ type ObjectMetadata struct {
 	ID *ObjectID
 
 	// The time of the first request/response for this object as unix timestamp.
+	// It is earlier by the Age of the response if it had spent time in other
+	// caches before it was received, so that the age of the object counts it.
 	ResponseTimestamp int64
 
 	// Status code of the first proxied response for this object.
 	Code int
 
+	// Whether the object is a cached error response of the upstream, such
+	// as 404, which is served whole with its Code and is never served
+	// stale.
+	Negative bool
+
 	// The object size in bytes. Normally this should correspond to the
 	// upstream's Content-Length header.
 	Size uint64
 
+	// The size of the contents of objects with the gzip content encoding
+	// once they are decompressed, or zero if it is not known.
+	UncompressedSize uint64
+
 	// HTTP headers which were received from the upstream and which we should
-	// pass down for this object for any subsequent request.
+	// pass down for this object for any subsequent request. The values of
+	// every header, e.g. multiple Set-Cookie, are kept in the order in which
+	// the upstream sent them. The order of the different headers is not kept
+	// as net/http writes them sorted by name anyway.
 	Headers http.Header
 
 	// The time at which this object can be considered stale. After this time
 	// the object must be revalidated or discarded. This value is a unix timestamp.
 	ExpiresAt int64
+
+	// The number of seconds after ExpiresAt during which the object may be
+	// served stale while it is revalidated in the background, as allowed by
+	// the stale-while-revalidate directive of the upstream response.
+	StaleWhileRevalidate int64
+
+	// Whether the upstream response had the immutable directive, so the
+	// object is not revalidated while it is fresh, even when the client
+	// asks for it.
+	Immutable bool
+
+	// The group to which the object belongs, if any. All objects in a group
+	// are purged together.
+	Group string
+
+	// The generation of the group at the time the object was saved. If the
+	// group has been purged since, the object must not be used.
+	GroupGeneration uint64
+
+	// The surrogate keys (tags) which the upstream sent for the object. It
+	// is purged with any of them.
+	SurrogateKeys []string
+
+	// CRC32 (IEEE) checksums of the stored parts of the object, by part
+	// number. They are kept only by storages which verify their parts.
+	PartChecksums map[uint32]uint32
+
+	// SHA-256 hashes of the contents of the stored parts of the object, by
+	// part number. They are kept only by storages which deduplicate the
+	// parts with the same contents.
+	PartHashes map[uint32]string
+
+	// The ObjectMetadataSchemaVersion of the app which stored the metadata.
+	// It is zero for the objects stored before it was recorded.
+	SchemaVersion uint32
 }
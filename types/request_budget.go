@@ -0,0 +1,45 @@
+package types
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RequestBudget bounds the time for which a client request waits for the
+// upstream response headers, summed over all of its retries, hedges and
+// revalidations. It is shared through the request context by the layers
+// which handle the request. A nil RequestBudget is unlimited.
+type RequestBudget struct {
+	deadline time.Time
+	spent    uint32
+}
+
+// NewRequestBudget returns a RequestBudget which is spent after the duration.
+func NewRequestBudget(d time.Duration) *RequestBudget {
+	return &RequestBudget{deadline: time.Now().Add(d)}
+}
+
+// Deadline returns the time at which the budget is spent.
+func (b *RequestBudget) Deadline() time.Time {
+	return b.deadline
+}
+
+// Allows returns whether the budget is not spent after waiting for the
+// duration.
+func (b *RequestBudget) Allows(d time.Duration) bool {
+	return b == nil || !b.Spent() && time.Now().Add(d).Before(b.deadline)
+}
+
+// Spend marks the budget as spent before its deadline, e.g. when a retry is
+// not made because it would not finish in time.
+func (b *RequestBudget) Spend() {
+	if b != nil {
+		atomic.StoreUint32(&b.spent, 1)
+	}
+}
+
+// Spent returns whether the deadline of the budget has passed or it was
+// spent before it.
+func (b *RequestBudget) Spent() bool {
+	return b != nil && (atomic.LoadUint32(&b.spent) != 0 || !time.Now().Before(b.deadline))
+}
@@ -1,6 +1,16 @@
 package types
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrCorruptedPart is returned by storages which verify the parts they read
+// when the contents of the requested part are not the ones that were saved.
+// Corrupted parts are discarded by the storage.
+var ErrCorruptedPart = errors.New("the stored object part is corrupted")
 
 // Storage represents a single unit of storage.
 type Storage interface {
@@ -17,12 +27,18 @@ type Storage interface {
 	GetPart(id *ObjectIndex) (io.ReadCloser, error)
 
 	// GetAvailableParts returns types.ObjectIndexMap including all the available
-	// parts of for the object specified by the provided objectMetadata
+	// parts of for the object specified by the provided objectMetadata. The
+	// parts are sorted by their numbers and there may be gaps between them.
 	GetAvailableParts(id *ObjectID) ([]*ObjectIndex, error)
 
 	// Saves the supplied metadata to the storage.
 	SaveMetadata(m *ObjectMetadata) error
 
+	// Atomically replaces the metadata of an object which is already in the
+	// storage. It returns os.ErrNotExist and saves nothing if the object is
+	// not there, e.g. because it was discarded meanwhile.
+	UpdateMetadata(m *ObjectMetadata) error
+
 	// Saves the contents of the supplied object part to the storage.
 	SavePart(index *ObjectIndex, data io.Reader) error
 
@@ -42,4 +58,83 @@ type Storage interface {
 	SetLogger(Logger)
 }
 
+// IterationErrorsReporter is implemented by the storages which can report the
+// stored objects that could not be loaded while iterating over them.
+type IterationErrorsReporter interface {
+	// IterateWithErrors works like Iterate, but onError is called with the
+	// error for every object which could not be loaded instead of logging
+	// it. When onError returns false, the iteration stops.
+	IterateWithErrors(
+		callback func(*ObjectMetadata, ...*ObjectIndex) bool,
+		onError func(error) bool,
+	) error
+}
+
+// DiskUsageReporter is implemented by the storages which can report how many
+// bytes they occupy on the disk.
+type DiskUsageReporter interface {
+	DiskUsage() (uint64, error)
+}
+
+// QuotaEnforcer is implemented by the storages which limit how many bytes
+// they store. They do not evict anything themselves, but call the function
+// set with OnQuotaExceeded with how many bytes should be freed when they are
+// close to the limit, so that the least valuable parts are evicted.
+type QuotaEnforcer interface {
+	OnQuotaExceeded(reclaim func(bytes uint64))
+}
+
+// ContextPartStorage is implemented by the storages whose reads and writes of
+// parts may have to wait for their turn, e.g. because the concurrent disk
+// operations are limited. The waiting stops with an error when the context is
+// done.
+type ContextPartStorage interface {
+	GetPartContext(ctx context.Context, id *ObjectIndex) (io.ReadCloser, error)
+	SavePartContext(ctx context.Context, index *ObjectIndex, data io.Reader) error
+}
+
+// IOConcurrency contains the numbers of the read and write operations of a
+// storage which are running and which are waiting for their turn.
+type IOConcurrency struct {
+	Reads        uint64 `json:"reads"`
+	ReadsQueued  uint64 `json:"reads_queued"`
+	Writes       uint64 `json:"writes"`
+	WritesQueued uint64 `json:"writes_queued"`
+}
+
+// IOConcurrencyReporter is implemented by the storages which can report how
+// many of their operations are running and waiting at the moment.
+type IOConcurrencyReporter interface {
+	IOConcurrency() IOConcurrency
+}
+
+// TempFileCreator is implemented by the storages which can create temporary
+// files on the disk, next to the objects they store. The caller has to close
+// and remove the files when it is done with them.
+type TempFileCreator interface {
+	CreateTempFile() (*os.File, error)
+}
+
+// PartEvictor is implemented by the storages which remove the parts evicted by
+// the cache algorithms in the background. EvictPart may return before the
+// part is removed, so it does not hold up the algorithm.
+type PartEvictor interface {
+	EvictPart(index *ObjectIndex) error
+}
+
+// FillFinisher is implemented by the storages which keep records of the saved
+// parts, such as their checksums, in memory while the object is being filled
+// instead of updating its metadata for every part. FinishFill writes them and
+// is called once a fill of the object is done, whether it succeeded or not.
+type FillFinisher interface {
+	FinishFill(id *ObjectID) error
+}
+
+// Stopper is implemented by the storages which do periodic work in the
+// background. Stop ends it and must be called only when the storage is no
+// longer used.
+type Stopper interface {
+	Stop()
+}
+
 //!TODO: use custom error type instead of os.ErrNotExist?
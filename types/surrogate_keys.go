@@ -0,0 +1,81 @@
+package types
+
+import "sync"
+
+// SurrogateKeys indexes the objects in a cache zone by the surrogate keys
+// (tags) which the upstream sent for them, so that all objects with a key can
+// be purged without iterating over the storage. An object can have many keys.
+// A nil *SurrogateKeys is valid and has no keys.
+type SurrogateKeys struct {
+	sync.Mutex
+	objects map[string]map[ObjectIDHash]*ObjectID
+	keys    map[ObjectIDHash][]string
+}
+
+// NewSurrogateKeys returns a new SurrogateKeys ready for use.
+func NewSurrogateKeys() *SurrogateKeys {
+	return &SurrogateKeys{
+		objects: make(map[string]map[ObjectIDHash]*ObjectID),
+		keys:    make(map[ObjectIDHash][]string),
+	}
+}
+
+// Add records the keys of the object, replacing the ones it had before.
+func (sk *SurrogateKeys) Add(id *ObjectID, keys []string) {
+	if sk == nil {
+		return
+	}
+	sk.Lock()
+	defer sk.Unlock()
+	sk.remove(id.Hash())
+	if len(keys) == 0 {
+		return
+	}
+	for _, key := range keys {
+		ids, ok := sk.objects[key]
+		if !ok {
+			ids = make(map[ObjectIDHash]*ObjectID)
+			sk.objects[key] = ids
+		}
+		ids[id.Hash()] = id
+	}
+	sk.keys[id.Hash()] = keys
+}
+
+// Remove forgets the keys of the object, e.g. after it was removed.
+func (sk *SurrogateKeys) Remove(id *ObjectID) {
+	if sk == nil {
+		return
+	}
+	sk.Lock()
+	defer sk.Unlock()
+	sk.remove(id.Hash())
+}
+
+// Purge forgets all objects with the key and returns them so they can be
+// removed.
+func (sk *SurrogateKeys) Purge(key string) []*ObjectID {
+	if sk == nil {
+		return nil
+	}
+	sk.Lock()
+	defer sk.Unlock()
+	var ids = make([]*ObjectID, 0, len(sk.objects[key]))
+	for hash, id := range sk.objects[key] {
+		ids = append(ids, id)
+		sk.remove(hash)
+	}
+	return ids
+}
+
+// remove removes the object from all of its keys. It should be called with the
+// lock held.
+func (sk *SurrogateKeys) remove(hash ObjectIDHash) {
+	for _, key := range sk.keys[hash] {
+		delete(sk.objects[key], hash)
+		if len(sk.objects[key]) == 0 {
+			delete(sk.objects, key)
+		}
+	}
+	delete(sk.keys, hash)
+}
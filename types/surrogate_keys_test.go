@@ -0,0 +1,35 @@
+package types
+
+import "testing"
+
+func TestSurrogateKeys(t *testing.T) {
+	t.Parallel()
+	var sk = NewSurrogateKeys()
+	var id1, id2 = NewObjectID("key", "/tagged/1"), NewObjectID("key", "/tagged/2")
+
+	sk.Add(id1, []string{"product-1", "products"})
+	sk.Add(id2, []string{"product-2", "products"})
+	if ids := sk.Purge("product-1"); len(ids) != 1 || *ids[0] != *id1 {
+		t.Errorf("expected only %s to be purged with its key but got %v", id1, ids)
+	}
+	// the purged objects are forgotten with all of their keys
+	if ids := sk.Purge("products"); len(ids) != 1 || *ids[0] != *id2 {
+		t.Errorf("expected only %s to be left with the shared key but got %v", id2, ids)
+	}
+
+	sk.Add(id1, []string{"old"})
+	sk.Add(id1, []string{"new"})
+	if ids := sk.Purge("old"); len(ids) != 0 {
+		t.Errorf("expected the replaced key to have no objects but got %v", ids)
+	}
+	sk.Remove(id1)
+	if ids := sk.Purge("new"); len(ids) != 0 {
+		t.Errorf("expected the removed object to have no keys but got %v", ids)
+	}
+
+	var nilKeys *SurrogateKeys
+	nilKeys.Add(id1, []string{"key"})
+	if nilKeys.Purge("key") != nil {
+		t.Error("nil surrogate keys should have no keys")
+	}
+}
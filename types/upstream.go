@@ -1,6 +1,10 @@
 package types
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+	"time"
+)
 
 // Upstream represents an object that is used by the proxy handler for making
 // requests to the configured upstream server or servers.
@@ -11,3 +15,51 @@ type Upstream interface {
 
 	GetAddress(string) (*UpstreamAddress, error)
 }
+
+// ErrUpstreamBusy is returned for the requests which could not be sent to an
+// upstream address because it has too many requests in flight.
+var ErrUpstreamBusy = errors.New("too many requests to the upstream address")
+
+// StickyUpstream is implemented by the upstreams which pin the clients to
+// the same address. The proxy gets their addresses by the AffinityKey of the
+// request instead of by its path, unless it is empty.
+type StickyUpstream interface {
+	AffinityKey(*http.Request) string
+}
+
+// HostHeaderUpstream is implemented by the upstreams which choose the Host
+// header of the requests to their addresses. HostHeader returns the host for
+// the request to the address or an empty string if the proxy chooses it.
+type HostHeaderUpstream interface {
+	HostHeader(req *http.Request, addr *UpstreamAddress) string
+}
+
+// UpstreamAddressHealth is the health of a single upstream address as
+// determined by the active health checks.
+type UpstreamAddressHealth struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	// Failures and Successes are the numbers of consecutive failed and
+	// passed checks.
+	Failures  uint32    `json:"failures"`
+	Successes uint32    `json:"successes"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// UpstreamAddressConnections are the numbers of requests to a single upstream
+// address which are in flight and which wait for one of them to finish.
+type UpstreamAddressConnections struct {
+	Address string `json:"address"`
+	InUse   uint32 `json:"in_use"`
+	Queued  uint32 `json:"queued"`
+}
+
+// UpstreamLatency is the number of the responses of the addresses of an
+// upstream and the median and 95th percentile of the times until the
+// addresses responded with their headers.
+type UpstreamLatency struct {
+	Requests uint64        `json:"requests"`
+	P50      time.Duration `json:"p50"`
+	P95      time.Duration `json:"p95"`
+}
@@ -22,6 +22,8 @@ func init() {
 	for id, algo := range unweighted.Algorithms {
 		allAlgorithms[unweightedPrefix+id] = algo
 	}
+	// The weighted round-robin is also known by its shorter nginx-like name.
+	allAlgorithms["weighted-rr"] = weighted.Algorithms["roundrobin"]
 }
 
 // New creates and returns a new balancing algorithm based on its ID. It uses
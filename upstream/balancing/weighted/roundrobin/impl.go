@@ -0,0 +1,58 @@
+package roundrobin
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// RoundRobin balances requests between its upstreams one by one, giving each
+// of them a number of turns proportional to its weight. It uses the smooth
+// weighted round-robin of nginx, so the turns of the heavier upstreams are
+// interleaved with the others instead of being consecutive.
+type RoundRobin struct {
+	sync.Mutex
+	buckets     []*types.UpstreamAddress
+	current     []int64
+	totalWeight int64
+}
+
+// Set implements the balancing algorithm interface.
+func (rr *RoundRobin) Set(buckets []*types.UpstreamAddress) {
+	rr.Lock()
+	defer rr.Unlock()
+	rr.buckets = buckets
+	rr.current = make([]int64, len(buckets))
+	rr.totalWeight = 0
+	for _, b := range buckets {
+		rr.totalWeight += int64(b.Weight)
+	}
+}
+
+// Get implements the balancing algorithm interface.
+func (rr *RoundRobin) Get(_ string) (*types.UpstreamAddress, error) {
+	rr.Lock()
+	defer rr.Unlock()
+	if rr.totalWeight <= 0 {
+		return nil, errors.New("No configured upstreams or upstream weights")
+	}
+
+	var chosen = -1
+	for i, b := range rr.buckets {
+		if b.Weight == 0 {
+			continue // never selected
+		}
+		rr.current[i] += int64(b.Weight)
+		if chosen < 0 || rr.current[i] > rr.current[chosen] {
+			chosen = i
+		}
+	}
+	rr.current[chosen] -= rr.totalWeight
+	return rr.buckets[chosen], nil
+}
+
+// New creates a new weighted round-robin upstream balancer.
+func New() *RoundRobin {
+	return &RoundRobin{}
+}
@@ -0,0 +1,97 @@
+package roundrobin
+
+import (
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestWeightedRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	rr := New()
+	if _, err := rr.Get("test"); err == nil {
+		t.Error("Expected get with no upstreams to return an error")
+	}
+	rr.Set([]*types.UpstreamAddress{{Hostname: "zero"}})
+	if _, err := rr.Get("test"); err == nil {
+		t.Error("Expected get with only zero weight upstreams to return an error")
+	}
+
+	h1 := &types.UpstreamAddress{Hostname: "host1", Weight: 5}
+	h2 := &types.UpstreamAddress{Hostname: "host2", Weight: 1}
+	h3 := &types.UpstreamAddress{Hostname: "host3", Weight: 1}
+	zero := &types.UpstreamAddress{Hostname: "zero", Weight: 0}
+	rr.Set([]*types.UpstreamAddress{h1, zero, h2, h3})
+
+	// the turns of the heavier upstream are interleaved with the others
+	var expected = []*types.UpstreamAddress{h1, h1, h2, h1, h3, h1, h1}
+	for round := 0; round < 3; round++ {
+		for i, exp := range expected {
+			if res, err := rr.Get("somepath"); err != nil {
+				t.Errorf("Received an unexpected error: %s", err)
+			} else if res != exp {
+				t.Errorf("Round %d, turn %d: expected %s but received %s",
+					round, i, exp.Hostname, res.Hostname)
+			}
+		}
+	}
+}
+
+func TestWeightedRoundRobinDistribution(t *testing.T) {
+	t.Parallel()
+
+	var weights = []uint32{1, 3, 0, 7, 13}
+	var upstreams = make([]*types.UpstreamAddress, len(weights))
+	var totalWeight uint32
+	for i, w := range weights {
+		upstreams[i] = &types.UpstreamAddress{Weight: w}
+		totalWeight += w
+	}
+
+	rr := New()
+	rr.Set(upstreams)
+	// the old upstreams are replaced as when the DNS resolver finishes
+	rr.Set(upstreams)
+
+	const getters, requests = 8, 3000
+	var mu sync.Mutex
+	var counts = make(map[*types.UpstreamAddress]int)
+	var wg sync.WaitGroup
+	wg.Add(getters)
+	for g := 0; g < getters; g++ {
+		go func() {
+			defer wg.Done()
+			var local = make(map[*types.UpstreamAddress]int)
+			for i := 0; i < requests; i++ {
+				res, err := rr.Get("path")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				local[res]++
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for u, c := range local {
+				counts[u] += c
+			}
+		}()
+	}
+	wg.Wait()
+
+	const total = getters * requests
+	for i, u := range upstreams {
+		var expected = float64(u.Weight) / float64(totalWeight)
+		var actual = float64(counts[u]) / total
+		if math.Abs(expected-actual) > 0.01 {
+			t.Errorf("Upstream %d with weight %d got %f of the requests instead of %f",
+				i, u.Weight, actual, expected)
+		}
+	}
+	if counts[upstreams[2]] != 0 {
+		t.Errorf("The upstream with zero weight was selected %d times", counts[upstreams[2]])
+	}
+}
@@ -0,0 +1,71 @@
+package sticky
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// Sticky implements upstream balancing which pins every client to the same
+// upstream address. The upstreams which use it give the affinity key of the
+// request (its client IP address or sticky cookie) to Get instead of the
+// request path.
+//
+// It is a weighted Rendezvous hashing in which the score of every address
+// depends only on its own host and weight. Because of that a key stays on its
+// address for as long as the address is set. When the address set changes only
+// the keys of the removed addresses move to others and only some of the keys
+// move to the added ones.
+type Sticky struct {
+	sync.RWMutex
+	addresses []types.UpstreamAddress
+}
+
+// Set implements the balancing algorithm interface.
+func (s *Sticky) Set(addresses []*types.UpstreamAddress) {
+	var newAddresses = make([]types.UpstreamAddress, len(addresses))
+	for i, addr := range addresses {
+		newAddresses[i] = *addr
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.addresses = newAddresses
+}
+
+// Get implements the balancing algorithm interface.
+func (s *Sticky) Get(key string) (*types.UpstreamAddress, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.addresses) == 0 {
+		return nil, errors.New("no upstream addresses set")
+	}
+
+	var maxIdx, maxScore = 0, math.Inf(-1)
+	for i := range s.addresses {
+		if score := s.score(i, key); score > maxScore {
+			maxIdx, maxScore = i, score
+		}
+	}
+	return &s.addresses[maxIdx], nil
+}
+
+// score returns the weighted score of the key for the address with the index
+// i. The hash is mapped to (0, 1) and the score is -weight/ln(hash), so every
+// address wins a share of the keys that is proportional to its weight.
+func (s *Sticky) score(i int, key string) float64 {
+	var h = fnv.New64a()
+	_, _ = h.Write([]byte(s.addresses[i].Host))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(key))
+	var unit = (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -float64(s.addresses[i].Weight) / math.Log(unit)
+}
+
+// New creates a new Sticky upstream balancer.
+func New() *Sticky {
+	return &Sticky{}
+}
@@ -0,0 +1,60 @@
+package sticky
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func getAll(t *testing.T, s *Sticky, keys []string) map[string]string {
+	var res = make(map[string]string, len(keys))
+	for _, key := range keys {
+		addr, err := s.Get(key)
+		if err != nil {
+			t.Fatalf("Unexpected error for key %s: %s", key, err)
+		}
+		res[key] = addr.Host
+	}
+	return res
+}
+
+func TestAffinityIsStable(t *testing.T) {
+	t.Parallel()
+	var addresses = make([]*types.UpstreamAddress, 5)
+	for i := range addresses {
+		addresses[i] = testutils.GetUpstream(i)
+	}
+	var keys = make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ip:10.0.%d.%d", i/256, i%256)
+	}
+
+	var s = New()
+	s.Set(addresses)
+	var before = getAll(t, s, keys)
+	if again := getAll(t, s, keys); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Errorf("The same keys were balanced to different addresses")
+	}
+
+	// removing an address moves only the keys which were on it
+	var removed = addresses[2].Host
+	s.Set(append(append([]*types.UpstreamAddress{}, addresses[:2]...), addresses[3:]...))
+	var after = getAll(t, s, keys)
+	for _, key := range keys {
+		if before[key] != removed && after[key] != before[key] {
+			t.Errorf("Key %s moved from %s to %s when %s was removed",
+				key, before[key], after[key], removed)
+		}
+		if after[key] == removed {
+			t.Errorf("Key %s is still on the removed %s", key, removed)
+		}
+	}
+
+	// adding it back returns its keys and does not move the others
+	s.Set(addresses)
+	if restored := getAll(t, s, keys); fmt.Sprint(restored) != fmt.Sprint(before) {
+		t.Errorf("The keys were not balanced as before when the address was added back")
+	}
+}
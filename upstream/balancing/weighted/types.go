@@ -10,6 +10,8 @@ import (
 	"github.com/ironsmile/nedomi/upstream/balancing/weighted/legacyketama"
 	"github.com/ironsmile/nedomi/upstream/balancing/weighted/random"
 	"github.com/ironsmile/nedomi/upstream/balancing/weighted/rendezvous"
+	"github.com/ironsmile/nedomi/upstream/balancing/weighted/roundrobin"
+	"github.com/ironsmile/nedomi/upstream/balancing/weighted/sticky"
 )
 
 // Algorithms contains all weighted upstream balancing algorithm implementations.
@@ -30,4 +32,12 @@ var Algorithms = map[string]func() types.UpstreamBalancingAlgorithm{
 	"rendezvous": func() types.UpstreamBalancingAlgorithm {
 		return rendezvous.New()
 	},
+
+	"roundrobin": func() types.UpstreamBalancingAlgorithm {
+		return roundrobin.New()
+	},
+
+	"sticky": func() types.UpstreamBalancingAlgorithm {
+		return sticky.New()
+	},
 }
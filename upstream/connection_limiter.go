@@ -1,9 +1,166 @@
 package upstream
 
-// newConnectionLimiter creates a wrapper around the supplied upClient that
-// restricts the maximum number of concurrent requests through it.
-func newConnectionLimiter(base upClient, limit uint32) upClient {
-	//!TODO: implement :)
+import (
+	"container/list"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
 
-	return base
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// connectionLimiter is a wrapper around an upClient that restricts the
+// maximum number of concurrent requests to every upstream address. With
+// HTTP/1.1 every request in flight holds its own connection, so this is the
+// same as limiting the connections. With HTTP/2 the requests are streams
+// multiplexed over a single connection per address and it still limits the
+// requests. A request holds its place until its response body is closed.
+type connectionLimiter struct {
+	upClient
+	limit, maxQueue uint32
+	maxWait         time.Duration
+	mu              sync.Mutex
+	servers         map[string]*serverConnections
+}
+
+// serverConnections are the requests to a single address. The queue holds the
+// channels of the waiting requests, which are closed when the place of a
+// finished request is handed over to them.
+type serverConnections struct {
+	inUse uint32
+	queue *list.List
+}
+
+func newConnectionLimiter(base upClient, settings config.UpstreamSettings) *connectionLimiter {
+	return &connectionLimiter{
+		upClient: base,
+		limit:    settings.MaxConnectionsPerServer,
+		maxQueue: settings.MaxConnectionQueue,
+		maxWait:  time.Duration(settings.MaxConnectionWait) * time.Millisecond,
+		servers:  make(map[string]*serverConnections),
+	}
+}
+
+// Do implements the upClient interface.
+func (c *connectionLimiter) Do(req *http.Request) (*http.Response, error) {
+	var host = req.URL.Host
+	if err := c.acquire(req, host); err != nil {
+		return nil, err
+	}
+	resp, err := c.upClient.Do(req)
+	if err != nil {
+		c.release(host)
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, release: func() { c.release(host) }}
+	return resp, nil
+}
+
+// acquire waits for a place for the request to the host. It returns
+// types.ErrUpstreamBusy if the queue is full or the wait is too long and the
+// error of the request context if it is canceled while waiting.
+func (c *connectionLimiter) acquire(req *http.Request, host string) error {
+	c.mu.Lock()
+	var s, ok = c.servers[host]
+	if !ok {
+		s = &serverConnections{queue: list.New()}
+		c.servers[host] = s
+	}
+	if s.inUse < c.limit {
+		s.inUse++
+		c.mu.Unlock()
+		return nil
+	}
+	if uint32(s.queue.Len()) >= c.maxQueue {
+		c.mu.Unlock()
+		return types.ErrUpstreamBusy
+	}
+	var ready = make(chan struct{})
+	var waiting = s.queue.PushBack(ready)
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if c.maxWait > 0 {
+		var timer = time.NewTimer(c.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timeout:
+		err = types.ErrUpstreamBusy
+	case <-req.Context().Done():
+		err = req.Context().Err()
+	}
+
+	c.mu.Lock()
+	select {
+	case <-ready:
+		// the place was handed over while giving up, so it is passed on
+		c.mu.Unlock()
+		c.release(host)
+	default:
+		s.queue.Remove(waiting)
+		c.forget(host, s)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// release frees the place of a finished request to the host, handing it over
+// to the first waiting request if there is one.
+func (c *connectionLimiter) release(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var s = c.servers[host]
+	if front := s.queue.Front(); front != nil {
+		close(s.queue.Remove(front).(chan struct{}))
+		return
+	}
+	s.inUse--
+	c.forget(host, s)
+}
+
+// forget removes the host if it has no requests, so that the addresses which
+// are no longer used are not kept forever. It should be called with the lock
+// held.
+func (c *connectionLimiter) forget(host string, s *serverConnections) {
+	if s.inUse == 0 && s.queue.Len() == 0 {
+		delete(c.servers, host)
+	}
+}
+
+// Connections returns the numbers of requests in flight and waiting for every
+// address which has any.
+func (c *connectionLimiter) Connections() []types.UpstreamAddressConnections {
+	c.mu.Lock()
+	var result = make([]types.UpstreamAddressConnections, 0, len(c.servers))
+	for host, s := range c.servers {
+		result = append(result, types.UpstreamAddressConnections{
+			Address: host,
+			InUse:   s.inUse,
+			Queued:  uint32(s.queue.Len()),
+		})
+	}
+	c.mu.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Address < result[j].Address })
+	return result
+}
+
+// limitedBody releases the place of the request when it is closed.
+type limitedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	var err = b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
 }
@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// okClient responds to all requests with an empty 200 response.
+type okClient struct{}
+
+func (okClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+func (okClient) CancelRequest(*http.Request) {}
+
+func newTestLimiter(queue, wait uint32) *connectionLimiter {
+	var settings = config.GetDefaultUpstreamSettings()
+	settings.MaxConnectionsPerServer = 1
+	settings.MaxConnectionQueue = queue
+	settings.MaxConnectionWait = wait
+	return newConnectionLimiter(okClient{}, settings)
+}
+
+func expectConnections(t *testing.T, c *connectionLimiter, expected ...types.UpstreamAddressConnections) {
+	var connections = c.Connections()
+	if len(connections) != len(expected) {
+		t.Fatalf("Expected connections %v but got %v", expected, connections)
+	}
+	for i := range expected {
+		if connections[i] != expected[i] {
+			t.Errorf("Expected connections %v but got %v", expected, connections)
+		}
+	}
+}
+
+func limitedRequest(ctx context.Context, c *connectionLimiter, host string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", "http://"+host+"/path", nil)
+	if err != nil {
+		panic(err)
+	}
+	return c.Do(req.WithContext(ctx))
+}
+
+func TestConnectionLimiterQueue(t *testing.T) {
+	t.Parallel()
+	var c = newTestLimiter(1, 0)
+	var ctx = context.Background()
+	first, err := limitedRequest(ctx, c, "first:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := limitedRequest(ctx, c, "other:80")
+	if err != nil {
+		t.Fatalf("Expected the other address not to be limited but got %s", err)
+	}
+
+	var queued = make(chan error)
+	go func() {
+		resp, err := limitedRequest(ctx, c, "first:80")
+		if err == nil {
+			err = resp.Body.Close()
+		}
+		queued <- err
+	}()
+	for c.Connections()[0].Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	expectConnections(t, c,
+		types.UpstreamAddressConnections{Address: "first:80", InUse: 1, Queued: 1},
+		types.UpstreamAddressConnections{Address: "other:80", InUse: 1},
+	)
+	if _, err := limitedRequest(ctx, c, "first:80"); err != types.ErrUpstreamBusy {
+		t.Errorf("Expected the request over the full queue to fail but got %v", err)
+	}
+
+	_ = first.Body.Close()
+	_ = first.Body.Close() // the place is released only once
+	if err := <-queued; err != nil {
+		t.Errorf("Expected the queued request to be sent when the first one finished but got %s", err)
+	}
+	_ = other.Body.Close()
+	expectConnections(t, c)
+}
+
+func TestConnectionLimiterMaxWait(t *testing.T) {
+	t.Parallel()
+	var c = newTestLimiter(1, 10)
+	first, err := limitedRequest(context.Background(), c, "host:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Body.Close()
+	if _, err := limitedRequest(context.Background(), c, "host:80"); err != types.ErrUpstreamBusy {
+		t.Errorf("Expected the request which waited too long to fail but got %v", err)
+	}
+	expectConnections(t, c, types.UpstreamAddressConnections{Address: "host:80", InUse: 1})
+}
+
+func TestConnectionLimiterCancellation(t *testing.T) {
+	t.Parallel()
+	var c = newTestLimiter(1, 0)
+	first, err := limitedRequest(context.Background(), c, "host:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	var start = time.Now()
+	if _, err := limitedRequest(ctx, c, "host:80"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the canceled request to fail with its context but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the canceled request to stop waiting promptly but it took %s", elapsed)
+	}
+	expectConnections(t, c, types.UpstreamAddressConnections{Address: "host:80", InUse: 1})
+
+	// the place is not handed over to the canceled request
+	_ = first.Body.Close()
+	expectConnections(t, c)
+}
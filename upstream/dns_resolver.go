@@ -2,41 +2,119 @@ package upstream
 
 import (
 	"net"
+	"sort"
+	"time"
 
 	"github.com/ironsmile/nedomi/types"
 )
 
-func (u *Upstream) initDNSResolver(
+// runDNSResolver resolves the host names of the upstream addresses and sets
+// the resulting IP addresses in the balancing algorithm. With a DNS refresh
+// interval it resolves them again every interval until the context of the
+// upstream is done. The algorithm gets the whole new set of addresses at once
+// and only when it has changed. The system resolver does not return the TTLs
+// of the records, so the interval is used for all of them.
+func (u *Upstream) runDNSResolver(
 	algo types.UpstreamBalancingAlgorithm,
-	upstreams []*types.UpstreamAddress,
+	unresolved []*types.UpstreamAddress,
 	logger types.Logger,
 ) {
-	//!TODO: use cancel channel
-	//!TODO: implement an intelligent TTL-aware persistent resolver
-	result := []*types.UpstreamAddress{}
+	var interval = time.Duration(u.config.Settings.DNSRefreshInterval) * time.Millisecond
+	// the last resolved IP addresses of every address, which are kept when
+	// its host name can not be resolved again
+	var known = make([][]*types.UpstreamAddress, len(unresolved))
+	var current []*types.UpstreamAddress
+	for first := true; ; first = false {
+		var result = u.resolveAddresses(unresolved, known, logger)
+		if u.ctx.Err() != nil {
+			return
+		}
+		if first || !sameAddresses(current, result) {
+			// the server names of the new addresses are known before
+			// they are used
+			if u.names != nil {
+				u.names.set(result)
+			}
+			algo.Set(result)
+			current = result
+			logger.Logf("Finished resolving the upstream IPs for %s; found %d", u.config.ID, len(result))
+		}
+		if interval == 0 {
+			return
+		}
 
-	for _, up := range upstreams {
-		ips, err := net.LookupIP(up.Hostname)
+		var timer = time.NewTimer(interval)
+		select {
+		case <-u.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// resolveAddresses returns the IP addresses of the host names of all
+// upstream addresses and updates the known ones with them.
+func (u *Upstream) resolveAddresses(
+	upstreams []*types.UpstreamAddress,
+	known [][]*types.UpstreamAddress,
+	logger types.Logger,
+) []*types.UpstreamAddress {
+	var result = []*types.UpstreamAddress{}
+	for i, up := range upstreams {
+		ips, err := u.lookupIPAddr(u.ctx, up.Hostname)
 		if err != nil {
-			logger.Errorf("ignoring upstream %s: %s", &up.URL, err)
+			if u.ctx.Err() != nil {
+				return nil
+			}
+			if known[i] != nil {
+				logger.Errorf("keeping the last known IPs of upstream %s: %s", &up.URL, err)
+				result = append(result, known[i]...)
+			} else {
+				logger.Errorf("ignoring upstream %s: %s", &up.URL, err)
+			}
 			continue
 		}
 
+		var addresses []*types.UpstreamAddress
 		for _, ip := range ips {
-			if !u.config.Settings.UseIPv4 && ip.To4() != nil {
+			if !u.config.Settings.UseIPv4 && ip.IP.To4() != nil {
 				continue
 			}
-			if !u.config.Settings.UseIPv6 && ip.To4() == nil {
+			if !u.config.Settings.UseIPv6 && ip.IP.To4() == nil {
 				continue
 			}
 
 			resolved := *up
-			resolved.Hostname = ip.String()
-			resolved.Host = net.JoinHostPort(ip.String(), up.Port)
-			result = append(result, &resolved)
+			resolved.Hostname = ip.IP.String()
+			resolved.Host = net.JoinHostPort(ip.IP.String(), up.Port)
+			addresses = append(addresses, &resolved)
 		}
+		known[i] = addresses
+		result = append(result, addresses...)
 	}
+	return result
+}
 
-	algo.Set(result)
-	logger.Logf("Finished resolving the upstream IPs for %s; found %d", u.config.ID, len(result))
+// sameAddresses returns whether a and b have the same addresses with the same
+// weights, in any order. The DNS servers often rotate the order of the IPs.
+func sameAddresses(a, b []*types.UpstreamAddress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var keys = func(addresses []*types.UpstreamAddress) []string {
+		var result = make([]string, len(addresses))
+		for i, addr := range addresses {
+			result[i] = addr.String()
+		}
+		sort.Strings(result)
+		return result
+	}
+	var keysA, keysB = keys(a), keys(b)
+	for i := range keysA {
+		if keysA[i] != keysB[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// recordingAlgo records every set of addresses it is given.
+type recordingAlgo struct {
+	sync.Mutex
+	sets [][]*types.UpstreamAddress
+}
+
+func (r *recordingAlgo) Set(addresses []*types.UpstreamAddress) {
+	r.Lock()
+	defer r.Unlock()
+	r.sets = append(r.sets, addresses)
+}
+
+func (r *recordingAlgo) Get(string) (*types.UpstreamAddress, error) {
+	return nil, errors.New("not implemented")
+}
+
+// waitForSet waits for the set number n and returns its hosts, sorted.
+func (r *recordingAlgo) waitForSet(t *testing.T, n int) string {
+	var deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		r.Lock()
+		if len(r.sets) >= n {
+			var hosts []string
+			for _, addr := range r.sets[n-1] {
+				hosts = append(hosts, addr.Host)
+			}
+			r.Unlock()
+			sort.Strings(hosts)
+			return strings.Join(hosts, " ")
+		}
+		r.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("The addresses were not set %d times in time", n)
+	return ""
+}
+
+func (r *recordingAlgo) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.sets)
+}
+
+func TestDNSResolverRefresh(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var records = map[string][]string{
+		"a.example": {"10.0.0.1", "10.0.0.2", "::1"},
+	}
+	var setRecords = func(host string, ips ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		records[host] = ips
+	}
+	var conf = &config.Upstream{ID: "test", Settings: config.GetDefaultUpstreamSettings()}
+	conf.Settings.DNSRefreshInterval = 5
+	var up = &Upstream{
+		config: conf,
+		names:  newServerNames(),
+		lookupIPAddr: func(_ context.Context, host string) ([]net.IPAddr, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var ips, ok = records[host]
+			if !ok {
+				return nil, errors.New("no such host")
+			}
+			var result []net.IPAddr
+			for _, ip := range ips {
+				result = append(result, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+			return result, nil
+		},
+	}
+	up.ctx, up.cancel = context.WithCancel(context.Background())
+
+	var algo = new(recordingAlgo)
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		up.runDNSResolver(algo, []*types.UpstreamAddress{
+			{Hostname: "a.example", Port: "80", OriginalURL: &url.URL{Host: "a.example"}},
+			{Hostname: "b.example", Port: "8080", OriginalURL: &url.URL{Host: "b.example:8080"}},
+		}, mock.NewLogger())
+	}()
+
+	// the IPv6 address and the host which can not be resolved are left out
+	if hosts := algo.waitForSet(t, 1); hosts != "10.0.0.1:80 10.0.0.2:80" {
+		t.Errorf("Unexpected first addresses %s", hosts)
+	}
+	// the rotation of the records does not change the addresses
+	setRecords("a.example", "10.0.0.2", "10.0.0.1")
+	time.Sleep(50 * time.Millisecond)
+	if n := algo.count(); n != 1 {
+		t.Errorf("Expected the same addresses not to be set again but they were set %d times", n)
+	}
+
+	setRecords("a.example", "10.0.0.3")
+	setRecords("b.example", "10.0.1.1")
+	if hosts := algo.waitForSet(t, 2); hosts != "10.0.0.3:80 10.0.1.1:8080" {
+		t.Errorf("Unexpected changed addresses %s", hosts)
+	}
+	// the resolved addresses are known before they are set
+	if name := up.names.get("10.0.1.1:8080"); name != "b.example" {
+		t.Errorf("Expected the server name of the resolved address to be b.example but got %s", name)
+	}
+
+	// the last known addresses are kept when a host can not be resolved
+	mu.Lock()
+	delete(records, "a.example")
+	mu.Unlock()
+	setRecords("b.example", "10.0.1.2")
+	if hosts := algo.waitForSet(t, 3); hosts != "10.0.0.3:80 10.0.1.2:8080" {
+		t.Errorf("Unexpected addresses after a failed resolving %s", hosts)
+	}
+
+	up.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The resolver did not stop with the upstream")
+	}
+}
+
+func TestDNSResolverStopsWithTheContext(t *testing.T) {
+	t.Parallel()
+	var addrURL, err = url.Parse("http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf = &config.Upstream{
+		ID:        "test",
+		Balancing: "random",
+		Addresses: []config.UpstreamAddress{{URL: addrURL, Weight: 1}},
+		Settings:  config.GetDefaultUpstreamSettings(),
+	}
+	conf.Settings.DNSRefreshInterval = 5
+	conf.Settings.HealthCheck.Path = "/health"
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	up, err := New(ctx, conf, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case <-up.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the context of the upstream to be done with the app one")
+	}
+	select {
+	case <-up.health.stop:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the health checks to be stopped with the context")
+	}
+}
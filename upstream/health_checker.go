@@ -0,0 +1,216 @@
+package upstream
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// healthChecker periodically checks all upstream addresses and ejects the
+// failing ones from the wrapped balancing algorithm until they recover. It
+// implements the balancing algorithm interface itself, so the DNS resolver
+// sets the addresses through it.
+type healthChecker struct {
+	sync.Mutex
+	algo      types.UpstreamBalancingAlgorithm
+	settings  config.HealthCheckSettings
+	client    *http.Client
+	logger    types.Logger
+	id        string
+	addresses []*types.UpstreamAddress
+	health    map[string]*types.UpstreamAddressHealth
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+func newHealthChecker(
+	id string,
+	algo types.UpstreamBalancingAlgorithm,
+	settings config.HealthCheckSettings,
+	names *serverNames,
+	logger types.Logger,
+) *healthChecker {
+	// the resolved addresses are checked with the TLS server names of the
+	// requests to them
+	var transport = &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{}).DialContext,
+	}
+	transport.DialTLSContext = names.dialTLS(transport)
+	return &healthChecker{
+		algo:     algo,
+		settings: settings,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(settings.Timeout) * time.Millisecond,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: logger,
+		id:     id,
+		health: make(map[string]*types.UpstreamAddressHealth),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Set implements the balancing algorithm interface. The health of the
+// addresses which were already known is preserved and the new ones are
+// considered healthy until they fail their checks.
+func (hc *healthChecker) Set(addresses []*types.UpstreamAddress) {
+	hc.Lock()
+	defer hc.Unlock()
+	var health = make(map[string]*types.UpstreamAddressHealth, len(addresses))
+	for _, addr := range addresses {
+		if h, ok := hc.health[addr.Host]; ok {
+			health[addr.Host] = h
+		} else {
+			health[addr.Host] = &types.UpstreamAddressHealth{Address: addr.Host, Healthy: true}
+		}
+	}
+	hc.addresses = addresses
+	hc.health = health
+	hc.updateAlgorithm()
+}
+
+// Get implements the balancing algorithm interface.
+func (hc *healthChecker) Get(path string) (*types.UpstreamAddress, error) {
+	return hc.algo.Get(path)
+}
+
+// updateAlgorithm sets only the healthy addresses in the balancing algorithm.
+// When none of them is healthy all are used as there is nothing better to do.
+// It should be called with the lock held.
+func (hc *healthChecker) updateAlgorithm() {
+	var healthy = make([]*types.UpstreamAddress, 0, len(hc.addresses))
+	for _, addr := range hc.addresses {
+		if hc.health[addr.Host].Healthy {
+			healthy = append(healthy, addr)
+		}
+	}
+	if len(healthy) == 0 && len(hc.addresses) > 0 {
+		hc.logger.Errorf("upstream %s: all addresses are unhealthy, using all of them", hc.id)
+		healthy = hc.addresses
+	}
+	hc.algo.Set(healthy)
+}
+
+// run checks the addresses every interval until stopped.
+func (hc *healthChecker) run() {
+	var ticker = time.NewTicker(time.Duration(hc.settings.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hc.stop:
+			return
+		case <-ticker.C:
+			hc.checkAll()
+		}
+	}
+}
+
+// Stop stops the periodic checks. The addresses are not changed anymore.
+func (hc *healthChecker) Stop() {
+	hc.stopOnce.Do(func() { close(hc.stop) })
+}
+
+// checkAll concurrently checks all addresses and records the results.
+func (hc *healthChecker) checkAll() {
+	hc.Lock()
+	var addresses = hc.addresses
+	hc.Unlock()
+
+	var errs = make([]error, len(addresses))
+	var wg sync.WaitGroup
+	wg.Add(len(addresses))
+	for i, addr := range addresses {
+		go func(i int, addr *types.UpstreamAddress) {
+			defer wg.Done()
+			errs[i] = hc.check(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	hc.Lock()
+	defer hc.Unlock()
+	var changed bool
+	for i, addr := range addresses {
+		if h, ok := hc.health[addr.Host]; ok && hc.record(h, errs[i]) {
+			changed = true
+		}
+	}
+	if changed {
+		hc.updateAlgorithm()
+	}
+}
+
+// record updates the health of an address with the result of its check and
+// returns whether it was ejected or re-admitted because of it.
+func (hc *healthChecker) record(h *types.UpstreamAddressHealth, err error) bool {
+	h.LastCheck = time.Now()
+	if err == nil {
+		h.LastError = ""
+		h.Failures = 0
+		h.Successes++
+		if !h.Healthy && h.Successes >= hc.settings.SuccessThreshold {
+			hc.logger.Logf("upstream %s: re-admitting %s after %d passed health checks",
+				hc.id, h.Address, h.Successes)
+			h.Healthy = true
+			return true
+		}
+		return false
+	}
+
+	h.LastError = err.Error()
+	h.Successes = 0
+	h.Failures++
+	if h.Healthy && h.Failures >= hc.settings.FailThreshold {
+		hc.logger.Errorf("upstream %s: ejecting %s after %d failed health checks: %s",
+			hc.id, h.Address, h.Failures, err)
+		h.Healthy = false
+		return true
+	}
+	return false
+}
+
+// check requests the health check path from the address and returns an error
+// if it did not respond with the expected status.
+func (hc *healthChecker) check(addr *types.UpstreamAddress) error {
+	var u = addr.URL
+	u.Path, u.RawPath, u.RawQuery = hc.settings.Path, "", ""
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = addr.OriginalURL.Host
+
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// the body is drained so that the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != hc.settings.ExpectedStatus {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Health returns the current health of all addresses.
+func (hc *healthChecker) Health() []types.UpstreamAddressHealth {
+	hc.Lock()
+	defer hc.Unlock()
+	var result = make([]types.UpstreamAddressHealth, 0, len(hc.addresses))
+	for _, addr := range hc.addresses {
+		result = append(result, *hc.health[addr.Host])
+	}
+	return result
+}
@@ -0,0 +1,179 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// newHealthServer returns a server whose health check responds with the
+// stored status code and how many health checks it received.
+func newHealthServer(status *int32, checks *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			atomic.AddInt32(checks, 1)
+			w.WriteHeader(int(atomic.LoadInt32(status)))
+		}
+	}))
+}
+
+func waitForHealth(t *testing.T, up *Upstream, host string, healthy bool) {
+	var deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, h := range up.Health() {
+			if h.Address == host && h.Healthy == healthy {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s did not become healthy=%t in time: %+v", host, healthy, up.Health())
+}
+
+func TestHealthChecksEjectAndReadmit(t *testing.T) {
+	t.Parallel()
+	var goodStatus, badStatus int32 = 200, 500
+	var goodChecks, badChecks int32
+	good := newHealthServer(&goodStatus, &goodChecks)
+	defer good.Close()
+	bad := newHealthServer(&badStatus, &badChecks)
+	defer bad.Close()
+
+	var goodURL, _ = url.Parse(good.URL)
+	var badURL, _ = url.Parse(bad.URL)
+	var conf = &config.Upstream{
+		ID:        "test",
+		Balancing: "random",
+		Addresses: []config.UpstreamAddress{{URL: goodURL, Weight: 1}, {URL: badURL, Weight: 1}},
+		Settings:  config.GetDefaultUpstreamSettings(),
+	}
+	conf.Settings.ResolveAddresses = false
+	conf.Settings.HealthCheck.Path = "/health"
+	conf.Settings.HealthCheck.Interval = 5
+	conf.Settings.HealthCheck.FailThreshold = 2
+	conf.Settings.HealthCheck.SuccessThreshold = 2
+
+	up, err := New(context.Background(), conf, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Stop()
+
+	waitForHealth(t, up, badURL.Host, false)
+	for _, h := range up.Health() {
+		if h.Address == badURL.Host && (h.Failures < 2 || h.LastError == "") {
+			t.Errorf("Unexpected health of the ejected address: %+v", h)
+		}
+	}
+
+	// the ejected address is never returned while it is requested concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				addr, err := up.GetAddress("/path")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if addr.Host != goodURL.Host {
+					t.Errorf("Received the ejected address %s", addr.Host)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	atomic.StoreInt32(&badStatus, 200)
+	waitForHealth(t, up, badURL.Host, true)
+
+	var seen = make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		addr, err := up.GetAddress("/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[addr.Host] = true
+	}
+	if !seen[badURL.Host] {
+		t.Error("The re-admitted address was not used")
+	}
+
+	// no more checks are made after the upstream is stopped
+	up.Stop()
+	time.Sleep(20 * time.Millisecond)
+	var checks = atomic.LoadInt32(&goodChecks)
+	time.Sleep(50 * time.Millisecond)
+	if now := atomic.LoadInt32(&goodChecks); now != checks {
+		t.Errorf("Expected no checks after stopping but there were %d", now-checks)
+	}
+}
+
+func TestHealthChecksAllUnhealthy(t *testing.T) {
+	t.Parallel()
+	var algo = &recordingAlgorithm{}
+	var settings = config.GetDefaultUpstreamSettings().HealthCheck
+	settings.FailThreshold = 1
+	var hc = newHealthChecker("test", algo, settings, newServerNames(), mock.NewLogger())
+
+	var first = &types.UpstreamAddress{URL: url.URL{Host: "first:80"}}
+	var second = &types.UpstreamAddress{URL: url.URL{Host: "second:80"}}
+	hc.Set([]*types.UpstreamAddress{first, second})
+	if len(algo.last()) != 2 {
+		t.Fatalf("Expected both addresses to be set but got %v", algo.last())
+	}
+
+	hc.record(hc.health["first:80"], errTest)
+	hc.updateAlgorithm()
+	if set := algo.last(); len(set) != 1 || set[0] != second {
+		t.Errorf("Expected only the second address to be set but got %v", set)
+	}
+
+	// the health is kept when the addresses are set again
+	hc.Set([]*types.UpstreamAddress{first, second})
+	if set := algo.last(); len(set) != 1 || set[0] != second {
+		t.Errorf("Expected only the second address to be set but got %v", set)
+	}
+
+	hc.record(hc.health["second:80"], errTest)
+	hc.updateAlgorithm()
+	if len(algo.last()) != 2 {
+		t.Errorf("Expected all addresses to be used when none is healthy but got %v", algo.last())
+	}
+}
+
+var errTest = errors.New("test error")
+
+type recordingAlgorithm struct {
+	sync.Mutex
+	addresses []*types.UpstreamAddress
+}
+
+func (r *recordingAlgorithm) Set(addresses []*types.UpstreamAddress) {
+	r.Lock()
+	defer r.Unlock()
+	r.addresses = addresses
+}
+
+func (r *recordingAlgorithm) Get(string) (*types.UpstreamAddress, error) {
+	return nil, nil
+}
+
+func (r *recordingAlgorithm) last() []*types.UpstreamAddress {
+	r.Lock()
+	defer r.Unlock()
+	return r.addresses
+}
@@ -0,0 +1,234 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// addressTracker remembers the addresses which are set in the wrapped
+// balancing algorithm, so that the hedged requests can be sent to another one
+// of them.
+type addressTracker struct {
+	types.UpstreamBalancingAlgorithm
+	mu        sync.RWMutex
+	addresses []*types.UpstreamAddress
+	next      uint32
+}
+
+// Set implements the balancing algorithm interface.
+func (t *addressTracker) Set(addresses []*types.UpstreamAddress) {
+	t.mu.Lock()
+	t.addresses = addresses
+	t.mu.Unlock()
+	t.UpstreamBalancingAlgorithm.Set(addresses)
+}
+
+// alternative returns the address with the host and another address which
+// is used instead of it. The alternatives are rotated, so that the hedged
+// requests are spread between them. The returned alternative is nil if there
+// are no other addresses.
+func (t *addressTracker) alternative(host string) (current, alt *types.UpstreamAddress) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var n = uint32(len(t.addresses))
+	var start = atomic.AddUint32(&t.next, 1)
+	for i := uint32(0); i < n; i++ {
+		var addr = t.addresses[(start+i)%n]
+		if addr.Host == host {
+			current = addr
+		} else if alt == nil {
+			alt = addr
+		}
+	}
+	return current, alt
+}
+
+// hedgingClient sends the idempotent requests which did not receive response
+// headers within the delay to another upstream address as well and uses the
+// first successful response, canceling the other request.
+type hedgingClient struct {
+	upClient
+	delay    time.Duration
+	tracker  *addressTracker
+	hedges   chan struct{}
+	mu       sync.Mutex
+	inFlight map[*http.Request]context.CancelFunc
+}
+
+func newHedgingClient(base upClient, tracker *addressTracker, settings config.UpstreamSettings) *hedgingClient {
+	return &hedgingClient{
+		upClient: base,
+		delay:    time.Duration(settings.HedgeDelay) * time.Millisecond,
+		tracker:  tracker,
+		hedges:   make(chan struct{}, settings.MaxHedges),
+		inFlight: make(map[*http.Request]context.CancelFunc),
+	}
+}
+
+// hedgeResult is the result of a single attempt of a hedged request. done is
+// called when the attempt is no longer needed.
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+	done    func()
+}
+
+func (r hedgeResult) successful() bool {
+	return r.err == nil && r.resp.StatusCode < http.StatusInternalServerError
+}
+
+// discard releases everything used by the attempt.
+func (r hedgeResult) discard() {
+	if r.resp != nil {
+		_, _ = io.Copy(ioutil.Discard, r.resp.Body)
+		_ = r.resp.Body.Close()
+	}
+	r.done()
+}
+
+// Do implements the upClient interface.
+func (h *hedgingClient) Do(req *http.Request) (*http.Response, error) {
+	if !isRetryable(req) {
+		return h.upClient.Do(req)
+	}
+
+	var ctx, cancel = context.WithCancel(req.Context())
+	h.mu.Lock()
+	h.inFlight[req] = cancel
+	h.mu.Unlock()
+	var finish = func() {
+		cancel()
+		h.mu.Lock()
+		delete(h.inFlight, req)
+		h.mu.Unlock()
+	}
+
+	var results = make(chan hedgeResult, 2)
+	var attempts = []context.CancelFunc{h.attempt(ctx, 0, req, func() {}, results)}
+	var pending = 1
+	var timer = time.NewTimer(h.delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if hedgeCancel := h.hedge(ctx, len(attempts), req, results); hedgeCancel != nil {
+				attempts = append(attempts, hedgeCancel)
+				pending++
+			}
+		case res := <-results:
+			if pending--; !res.successful() && pending > 0 {
+				res.discard()
+				continue
+			}
+			for i, cancelAttempt := range attempts {
+				if i != res.attempt {
+					cancelAttempt()
+				}
+			}
+			go drainHedgeResults(results, pending)
+			if res.err != nil {
+				res.done()
+				finish()
+				return nil, res.err
+			}
+			res.resp.Body = &hedgedBody{ReadCloser: res.resp.Body, done: func() {
+				res.done()
+				finish()
+			}}
+			return res.resp, nil
+		}
+	}
+}
+
+// attempt sends the request with its own context in the background and
+// returns the function which cancels it.
+func (h *hedgingClient) attempt(
+	parent context.Context,
+	attempt int,
+	req *http.Request,
+	done func(),
+	results chan<- hedgeResult,
+) context.CancelFunc {
+	var ctx, cancel = context.WithCancel(parent)
+	go func() {
+		resp, err := h.upClient.Do(req.WithContext(ctx))
+		results <- hedgeResult{attempt: attempt, resp: resp, err: err, done: func() {
+			cancel()
+			done()
+		}}
+	}()
+	return cancel
+}
+
+// hedge sends the request to another address if the hedges in flight are
+// not too many and the budget of the request is not spent. It returns the
+// function which cancels it or nil if it was not sent.
+func (h *hedgingClient) hedge(
+	ctx context.Context,
+	attempt int,
+	req *http.Request,
+	results chan<- hedgeResult,
+) context.CancelFunc {
+	var current, alt = h.tracker.alternative(req.URL.Host)
+	if alt == nil || !contexts.GetRequestBudget(ctx).Allows(0) {
+		return nil
+	}
+	select {
+	case h.hedges <- struct{}{}:
+	default:
+		return nil
+	}
+
+	var hedged = new(http.Request)
+	*hedged = *req
+	var u = *req.URL
+	u.Scheme, u.Host, u.User = alt.Scheme, alt.Host, alt.User
+	hedged.URL = &u
+	hedged.Body, hedged.ContentLength = nil, 0
+	if current != nil && req.Host == current.OriginalURL.Host {
+		hedged.Host = alt.OriginalURL.Host
+	}
+	return h.attempt(ctx, attempt, hedged, func() { <-h.hedges }, results)
+}
+
+// drainHedgeResults discards the results of the canceled attempts.
+func drainHedgeResults(results <-chan hedgeResult, pending int) {
+	for ; pending > 0; pending-- {
+		(<-results).discard()
+	}
+}
+
+// CancelRequest cancels all attempts of the request.
+func (h *hedgingClient) CancelRequest(req *http.Request) {
+	h.mu.Lock()
+	var cancel = h.inFlight[req]
+	h.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	h.upClient.CancelRequest(req)
+}
+
+// hedgedBody releases the attempt which won when its body is closed.
+type hedgedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *hedgedBody) Close() error {
+	var err = b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
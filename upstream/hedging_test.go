@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/upstream/balancing"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestHedgedRequestsUseTheFastResponse(t *testing.T) {
+	t.Parallel()
+	var slowCanceled = make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(slowCanceled)
+		case <-time.After(5 * time.Second):
+			_, _ = w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	var slowURL, _ = url.Parse(slow.URL)
+	var fastURL, _ = url.Parse(fast.URL)
+	var conf = &config.Upstream{
+		ID:        "test",
+		Balancing: "random",
+		Addresses: []config.UpstreamAddress{{URL: slowURL, Weight: 1}, {URL: fastURL, Weight: 1}},
+		Settings:  config.GetDefaultUpstreamSettings(),
+	}
+	conf.Settings.ResolveAddresses = false
+	conf.Settings.HedgeDelay = 20
+
+	up, err := New(context.Background(), conf, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var start = time.Now()
+	req, err := http.NewRequest("GET", slow.URL+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := up.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "fast" {
+		t.Errorf("Expected the response of the fast address but got '%s'", body)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the hedged request not to wait for the slow address but it took %s", elapsed)
+	}
+
+	select {
+	case <-slowCanceled:
+	case <-time.After(time.Second):
+		t.Error("Expected the request to the slow address to be canceled")
+	}
+}
+
+func TestHedgingIsBounded(t *testing.T) {
+	t.Parallel()
+	algo, err := balancing.New("random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tracker = &addressTracker{UpstreamBalancingAlgorithm: algo}
+	var addresses = testutils.GetUpstreams(1, 2)
+	tracker.Set(addresses)
+	var settings = config.GetDefaultUpstreamSettings()
+	settings.HedgeDelay = 1
+	settings.MaxHedges = 0
+	var h = newHedgingClient(nil, tracker, settings)
+
+	req, err := http.NewRequest("GET", "http://"+addresses[0].Host+"/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, alt := tracker.alternative(addresses[0].Host); alt != addresses[1] {
+		t.Errorf("Expected %s as the alternative but got %v", addresses[1].Host, alt)
+	}
+	if cancel := h.hedge(req.Context(), 1, req, make(chan hedgeResult, 1)); cancel != nil {
+		t.Error("Expected no hedge to be sent over the limit")
+	}
+}
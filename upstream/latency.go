@@ -0,0 +1,122 @@
+package upstream
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+)
+
+const (
+	// latencyBuckets is the number of buckets of a latencyHistogram. The
+	// upper bound of bucket i is minLatency * 2^(i/4), so the last bounded
+	// one ends after more than 20 minutes.
+	latencyBuckets = 96
+	minLatency     = 100 * time.Microsecond
+)
+
+// latencyHistogram counts the response times of an upstream in buckets whose
+// bounds grow exponentially, so it takes the same memory no matter how many
+// are added and the quantiles are estimated with an error of less than 20%.
+// It is safe for concurrent use and its zero value is ready to be used.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+}
+
+// latencyBucket returns the index of the bucket in which d is counted.
+func latencyBucket(d time.Duration) int {
+	if d <= minLatency {
+		return 0
+	}
+	var i = int(math.Ceil(4 * math.Log2(float64(d)/float64(minLatency))))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+// latencyBound returns the upper bound of the bucket i.
+func latencyBound(i int) time.Duration {
+	return time.Duration(float64(minLatency) * math.Exp2(float64(i)/4))
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	atomic.AddUint64(&h.counts[latencyBucket(d)], 1)
+}
+
+// stats returns the number of the counted response times and their median
+// and 95th percentile.
+func (h *latencyHistogram) stats() types.UpstreamLatency {
+	var counts [latencyBuckets]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	return types.UpstreamLatency{
+		Requests: total,
+		P50:      quantile(&counts, total, 0.5),
+		P95:      quantile(&counts, total, 0.95),
+	}
+}
+
+// quantile estimates the q quantile of the total counted times by assuming
+// that they are spread evenly within their buckets.
+func quantile(counts *[latencyBuckets]uint64, total uint64, q float64) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	var rank = q * float64(total)
+	var seen float64
+	for i, count := range counts {
+		if count == 0 || seen+float64(count) < rank {
+			seen += float64(count)
+			continue
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = latencyBound(i - 1)
+		}
+		if i == latencyBuckets-1 { // the last bucket has no upper bound
+			return lower
+		}
+		var fraction = (rank - seen) / float64(count)
+		return lower + time.Duration(fraction*float64(latencyBound(i)-lower))
+	}
+	return latencyBound(latencyBuckets - 2)
+}
+
+// timingTransport is an http.RoundTripper which measures the time until the
+// upstream responds with its headers to every attempt of a request. The times
+// are counted in the latency histogram and recorded through the context of
+// the request for the access log.
+type timingTransport struct {
+	http.RoundTripper
+	latency *latencyHistogram
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var start = time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil {
+		var d = time.Since(start)
+		t.latency.add(d)
+		contexts.RecordUpstreamTime(req.Context(), d)
+	}
+	return resp, err
+}
+
+// CancelRequest cancels the request with the wrapped transport, if it
+// supports it.
+func (t *timingTransport) CancelRequest(req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	if cr, ok := t.RoundTripper.(canceler); ok {
+		cr.CancelRequest(req)
+	}
+}
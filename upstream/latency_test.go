@@ -0,0 +1,84 @@
+package upstream
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+)
+
+func TestLatencyHistogramQuantiles(t *testing.T) {
+	t.Parallel()
+	var h = new(latencyHistogram)
+	if stats := h.stats(); stats.Requests != 0 || stats.P50 != 0 || stats.P95 != 0 {
+		t.Errorf("Expected empty stats without responses but got %+v", stats)
+	}
+
+	// 1ms to 100ms, added concurrently
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h.add(time.Duration(i) * time.Millisecond)
+		}(i)
+	}
+	wg.Wait()
+
+	var stats = h.stats()
+	if stats.Requests != 100 {
+		t.Errorf("Expected 100 requests but got %d", stats.Requests)
+	}
+	for _, q := range []struct {
+		got, expected time.Duration
+	}{
+		{stats.P50, 50 * time.Millisecond},
+		{stats.P95, 95 * time.Millisecond},
+	} {
+		if math.Abs(float64(q.got-q.expected)) > 0.2*float64(q.expected) {
+			t.Errorf("Expected a quantile of about %s but got %s", q.expected, q.got)
+		}
+	}
+
+	// the times out of the range of the buckets are still counted
+	h.add(0)
+	h.add(24 * time.Hour)
+	if stats := h.stats(); stats.Requests != 102 {
+		t.Errorf("Expected 102 requests but got %d", stats.Requests)
+	}
+}
+
+func TestTimingTransport(t *testing.T) {
+	t.Parallel()
+	var origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer origin.Close()
+
+	var latency = new(latencyHistogram)
+	var recorded time.Duration
+	var ctx = contexts.NewUpstreamTimeRecorderContext(context.Background(),
+		func(d time.Duration) { recorded = d })
+	req, err := http.NewRequest("GET", origin.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := getClient(config.GetDefaultUpstreamSettings(), latency, nil).Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if recorded < 20*time.Millisecond {
+		t.Errorf("Expected the upstream time to be recorded but got %s", recorded)
+	}
+	if stats := latency.stats(); stats.Requests != 1 || stats.P50 < 15*time.Millisecond {
+		t.Errorf("Expected the response to be counted but got %+v", stats)
+	}
+}
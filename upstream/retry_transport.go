@@ -0,0 +1,121 @@
+package upstream
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+)
+
+// RetryTransport is an http.RoundTripper which retries the idempotent requests
+// (GET and HEAD) without a body when they fail with a connection error or the
+// upstream responds with one of the configured status codes. The time between
+// the attempts grows exponentially. If all attempts fail, the result of the
+// last one is returned. No retry is made after the latency budget of the
+// request is spent, see types.RequestBudget.
+type RetryTransport struct {
+	Base         http.RoundTripper
+	MaxRetries   uint32
+	RetryOnCodes map[int]bool
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+}
+
+// NewRetryTransport returns a RetryTransport around base, configured with the
+// supplied upstream settings, or base itself if retries are disabled.
+func NewRetryTransport(base http.RoundTripper, settings config.UpstreamSettings) http.RoundTripper {
+	if settings.MaxRetries == 0 {
+		return base
+	}
+	var codes = make(map[int]bool, len(settings.RetryOnCodes))
+	for _, code := range settings.RetryOnCodes {
+		codes[code] = true
+	}
+	return &RetryTransport{
+		Base:         base,
+		MaxRetries:   settings.MaxRetries,
+		RetryOnCodes: codes,
+		Backoff:      time.Duration(settings.RetryBackoff) * time.Millisecond,
+		MaxBackoff:   time.Duration(settings.RetryMaxBackoff) * time.Millisecond,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetryable(req) {
+		return t.Base.RoundTrip(req)
+	}
+
+	var ctx = req.Context()
+	var budget = contexts.GetRequestBudget(ctx)
+	for attempt := uint32(0); ; attempt++ {
+		resp, err := t.Base.RoundTrip(req)
+		if err == nil && !t.RetryOnCodes[resp.StatusCode] {
+			return resp, nil
+		}
+		if attempt == t.MaxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		var backoff = t.backoff(attempt)
+		if !budget.Allows(backoff) {
+			// the retry would not be answered before the budget is spent
+			budget.Spend()
+			return resp, err
+		}
+		if resp != nil {
+			// drain the body so that the connection can be reused
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		var timer = time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if err == nil {
+				err = ctx.Err()
+			}
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the time to wait before the retry after the attempt. Zero
+// MaxBackoff means that it is not limited.
+func (t *RetryTransport) backoff(attempt uint32) time.Duration {
+	var d = t.Backoff
+	for i := uint32(0); i < attempt && (t.MaxBackoff == 0 || d < t.MaxBackoff) && d <= math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if t.MaxBackoff > 0 && d > t.MaxBackoff {
+		d = t.MaxBackoff
+	}
+	return d
+}
+
+// CancelRequest cancels the request with the base transport, if it supports
+// it.
+func (t *RetryTransport) CancelRequest(req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	if cr, ok := t.Base.(canceler); ok {
+		cr.CancelRequest(req)
+	}
+}
+
+// isRetryable returns whether the request can be sent again. The bodies of
+// the requests can be read only once, so only the ones without a body are.
+// The proxied requests always have a Body, but it is empty when they have
+// neither Content-Length nor Transfer-Encoding.
+func isRetryable(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	return req.Body == nil || req.ContentLength == 0 && len(req.TransferEncoding) == 0
+}
@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// fakeTransport returns the next of its results on every request
+type fakeTransport struct {
+	sync.Mutex
+	results  []interface{} // status codes or errors
+	attempts int
+}
+
+func (f *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	var result = f.results[f.attempts]
+	f.attempts++
+	if err, ok := result.(error); ok {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: result.(int),
+		Body:       ioutil.NopCloser(strings.NewReader("body")),
+		Request:    req,
+	}, nil
+}
+
+func newTestRetryTransport(results ...interface{}) (*RetryTransport, *fakeTransport) {
+	var fake = &fakeTransport{results: results}
+	var settings = config.GetDefaultUpstreamSettings()
+	settings.MaxRetries = 2
+	settings.RetryBackoff = 1
+	return NewRetryTransport(fake, settings).(*RetryTransport), fake
+}
+
+func TestRetryTransport(t *testing.T) {
+	t.Parallel()
+	var errConn = errors.New("connection refused")
+	var errLast = errors.New("connection reset")
+	for _, test := range []struct {
+		name     string
+		method   string
+		body     string
+		results  []interface{}
+		code     int
+		err      error
+		attempts int
+	}{
+		{name: "success", method: "GET", results: []interface{}{200}, code: 200, attempts: 1},
+		{name: "error then success", method: "GET",
+			results: []interface{}{errConn, 503, 200}, code: 200, attempts: 3},
+		{name: "head", method: "HEAD", results: []interface{}{502, 200}, code: 200, attempts: 2},
+		{name: "all fail with codes", method: "GET",
+			results: []interface{}{503, errConn, 504}, code: 504, attempts: 3},
+		{name: "all fail with errors", method: "GET",
+			results: []interface{}{errConn, 503, errLast}, err: errLast, attempts: 3},
+		{name: "not configured code", method: "GET", results: []interface{}{500}, code: 500, attempts: 1},
+		{name: "not idempotent", method: "POST", results: []interface{}{errConn}, err: errConn, attempts: 1},
+		{name: "with body", method: "GET", body: "body",
+			results: []interface{}{503}, code: 503, attempts: 1},
+	} {
+		var rt, fake = newTestRetryTransport(test.results...)
+		req, err := http.NewRequest(test.method, "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.body != "" {
+			req.Body = ioutil.NopCloser(strings.NewReader(test.body))
+			req.ContentLength = int64(len(test.body))
+		}
+
+		resp, err := rt.RoundTrip(req)
+		if err != test.err {
+			t.Errorf("%s: expected error %v but got %v", test.name, test.err, err)
+		}
+		if test.err == nil && (resp == nil || resp.StatusCode != test.code) {
+			t.Errorf("%s: expected a response with code %d but got %v", test.name, test.code, resp)
+		}
+		if fake.attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts but there were %d", test.name, test.attempts, fake.attempts)
+		}
+	}
+}
+
+func TestRetryTransportCancellation(t *testing.T) {
+	t.Parallel()
+	var rt, fake = newTestRetryTransport(503, 503, 503)
+	rt.Backoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var done = make(chan error)
+	go func() {
+		_, err := rt.RoundTrip(req.WithContext(ctx))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Expected the cancellation error but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The retries did not stop when the request was cancelled")
+	}
+	if fake.attempts != 1 {
+		t.Errorf("Expected a single attempt but there were %d", fake.attempts)
+	}
+}
+
+func TestRetryTransportBackoff(t *testing.T) {
+	t.Parallel()
+	var rt = &RetryTransport{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, expected := range []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second,
+	} {
+		if got := rt.backoff(uint32(attempt)); got != expected {
+			t.Errorf("Expected backoff %s after attempt %d but got %s", expected, attempt, got)
+		}
+	}
+}
+
+func TestRetryTransportUnlimitedBackoff(t *testing.T) {
+	t.Parallel()
+	var rt = &RetryTransport{Backoff: 100 * time.Millisecond}
+	for attempt, expected := range []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, 1600 * time.Millisecond,
+	} {
+		if got := rt.backoff(uint32(attempt)); got != expected {
+			t.Errorf("Expected backoff %s after attempt %d but got %s", expected, attempt, got)
+		}
+	}
+	if got := rt.backoff(100); got <= 0 {
+		t.Errorf("Expected the backoff to not overflow but got %s", got)
+	}
+}
+
+func TestRetriesWithConnectionLimiter(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		var n = requests
+		mu.Unlock()
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "finally")
+	}))
+	defer ts.Close()
+
+	var settings = config.GetDefaultUpstreamSettings()
+	settings.MaxRetries = 3
+	settings.RetryBackoff = 1
+	settings.MaxConnectionsPerServer = 1
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := getClient(settings, new(latencyHistogram), nil).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "finally" {
+		t.Errorf("Unexpected response %d: %q", resp.StatusCode, body)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 upstream requests but there were %d", requests)
+	}
+}
+
+func TestRetriesWithinRequestBudget(t *testing.T) {
+	t.Parallel()
+	var rt, fake = newTestRetryTransport(503, 503, 200)
+	rt.Backoff, rt.MaxBackoff = 50*time.Millisecond, 50*time.Millisecond
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var budget = types.NewRequestBudget(80 * time.Millisecond)
+	req = req.WithContext(contexts.NewRequestBudgetContext(req.Context(), budget))
+
+	var start = time.Now()
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != 503 || fake.attempts != 2 {
+		t.Errorf("Expected the retries to stop after 2 attempts with 503 but got %d after %d",
+			resp.StatusCode, fake.attempts)
+	}
+	if elapsed := time.Since(start); elapsed > 80*time.Millisecond {
+		t.Errorf("Expected the retries to stop within the budget but they took %s", elapsed)
+	}
+	if !budget.Spent() {
+		t.Error("Expected the budget to be marked as spent")
+	}
+}
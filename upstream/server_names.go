@@ -0,0 +1,94 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// serverNames maps the IP:port endpoints to which the host names of the
+// upstream addresses were resolved back to these host names. The endpoints
+// are dialed by their IPs, but the host names are used as the TLS server
+// names (SNI) and for the verification of their certificates.
+type serverNames struct {
+	sync.RWMutex
+	byEndpoint map[string]string
+}
+
+func newServerNames() *serverNames {
+	return &serverNames{byEndpoint: make(map[string]string)}
+}
+
+// set replaces all known endpoints with the resolved addresses.
+func (s *serverNames) set(addresses []*types.UpstreamAddress) {
+	var byEndpoint = make(map[string]string, len(addresses))
+	for _, addr := range addresses {
+		if addr.OriginalURL != nil {
+			byEndpoint[addr.Host] = addr.OriginalURL.Hostname()
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.byEndpoint = byEndpoint
+}
+
+// get returns the server name of the endpoint, which is its own host if it
+// is not a resolved one.
+func (s *serverNames) get(endpoint string) string {
+	s.RLock()
+	var name, ok = s.byEndpoint[endpoint]
+	s.RUnlock()
+	if ok {
+		return name
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	return host
+}
+
+// dialTLS returns a function for the DialTLSContext of the transport, which
+// dials an endpoint with its DialContext and makes the TLS handshake with
+// the server name of the endpoint, within its TLSHandshakeTimeout.
+func (s *serverNames) dialTLS(transport *http.Transport) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, endpoint string) (net.Conn, error) {
+		var dial = transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		conn, err := dial(ctx, network, endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		var config = new(tls.Config)
+		if transport.TLSClientConfig != nil {
+			config = transport.TLSClientConfig.Clone()
+		}
+		config.ServerName = s.get(endpoint)
+		if len(config.NextProtos) == 0 {
+			if transport.Protocols != nil && transport.Protocols.HTTP2() {
+				config.NextProtos = []string{"h2", "http/1.1"}
+			} else {
+				config.NextProtos = []string{"http/1.1"}
+			}
+		}
+		if transport.TLSHandshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+			defer cancel()
+		}
+
+		var tlsConn = tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestResolvedTLSAddressesUseTheHostName(t *testing.T) {
+	t.Parallel()
+	var origin = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Server-Name", r.TLS.ServerName)
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+	var roots = x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+	var endpoint, _ = url.Parse(origin.URL)
+
+	for _, test := range []struct {
+		protocol, hostname, proto string
+		fails                     bool
+	}{
+		{config.UpstreamProtocolHTTP1, "example.com", "HTTP/1.1", false},
+		{config.UpstreamProtocolHTTP2, "example.com", "HTTP/2.0", false},
+		// the certificate is verified for the host name and not the IP
+		{config.UpstreamProtocolHTTP1, "not.example.org", "", true},
+	} {
+		var names = newServerNames()
+		names.set([]*types.UpstreamAddress{{
+			URL:         *endpoint,
+			OriginalURL: &url.URL{Scheme: "https", Host: test.hostname + ":" + endpoint.Port()},
+		}})
+		var settings = config.GetDefaultUpstreamSettings()
+		settings.Protocol = test.protocol
+		var c = getClient(settings, new(latencyHistogram), names).(*client)
+		c.Transport.(*timingTransport).RoundTripper.(*http.Transport).TLSClientConfig =
+			&tls.Config{RootCAs: roots}
+
+		req, err := http.NewRequest("GET", origin.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if test.fails {
+			if err == nil {
+				_ = resp.Body.Close()
+				t.Errorf("Expected the certificate not to be valid for %s", test.hostname)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s with %s: %s", test.hostname, test.protocol, err)
+			continue
+		}
+		_ = resp.Body.Close()
+		if name := resp.Header.Get("X-Server-Name"); name != test.hostname {
+			t.Errorf("Expected the server name %s but the upstream got %q", test.hostname, name)
+		}
+		if proto := resp.Header.Get("X-Proto"); proto != test.proto {
+			t.Errorf("Expected %s with %s but the upstream got %s", test.proto, test.protocol, proto)
+		}
+	}
+}
+
+func TestServerNamesOfUnknownEndpoints(t *testing.T) {
+	t.Parallel()
+	var names = newServerNames()
+	names.set([]*types.UpstreamAddress{{
+		URL:         url.URL{Scheme: "https", Host: "[2001:db8::1]:443"},
+		OriginalURL: &url.URL{Scheme: "https", Host: "example.com"},
+	}})
+	for endpoint, expected := range map[string]string{
+		"[2001:db8::1]:443": "example.com",
+		"[2001:db8::2]:443": "2001:db8::2",
+		"example.net:8443":  "example.net",
+	} {
+		if name := names.get(endpoint); name != expected {
+			t.Errorf("Expected the server name %s for %s but got %s", expected, endpoint, name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,6 +14,10 @@ import (
 	"github.com/ironsmile/nedomi/utils/httputils"
 )
 
+// stickyBalancing is the balancing algorithm which uses the affinity keys of
+// the requests.
+const stickyBalancing = "sticky"
+
 type client http.Client
 
 func (c *client) Do(req *http.Request) (*http.Response, error) {
@@ -42,6 +47,15 @@ type Upstream struct {
 	upClient
 	config        *config.Upstream
 	addressGetter func(string) (*types.UpstreamAddress, error)
+	health        *healthChecker
+	limiter       *connectionLimiter
+	latency       *latencyHistogram
+	names         *serverNames
+	// the background work of the upstream is stopped when ctx is done
+	ctx    context.Context
+	cancel context.CancelFunc
+	// lookupIPAddr resolves the host names of the addresses
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
 }
 
 // GetAddress implements the Upstream interface
@@ -49,43 +63,133 @@ func (u *Upstream) GetAddress(uri string) (*types.UpstreamAddress, error) {
 	return u.addressGetter(uri)
 }
 
-func getClient(settings config.UpstreamSettings) upClient {
-	//!TODO: get all of these hardcoded values from the config
-	//!TODO: use the facebook retryable transport
+// AffinityKey implements the types.StickyUpstream interface. With the sticky
+// balancing it is the value of the sticky cookie or the client IP address and
+// it is empty for the other algorithms.
+func (u *Upstream) AffinityKey(req *http.Request) string {
+	if u.config == nil || u.config.Balancing != stickyBalancing {
+		return ""
+	}
+	if name := u.config.Settings.StickyCookie; name != "" {
+		if cookie, err := req.Cookie(name); err == nil && cookie.Value != "" {
+			return "cookie:" + cookie.Value
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// HostHeader implements the types.HostHeaderUpstream interface. It is the
+// host chosen by the host_header setting of the upstream for the request to
+// the address. The TLS server names of the addresses do not depend on it.
+func (u *Upstream) HostHeader(req *http.Request, addr *types.UpstreamAddress) string {
+	if u.config == nil {
+		return ""
+	}
+	switch u.config.Settings.HostHeader {
+	case config.UpstreamHostHeaderOriginal:
+		if req.Host != "" {
+			return req.Host
+		}
+		return req.URL.Host
+	case config.UpstreamHostHeaderUpstream:
+		return addr.OriginalURL.Host
+	case config.UpstreamHostHeaderExplicit:
+		return u.config.Settings.HostHeaderValue
+	}
+	return ""
+}
+
+// getClient returns the client for the requests to the upstream addresses.
+// With names the https:// addresses are dialed by their resolved IPs, but
+// their TLS server names are the host names in their URLs.
+func getClient(settings config.UpstreamSettings, latency *latencyHistogram, names *serverNames) upClient {
 	//!TODO: investigate transport timeouts for active connections
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(settings.DialTimeout) * time.Millisecond,
+			KeepAlive: time.Duration(settings.KeepAlive) * time.Millisecond,
+		}).DialContext,
+		TLSHandshakeTimeout: time.Duration(settings.TLSHandshakeTimeout) * time.Millisecond,
+		DisableKeepAlives:   settings.DisableKeepAlives,
+		DisableCompression:  settings.DisableCompression,
+		MaxIdleConnsPerHost: int(settings.MaxIdleConnsPerHost),
+		Protocols:           getProtocols(settings.Protocol),
+	}
+	if names != nil {
+		transport.DialTLSContext = names.dialTLS(transport)
+	}
 	c := (*client)(&http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   10 * time.Second,
-				KeepAlive: 10 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: 5 * time.Second,
-			DisableKeepAlives:   false,
-			DisableCompression:  true,
-			MaxIdleConnsPerHost: 5,
-		},
+		Transport: NewRetryTransport(&timingTransport{transport, latency}, settings),
 	})
 
+	// The retries are made by the transport, so all attempts of a request
+	// are counted as a single connection by the limiter
 	if settings.MaxConnectionsPerServer > 0 {
-		return newConnectionLimiter(c, settings.MaxConnectionsPerServer)
+		return newConnectionLimiter(c, settings)
 	}
 	return c
 }
 
-// New creates a new RoundTripper from the supplied upstream config
-func New(conf *config.Upstream, logger types.Logger) (*Upstream, error) {
+// getProtocols returns the HTTP versions which the transport uses for the
+// protocol setting of the upstream. The transport with a custom dialer speaks
+// only HTTP/1.1 by default.
+func getProtocols(protocol string) *http.Protocols {
+	var protocols = new(http.Protocols)
+	switch protocol {
+	case config.UpstreamProtocolHTTP2:
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case config.UpstreamProtocolH2C:
+		// without HTTP/1.1 the http:// addresses get HTTP/2 with prior
+		// knowledge instead of an upgrade
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		protocols.SetHTTP1(true)
+	}
+	return protocols
+}
+
+// New creates a new RoundTripper from the supplied upstream config. Its
+// background work, such as the health checks and the resolving of the
+// addresses, is stopped when ctx is done or the upstream is stopped.
+func New(ctx context.Context, conf *config.Upstream, logger types.Logger) (*Upstream, error) {
 
 	balancingAlgo, err := balancing.New(conf.Balancing)
 	if err != nil {
 		return nil, err
 	}
 
+	var latency, names = new(latencyHistogram), newServerNames()
 	up := &Upstream{
-		upClient:      getClient(conf.Settings),
-		config:        conf,
-		addressGetter: balancingAlgo.Get,
+		upClient: getClient(conf.Settings, latency, names),
+		config:   conf,
+		latency:  latency,
+		names:    names,
+
+		lookupIPAddr: net.DefaultResolver.LookupIPAddr,
+	}
+	up.ctx, up.cancel = context.WithCancel(ctx)
+	up.limiter, _ = up.upClient.(*connectionLimiter)
+	// The hedged requests are sent to the addresses which are currently
+	// balanced, i.e. after the unhealthy ones are ejected
+	if conf.Settings.HedgeDelay > 0 {
+		var tracker = &addressTracker{UpstreamBalancingAlgorithm: balancingAlgo}
+		balancingAlgo = tracker
+		up.upClient = newHedgingClient(up.upClient, tracker, conf.Settings)
 	}
+	// The health checker sits between the balancing algorithm and the
+	// addresses, so it can eject the unhealthy ones
+	if conf.Settings.HealthCheck.Path != "" {
+		up.health = newHealthChecker(conf.ID, balancingAlgo, conf.Settings.HealthCheck, names, logger)
+		balancingAlgo = up.health
+	}
+	up.addressGetter = balancingAlgo.Get
 
 	// Feed the unresolved addresses while waiting for DNS resolver
 	unresolved := make([]*types.UpstreamAddress, len(conf.Addresses))
@@ -106,13 +210,56 @@ func New(conf *config.Upstream, logger types.Logger) (*Upstream, error) {
 	balancingAlgo.Set(unresolved)
 
 	if conf.Settings.ResolveAddresses {
-		//!TODO: get app cancel channel to the dns resolver
-		go up.initDNSResolver(balancingAlgo, unresolved, logger)
+		go up.runDNSResolver(balancingAlgo, unresolved, logger)
+	}
+	if up.health != nil {
+		go up.health.run()
+		go func() {
+			<-up.ctx.Done()
+			up.health.Stop()
+		}()
 	}
 
 	return up, nil
 }
 
+// Health returns the health of the upstream addresses or nil if the upstream
+// does not check it.
+func (u *Upstream) Health() []types.UpstreamAddressHealth {
+	if u.health == nil {
+		return nil
+	}
+	return u.health.Health()
+}
+
+// Connections returns the numbers of requests in flight and waiting for the
+// upstream addresses which have any or nil if the upstream does not limit
+// them.
+func (u *Upstream) Connections() []types.UpstreamAddressConnections {
+	if u.limiter == nil {
+		return nil
+	}
+	return u.limiter.Connections()
+}
+
+// Latency returns the number of the responses of the upstream addresses and
+// the median and 95th percentile of the times until they started.
+func (u *Upstream) Latency() types.UpstreamLatency {
+	if u.latency == nil {
+		return types.UpstreamLatency{}
+	}
+	return u.latency.stats()
+}
+
+// Stop stops the background work of the upstream such as the health checks
+// and the resolving of the addresses. It can still be used for requests after
+// that.
+func (u *Upstream) Stop() {
+	if u.cancel != nil {
+		u.cancel()
+	}
+}
+
 // NewSimple creates a simple RoundTripper with the default configuration that
 // proxies requests to the supplied URL
 func NewSimple(url *url.URL) (*Upstream, error) {
@@ -129,8 +276,10 @@ func NewSimple(url *url.URL) (*Upstream, error) {
 		Weight:      1,
 	}
 
+	var latency = new(latencyHistogram)
 	return &Upstream{
-		upClient: getClient(config.GetDefaultUpstreamSettings()),
+		upClient: getClient(config.GetDefaultUpstreamSettings(), latency, nil),
+		latency:  latency,
 		addressGetter: func(_ string) (*types.UpstreamAddress, error) {
 			// Always return the same single url - no balancing needed
 			return up, nil
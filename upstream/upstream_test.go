@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+)
+
+func TestStickyAffinityKey(t *testing.T) {
+	t.Parallel()
+	var addrURL, _ = url.Parse("http://127.0.0.1:8080")
+	var conf = &config.Upstream{
+		ID:        "test",
+		Balancing: "sticky",
+		Addresses: []config.UpstreamAddress{{URL: addrURL, Weight: 1}},
+		Settings:  config.GetDefaultUpstreamSettings(),
+	}
+	conf.Settings.ResolveAddresses = false
+	conf.Settings.StickyCookie = "session"
+
+	up, err := New(context.Background(), conf, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req, _ = http.NewRequest("GET", "http://example.com/path", nil)
+	req.RemoteAddr = "10.1.2.3:5678"
+	if key := up.AffinityKey(req); key != "ip:10.1.2.3" {
+		t.Errorf("Expected the client IP as a key without the cookie but got '%s'", key)
+	}
+	req.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	if key := up.AffinityKey(req); key != "cookie:abc" {
+		t.Errorf("Expected the cookie value as a key but got '%s'", key)
+	}
+
+	conf.Balancing = "rendezvous"
+	if key := up.AffinityKey(req); key != "" {
+		t.Errorf("Expected no affinity key for other algorithms but got '%s'", key)
+	}
+}
+
+func TestTransportSettings(t *testing.T) {
+	t.Parallel()
+	var settings = config.GetDefaultUpstreamSettings()
+	settings.MaxIdleConnsPerHost = 64
+	settings.DisableKeepAlives = true
+	settings.DisableCompression = false
+	settings.TLSHandshakeTimeout = 1500
+
+	var timing = getClient(settings, new(latencyHistogram), nil).(*client).Transport.(*timingTransport)
+	var transport, ok = timing.RoundTripper.(*http.Transport)
+	if !ok {
+		t.Fatal("Expected the client to use an http.Transport")
+	}
+	if transport.MaxIdleConnsPerHost != 64 || !transport.DisableKeepAlives ||
+		transport.DisableCompression || transport.TLSHandshakeTimeout != 1500*time.Millisecond {
+		t.Errorf("The transport was not configured with the settings: %+v", transport)
+	}
+}
+
+func TestUpstreamProtocols(t *testing.T) {
+	t.Parallel()
+	var origin = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	origin.Config.Protocols = new(http.Protocols)
+	origin.Config.Protocols.SetHTTP1(true)
+	origin.Config.Protocols.SetUnencryptedHTTP2(true)
+	origin.Start()
+	defer origin.Close()
+
+	for protocol, expected := range map[string]string{
+		"":                           "HTTP/1.1",
+		config.UpstreamProtocolHTTP1: "HTTP/1.1",
+		// HTTP/2 is negotiated only over TLS
+		config.UpstreamProtocolHTTP2: "HTTP/1.1",
+		config.UpstreamProtocolH2C:   "HTTP/2.0",
+	} {
+		var settings = config.GetDefaultUpstreamSettings()
+		settings.Protocol = protocol
+		req, err := http.NewRequest("GET", origin.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := getClient(settings, new(latencyHistogram), nil).Do(req)
+		if err != nil {
+			t.Errorf("Unexpected error with protocol %q: %s", protocol, err)
+			continue
+		}
+		_ = resp.Body.Close()
+		if proto := resp.Header.Get("X-Proto"); proto != expected {
+			t.Errorf("Expected %s with protocol %q but the upstream got %s", expected, protocol, proto)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package cacheutils
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,8 +25,9 @@ func CacheSatisfiesRequest(obj *types.ObjectMetadata, req *http.Request) bool {
 
 // IsResponseCacheable returs whether the upstream server allows the requested
 // content to be saved in the cache. True result and 0 duration means that the
-// response has no expiry date.
-func IsResponseCacheable(code int, headers http.Header) bool {
+// response has no expiry date. Encoded responses are cacheable only in one of
+// the encodings.
+func IsResponseCacheable(code int, headers http.Header, encodings ...string) bool {
 	//!TODO: write a better custom implementation or fork the cacheobject - the API sucks
 	//!TODO: correctly handle cache-control, pragma, etag and vary headers
 	//!TODO: write unit tests
@@ -33,9 +35,27 @@ func IsResponseCacheable(code int, headers http.Header) bool {
 	if code != http.StatusOK && code != http.StatusPartialContent {
 		return false
 	}
+	return headersAllowCaching(headers, encodings)
+}
+
+// IsNegativeResponseCacheable returns whether the error response of the
+// upstream server may be saved in the cache, which is the case for the
+// responses with one of the provided codes which do not forbid it.
+func IsNegativeResponseCacheable(code int, codes []int, headers http.Header, encodings ...string) bool {
+	for _, c := range codes {
+		if c == code {
+			return headersAllowCaching(headers, encodings)
+		}
+	}
+	return false
+}
 
-	// For now, we do not cache encoded responses
-	if headers.Get("Content-Encoding") != "" {
+// headersAllowCaching returns whether the headers of a response allow it to be
+// saved in the cache.
+func headersAllowCaching(headers http.Header, encodings []string) bool {
+	// Encoded responses are cached only when they are asked for, as the
+	// parts of the different encodings can not be mixed
+	if encoding := headers.Get("Content-Encoding"); encoding != "" && !containsFold(encodings, encoding) {
 		return false
 	}
 
@@ -44,17 +64,44 @@ func IsResponseCacheable(code int, headers http.Header) bool {
 		return false
 	}
 
+	// responses with no-cache are cached, but they expire immediately and
+	// are always revalidated, see ResponseExpiresIn
 	respDir, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
-	if err != nil || respDir.NoCachePresent || respDir.NoStore || respDir.PrivatePresent {
+	if err != nil || respDir.NoStore || respDir.PrivatePresent {
 		return false
 	}
 
 	return true
 }
 
+// ResponseIsNoStore returns whether the response has the no-store directive,
+// which means that no part of it may be stored.
+func ResponseIsNoStore(headers http.Header) bool {
+	respDir, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
+	return err == nil && respDir.NoStore
+}
+
+// ResponseIsPrivate returns whether the response has the private directive,
+// which means that it is meant only for the user who requested it.
+func ResponseIsPrivate(headers http.Header) bool {
+	respDir, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
+	return err == nil && respDir.PrivatePresent
+}
+
+// AuthorizedResponseIsShareable returns whether the response to a request with
+// an Authorization header may be stored in a shared cache, which according to
+// RFC 7234 section 3.2 is only when it explicitly allows it with the public,
+// s-maxage or must-revalidate directives.
+func AuthorizedResponseIsShareable(headers http.Header) bool {
+	respDir, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
+	return err == nil && (respDir.Public || respDir.SMaxAge >= 0 || respDir.MustRevalidate)
+}
+
 // ResponseExpiresIn parses the expiration time from upstream headers, if any, and returns
 // it as a duration from now. If no expire time is found, it returns its second argument:
-// the default expiration time.
+// the default expiration time. Responses with no-cache expire immediately. As this is a
+// shared cache, s-maxage takes precedence over max-age. The time which the response
+// had spent in other caches, see ResponseAge, is subtracted from both of them.
 func ResponseExpiresIn(headers http.Header, ifNotAny time.Duration) time.Duration {
 
 	//!TODO: this cacheobject.ParseResponseCacheControl is called two times for every
@@ -65,10 +112,13 @@ func ResponseExpiresIn(headers http.Header, ifNotAny time.Duration) time.Duratio
 		return ifNotAny
 	}
 
-	if respDir.SMaxAge > 0 {
-		return time.Duration(respDir.SMaxAge) * time.Second
-	} else if respDir.MaxAge > 0 {
-		return time.Duration(respDir.MaxAge) * time.Second
+	// the missing delta-seconds directives are negative
+	if respDir.NoCachePresent {
+		return 0
+	} else if respDir.SMaxAge >= 0 {
+		return time.Duration(int64(respDir.SMaxAge)-ResponseAge(headers)) * time.Second
+	} else if respDir.MaxAge >= 0 {
+		return time.Duration(int64(respDir.MaxAge)-ResponseAge(headers)) * time.Second
 	} else if headers.Get("Expires") != "" {
 		_ = "breakpoint"
 		if t, err := time.Parse(time.RFC1123, headers.Get("Expires")); err == nil {
@@ -79,3 +129,47 @@ func ResponseExpiresIn(headers http.Header, ifNotAny time.Duration) time.Duratio
 
 	return ifNotAny
 }
+
+// ResponseStaleWhileRevalidate returns for how many seconds after it expires
+// the response may be served stale while it is revalidated, according to its
+// stale-while-revalidate directive. It is zero when there is no such
+// directive or when the response has no-cache.
+func ResponseStaleWhileRevalidate(headers http.Header) int64 {
+	respDir, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
+	if err != nil || respDir.NoCachePresent || respDir.StaleWhileRevalidate <= 0 {
+		return 0
+	}
+	return int64(respDir.StaleWhileRevalidate)
+}
+
+// ResponseIsImmutable returns whether the response has the immutable directive
+// of RFC 8246, which means that it will not change while it is fresh.
+func ResponseIsImmutable(headers http.Header) bool {
+	for _, value := range headers["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "immutable") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ResponseAge returns the number of seconds which the response had spent in
+// other caches according to its Age header, or zero if it has no valid one.
+func ResponseAge(headers http.Header) int64 {
+	age, err := strconv.ParseInt(strings.TrimSpace(headers.Get("Age")), 10, 64)
+	if err != nil || age < 0 {
+		return 0
+	}
+	return age
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
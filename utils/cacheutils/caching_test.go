@@ -54,7 +54,28 @@ var responseCacheabilityMatrix = []struct {
 	{
 		code:      http.StatusOK,
 		headers:   `Cache-Control: no-cache`,
-		cacheable: false, // actually true with expiresIN of 0 but no plans for supporting it yet
+		cacheable: true, // but always revalidated
+	},
+	{
+		code:      http.StatusOK,
+		headers:   `Cache-Control: no-cache, max-age=30`,
+		cacheable: true,
+	},
+	{
+		code:      http.StatusOK,
+		headers:   `Cache-Control: max-age=0`,
+		cacheable: true,
+	},
+	{
+		code:      http.StatusOK,
+		headers:   `Cache-Control: public, s-maxage=30, max-age=0`,
+		cacheable: true,
+		expiresIN: time.Second * 30,
+	},
+	{
+		code:      http.StatusOK,
+		headers:   `Cache-Control: private, max-age=30`,
+		cacheable: false,
 	},
 	{
 		code:      http.StatusOK,
@@ -110,6 +131,34 @@ func TestIsResponseCacheable(t *testing.T) {
 	}
 }
 
+func TestEncodedResponseCacheability(t *testing.T) {
+	t.Parallel()
+	var headers = http.Header{"Content-Encoding": {"gzip"}}
+	if IsResponseCacheable(http.StatusOK, headers) {
+		t.Error("Expected the encoded response not to be cacheable without encodings")
+	}
+	if IsResponseCacheable(http.StatusOK, headers, "br") {
+		t.Error("Expected the response not to be cacheable in another encoding")
+	}
+	if !IsResponseCacheable(http.StatusOK, headers, "br", "GZIP") {
+		t.Error("Expected the response to be cacheable in the asked for encoding")
+	}
+}
+
+func TestNegativeResponseCacheability(t *testing.T) {
+	t.Parallel()
+	var codes = []int{http.StatusNotFound}
+	if !IsNegativeResponseCacheable(http.StatusNotFound, codes, http.Header{}) {
+		t.Error("Expected the 404 response to be cacheable")
+	}
+	if IsNegativeResponseCacheable(http.StatusGone, codes, http.Header{}) {
+		t.Error("Expected the response with another code not to be cacheable")
+	}
+	if IsNegativeResponseCacheable(http.StatusNotFound, codes, http.Header{"Cache-Control": {"private"}}) {
+		t.Error("Expected the private 404 response not to be cacheable")
+	}
+}
+
 func TestResponseExpiresInDurationParsing(t *testing.T) {
 	t.Parallel()
 	for index, test := range responseCacheabilityMatrix {
@@ -127,3 +176,113 @@ func TestResponseExpiresInDurationParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestResponsesWhichExpireImmediately(t *testing.T) {
+	t.Parallel()
+	for _, cacheControl := range []string{
+		"no-cache",
+		"no-cache, max-age=30",
+		`no-cache="Set-Cookie", s-maxage=30`,
+		"max-age=0",
+		"max-age=30, s-maxage=0",
+	} {
+		var headers = http.Header{"Cache-Control": []string{cacheControl}}
+		if expiresIn := ResponseExpiresIn(headers, time.Hour); expiresIn != 0 {
+			t.Errorf("Expected %q to expire immediately but it expires in %s", cacheControl, expiresIn)
+		}
+	}
+}
+
+func TestResponseExpiresInWithAge(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		cacheControl, expires, age string
+		expected                   time.Duration
+	}{
+		{cacheControl: "max-age=3600", age: "100", expected: 3500 * time.Second},
+		{cacheControl: "max-age=3600, s-maxage=600", age: "100", expected: 500 * time.Second},
+		{cacheControl: "max-age=60", age: "100", expected: -40 * time.Second},
+		{cacheControl: "max-age=60", age: "broken", expected: time.Minute},
+		{expires: time.Now().Add(time.Hour).UTC().Format(time.RFC1123), age: "100", expected: time.Hour},
+	} {
+		var headers = http.Header{"Age": []string{test.age}}
+		if test.cacheControl != "" {
+			headers.Set("Cache-Control", test.cacheControl)
+		}
+		if test.expires != "" {
+			headers.Set("Expires", test.expires)
+		}
+		var expiresIn = ResponseExpiresIn(headers, time.Hour)
+		if expiresIn < test.expected-time.Second || expiresIn > test.expected {
+			t.Errorf("Expected %+v to expire in %s but got %s", test, test.expected, expiresIn)
+		}
+	}
+}
+
+func TestResponseStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	for cacheControl, expected := range map[string]int64{
+		"":                                      0,
+		"max-age=30":                            0,
+		"max-age=30, stale-while-revalidate=60": 60,
+		"stale-while-revalidate=0":              0,
+		"max-age=30, stale-while-revalidate=broke": 0,
+		"no-cache, stale-while-revalidate=60":      0,
+	} {
+		var headers = http.Header{"Cache-Control": []string{cacheControl}}
+		if got := ResponseStaleWhileRevalidate(headers); got != expected {
+			t.Errorf("Expected %d for %q but got %d", expected, cacheControl, got)
+		}
+	}
+}
+
+func TestResponseIsImmutable(t *testing.T) {
+	t.Parallel()
+	for cacheControl, expected := range map[string]bool{
+		"":                         false,
+		"max-age=3600":             false,
+		"max-age=3600, immutable":  true,
+		"public,Immutable":         true,
+		`no-cache="immutable-ish"`: false,
+	} {
+		var headers = http.Header{"Cache-Control": []string{cacheControl}}
+		if got := ResponseIsImmutable(headers); got != expected {
+			t.Errorf("Expected %t for %q but got %t", expected, cacheControl, got)
+		}
+	}
+}
+
+func TestResponseAge(t *testing.T) {
+	t.Parallel()
+	for age, expected := range map[string]int64{
+		"":      0,
+		"0":     0,
+		"120":   120,
+		" 42 ":  42,
+		"-5":    0,
+		"1.5":   0,
+		"never": 0,
+	} {
+		var headers = http.Header{"Age": []string{age}}
+		if got := ResponseAge(headers); got != expected {
+			t.Errorf("Expected %d for %q but got %d", expected, age, got)
+		}
+	}
+}
+
+func TestAuthorizedResponseIsShareable(t *testing.T) {
+	t.Parallel()
+	for cacheControl, expected := range map[string]bool{
+		"":                            false,
+		"max-age=60":                  false,
+		"public, max-age=60":          true,
+		"s-maxage=60":                 true,
+		"max-age=60, must-revalidate": true,
+		"private, max-age=60":         false,
+	} {
+		var headers = http.Header{"Cache-Control": {cacheControl}}
+		if got := AuthorizedResponseIsShareable(headers); got != expected {
+			t.Errorf("Expected %t for '%s' but got %t", expected, cacheControl, got)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package cacheutils
+
+import (
+	"math"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// maxPendingSizes is the number of the objects without parts in the cache
+// whose sizes are kept until their first part is added. The objects whose
+// parts are never added, e.g. the empty ones, must not fill the memory.
+const maxPendingSizes = 1024
+
+// ObjectSizes keeps the sizes of the objects which have parts in a cache
+// algorithm and computes from them the eviction weights of the parts. The
+// weight of a part is the number of parts of its object raised to the power
+// of the eviction size bias, so with a positive bias the parts of the large
+// objects are evicted earlier and with a negative one they are protected.
+// It also counts the bytes of all parts in the cache, see Bytes.
+// It is not safe for concurrent use.
+type ObjectSizes struct {
+	partSize types.BytesSize
+	bias     float64
+	objects  map[types.ObjectIDHash]*objectSize
+	pending  map[types.ObjectIDHash]uint64
+	bytes    uint64
+}
+
+type objectSize struct {
+	size  uint64
+	known bool
+	parts int
+	// the bytes of the parts of the object which are in the cache
+	bytes uint64
+}
+
+// NewObjectSizes returns ObjectSizes for the supplied part size and eviction
+// size bias.
+func NewObjectSizes(partSize types.BytesSize, bias float64) *ObjectSizes {
+	return &ObjectSizes{
+		partSize: partSize,
+		bias:     bias,
+		objects:  make(map[types.ObjectIDHash]*objectSize),
+		pending:  make(map[types.ObjectIDHash]uint64),
+	}
+}
+
+// Enabled returns whether the sizes of the objects change the eviction order.
+// All weights are 1 when it is false.
+func (s *ObjectSizes) Enabled() bool {
+	return s.bias != 0
+}
+
+// Set records the size of the object and returns whether the weights of its
+// parts have changed. The sizes of the objects without parts in the cache are
+// kept until their first part is added, as the metadata of an object is
+// usually saved before its parts, but only for the last maxPendingSizes of
+// them.
+func (s *ObjectSizes) Set(id *types.ObjectID, size uint64) bool {
+	var hash = id.Hash()
+	if obj, ok := s.objects[hash]; ok {
+		var changed = !obj.known || obj.size != size
+		obj.size, obj.known = size, true
+		return changed && s.Enabled()
+	}
+	var old, ok = s.pending[hash]
+	if !ok && len(s.pending) >= maxPendingSizes {
+		s.pending = make(map[types.ObjectIDHash]uint64)
+	}
+	s.pending[hash] = size
+	return (!ok || old != size) && s.Enabled()
+}
+
+// AddPart records that a part of the object is in the cache.
+func (s *ObjectSizes) AddPart(oi *types.ObjectIndex) {
+	var hash = oi.ObjID.Hash()
+	var obj, ok = s.objects[hash]
+	if !ok {
+		obj = new(objectSize)
+		if size, known := s.pending[hash]; known {
+			obj.size, obj.known = size, true
+			delete(s.pending, hash)
+		}
+		s.objects[hash] = obj
+	}
+	var bytes = s.PartBytes(oi)
+	obj.parts++
+	obj.bytes += bytes
+	s.bytes += bytes
+}
+
+// RemovePart records that a part of the object has left the cache. The size
+// of the object is forgotten with its last part.
+func (s *ObjectSizes) RemovePart(oi *types.ObjectIndex) {
+	var obj, ok = s.objects[oi.ObjID.Hash()]
+	if !ok {
+		return
+	}
+	// the size of the object may have changed since the part was added, so
+	// all of its counted bytes are removed with its last part
+	var bytes = s.PartBytes(oi)
+	if obj.parts--; obj.parts <= 0 || bytes > obj.bytes {
+		bytes = obj.bytes
+	}
+	obj.bytes -= bytes
+	s.bytes -= bytes
+	if obj.parts <= 0 {
+		delete(s.objects, oi.ObjID.Hash())
+	}
+}
+
+// PartBytes returns the size of the part. It is the part size unless the
+// part is the last one of an object with a known size.
+func (s *ObjectSizes) PartBytes(oi *types.ObjectIndex) uint64 {
+	var partSize = uint64(s.partSize)
+	var size, known = s.size(oi.ObjID)
+	if !known {
+		return partSize
+	}
+	var start = uint64(oi.Part) * partSize
+	if start < size && size-start < partSize {
+		return size - start
+	}
+	return partSize
+}
+
+// size returns the recorded size of the object and whether it is known.
+func (s *ObjectSizes) size(id *types.ObjectID) (uint64, bool) {
+	if obj, ok := s.objects[id.Hash()]; ok {
+		return obj.size, obj.known
+	}
+	var size, ok = s.pending[id.Hash()]
+	return size, ok
+}
+
+// Bytes returns the total size of the parts in the cache.
+func (s *ObjectSizes) Bytes() uint64 {
+	return s.bytes
+}
+
+// Parts returns the number of parts of the object with the given ID according
+// to its recorded size or 0 if its size is not known.
+func (s *ObjectSizes) Parts(id *types.ObjectID) uint64 {
+	var size, known = s.size(id)
+	if !known {
+		return 0
+	}
+	return (size + uint64(s.partSize) - 1) / uint64(s.partSize)
+}
+
+// Weight returns the eviction weight of the part. The parts with larger
+// weights should be evicted earlier. It is 1 for the parts of objects with
+// unknown sizes.
+func (s *ObjectSizes) Weight(oi *types.ObjectIndex) float64 {
+	var parts = s.Parts(oi.ObjID)
+	if !s.Enabled() || parts <= 1 {
+		return 1
+	}
+	return math.Pow(float64(parts), s.bias)
+}
@@ -0,0 +1,112 @@
+package cacheutils
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestObjectSizes(t *testing.T) {
+	t.Parallel()
+	var id = types.NewObjectID("key", "/path")
+	var part = func(n uint32) *types.ObjectIndex {
+		return &types.ObjectIndex{ObjID: id, Part: n}
+	}
+
+	var disabled = NewObjectSizes(10, 0)
+	if disabled.Set(id, 100) || disabled.Weight(part(0)) != 1 {
+		t.Error("Expected the sizes to be ignored without a bias")
+	}
+
+	var sizes = NewObjectSizes(10, 0.5)
+	if w := sizes.Weight(part(0)); w != 1 {
+		t.Errorf("Expected weight 1 for an unknown object but got %g", w)
+	}
+	if !sizes.Set(id, 85) || sizes.Set(id, 85) {
+		t.Error("Expected Set to report only the changes of the size")
+	}
+	if parts := sizes.Parts(id); parts != 9 {
+		t.Errorf("Expected 9 parts but got %d", parts)
+	}
+	if w := sizes.Weight(part(0)); w != 3 {
+		t.Errorf("Expected weight 3 but got %g", w)
+	}
+
+	sizes.AddPart(part(0))
+	sizes.AddPart(part(1))
+	sizes.RemovePart(part(0))
+	if parts := sizes.Parts(id); parts != 9 {
+		t.Errorf("Expected the size to be kept while the object has parts but got %d parts", parts)
+	}
+	sizes.RemovePart(part(1))
+	if parts := sizes.Parts(id); parts != 0 {
+		t.Errorf("Expected the size to be forgotten with the last part but got %d parts", parts)
+	}
+
+	var protecting = NewObjectSizes(10, -1)
+	protecting.Set(id, 40)
+	if w := protecting.Weight(part(0)); math.Abs(w-0.25) > 1e-9 {
+		t.Errorf("Expected weight 0.25 but got %g", w)
+	}
+}
+
+func TestObjectSizesBytes(t *testing.T) {
+	t.Parallel()
+	var id = types.NewObjectID("key", "/path")
+	var part = func(n uint32) *types.ObjectIndex {
+		return &types.ObjectIndex{ObjID: id, Part: n}
+	}
+
+	var sizes = NewObjectSizes(10, 0)
+	sizes.AddPart(part(0))
+	if bytes := sizes.Bytes(); bytes != 10 {
+		t.Errorf("Expected a part of an unknown object to be counted whole but got %d", bytes)
+	}
+	sizes.Set(id, 25)
+	if bytes := sizes.PartBytes(part(2)); bytes != 5 {
+		t.Errorf("Expected the last part to have 5 bytes but got %d", bytes)
+	}
+	sizes.AddPart(part(1))
+	sizes.AddPart(part(2))
+	if bytes := sizes.Bytes(); bytes != 25 {
+		t.Errorf("Expected 25 bytes but got %d", bytes)
+	}
+
+	// the changed size does not leave bytes behind
+	sizes.Set(id, 12)
+	sizes.RemovePart(part(0))
+	sizes.RemovePart(part(2))
+	if bytes := sizes.Bytes(); bytes != 5 {
+		t.Errorf("Expected 5 bytes but got %d", bytes)
+	}
+	sizes.RemovePart(part(1))
+	if bytes := sizes.Bytes(); bytes != 0 {
+		t.Errorf("Expected no bytes without parts but got %d", bytes)
+	}
+}
+
+func TestObjectSizesWithoutParts(t *testing.T) {
+	t.Parallel()
+	var sizes = NewObjectSizes(10, 0)
+	var first = types.NewObjectID("key", "/first")
+	sizes.Set(first, 5)
+	for i := 0; i < maxPendingSizes*3; i++ {
+		sizes.Set(types.NewObjectID("key", fmt.Sprintf("/empty/%d", i)), 0)
+	}
+	if len(sizes.pending) > maxPendingSizes || len(sizes.objects) != 0 {
+		t.Errorf("Expected at most %d sizes of objects without parts but got %d and %d",
+			maxPendingSizes, len(sizes.pending), len(sizes.objects))
+	}
+	if parts := sizes.Parts(first); parts != 0 {
+		t.Errorf("Expected the size of an old object without parts to be forgotten but got %d parts", parts)
+	}
+
+	var id = types.NewObjectID("key", "/path")
+	sizes.Set(id, 25)
+	sizes.AddPart(&types.ObjectIndex{ObjID: id, Part: 2})
+	if bytes := sizes.Bytes(); bytes != 5 {
+		t.Errorf("Expected the size set before the first part to be used but got %d bytes", bytes)
+	}
+}
@@ -0,0 +1,134 @@
+package cacheutils
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The warn-codes which a cache adds to the responses it serves stale, as
+// described in https://tools.ietf.org/html/rfc7234#section-5.5
+const (
+	WarningResponseIsStale       = 110
+	WarningRevalidationFailed    = 111
+	WarningDisconnectedOperation = 112
+)
+
+// warningAgent is the warn-agent used for the warnings added by nedomi
+const warningAgent = "nedomi"
+
+var warningTexts = map[int]string{
+	WarningResponseIsStale:       "Response is Stale",
+	WarningRevalidationFailed:    "Revalidation Failed",
+	WarningDisconnectedOperation: "Disconnected Operation",
+}
+
+// warning is a single warning-value of a Warning header.
+type warning struct {
+	code int
+	raw  string
+	date string
+}
+
+// AddWarning adds a Warning with the provided code to the headers.
+func AddWarning(headers http.Header, code int) {
+	var text, ok = warningTexts[code]
+	if !ok {
+		text = "Miscellaneous Warning"
+	}
+	headers.Add("Warning", fmt.Sprintf("%03d %s %q", code, warningAgent, text))
+}
+
+// RemoveOutdatedWarnings removes the warnings which must not be sent with a
+// stored response once it has been validated or served fresh. These are all
+// the warnings with 1xx codes, as they describe the freshness of the response
+// at the time it was received, and the ones whose warn-date does not match the
+// Date of the response.
+func RemoveOutdatedWarnings(headers http.Header) {
+	var values = headers["Warning"]
+	if len(values) == 0 {
+		return
+	}
+	var date = headers.Get("Date")
+	var kept []string
+	for _, value := range values {
+		for _, w := range parseWarnings(value) {
+			if w.code >= 100 && w.code < 200 {
+				continue
+			}
+			if w.date != "" && date != "" && !sameHTTPDate(w.date, date) {
+				continue
+			}
+			kept = append(kept, w.raw)
+		}
+	}
+	if len(kept) == 0 {
+		headers.Del("Warning")
+		return
+	}
+	headers["Warning"] = kept
+}
+
+// parseWarnings splits a Warning header value into its warning-values. Values
+// which can not be parsed are kept with a zero code.
+func parseWarnings(value string) []warning {
+	var result []warning
+	var inQuotes, escaped bool
+	var start int
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) {
+			switch c := value[i]; {
+			case escaped:
+				escaped = false
+				continue
+			case c == '\\' && inQuotes:
+				escaped = true
+				continue
+			case c == '"':
+				inQuotes = !inQuotes
+				continue
+			case c != ',' || inQuotes:
+				continue
+			}
+		}
+		if raw := strings.TrimSpace(value[start:i]); raw != "" {
+			result = append(result, parseWarning(raw))
+		}
+		start = i + 1
+	}
+	return result
+}
+
+func parseWarning(raw string) warning {
+	var w = warning{raw: raw}
+	var fields = strings.SplitN(raw, " ", 3)
+	if len(fields) != 3 {
+		return w
+	}
+	w.code, _ = strconv.Atoi(fields[0])
+	// the warn-date is the optional quoted string after the warn-text
+	var rest = fields[2]
+	if len(rest) < 2 || rest[0] != '"' {
+		return w
+	}
+	for i := 1; i < len(rest); i++ {
+		if rest[i] == '\\' {
+			i++
+		} else if rest[i] == '"' {
+			w.date = strings.Trim(strings.TrimSpace(rest[i+1:]), `"`)
+			break
+		}
+	}
+	return w
+}
+
+func sameHTTPDate(a, b string) bool {
+	ta, errA := http.ParseTime(a)
+	tb, errB := http.ParseTime(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return ta.Truncate(time.Second).Equal(tb.Truncate(time.Second))
+}
@@ -0,0 +1,60 @@
+package cacheutils
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestAddWarning(t *testing.T) {
+	t.Parallel()
+	var headers = http.Header{}
+	AddWarning(headers, WarningResponseIsStale)
+	AddWarning(headers, WarningDisconnectedOperation)
+	var expected = []string{
+		`110 nedomi "Response is Stale"`,
+		`112 nedomi "Disconnected Operation"`,
+	}
+	if !reflect.DeepEqual(headers["Warning"], expected) {
+		t.Errorf("Expected warnings %q but got %q", expected, headers["Warning"])
+	}
+}
+
+func TestRemoveOutdatedWarnings(t *testing.T) {
+	t.Parallel()
+	const date = "Sun, 06 Nov 1994 08:49:37 GMT"
+	for _, test := range []struct {
+		warnings []string
+		expected []string
+	}{
+		{
+			warnings: nil,
+			expected: nil,
+		},
+		{
+			warnings: []string{`110 - "Response is Stale"`},
+			expected: nil,
+		},
+		{
+			warnings: []string{`110 - "Response is Stale", 214 proxy "Transformation, Applied"`},
+			expected: []string{`214 proxy "Transformation, Applied"`},
+		},
+		{
+			warnings: []string{
+				`299 - "Misc \"persistent\"" "` + date + `"`,
+				`299 - "Misc" "Sun, 06 Nov 1994 08:49:38 GMT"`,
+				`112 - "Disconnected Operation"`,
+			},
+			expected: []string{`299 - "Misc \"persistent\"" "` + date + `"`},
+		},
+	} {
+		var headers = http.Header{"Date": []string{date}}
+		if test.warnings != nil {
+			headers["Warning"] = test.warnings
+		}
+		RemoveOutdatedWarnings(headers)
+		if !reflect.DeepEqual(headers["Warning"], test.expected) {
+			t.Errorf("For %q expected %q but got %q", test.warnings, test.expected, headers["Warning"])
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package httputils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// PreferredEncoding returns the one of the supported content encodings with
+// the highest quality in the Accept-Encoding header or an empty string if
+// none of them is acceptable. Encodings with equal quality are preferred in
+// the order in which they are supported.
+func PreferredEncoding(acceptEncoding string, supported ...string) string {
+	var qualities = make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		var params = strings.Split(part, ";")
+		var coding = strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		var q = 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	var best string
+	var bestQ float64
+	for _, coding := range supported {
+		q, ok := qualities[coding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,23 @@
+package httputils
+
+import "testing"
+
+func TestPreferredEncoding(t *testing.T) {
+	t.Parallel()
+	for header, expected := range map[string]string{
+		"":                        "",
+		"identity":                "",
+		"gzip":                    "gzip",
+		"x-gzip":                  "gzip",
+		"GZIP;q=0.5, deflate":     "deflate",
+		"deflate, gzip":           "gzip",
+		"*;q=0":                   "",
+		"*, gzip;q=0":             "deflate",
+		"gzip;q=0, deflate;q=0.0": "",
+		"br, gzip":                "gzip",
+	} {
+		if got := PreferredEncoding(header, "gzip", "deflate"); got != expected {
+			t.Errorf("Expected %q for %q but got %q", expected, header, got)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package httputils
+
+import "strings"
+
+// ETagMatches reports whether the entity tag matches any of the entity tags
+// in list, which is the value of a header like If-None-Match, If-Match or
+// If-Range. "*" matches any tag. With weak comparison the W/ prefix is
+// ignored, with strong comparison weak tags never match, as per RFC 7232
+// section 2.3.2.
+func ETagMatches(list, etag string, weak bool) bool {
+	// "*" matches any current representation, even one without an ETag
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		if eTagsEqual(strings.TrimSpace(candidate), etag, weak) {
+			return true
+		}
+	}
+	return false
+}
+
+func eTagsEqual(a, b string, weak bool) bool {
+	if weak {
+		return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+	}
+	return a == b && !strings.HasPrefix(a, "W/")
+}
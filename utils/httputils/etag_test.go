@@ -0,0 +1,33 @@
+package httputils
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		list, etag   string
+		weak, strong bool
+	}{
+		{list: `"a"`, etag: `"a"`, weak: true, strong: true},
+		{list: `"a"`, etag: `"b"`, weak: false, strong: false},
+		{list: `W/"a"`, etag: `"a"`, weak: true, strong: false},
+		{list: `"a"`, etag: `W/"a"`, weak: true, strong: false},
+		{list: `W/"a"`, etag: `W/"a"`, weak: true, strong: false},
+		{list: `"b", W/"a" ,"c"`, etag: `"a"`, weak: true, strong: false},
+		{list: `"b", "a"`, etag: `"a"`, weak: true, strong: true},
+		{list: `*`, etag: `"a"`, weak: true, strong: true},
+		{list: ` * `, etag: `W/"a"`, weak: true, strong: true},
+		{list: `*`, etag: ``, weak: true, strong: true},
+		{list: `"a"`, etag: ``, weak: false, strong: false},
+		{list: ``, etag: ``, weak: false, strong: false},
+		{list: `"a"`, etag: `"A"`, weak: false, strong: false},
+	}
+	for _, test := range tests {
+		if got := ETagMatches(test.list, test.etag, true); got != test.weak {
+			t.Errorf("Expected weak comparison of %s with %s to be %t", test.list, test.etag, test.weak)
+		}
+		if got := ETagMatches(test.list, test.etag, false); got != test.strong {
+			t.Errorf("Expected strong comparison of %s with %s to be %t", test.list, test.etag, test.strong)
+		}
+	}
+}
@@ -16,6 +16,13 @@ type FlexibleResponseWriter struct {
 	BodyWriter  io.WriteCloser
 	hook        func(*FlexibleResponseWriter)
 	wroteHeader bool
+	abortErr    error
+}
+
+// Aborter is implemented by response writers which should be notified when
+// the body of the response could not be written completely.
+type Aborter interface {
+	Abort(err error)
 }
 
 // NewFlexibleResponseWriter returns an initialized FlexibleResponseWriter.
@@ -66,6 +73,18 @@ func (frw *FlexibleResponseWriter) Close() error {
 	return frw.BodyWriter.Close()
 }
 
+// Abort records that the body of the response could not be written completely
+// because of the provided error.
+func (frw *FlexibleResponseWriter) Abort(err error) {
+	frw.abortErr = err
+}
+
+// Aborted returns the error with which the response was aborted or nil if it
+// was not.
+func (frw *FlexibleResponseWriter) Aborted() error {
+	return frw.abortErr
+}
+
 // ReadFrom uses io.Copy with the BoduWriter if available after writing headers and checking that the writer is set
 func (frw *FlexibleResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	if !frw.wroteHeader {
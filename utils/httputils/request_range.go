@@ -38,6 +38,7 @@ func ParseRequestRange(s string, size uint64) ([]Range, error) {
 		return nil, errors.New("invalid range")
 	}
 	var ranges []Range
+	var noOverlap bool
 	for _, ra := range strings.Split(s[len(b):], ",") {
 		ra = strings.TrimSpace(ra)
 		if ra == "" {
@@ -49,17 +50,27 @@ func ParseRequestRange(s string, size uint64) ([]Range, error) {
 		}
 		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
 		r, err := parseReqByteRange(start, end, size)
-		if err != nil {
+		if err == errNoOverlap {
+			// the ranges which start after the end are ignored as long as
+			// some of the others can be satisfied
+			noOverlap = true
+			continue
+		} else if err != nil {
 			return nil, err
 		}
 		ranges = append(ranges, *r)
 	}
 	if len(ranges) < 1 {
+		if noOverlap {
+			return nil, errNoOverlap
+		}
 		return nil, errors.New("invalid range")
 	}
 	return ranges, nil
 }
 
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
 // parseReqByteRange parses a byte range as per RFC 7233, section 2.1.
 func parseReqByteRange(start, end string, size uint64) (*Range, error) {
 	if start == "" {
@@ -69,9 +80,12 @@ func parseReqByteRange(start, end string, size uint64) (*Range, error) {
 	}
 
 	si, err := strconv.ParseUint(start, 10, 64)
-	if err != nil || si >= size {
+	if err != nil {
 		return nil, errors.New("invalid range")
 	}
+	if si >= size {
+		return nil, errNoOverlap
+	}
 	if end == "" {
 		// If no end is specified, range extends to end of the file.
 		return &Range{Start: si, Length: size - si}, nil
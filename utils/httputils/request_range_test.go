@@ -63,6 +63,10 @@ var reqRangeTests = []reqRangeTest{
 	{r: "bytes=12-100", size: 11, expErr: true},
 	{r: "bytes=100-", size: 11, expErr: true},
 	{r: "bytes=100-1000", size: 11, expErr: true},
+	{r: "bytes=0-1,100-", size: 11, expRanges: []Range{{0, 2}}},
+	{r: "bytes=11-,-2", size: 11, expRanges: []Range{{9, 2}}},
+	{r: "bytes=11-,100-", size: 11, expErr: true},
+	{r: "bytes=100-,a-", size: 11, expErr: true},
 }
 
 func testReverse(t *testing.T, test reqRangeTest, ranges []Range) {
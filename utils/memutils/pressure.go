@@ -0,0 +1,217 @@
+// Package memutils contains utilities for observing the memory usage of the
+// running process so the application can degrade gracefully before it runs
+// out of memory.
+package memutils
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCheckInterval is the time between the memory checks when no other
+// is configured.
+const DefaultCheckInterval = time.Second
+
+// UsageFunc returns the amount of memory currently used by the process and
+// the limit it is expected to stay under. A zero limit means it is unknown.
+type UsageFunc func() (used, limit uint64)
+
+// Monitor keeps track of the memory usage of the process and reports whether
+// it is under memory pressure. It uses two thresholds so that it does not
+// flip between states on every check.
+type Monitor struct {
+	sync.RWMutex
+	usage            UsageFunc
+	limit            uint64
+	threshold        float64
+	recoverThreshold float64
+	interval         time.Duration
+	intervalChanged  chan struct{}
+
+	used         uint64
+	currentLimit uint64
+	degraded     bool
+}
+
+// NewMonitor returns a monitor which uses the provided usage function to get
+// the memory usage. If limit is not zero it overrides the limit returned by the
+// usage function. The monitor becomes degraded when the usage reaches
+// threshold*limit and recovers when it drops below recoverThreshold*limit.
+// A threshold of zero disables the monitor. The usage is checked every
+// DefaultCheckInterval until the config is changed.
+func NewMonitor(usage UsageFunc, limit uint64, threshold, recoverThreshold float64) *Monitor {
+	m := &Monitor{
+		usage:           usage,
+		interval:        DefaultCheckInterval,
+		intervalChanged: make(chan struct{}, 1),
+	}
+	m.ChangeConfig(limit, threshold, recoverThreshold, 0)
+	return m
+}
+
+// ChangeConfig changes the limit, thresholds and check interval of the
+// monitor. A zero interval means DefaultCheckInterval. The new values are used
+// from the next check onwards.
+func (m *Monitor) ChangeConfig(limit uint64, threshold, recoverThreshold float64, interval time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if recoverThreshold <= 0 || recoverThreshold > threshold {
+		recoverThreshold = threshold
+	}
+	m.limit = limit
+	m.threshold = threshold
+	m.recoverThreshold = recoverThreshold
+	if threshold <= 0 {
+		m.degraded = false
+	}
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	if interval != m.interval {
+		m.interval = interval
+		select { // Run is already notified if the channel is full
+		case m.intervalChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *Monitor) checkInterval() time.Duration {
+	m.RLock()
+	defer m.RUnlock()
+	return m.interval
+}
+
+// SetUsageFunc replaces the function used for getting the memory usage.
+func (m *Monitor) SetUsageFunc(usage UsageFunc) {
+	m.Lock()
+	defer m.Unlock()
+	m.usage = usage
+}
+
+// Check samples the memory usage, updates the state of the monitor and
+// returns whether it is degraded.
+func (m *Monitor) Check() bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.usage == nil {
+		return m.degraded
+	}
+	used, limit := m.usage()
+	if m.limit != 0 {
+		limit = m.limit
+	}
+	m.used, m.currentLimit = used, limit
+	if m.threshold <= 0 || limit == 0 {
+		m.degraded = false
+		return m.degraded
+	}
+
+	var ratio = float64(used) / float64(limit)
+	if m.degraded {
+		m.degraded = ratio >= m.recoverThreshold
+	} else {
+		m.degraded = ratio >= m.threshold
+	}
+	return m.degraded
+}
+
+// Run checks the memory usage every check interval until the context is
+// cancelled. The ticker is reset when the interval is changed.
+func (m *Monitor) Run(ctx context.Context) {
+	var ticker = time.NewTicker(m.checkInterval())
+	defer ticker.Stop()
+	for {
+		m.Check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.intervalChanged:
+			ticker.Reset(m.checkInterval())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Degraded returns whether the process was under memory pressure on the last
+// check.
+func (m *Monitor) Degraded() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.degraded
+}
+
+// Stats returns the memory usage and limit from the last check as well as
+// whether the monitor is degraded.
+func (m *Monitor) Stats() (used, limit uint64, degraded bool) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.used, m.currentLimit, m.degraded
+}
+
+// RuntimeUsage is an UsageFunc that returns the memory obtained from the OS by
+// the Go runtime (minus the released heap) and the cgroup memory limit.
+func RuntimeUsage() (used, limit uint64) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Sys - ms.HeapReleased, CgroupLimit()
+}
+
+// cgroupLimitFiles are the files that may contain the memory limit of the
+// cgroup the process is in (v2 and v1 respectively).
+var cgroupLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// CgroupLimit returns the memory limit of the cgroup the process is in. If no
+// limit is set or it can not be read, zero is returned.
+func CgroupLimit() uint64 {
+	for _, file := range cgroupLimitFiles {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		limit, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+		if err != nil { // "max" for cgroups v2
+			continue
+		}
+		if total := totalMemory(); total != 0 && limit >= total {
+			// cgroups v1 reports a huge number when there is no limit
+			continue
+		}
+		return limit
+	}
+	return 0
+}
+
+// totalMemory returns the total memory of the machine as found in
+// /proc/meminfo or zero if it can't be read.
+func totalMemory() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		var fields = strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
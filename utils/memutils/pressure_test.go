@@ -0,0 +1,79 @@
+package memutils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMonitorDegradesAndRecovers(t *testing.T) {
+	t.Parallel()
+	var used uint64
+	m := NewMonitor(func() (uint64, uint64) { return used, 1000 }, 0, 0.9, 0.7)
+
+	for _, test := range []struct {
+		used     uint64
+		degraded bool
+	}{
+		{used: 100, degraded: false},
+		{used: 899, degraded: false},
+		{used: 900, degraded: true},
+		{used: 800, degraded: true},
+		{used: 700, degraded: true},
+		{used: 699, degraded: false},
+		{used: 850, degraded: false},
+	} {
+		used = test.used
+		if got := m.Check(); got != test.degraded {
+			t.Errorf("with usage %d expected degraded to be %t but got %t",
+				test.used, test.degraded, got)
+		}
+		if m.Degraded() != test.degraded {
+			t.Errorf("Degraded() with usage %d is not %t", test.used, test.degraded)
+		}
+	}
+
+	if u, l, _ := m.Stats(); u != 850 || l != 1000 {
+		t.Errorf("expected stats 850/1000 but got %d/%d", u, l)
+	}
+}
+
+func TestMonitorLimitOverride(t *testing.T) {
+	t.Parallel()
+	m := NewMonitor(func() (uint64, uint64) { return 600, 0 }, 1000, 0.5, 0)
+	if !m.Check() {
+		t.Error("expected the monitor to use the configured limit and degrade")
+	}
+
+	m.ChangeConfig(1000, 0, 0, 0)
+	if m.Check() {
+		t.Error("a disabled monitor should never be degraded")
+	}
+}
+
+func TestMonitorIntervalChange(t *testing.T) {
+	t.Parallel()
+	var checks = make(chan struct{}, 10)
+	m := NewMonitor(func() (uint64, uint64) {
+		select {
+		case checks <- struct{}{}:
+		default:
+		}
+		return 0, 1000
+	}, 0, 0.9, 0)
+	m.ChangeConfig(0, 0.9, 0, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	<-checks // the first check is right away
+
+	m.ChangeConfig(0, 0.9, 0, time.Millisecond)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-checks:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the monitor did not start using the new check interval")
+		}
+	}
+}
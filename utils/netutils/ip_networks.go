@@ -0,0 +1,54 @@
+package netutils
+
+import (
+	"fmt"
+	"net"
+)
+
+// IPNetworks is a list of IP networks, e.g. the clients which are trusted.
+type IPNetworks []*net.IPNet
+
+// ParseIPNetworks parses a list of IP addresses and CIDR networks. An
+// address is the network which contains only it.
+func ParseIPNetworks(networks []string) (IPNetworks, error) {
+	var result = make(IPNetworks, 0, len(networks))
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			var ip = net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or network `%s`", network)
+			}
+			var bits = 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// Contains returns whether the ip is in any of the networks.
+func (n IPNetworks) Contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsRemoteAddr returns whether the host of the remote address of a
+// request, as in http.Request.RemoteAddr, is in any of the networks. Only
+// the address of the connection should be checked as the headers with
+// forwarded addresses can be forged.
+func (n IPNetworks) ContainsRemoteAddr(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	var ip = net.ParseIP(host)
+	return ip != nil && n.Contains(ip)
+}
@@ -0,0 +1,65 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate of operations and of the bytes which they transfer.
+// Every call to Wait is scheduled after the previous ones so that the
+// configured rates are never exceeded on average. It is safe for concurrent
+// use. A nil *Limiter does not limit anything.
+type Limiter struct {
+	sync.Mutex
+	bytesPerSecond, opsPerSecond float64
+	next                         time.Time
+	now                          func() time.Time
+	sleep                        func(time.Duration)
+}
+
+// NewLimiter returns a Limiter allowing at most bytesPerSecond bytes and
+// opsPerSecond operations per second. A zero rate is not limited. If both of
+// the rates are zero nil is returned.
+func NewLimiter(bytesPerSecond, opsPerSecond uint64) *Limiter {
+	if bytesPerSecond == 0 && opsPerSecond == 0 {
+		return nil
+	}
+	return &Limiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		opsPerSecond:   float64(opsPerSecond),
+		now:            time.Now,
+		sleep:          sleepWithPooledTimer,
+	}
+}
+
+// Wait blocks until the provided number of operations transferring the
+// provided number of bytes may be done without exceeding the rates.
+func (l *Limiter) Wait(ops, bytes int64) {
+	if l == nil {
+		return
+	}
+	var wait = l.reserve(ops, bytes)
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+func (l *Limiter) reserve(ops, bytes int64) time.Duration {
+	var cost time.Duration
+	if l.opsPerSecond > 0 {
+		cost = time.Duration(float64(ops) / l.opsPerSecond * float64(time.Second))
+	}
+	if l.bytesPerSecond > 0 {
+		cost = maxDur(cost, time.Duration(float64(bytes)/l.bytesPerSecond*float64(time.Second)))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	var now = l.now()
+	var start = l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(cost)
+	return start.Sub(now)
+}
@@ -0,0 +1,59 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter(bytesPerSecond, opsPerSecond uint64) (*Limiter, *time.Duration) {
+	var l = NewLimiter(bytesPerSecond, opsPerSecond)
+	var start = time.Now()
+	var elapsed time.Duration
+	l.now = func() time.Time { return start.Add(elapsed) }
+	l.sleep = func(d time.Duration) { elapsed += d }
+	return l, &elapsed
+}
+
+func TestLimiterOps(t *testing.T) {
+	t.Parallel()
+	var l, elapsed = newTestLimiter(0, 10)
+	for i := 0; i < 21; i++ {
+		l.Wait(1, 1024*1024)
+	}
+	if *elapsed != 2*time.Second {
+		t.Errorf("21 operations at 10 ops/s took %s instead of 2s", *elapsed)
+	}
+}
+
+func TestLimiterBytes(t *testing.T) {
+	t.Parallel()
+	var l, elapsed = newTestLimiter(1000, 1000)
+	for i := 0; i < 5; i++ {
+		l.Wait(1, 500)
+	}
+	if *elapsed != 2*time.Second {
+		t.Errorf("2500 bytes at 1000 B/s took %s instead of 2s", *elapsed)
+	}
+}
+
+func TestLimiterIdleTimeIsNotAccumulated(t *testing.T) {
+	t.Parallel()
+	var l, elapsed = newTestLimiter(0, 10)
+	l.Wait(1, 0)
+	*elapsed += 10 * time.Second
+	var before = *elapsed
+	l.Wait(1, 0)
+	l.Wait(1, 0)
+	if *elapsed-before != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms after being idle but waited %s", *elapsed-before)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	t.Parallel()
+	var l = NewLimiter(0, 0)
+	if l != nil {
+		t.Fatal("expected a nil limiter without rates")
+	}
+	l.Wait(100, 100) // should not panic
+}